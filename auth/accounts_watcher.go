@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"kiro2api/logger"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// AccountsFilePattern 账户导出文件名模式（启动导入与热加载共用）
+const AccountsFilePattern = "kiro-accounts-*.json"
+
+// AccountsReloader 热加载需要的认证服务能力
+type AccountsReloader interface {
+	GetConfigs() []AuthConfig
+	ReloadTokens() error
+}
+
+// AccountsWatcher 监听账户文件变化，导入新账户后重载token池
+// 文件事件经过防抖合并：编辑器保存、批量复制等产生的连续事件只触发一次重载
+type AccountsWatcher struct {
+	dir        string
+	debounce   time.Duration
+	target     AccountsReloader
+	importFile func(path string) error
+	watcher    *fsnotify.Watcher
+	done       chan struct{}
+	stopOnce   sync.Once
+}
+
+// StartAccountsWatcher 监听 dir 下匹配 AccountsFilePattern 的文件
+func StartAccountsWatcher(dir string, debounce time.Duration, target AccountsReloader) (*AccountsWatcher, error) {
+	return startAccountsWatcher(dir, debounce, target, ImportAccounts)
+}
+
+func startAccountsWatcher(dir string, debounce time.Duration, target AccountsReloader, importFile func(string) error) (*AccountsWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("创建文件监听器失败: %w", err)
+	}
+	// 监听目录而非单个文件：新出现的账户文件与“写临时文件再重命名”的保存方式都能被捕获
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("监听目录失败: %w", err)
+	}
+
+	w := &AccountsWatcher{
+		dir:        dir,
+		debounce:   debounce,
+		target:     target,
+		importFile: importFile,
+		watcher:    watcher,
+		done:       make(chan struct{}),
+	}
+	go w.run()
+
+	logger.Info("账户文件热加载已启用",
+		logger.String("dir", dir),
+		logger.String("pattern", AccountsFilePattern),
+		logger.Duration("debounce", debounce))
+	return w, nil
+}
+
+// Stop 停止监听
+func (w *AccountsWatcher) Stop() {
+	if w == nil {
+		return
+	}
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.watcher.Close()
+	})
+}
+
+func (w *AccountsWatcher) run() {
+	var timer *time.Timer
+	var timerC <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-w.done:
+			return
+
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !isAccountsFileEvent(event) {
+				continue
+			}
+			logger.Debug("检测到账户文件变化",
+				logger.String("file", event.Name),
+				logger.String("op", event.Op.String()))
+			if timer == nil {
+				timer = time.NewTimer(w.debounce)
+			} else {
+				timer.Reset(w.debounce)
+			}
+			timerC = timer.C
+
+		case <-timerC:
+			timerC = nil
+			w.reload()
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Warn("账户文件监听出错", logger.Err(err))
+		}
+	}
+}
+
+// isAccountsFileEvent 仅关注账户文件的新增与写入（删除文件不会移除已导入的账户）
+func isAccountsFileEvent(event fsnotify.Event) bool {
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return false
+	}
+	matched, err := filepath.Match(AccountsFilePattern, filepath.Base(event.Name))
+	return err == nil && matched
+}
+
+// reload 重新导入全部账户文件并重载token池，输出新增/移除的账号数
+func (w *AccountsWatcher) reload() {
+	files, err := filepath.Glob(filepath.Join(w.dir, AccountsFilePattern))
+	if err != nil {
+		logger.Warn("扫描账户文件失败", logger.Err(err))
+		return
+	}
+	for _, file := range files {
+		if err := w.importFile(file); err != nil {
+			logger.Error("导入账户失败", logger.String("file", file), logger.Err(err))
+		}
+	}
+
+	before := refreshTokenSet(w.target.GetConfigs())
+	if err := w.target.ReloadTokens(); err != nil {
+		logger.Warn("账户文件变化后重载token失败", logger.Err(err))
+		return
+	}
+	after := refreshTokenSet(w.target.GetConfigs())
+
+	added, removed := 0, 0
+	for key := range after {
+		if !before[key] {
+			added++
+		}
+	}
+	for key := range before {
+		if !after[key] {
+			removed++
+		}
+	}
+	logger.Info("账户文件已热加载",
+		logger.Int("files", len(files)),
+		logger.Int("added", added),
+		logger.Int("removed", removed),
+		logger.Int("total", len(after)))
+}
+
+// refreshTokenSet 以 refreshToken 标识账号
+func refreshTokenSet(configs []AuthConfig) map[string]bool {
+	set := make(map[string]bool, len(configs))
+	for _, cfg := range configs {
+		if cfg.RefreshToken != "" {
+			set[cfg.RefreshToken] = true
+		}
+	}
+	return set
+}
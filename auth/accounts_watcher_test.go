@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAccountsReloader 记录重载次数，重载后返回预设的配置
+type fakeAccountsReloader struct {
+	mu      sync.Mutex
+	configs []AuthConfig
+	next    []AuthConfig
+	reloads int
+}
+
+func (f *fakeAccountsReloader) GetConfigs() []AuthConfig {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.configs
+}
+
+func (f *fakeAccountsReloader) ReloadTokens() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.configs = f.next
+	f.reloads++
+	return nil
+}
+
+func (f *fakeAccountsReloader) reloadCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.reloads
+}
+
+func TestAccountsWatcher_DebouncesAndImportsMatchingFiles(t *testing.T) {
+	dir := t.TempDir()
+	target := &fakeAccountsReloader{
+		configs: []AuthConfig{{RefreshToken: "a"}, {RefreshToken: "b"}},
+		next:    []AuthConfig{{RefreshToken: "b"}, {RefreshToken: "c"}, {RefreshToken: "d"}},
+	}
+
+	var mu sync.Mutex
+	var imported []string
+	importFile := func(path string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		imported = append(imported, filepath.Base(path))
+		return nil
+	}
+
+	w, err := startAccountsWatcher(dir, 100*time.Millisecond, target, importFile)
+	if err != nil {
+		t.Fatalf("startAccountsWatcher: %v", err)
+	}
+	defer w.Stop()
+
+	// 不匹配的文件不触发重载
+	if err := os.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// 连续多次写入只触发一次重载
+	path := filepath.Join(dir, "kiro-accounts-1.json")
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(path, []byte(`{"accounts":[]}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	for target.reloadCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	if got := target.reloadCount(); got != 1 {
+		t.Fatalf("reloads = %d, want 1", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(imported) != 1 || imported[0] != "kiro-accounts-1.json" {
+		t.Fatalf("imported = %v, want [kiro-accounts-1.json]", imported)
+	}
+}
+
+func TestAccountsWatcher_StopIsIdempotent(t *testing.T) {
+	w, err := startAccountsWatcher(t.TempDir(), time.Second, &fakeAccountsReloader{}, func(string) error { return nil })
+	if err != nil {
+		t.Fatalf("startAccountsWatcher: %v", err)
+	}
+	w.Stop()
+	w.Stop()
+}
+
+func TestAuthService_StopStopsAccountsWatcher(t *testing.T) {
+	as := &AuthService{}
+	if err := as.WatchAccounts(t.TempDir(), time.Second); err != nil {
+		t.Fatalf("WatchAccounts: %v", err)
+	}
+	w := as.accountsWatcher
+
+	as.Stop()
+	select {
+	case <-w.done:
+	default:
+		t.Fatal("AuthService.Stop 应停止账户文件监听")
+	}
+	if as.accountsWatcher != nil {
+		t.Error("停止后应清除监听器引用")
+	}
+}
+
+func TestRefreshTokenSet(t *testing.T) {
+	set := refreshTokenSet([]AuthConfig{{RefreshToken: "a"}, {RefreshToken: ""}, {RefreshToken: "a"}, {RefreshToken: "b"}})
+	if len(set) != 2 || !set["a"] || !set["b"] {
+		t.Fatalf("refreshTokenSet = %v, want {a, b}", set)
+	}
+}
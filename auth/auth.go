@@ -1,19 +1,22 @@
 package auth
 
 import (
+	"context"
 	"fmt"
 	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
 	"os"
 	"sync"
+	"time"
 )
 
 // AuthService 认证服务（推荐使用依赖注入方式）
 type AuthService struct {
-	tokenManager *TokenManager
-	configs      []AuthConfig
-	mu           sync.RWMutex
+	tokenManager    *TokenManager
+	configs         []AuthConfig
+	accountsWatcher *AccountsWatcher // 账户文件热加载（未启用时为 nil），随 Stop 停止
+	mu              sync.RWMutex
 }
 
 // 全局 AuthService 实例引用（用于 OAuth token 重载）
@@ -76,13 +79,16 @@ func NewAuthService() (*AuthService, error) {
 		logger.Info("TokenManager创建成功")
 
 		// 预热第一个可用token（可通过环境变量跳过，便于测试/离线环境）
-		if !shouldSkipTokenWarmup() {
+		// 启用 TOKEN_WARMUP_ENABLED 时由后台预热刷新全部账号，不再同步预热，避免每个账号刷新两次
+		if shouldSkipTokenWarmup() {
+			logger.Info("已跳过token预热（SKIP_TOKEN_WARMUP=true）")
+		} else if config.TokenWarmupEnabled {
+			logger.Info("后台预热已启用，跳过同步token预热")
+		} else {
 			_, warmupErr := tokenManager.getBestToken()
 			if warmupErr != nil {
 				logger.Warn("token预热失败", logger.Err(warmupErr))
 			}
-		} else {
-			logger.Info("已跳过token预热（SKIP_TOKEN_WARMUP=true）")
 		}
 	}
 
@@ -133,17 +139,116 @@ func (as *AuthService) GetTokenWithFingerprintForSessionAndModel(sessionID strin
 	return as.tokenManager.GetTokenWithFingerprintForSessionAndModel(sessionID, model)
 }
 
-// MarkTokenFailed 标记当前token请求失败
-func (as *AuthService) MarkTokenFailed() {
+// GetTokenWithFingerprintForSessionAndModelContext 同 GetTokenWithFingerprintForSessionAndModel，等待可用token时响应 ctx 取消
+func (as *AuthService) GetTokenWithFingerprintForSessionAndModelContext(ctx context.Context, sessionID string, model string) (types.TokenInfo, *Fingerprint, string, error) {
+	if as.tokenManager == nil {
+		return types.TokenInfo{}, nil, "", fmt.Errorf("token管理器未初始化")
+	}
+	return as.tokenManager.GetTokenWithFingerprintForSessionAndModelContext(ctx, sessionID, model)
+}
+
+// GetTokenWithFingerprintForIndex 直接使用指定配置索引的token（调试用）
+func (as *AuthService) GetTokenWithFingerprintForIndex(index int) (types.TokenInfo, *Fingerprint, string, error) {
+	if as.tokenManager == nil {
+		return types.TokenInfo{}, nil, "", fmt.Errorf("token管理器未初始化")
+	}
+	return as.tokenManager.GetTokenWithFingerprintForIndex(index)
+}
+
+// MarkTokenFailed 标记指定token请求失败（tokenKey 为空时使用当前token）
+// 并发请求下当前token可能已切换，调用方应传入失败请求所使用的 token_key
+func (as *AuthService) MarkTokenFailed(tokenKey string) {
 	if as.tokenManager == nil {
 		return
 	}
-	tokenKey := as.tokenManager.GetCurrentTokenKey()
+	if tokenKey == "" {
+		tokenKey = as.tokenManager.GetCurrentTokenKey()
+	}
 	if tokenKey != "" {
 		as.tokenManager.MarkTokenFailed(tokenKey)
 	}
 }
 
+// MarkTokenSucceeded 标记指定token请求成功（tokenKey 为空时使用当前token）
+func (as *AuthService) MarkTokenSucceeded(tokenKey string) {
+	if as.tokenManager == nil {
+		return
+	}
+	if tokenKey == "" {
+		tokenKey = as.tokenManager.GetCurrentTokenKey()
+	}
+	if tokenKey != "" {
+		as.tokenManager.MarkTokenSuccess(tokenKey)
+	}
+}
+
+// RecordTokenError 记录指定token的上游服务端错误（计入熔断，tokenKey 为空时使用当前token）
+func (as *AuthService) RecordTokenError(tokenKey string) {
+	if as.tokenManager == nil {
+		return
+	}
+	if tokenKey == "" {
+		tokenKey = as.tokenManager.GetCurrentTokenKey()
+	}
+	if tokenKey != "" {
+		as.tokenManager.RecordTokenError(tokenKey)
+	}
+}
+
+// GetCircuitBreakerStatus 获取指定token的熔断状态
+func (as *AuthService) GetCircuitBreakerStatus(tokenKey string) CircuitBreakerStatus {
+	if as.tokenManager == nil {
+		return CircuitBreakerStatus{State: CircuitClosed}
+	}
+	return as.tokenManager.GetCircuitBreakerStatus(tokenKey)
+}
+
+// GetTokenUsageHistory 获取指定配置索引的可用额度历史（从旧到新），索引无效时 ok 为 false
+func (as *AuthService) GetTokenUsageHistory(index int) ([]UsageSnapshot, bool) {
+	if as.tokenManager == nil {
+		return nil, false
+	}
+	return as.tokenManager.GetUsageHistory(index)
+}
+
+// MarkTokenExhausted 标记指定token额度耗尽（tokenKey 为空时使用当前token）
+// 并发请求下当前token可能已切换，调用方应传入返回配额错误的请求所使用的 token_key
+func (as *AuthService) MarkTokenExhausted(tokenKey string) {
+	if as.tokenManager == nil {
+		return
+	}
+	if tokenKey == "" {
+		tokenKey = as.tokenManager.GetCurrentTokenKey()
+	}
+	if tokenKey != "" {
+		as.tokenManager.MarkTokenExhausted(tokenKey)
+	}
+}
+
+// GetPoolHealth 获取token池健康状况
+func (as *AuthService) GetPoolHealth() PoolHealth {
+	if as == nil || as.tokenManager == nil {
+		return PoolHealth{}
+	}
+	return as.tokenManager.GetPoolHealth()
+}
+
+// GetTokenProxy 获取指定token绑定的出口代理（未绑定返回空）
+func (as *AuthService) GetTokenProxy(tokenKey string) string {
+	if as == nil || as.tokenManager == nil {
+		return ""
+	}
+	return as.tokenManager.GetProxyForToken(tokenKey)
+}
+
+// GetTokenAccountLevel 获取指定token的账号等级
+func (as *AuthService) GetTokenAccountLevel(tokenKey string) AccountLevel {
+	if as == nil || as.tokenManager == nil {
+		return AccountLevelUnknown
+	}
+	return as.tokenManager.GetAccountLevelForToken(tokenKey)
+}
+
 // GetTokenManager 获取底层的TokenManager（用于高级操作）
 func (as *AuthService) GetTokenManager() *TokenManager {
 	return as.tokenManager
@@ -151,6 +256,8 @@ func (as *AuthService) GetTokenManager() *TokenManager {
 
 // GetConfigs 获取认证配置
 func (as *AuthService) GetConfigs() []AuthConfig {
+	as.mu.RLock()
+	defer as.mu.RUnlock()
 	return as.configs
 }
 
@@ -187,6 +294,34 @@ func (as *AuthService) ReloadTokens() error {
 	return nil
 }
 
+// WatchAccounts 监听 dir 下的账户文件变化并自动重载token池，监听器随 Stop 停止
+func (as *AuthService) WatchAccounts(dir string, debounce time.Duration) error {
+	watcher, err := StartAccountsWatcher(dir, debounce, as)
+	if err != nil {
+		return err
+	}
+	as.mu.Lock()
+	previous := as.accountsWatcher
+	as.accountsWatcher = watcher
+	as.mu.Unlock()
+	previous.Stop()
+	return nil
+}
+
+// Stop 停止认证服务的后台任务（账户文件监听、主动刷新等）
+func (as *AuthService) Stop() {
+	if as == nil {
+		return
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.accountsWatcher.Stop()
+	as.accountsWatcher = nil
+	if as.tokenManager != nil {
+		as.tokenManager.Stop()
+	}
+}
+
 // shouldSkipTokenWarmup 判断是否跳过token预热
 func shouldSkipTokenWarmup() bool {
 	val := os.Getenv("SKIP_TOKEN_WARMUP")
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// CircuitState 熔断器状态
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"    // 正常分配
+	CircuitOpen     CircuitState = "open"      // 熔断中，选择时跳过
+	CircuitHalfOpen CircuitState = "half_open" // 熔断窗口结束，仅放行一个探测请求
+)
+
+// CircuitBreakerStatus 熔断器状态快照（用于 /api/tokens 展示）
+type CircuitBreakerStatus struct {
+	State               CircuitState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenUntil           *time.Time   `json:"open_until,omitempty"`
+}
+
+// circuitEntry 单个token的熔断状态
+type circuitEntry struct {
+	failures       int
+	state          CircuitState
+	openedAt       time.Time
+	probeStartedAt time.Time // 半开状态下探测请求的发出时间（零值表示尚未发出）
+}
+
+// CircuitBreaker 按token的熔断器
+// 连续失败达到阈值后打开熔断，窗口期内不再分配该token；窗口结束后进入半开状态，
+// 只放行一个探测请求：成功则关闭熔断，失败则重新打开
+type CircuitBreaker struct {
+	mutex            sync.Mutex
+	entries          map[string]*circuitEntry
+	failureThreshold int           // 连续失败次数阈值，<=0 表示禁用熔断
+	openDuration     time.Duration // 熔断窗口
+	now              func() time.Time
+}
+
+// NewCircuitBreaker 创建熔断器
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		entries:          make(map[string]*circuitEntry),
+		failureThreshold: failureThreshold,
+		openDuration:     openDuration,
+		now:              time.Now,
+	}
+}
+
+// NewCircuitBreakerFromConfig 按 CIRCUIT_BREAKER_* 配置创建熔断器
+func NewCircuitBreakerFromConfig() *CircuitBreaker {
+	return NewCircuitBreaker(config.CircuitBreakerFailureThreshold, config.CircuitBreakerOpenDuration)
+}
+
+// enabled 是否启用熔断
+func (cb *CircuitBreaker) enabled() bool {
+	return cb != nil && cb.failureThreshold > 0
+}
+
+// refreshUnlocked 熔断窗口结束时转换为半开状态；探测请求超过一个窗口仍无结果时允许重新探测
+// 内部方法：调用者必须持有 cb.mutex
+func (cb *CircuitBreaker) refreshUnlocked(entry *circuitEntry) {
+	now := cb.now()
+	switch entry.state {
+	case CircuitOpen:
+		if now.Sub(entry.openedAt) >= cb.openDuration {
+			entry.state = CircuitHalfOpen
+			entry.probeStartedAt = time.Time{}
+		}
+	case CircuitHalfOpen:
+		if !entry.probeStartedAt.IsZero() && now.Sub(entry.probeStartedAt) >= cb.openDuration {
+			entry.probeStartedAt = time.Time{}
+		}
+	}
+}
+
+// Allow 检查token当前是否可被分配（不占用半开状态的探测名额）
+func (cb *CircuitBreaker) Allow(tokenKey string) bool {
+	if !cb.enabled() {
+		return true
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	entry, exists := cb.entries[tokenKey]
+	if !exists {
+		return true
+	}
+	cb.refreshUnlocked(entry)
+	switch entry.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		return entry.probeStartedAt.IsZero()
+	}
+	return true
+}
+
+// OnSelected token被选中时调用：半开状态下占用唯一的探测名额
+func (cb *CircuitBreaker) OnSelected(tokenKey string) {
+	if !cb.enabled() {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if entry, exists := cb.entries[tokenKey]; exists && entry.state == CircuitHalfOpen && entry.probeStartedAt.IsZero() {
+		entry.probeStartedAt = cb.now()
+		logger.Info("熔断半开，放行探测请求",
+			logger.String("token_key", tokenKey))
+	}
+}
+
+// RecordFailure 记录一次失败，返回是否因此打开了熔断
+func (cb *CircuitBreaker) RecordFailure(tokenKey string) bool {
+	if !cb.enabled() {
+		return false
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	entry, exists := cb.entries[tokenKey]
+	if !exists {
+		entry = &circuitEntry{state: CircuitClosed}
+		cb.entries[tokenKey] = entry
+	}
+	cb.refreshUnlocked(entry)
+	entry.failures++
+
+	switch entry.state {
+	case CircuitOpen:
+		return false
+	case CircuitClosed:
+		if entry.failures < cb.failureThreshold {
+			return false
+		}
+	}
+
+	// 连续失败达到阈值，或半开状态的探测请求失败：打开熔断
+	entry.state = CircuitOpen
+	entry.openedAt = cb.now()
+	entry.probeStartedAt = time.Time{}
+	logger.Warn("Token熔断已打开",
+		logger.String("token_key", tokenKey),
+		logger.Int("consecutive_failures", entry.failures),
+		logger.Duration("open_duration", cb.openDuration))
+	return true
+}
+
+// RecordSuccess 记录一次成功：关闭熔断并清零失败计数
+func (cb *CircuitBreaker) RecordSuccess(tokenKey string) {
+	if !cb.enabled() {
+		return
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	entry, exists := cb.entries[tokenKey]
+	if !exists {
+		return
+	}
+	if entry.state != CircuitClosed {
+		logger.Info("Token熔断已关闭，恢复分配",
+			logger.String("token_key", tokenKey))
+	}
+	delete(cb.entries, tokenKey)
+}
+
+// Status 获取token的熔断状态快照
+func (cb *CircuitBreaker) Status(tokenKey string) CircuitBreakerStatus {
+	status := CircuitBreakerStatus{State: CircuitClosed}
+	if !cb.enabled() {
+		return status
+	}
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	entry, exists := cb.entries[tokenKey]
+	if !exists {
+		return status
+	}
+	cb.refreshUnlocked(entry)
+	status.State = entry.state
+	status.ConsecutiveFailures = entry.failures
+	if entry.state == CircuitOpen {
+		openUntil := entry.openedAt.Add(cb.openDuration)
+		status.OpenUntil = &openUntil
+	}
+	return status
+}
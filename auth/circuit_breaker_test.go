@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestCircuitBreaker 创建使用可控时钟的熔断器
+func newTestCircuitBreaker(threshold int, openDuration time.Duration) (*CircuitBreaker, *time.Time) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cb := NewCircuitBreaker(threshold, openDuration)
+	cb.now = func() time.Time { return now }
+	return cb, &now
+}
+
+func TestCircuitBreaker_OpensAtThreshold(t *testing.T) {
+	cb, _ := newTestCircuitBreaker(3, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if cb.RecordFailure("token_0") {
+			t.Fatalf("第%d次失败不应打开熔断", i+1)
+		}
+	}
+	if !cb.Allow("token_0") {
+		t.Fatal("未达到阈值时应允许分配")
+	}
+
+	if !cb.RecordFailure("token_0") {
+		t.Fatal("达到阈值时应打开熔断")
+	}
+	if cb.Allow("token_0") {
+		t.Error("熔断打开期间不应分配")
+	}
+	if !cb.Allow("token_1") {
+		t.Error("其他token不受影响")
+	}
+
+	status := cb.Status("token_0")
+	if status.State != CircuitOpen || status.ConsecutiveFailures != 3 || status.OpenUntil == nil {
+		t.Errorf("熔断状态不正确: %+v", status)
+	}
+}
+
+func TestCircuitBreaker_SuccessResetsFailures(t *testing.T) {
+	cb, _ := newTestCircuitBreaker(2, time.Minute)
+
+	cb.RecordFailure("token_0")
+	cb.RecordSuccess("token_0")
+	if cb.RecordFailure("token_0") {
+		t.Error("成功后失败计数应清零")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenSingleProbe(t *testing.T) {
+	cb, now := newTestCircuitBreaker(1, time.Minute)
+
+	cb.RecordFailure("token_0")
+	*now = now.Add(time.Minute)
+
+	if !cb.Allow("token_0") {
+		t.Fatal("熔断窗口结束后应放行探测请求")
+	}
+	if status := cb.Status("token_0"); status.State != CircuitHalfOpen {
+		t.Fatalf("期望半开状态，实际 %s", status.State)
+	}
+
+	cb.OnSelected("token_0")
+	if cb.Allow("token_0") {
+		t.Error("探测请求进行中不应再次放行")
+	}
+
+	// 探测失败：重新打开
+	if !cb.RecordFailure("token_0") {
+		t.Error("探测失败应重新打开熔断")
+	}
+	if cb.Allow("token_0") {
+		t.Error("重新打开后不应分配")
+	}
+
+	// 再次半开，探测成功：关闭
+	*now = now.Add(time.Minute)
+	cb.OnSelected("token_0")
+	cb.RecordSuccess("token_0")
+	if status := cb.Status("token_0"); status.State != CircuitClosed || status.ConsecutiveFailures != 0 {
+		t.Errorf("探测成功后应关闭熔断，实际 %+v", status)
+	}
+}
+
+func TestCircuitBreaker_StaleProbeReleased(t *testing.T) {
+	cb, now := newTestCircuitBreaker(1, time.Minute)
+
+	cb.RecordFailure("token_0")
+	*now = now.Add(time.Minute)
+	cb.OnSelected("token_0")
+
+	// 探测请求一直没有结果（例如客户端断开），一个窗口后允许重新探测
+	*now = now.Add(time.Minute)
+	if !cb.Allow("token_0") {
+		t.Error("探测超时后应允许重新探测")
+	}
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	cb, _ := newTestCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		if cb.RecordFailure("token_0") {
+			t.Fatal("阈值为0时不应打开熔断")
+		}
+	}
+	if !cb.Allow("token_0") {
+		t.Error("禁用时应始终允许分配")
+	}
+
+	var nilBreaker *CircuitBreaker
+	if !nilBreaker.Allow("token_0") {
+		t.Error("nil 熔断器应始终允许分配")
+	}
+}
+
+// TestTokenManager_CircuitBreakerSkipsToken 熔断中的token不参与选择
+func TestTokenManager_CircuitBreakerSkipsToken(t *testing.T) {
+	for _, strategy := range []SelectionStrategy{SelectionStrategyRoundRobin, SelectionStrategyWeighted, SelectionStrategyLRU} {
+		tm := newStrategyTestManager(t, strategy, []float64{50, 50})
+		tm.circuitBreaker = NewCircuitBreaker(1, time.Hour)
+		tm.RecordTokenError("token_0")
+
+		for i := 0; i < 5; i++ {
+			token, err := tm.getBestToken()
+			if err != nil {
+				t.Fatalf("%s: getBestToken failed: %v", strategy, err)
+			}
+			if token.AccessToken != "access_1" {
+				t.Errorf("%s: 期望跳过熔断中的token，实际选中 %s", strategy, token.AccessToken)
+			}
+		}
+
+		tm.RecordTokenError("token_1")
+		if _, err := tm.getBestToken(); err == nil {
+			t.Errorf("%s: 全部熔断时期望返回错误", strategy)
+		}
+	}
+}
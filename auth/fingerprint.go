@@ -2,6 +2,8 @@ package auth
 
 import (
 	"fmt"
+	"kiro2api/config"
+	"kiro2api/logger"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -49,13 +51,24 @@ type Fingerprint struct {
 }
 
 // FingerprintManager 指纹管理器，每个token绑定固定指纹
+// 配置轮换策略后，请求路径通过 AcquireFingerprint* 获取指纹，达到次数/时长阈值时为该token生成新指纹
 type FingerprintManager struct {
 	fingerprints      map[string]*Fingerprint
-	bindingMachineIds map[string]string // bindingKey -> machineId 绑定
+	usage             map[string]*fingerprintUsage // 指纹key -> 使用情况
+	bindingMachineIds map[string]string            // bindingKey -> machineId 绑定
+	rotateRequests    int                          // 使用达到该次数后轮换（0 表示不按次数轮换）
+	rotateInterval    time.Duration                // 生成超过该时长后轮换（0 表示不按时间轮换）
 	mutex             sync.RWMutex
 	rng               *rand.Rand
 }
 
+// fingerprintUsage 指纹的生成时间与使用次数
+type fingerprintUsage struct {
+	createdAt time.Time
+	requests  int
+	rotations int // 该key累计轮换次数
+}
+
 var (
 	globalFingerprintManager *FingerprintManager
 	fingerprintOnce          sync.Once
@@ -166,7 +179,10 @@ func GetFingerprintManager() *FingerprintManager {
 	fingerprintOnce.Do(func() {
 		globalFingerprintManager = &FingerprintManager{
 			fingerprints:      make(map[string]*Fingerprint),
+			usage:             make(map[string]*fingerprintUsage),
 			bindingMachineIds: make(map[string]string),
+			rotateRequests:    config.FingerprintRotateRequests,
+			rotateInterval:    config.FingerprintRotateInterval,
 			rng:               rand.New(rand.NewSource(time.Now().UnixNano())),
 		}
 		// 加载已有的机器码绑定
@@ -194,9 +210,69 @@ func (fm *FingerprintManager) GetFingerprint(tokenKey string) *Fingerprint {
 
 	fp := fm.generateFingerprint()
 	fm.fingerprints[tokenKey] = fp
+	fm.usage[tokenKey] = &fingerprintUsage{createdAt: time.Now()}
+	return fp
+}
+
+// AcquireFingerprint 为一次上游请求获取token的指纹：计入使用次数，满足轮换策略时先换用新指纹
+// 轮换只替换管理器中的指纹，已分配给会话的指纹对象不受影响
+func (fm *FingerprintManager) AcquireFingerprint(tokenKey string) *Fingerprint {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+	return fm.acquireLocked(tokenKey, fm.generateFingerprint)
+}
+
+// AcquireFingerprintForBindingKey 与 AcquireFingerprint 相同，绑定了机器码时使用绑定的机器码（轮换后保持不变）
+func (fm *FingerprintManager) AcquireFingerprintForBindingKey(bindingKey, tokenKey string) *Fingerprint {
+	fm.mutex.Lock()
+	defer fm.mutex.Unlock()
+
+	machineId := fm.bindingMachineIds[bindingKey]
+	if machineId == "" {
+		return fm.acquireLocked(tokenKey, fm.generateFingerprint)
+	}
+	return fm.acquireLocked("binding:"+bindingKey, func() *Fingerprint {
+		return fm.generateFingerprintWithMachineId(machineId)
+	})
+}
+
+// acquireLocked 获取指纹并计数，需持有写锁
+func (fm *FingerprintManager) acquireLocked(fpKey string, generate func() *Fingerprint) *Fingerprint {
+	now := time.Now()
+	fp, exists := fm.fingerprints[fpKey]
+	usage := fm.usage[fpKey]
+	if usage == nil {
+		usage = &fingerprintUsage{createdAt: now}
+		fm.usage[fpKey] = usage
+	}
+
+	if !exists {
+		fp = generate()
+		fm.fingerprints[fpKey] = fp
+	} else if fm.shouldRotate(usage, now) {
+		logger.Debug("指纹达到轮换条件，生成新指纹",
+			logger.String("fingerprint_key", fpKey),
+			logger.Int("requests", usage.requests),
+			logger.Duration("age", now.Sub(usage.createdAt)))
+		fp = generate()
+		fm.fingerprints[fpKey] = fp
+		usage.createdAt = now
+		usage.requests = 0
+		usage.rotations++
+	}
+
+	usage.requests++
 	return fp
 }
 
+// shouldRotate 是否满足轮换策略
+func (fm *FingerprintManager) shouldRotate(usage *fingerprintUsage, now time.Time) bool {
+	if fm.rotateRequests > 0 && usage.requests >= fm.rotateRequests {
+		return true
+	}
+	return fm.rotateInterval > 0 && now.Sub(usage.createdAt) >= fm.rotateInterval
+}
+
 // generateFingerprint 生成随机指纹（保持内部一致性）
 func (fm *FingerprintManager) generateFingerprint() *Fingerprint {
 	// 随机选择操作系统配置
@@ -376,14 +452,26 @@ func (fm *FingerprintManager) GetStats() map[string]any {
 	localeCounts := make(map[string]int)
 	screenCounts := make(map[string]int)
 
+	now := time.Now()
+	totalRotations := 0
 	for key, fp := range fm.fingerprints {
 		// 统计OS分布
 		osCounts[fp.OSType]++
 		localeCounts[fp.Locale]++
 		screenCounts[fp.ScreenResolution]++
 
-		// 记录每个token的指纹摘要
-		fingerprintDetails[key] = fp.GetInfo()
+		// 记录每个token的指纹摘要及当前指纹的年龄/使用次数
+		detail := make(map[string]any)
+		for k, v := range fp.GetInfo() {
+			detail[k] = v
+		}
+		if usage := fm.usage[key]; usage != nil {
+			detail["age_seconds"] = now.Sub(usage.createdAt).Seconds()
+			detail["requests"] = usage.requests
+			detail["rotations"] = usage.rotations
+			totalRotations += usage.rotations
+		}
+		fingerprintDetails[key] = detail
 	}
 
 	return map[string]any{
@@ -392,6 +480,11 @@ func (fm *FingerprintManager) GetStats() map[string]any {
 		"locale_distribution": localeCounts,
 		"screen_distribution": screenCounts,
 		"details":             fingerprintDetails,
+		"rotation": map[string]any{
+			"rotate_requests":     fm.rotateRequests,
+			"rotate_interval_sec": fm.rotateInterval.Seconds(),
+			"total_rotations":     totalRotations,
+		},
 	}
 }
 
@@ -419,6 +512,7 @@ func (fm *FingerprintManager) SetMachineIdForBindingKey(bindingKey, machineId st
 	// 清除缓存的指纹，确保使用新机器码
 	fpKey := "binding:" + bindingKey
 	delete(fm.fingerprints, fpKey)
+	delete(fm.usage, fpKey)
 }
 
 // RemoveMachineIdForBindingKey 移除指定绑定key的机器码绑定
@@ -432,6 +526,7 @@ func (fm *FingerprintManager) RemoveMachineIdForBindingKey(bindingKey string) {
 	// 清除缓存的指纹
 	fpKey := "binding:" + bindingKey
 	delete(fm.fingerprints, fpKey)
+	delete(fm.usage, fpKey)
 }
 
 // GetMachineIdForBindingKey 获取指定绑定key的机器码
@@ -469,20 +564,9 @@ func (fm *FingerprintManager) GetFingerprintForBindingKey(bindingKey, tokenKey s
 			return fp
 		}
 
-		// 生成新指纹，使用绑定的机器码作为 KiroHash
-		fp := fm.generateFingerprint()
-		// 允许 UUID 或 64位HEX
-		cleanMachineId := strings.ReplaceAll(machineId, "-", "")
-		if len(cleanMachineId) == 64 {
-			fp.KiroHash = strings.ToLower(cleanMachineId)
-		} else {
-			// UUID 去掉连字符后为32位，重复以保证64位
-			if len(cleanMachineId) < 64 {
-				cleanMachineId = cleanMachineId + cleanMachineId
-			}
-			fp.KiroHash = strings.ToLower(cleanMachineId[:64])
-		}
+		fp := fm.generateFingerprintWithMachineId(machineId)
 		fm.fingerprints[fpKey] = fp
+		fm.usage[fpKey] = &fingerprintUsage{createdAt: time.Now()}
 		return fp
 	}
 
@@ -490,6 +574,23 @@ func (fm *FingerprintManager) GetFingerprintForBindingKey(bindingKey, tokenKey s
 	return fm.GetFingerprint(tokenKey)
 }
 
+// generateFingerprintWithMachineId 生成新指纹，使用绑定的机器码作为 KiroHash
+func (fm *FingerprintManager) generateFingerprintWithMachineId(machineId string) *Fingerprint {
+	fp := fm.generateFingerprint()
+	// 允许 UUID 或 64位HEX
+	cleanMachineId := strings.ReplaceAll(machineId, "-", "")
+	if len(cleanMachineId) == 64 {
+		fp.KiroHash = strings.ToLower(cleanMachineId)
+	} else {
+		// UUID 去掉连字符后为32位，重复以保证64位
+		if len(cleanMachineId) < 64 {
+			cleanMachineId = cleanMachineId + cleanMachineId
+		}
+		fp.KiroHash = strings.ToLower(cleanMachineId[:64])
+	}
+	return fp
+}
+
 // SetMachineIdForEmail 为指定邮箱设置机器码（兼容旧接口）
 func (fm *FingerprintManager) SetMachineIdForEmail(email, machineId string) {
 	key := NormalizeBindingKey(email)
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func newTestFingerprintManager(rotateRequests int, rotateInterval time.Duration) *FingerprintManager {
+	return &FingerprintManager{
+		fingerprints:      make(map[string]*Fingerprint),
+		usage:             make(map[string]*fingerprintUsage),
+		bindingMachineIds: make(map[string]string),
+		rotateRequests:    rotateRequests,
+		rotateInterval:    rotateInterval,
+		rng:               rand.New(rand.NewSource(1)),
+	}
+}
+
+func TestFingerprintManager_RotatesAfterRequests(t *testing.T) {
+	fm := newTestFingerprintManager(3, 0)
+
+	first := fm.AcquireFingerprint("token_1")
+	for i := 0; i < 2; i++ {
+		if fp := fm.AcquireFingerprint("token_1"); fp != first {
+			t.Fatalf("request %d: fingerprint rotated before reaching the limit", i+2)
+		}
+	}
+
+	// 会话持有的指纹对象在轮换后保持不变
+	sessionFP := first
+	snapshot := *first
+
+	rotated := fm.AcquireFingerprint("token_1")
+	if rotated == first {
+		t.Fatalf("expected a new fingerprint after 3 requests")
+	}
+	if sessionFP.KiroHash != snapshot.KiroHash || sessionFP.OSType != snapshot.OSType {
+		t.Fatalf("rotation must not mutate fingerprints already handed out")
+	}
+	if fp := fm.GetFingerprint("token_1"); fp != rotated {
+		t.Fatalf("GetFingerprint should return the rotated fingerprint")
+	}
+
+	usage := fm.usage["token_1"]
+	if usage.requests != 1 || usage.rotations != 1 {
+		t.Fatalf("usage = %+v, want requests=1 rotations=1", *usage)
+	}
+}
+
+func TestFingerprintManager_RotatesAfterInterval(t *testing.T) {
+	fm := newTestFingerprintManager(0, time.Hour)
+
+	first := fm.AcquireFingerprint("token_1")
+	if fp := fm.AcquireFingerprint("token_1"); fp != first {
+		t.Fatalf("fingerprint rotated before the interval elapsed")
+	}
+
+	fm.usage["token_1"].createdAt = time.Now().Add(-2 * time.Hour)
+	if fp := fm.AcquireFingerprint("token_1"); fp == first {
+		t.Fatalf("expected a new fingerprint after the interval elapsed")
+	}
+}
+
+func TestFingerprintManager_RotationKeepsBoundMachineId(t *testing.T) {
+	fm := newTestFingerprintManager(1, 0)
+	fm.bindingMachineIds["user@example.com"] = "0123456789abcdef0123456789abcdef"
+
+	first := fm.AcquireFingerprintForBindingKey("user@example.com", "token_1")
+	rotated := fm.AcquireFingerprintForBindingKey("user@example.com", "token_1")
+	if rotated == first {
+		t.Fatalf("expected rotation after 1 request")
+	}
+	if rotated.KiroHash != first.KiroHash {
+		t.Fatalf("bound machine id changed on rotation: %s -> %s", first.KiroHash, rotated.KiroHash)
+	}
+}
+
+func TestFingerprintManager_NoPolicyKeepsFingerprint(t *testing.T) {
+	fm := newTestFingerprintManager(0, 0)
+
+	first := fm.AcquireFingerprint("token_1")
+	for i := 0; i < 50; i++ {
+		if fm.AcquireFingerprint("token_1") != first {
+			t.Fatalf("fingerprint rotated without a rotation policy")
+		}
+	}
+
+	detail := fm.GetStats()["details"].(map[string]any)["token_1"].(map[string]any)
+	if detail["requests"] != 51 || detail["rotations"] != 0 {
+		t.Fatalf("stats detail = %v", detail)
+	}
+}
@@ -97,6 +97,20 @@ func AllowedModelsForLevel(level AccountLevel) []string {
 	return models
 }
 
+// MaxTokensCapForLevel 返回该账号等级的 max_tokens 上限（0 表示不限制）
+func MaxTokensCapForLevel(level AccountLevel) int {
+	switch level {
+	case AccountLevelFree:
+		return config.MaxTokensCapFree
+	case AccountLevelPro:
+		return config.MaxTokensCapPro
+	case AccountLevelEnterprise:
+		return config.MaxTokensCapEnterprise
+	default:
+		return config.MaxTokensCapUnknown
+	}
+}
+
 // AllowedModelsForUsage 返回 usage 对应账号的可用模型
 func AllowedModelsForUsage(usage *types.UsageLimits) []string {
 	level := DetectAccountLevelFromUsage(usage)
@@ -144,3 +158,28 @@ func IsModelAllowedForUsage(usage *types.UsageLimits, requestedModel string) boo
 	level := DetectAccountLevelFromUsage(usage)
 	return IsModelAllowedForLevel(level, requestedModel)
 }
+
+// IsModelInAllowlist 判断请求模型是否在账号配置的模型白名单中
+// 两侧都按 ResolveModelID 解析后比较，无法解析的模型按归一化名称比较；不受 MODEL_ACCESS_CONTROL_ENABLED 影响
+func IsModelInAllowlist(allowed []string, requestedModel string) bool {
+	requestedModel = strings.TrimSpace(requestedModel)
+	if requestedModel == "" {
+		return true
+	}
+
+	requested := normalizeAllowlistModel(requestedModel)
+	for _, model := range allowed {
+		if normalizeAllowlistModel(model) == requested {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeAllowlistModel 将模型名转换为白名单比较使用的形式
+func normalizeAllowlistModel(model string) string {
+	if resolved, _, ok := config.ResolveModelID(model); ok {
+		return resolved
+	}
+	return config.NormalizeModelName(model)
+}
@@ -188,6 +188,60 @@ func TestTokenManager_GetBestTokenForModel_ModelNotFoundWhenNoAccountSupports(t
 	}
 }
 
+func TestTokenManager_AllowedModelsOverridesAccountLevel(t *testing.T) {
+	origEnabled := config.ModelAccessControlEnabled
+	defer func() {
+		config.ModelAccessControlEnabled = origEnabled
+	}()
+	config.ModelAccessControlEnabled = true
+
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "token_enterprise", AllowedModels: []string{"claude-haiku-4-5"}},
+		{AuthType: AuthMethodSocial, RefreshToken: "token_free", AllowedModels: []string{"claude-opus-4-6", "claude-sonnet-4-5"}},
+	}
+	tm := NewTokenManager(configs)
+
+	now := time.Now()
+	tm.mutex.Lock()
+	tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 0)] = &CachedToken{
+		Token:        types.TokenInfo{AccessToken: "access_enterprise", ExpiresAt: now.Add(1 * time.Hour)},
+		CachedAt:     now,
+		Available:    10,
+		AccountLevel: AccountLevelEnterprise,
+	}
+	tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 1)] = &CachedToken{
+		Token:        types.TokenInfo{AccessToken: "access_free", ExpiresAt: now.Add(1 * time.Hour)},
+		CachedAt:     now,
+		Available:    10,
+		AccountLevel: AccountLevelFree,
+	}
+	tm.lastRefresh = now
+	tm.mutex.Unlock()
+
+	// 白名单优先于等级：免费账号可以请求 opus，企业账号只能请求 haiku
+	token, err := tm.getBestTokenForModel("claude-opus-4-6-thinking")
+	if err != nil {
+		t.Fatalf("getBestTokenForModel() unexpected error: %v", err)
+	}
+	if token.AccessToken != "access_free" {
+		t.Fatalf("expected free token pinned to opus, got %s", token.AccessToken)
+	}
+
+	enterpriseKey := fmt.Sprintf(config.TokenCacheKeyFormat, 0)
+	if tm.IsTokenAllowedForModel(enterpriseKey, "claude-opus-4-6") {
+		t.Fatalf("enterprise token should not allow opus outside its allowedModels")
+	}
+	if !tm.IsTokenAllowedForModel(enterpriseKey, "claude-haiku-4-5-20251001") {
+		t.Fatalf("enterprise token should allow haiku alias in its allowedModels")
+	}
+
+	// 关闭等级访问控制时白名单仍然生效
+	config.ModelAccessControlEnabled = false
+	if tm.IsTokenAllowedForModel(enterpriseKey, "claude-sonnet-4-5") {
+		t.Fatalf("allowedModels should apply even when ModelAccessControlEnabled=false")
+	}
+}
+
 func buildUsageForPlan(plan string) *types.UsageLimits {
 	return &types.UsageLimits{
 		SubscriptionInfo: types.SubscriptionInfo{
@@ -162,6 +162,20 @@ func (s *OAuthTokenStore) ToAuthConfigs() []AuthConfig {
 	return configs
 }
 
+// UpdateRefreshToken 上游轮换 refresh token 后写回新值（按 ID 查找，ID 为空时按旧的 refresh token 查找）
+func (s *OAuthTokenStore) UpdateRefreshToken(id, oldRefreshToken, newRefreshToken string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, token := range s.Tokens {
+		if (id != "" && token.ID == id) || (id == "" && token.RefreshToken == oldRefreshToken) {
+			s.Tokens[i].RefreshToken = newRefreshToken
+			return s.save()
+		}
+	}
+	return fmt.Errorf("未找到需要更新 refresh token 的OAuth token")
+}
+
 // SetTokenDisabled 设置 token 的禁用状态（临时禁用，后台刷新不停止）
 func (s *OAuthTokenStore) SetTokenDisabled(id string, disabled bool) error {
 	s.mutex.Lock()
@@ -390,6 +390,20 @@ func maskProxyURL(proxyURL string) string {
 	return u.String()
 }
 
+// isValidProxyURL 校验代理URL（支持 http/https/socks5）
+func isValidProxyURL(proxyURL string) bool {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return true
+	default:
+		return false
+	}
+}
+
 // AddProxy 动态添加代理
 func (pp *ProxyPool) AddProxy(proxyURL string) error {
 	if proxyURL == "" {
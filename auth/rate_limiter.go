@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"strings"
@@ -40,6 +41,7 @@ type RateLimiter struct {
 	minTokenInterval  time.Duration // 单token最小请求间隔
 	maxTokenInterval  time.Duration // 单token最大请求间隔（随机范围）
 	globalMinInterval time.Duration // 全局最小请求间隔
+	minRequestSpacing time.Duration // 单token请求间隔硬下限（全局默认值）
 	maxConsecutiveUse int           // 单token最大连续使用次数
 	cooldownDuration  time.Duration // token冷却时间
 
@@ -49,13 +51,31 @@ type RateLimiter struct {
 	backoffMultiplier float64       // 退避倍数
 
 	// 新增：每日限制配置
-	dailyMaxRequests int // 每日最大请求次数
+	dailyMaxRequests int                      // 每日最大请求次数（全局默认值）
+	dailyLimits      map[string]int           // 按token覆盖的每日上限（-1 表示不限制）
+	requestSpacings  map[string]time.Duration // 按token覆盖的请求间隔硬下限（0 表示不限制）
+	resetLocation    *time.Location           // 每日计数重置时区
+	resetHour        int                      // 每日计数重置的整点（0-23）
 
 	// 新增：抖动配置
 	jitterPercent int // 抖动百分比
 
 	// 新增：被暂停token的冷却时间
 	suspendedCooldown time.Duration
+
+	// 冷却状态变更回调（用于持久化，在锁外调用）
+	onCooldownChange func()
+
+	// token事件回调（用于Webhook告警，在锁外调用）
+	onTokenEvent func(TokenEvent)
+}
+
+// CooldownSnapshot token冷却状态快照（用于持久化）
+type CooldownSnapshot struct {
+	CooldownEnd   time.Time
+	FailCount     int
+	IsSuspended   bool
+	SuspendReason string
 }
 
 // RateLimiterConfig 频率限制器配置
@@ -63,6 +83,7 @@ type RateLimiterConfig struct {
 	MinTokenInterval  time.Duration
 	MaxTokenInterval  time.Duration
 	GlobalMinInterval time.Duration
+	MinRequestSpacing time.Duration
 	MaxConsecutiveUse int
 	CooldownDuration  time.Duration
 	BackoffBase       time.Duration
@@ -71,6 +92,8 @@ type RateLimiterConfig struct {
 	DailyMaxRequests  int
 	JitterPercent     int
 	SuspendedCooldown time.Duration
+	DailyResetTZ      string // 为空时使用本地时区
+	DailyResetHour    int
 }
 
 // DefaultRateLimiterConfig 默认配置（从config包读取）
@@ -79,6 +102,7 @@ func DefaultRateLimiterConfig() RateLimiterConfig {
 		MinTokenInterval:  config.RateLimitMinTokenInterval,
 		MaxTokenInterval:  config.RateLimitMaxTokenInterval,
 		GlobalMinInterval: config.RateLimitGlobalMinInterval,
+		MinRequestSpacing: config.RateLimitMinRequestSpacing,
 		MaxConsecutiveUse: config.RateLimitMaxConsecutiveUse,
 		CooldownDuration:  config.RateLimitCooldownDuration,
 		BackoffBase:       config.RateLimitBackoffBase,
@@ -87,6 +111,8 @@ func DefaultRateLimiterConfig() RateLimiterConfig {
 		DailyMaxRequests:  config.RateLimitDailyMaxRequests,
 		JitterPercent:     config.RateLimitJitterPercent,
 		SuspendedCooldown: config.SuspendedTokenCooldown,
+		DailyResetTZ:      config.DailyResetTZ,
+		DailyResetHour:    config.DailyResetHour,
 	}
 }
 
@@ -112,23 +138,62 @@ func NewRateLimiter(cfg RateLimiterConfig) *RateLimiter {
 		minTokenInterval:  cfg.MinTokenInterval,
 		maxTokenInterval:  cfg.MaxTokenInterval,
 		globalMinInterval: cfg.GlobalMinInterval,
+		minRequestSpacing: cfg.MinRequestSpacing,
 		maxConsecutiveUse: cfg.MaxConsecutiveUse,
 		cooldownDuration:  cfg.CooldownDuration,
 		backoffBase:       cfg.BackoffBase,
 		backoffMax:        cfg.BackoffMax,
 		backoffMultiplier: cfg.BackoffMultiplier,
 		dailyMaxRequests:  cfg.DailyMaxRequests,
+		dailyLimits:       make(map[string]int),
+		requestSpacings:   make(map[string]time.Duration),
+		resetLocation:     loadResetLocation(cfg.DailyResetTZ),
+		resetHour:         min(max(cfg.DailyResetHour, 0), 23),
 		jitterPercent:     cfg.JitterPercent,
 		suspendedCooldown: cfg.SuspendedCooldown,
 	}
 }
 
+// loadResetLocation 解析每日重置时区，无效时回退到本地时区
+func loadResetLocation(name string) *time.Location {
+	if name == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		logger.Warn("DAILY_RESET_TZ 无效，使用本地时区",
+			logger.String("tz", name),
+			logger.Err(err))
+		return time.Local
+	}
+	return loc
+}
+
+// nextDailyReset 计算 now 之后的下一个每日重置时间点
+func (rl *RateLimiter) nextDailyReset(now time.Time) time.Time {
+	loc := rl.resetLocation
+	if loc == nil {
+		loc = time.Local
+	}
+	local := now.In(loc)
+	reset := time.Date(local.Year(), local.Month(), local.Day(), rl.resetHour, 0, 0, 0, loc)
+	if !reset.After(local) {
+		reset = reset.AddDate(0, 0, 1)
+	}
+	return reset
+}
+
+// DailyResetAt 返回当前每日计数周期的重置时间点
+func (rl *RateLimiter) DailyResetAt() time.Time {
+	return rl.nextDailyReset(time.Now())
+}
+
 // getOrCreateState 获取或创建token状态
 func (rl *RateLimiter) getOrCreateState(tokenKey string) *TokenState {
 	state, exists := rl.tokenStates[tokenKey]
 	if !exists {
 		state = &TokenState{
-			DailyResetTime: time.Now().Truncate(24 * time.Hour).Add(24 * time.Hour),
+			DailyResetTime: rl.nextDailyReset(time.Now()),
 		}
 		rl.tokenStates[tokenKey] = state
 	}
@@ -136,7 +201,7 @@ func (rl *RateLimiter) getOrCreateState(tokenKey string) *TokenState {
 	// 检查是否需要重置每日计数
 	if time.Now().After(state.DailyResetTime) {
 		state.DailyRequests = 0
-		state.DailyResetTime = time.Now().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		state.DailyResetTime = rl.nextDailyReset(time.Now())
 		logger.Debug("重置每日请求计数",
 			logger.String("token_key", tokenKey))
 	}
@@ -146,13 +211,15 @@ func (rl *RateLimiter) getOrCreateState(tokenKey string) *TokenState {
 
 // WaitForToken 等待直到可以使用指定token，返回实际等待时间
 func (rl *RateLimiter) WaitForToken(tokenKey string) time.Duration {
+	rl.mutex.Lock()
+
 	// 如果配置为 0，表示无限制模式，直接返回
-	if rl.globalMinInterval == 0 && rl.minTokenInterval == 0 && rl.maxTokenInterval == 0 {
+	spacing := rl.requestSpacingUnlocked(tokenKey)
+	if rl.globalMinInterval == 0 && rl.minTokenInterval == 0 && rl.maxTokenInterval == 0 && spacing == 0 {
+		rl.mutex.Unlock()
 		return 0
 	}
 
-	rl.mutex.Lock()
-
 	now := time.Now()
 	var totalWait time.Duration
 
@@ -180,6 +247,14 @@ func (rl *RateLimiter) WaitForToken(tokenKey string) time.Duration {
 		}
 	}
 
+	// 检查token请求间隔硬下限
+	if spacing > 0 && !state.LastRequest.IsZero() {
+		requiredSpacing := rl.withJitter(spacing)
+		if tokenWait := requiredSpacing - now.Sub(state.LastRequest); tokenWait > totalWait {
+			totalWait = tokenWait
+		}
+	}
+
 	rl.mutex.Unlock()
 
 	// 执行等待
@@ -242,6 +317,13 @@ func (rl *RateLimiter) MarkTokenCooldown(tokenKey string) {
 		logger.String("token_key", tokenKey),
 		logger.Int("fail_count", state.FailCount),
 		logger.Duration("cooldown", backoffDuration))
+
+	rl.notifyCooldownChangeAsync()
+	rl.notifyTokenEventAsync(TokenEvent{
+		Event:    TokenEventCooldown,
+		TokenKey: tokenKey,
+		Reason:   fmt.Sprintf("请求失败，连续失败 %d 次", state.FailCount),
+	}, state.CooldownEnd)
 }
 
 // MarkTokenSuspended 标记token被AWS暂停
@@ -262,6 +344,90 @@ func (rl *RateLimiter) MarkTokenSuspended(tokenKey string, reason string) {
 		logger.String("reason", reason),
 		logger.Duration("cooldown", rl.suspendedCooldown),
 		logger.String("cooldown_end", state.CooldownEnd.Format(time.RFC3339)))
+
+	rl.notifyCooldownChangeAsync()
+	rl.notifyTokenEventAsync(TokenEvent{
+		Event:    TokenEventSuspended,
+		TokenKey: tokenKey,
+		Reason:   reason,
+	}, state.CooldownEnd)
+}
+
+// SetCooldownChangeHook 设置冷却状态变更回调（传 nil 取消）
+func (rl *RateLimiter) SetCooldownChangeHook(hook func()) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.onCooldownChange = hook
+}
+
+// notifyCooldownChangeAsync 异步触发冷却状态变更回调（调用者必须持有锁）
+// 回调内部会再次读取限制器状态，因此不能在持锁时同步调用
+func (rl *RateLimiter) notifyCooldownChangeAsync() {
+	if rl.onCooldownChange != nil {
+		go rl.onCooldownChange()
+	}
+}
+
+// SetTokenEventHook 设置token事件回调（传 nil 取消）
+func (rl *RateLimiter) SetTokenEventHook(hook func(TokenEvent)) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.onTokenEvent = hook
+}
+
+// notifyTokenEventAsync 异步触发token事件回调（调用者必须持有锁）
+func (rl *RateLimiter) notifyTokenEventAsync(event TokenEvent, cooldownUntil time.Time) {
+	if rl.onTokenEvent == nil {
+		return
+	}
+	event.CooldownUntil = &cooldownUntil
+	event.Timestamp = time.Now()
+	go rl.onTokenEvent(event)
+}
+
+// SnapshotCooldowns 导出仍处于冷却期的token状态
+func (rl *RateLimiter) SnapshotCooldowns() map[string]CooldownSnapshot {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	snapshots := make(map[string]CooldownSnapshot)
+	for key, state := range rl.tokenStates {
+		if !now.Before(state.CooldownEnd) {
+			continue
+		}
+		snapshots[key] = CooldownSnapshot{
+			CooldownEnd:   state.CooldownEnd,
+			FailCount:     state.FailCount,
+			IsSuspended:   state.IsSuspended,
+			SuspendReason: state.SuspendReason,
+		}
+	}
+	return snapshots
+}
+
+// RestoreCooldown 恢复持久化的冷却状态，已过期的快照将被忽略
+func (rl *RateLimiter) RestoreCooldown(tokenKey string, snapshot CooldownSnapshot) bool {
+	if !time.Now().Before(snapshot.CooldownEnd) {
+		return false
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	// 只接受更晚的冷却：同一条记录重复导入时不覆盖本地已重置的失败计数
+	state := rl.getOrCreateState(tokenKey)
+	if !snapshot.CooldownEnd.After(state.CooldownEnd) {
+		return false
+	}
+	state.CooldownEnd = snapshot.CooldownEnd
+	state.FailCount = snapshot.FailCount
+	state.IsSuspended = snapshot.IsSuspended
+	state.SuspendReason = snapshot.SuspendReason
+	if snapshot.IsSuspended && state.SuspendedAt.IsZero() {
+		state.SuspendedAt = time.Now()
+	}
+	return true
 }
 
 // IsTokenSuspended 检查token是否被暂停
@@ -353,34 +519,118 @@ func (rl *RateLimiter) IsTokenInCooldown(tokenKey string) bool {
 	return false
 }
 
+// CooldownRemaining 返回token冷却（含暂停）的剩余时长，不在冷却期时返回0
+func (rl *RateLimiter) CooldownRemaining(tokenKey string) time.Duration {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	state, exists := rl.tokenStates[tokenKey]
+	if !exists {
+		return 0
+	}
+	return max(time.Until(state.CooldownEnd), 0)
+}
+
+// SetDailyLimits 设置按token覆盖的每日上限（替换之前的设置）
+// 值为正数时覆盖全局 RATE_LIMIT_DAILY_MAX，-1 表示该token不限制
+func (rl *RateLimiter) SetDailyLimits(limits map[string]int) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.dailyLimits = make(map[string]int, len(limits))
+	for key, limit := range limits {
+		rl.dailyLimits[key] = limit
+	}
+}
+
+// SetRequestSpacings 设置按token覆盖的请求间隔硬下限（替换之前的设置）
+// 覆盖全局 RATE_LIMIT_MIN_REQUEST_SPACING，0 表示该token不限制
+func (rl *RateLimiter) SetRequestSpacings(spacings map[string]time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	rl.requestSpacings = make(map[string]time.Duration, len(spacings))
+	for key, spacing := range spacings {
+		rl.requestSpacings[key] = spacing
+	}
+}
+
+// requestSpacingUnlocked 返回token生效的请求间隔硬下限（不含抖动），0 表示不限制
+// 内部方法：调用者必须持有 rl.mutex
+func (rl *RateLimiter) requestSpacingUnlocked(tokenKey string) time.Duration {
+	if spacing, ok := rl.requestSpacings[tokenKey]; ok {
+		return max(spacing, 0)
+	}
+	return max(rl.minRequestSpacing, 0)
+}
+
+// dailyLimitUnlocked 返回token生效的每日上限，0 表示不限制
+// 内部方法：调用者必须持有 rl.mutex
+func (rl *RateLimiter) dailyLimitUnlocked(tokenKey string) int {
+	if limit, ok := rl.dailyLimits[tokenKey]; ok {
+		return max(limit, 0)
+	}
+	return max(rl.dailyMaxRequests, 0)
+}
+
 // IsDailyLimitExceeded 检查是否超过每日限制
 func (rl *RateLimiter) IsDailyLimitExceeded(tokenKey string) bool {
-	if rl.dailyMaxRequests <= 0 {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	limit := rl.dailyLimitUnlocked(tokenKey)
+	if limit == 0 {
 		return false // 0 表示不限制
 	}
+	state := rl.getOrCreateState(tokenKey)
+	return state.DailyRequests >= limit
+}
 
+// MergeDailyRequests 合并其他实例共享的每日请求计数（同一重置周期内取较大值）
+func (rl *RateLimiter) MergeDailyRequests(tokenKey string, resetAt time.Time, count int) {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
 	state := rl.getOrCreateState(tokenKey)
-	return state.DailyRequests >= rl.dailyMaxRequests
+	if state.DailyResetTime.Equal(resetAt) && count > state.DailyRequests {
+		state.DailyRequests = count
+	}
 }
 
 // GetDailyRemaining 获取今日剩余请求次数
 func (rl *RateLimiter) GetDailyRemaining(tokenKey string) int {
-	if rl.dailyMaxRequests <= 0 {
-		return -1 // -1 表示不限制
-	}
+	return rl.GetDailyUsage(tokenKey).Remaining
+}
+
+// DailyUsage token今日请求配额使用情况
+type DailyUsage struct {
+	Limit     int       // 每日上限，0 表示不限制
+	Used      int       // 今日已用次数
+	Remaining int       // 剩余次数，-1 表示不限制
+	ResetAt   time.Time // 下次重置时间
+}
 
+// GetDailyUsage 获取token今日配额使用情况
+func (rl *RateLimiter) GetDailyUsage(tokenKey string) DailyUsage {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
 	state := rl.getOrCreateState(tokenKey)
-	remaining := rl.dailyMaxRequests - state.DailyRequests
-	if remaining < 0 {
-		return 0
+	limit := rl.dailyLimitUnlocked(tokenKey)
+	return DailyUsage{
+		Limit:     limit,
+		Used:      state.DailyRequests,
+		Remaining: dailyRemaining(limit, state.DailyRequests),
+		ResetAt:   state.DailyResetTime,
 	}
-	return remaining
+}
+
+// dailyRemaining 计算剩余次数：超出上限时为0（不为负），不限制时为 -1
+func dailyRemaining(limit, used int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return max(limit-used, 0)
 }
 
 // randomIntervalWithJitter 生成带抖动的随机间隔时间
@@ -391,13 +641,16 @@ func (rl *RateLimiter) randomIntervalWithJitter() time.Duration {
 	baseInterval := rl.minTokenInterval + randomDelta
 
 	// 添加额外抖动
+	return rl.withJitter(baseInterval)
+}
+
+// withJitter 在间隔上增加 0-jitterPercent% 的随机抖动
+func (rl *RateLimiter) withJitter(interval time.Duration) time.Duration {
 	if rl.jitterPercent > 0 {
-		jitterRange := float64(baseInterval) * float64(rl.jitterPercent) / 100.0
-		jitter := time.Duration(rl.rng.Float64() * jitterRange)
-		baseInterval += jitter
+		jitterRange := float64(interval) * float64(rl.jitterPercent) / 100.0
+		interval += time.Duration(rl.rng.Float64() * jitterRange)
 	}
-
-	return baseInterval
+	return interval
 }
 
 // randomInterval 生成随机间隔时间（保持向后兼容）
@@ -407,8 +660,8 @@ func (rl *RateLimiter) randomInterval() time.Duration {
 	return rl.minTokenInterval + randomDelta
 }
 
-// RecordSuccess 记录成功请求，重置失败计数
-func (rl *RateLimiter) RecordSuccess(tokenKey string) {
+// RecordSuccess 记录成功请求，重置失败计数，返回是否发生了重置
+func (rl *RateLimiter) RecordSuccess(tokenKey string) bool {
 	rl.mutex.Lock()
 	defer rl.mutex.Unlock()
 
@@ -417,7 +670,9 @@ func (rl *RateLimiter) RecordSuccess(tokenKey string) {
 		state.FailCount = 0
 		logger.Debug("请求成功，重置失败计数",
 			logger.String("token_key", tokenKey))
+		return true
 	}
+	return false
 }
 
 // CheckAndMarkSuspended 检查错误消息是否包含暂停信息，如果是则标记token
@@ -452,7 +707,9 @@ func (rl *RateLimiter) GetStats() map[string]any {
 			"cooldown_remaining_s": cooldownRemaining.Seconds(),
 			"fail_count":           state.FailCount,
 			"daily_requests":       state.DailyRequests,
-			"daily_remaining":      rl.dailyMaxRequests - state.DailyRequests,
+			"daily_limit":          rl.dailyLimitUnlocked(key),
+			"daily_remaining":      dailyRemaining(rl.dailyLimitUnlocked(key), state.DailyRequests),
+			"min_spacing_ms":       rl.requestSpacingUnlocked(key).Milliseconds(),
 			"is_suspended":         state.IsSuspended,
 			"suspend_reason":       state.SuspendReason,
 		}
@@ -464,12 +721,15 @@ func (rl *RateLimiter) GetStats() map[string]any {
 			"min_interval_s":     rl.minTokenInterval.Seconds(),
 			"max_interval_s":     rl.maxTokenInterval.Seconds(),
 			"global_min_s":       rl.globalMinInterval.Seconds(),
+			"min_spacing_s":      rl.minRequestSpacing.Seconds(),
 			"max_consecutive":    rl.maxConsecutiveUse,
 			"cooldown_s":         rl.cooldownDuration.Seconds(),
 			"backoff_base_s":     rl.backoffBase.Seconds(),
 			"backoff_max_s":      rl.backoffMax.Seconds(),
 			"backoff_multiplier": rl.backoffMultiplier,
 			"daily_max_requests": rl.dailyMaxRequests,
+			"daily_reset_tz":     rl.resetLocation.String(),
+			"daily_reset_hour":   rl.resetHour,
 			"jitter_percent":     rl.jitterPercent,
 			"suspended_cooldown": rl.suspendedCooldown.Seconds(),
 		},
@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_PerTokenDailyLimit(t *testing.T) {
+	cfg := DefaultRateLimiterConfig()
+	cfg.DailyMaxRequests = 2
+	rl := NewRateLimiter(cfg)
+	rl.SetDailyLimits(map[string]int{"token_0": 1, "token_1": -1})
+
+	for i := 0; i < 3; i++ {
+		rl.RecordRequest("token_0")
+		rl.RecordRequest("token_1")
+		rl.RecordRequest("token_2")
+	}
+
+	if !rl.IsDailyLimitExceeded("token_0") {
+		t.Error("token_0 应受自身上限 1 限制")
+	}
+	if rl.IsDailyLimitExceeded("token_1") {
+		t.Error("token_1 配置为 -1，不应受限")
+	}
+	if !rl.IsDailyLimitExceeded("token_2") {
+		t.Error("token_2 未单独配置，应使用全局上限 2")
+	}
+
+	usage := rl.GetDailyUsage("token_0")
+	if usage.Limit != 1 || usage.Used != 3 || usage.Remaining != 0 {
+		t.Errorf("token_0 配额信息不符: %+v", usage)
+	}
+	if remaining := rl.GetDailyRemaining("token_1"); remaining != -1 {
+		t.Errorf("不限制的token剩余次数应为 -1，实际 %d", remaining)
+	}
+
+	stats := rl.GetStats()["token_stats"].(map[string]any)
+	if remaining := stats["token_0"].(map[string]any)["daily_remaining"]; remaining != 0 {
+		t.Errorf("超出上限后统计中的剩余次数应为 0，实际 %v", remaining)
+	}
+}
+
+func TestRateLimiter_NextDailyReset(t *testing.T) {
+	cfg := DefaultRateLimiterConfig()
+	cfg.DailyResetTZ = "Asia/Shanghai"
+	cfg.DailyResetHour = 4
+	rl := NewRateLimiter(cfg)
+
+	loc, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skipf("时区数据不可用: %v", err)
+	}
+
+	before := time.Date(2026, 3, 1, 3, 30, 0, 0, loc)
+	if got, want := rl.nextDailyReset(before), time.Date(2026, 3, 1, 4, 0, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("重置点之前应在当天重置: got %v, want %v", got, want)
+	}
+
+	after := time.Date(2026, 3, 1, 4, 0, 0, 0, loc)
+	if got, want := rl.nextDailyReset(after), time.Date(2026, 3, 2, 4, 0, 0, 0, loc); !got.Equal(want) {
+		t.Errorf("到达重置点后应在次日重置: got %v, want %v", got, want)
+	}
+
+	if loc := loadResetLocation("Invalid/Zone"); loc != time.Local {
+		t.Errorf("无效时区应回退到本地时区，实际 %v", loc)
+	}
+}
+
+func TestTokenManager_SkipsTokenOverDailyLimit(t *testing.T) {
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{100, 100})
+	tm.rateLimiter.SetDailyLimits(map[string]int{"token_0": 1})
+	tm.rateLimiter.RecordRequest("token_0")
+
+	for i := 0; i < 3; i++ {
+		token, err := tm.getBestToken()
+		if err != nil {
+			t.Fatalf("getBestToken failed: %v", err)
+		}
+		if token.AccessToken != "access_1" {
+			t.Errorf("第%d次: 期望跳过已达上限的 token_0，实际选中 %s", i+1, token.AccessToken)
+		}
+	}
+
+	if limits := buildDailyLimits([]AuthConfig{{DailyLimit: 5}, {}, {DailyLimit: -1}}); len(limits) != 2 ||
+		limits["token_0"] != 5 || limits["token_2"] != -1 {
+		t.Errorf("buildDailyLimits 结果不符: %v", limits)
+	}
+}
+
+func TestRateLimiter_MinRequestSpacing(t *testing.T) {
+	cfg := DefaultRateLimiterConfig()
+	cfg.MinTokenInterval = 0
+	cfg.MaxTokenInterval = 0
+	cfg.GlobalMinInterval = 0
+	cfg.JitterPercent = 0
+	cfg.MinRequestSpacing = 80 * time.Millisecond
+	rl := NewRateLimiter(cfg)
+	rl.SetRequestSpacings(map[string]time.Duration{"token_1": 0})
+
+	if wait := rl.WaitForToken("token_0"); wait != 0 {
+		t.Errorf("首次请求不应等待，实际 %v", wait)
+	}
+	rl.RecordRequest("token_0")
+	if wait := rl.WaitForToken("token_0"); wait < 50*time.Millisecond || wait > 80*time.Millisecond {
+		t.Errorf("期望等待至间隔下限 80ms，实际 %v", wait)
+	}
+
+	rl.RecordRequest("token_1")
+	if wait := rl.WaitForToken("token_1"); wait != 0 {
+		t.Errorf("token_1 覆盖为 0，不应等待，实际 %v", wait)
+	}
+
+	stats := rl.GetStats()["token_stats"].(map[string]any)
+	if got := stats["token_0"].(map[string]any)["min_spacing_ms"]; got != int64(80) {
+		t.Errorf("token_0 生效间隔应为 80ms，实际 %v", got)
+	}
+
+	spacings := buildRequestSpacings([]AuthConfig{{MinRequestSpacing: "800ms"}, {}, {MinRequestSpacing: "abc"}, {MinRequestSpacing: "0s"}})
+	if len(spacings) != 2 || spacings["token_0"] != 800*time.Millisecond || spacings["token_3"] != 0 {
+		t.Errorf("buildRequestSpacings 结果不符: %v", spacings)
+	}
+}
+
+func TestRateLimiter_MinRequestSpacingJitter(t *testing.T) {
+	cfg := DefaultRateLimiterConfig()
+	cfg.MinTokenInterval = 0
+	cfg.MaxTokenInterval = 0
+	cfg.GlobalMinInterval = 0
+	cfg.JitterPercent = 50
+	rl := NewRateLimiter(cfg)
+
+	for range 100 {
+		if got := rl.withJitter(time.Second); got < time.Second || got > 1500*time.Millisecond {
+			t.Fatalf("抖动后间隔应在 [1s, 1.5s] 内，实际 %v", got)
+		}
+	}
+}
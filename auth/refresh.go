@@ -12,8 +12,31 @@ import (
 	"time"
 )
 
+// 刷新端点（测试中替换为模拟认证服务）
+var (
+	socialRefreshURL = config.GetRefreshTokenURL
+	idcRefreshURL    = config.GetIdcRefreshTokenURL
+)
+
 // refreshSingleToken 刷新单个token
+// 上游轮换了 refresh token 时返回的 token.RefreshToken 为新值，由调用方通过 applyRotatedRefreshTokenUnlocked 写回账号配置
+// 同一账号（按 refresh token 区分）的并发刷新合并为一次上游请求：主动刷新与缓存刷新可能同时刷新同一账号，
+// 上游轮换 refresh token 时重复刷新的一方会因旧值失效而失败
 func (tm *TokenManager) refreshSingleToken(authConfig AuthConfig) (types.TokenInfo, error) {
+	result, err, shared := tm.refreshGroup.Do(authConfig.RefreshToken, func() (any, error) {
+		return tm.doRefreshSingleToken(authConfig)
+	})
+	if err != nil {
+		return types.TokenInfo{}, err
+	}
+	if shared {
+		logger.Debug("复用进行中的token刷新结果", logger.String("auth_type", authConfig.AuthType))
+	}
+	return result.(types.TokenInfo), nil
+}
+
+// doRefreshSingleToken 按认证类型向上游刷新单个token
+func (tm *TokenManager) doRefreshSingleToken(authConfig AuthConfig) (types.TokenInfo, error) {
 	switch authConfig.AuthType {
 	case AuthMethodSocial:
 		token, err := refreshSocialToken(authConfig.RefreshToken)
@@ -52,11 +75,11 @@ func refreshSocialToken(refreshToken string) (types.TokenInfo, error) {
 		prefixLen = tokenLen
 	}
 	logger.Debug("Social token 刷新请求",
-		logger.String("url", config.GetRefreshTokenURL()),
+		logger.String("url", socialRefreshURL()),
 		logger.Int("token_length", tokenLen),
 		logger.String("token_prefix", refreshToken[:prefixLen]))
 
-	req, err := http.NewRequest("POST", config.GetRefreshTokenURL(), bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", socialRefreshURL(), bytes.NewBuffer(reqBody))
 	if err != nil {
 		return types.TokenInfo{}, fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -109,7 +132,7 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 		return types.TokenInfo{}, fmt.Errorf("序列化IdC请求失败: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", config.GetIdcRefreshTokenURL(), bytes.NewBuffer(reqBody))
+	req, err := http.NewRequest("POST", idcRefreshURL(), bytes.NewBuffer(reqBody))
 	if err != nil {
 		return types.TokenInfo{}, fmt.Errorf("创建IdC请求失败: %v", err)
 	}
@@ -157,6 +180,9 @@ func refreshIdCToken(authConfig AuthConfig) (types.TokenInfo, error) {
 	var token types.Token
 	token.AccessToken = refreshResp.AccessToken
 	token.RefreshToken = authConfig.RefreshToken
+	if refreshResp.RefreshToken != "" {
+		token.RefreshToken = refreshResp.RefreshToken
+	}
 	token.ExpiresIn = refreshResp.ExpiresIn
 	token.ExpiresAt = time.Now().Add(time.Duration(refreshResp.ExpiresIn) * time.Second)
 
@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"kiro2api/logger"
+)
+
+// 部分认证服务每次刷新都会轮换 refresh token，旧值随即失效
+// 刷新成功后若返回了新的 refresh token，立即更新内存中的账号配置并写回账号来源，
+// 否则下一次刷新仍使用旧值，账号在一个刷新周期后失效
+
+// rotationWrite 一次待执行的写回
+// 轮换写回：oldCfg 为账号存储中当前保存的配置，newCfg 为最新配置；run 非 nil 时为普通任务（如测试中的同步点）
+type rotationWrite struct {
+	index  int
+	oldCfg AuthConfig
+	newCfg AuthConfig
+	run    func()
+}
+
+// 写回队列：单个后台goroutine按入队顺序执行，队列不设上限（同一账号的待执行写回会合并，长度不超过账号数）
+var (
+	rotationMutex      sync.Mutex
+	rotationPending    []*rotationWrite
+	rotationWake       = make(chan struct{}, 1)
+	rotationWorkerOnce sync.Once
+)
+
+// enqueueRotationWrite 将任务加入写回队列，在轮换写回之后按顺序执行
+func enqueueRotationWrite(run func()) {
+	enqueueRotation(&rotationWrite{run: run})
+}
+
+// enqueueRotation 将写回交给后台goroutine按顺序执行，调用方（持有 tm.mutex）不做文件I/O
+// 同一账号连续轮换且上一次写回尚未开始时合并为一次：从存储中的旧值直接替换为最新值，
+// 避免旧的 refresh token 最后写入导致重启后无法刷新
+func enqueueRotation(write *rotationWrite) {
+	rotationMutex.Lock()
+	merged := false
+	if write.run == nil {
+		for _, pending := range rotationPending {
+			if pending.run == nil && pending.newCfg.RefreshToken == write.oldCfg.RefreshToken {
+				pending.index = write.index
+				pending.newCfg = write.newCfg
+				merged = true
+				break
+			}
+		}
+	}
+	if !merged {
+		rotationPending = append(rotationPending, write)
+	}
+	rotationMutex.Unlock()
+
+	rotationWorkerOnce.Do(func() { go rotationWorker() })
+	select {
+	case rotationWake <- struct{}{}:
+	default:
+	}
+}
+
+// rotationWorker 依次执行队列中的写回
+func rotationWorker() {
+	for range rotationWake {
+		for {
+			rotationMutex.Lock()
+			if len(rotationPending) == 0 {
+				rotationMutex.Unlock()
+				break
+			}
+			write := rotationPending[0]
+			rotationPending = rotationPending[1:]
+			rotationMutex.Unlock()
+
+			if write.run != nil {
+				write.run()
+				continue
+			}
+			writeRotatedRefreshToken(write.index, write.oldCfg, write.newCfg)
+		}
+	}
+}
+
+// writeRotatedRefreshToken 迁移机器码绑定并将新的 refresh token 写回账号存储
+func writeRotatedRefreshToken(index int, oldCfg, newCfg AuthConfig) {
+	migrateMachineIdBinding(oldCfg, newCfg)
+
+	if err := persistRotatedRefreshToken(oldCfg, newCfg.RefreshToken); err != nil {
+		logger.Warn("refresh token 已轮换，但写回账号存储失败，重启后该账号可能无法刷新",
+			logger.Int("config_index", index),
+			logger.String("source", oldCfg.Source),
+			logger.Err(err))
+		return
+	}
+	logger.Info("refresh token 已轮换并写回账号存储",
+		logger.Int("config_index", index),
+		logger.String("source", oldCfg.Source))
+}
+
+// applyRotatedRefreshTokenUnlocked 刷新后上游返回了新的 refresh token 时更新账号配置，并在后台写回存储
+// 索引处的配置已不是刷新时使用的 refresh token（如配置已重载）时忽略
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) applyRotatedRefreshTokenUnlocked(index int, oldRefreshToken, newRefreshToken string) {
+	if newRefreshToken == "" || newRefreshToken == oldRefreshToken {
+		return
+	}
+	if index < 0 || index >= len(tm.configs) || tm.configs[index].RefreshToken != oldRefreshToken {
+		return
+	}
+
+	oldCfg := tm.configs[index]
+	tm.configs[index].RefreshToken = newRefreshToken
+	newCfg := tm.configs[index]
+
+	// 共享存储中的状态以账号标识为键，未配置 OAuth ID 的账号标识随 refresh token 变化，迁移到新标识
+	tm.migrateSharedAccountState(oldCfg, newCfg)
+
+	enqueueRotation(&rotationWrite{index: index, oldCfg: oldCfg, newCfg: newCfg})
+}
+
+// migrateMachineIdBinding 账号标识随 refresh token 变化时，将已有的机器码绑定迁移到新标识，保持指纹稳定
+func migrateMachineIdBinding(oldCfg, newCfg AuthConfig) {
+	oldKey, newKey := BuildMachineIdBindingKey(oldCfg), BuildMachineIdBindingKey(newCfg)
+	if oldKey == "" || newKey == "" || oldKey == newKey {
+		return
+	}
+	manager := GetMachineIdBindingManager()
+	binding := manager.GetBinding(oldKey)
+	if binding == nil || binding.MachineId == "" {
+		return
+	}
+	if err := manager.SetBinding(newKey, binding.MachineId); err != nil {
+		logger.Warn("迁移机器码绑定失败", logger.String("binding_key", newKey), logger.Err(err))
+	}
+}
+
+// persistRotatedRefreshToken 将新的 refresh token 写回账号来源
+// OAuth 账号写回 OAuth token 文件；KIRO_AUTH_TOKEN 为文件路径时替换文件中的旧值；
+// KIRO_AUTH_TOKEN 为 JSON 字符串时无法写回，返回错误
+func persistRotatedRefreshToken(oldCfg AuthConfig, newRefreshToken string) error {
+	if oldCfg.Source == "oauth" || oldCfg.OAuthID != "" {
+		return GetOAuthTokenStore().UpdateRefreshToken(oldCfg.OAuthID, oldCfg.RefreshToken, newRefreshToken)
+	}
+
+	path := os.Getenv("KIRO_AUTH_TOKEN")
+	if fileInfo, err := os.Stat(path); path == "" || err != nil || fileInfo.IsDir() {
+		return fmt.Errorf("KIRO_AUTH_TOKEN 不是配置文件路径，请手动更新该账号的 refreshToken")
+	}
+	return replaceRefreshTokenInFile(path, oldCfg.RefreshToken, newRefreshToken)
+}
+
+// replaceRefreshTokenInFile 将配置文件中旧 refresh token 的 JSON 字符串替换为新值（保留文件其余内容与格式）
+func replaceRefreshTokenInFile(path, oldRefreshToken, newRefreshToken string) error {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("读取配置文件失败: %w", err)
+	}
+
+	oldLiteral, _ := json.Marshal(oldRefreshToken)
+	newLiteral, _ := json.Marshal(newRefreshToken)
+	if !bytes.Contains(content, oldLiteral) {
+		return fmt.Errorf("配置文件中没有找到旧的 refreshToken: %s", path)
+	}
+	updated := bytes.ReplaceAll(content, oldLiteral, newLiteral)
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, updated, fileInfo.Mode().Perm()); err != nil {
+		return fmt.Errorf("写入配置文件失败: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("写入配置文件失败: %w", err)
+	}
+	return nil
+}
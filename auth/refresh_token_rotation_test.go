@@ -0,0 +1,302 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+// rotatingAuthServer 模拟每次刷新都轮换 refresh token 的认证服务：旧值刷新一次后即失效
+type rotatingAuthServer struct {
+	mutex     sync.Mutex
+	current   string
+	rotations int
+	requests  int
+
+	// 非 nil 时每个刷新请求到达后通知 entered，并等待 release 关闭后再处理（构造并发刷新）
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *rotatingAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/refreshToken" {
+		http.NotFound(w, r)
+		return
+	}
+	if s.entered != nil {
+		s.entered <- struct{}{}
+		<-s.release
+	}
+	var req types.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+	if req.RefreshToken != s.current {
+		http.Error(w, `{"message":"Invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+	s.rotations++
+	s.current = fmt.Sprintf("rt-%d", s.rotations+1)
+	_ = json.NewEncoder(w).Encode(types.RefreshResponse{
+		AccessToken:  fmt.Sprintf("mock-access-token-%04d", s.rotations),
+		ExpiresIn:    3600,
+		RefreshToken: s.current,
+	})
+}
+
+// useRotatingAuthServer 将刷新与使用限制请求指向模拟服务，机器码绑定写入临时文件
+func useRotatingAuthServer(t *testing.T) *rotatingAuthServer {
+	t.Helper()
+	authServer := &rotatingAuthServer{current: "rt-1"}
+	srv := httptest.NewServer(authServer)
+	t.Cleanup(srv.Close)
+
+	origSocialURL := socialRefreshURL
+	socialRefreshURL = func() string { return srv.URL + "/refreshToken" }
+	t.Cleanup(func() { socialRefreshURL = origSocialURL })
+
+	if err := config.SetCodeWhispererEndpoint(srv.URL+"/generateAssistantResponse", ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = config.SetCodeWhispererEndpoint("", "") })
+
+	bindings := GetMachineIdBindingManager()
+	bindings.mutex.Lock()
+	origBindingFile := bindings.filePath
+	bindings.filePath = filepath.Join(t.TempDir(), "machine_id_bindings.json")
+	bindings.mutex.Unlock()
+	t.Cleanup(func() {
+		// 先等待后台写回（迁移机器码绑定）执行完毕，再还原路径
+		flushRotationWrites(t)
+		bindings.mutex.Lock()
+		bindings.filePath = origBindingFile
+		bindings.mutex.Unlock()
+	})
+	return authServer
+}
+
+// flushRotationWrites 等待之前加入队列的 refresh token 写回全部执行完毕
+func flushRotationWrites(t *testing.T) {
+	t.Helper()
+	done := make(chan struct{})
+	enqueueRotationWrite(func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("等待 refresh token 写回超时")
+	}
+}
+
+// TestRefreshTokenRotation_PersistsToConfigFile 轮换后的 refresh token 用于下一次刷新并写回 KIRO_AUTH_TOKEN 配置文件
+func TestRefreshTokenRotation_PersistsToConfigFile(t *testing.T) {
+	authServer := useRotatingAuthServer(t)
+
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	if err := os.WriteFile(path, []byte(`[{"auth":"Social","refreshToken":"rt-1"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KIRO_AUTH_TOKEN", path)
+
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "rt-1", Source: "env"}})
+	tm.mutex.Lock()
+	for range 2 {
+		if err := tm.refreshCacheUnlocked(); err != nil {
+			tm.mutex.Unlock()
+			t.Fatal(err)
+		}
+	}
+	refreshToken := tm.configs[0].RefreshToken
+	cached := tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 0)]
+	tm.mutex.Unlock()
+
+	if authServer.rotations != 2 {
+		t.Fatalf("期望两次刷新都成功，实际 %d 次", authServer.rotations)
+	}
+	if refreshToken != "rt-3" {
+		t.Errorf("期望内存中的 refresh token 为 rt-3，实际 %s", refreshToken)
+	}
+	if cached == nil || cached.Token.AccessToken != "mock-access-token-0002" {
+		t.Errorf("期望缓存第二次刷新得到的 access token，实际 %+v", cached)
+	}
+
+	flushRotationWrites(t)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != `[{"auth":"Social","refreshToken":"rt-3"}]` {
+		t.Errorf("期望配置文件写回新的 refresh token，实际 %s", content)
+	}
+}
+
+// TestRefreshTokenRotation_InlineConfigKeepsInMemory KIRO_AUTH_TOKEN 为 JSON 字符串时无法写回，但内存中的配置仍更新
+func TestRefreshTokenRotation_InlineConfigKeepsInMemory(t *testing.T) {
+	useRotatingAuthServer(t)
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"rt-1"}]`)
+
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "rt-1", Source: "env"}})
+	tm.proactiveRefreshWithLoader(tm.loadCachedToken)
+
+	tm.mutex.Lock()
+	refreshToken := tm.configs[0].RefreshToken
+	tm.mutex.Unlock()
+	if refreshToken != "rt-2" {
+		t.Errorf("期望内存中的 refresh token 为 rt-2，实际 %s", refreshToken)
+	}
+}
+
+// TestRefreshTokenRotation_ConcurrentRefreshShared 主动刷新与缓存刷新同时刷新同一账号时只发出一次刷新请求
+func TestRefreshTokenRotation_ConcurrentRefreshShared(t *testing.T) {
+	authServer := useRotatingAuthServer(t)
+	authServer.entered = make(chan struct{}, 2)
+	authServer.release = make(chan struct{})
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"rt-1"}]`)
+
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "rt-1", Source: "env"}})
+	job := proactiveRefreshJob{cacheKey: fmt.Sprintf(config.TokenCacheKeyFormat, 0), cfg: tm.configs[0]}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		tm.runProactiveRefresh(job, tm.loadCachedToken)
+	}()
+	<-authServer.entered
+	go func() {
+		defer wg.Done()
+		tm.mutex.Lock()
+		defer tm.mutex.Unlock()
+		_ = tm.refreshCacheUnlocked()
+	}()
+
+	// 未合并时缓存刷新会带着同一个 refresh token 发出第二个请求
+	select {
+	case <-authServer.entered:
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(authServer.release)
+	wg.Wait()
+
+	authServer.mutex.Lock()
+	requests := authServer.requests
+	authServer.mutex.Unlock()
+	if requests != 1 {
+		t.Errorf("期望并发刷新合并为一次请求，实际 %d 次", requests)
+	}
+
+	tm.mutex.Lock()
+	refreshToken := tm.configs[0].RefreshToken
+	_, cached := tm.cache.tokens[job.cacheKey]
+	tm.mutex.Unlock()
+	if refreshToken != "rt-2" || !cached {
+		t.Errorf("期望刷新结果写入缓存且 refresh token 为 rt-2，实际 %s（已缓存: %v）", refreshToken, cached)
+	}
+}
+
+// TestRefreshTokenRotation_CoalescesPendingWrites 同一账号连续轮换、写回尚未执行时合并为一次，文件中最终为最新值
+func TestRefreshTokenRotation_CoalescesPendingWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	if err := os.WriteFile(path, []byte(`[{"auth":"Social","refreshToken":"rt-1"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KIRO_AUTH_TOKEN", path)
+
+	// 阻塞写回goroutine，使两次轮换都停留在队列中
+	release := make(chan struct{})
+	enqueueRotationWrite(func() { <-release })
+
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "rt-1", Source: "env"}})
+	tm.mutex.Lock()
+	tm.applyRotatedRefreshTokenUnlocked(0, "rt-1", "rt-2")
+	tm.applyRotatedRefreshTokenUnlocked(0, "rt-2", "rt-3")
+	tm.mutex.Unlock()
+
+	rotationMutex.Lock()
+	pending := 0
+	for _, write := range rotationPending {
+		if write.run == nil {
+			pending++
+		}
+	}
+	rotationMutex.Unlock()
+	close(release)
+	flushRotationWrites(t)
+
+	if pending != 1 {
+		t.Errorf("期望两次轮换合并为一次写回，实际 %d 次", pending)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"rt-3"`) {
+		t.Errorf("期望配置文件中为最新的 refresh token，实际 %s", content)
+	}
+}
+
+func TestReplaceRefreshTokenInFile_MissingToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	if err := os.WriteFile(path, []byte(`[{"refreshToken":"other"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := replaceRefreshTokenInFile(path, "rt-1", "rt-2")
+	if err == nil || !strings.Contains(err.Error(), "没有找到") {
+		t.Errorf("期望旧值不存在时返回错误，实际 %v", err)
+	}
+}
+
+// TestRefreshTokenRotation_MigratesSharedState 轮换后共享存储中的冷却与每日计数迁移到新的账号标识
+func TestRefreshTokenRotation_MigratesSharedState(t *testing.T) {
+	useRotatingAuthServer(t)
+	t.Setenv("KIRO_AUTH_TOKEN", `[{"auth":"Social","refreshToken":"rt-1"}]`)
+
+	store := newMemorySharedTokenStateStore()
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10})
+	tm.enableSharedStore(store)
+
+	oldCfg := AuthConfig{AuthType: AuthMethodSocial, RefreshToken: "rt-1", Source: "env"}
+	tm.mutex.Lock()
+	tm.configs = []AuthConfig{oldCfg}
+	tm.mutex.Unlock()
+	oldKey := BuildMachineIdBindingKey(oldCfg)
+	resetAt := tm.rateLimiter.DailyResetAt()
+	if err := store.SaveCooldown(oldKey, CooldownSnapshot{CooldownEnd: time.Now().Add(time.Hour), FailCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.IncrDailyRequests(oldKey, resetAt); err != nil {
+		t.Fatal(err)
+	}
+
+	tm.mutex.Lock()
+	tm.applyRotatedRefreshTokenUnlocked(0, "rt-1", "rt-2")
+	newKey := tm.accountKeyForTokenKey("token_0")
+	tm.mutex.Unlock()
+	flushSharedWrites(t, tm)
+	flushRotationWrites(t)
+
+	cooldowns, _ := store.LoadCooldowns()
+	if _, ok := cooldowns[newKey]; !ok {
+		t.Errorf("期望冷却迁移到新标识，实际 %+v", cooldowns)
+	}
+	if _, ok := cooldowns[oldKey]; ok {
+		t.Errorf("旧标识的冷却应被删除")
+	}
+	if counts, _ := store.LoadDailyRequests(resetAt); counts[newKey] != 1 || counts[oldKey] != 0 {
+		t.Errorf("期望每日计数迁移到新标识，实际 %+v", counts)
+	}
+}
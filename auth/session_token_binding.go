@@ -15,6 +15,7 @@ import (
 type SessionTokenBinding struct {
 	sessionID      string
 	tokenKey       string
+	model          string // 绑定时请求的模型
 	token          types.TokenInfo
 	fingerprint    *Fingerprint
 	createdAt      time.Time
@@ -68,6 +69,7 @@ func GetSessionTokenBindingManager() *SessionTokenBindingManager {
 func (m *SessionTokenBindingManager) BindSessionToken(
 	sessionID string,
 	tokenKey string,
+	model string,
 	token types.TokenInfo,
 	fingerprint *Fingerprint,
 ) {
@@ -82,6 +84,7 @@ func (m *SessionTokenBindingManager) BindSessionToken(
 	m.bindings[sessionID] = &SessionTokenBinding{
 		sessionID:      sessionID,
 		tokenKey:       tokenKey,
+		model:          model,
 		token:          token,
 		fingerprint:    fingerprint,
 		createdAt:      now,
@@ -91,7 +94,37 @@ func (m *SessionTokenBindingManager) BindSessionToken(
 
 	logger.Debug("会话已绑定Token",
 		logger.String("session_id", sessionID),
-		logger.String("token_key", tokenKey))
+		logger.String("token_key", tokenKey),
+		logger.String("model", model))
+}
+
+// SessionModel 返回会话绑定时请求的模型，未绑定时返回空
+func (m *SessionTokenBindingManager) SessionModel(sessionID string) string {
+	if !m.enabled {
+		return ""
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if binding, exists := m.bindings[sessionID]; exists {
+		return binding.model
+	}
+	return ""
+}
+
+// UpdateSessionToken 更新会话绑定的 Token 快照（同一账号刷新后的 Token），绑定的账号已变更时忽略
+func (m *SessionTokenBindingManager) UpdateSessionToken(sessionID, tokenKey string, token types.TokenInfo) {
+	if !m.enabled {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if binding, exists := m.bindings[sessionID]; exists && binding.tokenKey == tokenKey {
+		binding.token = token
+	}
 }
 
 // GetSessionToken 获取会话绑定的 Token
@@ -129,16 +162,17 @@ func (m *SessionTokenBindingManager) GetSessionToken(sessionID string) (types.To
 	return binding.token, binding.fingerprint, binding.tokenKey, true
 }
 
-// UnbindSession 解绑会话
-func (m *SessionTokenBindingManager) UnbindSession(sessionID string) {
+// UnbindSession 解绑会话，返回会话是否存在绑定
+func (m *SessionTokenBindingManager) UnbindSession(sessionID string) bool {
 	if !m.enabled {
-		return
+		return false
 	}
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if binding, exists := m.bindings[sessionID]; exists {
+	binding, exists := m.bindings[sessionID]
+	if exists {
 		logger.Debug("会话已解绑",
 			logger.String("session_id", sessionID),
 			logger.String("token_key", binding.tokenKey),
@@ -146,6 +180,7 @@ func (m *SessionTokenBindingManager) UnbindSession(sessionID string) {
 			logger.Duration("session_duration", time.Since(binding.createdAt)))
 		delete(m.bindings, sessionID)
 	}
+	return exists
 }
 
 // GetSessionStats 获取会话统计信息
@@ -170,6 +205,7 @@ func (m *SessionTokenBindingManager) GetSessionStats(sessionID string) map[strin
 		"bound":            true,
 		"session_id":       binding.sessionID,
 		"token_key":        binding.tokenKey,
+		"model":            binding.model,
 		"created_at":       binding.createdAt.Format(time.RFC3339),
 		"last_accessed_at": binding.lastAccessedAt.Format(time.RFC3339),
 		"request_count":    binding.requestCount,
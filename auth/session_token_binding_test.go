@@ -0,0 +1,126 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+// newSessionAffinityTestManager 两个账号：token_0 可请求 opus 与 haiku，token_1 只能请求 haiku
+func newSessionAffinityTestManager(t *testing.T) *TokenManager {
+	t.Helper()
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10, 10})
+	tm.allowedModels = map[string][]string{
+		"token_0": {"claude-opus-4-6", "claude-haiku-4-5"},
+		"token_1": {"claude-haiku-4-5"},
+	}
+	return tm
+}
+
+func setSessionTokenStickyAcrossModels(t *testing.T, sticky bool) {
+	t.Helper()
+	orig := config.SessionTokenStickyAcrossModels
+	config.SessionTokenStickyAcrossModels = sticky
+	t.Cleanup(func() { config.SessionTokenStickyAcrossModels = orig })
+}
+
+func TestSessionBinding_StickyAcrossModels(t *testing.T) {
+	setSessionTokenStickyAcrossModels(t, true)
+	tm := newSessionAffinityTestManager(t)
+	sessionID := "sticky-across-models-" + t.Name()
+	defer GetSessionTokenBindingManager().UnbindSession(sessionID)
+
+	_, _, first, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-opus-4-6")
+	if err != nil || first != "token_0" {
+		t.Fatalf("opus request got %q, %v; want token_0", first, err)
+	}
+	for range 3 {
+		_, _, key, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-haiku-4-5")
+		if err != nil || key != first {
+			t.Fatalf("haiku request got %q, %v; want sticky %q", key, err, first)
+		}
+	}
+	if got := GetSessionTokenBindingManager().SessionModel(sessionID); got != "claude-opus-4-6" {
+		t.Fatalf("bound model = %q, want claude-opus-4-6", got)
+	}
+}
+
+func TestSessionBinding_RebindsWhenBoundTokenCannotServeModel(t *testing.T) {
+	setSessionTokenStickyAcrossModels(t, true)
+	tm := newSessionAffinityTestManager(t)
+	tm.allowedModels["token_0"] = []string{"claude-opus-4-6"}
+	sessionID := "sticky-rebind-" + t.Name()
+	defer GetSessionTokenBindingManager().UnbindSession(sessionID)
+
+	if _, _, key, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-opus-4-6"); err != nil || key != "token_0" {
+		t.Fatalf("opus request got %q, %v; want token_0", key, err)
+	}
+	if _, _, key, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-haiku-4-5"); err != nil || key != "token_1" {
+		t.Fatalf("haiku request got %q, %v; want rebind to token_1", key, err)
+	}
+	if got := GetSessionTokenBindingManager().SessionModel(sessionID); got != "claude-haiku-4-5" {
+		t.Fatalf("bound model = %q, want claude-haiku-4-5", got)
+	}
+}
+
+func TestSessionBinding_NotStickyRebindsOnModelSwitch(t *testing.T) {
+	setSessionTokenStickyAcrossModels(t, false)
+	tm := newSessionAffinityTestManager(t)
+	sessionID := "not-sticky-" + t.Name()
+	defer GetSessionTokenBindingManager().UnbindSession(sessionID)
+	sessionManager := GetSessionTokenBindingManager()
+
+	if _, _, _, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-opus-4-6"); err != nil {
+		t.Fatalf("opus request failed: %v", err)
+	}
+	// 同一模型继续使用绑定
+	if _, _, key, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-opus-4-6"); err != nil || key != "token_0" {
+		t.Fatalf("repeated opus request got %q, %v; want token_0", key, err)
+	}
+	if _, _, _, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-haiku-4-5"); err != nil {
+		t.Fatalf("haiku request failed: %v", err)
+	}
+	if got := sessionManager.SessionModel(sessionID); got != "claude-haiku-4-5" {
+		t.Fatalf("bound model = %q, want rebind for claude-haiku-4-5", got)
+	}
+}
+
+func TestSessionBinding_ExpiredSnapshotReusesRefreshedToken(t *testing.T) {
+	setSessionTokenStickyAcrossModels(t, true)
+	tm := newSessionAffinityTestManager(t)
+	sessionID := "refreshed-snapshot-" + t.Name()
+	sessionManager := GetSessionTokenBindingManager()
+	defer sessionManager.UnbindSession(sessionID)
+
+	// 会话绑定时的 Token 快照已过期，缓存中的同一账号已刷新
+	sessionManager.BindSessionToken(sessionID, "token_0", "claude-opus-4-6",
+		types.TokenInfo{AccessToken: "stale", ExpiresAt: time.Now().Add(-time.Minute)}, nil)
+
+	token, _, key, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-opus-4-6")
+	if err != nil || key != "token_0" {
+		t.Fatalf("got %q, %v; want token_0", key, err)
+	}
+	if token.AccessToken != "access_0" {
+		t.Fatalf("access token = %q, want refreshed access_0", token.AccessToken)
+	}
+	if bound, _, _, ok := sessionManager.GetSessionToken(sessionID); !ok || bound.AccessToken != "access_0" {
+		t.Fatalf("binding snapshot = %q, want updated to access_0", bound.AccessToken)
+	}
+}
+
+func TestSessionBinding_RebindsWhenBoundTokenExhausted(t *testing.T) {
+	setSessionTokenStickyAcrossModels(t, true)
+	tm := newSessionAffinityTestManager(t)
+	sessionID := "exhausted-rebind-" + t.Name()
+	defer GetSessionTokenBindingManager().UnbindSession(sessionID)
+
+	if _, _, key, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-haiku-4-5"); err != nil || key != "token_0" {
+		t.Fatalf("first request got %q, %v; want token_0", key, err)
+	}
+	tm.MarkTokenExhausted("token_0")
+	if _, _, key, err := tm.GetTokenWithFingerprintForSessionAndModel(sessionID, "claude-haiku-4-5"); err != nil || key != "token_1" {
+		t.Fatalf("after exhaustion got %q, %v; want rebind to token_1", key, err)
+	}
+}
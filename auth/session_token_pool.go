@@ -7,6 +7,7 @@ import (
 	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
+	"sort"
 	"sync"
 	"time"
 )
@@ -297,7 +298,7 @@ func (m *SessionTokenPoolManager) TryAllocateBackupTokenForModel(sessionID, requ
 		return types.TokenInfo{}, nil, "", fmt.Errorf("TokenManager未初始化")
 	}
 
-	token, fingerprint, tokenKey, err := m.tokenManager.GetTokenWithFingerprintForSessionAndModel(sessionID+"_backup", requestedModel)
+	token, fingerprint, tokenKey, err := m.tokenManager.GetTokenWithFingerprintForSessionAndModel(SessionBackupBindingID(sessionID), requestedModel)
 	if err != nil {
 		return types.TokenInfo{}, nil, "", err
 	}
@@ -413,17 +414,93 @@ func (m *SessionTokenPoolManager) GetPoolStats(sessionID string) map[string]any
 	}
 }
 
-// UnbindSession 解绑会话
-func (m *SessionTokenPoolManager) UnbindSession(sessionID string) {
+// ListPoolStats 获取全部会话池的汇总统计，并分页列出会话（按创建时间升序，offset 从 0 开始）
+func (m *SessionTokenPoolManager) ListPoolStats(offset, limit int) map[string]any {
+	m.mutex.RLock()
+	pools := make([]*SessionTokenPool, 0, len(m.pools))
+	for _, pool := range m.pools {
+		pools = append(pools, pool)
+	}
+	m.mutex.RUnlock()
+
+	// 创建时间相同时按会话ID排序，保证翻页稳定
+	sort.Slice(pools, func(i, j int) bool {
+		if pools[i].CreatedAt.Equal(pools[j].CreatedAt) {
+			return pools[i].SessionID < pools[j].SessionID
+		}
+		return pools[i].CreatedAt.Before(pools[j].CreatedAt)
+	})
+
+	now := time.Now()
+	totalBackups := 0
+	inCooldown := 0
+	sessions := make([]map[string]any, 0)
+	for i, pool := range pools {
+		pool.mutex.RLock()
+		backupCount := len(pool.BackupTokens)
+		cooling := pool.PrimaryToken.inCooldown(now)
+		for _, backup := range pool.BackupTokens {
+			cooling = cooling || backup.inCooldown(now)
+		}
+		if i >= offset && (limit <= 0 || len(sessions) < limit) {
+			primaryKey := ""
+			if pool.PrimaryToken != nil {
+				primaryKey = pool.PrimaryToken.TokenKey
+			}
+			sessions = append(sessions, map[string]any{
+				"session_id":     pool.SessionID,
+				"primary_token":  primaryKey,
+				"backup_count":   backupCount,
+				"total_requests": pool.TotalRequests,
+				"in_cooldown":    cooling,
+				"age_seconds":    now.Sub(pool.CreatedAt).Seconds(),
+				"created_at":     pool.CreatedAt.Format(time.RFC3339),
+				"last_accessed":  pool.LastAccessedAt.Format(time.RFC3339),
+			})
+		}
+		pool.mutex.RUnlock()
+
+		totalBackups += backupCount
+		if cooling {
+			inCooldown++
+		}
+	}
+
+	return map[string]any{
+		"total_pools":          len(pools),
+		"total_backup_tokens":  totalBackups,
+		"sessions_in_cooldown": inCooldown,
+		"max_pool_size":        m.maxPoolSize,
+		"ttl_seconds":          m.ttl.Seconds(),
+		"offset":               offset,
+		"limit":                limit,
+		"sessions":             sessions,
+	}
+}
+
+// inCooldown Token 是否处于未结束的冷却中（nil 安全）
+func (t *PooledToken) inCooldown(now time.Time) bool {
+	return t != nil && t.Status == TokenStatusCooldown && now.Before(t.CooldownUntil)
+}
+
+// UnbindSession 解绑会话，返回会话池是否存在
+func (m *SessionTokenPoolManager) UnbindSession(sessionID string) bool {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if pool, exists := m.pools[sessionID]; exists {
+	pool, exists := m.pools[sessionID]
+	if exists {
 		logger.Debug("解绑会话池",
 			logger.String("session_id", sessionID),
 			logger.Int("total_requests", pool.TotalRequests))
 		delete(m.pools, sessionID)
 	}
+	return exists
+}
+
+// SessionBackupBindingID 会话池分配备用账号时使用的会话绑定ID
+func SessionBackupBindingID(sessionID string) string {
+	return sessionID + "_backup"
 }
 
 func (m *SessionTokenPoolManager) tokenSupportsModel(tokenKey, requestedModel string) bool {
@@ -487,17 +564,22 @@ func (m *SessionTokenPoolManager) Stop() {
 
 // CalculateCooldownDuration 计算冷却时间（解析 API 返回的 quota_reset_timestamp）
 func CalculateCooldownDuration(responseBody []byte, defaultDuration time.Duration) time.Duration {
+	if resetTimestamp := ParseQuotaResetTimestamp(responseBody); resetTimestamp > 0 {
+		cooldown := time.Until(time.Unix(resetTimestamp, 0))
+		if cooldown > 0 && cooldown < 24*time.Hour {
+			return cooldown
+		}
+	}
+	return defaultDuration
+}
+
+// ParseQuotaResetTimestamp 解析上游错误响应中的 quota_reset_timestamp（Unix 秒，缺失时返回 0）
+func ParseQuotaResetTimestamp(responseBody []byte) int64 {
 	var errorResp struct {
 		QuotaResetTimestamp int64 `json:"quota_reset_timestamp"`
 	}
-	if err := json.Unmarshal(responseBody, &errorResp); err == nil {
-		if errorResp.QuotaResetTimestamp > 0 {
-			resetTime := time.Unix(errorResp.QuotaResetTimestamp, 0)
-			cooldown := time.Until(resetTime)
-			if cooldown > 0 && cooldown < 24*time.Hour {
-				return cooldown
-			}
-		}
+	if err := json.Unmarshal(responseBody, &errorResp); err != nil {
+		return 0
 	}
-	return defaultDuration
+	return errorResp.QuotaResetTimestamp
 }
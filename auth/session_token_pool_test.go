@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionTokenPoolManager_ListPoolStats(t *testing.T) {
+	now := time.Now()
+	m := &SessionTokenPoolManager{pools: make(map[string]*SessionTokenPool), maxPoolSize: 3, ttl: time.Hour}
+	m.pools["s2"] = &SessionTokenPool{
+		SessionID:     "s2",
+		PrimaryToken:  &PooledToken{TokenKey: "token_1", Status: TokenStatusCooldown, CooldownUntil: now.Add(time.Minute)},
+		BackupTokens:  []*PooledToken{{TokenKey: "token_2"}, {TokenKey: "token_3"}},
+		CreatedAt:     now.Add(-2 * time.Minute),
+		TotalRequests: 7,
+	}
+	m.pools["s1"] = &SessionTokenPool{
+		SessionID:     "s1",
+		PrimaryToken:  &PooledToken{TokenKey: "token_2"},
+		BackupTokens:  []*PooledToken{{TokenKey: "token_1", Status: TokenStatusCooldown, CooldownUntil: now.Add(-time.Second)}},
+		CreatedAt:     now.Add(-3 * time.Minute),
+		TotalRequests: 2,
+	}
+	m.pools["s3"] = &SessionTokenPool{
+		SessionID:    "s3",
+		PrimaryToken: &PooledToken{TokenKey: "token_3"},
+		CreatedAt:    now.Add(-time.Minute),
+	}
+
+	stats := m.ListPoolStats(1, 1)
+	if stats["total_pools"] != 3 || stats["total_backup_tokens"] != 3 {
+		t.Fatalf("totals = %v/%v, want 3/3", stats["total_pools"], stats["total_backup_tokens"])
+	}
+	// s1 的备用账号冷却已结束，不计入
+	if stats["sessions_in_cooldown"] != 1 {
+		t.Fatalf("sessions_in_cooldown = %v, want 1", stats["sessions_in_cooldown"])
+	}
+
+	sessions := stats["sessions"].([]map[string]any)
+	if len(sessions) != 1 {
+		t.Fatalf("len(sessions) = %d, want 1", len(sessions))
+	}
+	// 按创建时间升序：s1, s2, s3
+	got := sessions[0]
+	if got["session_id"] != "s2" || got["primary_token"] != "token_1" || got["total_requests"] != 7 ||
+		got["backup_count"] != 2 || got["in_cooldown"] != true {
+		t.Fatalf("sessions[0] = %v", got)
+	}
+	if age := got["age_seconds"].(float64); age < 119 || age > 125 {
+		t.Fatalf("age_seconds = %v, want ~120", age)
+	}
+
+	if sessions := m.ListPoolStats(5, 10)["sessions"].([]map[string]any); len(sessions) != 0 {
+		t.Fatalf("offset past end returned %d sessions", len(sessions))
+	}
+}
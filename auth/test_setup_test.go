@@ -3,6 +3,7 @@ package auth
 import (
 	"kiro2api/config"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -14,7 +15,9 @@ func TestMain(m *testing.M) {
 	origMaxInterval := config.RateLimitMaxTokenInterval
 	origGlobalInterval := config.RateLimitGlobalMinInterval
 	origDailyMax := config.RateLimitDailyMaxRequests
+	origStatePersist := config.TokenStatePersistEnabled
 	origSkipWarmup := os.Getenv("SKIP_TOKEN_WARMUP")
+	origBindingFile, hasBindingFile := os.LookupEnv("MACHINE_ID_BINDING_FILE")
 
 	// 测试环境：关闭主动刷新与会话池，避免网络与后台任务干扰
 	config.ProactiveRefreshEnabled = false
@@ -23,8 +26,17 @@ func TestMain(m *testing.M) {
 	config.RateLimitMaxTokenInterval = 0
 	config.RateLimitGlobalMinInterval = 0
 	config.RateLimitDailyMaxRequests = 0
+	config.TokenStatePersistEnabled = false
 	_ = os.Setenv("SKIP_TOKEN_WARMUP", "1")
 
+	// 机器码绑定写入临时目录：后台写回（如 refresh token 轮换迁移绑定）可能晚于单个测试的清理，
+	// 不能落到包目录下默认的 machine_id_bindings.json
+	bindingDir, err := os.MkdirTemp("", "kiro2api-auth-test-")
+	if err != nil {
+		panic(err)
+	}
+	_ = os.Setenv("MACHINE_ID_BINDING_FILE", filepath.Join(bindingDir, "machine_id_bindings.json"))
+
 	code := m.Run()
 
 	// 还原配置
@@ -34,11 +46,18 @@ func TestMain(m *testing.M) {
 	config.RateLimitMaxTokenInterval = origMaxInterval
 	config.RateLimitGlobalMinInterval = origGlobalInterval
 	config.RateLimitDailyMaxRequests = origDailyMax
+	config.TokenStatePersistEnabled = origStatePersist
 	if origSkipWarmup == "" {
 		_ = os.Unsetenv("SKIP_TOKEN_WARMUP")
 	} else {
 		_ = os.Setenv("SKIP_TOKEN_WARMUP", origSkipWarmup)
 	}
+	if hasBindingFile {
+		_ = os.Setenv("MACHINE_ID_BINDING_FILE", origBindingFile)
+	} else {
+		_ = os.Unsetenv("MACHINE_ID_BINDING_FILE")
+	}
+	_ = os.RemoveAll(bindingDir)
 
 	os.Exit(code)
 }
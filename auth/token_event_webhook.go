@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+)
+
+// token事件类型
+const (
+	TokenEventCooldown  = "token_cooldown"  // 请求失败进入退避冷却
+	TokenEventSuspended = "token_suspended" // 被AWS暂停，进入长时间冷却
+	TokenEventExhausted = "token_exhausted" // 额度耗尽（402）
+)
+
+// TokenEvent 推送到Webhook的token状态变更事件
+type TokenEvent struct {
+	Event         string     `json:"event"`
+	TokenKey      string     `json:"token_key"`
+	Email         string     `json:"email,omitempty"` // 已脱敏
+	Reason        string     `json:"reason"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+	Timestamp     time.Time  `json:"timestamp"`
+}
+
+// TokenEventNotifier 异步Webhook推送器
+// 事件写入有界缓冲区后由单个worker顺序投递，缓冲区满时直接丢弃，绝不阻塞请求路径
+type TokenEventNotifier struct {
+	url        string
+	client     *http.Client
+	events     chan TokenEvent
+	maxRetries int
+	retryBase  time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewTokenEventNotifier 创建推送器并启动worker
+func NewTokenEventNotifier(url string) *TokenEventNotifier {
+	bufferSize := config.TokenEventWebhookBufferSize
+	if bufferSize <= 0 {
+		bufferSize = 1
+	}
+	n := &TokenEventNotifier{
+		url:        url,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		events:     make(chan TokenEvent, bufferSize),
+		maxRetries: max(config.TokenEventWebhookMaxRetries, 0),
+		retryBase:  time.Second,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Notify 投递事件（非阻塞），返回是否成功进入缓冲区
+func (n *TokenEventNotifier) Notify(event TokenEvent) bool {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	select {
+	case <-n.stop:
+		return false
+	default:
+	}
+	select {
+	case n.events <- event:
+		return true
+	default:
+		logger.Warn("token事件缓冲区已满，丢弃事件",
+			logger.String("event", event.Event),
+			logger.String("token_key", event.TokenKey))
+		return false
+	}
+}
+
+// Stop 停止worker（缓冲区中未投递的事件被丢弃）
+func (n *TokenEventNotifier) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+	<-n.done
+}
+
+// run worker循环
+func (n *TokenEventNotifier) run() {
+	defer close(n.done)
+	for {
+		select {
+		case <-n.stop:
+			return
+		case event := <-n.events:
+			n.deliver(event)
+		}
+	}
+}
+
+// deliver 推送单个事件，瞬时失败时按指数退避重试
+func (n *TokenEventNotifier) deliver(event TokenEvent) {
+	payload, err := utils.SafeMarshal(event)
+	if err != nil {
+		logger.Warn("序列化token事件失败", logger.Err(err))
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		retryable, err := n.post(payload)
+		if err == nil {
+			logger.Debug("token事件已推送",
+				logger.String("event", event.Event),
+				logger.String("token_key", event.TokenKey))
+			return
+		}
+		if !retryable || attempt >= n.maxRetries {
+			logger.Warn("token事件推送失败",
+				logger.String("event", event.Event),
+				logger.String("token_key", event.TokenKey),
+				logger.Int("attempts", attempt+1),
+				logger.Err(err))
+			return
+		}
+
+		select {
+		case <-n.stop:
+			return
+		case <-time.After(n.retryBase << attempt):
+		}
+	}
+}
+
+// post 发送一次请求，返回失败是否可重试
+func (n *TokenEventNotifier) post(payload []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("webhook返回状态码 %d", resp.StatusCode)
+}
+
+// notifyTokenEvent 补充邮箱信息后投递事件（未配置Webhook时为空操作）
+func (tm *TokenManager) notifyTokenEvent(event TokenEvent) {
+	if tm.eventNotifier == nil {
+		return
+	}
+	if event.Event == TokenEventCooldown && event.CooldownUntil != nil &&
+		time.Until(*event.CooldownUntil) < config.TokenEventWebhookMinCooldown {
+		return
+	}
+
+	tm.mutex.RLock()
+	if cached, exists := tm.cache.tokens[event.TokenKey]; exists && cached.UsageInfo != nil {
+		event.Email = maskEmail(cached.UsageInfo.UserInfo.Email)
+	}
+	tm.mutex.RUnlock()
+
+	tm.eventNotifier.Notify(event)
+}
+
+// maskEmail 邮箱脱敏：保留用户名首尾字符与域名（a***b@example.com）
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return ""
+	}
+	name, domain := email[:at], email[at:]
+	if len(name) <= 2 {
+		return name[:1] + "***" + domain
+	}
+	return name[:1] + "***" + name[len(name)-1:] + domain
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenEventNotifier_RetriesTransientFailures(t *testing.T) {
+	var attempts atomic.Int32
+	received := make(chan TokenEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var event TokenEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("解析事件失败: %v", err)
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	n := NewTokenEventNotifier(srv.URL)
+	defer n.Stop()
+	n.retryBase = time.Millisecond
+
+	until := time.Now().Add(time.Hour)
+	if !n.Notify(TokenEvent{Event: TokenEventCooldown, TokenKey: "token_1", Email: "a***e@example.com", Reason: "test", CooldownUntil: &until}) {
+		t.Fatal("期望事件进入缓冲区")
+	}
+
+	select {
+	case event := <-received:
+		if event.TokenKey != "token_1" || event.Event != TokenEventCooldown || event.CooldownUntil == nil {
+			t.Errorf("事件内容不符: %+v", event)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("期望自动填充 timestamp")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("事件未在超时前送达")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("期望重试到第3次成功，实际请求 %d 次", got)
+	}
+}
+
+func TestTokenEventNotifier_DropsWhenBufferFull(t *testing.T) {
+	// 不启动 worker，模拟投递阻塞
+	n := &TokenEventNotifier{
+		events: make(chan TokenEvent, 1),
+		stop:   make(chan struct{}),
+	}
+
+	if !n.Notify(TokenEvent{Event: TokenEventExhausted, TokenKey: "token_0"}) {
+		t.Fatal("第一个事件应进入缓冲区")
+	}
+	if n.Notify(TokenEvent{Event: TokenEventExhausted, TokenKey: "token_1"}) {
+		t.Error("缓冲区满时应丢弃事件而不是阻塞")
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	cases := map[string]string{
+		"alice@example.com": "a***e@example.com",
+		"ab@example.com":    "a***@example.com",
+		"":                  "",
+		"invalid":           "",
+	}
+	for input, want := range cases {
+		if got := maskEmail(input); got != want {
+			t.Errorf("maskEmail(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// TokenIndexError 指定的token索引不可用（索引越界、账号禁用或token无法刷新）
+type TokenIndexError struct {
+	Index  int
+	Reason string
+}
+
+func (e *TokenIndexError) Error() string {
+	return fmt.Sprintf("token索引 %d 不可用: %s", e.Index, e.Reason)
+}
+
+// GetTokenWithFingerprintForIndex 直接使用指定配置索引的token（调试用，跳过轮询选择）
+// 不检查冷却、熔断、每日上限与模型限制，只要求账号未禁用且token已成功刷新
+func (tm *TokenManager) GetTokenWithFingerprintForIndex(index int) (types.TokenInfo, *Fingerprint, string, error) {
+	tm.mutex.Lock()
+	if index < 0 || index >= len(tm.configs) {
+		count := len(tm.configs)
+		tm.mutex.Unlock()
+		return types.TokenInfo{}, nil, "", &TokenIndexError{Index: index, Reason: fmt.Sprintf("有效范围为 0-%d", count-1)}
+	}
+	if tm.configs[index].Disabled {
+		tm.mutex.Unlock()
+		return types.TokenInfo{}, nil, "", &TokenIndexError{Index: index, Reason: "账号已禁用"}
+	}
+
+	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
+		if err := tm.refreshCacheUnlocked(); err != nil {
+			logger.Warn("刷新token缓存失败", logger.Err(err))
+		}
+	}
+
+	tokenKey := fmt.Sprintf(config.TokenCacheKeyFormat, index)
+	cached, exists := tm.cache.tokens[tokenKey]
+	if !exists || time.Now().After(cached.Token.ExpiresAt) {
+		tm.mutex.Unlock()
+		return types.TokenInfo{}, nil, "", &TokenIndexError{Index: index, Reason: "token刷新失败或已过期"}
+	}
+	cached.LastUsed = time.Now()
+	token := cached.Token
+	tm.mutex.Unlock()
+
+	if tm.rateLimiter != nil {
+		tm.recordRequest(tokenKey)
+	}
+
+	var fingerprint *Fingerprint
+	if tm.fingerprintManager != nil {
+		if bindingKey := tm.getBindingKeyForToken(tokenKey, cached); bindingKey != "" {
+			fingerprint = tm.fingerprintManager.AcquireFingerprintForBindingKey(bindingKey, tokenKey)
+		} else {
+			fingerprint = tm.fingerprintManager.AcquireFingerprint(tokenKey)
+		}
+	}
+
+	logger.Info("按请求指定的索引使用token",
+		logger.String("token_key", tokenKey))
+	return token, fingerprint, tokenKey, nil
+}
@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestGetTokenWithFingerprintForIndex 指定索引时跳过冷却等选择条件，索引无效或账号禁用时返回 TokenIndexError
+func TestGetTokenWithFingerprintForIndex(t *testing.T) {
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10, 10, 10})
+	setTestCooldown(tm, 1, time.Minute)
+	tm.configs[2].Disabled = true
+
+	token, _, tokenKey, err := tm.GetTokenWithFingerprintForIndex(1)
+	if err != nil {
+		t.Fatalf("期望冷却中的token也可被指定使用，实际错误: %v", err)
+	}
+	if token.AccessToken != "access_1" || tokenKey != "token_1" {
+		t.Errorf("期望 access_1/token_1，实际 %s/%s", token.AccessToken, tokenKey)
+	}
+
+	for _, index := range []int{-1, 3, 2} {
+		_, _, _, err := tm.GetTokenWithFingerprintForIndex(index)
+		var indexErr *TokenIndexError
+		if !errors.As(err, &indexErr) || indexErr.Index != index {
+			t.Errorf("索引 %d 期望返回 TokenIndexError，实际: %v", index, err)
+		}
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
+	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 // {{RIPER-10 Action}}
@@ -27,10 +30,42 @@ type TokenManager struct {
 	currentIndex int             // 当前使用的token索引（轮询用）
 	exhausted    map[string]bool // 已耗尽的token记录
 
+	// 选择策略相关
+	strategy SelectionStrategy // token选择策略（默认严格轮询）
+	rng      *rand.Rand        // 加权随机源（由 mutex 保护）
+
 	// 智能轮换相关
 	rateLimiter        *RateLimiter        // 频率限制器
 	fingerprintManager *FingerprintManager // 指纹管理器
 
+	// 状态持久化（冷却/耗尽标记跨重启保留）
+	stateStore *TokenStateStore
+
+	// 多实例共享的冷却、每日计数与轮询位置（TOKEN_STORE=memory 时为 nil）
+	sharedStore  SharedTokenStateStore
+	sharedWrites chan sharedStoreWrite // 按顺序写入共享存储的队列
+
+	// 按token的熔断器（连续失败后暂停分配，半开探测恢复）
+	circuitBreaker *CircuitBreaker
+
+	// token事件Webhook推送（TOKEN_EVENT_WEBHOOK_URL 未配置时为 nil）
+	eventNotifier *TokenEventNotifier
+
+	// 按账号配置的模型白名单（tokenKey -> AllowedModels），构造后只读
+	allowedModels map[string][]string
+
+	// 按token的可用额度历史（每次查询使用限制时记录，容量 TOKEN_USAGE_HISTORY_SIZE）
+	usageHistory map[string]*usageHistory
+
+	// 主动刷新失败的token（tokenKey -> 连续失败次数与下次重试时间），成功后移除
+	refreshFailures map[string]*refreshFailure
+
+	// 同一账号进行中的刷新请求（主动刷新与缓存刷新共享结果，避免重复轮换 refresh token）
+	refreshGroup singleflight.Group
+
+	// 请求后台使用限制检查立即执行一次（容量1，已有待处理请求时合并）
+	usageCheckTrigger chan struct{}
+
 	// 主动刷新相关
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -52,6 +87,12 @@ type CachedToken struct {
 	Available    float64
 	AccountLevel AccountLevel
 	Disabled     bool // 标记此 token 是否被临时禁用（依然刷新，但不分配给请求）
+
+	// UsageCheckedAt 最近一次成功查询使用限制的时间（零值表示尚无已知额度）
+	UsageCheckedAt time.Time
+
+	// usagePending 首次加载时额度尚待后台检查，检查完成前视为可用
+	usagePending bool
 }
 
 // NewSimpleTokenCache 创建简单的token缓存
@@ -67,7 +108,10 @@ func NewTokenManager(configs []AuthConfig) *TokenManager {
 	// 生成配置顺序
 	configOrder := generateConfigOrder(configs)
 
-	logger.Info("TokenManager初始化（严格轮询策略）",
+	strategy := ParseSelectionStrategy(config.TokenSelectionStrategy)
+
+	logger.Info("TokenManager初始化",
+		logger.String("strategy", string(strategy)),
 		logger.Int("config_count", len(configs)),
 		logger.Int("config_order_count", len(configOrder)))
 
@@ -79,17 +123,71 @@ func NewTokenManager(configs []AuthConfig) *TokenManager {
 		configOrder:        configOrder,
 		currentIndex:       0,
 		exhausted:          make(map[string]bool),
+		allowedModels:      buildAllowedModels(configs),
+		usageHistory:       make(map[string]*usageHistory),
+		strategy:           strategy,
+		rng:                rand.New(rand.NewSource(time.Now().UnixNano())),
 		rateLimiter:        GetRateLimiter(),
 		fingerprintManager: GetFingerprintManager(),
+		circuitBreaker:     NewCircuitBreakerFromConfig(),
+		usageCheckTrigger:  make(chan struct{}, 1),
 		ctx:                ctx,
 		cancel:             cancel,
 	}
 
+	// 按账号配置的每日请求上限
+	if tm.rateLimiter != nil {
+		tm.rateLimiter.SetDailyLimits(buildDailyLimits(configs))
+		tm.rateLimiter.SetRequestSpacings(buildRequestSpacings(configs))
+	}
+
+	// 恢复持久化的冷却/耗尽状态
+	if config.TokenStatePersistEnabled {
+		tm.stateStore = NewTokenStateStore(resolveTokenStateFile())
+		tm.restorePersistedState()
+	}
+
+	// 多实例共享token状态（配置错误时退化为进程内状态，连通性在后台检查）
+	if store, err := NewSharedTokenStateStoreFromConfig(); err != nil {
+		logger.Error("初始化共享token状态存储失败，退化为进程内状态",
+			logger.String("token_store", config.TokenStore),
+			logger.Err(err))
+	} else if store != nil {
+		tm.enableSharedStore(store)
+		go tm.sharedStoreSyncLoop()
+		logger.Info("共享token状态存储已启用",
+			logger.String("token_store", config.TokenStore),
+			logger.Duration("sync_interval", config.TokenStoreSyncInterval))
+	}
+
+	if (tm.stateStore != nil || tm.sharedStore != nil) && tm.rateLimiter != nil {
+		tm.rateLimiter.SetCooldownChangeHook(tm.onCooldownChange)
+	}
+
+	// token状态变更Webhook告警
+	if config.TokenEventWebhookURL != "" {
+		tm.eventNotifier = NewTokenEventNotifier(config.TokenEventWebhookURL)
+		if tm.rateLimiter != nil {
+			tm.rateLimiter.SetTokenEventHook(tm.notifyTokenEvent)
+		}
+		logger.Info("token事件Webhook已启用")
+	}
+
+	// 启动时预热token缓存（后台执行，不阻塞启动）
+	if config.TokenWarmupEnabled && len(configs) > 0 {
+		go tm.warmup()
+	}
+
 	// 启动主动刷新goroutine
 	if config.ProactiveRefreshEnabled {
 		go tm.proactiveRefreshLoop()
 	}
 
+	// 后台定期检查使用限制，更新缓存中的可用额度与账号等级（不阻塞token选择）
+	if config.UsageCheckInterval > 0 && len(configs) > 0 {
+		go tm.usageCheckLoop()
+	}
+
 	// 初始化会话池管理器并设置 TokenManager 引用
 	if config.SessionPoolEnabled {
 		poolManager := GetSessionTokenPoolManager()
@@ -104,89 +202,19 @@ func (tm *TokenManager) Stop() {
 	if tm.cancel != nil {
 		tm.cancel()
 	}
-}
-
-// proactiveRefreshLoop 主动刷新循环
-func (tm *TokenManager) proactiveRefreshLoop() {
-	ticker := time.NewTicker(config.ProactiveRefreshInterval)
-	defer ticker.Stop()
-
-	logger.Info("主动刷新goroutine已启动",
-		logger.Duration("interval", config.ProactiveRefreshInterval),
-		logger.Duration("threshold", config.ProactiveRefreshThreshold))
-
-	for {
-		select {
-		case <-tm.ctx.Done():
-			logger.Info("主动刷新goroutine已停止")
-			return
-		case <-ticker.C:
-			tm.proactiveRefresh()
-		}
+	if (tm.stateStore != nil || tm.sharedStore != nil) && tm.rateLimiter != nil {
+		tm.rateLimiter.SetCooldownChangeHook(nil)
 	}
-}
-
-// proactiveRefresh 检查并主动刷新即将过期的token
-func (tm *TokenManager) proactiveRefresh() {
-	tm.mutex.Lock()
-	defer tm.mutex.Unlock()
-
-	now := time.Now()
-	refreshed := 0
-
-	for i, cfg := range tm.configs {
-		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
-		cached, exists := tm.cache.tokens[cacheKey]
-
-		// 检查是否需要刷新：不存在、已过期、或即将过期
-		needRefresh := !exists ||
-			now.After(cached.Token.ExpiresAt) ||
-			cached.Token.ExpiresAt.Sub(now) < config.ProactiveRefreshThreshold
-
-		if !needRefresh {
-			continue
+	if tm.sharedStore != nil {
+		if err := tm.sharedStore.Close(); err != nil {
+			logger.Warn("关闭共享token状态存储失败", logger.Err(err))
 		}
-
-		// 刷新token
-		token, err := tm.refreshSingleToken(cfg)
-		if err != nil {
-			logger.Warn("主动刷新token失败",
-				logger.Int("config_index", i),
-				logger.Err(err))
-			continue
-		}
-
-		// 检查使用限制
-		var usageInfo *types.UsageLimits
-		var available float64
-		accountLevel := AccountLevelUnknown
-
-		checker := NewUsageLimitsChecker()
-		if usage, checkErr := checker.CheckUsageLimits(token); checkErr == nil {
-			usageInfo = usage
-			available = CalculateAvailableCount(usage)
-			accountLevel = DetectAccountLevelFromUsage(usage)
-		}
-
-		// 更新缓存
-		tm.cache.tokens[cacheKey] = &CachedToken{
-			Token:        token,
-			UsageInfo:    usageInfo,
-			CachedAt:     now,
-			Available:    available,
-			AccountLevel: accountLevel,
-			Disabled:     cfg.Disabled,
-		}
-
-		refreshed++
-		logger.Debug("主动刷新token成功",
-			logger.String("cache_key", cacheKey),
-			logger.String("new_expires_at", token.ExpiresAt.Format("2006-01-02T15:04:05Z07:00")))
 	}
-
-	if refreshed > 0 {
-		logger.Info("主动刷新完成",
-			logger.Int("refreshed_count", refreshed))
+	if tm.eventNotifier != nil {
+		if tm.rateLimiter != nil {
+			tm.rateLimiter.SetTokenEventHook(nil)
+		}
+		tm.eventNotifier.Stop()
 	}
 }
 
@@ -226,13 +254,14 @@ func (tm *TokenManager) getBestTokenForModel(requestedModel string) (types.Token
 	// 频率限制等待
 	if tm.rateLimiter != nil {
 		tm.rateLimiter.WaitForToken(tokenKey)
-		tm.rateLimiter.RecordRequest(tokenKey)
+		tm.recordRequest(tokenKey)
 
 		// 检查是否需要轮换（连续使用次数过多）
 		if tm.rateLimiter.ShouldRotate(tokenKey) {
 			tm.rateLimiter.ResetTokenCount(tokenKey)
 			tm.mutex.Lock()
 			tm.advanceToNextToken()
+			tm.publishRoundRobinCursorUnlocked()
 			logger.Info("触发轮询切换",
 				logger.String("reason", "consecutive_use_limit"),
 				logger.String("from_token", tokenKey),
@@ -259,40 +288,23 @@ func (tm *TokenManager) GetTokenWithFingerprint() (types.TokenInfo, *Fingerprint
 }
 
 // GetTokenWithFingerprintForModel 获取指定模型可用的token及其对应的指纹
+// 没有可用token时最多等待 TOKEN_WAIT_TIMEOUT
 func (tm *TokenManager) GetTokenWithFingerprintForModel(requestedModel string) (types.TokenInfo, *Fingerprint, error) {
-	tm.mutex.Lock()
-
-	// 检查是否需要刷新缓存
-	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
-		if err := tm.refreshCacheUnlocked(); err != nil {
-			logger.Warn("刷新token缓存失败", logger.Err(err))
-		}
-	}
-
-	// 选择下一个可用token（严格轮询 + 模型限制）
-	bestToken, tokenKey, modelSupported := tm.selectNextAvailableTokenForModelUnlocked(requestedModel)
-	if bestToken == nil {
-		tm.mutex.Unlock()
-		if requestedModel != "" && !modelSupported {
-			return types.TokenInfo{}, nil, types.NewModelNotFoundErrorType(
-				requestedModel,
-				fmt.Sprintf("model-gate-%d", time.Now().UnixNano()),
-			)
-		}
-		return types.TokenInfo{}, nil, fmt.Errorf("没有可用的token")
+	bestToken, tokenKey, err := tm.selectTokenForModelWithWait(context.Background(), requestedModel)
+	if err != nil {
+		return types.TokenInfo{}, nil, err
 	}
 
-	tm.mutex.Unlock()
-
 	// 频率限制等待
 	if tm.rateLimiter != nil {
 		tm.rateLimiter.WaitForToken(tokenKey)
-		tm.rateLimiter.RecordRequest(tokenKey)
+		tm.recordRequest(tokenKey)
 
 		if tm.rateLimiter.ShouldRotate(tokenKey) {
 			tm.rateLimiter.ResetTokenCount(tokenKey)
 			tm.mutex.Lock()
 			tm.advanceToNextToken()
+			tm.publishRoundRobinCursorUnlocked()
 			tm.mutex.Unlock()
 		}
 	}
@@ -302,9 +314,9 @@ func (tm *TokenManager) GetTokenWithFingerprintForModel(requestedModel string) (
 	if tm.fingerprintManager != nil {
 		bindingKey := tm.getBindingKeyForToken(tokenKey, bestToken)
 		if bindingKey != "" {
-			fingerprint = tm.fingerprintManager.GetFingerprintForBindingKey(bindingKey, tokenKey)
+			fingerprint = tm.fingerprintManager.AcquireFingerprintForBindingKey(bindingKey, tokenKey)
 		} else {
-			fingerprint = tm.fingerprintManager.GetFingerprint(tokenKey)
+			fingerprint = tm.fingerprintManager.AcquireFingerprint(tokenKey)
 		}
 	}
 
@@ -326,61 +338,68 @@ func (tm *TokenManager) GetTokenWithFingerprintForSession(sessionID string) (typ
 
 // GetTokenWithFingerprintForSessionAndModel 为会话获取指定模型可用的 Token（支持会话绑定）
 func (tm *TokenManager) GetTokenWithFingerprintForSessionAndModel(sessionID string, requestedModel string) (types.TokenInfo, *Fingerprint, string, error) {
+	return tm.GetTokenWithFingerprintForSessionAndModelContext(context.Background(), sessionID, requestedModel)
+}
+
+// GetTokenWithFingerprintForSessionAndModelContext 同 GetTokenWithFingerprintForSessionAndModel
+// 没有可用token时最多等待 TOKEN_WAIT_TIMEOUT，ctx 取消时提前返回
+func (tm *TokenManager) GetTokenWithFingerprintForSessionAndModelContext(ctx context.Context, sessionID string, requestedModel string) (types.TokenInfo, *Fingerprint, string, error) {
 	// 尝试获取会话绑定的 Token
 	sessionManager := GetSessionTokenBindingManager()
 	if token, fingerprint, tokenKey, bound := sessionManager.GetSessionToken(sessionID); bound {
-		// 检查 Token 是否仍然有效，且满足当前模型限制，且未被禁用
+		// 检查 Token 是否满足当前模型限制且未被禁用
+		// 跨模型保持绑定（SESSION_TOKEN_STICKY_ACROSS_MODELS）时只要账号可用于新模型就沿用，否则切换模型即重新分配
 		modelAllowed := tm.IsTokenAllowedForModel(tokenKey, requestedModel)
 		isDisabled := tm.isTokenDisabled(tokenKey)
-		if time.Now().Before(token.ExpiresAt) && modelAllowed && !isDisabled {
-			logger.Debug("使用会话绑定的Token",
-				logger.String("session_id", sessionID),
-				logger.String("token_key", tokenKey))
-			return token, fingerprint, tokenKey, nil
+		modelSwitched := !config.SessionTokenStickyAcrossModels && requestedModel != "" &&
+			sessionManager.SessionModel(sessionID) != requestedModel
+		// 与常规选择相同：冷却、熔断、每日限制、额度耗尽的账号不再沿用绑定
+		unavailableReason := tm.boundTokenUnavailableReason(tokenKey)
+		if modelAllowed && !isDisabled && !modelSwitched && unavailableReason == "" {
+			if time.Now().Before(token.ExpiresAt) {
+				logger.Debug("使用会话绑定的Token",
+					logger.String("session_id", sessionID),
+					logger.String("token_key", tokenKey))
+				tm.circuitBreaker.OnSelected(tokenKey)
+				return token, fingerprint, tokenKey, nil
+			}
+			// 绑定时的 Token 快照已过期，账号已刷新出新 Token 时沿用同一账号，保持会话连续
+			if refreshed, ok := tm.validCachedToken(tokenKey); ok {
+				sessionManager.UpdateSessionToken(sessionID, tokenKey, refreshed)
+				logger.Debug("会话绑定的Token已刷新，继续使用同一账号",
+					logger.String("session_id", sessionID),
+					logger.String("token_key", tokenKey))
+				tm.circuitBreaker.OnSelected(tokenKey)
+				return refreshed, fingerprint, tokenKey, nil
+			}
 		}
 
-		// Token 已过期、不满足模型限制或已被禁用，解绑会话
+		// Token 已过期、不满足模型限制、已被禁用、切换了模型或账号暂不可用，解绑会话
 		sessionManager.UnbindSession(sessionID)
 		logger.Debug("会话绑定的Token不可用，重新分配",
 			logger.String("session_id", sessionID),
 			logger.Bool("model_allowed", modelAllowed),
-			logger.Bool("is_disabled", isDisabled))
+			logger.Bool("is_disabled", isDisabled),
+			logger.Bool("model_switched", modelSwitched),
+			logger.String("unavailable_reason", unavailableReason))
 	}
 
 	// 获取新 Token
-	tm.mutex.Lock()
-
-	// 检查是否需要刷新缓存
-	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
-		if err := tm.refreshCacheUnlocked(); err != nil {
-			logger.Warn("刷新token缓存失败", logger.Err(err))
-		}
-	}
-
-	// 选择下一个可用token（严格轮询 + 模型限制）
-	bestToken, tokenKey, modelSupported := tm.selectNextAvailableTokenForModelUnlocked(requestedModel)
-	if bestToken == nil {
-		tm.mutex.Unlock()
-		if requestedModel != "" && !modelSupported {
-			return types.TokenInfo{}, nil, "", types.NewModelNotFoundErrorType(
-				requestedModel,
-				fmt.Sprintf("model-gate-%d", time.Now().UnixNano()),
-			)
-		}
-		return types.TokenInfo{}, nil, "", fmt.Errorf("没有可用的token")
+	bestToken, tokenKey, err := tm.selectTokenForModelWithWait(ctx, requestedModel)
+	if err != nil {
+		return types.TokenInfo{}, nil, "", err
 	}
 
-	tm.mutex.Unlock()
-
 	// 频率限制等待
 	if tm.rateLimiter != nil {
 		tm.rateLimiter.WaitForToken(tokenKey)
-		tm.rateLimiter.RecordRequest(tokenKey)
+		tm.recordRequest(tokenKey)
 
 		if tm.rateLimiter.ShouldRotate(tokenKey) {
 			tm.rateLimiter.ResetTokenCount(tokenKey)
 			tm.mutex.Lock()
 			tm.advanceToNextToken()
+			tm.publishRoundRobinCursorUnlocked()
 			tm.mutex.Unlock()
 		}
 	}
@@ -390,9 +409,9 @@ func (tm *TokenManager) GetTokenWithFingerprintForSessionAndModel(sessionID stri
 	if tm.fingerprintManager != nil {
 		bindingKey := tm.getBindingKeyForToken(tokenKey, bestToken)
 		if bindingKey != "" {
-			fingerprint = tm.fingerprintManager.GetFingerprintForBindingKey(bindingKey, tokenKey)
+			fingerprint = tm.fingerprintManager.AcquireFingerprintForBindingKey(bindingKey, tokenKey)
 		} else {
-			fingerprint = tm.fingerprintManager.GetFingerprint(tokenKey)
+			fingerprint = tm.fingerprintManager.AcquireFingerprint(tokenKey)
 		}
 	}
 
@@ -405,7 +424,7 @@ func (tm *TokenManager) GetTokenWithFingerprintForSessionAndModel(sessionID stri
 	tm.mutex.Unlock()
 
 	// 绑定会话到 Token
-	sessionManager.BindSessionToken(sessionID, tokenKey, token, fingerprint)
+	sessionManager.BindSessionToken(sessionID, tokenKey, requestedModel, token, fingerprint)
 
 	logger.Debug("为会话分配新Token",
 		logger.String("session_id", sessionID),
@@ -414,27 +433,96 @@ func (tm *TokenManager) GetTokenWithFingerprintForSessionAndModel(sessionID stri
 	return token, fingerprint, tokenKey, nil
 }
 
-// MarkTokenFailed 标记token请求失败，触发冷却
+// validCachedToken 返回账号缓存中未过期的 Token（缓存超过 TokenCacheTTL 时先刷新）
+func (tm *TokenManager) validCachedToken(tokenKey string) (types.TokenInfo, bool) {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
+		if err := tm.refreshCacheUnlocked(); err != nil {
+			logger.Warn("刷新token缓存失败", logger.Err(err))
+		}
+	}
+
+	cached, exists := tm.cache.tokens[tokenKey]
+	if !exists || !time.Now().Before(cached.Token.ExpiresAt) {
+		return types.TokenInfo{}, false
+	}
+	cached.LastUsed = time.Now()
+	return cached.Token, true
+}
+
+// MarkTokenFailed 标记token请求失败，触发冷却并计入熔断
 func (tm *TokenManager) MarkTokenFailed(tokenKey string) {
 	if tm.rateLimiter != nil {
 		tm.rateLimiter.MarkTokenCooldown(tokenKey)
 	}
+	tm.circuitBreaker.RecordFailure(tokenKey)
 
 	tm.mutex.Lock()
 	defer tm.mutex.Unlock()
 
 	// 切换到下一个token
 	tm.advanceToNextToken()
+	tm.publishRoundRobinCursorUnlocked()
 	logger.Warn("Token请求失败，切换到下一个",
 		logger.String("failed_token", tokenKey),
 		logger.Int("next_index", tm.currentIndex))
 }
 
-// MarkTokenSuccess 标记token请求成功，重置失败计数
+// MarkTokenExhausted 标记token额度耗尽（如 402 MONTHLY_REQUEST_COUNT）
+// 耗尽标记会被持久化，直到使用限制检查显示额度恢复
+func (tm *TokenManager) MarkTokenExhausted(tokenKey string) {
+	tm.mutex.Lock()
+	tm.exhausted[tokenKey] = true
+	if cached, exists := tm.cache.tokens[tokenKey]; exists {
+		cached.Available = 0
+	}
+	tm.advanceToNextToken()
+	tm.publishRoundRobinCursorUnlocked()
+	tm.mutex.Unlock()
+
+	logger.Warn("Token额度耗尽，已标记",
+		logger.String("token_key", tokenKey))
+
+	tm.notifyTokenEvent(TokenEvent{
+		Event:     TokenEventExhausted,
+		TokenKey:  tokenKey,
+		Reason:    "额度耗尽（402）",
+		Timestamp: time.Now(),
+	})
+	tm.persistState()
+}
+
+// clearExhaustedUnlocked 额度恢复时清除耗尽标记，返回是否有变化
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) clearExhaustedUnlocked(tokenKey string, available float64) bool {
+	if available <= 0 || !tm.exhausted[tokenKey] {
+		return false
+	}
+	delete(tm.exhausted, tokenKey)
+	logger.Info("Token额度已恢复，清除耗尽标记",
+		logger.String("token_key", tokenKey),
+		logger.Float64("available", available))
+	return true
+}
+
+// MarkTokenSuccess 标记token请求成功，重置失败计数并关闭熔断
 func (tm *TokenManager) MarkTokenSuccess(tokenKey string) {
-	if tm.rateLimiter != nil {
-		tm.rateLimiter.RecordSuccess(tokenKey)
+	if tm.rateLimiter != nil && tm.rateLimiter.RecordSuccess(tokenKey) {
+		tm.clearSharedCooldown(tokenKey)
 	}
+	tm.circuitBreaker.RecordSuccess(tokenKey)
+}
+
+// RecordTokenError 记录上游5xx等账号级错误：只计入熔断，不触发冷却
+func (tm *TokenManager) RecordTokenError(tokenKey string) {
+	tm.circuitBreaker.RecordFailure(tokenKey)
+}
+
+// GetCircuitBreakerStatus 获取token的熔断状态
+func (tm *TokenManager) GetCircuitBreakerStatus(tokenKey string) CircuitBreakerStatus {
+	return tm.circuitBreaker.Status(tokenKey)
 }
 
 // GetCurrentTokenKey 获取当前token的key
@@ -448,10 +536,52 @@ func (tm *TokenManager) GetCurrentTokenKey() string {
 	return tm.configOrder[tm.currentIndex]
 }
 
+// PoolHealth token池健康状况
+type PoolHealth struct {
+	Total     int // 配置的token总数
+	Active    int // 当前可分配的token数（未过期、有额度、不在冷却期、未禁用、未耗尽）
+	Exhausted int // 已标记额度耗尽或额度为0的token数
+
+	CacheRefreshed bool // 是否已完成首次token缓存刷新，或已有可分配的token（如部分账号预热成功）
+}
+
+// GetPoolHealth 统计token池可用情况（只读，不触发刷新）
+func (tm *TokenManager) GetPoolHealth() PoolHealth {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	health := PoolHealth{Total: len(tm.configOrder), CacheRefreshed: !tm.lastRefresh.IsZero()}
+	for _, key := range tm.configOrder {
+		cached, exists := tm.cache.tokens[key]
+		if tm.exhausted[key] || (exists && cached.Available <= 0) {
+			health.Exhausted++
+		}
+		if !exists || cached.Disabled || tm.exhausted[key] || !cached.IsUsable() {
+			continue
+		}
+		if tm.rateLimiter != nil && tm.rateLimiter.IsTokenInCooldown(key) {
+			continue
+		}
+		health.Active++
+	}
+	// 预热时有账号失败不会更新 lastRefresh（保留懒刷新以便重试），已有可用token时同样视为就绪
+	if health.Active > 0 {
+		health.CacheRefreshed = true
+	}
+	return health
+}
+
 // IsTokenAllowedForModel 判断指定 token 是否允许请求某个模型
 func (tm *TokenManager) IsTokenAllowedForModel(tokenKey, requestedModel string) bool {
 	requestedModel = strings.TrimSpace(requestedModel)
-	if requestedModel == "" || !config.ModelAccessControlEnabled {
+	if requestedModel == "" {
+		return true
+	}
+	// 账号配置的模型白名单优先于等级检测
+	if allowed, ok := tm.allowedModels[tokenKey]; ok {
+		return IsModelInAllowlist(allowed, requestedModel)
+	}
+	if !config.ModelAccessControlEnabled {
 		return true
 	}
 
@@ -533,6 +663,51 @@ func (tm *TokenManager) getAuthConfigByTokenKey(tokenKey string) (AuthConfig, bo
 	return tm.configs[index], true
 }
 
+// GetProxyForToken 返回 tokenKey 对应账号绑定的出口代理（未绑定返回空）
+func (tm *TokenManager) GetProxyForToken(tokenKey string) string {
+	cfg, ok := tm.getAuthConfigByTokenKey(tokenKey)
+	if !ok {
+		return ""
+	}
+	return cfg.Proxy
+}
+
+// GetAccountLevelForToken 获取指定token的账号等级（无缓存时返回 unknown）
+func (tm *TokenManager) GetAccountLevelForToken(tokenKey string) AccountLevel {
+	tm.mutex.RLock()
+	cached, exists := tm.cache.tokens[tokenKey]
+	tm.mutex.RUnlock()
+	if !exists {
+		return AccountLevelUnknown
+	}
+
+	if cached.AccountLevel != "" {
+		return cached.AccountLevel
+	}
+	return DetectAccountLevelFromUsage(cached.UsageInfo)
+}
+
+// boundTokenUnavailableReason 检查会话绑定的账号当前是否可继续使用
+// 返回不可用原因（冷却/熔断/每日限制/额度耗尽），可用时返回空字符串
+func (tm *TokenManager) boundTokenUnavailableReason(tokenKey string) string {
+	if tm.rateLimiter != nil && tm.rateLimiter.IsTokenInCooldown(tokenKey) {
+		return "cooldown"
+	}
+	if !tm.circuitBreaker.Allow(tokenKey) {
+		return "circuit_open"
+	}
+	if tm.rateLimiter != nil && tm.rateLimiter.IsDailyLimitExceeded(tokenKey) {
+		return "daily_limit"
+	}
+	tm.mutex.RLock()
+	exhausted := tm.exhausted[tokenKey]
+	tm.mutex.RUnlock()
+	if exhausted {
+		return "exhausted"
+	}
+	return ""
+}
+
 // isTokenDisabled 检查指定 tokenKey 对应的 token 是否已被临时禁用
 func (tm *TokenManager) isTokenDisabled(tokenKey string) bool {
 	cfg, ok := tm.getAuthConfigByTokenKey(tokenKey)
@@ -590,7 +765,7 @@ func (tm *TokenManager) selectNextAvailableTokenForModelUnlocked(requestedModel
 			if time.Since(cached.CachedAt) > tm.cache.ttl {
 				continue
 			}
-			if !tm.isCachedTokenModelAllowed(cached, requestedModel) {
+			if !tm.isCachedTokenModelAllowed(key, cached, requestedModel) {
 				continue
 			}
 			modelSupported = true
@@ -604,6 +779,15 @@ func (tm *TokenManager) selectNextAvailableTokenForModelUnlocked(requestedModel
 		return nil, "", modelSupported
 	}
 
+	// 非轮询策略：在全部可用token中按策略挑选
+	if tm.strategy == SelectionStrategyWeighted || tm.strategy == SelectionStrategyLRU {
+		cached, key, modelSupported := tm.selectByStrategyUnlocked(requestedModel)
+		if cached != nil {
+			tm.circuitBreaker.OnSelected(key)
+		}
+		return cached, key, modelSupported
+	}
+
 	// 从当前索引开始，尝试找到一个可用的token
 	startIndex := tm.currentIndex
 	tried := 0
@@ -625,9 +809,9 @@ func (tm *TokenManager) selectNextAvailableTokenForModelUnlocked(requestedModel
 			continue
 		}
 
-		// 检查账号等级是否允许该模型
-		if !tm.isCachedTokenModelAllowed(cached, requestedModel) {
-			logger.Debug("token账号等级不支持当前模型，跳过",
+		// 检查账号模型白名单/账号等级是否允许该模型
+		if !tm.isCachedTokenModelAllowed(key, cached, requestedModel) {
+			logger.Debug("token不支持当前模型（模型白名单或账号等级），跳过",
 				logger.String("token_key", key),
 				logger.String("requested_model", requestedModel),
 				logger.String("account_level", string(tm.getCachedTokenLevel(cached))))
@@ -646,6 +830,15 @@ func (tm *TokenManager) selectNextAvailableTokenForModelUnlocked(requestedModel
 			continue
 		}
 
+		// 检查熔断状态（打开或半开探测进行中）
+		if !tm.circuitBreaker.Allow(key) {
+			logger.Debug("token熔断中，跳过",
+				logger.String("token_key", key))
+			tm.advanceToNextToken()
+			tried++
+			continue
+		}
+
 		// 检查每日限制
 		if tm.rateLimiter != nil && tm.rateLimiter.IsDailyLimitExceeded(key) {
 			logger.Debug("token已达每日限制，跳过",
@@ -656,6 +849,13 @@ func (tm *TokenManager) selectNextAvailableTokenForModelUnlocked(requestedModel
 			continue
 		}
 
+		// 跳过已标记额度耗尽的 token
+		if tm.exhausted[key] {
+			tm.advanceToNextToken()
+			tried++
+			continue
+		}
+
 		// 跳过被临时禁用的 token（依然刷新，但不分配给请求）
 		if cached.Disabled {
 			tm.advanceToNextToken()
@@ -677,6 +877,10 @@ func (tm *TokenManager) selectNextAvailableTokenForModelUnlocked(requestedModel
 			logger.Int("current_index", tm.currentIndex),
 			logger.Int("start_index", startIndex))
 
+		if tm.currentIndex != startIndex {
+			tm.publishRoundRobinCursorUnlocked()
+		}
+		tm.circuitBreaker.OnSelected(key)
 		return cached, key, true
 	}
 
@@ -699,7 +903,11 @@ func (tm *TokenManager) getCachedTokenLevel(cached *CachedToken) AccountLevel {
 	return level
 }
 
-func (tm *TokenManager) isCachedTokenModelAllowed(cached *CachedToken, requestedModel string) bool {
+// isCachedTokenModelAllowed 判断token是否允许请求该模型：配置了 allowedModels 的账号按白名单判断，否则按账号等级
+func (tm *TokenManager) isCachedTokenModelAllowed(key string, cached *CachedToken, requestedModel string) bool {
+	if allowed, ok := tm.allowedModels[key]; ok {
+		return IsModelInAllowlist(allowed, requestedModel)
+	}
 	level := tm.getCachedTokenLevel(cached)
 	return IsModelAllowedForLevel(level, requestedModel)
 }
@@ -720,6 +928,8 @@ func (tm *TokenManager) selectBestTokenWithKeyUnlocked() (*CachedToken, string)
 // 内部方法：调用者必须持有 tm.mutex
 func (tm *TokenManager) refreshCacheUnlocked() error {
 	logger.Debug("开始刷新token缓存")
+	stateChanged := false
+	usageCheckNeeded := false
 
 	for i, cfg := range tm.configs {
 		// 刷新token
@@ -732,40 +942,68 @@ func (tm *TokenManager) refreshCacheUnlocked() error {
 			continue
 		}
 
-		// 检查使用限制
-		var usageInfo *types.UsageLimits
-		var available float64
-		accountLevel := AccountLevelUnknown
+		tm.applyRotatedRefreshTokenUnlocked(i, cfg.RefreshToken, token.RefreshToken)
 
-		checker := NewUsageLimitsChecker()
-		if usage, checkErr := checker.CheckUsageLimits(token); checkErr == nil {
-			usageInfo = usage
-			available = CalculateAvailableCount(usage)
-			accountLevel = DetectAccountLevelFromUsage(usage)
+		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		cached := &CachedToken{
+			Token:        token,
+			CachedAt:     time.Now(),
+			AccountLevel: AccountLevelUnknown,
+			Disabled:     cfg.Disabled,
+		}
+
+		// 启用后台使用限制检查时不在锁内查询：沿用上次已知的额度，尚无已知额度时立即触发一次后台检查；
+		// 未启用后台检查时同步检查使用限制
+		if config.UsageCheckInterval > 0 {
+			if previous, ok := tm.cache.tokens[cacheKey]; ok {
+				cached.UsageInfo = previous.UsageInfo
+				cached.Available = previous.Available
+				cached.AccountLevel = previous.AccountLevel
+				cached.UsageCheckedAt = previous.UsageCheckedAt
+			}
+			if cached.UsageCheckedAt.IsZero() {
+				cached.usagePending = true
+				usageCheckNeeded = true
+			}
+		} else if usage, checkErr := NewUsageLimitsChecker().CheckUsageLimits(token); checkErr == nil {
+			cached.applyUsageLimits(usage, time.Now())
+			tm.recordUsageSnapshotUnlocked(cacheKey, cached.Available, cached.UsageCheckedAt)
 		} else {
 			logger.Warn("检查使用限制失败", logger.Err(checkErr))
 		}
 
 		// 更新缓存（直接访问，已在tm.mutex保护下）
-		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
-		tm.cache.tokens[cacheKey] = &CachedToken{
-			Token:        token,
-			UsageInfo:    usageInfo,
-			CachedAt:     time.Now(),
-			Available:    available,
-			AccountLevel: accountLevel,
-			Disabled:     cfg.Disabled,
+		tm.cache.tokens[cacheKey] = cached
+
+		if tm.clearExhaustedUnlocked(cacheKey, cached.Available) {
+			stateChanged = true
 		}
 
 		logger.Debug("token缓存更新",
 			logger.String("cache_key", cacheKey),
-			logger.Float64("available", available))
+			logger.Float64("available", cached.Available))
+	}
+
+	if stateChanged {
+		go tm.persistState()
+	}
+	if usageCheckNeeded {
+		tm.requestUsageCheck()
 	}
 
 	tm.lastRefresh = time.Now()
 	return nil
 }
 
+// applyUsageLimits 使用查询到的使用限制更新可用额度与账号等级
+func (ct *CachedToken) applyUsageLimits(usage *types.UsageLimits, at time.Time) {
+	ct.UsageInfo = usage
+	ct.Available = CalculateAvailableCount(usage)
+	ct.AccountLevel = DetectAccountLevelFromUsage(usage)
+	ct.UsageCheckedAt = at
+	ct.usagePending = false
+}
+
 // IsUsable 检查缓存的token是否可用
 func (ct *CachedToken) IsUsable() bool {
 	// 检查token是否过期
@@ -773,8 +1011,8 @@ func (ct *CachedToken) IsUsable() bool {
 		return false
 	}
 
-	// 检查可用次数
-	return ct.Available > 0
+	// 检查可用次数（额度尚待后台检查时先放行）
+	return ct.Available > 0 || ct.usagePending
 }
 
 // CalculateAvailableCount 计算可用次数 (基于CREDIT资源类型，返回浮点精度)
@@ -808,6 +1046,47 @@ func CalculateAvailableCount(usage *types.UsageLimits) float64 {
 	return 0.0
 }
 
+// buildDailyLimits 收集账号配置的每日上限（tokenKey -> DailyLimit），未配置的账号使用全局默认值
+func buildDailyLimits(configs []AuthConfig) map[string]int {
+	limits := make(map[string]int)
+	for i, cfg := range configs {
+		if cfg.DailyLimit != 0 {
+			limits[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = cfg.DailyLimit
+		}
+	}
+	return limits
+}
+
+// buildRequestSpacings 收集账号配置的请求间隔硬下限（tokenKey -> MinRequestSpacing），无法解析的值忽略并告警
+func buildRequestSpacings(configs []AuthConfig) map[string]time.Duration {
+	spacings := make(map[string]time.Duration)
+	for i, cfg := range configs {
+		if cfg.MinRequestSpacing == "" {
+			continue
+		}
+		spacing, err := time.ParseDuration(cfg.MinRequestSpacing)
+		if err != nil || spacing < 0 {
+			logger.Warn("账号 minRequestSpacing 无效，使用全局默认值",
+				logger.Int("config_index", i),
+				logger.String("min_request_spacing", cfg.MinRequestSpacing))
+			continue
+		}
+		spacings[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = spacing
+	}
+	return spacings
+}
+
+// buildAllowedModels 收集账号配置的模型白名单（tokenKey -> AllowedModels），未配置的账号不在结果中
+func buildAllowedModels(configs []AuthConfig) map[string][]string {
+	allowed := make(map[string][]string)
+	for i, cfg := range configs {
+		if len(cfg.AllowedModels) > 0 {
+			allowed[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = cfg.AllowedModels
+		}
+	}
+	return allowed
+}
+
 // generateConfigOrder 生成token配置的顺序
 func generateConfigOrder(configs []AuthConfig) []string {
 	var order []string
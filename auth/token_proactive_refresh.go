@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// refreshFailure 主动刷新失败的退避状态
+type refreshFailure struct {
+	count   int       // 连续失败次数
+	retryAt time.Time // 在此之前不再主动刷新
+}
+
+// proactiveRefreshJob 一次待执行的主动刷新
+type proactiveRefreshJob struct {
+	index    int
+	cacheKey string
+	cfg      AuthConfig
+	delay    time.Duration // 相对本轮开始的错开时间
+}
+
+// proactiveRefreshLoop 主动刷新循环
+func (tm *TokenManager) proactiveRefreshLoop() {
+	ticker := time.NewTicker(config.ProactiveRefreshInterval)
+	defer ticker.Stop()
+
+	logger.Info("主动刷新goroutine已启动",
+		logger.Duration("interval", config.ProactiveRefreshInterval),
+		logger.Duration("threshold", config.ProactiveRefreshThreshold),
+		logger.Bool("jitter", config.ProactiveRefreshJitter))
+
+	for {
+		select {
+		case <-tm.ctx.Done():
+			logger.Info("主动刷新goroutine已停止")
+			return
+		case <-ticker.C:
+			tm.proactiveRefresh()
+		}
+	}
+}
+
+// proactiveRefresh 检查并主动刷新即将过期的token
+func (tm *TokenManager) proactiveRefresh() {
+	tm.proactiveRefreshWithLoader(tm.loadCachedToken)
+}
+
+// proactiveRefreshWithLoader 使用指定的加载函数刷新即将过期的token
+// 各token按错开时间并发刷新，本轮全部结束后才返回（错开时间不超过检查间隔，不会与下一轮重叠）
+func (tm *TokenManager) proactiveRefreshWithLoader(load func(AuthConfig) (*CachedToken, error)) {
+	jobs := tm.collectProactiveRefreshJobs(time.Now())
+	if len(jobs) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	refreshed, failed := 0, 0
+	for _, job := range jobs {
+		wg.Add(1)
+		go func(job proactiveRefreshJob) {
+			defer wg.Done()
+			if job.delay > 0 {
+				timer := time.NewTimer(job.delay)
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-tm.ctx.Done():
+					return
+				}
+			}
+
+			ok := tm.runProactiveRefresh(job, load)
+			mu.Lock()
+			if ok {
+				refreshed++
+			} else {
+				failed++
+			}
+			mu.Unlock()
+		}(job)
+	}
+	wg.Wait()
+
+	logger.Info("主动刷新完成",
+		logger.Int("refreshed_count", refreshed),
+		logger.Int("failed_count", failed))
+}
+
+// collectProactiveRefreshJobs 找出需要刷新的token：不存在、已过期、或在 PROACTIVE_REFRESH_THRESHOLD 内过期
+// 处于失败退避期内的token跳过
+func (tm *TokenManager) collectProactiveRefreshJobs(now time.Time) []proactiveRefreshJob {
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	var jobs []proactiveRefreshJob
+	for i, cfg := range tm.configs {
+		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		cached, exists := tm.cache.tokens[cacheKey]
+
+		needRefresh := !exists ||
+			now.After(cached.Token.ExpiresAt) ||
+			cached.Token.ExpiresAt.Sub(now) < config.ProactiveRefreshThreshold
+		if !needRefresh {
+			continue
+		}
+		if failure, ok := tm.refreshFailures[cacheKey]; ok && now.Before(failure.retryAt) {
+			continue
+		}
+
+		var remaining time.Duration
+		if exists {
+			remaining = cached.Token.ExpiresAt.Sub(now)
+		}
+		jobs = append(jobs, proactiveRefreshJob{
+			index:    i,
+			cacheKey: cacheKey,
+			cfg:      cfg,
+			delay:    tm.proactiveRefreshDelayUnlocked(remaining),
+		})
+	}
+	return jobs
+}
+
+// proactiveRefreshDelayUnlocked 本轮内的随机错开时间，范围 [0, min(检查间隔, 剩余有效期/2))
+// 已过期或尚未缓存（remaining<=0）时立即刷新
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) proactiveRefreshDelayUnlocked(remaining time.Duration) time.Duration {
+	if !config.ProactiveRefreshJitter || remaining <= 0 {
+		return 0
+	}
+	spread := min(config.ProactiveRefreshInterval, remaining/2)
+	if spread <= 0 {
+		return 0
+	}
+	return time.Duration(tm.randInt63nUnlocked(int64(spread)))
+}
+
+// proactiveRefreshBackoffUnlocked 连续失败 failures 次后的重试等待：基数按2倍递增，不超过上限，叠加 0-20% 抖动
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) proactiveRefreshBackoffUnlocked(failures int) time.Duration {
+	backoff := config.ProactiveRefreshBackoffBase
+	for i := 1; i < failures && backoff < config.ProactiveRefreshBackoffMax; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, config.ProactiveRefreshBackoffMax)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff + time.Duration(tm.randInt63nUnlocked(int64(backoff)/5+1))
+}
+
+// randInt63nUnlocked 使用 tm.rng 生成 [0, n) 的随机数（未初始化时使用全局随机源）
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) randInt63nUnlocked(n int64) int64 {
+	if tm.rng == nil {
+		return rand.Int63n(n)
+	}
+	return tm.rng.Int63n(n)
+}
+
+// runProactiveRefresh 刷新单个token并写入缓存，失败时记录退避状态；返回是否刷新成功
+func (tm *TokenManager) runProactiveRefresh(job proactiveRefreshJob, load func(AuthConfig) (*CachedToken, error)) bool {
+	cached, err := load(job.cfg)
+
+	tm.mutex.Lock()
+	// 刷新期间账号配置已重载，结果不再对应该索引
+	if job.index >= len(tm.configs) || tm.configs[job.index].RefreshToken != job.cfg.RefreshToken {
+		tm.mutex.Unlock()
+		return false
+	}
+
+	if err != nil {
+		if tm.refreshFailures == nil {
+			tm.refreshFailures = make(map[string]*refreshFailure)
+		}
+		failure, ok := tm.refreshFailures[job.cacheKey]
+		if !ok {
+			failure = &refreshFailure{}
+			tm.refreshFailures[job.cacheKey] = failure
+		}
+		failure.count++
+		failure.retryAt = time.Now().Add(tm.proactiveRefreshBackoffUnlocked(failure.count))
+		count, retryAt := failure.count, failure.retryAt
+		tm.mutex.Unlock()
+
+		logger.Warn("主动刷新token失败",
+			logger.Int("config_index", job.index),
+			logger.Int("consecutive_failures", count),
+			logger.String("retry_at", retryAt.Format(time.RFC3339)),
+			logger.Err(err))
+		return false
+	}
+
+	tm.applyRotatedRefreshTokenUnlocked(job.index, job.cfg.RefreshToken, cached.Token.RefreshToken)
+	delete(tm.refreshFailures, job.cacheKey)
+	tm.cache.tokens[job.cacheKey] = cached
+	if cached.UsageInfo != nil {
+		tm.recordUsageSnapshotUnlocked(job.cacheKey, cached.Available, cached.CachedAt)
+	}
+	stateChanged := tm.clearExhaustedUnlocked(job.cacheKey, cached.Available)
+	tm.mutex.Unlock()
+
+	if stateChanged {
+		go tm.persistState()
+	}
+	logger.Debug("主动刷新token成功",
+		logger.String("cache_key", job.cacheKey),
+		logger.String("new_expires_at", cached.Token.ExpiresAt.Format("2006-01-02T15:04:05Z07:00")))
+	return true
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+// withProactiveRefreshConfig 临时修改主动刷新配置
+func withProactiveRefreshConfig(t *testing.T, interval, backoffBase time.Duration, jitter bool) {
+	t.Helper()
+	origInterval, origBase, origJitter := config.ProactiveRefreshInterval, config.ProactiveRefreshBackoffBase, config.ProactiveRefreshJitter
+	config.ProactiveRefreshInterval, config.ProactiveRefreshBackoffBase, config.ProactiveRefreshJitter = interval, backoffBase, jitter
+	t.Cleanup(func() {
+		config.ProactiveRefreshInterval, config.ProactiveRefreshBackoffBase, config.ProactiveRefreshJitter = origInterval, origBase, origJitter
+	})
+}
+
+func refreshedCachedToken(cfg AuthConfig) *CachedToken {
+	return &CachedToken{
+		Token:     types.TokenInfo{AccessToken: "refreshed_" + cfg.RefreshToken, ExpiresAt: time.Now().Add(time.Hour)},
+		CachedAt:  time.Now(),
+		Available: 10,
+	}
+}
+
+func TestProactiveRefresh_StaggersNearExpiryTokens(t *testing.T) {
+	withProactiveRefreshConfig(t, 200*time.Millisecond, time.Minute, true)
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10, 10, 10, 10})
+	tm.mutex.Lock()
+	tm.cache.tokens["token_0"].Token.ExpiresAt = time.Now().Add(time.Minute)
+	tm.cache.tokens["token_1"].Token.ExpiresAt = time.Now().Add(time.Minute)
+	tm.cache.tokens["token_2"].Token.ExpiresAt = time.Now().Add(-time.Minute) // 已过期，立即刷新
+	tm.mutex.Unlock()
+
+	start := time.Now()
+	var mu sync.Mutex
+	loadedAfter := map[string]time.Duration{}
+	tm.proactiveRefreshWithLoader(func(cfg AuthConfig) (*CachedToken, error) {
+		mu.Lock()
+		loadedAfter[cfg.RefreshToken] = time.Since(start)
+		mu.Unlock()
+		return refreshedCachedToken(cfg), nil
+	})
+
+	if len(loadedAfter) != 3 {
+		t.Fatalf("期望刷新3个即将过期或已过期的token，实际 %v", loadedAfter)
+	}
+	if _, ok := loadedAfter["token3"]; ok {
+		t.Errorf("未临近过期的token不应刷新")
+	}
+	if loadedAfter["token2"] > 50*time.Millisecond {
+		t.Errorf("已过期的token应立即刷新，实际延迟 %v", loadedAfter["token2"])
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("错开时间不应超过检查间隔，本轮耗时 %v", elapsed)
+	}
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	if got := tm.cache.tokens["token_0"].Token.AccessToken; got != "refreshed_token0" {
+		t.Errorf("刷新结果应写入缓存，实际 %s", got)
+	}
+}
+
+func TestProactiveRefresh_DelayWithinInterval(t *testing.T) {
+	withProactiveRefreshConfig(t, time.Minute, time.Minute, true)
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10})
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	for range 100 {
+		if delay := tm.proactiveRefreshDelayUnlocked(4 * time.Minute); delay < 0 || delay >= time.Minute {
+			t.Fatalf("错开时间应在检查间隔内，实际 %v", delay)
+		}
+		if delay := tm.proactiveRefreshDelayUnlocked(30 * time.Second); delay >= 15*time.Second {
+			t.Fatalf("错开时间不应超过剩余有效期的一半，实际 %v", delay)
+		}
+	}
+	if delay := tm.proactiveRefreshDelayUnlocked(0); delay != 0 {
+		t.Errorf("已过期的token应立即刷新，实际 %v", delay)
+	}
+
+	config.ProactiveRefreshJitter = false
+	if delay := tm.proactiveRefreshDelayUnlocked(4 * time.Minute); delay != 0 {
+		t.Errorf("关闭抖动后应立即刷新，实际 %v", delay)
+	}
+}
+
+func TestProactiveRefresh_BacksOffAfterFailure(t *testing.T) {
+	withProactiveRefreshConfig(t, 10*time.Millisecond, time.Minute, false)
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10})
+	tm.mutex.Lock()
+	tm.cache.tokens["token_0"].Token.ExpiresAt = time.Now().Add(time.Minute)
+	tm.mutex.Unlock()
+
+	calls := 0
+	failing := func(cfg AuthConfig) (*CachedToken, error) {
+		calls++
+		return nil, errors.New("refresh failed")
+	}
+	tm.proactiveRefreshWithLoader(failing)
+	tm.proactiveRefreshWithLoader(failing)
+	if calls != 1 {
+		t.Fatalf("失败后退避期内不应重试，实际调用 %d 次", calls)
+	}
+
+	tm.mutex.Lock()
+	failure := tm.refreshFailures["token_0"]
+	if failure == nil || failure.count != 1 || time.Until(failure.retryAt) < 50*time.Second {
+		t.Fatalf("期望记录约1分钟的退避，实际 %+v", failure)
+	}
+	// 退避到期后重试，连续失败时等待翻倍
+	failure.retryAt = time.Now().Add(-time.Second)
+	tm.mutex.Unlock()
+
+	tm.proactiveRefreshWithLoader(failing)
+	tm.mutex.Lock()
+	if failure := tm.refreshFailures["token_0"]; calls != 2 || failure.count != 2 || time.Until(failure.retryAt) < 110*time.Second {
+		t.Errorf("期望第二次失败后退避约2分钟，实际调用 %d 次 %+v", calls, failure)
+	}
+	tm.refreshFailures["token_0"].retryAt = time.Now().Add(-time.Second)
+	tm.mutex.Unlock()
+
+	tm.proactiveRefreshWithLoader(func(cfg AuthConfig) (*CachedToken, error) { return refreshedCachedToken(cfg), nil })
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	if _, ok := tm.refreshFailures["token_0"]; ok {
+		t.Errorf("刷新成功后应清除退避状态")
+	}
+}
+
+func TestProactiveRefresh_BackoffCapped(t *testing.T) {
+	withProactiveRefreshConfig(t, time.Minute, time.Minute, true)
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10})
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+
+	if got := tm.proactiveRefreshBackoffUnlocked(20); got < config.ProactiveRefreshBackoffMax || got > config.ProactiveRefreshBackoffMax*6/5 {
+		t.Errorf("退避应以 PROACTIVE_REFRESH_BACKOFF_MAX 为上限（含抖动），实际 %v", got)
+	}
+}
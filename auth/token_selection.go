@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"kiro2api/logger"
+)
+
+// SelectionStrategy token选择策略
+type SelectionStrategy string
+
+const (
+	// SelectionStrategyRoundRobin 严格轮询（默认）
+	SelectionStrategyRoundRobin SelectionStrategy = "round_robin"
+	// SelectionStrategyWeighted 按剩余额度（CachedToken.Available）加权随机
+	SelectionStrategyWeighted SelectionStrategy = "weighted"
+	// SelectionStrategyLRU 最久未使用优先
+	SelectionStrategyLRU SelectionStrategy = "lru"
+)
+
+// ParseSelectionStrategy 解析选择策略名称，未知值回退到严格轮询
+func ParseSelectionStrategy(name string) SelectionStrategy {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "round_robin", "round-robin", "roundrobin", "rr":
+		return SelectionStrategyRoundRobin
+	case "weighted", "weighted_by_available", "weighted-by-available":
+		return SelectionStrategyWeighted
+	case "lru", "least_recently_used", "least-recently-used":
+		return SelectionStrategyLRU
+	default:
+		logger.Warn("未知的token选择策略，使用严格轮询",
+			logger.String("strategy", name))
+		return SelectionStrategyRoundRobin
+	}
+}
+
+// tokenCandidate 候选token
+type tokenCandidate struct {
+	index  int
+	key    string
+	cached *CachedToken
+}
+
+// selectByStrategyUnlocked 按加权/LRU策略选择可用token
+// 内部方法：调用者必须持有 tm.mutex
+// 选中后同步 currentIndex，保证 GetCurrentTokenKey/MarkTokenFailed 指向实际使用的token，并立即更新 LastUsed
+func (tm *TokenManager) selectByStrategyUnlocked(requestedModel string) (*CachedToken, string, bool) {
+	modelSupported := requestedModel == ""
+	candidates := make([]tokenCandidate, 0, len(tm.configOrder))
+
+	for i, key := range tm.configOrder {
+		cached, exists := tm.cache.tokens[key]
+		if !exists || time.Since(cached.CachedAt) > tm.cache.ttl {
+			continue
+		}
+		if !tm.isCachedTokenModelAllowed(key, cached, requestedModel) {
+			continue
+		}
+		modelSupported = true
+
+		if !tm.isCachedTokenSelectableUnlocked(key, cached) {
+			continue
+		}
+		candidates = append(candidates, tokenCandidate{index: i, key: key, cached: cached})
+	}
+
+	if len(candidates) == 0 {
+		logger.Warn("所有token都不可用",
+			logger.String("strategy", string(tm.strategy)),
+			logger.Int("total_count", len(tm.configOrder)))
+		return nil, "", modelSupported
+	}
+
+	var chosen tokenCandidate
+	switch tm.strategy {
+	case SelectionStrategyWeighted:
+		chosen = pickWeighted(candidates, tm.rng)
+	case SelectionStrategyLRU:
+		chosen = pickLeastRecentlyUsed(candidates)
+	default:
+		chosen = candidates[0]
+	}
+
+	tm.currentIndex = chosen.index
+	// 在锁内记录使用时间：调用方释放锁后才会再次更新 LastUsed，
+	// 否则并发的 LRU 选择在此期间都会选中同一个token
+	chosen.cached.LastUsed = time.Now()
+
+	logger.Debug("按策略选择token",
+		logger.String("strategy", string(tm.strategy)),
+		logger.String("selected_key", chosen.key),
+		logger.Float64("available_count", chosen.cached.Available),
+		logger.Int("candidate_count", len(candidates)))
+
+	return chosen.cached, chosen.key, true
+}
+
+// isCachedTokenSelectableUnlocked 检查token是否可分配（冷却、每日限制、熔断、耗尽、禁用、额度）
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) isCachedTokenSelectableUnlocked(key string, cached *CachedToken) bool {
+	if tm.rateLimiter != nil && tm.rateLimiter.IsTokenInCooldown(key) {
+		return false
+	}
+	if tm.rateLimiter != nil && tm.rateLimiter.IsDailyLimitExceeded(key) {
+		return false
+	}
+	if !tm.circuitBreaker.Allow(key) {
+		return false
+	}
+	if tm.exhausted[key] || cached.Disabled {
+		return false
+	}
+	return cached.IsUsable()
+}
+
+// pickWeighted 按 Available 加权随机选择，剩余额度越多被选中概率越大
+func pickWeighted(candidates []tokenCandidate, rng *rand.Rand) tokenCandidate {
+	var total float64
+	for _, c := range candidates {
+		total += c.cached.Available
+	}
+	if total <= 0 {
+		return candidates[0]
+	}
+
+	target := rng.Float64() * total
+	for _, c := range candidates {
+		target -= c.cached.Available
+		if target < 0 {
+			return c
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// pickLeastRecentlyUsed 选择 LastUsed 最早的token，相同时保持配置顺序
+func pickLeastRecentlyUsed(candidates []tokenCandidate) tokenCandidate {
+	chosen := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.cached.LastUsed.Before(chosen.cached.LastUsed) {
+			chosen = c
+		}
+	}
+	return chosen
+}
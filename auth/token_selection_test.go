@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"fmt"
+	"kiro2api/config"
+	"kiro2api/types"
+	"testing"
+	"time"
+)
+
+// newStrategyTestManager 创建预填充缓存的 TokenManager，用于策略测试
+func newStrategyTestManager(t *testing.T, strategy SelectionStrategy, available []float64) *TokenManager {
+	t.Helper()
+
+	configs := make([]AuthConfig, len(available))
+	for i := range available {
+		configs[i] = AuthConfig{AuthType: AuthMethodSocial, RefreshToken: fmt.Sprintf("token%d", i)}
+	}
+
+	tm := NewTokenManager(configs)
+	tm.mutex.Lock()
+	tm.strategy = strategy
+	// 使用独立的频率限制器，避免全局限制器中其他测试累积的连续使用计数触发轮换
+	tm.rateLimiter = NewRateLimiter(DefaultRateLimiterConfig())
+	for i, avail := range available {
+		tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, i)] = &CachedToken{
+			Token: types.TokenInfo{
+				AccessToken: fmt.Sprintf("access_%d", i),
+				ExpiresAt:   time.Now().Add(1 * time.Hour),
+			},
+			CachedAt:  time.Now(),
+			Available: avail,
+		}
+	}
+	tm.lastRefresh = time.Now()
+	tm.mutex.Unlock()
+	return tm
+}
+
+func TestParseSelectionStrategy(t *testing.T) {
+	cases := map[string]SelectionStrategy{
+		"":                      SelectionStrategyRoundRobin,
+		"round_robin":           SelectionStrategyRoundRobin,
+		"Weighted":              SelectionStrategyWeighted,
+		"weighted-by-available": SelectionStrategyWeighted,
+		"lru":                   SelectionStrategyLRU,
+		"least_recently_used":   SelectionStrategyLRU,
+		"unknown":               SelectionStrategyRoundRobin,
+	}
+	for input, want := range cases {
+		if got := ParseSelectionStrategy(input); got != want {
+			t.Errorf("ParseSelectionStrategy(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
+
+// TestTokenManager_WeightedSelection 剩余额度越多的token被选中越频繁
+func TestTokenManager_WeightedSelection(t *testing.T) {
+	tm := newStrategyTestManager(t, SelectionStrategyWeighted, []float64{100000, 1000})
+
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		token, _, err := tm.GetTokenWithFingerprint()
+		if err != nil {
+			t.Fatalf("GetTokenWithFingerprint failed: %v", err)
+		}
+		counts[token.AccessToken]++
+	}
+
+	if counts["access_0"] <= counts["access_1"]*10 {
+		t.Errorf("期望高额度token被明显更多选中，实际分布: %v", counts)
+	}
+}
+
+// TestTokenManager_LRUSelection 最久未使用的token优先
+func TestTokenManager_LRUSelection(t *testing.T) {
+	tm := newStrategyTestManager(t, SelectionStrategyLRU, []float64{10, 10, 10})
+
+	tm.mutex.Lock()
+	tm.cache.tokens["token_0"].LastUsed = time.Now()
+	tm.cache.tokens["token_1"].LastUsed = time.Now().Add(-1 * time.Minute)
+	tm.cache.tokens["token_2"].LastUsed = time.Now().Add(-2 * time.Minute)
+	tm.mutex.Unlock()
+
+	want := []string{"access_2", "access_1", "access_0"}
+	for i, expected := range want {
+		token, err := tm.getBestToken()
+		if err != nil {
+			t.Fatalf("getBestToken failed: %v", err)
+		}
+		if token.AccessToken != expected {
+			t.Errorf("第%d次选择期望 %s，实际 %s", i+1, expected, token.AccessToken)
+		}
+		if key := tm.GetCurrentTokenKey(); key != fmt.Sprintf(config.TokenCacheKeyFormat, 2-i) {
+			t.Errorf("currentIndex 未同步到选中token，实际 %s", key)
+		}
+	}
+}
+
+// TestTokenManager_LRUSelectionStampsUnderLock 选中即更新 LastUsed，调用方释放锁前的连续选择不会重复命中同一token
+func TestTokenManager_LRUSelectionStampsUnderLock(t *testing.T) {
+	tm := newStrategyTestManager(t, SelectionStrategyLRU, []float64{10, 10, 10})
+
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		_, key, _ := tm.selectByStrategyUnlocked("")
+		if seen[key] {
+			t.Fatalf("第%d次选择重复命中 %s", i+1, key)
+		}
+		seen[key] = true
+	}
+}
+
+// TestTokenManager_StrategySkipsUnusable 非轮询策略同样跳过不可用token
+func TestTokenManager_StrategySkipsUnusable(t *testing.T) {
+	for _, strategy := range []SelectionStrategy{SelectionStrategyWeighted, SelectionStrategyLRU} {
+		tm := newStrategyTestManager(t, strategy, []float64{0, 50})
+
+		tm.mutex.Lock()
+		tm.cache.tokens["token_1"].Disabled = true
+		tm.mutex.Unlock()
+
+		if _, err := tm.getBestToken(); err == nil {
+			t.Errorf("%s: 期望无可用token时返回错误", strategy)
+		}
+
+		tm.mutex.Lock()
+		tm.cache.tokens["token_1"].Disabled = false
+		tm.mutex.Unlock()
+
+		token, err := tm.getBestToken()
+		if err != nil {
+			t.Fatalf("%s: getBestToken failed: %v", strategy, err)
+		}
+		if token.AccessToken != "access_1" {
+			t.Errorf("%s: 期望选中 access_1，实际 %s", strategy, token.AccessToken)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// SharedTokenStateStore 多实例共享的token状态存储（冷却、每日计数、轮询位置）
+// accountKey 使用 BuildMachineIdBindingKey 生成的稳定标识，各实例配置顺序不同也不会错位
+type SharedTokenStateStore interface {
+	// SaveCooldown 写入账号的冷却状态
+	SaveCooldown(accountKey string, snapshot CooldownSnapshot) error
+	// DeleteCooldown 删除账号的冷却状态（本实例已重置失败计数时调用）
+	DeleteCooldown(accountKey string) error
+	// LoadCooldowns 读取仍处于冷却期的账号
+	LoadCooldowns() (map[string]CooldownSnapshot, error)
+	// IncrDailyRequests 账号在 resetAt 所属周期内的请求计数加一
+	IncrDailyRequests(accountKey string, resetAt time.Time) error
+	// LoadDailyRequests 读取 resetAt 所属周期内各账号的请求计数
+	LoadDailyRequests(resetAt time.Time) (map[string]int, error)
+	// SaveRoundRobinCursor 记录严格轮询当前使用的账号
+	SaveRoundRobinCursor(accountKey string) error
+	// LoadRoundRobinCursor 读取严格轮询当前使用的账号（未记录时返回空）
+	LoadRoundRobinCursor() (string, error)
+	// MigrateAccount 账号标识变化（refresh token 轮换）时将冷却、resetAt 周期的每日计数与轮询位置迁移到新标识
+	MigrateAccount(oldAccountKey, newAccountKey string, resetAt time.Time) error
+	// Close 释放连接
+	Close() error
+}
+
+// NewSharedTokenStateStoreFromConfig 按 TOKEN_STORE 创建共享状态存储
+// memory（默认）返回 nil，状态只保存在进程内的 RateLimiter 中（RateLimiter 为进程级单例，无需额外存储）
+func NewSharedTokenStateStoreFromConfig() (SharedTokenStateStore, error) {
+	switch strings.ToLower(strings.TrimSpace(config.TokenStore)) {
+	case "", "memory":
+		return nil, nil
+	case "redis":
+		if config.TokenStoreRedisURL == "" {
+			return nil, fmt.Errorf("TOKEN_STORE=redis 需要配置 TOKEN_STORE_REDIS_URL")
+		}
+		return NewRedisSharedTokenStateStore(config.TokenStoreRedisURL, config.TokenStoreRedisPrefix)
+	default:
+		return nil, fmt.Errorf("不支持的 TOKEN_STORE: %s（可选 memory/redis）", config.TokenStore)
+	}
+}
+
+// ========== TokenManager 共享状态同步 ==========
+
+// accountKeyForTokenKey 将 tokenKey（token_N）映射为稳定的账号标识，无法映射时返回空
+func (tm *TokenManager) accountKeyForTokenKey(tokenKey string) string {
+	index, err := strconv.Atoi(strings.TrimPrefix(tokenKey, "token_"))
+	if err != nil || index < 0 || index >= len(tm.configs) {
+		return ""
+	}
+	return BuildMachineIdBindingKey(tm.configs[index])
+}
+
+// tokenKeysByAccountKey 构建稳定账号标识到 tokenKey 的映射
+func (tm *TokenManager) tokenKeysByAccountKey() map[string]string {
+	keys := make(map[string]string, len(tm.configs))
+	for i, cfg := range tm.configs {
+		if accountKey := BuildMachineIdBindingKey(cfg); accountKey != "" {
+			keys[accountKey] = fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		}
+	}
+	return keys
+}
+
+// sharedStoreWriteQueueSize 共享存储写入队列长度，队列已满时丢弃写入（尽力而为）
+const sharedStoreWriteQueueSize = 256
+
+// sharedStoreWrite 一次待写入共享存储的操作
+type sharedStoreWrite struct {
+	desc  string
+	apply func(SharedTokenStateStore) error
+}
+
+// enableSharedStore 启用共享存储：启动按顺序执行写入的后台goroutine
+// 写入由单个goroutine依次执行，保证同一实例的写入按发生顺序到达共享存储
+func (tm *TokenManager) enableSharedStore(store SharedTokenStateStore) {
+	tm.sharedStore = store
+	tm.sharedWrites = make(chan sharedStoreWrite, sharedStoreWriteQueueSize)
+	go tm.sharedStoreWriteLoop(store, tm.sharedWrites)
+}
+
+// sharedStoreWriteLoop 依次执行共享存储写入，TokenManager 停止时退出
+func (tm *TokenManager) sharedStoreWriteLoop(store SharedTokenStateStore, writes <-chan sharedStoreWrite) {
+	for {
+		select {
+		case <-tm.ctx.Done():
+			return
+		case write := <-writes:
+			if err := write.apply(store); err != nil {
+				logger.Warn("写入共享token状态失败",
+					logger.String("operation", write.desc),
+					logger.Err(err))
+			}
+		}
+	}
+}
+
+// enqueueSharedWrite 将写入加入队列，不阻塞调用方（可能持有 tm.mutex）
+func (tm *TokenManager) enqueueSharedWrite(desc string, apply func(SharedTokenStateStore) error) {
+	if tm.sharedWrites == nil {
+		return
+	}
+	select {
+	case tm.sharedWrites <- sharedStoreWrite{desc: desc, apply: apply}:
+	default:
+		logger.Warn("共享token状态写入队列已满，丢弃写入",
+			logger.String("operation", desc))
+	}
+}
+
+// onCooldownChange 冷却状态变更回调：写入状态文件并发布到共享存储
+func (tm *TokenManager) onCooldownChange() {
+	tm.persistState()
+	tm.publishCooldowns()
+}
+
+// publishCooldowns 将本实例仍在冷却期的token写入共享存储（尽力而为）
+func (tm *TokenManager) publishCooldowns() {
+	if tm.sharedStore == nil || tm.rateLimiter == nil {
+		return
+	}
+	snapshots := make(map[string]CooldownSnapshot)
+	for tokenKey, snapshot := range tm.rateLimiter.SnapshotCooldowns() {
+		if accountKey := tm.accountKeyForTokenKey(tokenKey); accountKey != "" {
+			snapshots[accountKey] = snapshot
+		}
+	}
+	if len(snapshots) == 0 {
+		return
+	}
+	tm.enqueueSharedWrite("save_cooldown", func(store SharedTokenStateStore) error {
+		for accountKey, snapshot := range snapshots {
+			if err := store.SaveCooldown(accountKey, snapshot); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// clearSharedCooldown 本实例重置了token的失败计数，删除共享存储中该账号的冷却记录
+// 避免其他实例（以及本实例的下一次同步）重新导入旧的失败计数
+func (tm *TokenManager) clearSharedCooldown(tokenKey string) {
+	if tm.sharedStore == nil {
+		return
+	}
+	accountKey := tm.accountKeyForTokenKey(tokenKey)
+	if accountKey == "" {
+		return
+	}
+	tm.enqueueSharedWrite("delete_cooldown", func(store SharedTokenStateStore) error {
+		return store.DeleteCooldown(accountKey)
+	})
+}
+
+// migrateSharedAccountState 账号标识随配置变化时（refresh token 轮换），迁移共享存储中的状态
+func (tm *TokenManager) migrateSharedAccountState(oldCfg, newCfg AuthConfig) {
+	if tm.sharedStore == nil || tm.rateLimiter == nil {
+		return
+	}
+	oldKey, newKey := BuildMachineIdBindingKey(oldCfg), BuildMachineIdBindingKey(newCfg)
+	if oldKey == "" || newKey == "" || oldKey == newKey {
+		return
+	}
+	resetAt := tm.rateLimiter.DailyResetAt()
+	tm.enqueueSharedWrite("migrate_account", func(store SharedTokenStateStore) error {
+		return store.MigrateAccount(oldKey, newKey, resetAt)
+	})
+}
+
+// recordRequest 记录一次token请求，启用共享存储时同步累加每日计数
+func (tm *TokenManager) recordRequest(tokenKey string) {
+	tm.rateLimiter.RecordRequest(tokenKey)
+	if tm.sharedStore == nil {
+		return
+	}
+	accountKey := tm.accountKeyForTokenKey(tokenKey)
+	if accountKey == "" {
+		return
+	}
+	resetAt := tm.rateLimiter.DailyResetAt()
+	tm.enqueueSharedWrite("incr_daily_requests", func(store SharedTokenStateStore) error {
+		return store.IncrDailyRequests(accountKey, resetAt)
+	})
+}
+
+// publishRoundRobinCursorUnlocked 严格轮询切换token后记录当前位置
+// 内部方法：调用者必须持有 tm.mutex
+func (tm *TokenManager) publishRoundRobinCursorUnlocked() {
+	if tm.sharedStore == nil || len(tm.configOrder) == 0 {
+		return
+	}
+	accountKey := tm.accountKeyForTokenKey(tm.configOrder[tm.currentIndex])
+	if accountKey == "" {
+		return
+	}
+	tm.enqueueSharedWrite("save_round_robin_cursor", func(store SharedTokenStateStore) error {
+		return store.SaveRoundRobinCursor(accountKey)
+	})
+}
+
+// sharedStoreSyncLoop 定期从共享存储拉取其他实例的冷却、每日计数与轮询位置
+// 启动后立即同步一次，不阻塞 TokenManager 的创建
+func (tm *TokenManager) sharedStoreSyncLoop() {
+	interval := config.TokenStoreSyncInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	tm.syncSharedState()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tm.ctx.Done():
+			return
+		case <-ticker.C:
+			tm.syncSharedState()
+		}
+	}
+}
+
+// syncSharedState 合并共享存储中的状态：冷却取较晚的结束时间，每日计数取较大值
+func (tm *TokenManager) syncSharedState() {
+	if tm.sharedStore == nil {
+		return
+	}
+	tokenKeys := tm.tokenKeysByAccountKey()
+
+	if tm.rateLimiter != nil {
+		cooldowns, err := tm.sharedStore.LoadCooldowns()
+		if err != nil {
+			logger.Warn("读取共享token冷却状态失败", logger.Err(err))
+			return
+		}
+		for accountKey, snapshot := range cooldowns {
+			if tokenKey, ok := tokenKeys[accountKey]; ok {
+				tm.rateLimiter.RestoreCooldown(tokenKey, snapshot)
+			}
+		}
+
+		resetAt := tm.rateLimiter.DailyResetAt()
+		counts, err := tm.sharedStore.LoadDailyRequests(resetAt)
+		if err != nil {
+			logger.Warn("读取共享每日请求计数失败", logger.Err(err))
+			return
+		}
+		for accountKey, count := range counts {
+			if tokenKey, ok := tokenKeys[accountKey]; ok {
+				tm.rateLimiter.MergeDailyRequests(tokenKey, resetAt, count)
+			}
+		}
+	}
+
+	cursor, err := tm.sharedStore.LoadRoundRobinCursor()
+	if err != nil {
+		logger.Warn("读取共享轮询位置失败", logger.Err(err))
+		return
+	}
+	tokenKey, ok := tokenKeys[cursor]
+	if !ok {
+		return
+	}
+	tm.mutex.Lock()
+	defer tm.mutex.Unlock()
+	if tm.strategy != SelectionStrategyRoundRobin {
+		return
+	}
+	for i, key := range tm.configOrder {
+		if key == tokenKey {
+			tm.currentIndex = i
+			break
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"kiro2api/logger"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisOpTimeout 单次 Redis 操作超时，避免共享存储故障拖慢请求路径
+const redisOpTimeout = 500 * time.Millisecond
+
+// redisDailyKeyGrace 每日计数键在重置时间之后的保留时长（容忍各实例时钟偏差）
+const redisDailyKeyGrace = time.Hour
+
+// redisSaveCooldownScript 写入冷却状态并把哈希的过期时间延长到 ARGV[3] 毫秒（只延长不缩短）
+// 用 PTTL 比较代替 EXPIRE NX/GT，兼容 Redis 7 以下版本；脚本整体原子执行，多实例并发写入不会互相缩短过期时间
+var redisSaveCooldownScript = redis.NewScript(`
+local ttl = tonumber(ARGV[3])
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if redis.call('PTTL', KEYS[1]) < ttl then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// redisCooldownRecord 冷却状态在 Redis 中的 JSON 结构
+type redisCooldownRecord struct {
+	CooldownEnd   time.Time `json:"cooldown_end"`
+	FailCount     int       `json:"fail_count,omitempty"`
+	IsSuspended   bool      `json:"is_suspended,omitempty"`
+	SuspendReason string    `json:"suspend_reason,omitempty"`
+}
+
+// RedisSharedTokenStateStore 基于 Redis 的 SharedTokenStateStore 实现
+// 键布局（prefix 默认 kiro2api:）：
+// - prefix+"cooldown"：HASH，账号 -> 冷却状态 JSON
+// - prefix+"daily:"+重置时间戳：HASH，账号 -> 请求计数，重置后自动过期
+// - prefix+"rr_cursor"：STRING，严格轮询当前账号
+type RedisSharedTokenStateStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisSharedTokenStateStore 按连接地址（redis://...）创建 Redis 状态存储
+// 连通性检查在后台进行，不阻塞 TokenManager 创建与账号重新加载；连接失败时各操作返回错误并记录日志
+func NewRedisSharedTokenStateStore(url, prefix string) (*RedisSharedTokenStateStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("解析 TOKEN_STORE_REDIS_URL 失败: %w", err)
+	}
+	store := &RedisSharedTokenStateStore{client: redis.NewClient(opts), prefix: prefix}
+	go store.checkConnection()
+	return store, nil
+}
+
+// checkConnection 检查 Redis 连通性，失败时记录警告
+func (s *RedisSharedTokenStateStore) checkConnection() {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		logger.Warn("连接共享token状态 Redis 失败，将在后续同步时重试", logger.Err(err))
+	}
+}
+
+func (s *RedisSharedTokenStateStore) cooldownKey() string {
+	return s.prefix + "cooldown"
+}
+
+func (s *RedisSharedTokenStateStore) dailyKey(resetAt time.Time) string {
+	return s.prefix + "daily:" + strconv.FormatInt(resetAt.Unix(), 10)
+}
+
+func (s *RedisSharedTokenStateStore) cursorKey() string {
+	return s.prefix + "rr_cursor"
+}
+
+// SaveCooldown 写入账号的冷却状态
+// 冷却哈希的过期时间延长到最晚的冷却结束时间，全部冷却结束后整个键自动删除
+func (s *RedisSharedTokenStateStore) SaveCooldown(accountKey string, snapshot CooldownSnapshot) error {
+	ttl := time.Until(snapshot.CooldownEnd)
+	if ttl <= 0 {
+		return s.DeleteCooldown(accountKey)
+	}
+	data, err := json.Marshal(redisCooldownRecord(snapshot))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	// 过期时间至少 1 毫秒，避免 PEXPIRE 0 立即删除整个哈希
+	return redisSaveCooldownScript.Run(ctx, s.client, []string{s.cooldownKey()},
+		accountKey, data, max(ttl.Milliseconds(), 1)).Err()
+}
+
+// DeleteCooldown 删除账号的冷却状态
+func (s *RedisSharedTokenStateStore) DeleteCooldown(accountKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return s.client.HDel(ctx, s.cooldownKey(), accountKey).Err()
+}
+
+// LoadCooldowns 读取仍处于冷却期的账号，顺带删除已过期或无法解析的条目
+func (s *RedisSharedTokenStateStore) LoadCooldowns() (map[string]CooldownSnapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	entries, err := s.client.HGetAll(ctx, s.cooldownKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := make(map[string]CooldownSnapshot, len(entries))
+	var stale []string
+	for accountKey, raw := range entries {
+		var record redisCooldownRecord
+		if err := json.Unmarshal([]byte(raw), &record); err != nil || !now.Before(record.CooldownEnd) {
+			stale = append(stale, accountKey)
+			continue
+		}
+		result[accountKey] = CooldownSnapshot(record)
+	}
+	if len(stale) > 0 {
+		// 清理失败不影响本次结果，下次同步会重试
+		_ = s.client.HDel(ctx, s.cooldownKey(), stale...).Err()
+	}
+	return result, nil
+}
+
+// IncrDailyRequests 账号在 resetAt 所属周期内的请求计数加一
+func (s *RedisSharedTokenStateStore) IncrDailyRequests(accountKey string, resetAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	key := s.dailyKey(resetAt)
+	pipe := s.client.TxPipeline()
+	pipe.HIncrBy(ctx, key, accountKey, 1)
+	pipe.ExpireAt(ctx, key, resetAt.Add(redisDailyKeyGrace))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// LoadDailyRequests 读取 resetAt 所属周期内各账号的请求计数
+func (s *RedisSharedTokenStateStore) LoadDailyRequests(resetAt time.Time) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	entries, err := s.client.HGetAll(ctx, s.dailyKey(resetAt)).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]int, len(entries))
+	for accountKey, raw := range entries {
+		if count, err := strconv.Atoi(raw); err == nil {
+			result[accountKey] = count
+		}
+	}
+	return result, nil
+}
+
+// SaveRoundRobinCursor 记录严格轮询当前使用的账号
+func (s *RedisSharedTokenStateStore) SaveRoundRobinCursor(accountKey string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return s.client.Set(ctx, s.cursorKey(), accountKey, 0).Err()
+}
+
+// LoadRoundRobinCursor 读取严格轮询当前使用的账号（未记录时返回空）
+func (s *RedisSharedTokenStateStore) LoadRoundRobinCursor() (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	cursor, err := s.client.Get(ctx, s.cursorKey()).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return cursor, err
+}
+
+// MigrateAccount 将旧账号标识的冷却、每日计数与轮询位置迁移到新标识
+func (s *RedisSharedTokenStateStore) MigrateAccount(oldAccountKey, newAccountKey string, resetAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	cooldown, err := s.client.HGet(ctx, s.cooldownKey(), oldAccountKey).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	count, err := s.client.HGet(ctx, s.dailyKey(resetAt), oldAccountKey).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	cursor, err := s.client.Get(ctx, s.cursorKey()).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	pipe := s.client.TxPipeline()
+	if cooldown != "" {
+		pipe.HSet(ctx, s.cooldownKey(), newAccountKey, cooldown)
+		pipe.HDel(ctx, s.cooldownKey(), oldAccountKey)
+	}
+	if count > 0 {
+		pipe.HIncrBy(ctx, s.dailyKey(resetAt), newAccountKey, count)
+		pipe.HDel(ctx, s.dailyKey(resetAt), oldAccountKey)
+	}
+	if cursor == oldAccountKey {
+		pipe.Set(ctx, s.cursorKey(), newAccountKey, 0)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Close 关闭 Redis 连接
+func (s *RedisSharedTokenStateStore) Close() error {
+	return s.client.Close()
+}
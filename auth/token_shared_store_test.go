@@ -0,0 +1,336 @@
+package auth
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// memorySharedTokenStateStore 进程内的 SharedTokenStateStore 实现，模拟多个实例共享的存储
+type memorySharedTokenStateStore struct {
+	mutex     sync.Mutex
+	cooldowns map[string]CooldownSnapshot
+	daily     map[int64]map[string]int
+	cursor    string
+}
+
+// newMemorySharedTokenStateStore 创建进程内状态存储
+func newMemorySharedTokenStateStore() *memorySharedTokenStateStore {
+	return &memorySharedTokenStateStore{
+		cooldowns: make(map[string]CooldownSnapshot),
+		daily:     make(map[int64]map[string]int),
+	}
+}
+
+// SaveCooldown 写入账号的冷却状态
+func (s *memorySharedTokenStateStore) SaveCooldown(accountKey string, snapshot CooldownSnapshot) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cooldowns[accountKey] = snapshot
+	return nil
+}
+
+// DeleteCooldown 删除账号的冷却状态
+func (s *memorySharedTokenStateStore) DeleteCooldown(accountKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.cooldowns, accountKey)
+	return nil
+}
+
+// LoadCooldowns 读取仍处于冷却期的账号，顺带清理已过期的条目
+func (s *memorySharedTokenStateStore) LoadCooldowns() (map[string]CooldownSnapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	result := make(map[string]CooldownSnapshot, len(s.cooldowns))
+	for key, snapshot := range s.cooldowns {
+		if !now.Before(snapshot.CooldownEnd) {
+			delete(s.cooldowns, key)
+			continue
+		}
+		result[key] = snapshot
+	}
+	return result, nil
+}
+
+// IncrDailyRequests 账号在 resetAt 所属周期内的请求计数加一，并清理过去周期的计数
+func (s *memorySharedTokenStateStore) IncrDailyRequests(accountKey string, resetAt time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	period := resetAt.Unix()
+	for p := range s.daily {
+		if p < period {
+			delete(s.daily, p)
+		}
+	}
+	counts, ok := s.daily[period]
+	if !ok {
+		counts = make(map[string]int)
+		s.daily[period] = counts
+	}
+	counts[accountKey]++
+	return nil
+}
+
+// LoadDailyRequests 读取 resetAt 所属周期内各账号的请求计数
+func (s *memorySharedTokenStateStore) LoadDailyRequests(resetAt time.Time) (map[string]int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make(map[string]int)
+	for key, count := range s.daily[resetAt.Unix()] {
+		result[key] = count
+	}
+	return result, nil
+}
+
+// SaveRoundRobinCursor 记录严格轮询当前使用的账号
+func (s *memorySharedTokenStateStore) SaveRoundRobinCursor(accountKey string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cursor = accountKey
+	return nil
+}
+
+// LoadRoundRobinCursor 读取严格轮询当前使用的账号
+func (s *memorySharedTokenStateStore) LoadRoundRobinCursor() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cursor, nil
+}
+
+// Close 进程内存储无需释放
+func (s *memorySharedTokenStateStore) Close() error {
+	return nil
+}
+
+// MigrateAccount 将旧账号标识的状态迁移到新标识
+func (s *memorySharedTokenStateStore) MigrateAccount(oldAccountKey, newAccountKey string, resetAt time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if snapshot, ok := s.cooldowns[oldAccountKey]; ok {
+		s.cooldowns[newAccountKey] = snapshot
+		delete(s.cooldowns, oldAccountKey)
+	}
+	if counts, ok := s.daily[resetAt.Unix()]; ok {
+		if count, ok := counts[oldAccountKey]; ok {
+			counts[newAccountKey] += count
+			delete(counts, oldAccountKey)
+		}
+	}
+	if s.cursor == oldAccountKey {
+		s.cursor = newAccountKey
+	}
+	return nil
+}
+
+// newSharedStoreTestManager 创建使用共享存储和独立频率限制器的 TokenManager，模拟一个实例
+func newSharedStoreTestManager(t *testing.T, store SharedTokenStateStore) *TokenManager {
+	t.Helper()
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10, 10, 10})
+	tm.enableSharedStore(store)
+	return tm
+}
+
+// flushSharedWrites 等待之前加入队列的共享存储写入全部执行完毕
+func flushSharedWrites(t *testing.T, tm *TokenManager) {
+	t.Helper()
+	done := make(chan struct{})
+	tm.enqueueSharedWrite("flush", func(SharedTokenStateStore) error {
+		close(done)
+		return nil
+	})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("等待共享存储写入超时")
+	}
+}
+
+// TestSharedStore_CooldownAndDailyCountsAcrossInstances 一个实例的冷却与请求计数同步到另一个实例
+func TestSharedStore_CooldownAndDailyCountsAcrossInstances(t *testing.T) {
+	store := newMemorySharedTokenStateStore()
+	a := newSharedStoreTestManager(t, store)
+	b := newSharedStoreTestManager(t, store)
+
+	a.rateLimiter.MarkTokenCooldown("token_0")
+	a.publishCooldowns()
+	flushSharedWrites(t, a)
+	a.rateLimiter.RecordRequest("token_1")
+	if err := store.IncrDailyRequests(a.accountKeyForTokenKey("token_1"), a.rateLimiter.DailyResetAt()); err != nil {
+		t.Fatal(err)
+	}
+
+	b.syncSharedState()
+	if !b.rateLimiter.IsTokenInCooldown("token_0") {
+		t.Errorf("期望另一个实例同步到 token_0 的冷却")
+	}
+	if used := b.rateLimiter.GetDailyUsage("token_1").Used; used != 1 {
+		t.Errorf("期望另一个实例同步到每日计数 1，实际 %d", used)
+	}
+
+	token, key, _ := b.selectNextAvailableTokenForModelUnlocked("")
+	if token == nil || key != "token_1" {
+		t.Fatalf("期望跳过冷却中的 token_0 选中 token_1，实际 %s", key)
+	}
+}
+
+// TestSharedStore_RoundRobinCursor 轮询切换后另一个实例从同一位置继续
+func TestSharedStore_RoundRobinCursor(t *testing.T) {
+	store := newMemorySharedTokenStateStore()
+	a := newSharedStoreTestManager(t, store)
+	b := newSharedStoreTestManager(t, store)
+
+	a.MarkTokenFailed("token_0")
+	flushSharedWrites(t, a)
+	if cursor, _ := store.LoadRoundRobinCursor(); cursor == "" {
+		t.Fatal("期望记录共享轮询位置")
+	}
+
+	b.syncSharedState()
+	if got := b.GetCurrentTokenKey(); got != "token_1" {
+		t.Errorf("期望另一个实例轮询位置为 token_1，实际 %s", got)
+	}
+}
+
+// TestSharedStore_WritesApplyInOrder 同一实例的写入按发生顺序到达共享存储
+func TestSharedStore_WritesApplyInOrder(t *testing.T) {
+	store := newMemorySharedTokenStateStore()
+	a := newSharedStoreTestManager(t, store)
+
+	a.mutex.Lock()
+	for range 20 {
+		a.advanceToNextToken()
+		a.publishRoundRobinCursorUnlocked()
+	}
+	want := a.accountKeyForTokenKey(a.configOrder[a.currentIndex])
+	a.mutex.Unlock()
+	flushSharedWrites(t, a)
+
+	if cursor, _ := store.LoadRoundRobinCursor(); cursor != want {
+		t.Errorf("期望最后写入的轮询位置 %q，实际 %q", want, cursor)
+	}
+}
+
+// TestSharedStore_SuccessClearsSharedCooldown 成功请求重置失败计数后删除共享冷却，同步不再覆盖本地失败计数
+func TestSharedStore_SuccessClearsSharedCooldown(t *testing.T) {
+	store := newMemorySharedTokenStateStore()
+	a := newSharedStoreTestManager(t, store)
+
+	a.rateLimiter.MarkTokenCooldown("token_0")
+	a.publishCooldowns()
+	flushSharedWrites(t, a)
+
+	// 同一条记录重复导入不覆盖本地状态
+	a.rateLimiter.RecordSuccess("token_0")
+	a.syncSharedState()
+	if state := a.rateLimiter.getOrCreateState("token_0"); state.FailCount != 0 {
+		t.Errorf("重复导入不应覆盖已重置的失败计数，实际 %d", state.FailCount)
+	}
+
+	a.rateLimiter.MarkTokenCooldown("token_0")
+	a.MarkTokenSuccess("token_0")
+	flushSharedWrites(t, a)
+	if cooldowns, _ := store.LoadCooldowns(); len(cooldowns) != 0 {
+		t.Errorf("失败计数重置后应删除共享冷却，实际 %+v", cooldowns)
+	}
+}
+
+func TestRedisSharedTokenStateStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := NewRedisSharedTokenStateStore("redis://"+server.Addr(), "test:")
+	if err != nil {
+		t.Fatalf("创建 Redis 存储失败: %v", err)
+	}
+	defer store.Close()
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := store.SaveCooldown("refresh:a", CooldownSnapshot{CooldownEnd: until, FailCount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveCooldown("refresh:b", CooldownSnapshot{CooldownEnd: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	cooldowns, err := store.LoadCooldowns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := cooldowns["refresh:a"]; !ok || !got.CooldownEnd.Equal(until) || got.FailCount != 2 {
+		t.Errorf("冷却状态不符: %+v", got)
+	}
+	if _, ok := cooldowns["refresh:b"]; ok || server.HGet("test:cooldown", "refresh:b") != "" {
+		t.Errorf("已过期的冷却应被过滤并删除")
+	}
+	if ttl := server.TTL("test:cooldown"); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("冷却键应在最晚的冷却结束时过期，实际 TTL %v", ttl)
+	}
+	if err := store.SaveCooldown("refresh:c", CooldownSnapshot{CooldownEnd: time.Now().Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("test:cooldown"); ttl <= time.Minute {
+		t.Errorf("较早结束的冷却不应缩短过期时间，实际 TTL %v", ttl)
+	}
+	if err := store.DeleteCooldown("refresh:a"); err != nil {
+		t.Fatal(err)
+	}
+	if server.HGet("test:cooldown", "refresh:a") != "" {
+		t.Errorf("DeleteCooldown 应删除冷却记录")
+	}
+
+	resetAt := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+	for range 3 {
+		if err := store.IncrDailyRequests("refresh:a", resetAt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	counts, err := store.LoadDailyRequests(resetAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts["refresh:a"] != 3 {
+		t.Errorf("期望每日计数 3，实际 %d", counts["refresh:a"])
+	}
+	if ttl := server.TTL(store.dailyKey(resetAt)); ttl <= 2*time.Hour {
+		t.Errorf("每日计数键应在重置时间之后过期，实际 TTL %v", ttl)
+	}
+
+	if cursor, err := store.LoadRoundRobinCursor(); err != nil || cursor != "" {
+		t.Errorf("未记录时应返回空游标: %q %v", cursor, err)
+	}
+	if err := store.SaveRoundRobinCursor("refresh:a"); err != nil {
+		t.Fatal(err)
+	}
+	if cursor, _ := store.LoadRoundRobinCursor(); cursor != "refresh:a" {
+		t.Errorf("期望游标 refresh:a，实际 %q", cursor)
+	}
+
+	// refresh token 轮换：状态迁移到新标识
+	if err := store.SaveCooldown("refresh:a", CooldownSnapshot{CooldownEnd: until, FailCount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MigrateAccount("refresh:a", "refresh:a2", resetAt); err != nil {
+		t.Fatal(err)
+	}
+	cooldowns, _ = store.LoadCooldowns()
+	if _, ok := cooldowns["refresh:a2"]; !ok {
+		t.Errorf("期望冷却迁移到新标识，实际 %+v", cooldowns)
+	}
+	if _, ok := cooldowns["refresh:a"]; ok {
+		t.Errorf("旧标识的冷却应被删除")
+	}
+	if counts, _ := store.LoadDailyRequests(resetAt); counts["refresh:a2"] != 3 || counts["refresh:a"] != 0 {
+		t.Errorf("期望每日计数迁移到新标识，实际 %+v", counts)
+	}
+	if cursor, _ := store.LoadRoundRobinCursor(); cursor != "refresh:a2" {
+		t.Errorf("期望游标迁移到 refresh:a2，实际 %q", cursor)
+	}
+	// 旧标识没有任何状态时迁移为空操作
+	if err := store.MigrateAccount("refresh:none", "refresh:none2", resetAt); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// PersistedTokenState 持久化的token状态
+type PersistedTokenState struct {
+	CooldownUntil time.Time `json:"cooldown_until,omitempty"`
+	FailCount     int       `json:"fail_count,omitempty"`
+	IsSuspended   bool      `json:"is_suspended,omitempty"`
+	SuspendReason string    `json:"suspend_reason,omitempty"`
+	Exhausted     bool      `json:"exhausted,omitempty"`
+}
+
+// TokenStateData 持久化文件结构
+// key 使用 BuildMachineIdBindingKey 生成的稳定标识，避免配置顺序变化导致错位
+type TokenStateData struct {
+	SavedAt time.Time                       `json:"saved_at"`
+	Tokens  map[string]*PersistedTokenState `json:"tokens"`
+}
+
+// TokenStateStore token冷却/耗尽状态的文件存储（尽力而为，失败只记录日志）
+type TokenStateStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewTokenStateStore 创建状态存储
+func NewTokenStateStore(path string) *TokenStateStore {
+	return &TokenStateStore{path: path}
+}
+
+// resolveTokenStateFile 解析状态文件路径
+// 未显式配置时与 OAUTH_TOKEN_FILE 同目录，否则使用当前目录
+func resolveTokenStateFile() string {
+	if config.TokenStateFile != "" {
+		return config.TokenStateFile
+	}
+	if oauthFile := os.Getenv("OAUTH_TOKEN_FILE"); oauthFile != "" {
+		return filepath.Join(filepath.Dir(oauthFile), "token_state.json")
+	}
+	return "token_state.json"
+}
+
+// Path 返回状态文件路径
+func (s *TokenStateStore) Path() string {
+	return s.path
+}
+
+// Load 读取状态文件，丢弃冷却已过期且未耗尽的条目
+// 文件不存在返回空结果；文件损坏时记录警告并返回空结果
+func (s *TokenStateStore) Load() map[string]*PersistedTokenState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := make(map[string]*PersistedTokenState)
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("读取token状态文件失败，将从空状态开始",
+				logger.String("path", s.path),
+				logger.Err(err))
+		}
+		return result
+	}
+
+	var stateData TokenStateData
+	if err := json.Unmarshal(data, &stateData); err != nil {
+		logger.Warn("解析token状态文件失败，将从空状态开始",
+			logger.String("path", s.path),
+			logger.Err(err))
+		return result
+	}
+
+	now := time.Now()
+	for key, state := range stateData.Tokens {
+		if state == nil || key == "" {
+			continue
+		}
+		if !now.Before(state.CooldownUntil) {
+			// 冷却已过期，仅保留耗尽标记
+			state.CooldownUntil = time.Time{}
+			state.FailCount = 0
+			state.IsSuspended = false
+			state.SuspendReason = ""
+		}
+		if state.CooldownUntil.IsZero() && !state.Exhausted {
+			continue
+		}
+		result[key] = state
+	}
+
+	logger.Info("加载token状态成功",
+		logger.String("path", s.path),
+		logger.Int("count", len(result)))
+	return result
+}
+
+// Save 写入状态文件（先写临时文件再重命名，避免写入中断导致文件损坏）
+func (s *TokenStateStore) Save(states map[string]*PersistedTokenState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveUnlocked(states)
+}
+
+// Update 在锁内构建最新状态并写入，保证并发写入时最后落盘的是最新快照
+func (s *TokenStateStore) Update(build func() map[string]*PersistedTokenState) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.saveUnlocked(build())
+}
+
+// saveUnlocked 写入状态文件（调用者必须持有锁）
+func (s *TokenStateStore) saveUnlocked(states map[string]*PersistedTokenState) error {
+	data, err := json.MarshalIndent(TokenStateData{
+		SavedAt: time.Now(),
+		Tokens:  states,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+// ========== TokenManager 状态持久化 ==========
+
+// restorePersistedState 从状态文件恢复冷却与耗尽标记（NewTokenManager 中调用）
+func (tm *TokenManager) restorePersistedState() {
+	if tm.stateStore == nil {
+		return
+	}
+
+	states := tm.stateStore.Load()
+	if len(states) == 0 {
+		return
+	}
+
+	restored := 0
+	tm.mutex.Lock()
+	for i, cfg := range tm.configs {
+		state, ok := states[BuildMachineIdBindingKey(cfg)]
+		if !ok {
+			continue
+		}
+		tokenKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		if state.Exhausted {
+			tm.exhausted[tokenKey] = true
+		}
+		if tm.rateLimiter != nil && tm.rateLimiter.RestoreCooldown(tokenKey, CooldownSnapshot{
+			CooldownEnd:   state.CooldownUntil,
+			FailCount:     state.FailCount,
+			IsSuspended:   state.IsSuspended,
+			SuspendReason: state.SuspendReason,
+		}) {
+			logger.Debug("恢复token冷却状态",
+				logger.String("token_key", tokenKey),
+				logger.String("cooldown_until", state.CooldownUntil.Format(time.RFC3339)))
+		}
+		restored++
+	}
+	tm.mutex.Unlock()
+
+	logger.Info("已恢复持久化的token状态",
+		logger.String("path", tm.stateStore.Path()),
+		logger.Int("restored_count", restored))
+}
+
+// persistState 将当前冷却与耗尽状态写入文件（尽力而为）
+// 调用者不能持有 tm.mutex
+func (tm *TokenManager) persistState() {
+	if tm.stateStore == nil {
+		return
+	}
+	if err := tm.stateStore.Update(tm.snapshotPersistedState); err != nil {
+		logger.Warn("保存token状态失败",
+			logger.String("path", tm.stateStore.Path()),
+			logger.Err(err))
+	}
+}
+
+// snapshotPersistedState 构建需要持久化的token状态
+func (tm *TokenManager) snapshotPersistedState() map[string]*PersistedTokenState {
+	var cooldowns map[string]CooldownSnapshot
+	if tm.rateLimiter != nil {
+		cooldowns = tm.rateLimiter.SnapshotCooldowns()
+	}
+
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	states := make(map[string]*PersistedTokenState)
+	for i, cfg := range tm.configs {
+		stableKey := BuildMachineIdBindingKey(cfg)
+		if stableKey == "" {
+			continue
+		}
+		tokenKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+
+		state := &PersistedTokenState{Exhausted: tm.exhausted[tokenKey]}
+		if snapshot, ok := cooldowns[tokenKey]; ok {
+			state.CooldownUntil = snapshot.CooldownEnd
+			state.FailCount = snapshot.FailCount
+			state.IsSuspended = snapshot.IsSuspended
+			state.SuspendReason = snapshot.SuspendReason
+		}
+		if state.Exhausted || !state.CooldownUntil.IsZero() {
+			states[stableKey] = state
+		}
+	}
+	return states
+}
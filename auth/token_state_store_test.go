@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+)
+
+func TestTokenStateStore_LoadDropsExpiredCooldowns(t *testing.T) {
+	store := NewTokenStateStore(filepath.Join(t.TempDir(), "token_state.json"))
+
+	err := store.Save(map[string]*PersistedTokenState{
+		"refresh:active":    {CooldownUntil: time.Now().Add(time.Hour), FailCount: 2},
+		"refresh:expired":   {CooldownUntil: time.Now().Add(-time.Minute), FailCount: 1},
+		"refresh:exhausted": {CooldownUntil: time.Now().Add(-time.Minute), Exhausted: true},
+	})
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	states := store.Load()
+	if _, ok := states["refresh:expired"]; ok {
+		t.Errorf("冷却已过期的条目应被丢弃")
+	}
+	if state, ok := states["refresh:active"]; !ok || state.FailCount != 2 {
+		t.Errorf("期望保留仍在冷却中的条目，实际: %+v", state)
+	}
+	state, ok := states["refresh:exhausted"]
+	if !ok || !state.Exhausted {
+		t.Fatalf("期望保留耗尽标记")
+	}
+	if !state.CooldownUntil.IsZero() {
+		t.Errorf("耗尽条目的过期冷却应被清空")
+	}
+}
+
+func TestTokenStateStore_CorruptFileStartsFresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token_state.json")
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if states := NewTokenStateStore(path).Load(); len(states) != 0 {
+		t.Errorf("损坏文件应返回空状态，实际 %d 条", len(states))
+	}
+	if states := NewTokenStateStore(path + ".missing").Load(); len(states) != 0 {
+		t.Errorf("缺失文件应返回空状态，实际 %d 条", len(states))
+	}
+}
+
+// TestTokenManager_PersistAcrossRestart 冷却与耗尽状态在重建 TokenManager 后恢复
+func TestTokenManager_PersistAcrossRestart(t *testing.T) {
+	origEnabled, origFile := config.TokenStatePersistEnabled, config.TokenStateFile
+	config.TokenStatePersistEnabled = true
+	config.TokenStateFile = filepath.Join(t.TempDir(), "token_state.json")
+	defer func() {
+		config.TokenStatePersistEnabled, config.TokenStateFile = origEnabled, origFile
+	}()
+
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "persist_token_a"},
+		{AuthType: AuthMethodSocial, RefreshToken: "persist_token_b"},
+	}
+
+	limiter := NewRateLimiter(DefaultRateLimiterConfig())
+	tm := NewTokenManager(configs)
+	tm.rateLimiter = limiter
+	limiter.MarkTokenCooldown("token_0")
+	tm.MarkTokenExhausted("token_1")
+	tm.Stop()
+
+	restartedLimiter := NewRateLimiter(DefaultRateLimiterConfig())
+	restarted := &TokenManager{
+		configs:     configs,
+		exhausted:   make(map[string]bool),
+		rateLimiter: restartedLimiter,
+		stateStore:  NewTokenStateStore(config.TokenStateFile),
+	}
+	restarted.restorePersistedState()
+
+	if !restartedLimiter.IsTokenInCooldown("token_0") {
+		t.Errorf("期望 token_0 的冷却状态在重启后恢复")
+	}
+	if !restarted.exhausted["token_1"] {
+		t.Errorf("期望 token_1 的耗尽标记在重启后恢复")
+	}
+}
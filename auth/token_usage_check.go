@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// usageCheckTarget 一次待执行的使用限制检查
+type usageCheckTarget struct {
+	cacheKey string
+	token    types.TokenInfo
+}
+
+// usageCheckLoop 后台使用限制检查循环
+// 与token刷新解耦：刷新缓存时沿用上次已知的额度，本循环按 USAGE_CHECK_INTERVAL 异步更新
+func (tm *TokenManager) usageCheckLoop() {
+	ticker := time.NewTicker(config.UsageCheckInterval)
+	defer ticker.Stop()
+
+	logger.Info("使用限制检查goroutine已启动",
+		logger.Duration("interval", config.UsageCheckInterval))
+
+	for {
+		select {
+		case <-tm.ctx.Done():
+			logger.Info("使用限制检查goroutine已停止")
+			return
+		case <-ticker.C:
+			tm.refreshUsageLimits()
+		case <-tm.usageCheckTrigger:
+			tm.refreshUsageLimits()
+		}
+	}
+}
+
+// requestUsageCheck 请求后台循环立即检查一次使用限制（不阻塞，可在持有 tm.mutex 时调用）
+func (tm *TokenManager) requestUsageCheck() {
+	select {
+	case tm.usageCheckTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// refreshUsageLimits 检查所有已缓存token的使用限制
+func (tm *TokenManager) refreshUsageLimits() {
+	tm.refreshUsageLimitsWith(NewUsageLimitsChecker().CheckUsageLimits)
+}
+
+// refreshUsageLimitsWith 使用指定的检查函数逐个检查已缓存token的使用限制
+// 检查期间不持有 tm.mutex，仅在写回结果时短暂加锁；检查失败的token保留上次已知的额度
+func (tm *TokenManager) refreshUsageLimitsWith(check func(types.TokenInfo) (*types.UsageLimits, error)) {
+	now := time.Now()
+	tm.mutex.RLock()
+	targets := make([]usageCheckTarget, 0, len(tm.cache.tokens))
+	for key, cached := range tm.cache.tokens {
+		if now.Before(cached.Token.ExpiresAt) {
+			targets = append(targets, usageCheckTarget{cacheKey: key, token: cached.Token})
+		}
+	}
+	tm.mutex.RUnlock()
+
+	stateChanged := false
+	checked, failed := 0, 0
+	for _, target := range targets {
+		if tm.ctx.Err() != nil {
+			return
+		}
+
+		usage, err := check(target.token)
+		if err != nil {
+			failed++
+			logger.Warn("后台检查使用限制失败",
+				logger.String("cache_key", target.cacheKey),
+				logger.Err(err))
+			continue
+		}
+		checked++
+
+		tm.mutex.Lock()
+		// 检查期间缓存已被清除（如账号配置重载）时丢弃结果
+		if cached, exists := tm.cache.tokens[target.cacheKey]; exists {
+			cached.applyUsageLimits(usage, time.Now())
+			tm.recordUsageSnapshotUnlocked(target.cacheKey, cached.Available, cached.UsageCheckedAt)
+			if tm.clearExhaustedUnlocked(target.cacheKey, cached.Available) {
+				stateChanged = true
+			}
+		}
+		tm.mutex.Unlock()
+	}
+
+	if stateChanged {
+		go tm.persistState()
+	}
+
+	logger.Debug("后台使用限制检查完成",
+		logger.Int("checked", checked),
+		logger.Int("failed", failed))
+}
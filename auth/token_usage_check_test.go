@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+func creditUsage(limit, used float64, subscription string) *types.UsageLimits {
+	usage := &types.UsageLimits{
+		UsageBreakdownList: []types.UsageBreakdown{
+			{ResourceType: "CREDIT", UsageLimitWithPrecision: limit, CurrentUsageWithPrecision: used},
+		},
+	}
+	usage.SubscriptionInfo.Type = subscription
+	return usage
+}
+
+func TestTokenManager_RefreshUsageLimitsUpdatesAvailability(t *testing.T) {
+	tm := NewTokenManager([]AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "usage_a"},
+		{AuthType: AuthMethodSocial, RefreshToken: "usage_b"},
+	})
+	defer tm.Stop()
+
+	keyA := fmt.Sprintf(config.TokenCacheKeyFormat, 0)
+	keyB := fmt.Sprintf(config.TokenCacheKeyFormat, 1)
+	tm.mutex.Lock()
+	for _, key := range []string{keyA, keyB} {
+		tm.cache.tokens[key] = &CachedToken{
+			Token:     types.TokenInfo{AccessToken: "access_" + key, ExpiresAt: time.Now().Add(time.Hour)},
+			CachedAt:  time.Now(),
+			Available: 5,
+		}
+	}
+	tm.lastRefresh = time.Now()
+	tm.mutex.Unlock()
+
+	tm.refreshUsageLimitsWith(func(token types.TokenInfo) (*types.UsageLimits, error) {
+		if token.AccessToken == "access_"+keyB {
+			return nil, errors.New("usage api unavailable")
+		}
+		return creditUsage(100, 40, "Kiro Pro"), nil
+	})
+
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	a, b := tm.cache.tokens[keyA], tm.cache.tokens[keyB]
+	if a.Available != 60 || a.AccountLevel != AccountLevelPro || a.UsageCheckedAt.IsZero() {
+		t.Errorf("期望 %s 更新为可用60、Pro等级，实际 available=%v level=%s", keyA, a.Available, a.AccountLevel)
+	}
+	if b.Available != 5 || !b.UsageCheckedAt.IsZero() {
+		t.Errorf("检查失败时应保留上次已知的额度，实际 available=%v", b.Available)
+	}
+}
+
+func TestTokenManager_SelectionDoesNotWaitOnUsageCheck(t *testing.T) {
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "usage_slow"}})
+	defer tm.Stop()
+
+	key := fmt.Sprintf(config.TokenCacheKeyFormat, 0)
+	tm.mutex.Lock()
+	tm.cache.tokens[key] = &CachedToken{
+		Token:     types.TokenInfo{AccessToken: "access_slow", ExpiresAt: time.Now().Add(time.Hour)},
+		CachedAt:  time.Now(),
+		Available: 5,
+	}
+	tm.lastRefresh = time.Now()
+	tm.mutex.Unlock()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tm.refreshUsageLimitsWith(func(types.TokenInfo) (*types.UsageLimits, error) {
+			close(started)
+			<-release
+			return creditUsage(100, 0, ""), nil
+		})
+	}()
+	<-started
+
+	selected := make(chan error, 1)
+	go func() {
+		_, err := tm.getBestToken()
+		selected <- err
+	}()
+	select {
+	case err := <-selected:
+		if err != nil {
+			t.Fatalf("使用限制检查进行中时应按上次已知额度选择token: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("token选择不应等待使用限制检查")
+	}
+
+	close(release)
+	<-done
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	if got := tm.cache.tokens[key].Available; got != 100 {
+		t.Errorf("期望后台检查完成后可用额度更新为100，实际 %v", got)
+	}
+}
+
+func TestTokenManager_PendingUsageCheckIsAsync(t *testing.T) {
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "usage_pending"}})
+	defer tm.Stop()
+
+	// 持有锁时请求检查不应阻塞，重复请求合并为一次
+	tm.mutex.Lock()
+	tm.requestUsageCheck()
+	tm.requestUsageCheck()
+	tm.mutex.Unlock()
+
+	cached := &CachedToken{
+		Token:        types.TokenInfo{AccessToken: "access_pending", ExpiresAt: time.Now().Add(time.Hour)},
+		usagePending: true,
+	}
+	if !cached.IsUsable() {
+		t.Fatal("额度尚待后台检查时token应视为可用")
+	}
+	cached.applyUsageLimits(creditUsage(100, 100, ""), time.Now())
+	if cached.IsUsable() {
+		t.Error("后台检查确认额度耗尽后token应不可用")
+	}
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// selectTokenForModelWithWait 选择指定模型可用的token
+// 没有可用token时（如全部处于短暂冷却），最多等待 TOKEN_WAIT_TIMEOUT 并周期性重新选择；
+// 没有任何账号支持该模型时不等待，直接返回 ModelNotFound
+// 调用者不能持有 tm.mutex，返回时也不持有
+func (tm *TokenManager) selectTokenForModelWithWait(ctx context.Context, requestedModel string) (*CachedToken, string, error) {
+	start := time.Now()
+	deadline := start.Add(config.TokenWaitTimeout)
+
+	for attempt := 0; ; attempt++ {
+		tm.mutex.Lock()
+
+		// 检查是否需要刷新缓存
+		if time.Since(tm.lastRefresh) > config.TokenCacheTTL {
+			if err := tm.refreshCacheUnlocked(); err != nil {
+				logger.Warn("刷新token缓存失败", logger.Err(err))
+			}
+		}
+
+		// 选择下一个可用token（严格轮询 + 模型限制）
+		bestToken, tokenKey, modelSupported := tm.selectNextAvailableTokenForModelUnlocked(requestedModel)
+		tm.mutex.Unlock()
+
+		if bestToken != nil {
+			if attempt > 0 {
+				logger.Info("等待后获得可用token",
+					logger.String("token_key", tokenKey),
+					logger.String("requested_model", requestedModel),
+					logger.Duration("waited", time.Since(start)))
+			}
+			return bestToken, tokenKey, nil
+		}
+
+		if requestedModel != "" && !modelSupported {
+			return nil, "", types.NewModelNotFoundErrorType(
+				requestedModel,
+				fmt.Sprintf("model-gate-%d", time.Now().UnixNano()),
+			)
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			if config.TokenWaitTimeout > 0 {
+				return nil, "", fmt.Errorf("没有可用的token（已等待 %s）", config.TokenWaitTimeout)
+			}
+			return nil, "", fmt.Errorf("没有可用的token")
+		}
+
+		wait := min(tm.nextTokenPollInterval(), remaining)
+		if attempt == 0 {
+			logger.Debug("没有可用的token，等待冷却结束",
+				logger.String("requested_model", requestedModel),
+				logger.Duration("timeout", config.TokenWaitTimeout))
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, "", fmt.Errorf("等待可用token时请求已取消: %w", ctx.Err())
+		case <-tm.ctx.Done():
+			timer.Stop()
+			return nil, "", fmt.Errorf("等待可用token时token管理器已停止")
+		case <-timer.C:
+		}
+	}
+}
+
+// nextTokenPollInterval 返回下次重新选择token前的等待时长
+// 取 TOKEN_WAIT_POLL_INTERVAL 与最早结束的冷却剩余时长中的较小值
+func (tm *TokenManager) nextTokenPollInterval() time.Duration {
+	wait := config.TokenWaitPollInterval
+	if wait <= 0 {
+		wait = 500 * time.Millisecond
+	}
+	if tm.rateLimiter == nil {
+		return wait
+	}
+
+	tm.mutex.RLock()
+	keys := append([]string(nil), tm.configOrder...)
+	tm.mutex.RUnlock()
+
+	for _, key := range keys {
+		if remaining := tm.rateLimiter.CooldownRemaining(key); remaining > 0 && remaining < wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
@@ -0,0 +1,87 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"kiro2api/config"
+	"testing"
+	"time"
+)
+
+// setTestCooldown 让token进入指定时长的冷却
+func setTestCooldown(tm *TokenManager, index int, d time.Duration) {
+	tm.rateLimiter.mutex.Lock()
+	defer tm.rateLimiter.mutex.Unlock()
+	tm.rateLimiter.getOrCreateState(fmt.Sprintf(config.TokenCacheKeyFormat, index)).CooldownEnd = time.Now().Add(d)
+}
+
+func withTokenWaitConfig(t *testing.T, timeout, poll time.Duration) {
+	t.Helper()
+	origTimeout, origPoll := config.TokenWaitTimeout, config.TokenWaitPollInterval
+	config.TokenWaitTimeout, config.TokenWaitPollInterval = timeout, poll
+	t.Cleanup(func() {
+		config.TokenWaitTimeout, config.TokenWaitPollInterval = origTimeout, origPoll
+	})
+}
+
+// TestTokenWait_DisabledFailsImmediately 默认不等待，保持原有的立即失败行为
+func TestTokenWait_DisabledFailsImmediately(t *testing.T) {
+	withTokenWaitConfig(t, 0, time.Second)
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10})
+	setTestCooldown(tm, 0, time.Minute)
+
+	start := time.Now()
+	if _, _, err := tm.GetTokenWithFingerprint(); err == nil {
+		t.Fatal("期望没有可用token时返回错误")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("TOKEN_WAIT_TIMEOUT=0 时不应等待，实际耗时 %v", elapsed)
+	}
+}
+
+// TestTokenWait_ReturnsWhenCooldownEnds 冷却结束后立即获得token，不必等满轮询间隔
+func TestTokenWait_ReturnsWhenCooldownEnds(t *testing.T) {
+	withTokenWaitConfig(t, 2*time.Second, time.Second)
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10})
+	setTestCooldown(tm, 0, 150*time.Millisecond)
+
+	start := time.Now()
+	token, _, err := tm.GetTokenWithFingerprintForModel("")
+	if err != nil {
+		t.Fatalf("期望等待后获得token，实际错误: %v", err)
+	}
+	if token.AccessToken != "access_0" {
+		t.Errorf("期望 access_0，实际 %s", token.AccessToken)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > 800*time.Millisecond {
+		t.Errorf("期望在冷却结束时返回，实际耗时 %v", elapsed)
+	}
+}
+
+// TestTokenWait_TimeoutAndCancel 超时或请求取消时返回错误
+func TestTokenWait_TimeoutAndCancel(t *testing.T) {
+	withTokenWaitConfig(t, 200*time.Millisecond, 50*time.Millisecond)
+	tm := newStrategyTestManager(t, SelectionStrategyRoundRobin, []float64{10})
+	setTestCooldown(tm, 0, time.Minute)
+
+	start := time.Now()
+	if _, _, err := tm.GetTokenWithFingerprint(); err == nil {
+		t.Fatal("期望等待超时后返回错误")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("期望等待满 TOKEN_WAIT_TIMEOUT，实际耗时 %v", elapsed)
+	}
+
+	config.TokenWaitTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, _, err := tm.selectTokenForModelWithWait(ctx, "")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("期望返回 ctx 错误，实际: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ctx 取消后应尽快返回，实际耗时 %v", elapsed)
+	}
+}
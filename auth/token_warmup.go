@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// warmup 启动时预热token缓存：并发刷新所有未禁用的配置并检查使用限制
+// 避免重启后的第一个请求承担全部刷新延迟，同时尽早暴露无效配置
+func (tm *TokenManager) warmup() {
+	tm.warmupWithLoader(tm.loadCachedToken)
+}
+
+// warmupWithLoader 使用指定的加载函数预热缓存（并发数由 TOKEN_WARMUP_CONCURRENCY 控制）
+func (tm *TokenManager) warmupWithLoader(load func(AuthConfig) (*CachedToken, error)) {
+	startTime := time.Now()
+
+	concurrency := config.TokenWarmupConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make([]*CachedToken, len(tm.configs))
+	refreshTokens := make([]string, len(tm.configs)) // 预热时使用的 refresh token，用于识别上游轮换
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	enabled := 0
+	for i, cfg := range tm.configs {
+		if cfg.Disabled {
+			continue
+		}
+		enabled++
+		refreshTokens[i] = cfg.RefreshToken
+
+		wg.Add(1)
+		go func(index int, authConfig AuthConfig) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-tm.ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			cached, err := load(authConfig)
+			if err != nil {
+				logger.Warn("预热token失败",
+					logger.Int("config_index", index),
+					logger.String("auth_type", authConfig.AuthType),
+					logger.Err(err))
+				return
+			}
+			results[index] = cached
+		}(i, cfg)
+	}
+	wg.Wait()
+
+	if tm.ctx.Err() != nil {
+		return
+	}
+
+	warmed, usable := 0, 0
+	stateChanged := false
+	tm.mutex.Lock()
+	for i, cached := range results {
+		if cached == nil {
+			continue
+		}
+		warmed++
+		tm.applyRotatedRefreshTokenUnlocked(i, refreshTokens[i], cached.Token.RefreshToken)
+
+		cacheKey := fmt.Sprintf(config.TokenCacheKeyFormat, i)
+		// 预热期间请求已触发刷新时，保留更新的缓存
+		if existing, exists := tm.cache.tokens[cacheKey]; exists && existing.CachedAt.After(startTime) {
+			cached = existing
+		} else {
+			tm.cache.tokens[cacheKey] = cached
+			if cached.UsageInfo != nil {
+				tm.recordUsageSnapshotUnlocked(cacheKey, cached.Available, cached.CachedAt)
+			}
+			if tm.clearExhaustedUnlocked(cacheKey, cached.Available) {
+				stateChanged = true
+			}
+		}
+		if tm.isCachedTokenSelectableUnlocked(cacheKey, cached) {
+			usable++
+		}
+	}
+	// 全部预热成功时才视为完成一次刷新；有失败的配置则保留懒刷新以便首个请求重试
+	if warmed == enabled && tm.lastRefresh.Before(startTime) {
+		tm.lastRefresh = startTime
+	}
+	tm.mutex.Unlock()
+
+	if stateChanged {
+		go tm.persistState()
+	}
+
+	logger.Info("token预热完成",
+		logger.Int("config_count", len(tm.configs)),
+		logger.Int("enabled_count", enabled),
+		logger.Int("warmed_count", warmed),
+		logger.Int("usable_count", usable),
+		logger.Duration("duration", time.Since(startTime)))
+	if usable == 0 && enabled > 0 {
+		logger.Warn("预热后没有可用的token，请检查账号配置")
+	}
+}
+
+// loadCachedToken 刷新单个配置并查询使用限制，构建缓存条目（预热与主动刷新共用）
+func (tm *TokenManager) loadCachedToken(cfg AuthConfig) (*CachedToken, error) {
+	token, err := tm.refreshSingleToken(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := &CachedToken{
+		Token:        token,
+		CachedAt:     time.Now(),
+		AccountLevel: AccountLevelUnknown,
+		Disabled:     cfg.Disabled,
+	}
+
+	checker := NewUsageLimitsChecker()
+	if usage, checkErr := checker.CheckUsageLimits(token); checkErr == nil {
+		cached.applyUsageLimits(usage, time.Now())
+	} else {
+		logger.Warn("刷新token后检查使用限制失败", logger.Err(checkErr))
+	}
+	return cached, nil
+}
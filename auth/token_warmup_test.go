@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+func TestTokenManager_WarmupPopulatesCache(t *testing.T) {
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "warm_a"},
+		{AuthType: AuthMethodSocial, RefreshToken: "warm_disabled", Disabled: true},
+		{AuthType: AuthMethodSocial, RefreshToken: "warm_b"},
+	}
+	tm := NewTokenManager(configs)
+	defer tm.Stop()
+
+	var mu sync.Mutex
+	var loaded []string
+	tm.warmupWithLoader(func(cfg AuthConfig) (*CachedToken, error) {
+		mu.Lock()
+		loaded = append(loaded, cfg.RefreshToken)
+		mu.Unlock()
+		return &CachedToken{
+			Token:     types.TokenInfo{AccessToken: "access_" + cfg.RefreshToken, ExpiresAt: time.Now().Add(time.Hour)},
+			CachedAt:  time.Now(),
+			Available: 10,
+		}, nil
+	})
+
+	if len(loaded) != 2 {
+		t.Fatalf("期望只预热2个未禁用配置，实际加载: %v", loaded)
+	}
+	for _, refreshToken := range loaded {
+		if refreshToken == "warm_disabled" {
+			t.Errorf("禁用的配置不应被预热")
+		}
+	}
+
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	for _, idx := range []int{0, 2} {
+		if _, ok := tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, idx)]; !ok {
+			t.Errorf("期望 token_%d 已写入缓存", idx)
+		}
+	}
+	if _, ok := tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 1)]; ok {
+		t.Errorf("禁用的配置不应写入缓存")
+	}
+	if tm.lastRefresh.IsZero() {
+		t.Errorf("全部预热成功后应更新 lastRefresh，避免首个请求重复刷新")
+	}
+}
+
+func TestTokenManager_WarmupToleratesFailures(t *testing.T) {
+	configs := []AuthConfig{
+		{AuthType: AuthMethodSocial, RefreshToken: "warm_ok"},
+		{AuthType: AuthMethodSocial, RefreshToken: "warm_fail"},
+	}
+	tm := NewTokenManager(configs)
+	defer tm.Stop()
+
+	tm.warmupWithLoader(func(cfg AuthConfig) (*CachedToken, error) {
+		if cfg.RefreshToken == "warm_fail" {
+			return nil, errors.New("refresh failed")
+		}
+		return &CachedToken{
+			Token:     types.TokenInfo{AccessToken: "access_ok", ExpiresAt: time.Now().Add(time.Hour)},
+			CachedAt:  time.Now(),
+			Available: 5,
+		}, nil
+	})
+
+	if health := tm.GetPoolHealth(); !health.CacheRefreshed || health.Active != 1 {
+		t.Errorf("部分账号预热成功后应视为就绪，实际 %+v", health)
+	}
+
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+	if _, ok := tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 0)]; !ok {
+		t.Errorf("成功的配置应写入缓存")
+	}
+	if _, ok := tm.cache.tokens[fmt.Sprintf(config.TokenCacheKeyFormat, 1)]; ok {
+		t.Errorf("失败的配置不应写入缓存")
+	}
+	if !tm.lastRefresh.IsZero() {
+		t.Errorf("存在失败配置时不应更新 lastRefresh，以便首个请求重试")
+	}
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"fmt"
+	"time"
+
+	"kiro2api/config"
+)
+
+// UsageSnapshot 一次使用限制查询得到的可用额度
+type UsageSnapshot struct {
+	Timestamp time.Time `json:"timestamp"`
+	Available float64   `json:"available"`
+}
+
+// usageHistory 固定容量的可用额度快照环形缓冲区（无锁，由 TokenManager.mutex 保护）
+type usageHistory struct {
+	buf  []UsageSnapshot
+	next int
+	full bool
+}
+
+func newUsageHistory(capacity int) *usageHistory {
+	return &usageHistory{buf: make([]UsageSnapshot, capacity)}
+}
+
+// add 追加快照，缓冲区已满时覆盖最旧的一条
+func (h *usageHistory) add(snapshot UsageSnapshot) {
+	if len(h.buf) == 0 {
+		return
+	}
+	h.buf[h.next] = snapshot
+	h.next = (h.next + 1) % len(h.buf)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// snapshots 按时间从旧到新返回快照副本
+func (h *usageHistory) snapshots() []UsageSnapshot {
+	if !h.full {
+		return append([]UsageSnapshot(nil), h.buf[:h.next]...)
+	}
+	result := make([]UsageSnapshot, 0, len(h.buf))
+	result = append(result, h.buf[h.next:]...)
+	return append(result, h.buf[:h.next]...)
+}
+
+// recordUsageSnapshotUnlocked 记录token刷新使用限制后的可用额度（调用者必须持有 tm.mutex）
+func (tm *TokenManager) recordUsageSnapshotUnlocked(cacheKey string, available float64, at time.Time) {
+	if config.TokenUsageHistorySize <= 0 {
+		return
+	}
+	history, exists := tm.usageHistory[cacheKey]
+	if !exists {
+		history = newUsageHistory(config.TokenUsageHistorySize)
+		tm.usageHistory[cacheKey] = history
+	}
+	history.add(UsageSnapshot{Timestamp: at, Available: available})
+}
+
+// GetUsageHistory 返回指定配置索引的可用额度历史（从旧到新）
+// 索引超出配置范围时 ok 为 false；历史只保存在内存中，ReloadTokens 重建 TokenManager 后清空
+func (tm *TokenManager) GetUsageHistory(index int) (snapshots []UsageSnapshot, ok bool) {
+	tm.mutex.RLock()
+	defer tm.mutex.RUnlock()
+
+	if index < 0 || index >= len(tm.configs) {
+		return nil, false
+	}
+	history, exists := tm.usageHistory[fmt.Sprintf(config.TokenCacheKeyFormat, index)]
+	if !exists {
+		return []UsageSnapshot{}, true
+	}
+	return history.snapshots(), true
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+func TestUsageHistory_RingBufferKeepsNewest(t *testing.T) {
+	h := newUsageHistory(3)
+	base := time.Now()
+	for i := 0; i < 5; i++ {
+		h.add(UsageSnapshot{Timestamp: base.Add(time.Duration(i) * time.Minute), Available: float64(100 - i)})
+	}
+
+	got := h.snapshots()
+	if len(got) != 3 {
+		t.Fatalf("len = %d, want 3", len(got))
+	}
+	for i, want := range []float64{98, 97, 96} {
+		if got[i].Available != want {
+			t.Errorf("snapshots[%d].Available = %v, want %v", i, got[i].Available, want)
+		}
+	}
+
+	// 返回的是副本，修改不影响缓冲区
+	got[0].Available = -1
+	if h.snapshots()[0].Available != 98 {
+		t.Errorf("snapshots 应返回副本")
+	}
+}
+
+func TestTokenManager_UsageHistoryRecordedOnWarmup(t *testing.T) {
+	orig := config.TokenUsageHistorySize
+	config.TokenUsageHistorySize = 2
+	defer func() { config.TokenUsageHistorySize = orig }()
+
+	tm := NewTokenManager([]AuthConfig{{AuthType: AuthMethodSocial, RefreshToken: "history_a"}})
+	defer tm.Stop()
+
+	available := 50.0
+	loader := func(cfg AuthConfig) (*CachedToken, error) {
+		available -= 10
+		return &CachedToken{
+			Token:     types.TokenInfo{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)},
+			UsageInfo: &types.UsageLimits{},
+			CachedAt:  time.Now(),
+			Available: available,
+		}, nil
+	}
+	for i := 0; i < 3; i++ {
+		tm.warmupWithLoader(loader)
+	}
+
+	history, ok := tm.GetUsageHistory(0)
+	if !ok {
+		t.Fatalf("GetUsageHistory(0) ok = false")
+	}
+	if len(history) != 2 || history[0].Available != 30 || history[1].Available != 20 {
+		t.Fatalf("history = %+v, want available [30 20]", history)
+	}
+
+	if _, ok := tm.GetUsageHistory(1); ok {
+		t.Errorf("超出配置范围的索引应返回 ok = false")
+	}
+
+	// 重载时重建 TokenManager，历史随之清空
+	reloaded := NewTokenManager(tm.configs)
+	defer reloaded.Stop()
+	if history, _ := reloaded.GetUsageHistory(0); len(history) != 0 {
+		t.Errorf("新 TokenManager 的历史应为空，实际: %+v", history)
+	}
+}
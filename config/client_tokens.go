@@ -0,0 +1,115 @@
+package config
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ClientTokenEnv 单个客户端认证token
+const ClientTokenEnv = "KIRO_CLIENT_TOKEN"
+
+// ClientTokensEnv 多个客户端认证token（逗号分隔）
+// 为不同调用方分配独立token，便于按调用方限流；与 KIRO_CLIENT_TOKEN、KIRO_CLIENT_TOKENS_FILE 同时设置时合并生效
+// 取自进程环境变量，运行中无法修改，吊销其中的token需要重启
+const ClientTokensEnv = "KIRO_CLIENT_TOKENS"
+
+// ClientTokensFileEnv 客户端token文件路径（每行一个或逗号分隔，# 开头的行为注释）
+// 文件内容变更后调用 reload 接口即可生效，适合需要在运行中吊销token的场景；文件不存在时报错
+const ClientTokensFileEnv = "KIRO_CLIENT_TOKENS_FILE"
+
+var (
+	clientTokens      []string
+	clientTokensMutex sync.RWMutex
+)
+
+// ReadClientTokens 读取 KIRO_CLIENT_TOKEN、KIRO_CLIENT_TOKENS 与 KIRO_CLIENT_TOKENS_FILE 配置的全部客户端token（去重并保持顺序）
+// 只读取配置，不修改当前生效的token列表
+func ReadClientTokens() ([]string, error) {
+	var tokens []string
+	if token := strings.TrimSpace(os.Getenv(ClientTokenEnv)); token != "" {
+		tokens = append(tokens, token)
+	}
+	tokens = append(tokens, parseClientTokenList(os.Getenv(ClientTokensEnv))...)
+
+	if path := strings.TrimSpace(os.Getenv(ClientTokensFileEnv)); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("读取客户端token文件失败: %w", err)
+		}
+		tokens = append(tokens, parseClientTokenList(string(content))...)
+	}
+
+	seen := make(map[string]bool, len(tokens))
+	unique := tokens[:0]
+	for _, token := range tokens {
+		if !seen[token] {
+			seen[token] = true
+			unique = append(unique, token)
+		}
+	}
+	return unique, nil
+}
+
+// parseClientTokenList 解析按行或逗号分隔的token列表，忽略空行与 # 开头的注释行
+func parseClientTokenList(raw string) []string {
+	var tokens []string
+	for _, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, token := range strings.Split(line, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// SetClientTokens 替换当前生效的客户端token列表
+func SetClientTokens(tokens []string) {
+	clientTokensMutex.Lock()
+	defer clientTokensMutex.Unlock()
+	clientTokens = append([]string(nil), tokens...)
+}
+
+// ClientTokenIDs 返回当前生效的客户端token标识（不含明文）
+func ClientTokenIDs() []string {
+	clientTokensMutex.RLock()
+	defer clientTokensMutex.RUnlock()
+	ids := make([]string, 0, len(clientTokens))
+	for _, token := range clientTokens {
+		ids = append(ids, ClientTokenID(token))
+	}
+	return ids
+}
+
+// MatchClientToken 校验客户端提供的token，匹配时返回该token的标识
+// 逐个以常量时间比较，不因匹配位置提前返回
+func MatchClientToken(provided string) (string, bool) {
+	clientTokensMutex.RLock()
+	defer clientTokensMutex.RUnlock()
+
+	matched := ""
+	for _, token := range clientTokens {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1 {
+			matched = token
+		}
+	}
+	if matched == "" {
+		return "", false
+	}
+	return ClientTokenID(matched), true
+}
+
+// ClientTokenID 由客户端token生成稳定的标识（sha256 前8字节），用于日志与按调用方统计，不保留明文
+func ClientTokenID(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "client:" + hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadClientTokens_MergesSingleAndList(t *testing.T) {
+	t.Setenv(ClientTokenEnv, "primary")
+	t.Setenv(ClientTokensEnv, " team-a, team-b ,primary,,")
+
+	tokens, err := ReadClientTokens()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"primary", "team-a", "team-b"}, tokens)
+}
+
+func TestReadClientTokens_FromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client_tokens.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# ci\nteam-ci\n\nteam-web, team-cli\n"), 0600))
+	t.Setenv(ClientTokenEnv, "")
+	t.Setenv(ClientTokensEnv, "team-env")
+	t.Setenv(ClientTokensFileEnv, path)
+
+	tokens, err := ReadClientTokens()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"team-env", "team-ci", "team-web", "team-cli"}, tokens)
+}
+
+func TestReadClientTokens_MissingFileErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.txt")
+	t.Setenv(ClientTokenEnv, "primary")
+	t.Setenv(ClientTokensEnv, "")
+	t.Setenv(ClientTokensFileEnv, path)
+
+	_, err := ReadClientTokens()
+	require.Error(t, err)
+}
+
+func TestReadClientTokens_PathInListIsNotReadAsFile(t *testing.T) {
+	// KIRO_CLIENT_TOKENS 只接受token列表，路径字符串按token处理而不会读取文件
+	path := filepath.Join(t.TempDir(), "client_tokens.txt")
+	require.NoError(t, os.WriteFile(path, []byte("team-file\n"), 0600))
+	t.Setenv(ClientTokenEnv, "")
+	t.Setenv(ClientTokensEnv, path)
+	t.Setenv(ClientTokensFileEnv, "")
+
+	tokens, err := ReadClientTokens()
+	require.NoError(t, err)
+	assert.Equal(t, []string{path}, tokens)
+}
+
+func TestMatchClientToken(t *testing.T) {
+	t.Cleanup(func() { SetClientTokens(nil) })
+	SetClientTokens([]string{"team-a", "team-b"})
+
+	id, ok := MatchClientToken("team-b")
+	assert.True(t, ok)
+	assert.Equal(t, ClientTokenID("team-b"), id)
+	assert.NotContains(t, id, "team-b")
+
+	_, ok = MatchClientToken("team-c")
+	assert.False(t, ok)
+	_, ok = MatchClientToken("")
+	assert.False(t, ok)
+
+	// 吊销：移除token后立即失效
+	SetClientTokens([]string{"team-a"})
+	_, ok = MatchClientToken("team-b")
+	assert.False(t, ok)
+	assert.Equal(t, []string{ClientTokenID("team-a")}, ClientTokenIDs())
+}
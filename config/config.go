@@ -1,6 +1,9 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+)
 
 // DefaultRegion 默认区域（支持 KIRO_REGION 环境变量覆盖）
 var DefaultRegion = getEnvString("KIRO_REGION", "us-east-1")
@@ -27,17 +30,36 @@ func GetIdcRefreshTokenURL() string {
 	return fmt.Sprintf("https://oidc.%s.amazonaws.com/token", DefaultRegion)
 }
 
-// GetCodeWhispererURL 获取 API URL（与 kiro.rs 对齐使用 q.{region}.amazonaws.com）
+// GetCodeWhispererURL 获取 API URL（与 kiro.rs 对齐使用 q.{region}.amazonaws.com，可由 CODEWHISPERER_URL 覆盖）
 func GetCodeWhispererURL() string {
+	if override, _ := codeWhispererOverrides(); override != "" {
+		return override
+	}
 	return fmt.Sprintf("https://q.%s.amazonaws.com/generateAssistantResponse", DefaultRegion)
 }
 
 // GetCodeWhispererHost 获取 API Host 头（与 kiro.rs 对齐）
+// 优先使用 CODEWHISPERER_HOST，其次取 CODEWHISPERER_URL 的主机名
 func GetCodeWhispererHost() string {
+	urlOverride, hostOverride := codeWhispererOverrides()
+	if hostOverride != "" {
+		return hostOverride
+	}
+	if urlOverride != "" {
+		if parsed, err := url.Parse(urlOverride); err == nil {
+			return parsed.Host
+		}
+	}
 	return fmt.Sprintf("q.%s.amazonaws.com", DefaultRegion)
 }
 
 // GetUsageLimitsURL 获取使用限制检查 URL（与 kiro.rs 对齐）
+// 配置了 CODEWHISPERER_URL 时使用同一主机，便于指向同一个模拟服务
 func GetUsageLimitsURL() string {
+	if override, _ := codeWhispererOverrides(); override != "" {
+		if parsed, err := url.Parse(override); err == nil {
+			return (&url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: "/getUsageLimits"}).String()
+		}
+	}
 	return fmt.Sprintf("https://q.%s.amazonaws.com/getUsageLimits", DefaultRegion)
 }
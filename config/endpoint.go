@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// CodeWhispererURLEnv 覆盖上游 generateAssistantResponse 地址（如本地录制/回放服务或其他区域端点）
+const CodeWhispererURLEnv = "CODEWHISPERER_URL"
+
+// CodeWhispererHostEnv 覆盖上游请求的 Host 头（未设置时取 CODEWHISPERER_URL 的主机名）
+const CodeWhispererHostEnv = "CODEWHISPERER_HOST"
+
+var (
+	codeWhispererURLOverride  string
+	codeWhispererHostOverride string
+	codeWhispererMutex        sync.RWMutex
+)
+
+// LoadCodeWhispererEndpoint 从 CODEWHISPERER_URL / CODEWHISPERER_HOST 加载上游端点覆盖并生效
+// 覆盖值格式不合法时返回错误且不生效；未配置时恢复按 KIRO_REGION 生成的默认端点
+func LoadCodeWhispererEndpoint() error {
+	return SetCodeWhispererEndpoint(os.Getenv(CodeWhispererURLEnv), os.Getenv(CodeWhispererHostEnv))
+}
+
+// SetCodeWhispererEndpoint 设置上游端点覆盖（空字符串表示使用默认值）
+// rawURL 必须是带主机名的 http/https 地址；host 只能是主机名（可带端口）
+func SetCodeWhispererEndpoint(rawURL, host string) error {
+	rawURL = strings.TrimSpace(rawURL)
+	host = strings.TrimSpace(host)
+
+	if rawURL != "" {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("%s 不是合法的URL: %w", CodeWhispererURLEnv, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("%s 必须使用 http 或 https: %s", CodeWhispererURLEnv, rawURL)
+		}
+		if parsed.Host == "" {
+			return fmt.Errorf("%s 缺少主机名: %s", CodeWhispererURLEnv, rawURL)
+		}
+	}
+	if host != "" && (strings.Contains(host, "/") || strings.ContainsAny(host, " \t")) {
+		return fmt.Errorf("%s 只能是主机名（可带端口），不能包含协议或路径: %s", CodeWhispererHostEnv, host)
+	}
+
+	codeWhispererMutex.Lock()
+	defer codeWhispererMutex.Unlock()
+	codeWhispererURLOverride = rawURL
+	codeWhispererHostOverride = host
+	return nil
+}
+
+// codeWhispererOverrides 返回当前生效的端点覆盖
+func codeWhispererOverrides() (string, string) {
+	codeWhispererMutex.RLock()
+	defer codeWhispererMutex.RUnlock()
+	return codeWhispererURLOverride, codeWhispererHostOverride
+}
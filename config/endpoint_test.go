@@ -0,0 +1,50 @@
+package config
+
+import "testing"
+
+func TestCodeWhispererEndpointOverride(t *testing.T) {
+	defer SetCodeWhispererEndpoint("", "")
+
+	if got := GetCodeWhispererURL(); got != "https://q."+DefaultRegion+".amazonaws.com/generateAssistantResponse" {
+		t.Errorf("未配置覆盖时应使用默认端点，实际 %s", got)
+	}
+
+	if err := SetCodeWhispererEndpoint("http://127.0.0.1:9000/generateAssistantResponse", ""); err != nil {
+		t.Fatalf("SetCodeWhispererEndpoint: %v", err)
+	}
+	if got := GetCodeWhispererURL(); got != "http://127.0.0.1:9000/generateAssistantResponse" {
+		t.Errorf("GetCodeWhispererURL = %s", got)
+	}
+	if got := GetCodeWhispererHost(); got != "127.0.0.1:9000" {
+		t.Errorf("未设置 CODEWHISPERER_HOST 时应取 URL 的主机名，实际 %s", got)
+	}
+	if got := GetUsageLimitsURL(); got != "http://127.0.0.1:9000/getUsageLimits" {
+		t.Errorf("GetUsageLimitsURL = %s", got)
+	}
+
+	if err := SetCodeWhispererEndpoint("http://127.0.0.1:9000/generateAssistantResponse", "q.eu-central-1.amazonaws.com"); err != nil {
+		t.Fatalf("SetCodeWhispererEndpoint: %v", err)
+	}
+	if got := GetCodeWhispererHost(); got != "q.eu-central-1.amazonaws.com" {
+		t.Errorf("GetCodeWhispererHost = %s", got)
+	}
+}
+
+func TestSetCodeWhispererEndpoint_RejectsMalformed(t *testing.T) {
+	defer SetCodeWhispererEndpoint("", "")
+
+	for _, tc := range []struct{ url, host string }{
+		{"q.us-east-1.amazonaws.com/generateAssistantResponse", ""},
+		{"ftp://example.com/x", ""},
+		{"http://", ""},
+		{"http://[::1", ""},
+		{"", "https://q.us-east-1.amazonaws.com"},
+	} {
+		if err := SetCodeWhispererEndpoint(tc.url, tc.host); err == nil {
+			t.Errorf("期望拒绝 url=%q host=%q", tc.url, tc.host)
+		}
+	}
+	if override, _ := codeWhispererOverrides(); override != "" {
+		t.Errorf("无效配置不应生效，实际 %s", override)
+	}
+}
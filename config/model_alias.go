@@ -0,0 +1,87 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ModelAliasesEnv 自定义模型别名配置（JSON 对象字符串或 JSON 文件路径）
+// 示例：{"gpt-4o": "claude-sonnet-4-6", "internal-fast": "claude-haiku-4-5-20251001"}
+const ModelAliasesEnv = "MODEL_ALIASES"
+
+var (
+	modelAliases      map[string]string // 归一化后的请求模型名 -> 目标模型名
+	modelAliasesMutex sync.RWMutex
+)
+
+// LoadModelAliases 从 MODEL_ALIASES 加载自定义模型别名并生效，返回生效的别名表
+// 未配置时返回空表；任一别名的目标模型无法解析时整体报错，不生效
+func LoadModelAliases() (map[string]string, error) {
+	raw := strings.TrimSpace(os.Getenv(ModelAliasesEnv))
+	if raw == "" {
+		SetModelAliases(nil)
+		return map[string]string{}, nil
+	}
+
+	data := []byte(raw)
+	if fileInfo, err := os.Stat(raw); err == nil && !fileInfo.IsDir() {
+		content, err := os.ReadFile(raw)
+		if err != nil {
+			return nil, fmt.Errorf("读取模型别名文件失败: %w", err)
+		}
+		data = content
+	}
+
+	var aliases map[string]string
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return nil, fmt.Errorf("解析模型别名失败（需为JSON对象或JSON文件路径）: %w", err)
+	}
+	if err := SetModelAliases(aliases); err != nil {
+		return nil, err
+	}
+	return ModelAliases(), nil
+}
+
+// SetModelAliases 设置自定义模型别名（nil 清空）
+// 目标模型只按内置规则解析，不会再次查找别名，避免别名链与循环
+func SetModelAliases(aliases map[string]string) error {
+	normalized := make(map[string]string, len(aliases))
+	for name, target := range aliases {
+		name = NormalizeModelName(name)
+		target = strings.TrimSpace(target)
+		if name == "" {
+			continue
+		}
+		if _, _, ok := resolveBuiltinModelID(target); !ok {
+			return fmt.Errorf("模型别名 %q 的目标模型 %q 无法解析", name, target)
+		}
+		normalized[name] = target
+	}
+
+	modelAliasesMutex.Lock()
+	defer modelAliasesMutex.Unlock()
+	modelAliases = normalized
+	return nil
+}
+
+// ModelAliases 返回当前生效的别名表副本
+func ModelAliases() map[string]string {
+	modelAliasesMutex.RLock()
+	defer modelAliasesMutex.RUnlock()
+	aliases := make(map[string]string, len(modelAliases))
+	for name, target := range modelAliases {
+		aliases[name] = target
+	}
+	return aliases
+}
+
+// lookupModelAlias 查找归一化模型名对应的别名目标
+func lookupModelAlias(normalized string) (string, bool) {
+	modelAliasesMutex.RLock()
+	defer modelAliasesMutex.RUnlock()
+	target, ok := modelAliases[normalized]
+	return target, ok
+}
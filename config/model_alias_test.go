@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveModelID_CustomAliases(t *testing.T) {
+	defer SetModelAliases(nil)
+
+	if err := SetModelAliases(map[string]string{
+		"GPT-4o":        "claude-sonnet-4-6",
+		"internal-fast": "claude-haiku-4-5-20251001",
+	}); err != nil {
+		t.Fatalf("SetModelAliases: %v", err)
+	}
+
+	tests := []struct {
+		model        string
+		wantResolved string
+		wantModelID  string
+	}{
+		{"gpt-4o", CanonicalModelSonnet46, "claude-sonnet-4.6"},
+		{"gpt-4o-thinking", CanonicalModelSonnet46, "claude-sonnet-4.6"},
+		{"internal-fast", CanonicalModelHaiku45, "claude-haiku-4.5"},
+		// 未命中别名时按内置规则解析
+		{"claude-opus-4-5", CanonicalModelOpus45, "claude-opus-4.5"},
+	}
+	for _, tt := range tests {
+		resolved, modelID, ok := ResolveModelID(tt.model)
+		if !ok || resolved != tt.wantResolved || modelID != tt.wantModelID {
+			t.Errorf("ResolveModelID(%q) = %s %s %v, want %s %s", tt.model, resolved, modelID, ok, tt.wantResolved, tt.wantModelID)
+		}
+	}
+	if _, _, ok := ResolveModelID("gpt-3.5-turbo"); ok {
+		t.Errorf("expected unknown model to stay unresolved")
+	}
+}
+
+func TestSetModelAliases_RejectsUnresolvableTarget(t *testing.T) {
+	defer SetModelAliases(nil)
+
+	if err := SetModelAliases(map[string]string{"gpt-4o": "claude-sonnet-4-6"}); err != nil {
+		t.Fatalf("SetModelAliases: %v", err)
+	}
+	// 目标不能是另一个别名，也不能是未知模型；失败时保留原有别名表
+	if err := SetModelAliases(map[string]string{"a": "gpt-4o"}); err == nil {
+		t.Fatalf("expected alias pointing to another alias to be rejected")
+	}
+	if _, ok := ModelAliases()["gpt-4o"]; !ok {
+		t.Fatalf("expected previous aliases to remain after rejected update")
+	}
+}
+
+func TestLoadModelAliases_FromFile(t *testing.T) {
+	defer SetModelAliases(nil)
+
+	path := filepath.Join(t.TempDir(), "model_aliases.json")
+	if err := os.WriteFile(path, []byte(`{"my-model": "claude-opus-4-6"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ModelAliasesEnv, path)
+
+	aliases, err := LoadModelAliases()
+	if err != nil {
+		t.Fatalf("LoadModelAliases: %v", err)
+	}
+	if len(aliases) != 1 || aliases["my-model"] != "claude-opus-4-6" {
+		t.Fatalf("aliases = %v", aliases)
+	}
+
+	t.Setenv(ModelAliasesEnv, `{"broken"`)
+	if _, err := LoadModelAliases(); err == nil {
+		t.Fatalf("expected invalid JSON to fail")
+	}
+}
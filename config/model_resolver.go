@@ -31,7 +31,17 @@ func NormalizeModelName(model string) string {
 // - opus* 且包含 4.5/4-5 -> claude-opus-4.5
 // - opus* 其他 -> claude-opus-4.6
 // - haiku* -> claude-haiku-4.5
+// - gemini* -> 按 GEMINI_MODEL_ALIAS 配置的Claude模型解析
+// MODEL_ALIASES 中配置的自定义别名优先于上述规则；未命中别名时按上述规则解析。
 func ResolveModelID(model string) (resolvedModel string, modelID string, ok bool) {
+	if target, found := lookupModelAlias(NormalizeModelName(model)); found {
+		return resolveBuiltinModelID(target)
+	}
+	return resolveBuiltinModelID(model)
+}
+
+// resolveBuiltinModelID 按内置的模型家族规则解析（不查找自定义别名）
+func resolveBuiltinModelID(model string) (resolvedModel string, modelID string, ok bool) {
 	normalized := NormalizeModelName(model)
 	if normalized == "" {
 		return "", "", false
@@ -50,11 +60,28 @@ func ResolveModelID(model string) (resolvedModel string, modelID string, ok bool
 		return CanonicalModelOpus46, "claude-opus-4.6", true
 	case strings.Contains(normalized, "haiku"):
 		return CanonicalModelHaiku45, "claude-haiku-4.5", true
+	case strings.HasPrefix(normalized, "gemini"):
+		// 别名本身仍为 gemini* 时视为无效配置，避免递归
+		if alias := NormalizeModelName(GeminiModelAlias); alias != "" && !strings.HasPrefix(alias, "gemini") {
+			return ResolveModelID(alias)
+		}
 	}
 
 	return "", "", false
 }
 
+// ResponseModel 返回响应中 model 字段的取值
+// ECHO_RESOLVED_MODEL=true 时为解析后的规范模型名（别名、-thinking 后缀等均已归一化），无法解析时原样返回
+func ResponseModel(model string) string {
+	if !EchoResolvedModel {
+		return model
+	}
+	if resolved, _, ok := ResolveModelID(model); ok {
+		return resolved
+	}
+	return model
+}
+
 // ListRequestModels 返回对外展示的可请求模型列表（去重后有序）。
 func ListRequestModels() []string {
 	seen := make(map[string]struct{}, len(publicRequestModels))
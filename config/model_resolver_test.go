@@ -103,3 +103,37 @@ func TestListRequestModels_ContainsExpectedEntries(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveModelID_GeminiAlias(t *testing.T) {
+	original := GeminiModelAlias
+	defer func() { GeminiModelAlias = original }()
+
+	GeminiModelAlias = "claude-opus-4-6"
+	resolved, modelID, ok := ResolveModelID("gemini-2.5-pro")
+	if !ok || resolved != CanonicalModelOpus46 || modelID != "claude-opus-4.6" {
+		t.Fatalf("unexpected gemini alias resolution: %s %s %v", resolved, modelID, ok)
+	}
+
+	GeminiModelAlias = "gemini-2.5-flash"
+	if _, _, ok := ResolveModelID("gemini-2.5-pro"); ok {
+		t.Fatalf("expected gemini alias pointing to gemini model to be rejected")
+	}
+}
+
+func TestResponseModel(t *testing.T) {
+	original := EchoResolvedModel
+	defer func() { EchoResolvedModel = original }()
+
+	EchoResolvedModel = false
+	if got := ResponseModel("claude-sonnet-4-6-thinking"); got != "claude-sonnet-4-6-thinking" {
+		t.Fatalf("expected requested model to be echoed, got %s", got)
+	}
+
+	EchoResolvedModel = true
+	if got := ResponseModel("claude-sonnet-4-6-thinking"); got != CanonicalModelSonnet46 {
+		t.Fatalf("expected resolved model %s, got %s", CanonicalModelSonnet46, got)
+	}
+	if got := ResponseModel("unknown-model"); got != "unknown-model" {
+		t.Fatalf("expected unresolvable model to be echoed, got %s", got)
+	}
+}
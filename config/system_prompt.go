@@ -0,0 +1,52 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultSystemPromptEnv 默认系统提示（文本或文本文件路径），注入到每个请求的 system 最前面
+const DefaultSystemPromptEnv = "DEFAULT_SYSTEM_PROMPT"
+
+var (
+	defaultSystemPrompt      string
+	defaultSystemPromptMutex sync.RWMutex
+)
+
+// LoadDefaultSystemPrompt 从 DEFAULT_SYSTEM_PROMPT 加载默认系统提示并生效，返回生效的内容
+// 值为存在的文件路径时读取文件内容，否则直接作为提示文本；未配置时清空
+func LoadDefaultSystemPrompt() (string, error) {
+	raw := strings.TrimSpace(os.Getenv(DefaultSystemPromptEnv))
+	if raw == "" {
+		SetDefaultSystemPrompt("")
+		return "", nil
+	}
+
+	prompt := raw
+	if fileInfo, err := os.Stat(raw); err == nil && !fileInfo.IsDir() {
+		content, err := os.ReadFile(raw)
+		if err != nil {
+			return "", fmt.Errorf("读取默认系统提示文件失败: %w", err)
+		}
+		prompt = string(content)
+	}
+
+	SetDefaultSystemPrompt(prompt)
+	return DefaultSystemPrompt(), nil
+}
+
+// SetDefaultSystemPrompt 设置默认系统提示（空字符串表示不注入）
+func SetDefaultSystemPrompt(prompt string) {
+	defaultSystemPromptMutex.Lock()
+	defer defaultSystemPromptMutex.Unlock()
+	defaultSystemPrompt = strings.TrimSpace(prompt)
+}
+
+// DefaultSystemPrompt 返回当前生效的默认系统提示
+func DefaultSystemPrompt() string {
+	defaultSystemPromptMutex.RLock()
+	defer defaultSystemPromptMutex.RUnlock()
+	return defaultSystemPrompt
+}
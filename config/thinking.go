@@ -0,0 +1,44 @@
+package config
+
+import "strings"
+
+// thinkingBudget 模型家族的 thinking budget_tokens 默认值与上限
+type thinkingBudget struct {
+	defaultTokens int
+	maxTokens     int
+}
+
+// thinkingBudgets 各模型家族的 budget_tokens（未匹配的模型使用 ThinkingBudgetTokensDefault / ThinkingBudgetTokensMax）
+// haiku 输出上限较低，默认预算更小，避免思考占满输出
+var thinkingBudgets = map[string]thinkingBudget{
+	"opus":   {defaultTokens: 20000, maxTokens: ThinkingBudgetTokensMax},
+	"sonnet": {defaultTokens: 16000, maxTokens: ThinkingBudgetTokensMax},
+	"haiku":  {defaultTokens: 8192, maxTokens: 16384},
+}
+
+// thinkingBudgetForModel 按模型家族查找 thinking 预算
+func thinkingBudgetForModel(model string) thinkingBudget {
+	normalized := NormalizeModelName(model)
+	for _, family := range []string{"opus", "sonnet", "haiku"} {
+		if strings.Contains(normalized, family) {
+			return thinkingBudgets[family]
+		}
+	}
+	return thinkingBudget{defaultTokens: ThinkingBudgetTokensDefault, maxTokens: ThinkingBudgetTokensMax}
+}
+
+// DefaultThinkingBudget 返回模型的默认 budget_tokens（-thinking 后缀自动开启思考时使用）
+// 设置 THINKING_BUDGET_TOKENS 时优先使用该值，并截断到模型允许的范围内
+func DefaultThinkingBudget(model string) int {
+	budget := thinkingBudgetForModel(model)
+	tokens := budget.defaultTokens
+	if ThinkingBudgetTokensOverride > 0 {
+		tokens = ThinkingBudgetTokensOverride
+	}
+	return min(max(tokens, ThinkingBudgetTokensMin), budget.maxTokens)
+}
+
+// MaxThinkingBudget 返回模型允许的最大 budget_tokens
+func MaxThinkingBudget(model string) int {
+	return thinkingBudgetForModel(model).maxTokens
+}
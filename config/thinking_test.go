@@ -0,0 +1,33 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultThinkingBudget_ByModelFamily(t *testing.T) {
+	assert.Equal(t, 20000, DefaultThinkingBudget("claude-opus-4-5-20251101"))
+	assert.Equal(t, 16000, DefaultThinkingBudget("claude-sonnet-4-5-20250929-thinking"))
+	assert.Equal(t, 8192, DefaultThinkingBudget("claude-haiku-4-5-20251001"))
+	assert.Equal(t, ThinkingBudgetTokensDefault, DefaultThinkingBudget("unknown-model"))
+}
+
+func TestDefaultThinkingBudget_Override(t *testing.T) {
+	orig := ThinkingBudgetTokensOverride
+	defer func() { ThinkingBudgetTokensOverride = orig }()
+
+	ThinkingBudgetTokensOverride = 12000
+	assert.Equal(t, 12000, DefaultThinkingBudget("claude-sonnet-4-6"))
+
+	// 覆盖值超过模型上限时截断，低于全局下限时抬升
+	ThinkingBudgetTokensOverride = 20000
+	assert.Equal(t, 16384, DefaultThinkingBudget("claude-haiku-4-5-20251001"))
+	ThinkingBudgetTokensOverride = 100
+	assert.Equal(t, ThinkingBudgetTokensMin, DefaultThinkingBudget("claude-opus-4-6"))
+}
+
+func TestMaxThinkingBudget(t *testing.T) {
+	assert.Equal(t, ThinkingBudgetTokensMax, MaxThinkingBudget("claude-opus-4-6"))
+	assert.Equal(t, 16384, MaxThinkingBudget("claude-haiku-4-5-20251001"))
+}
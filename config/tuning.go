@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -30,6 +31,59 @@ var HTTPClientKeepAlive = getEnvDuration("HTTP_CLIENT_KEEP_ALIVE", 30*time.Secon
 // HTTPClientTLSHandshakeTimeout HTTP客户端TLS握手超时
 var HTTPClientTLSHandshakeTimeout = getEnvDuration("HTTP_CLIENT_TLS_TIMEOUT", 15*time.Second)
 
+// UpstreamTimeout 上游请求总超时（含流式响应体读取，0 表示不限制）
+// 防止挂起的连接无限期占用goroutine
+var UpstreamTimeout = getEnvDuration("UPSTREAM_TIMEOUT", 10*time.Minute)
+
+// UpstreamConnectTimeout 上游建立TCP连接的超时
+var UpstreamConnectTimeout = getEnvDuration("UPSTREAM_CONNECT_TIMEOUT", 15*time.Second)
+
+// UpstreamMaxIdleConns 上游HTTP连接池保留的空闲连接总数（0 表示不限制）
+var UpstreamMaxIdleConns = getEnvInt("UPSTREAM_MAX_IDLE_CONNS", 200)
+
+// UpstreamMaxIdleConnsPerHost 每个上游主机保留的空闲连接数（0 时使用 Go 默认值 2，高并发下会频繁重新握手TLS）
+var UpstreamMaxIdleConnsPerHost = getEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 100)
+
+// UpstreamIdleConnTimeout 空闲连接在连接池中的保留时长（0 表示不超时）
+var UpstreamIdleConnTimeout = getEnvDuration("UPSTREAM_IDLE_CONN_TIMEOUT", 120*time.Second)
+
+// UpstreamForceConnectionClose 未使用请求指纹时是否发送 Connection: close（每个请求重新建立连接）
+// 默认发送 keep-alive 复用连接；使用指纹时由指纹的 ConnectionBehavior 决定
+var UpstreamForceConnectionClose = getEnvBool("UPSTREAM_FORCE_CONNECTION_CLOSE", false)
+
+// UpstreamNetRetries 上游请求建立连接失败（连接被拒绝、连接超时、DNS 抖动）时的重试次数（0 表示不重试）
+// 连接建立后的网络错误可能已被上游处理，不重试
+var UpstreamNetRetries = getEnvInt("UPSTREAM_NET_RETRIES", 2)
+
+// UpstreamNetRetryInterval 连接失败重试的初始间隔，之后逐次翻倍
+var UpstreamNetRetryInterval = getEnvDuration("UPSTREAM_NET_RETRY_INTERVAL", 200*time.Millisecond)
+
+// NonStreamParseTimeout 非流式请求读取并解析上游响应的超时（0 表示不限制，仅受 UPSTREAM_TIMEOUT 约束）
+// 超时后返回已收到的部分内容
+var NonStreamParseTimeout = getEnvDuration("NONSTREAM_PARSE_TIMEOUT", 2*time.Minute)
+
+// ========== 调试配置 ==========
+
+// TokenIndexOverrideEnabled 允许通过 X-Kiro-Token-Index 请求头指定使用的token配置索引（跳过轮询选择，仅用于排查单个账号问题）
+var TokenIndexOverrideEnabled = getEnvBool("TOKEN_INDEX_OVERRIDE_ENABLED", false)
+
+// SSEStrictMode SSE状态管理器严格模式：事件序列违反 Claude 流式协议时记录完整上下文，
+// 并向客户端下发 error 事件结束流（默认跳过违规事件继续下发）
+var SSEStrictMode = getEnvBool("SSE_STRICT_MODE", false)
+
+// SSEAutoCloseTextBeforeTool 工具块启动前自动关闭未关闭的文本块，避免文本与工具块事件交错（默认开启）
+// 关闭后按上游原生顺序下发，用于排查依赖 Anthropic 原始交错顺序的客户端
+var SSEAutoCloseTextBeforeTool = getEnvBool("SSE_AUTO_CLOSE_TEXT_BEFORE_TOOL", true)
+
+// ========== 上游录制回放配置 ==========
+
+// UpstreamReplayDir 上游响应录制/回放目录（为空时禁用）
+// 未开启 UPSTREAM_RECORD 时按请求哈希回放目录中的录制，不再请求上游
+var UpstreamReplayDir = getEnvString("UPSTREAM_REPLAY_DIR", "")
+
+// UpstreamRecord 为 true 时照常请求上游，并将原始响应字节按请求哈希写入 UPSTREAM_REPLAY_DIR
+var UpstreamRecord = getEnvBool("UPSTREAM_RECORD", false)
+
 // ========== 防封号配置（增强版 - 2025-12-17更新） ==========
 // 问题：多token快速轮换触发AWS安全检测，导致账户被暂停
 // 解决：增加请求间隔，减少轮换频率
@@ -46,6 +100,10 @@ var RateLimitMaxTokenInterval = getEnvDuration("RATE_LIMIT_MAX_INTERVAL", 30*tim
 // 从2秒提升到5秒
 var RateLimitGlobalMinInterval = getEnvDuration("RATE_LIMIT_GLOBAL_MIN_INTERVAL", 5*time.Second)
 
+// RateLimitMinRequestSpacing 单token请求间隔的硬下限（叠加 RATE_LIMIT_JITTER_PERCENT 抖动，0 表示不启用）
+// 与 RATE_LIMIT_MIN_INTERVAL 不同，即使其余间隔均为 0 也会生效；账号可通过 minRequestSpacing 单独覆盖
+var RateLimitMinRequestSpacing = getEnvDuration("RATE_LIMIT_MIN_REQUEST_SPACING", 0)
+
 // RateLimitMaxConsecutiveUse 单token最大连续使用次数
 // 从3次提升到10次，减少轮换频率（关键修改！）
 // 原因：频繁轮换导致AWS检测到异常模式
@@ -55,6 +113,15 @@ var RateLimitMaxConsecutiveUse = getEnvInt("RATE_LIMIT_MAX_CONSECUTIVE", 10)
 // 保持5分钟
 var RateLimitCooldownDuration = getEnvDuration("RATE_LIMIT_COOLDOWN", 5*time.Minute)
 
+// ========== 指纹轮换配置 ==========
+
+// FingerprintRotateRequests 每个token的指纹使用达到该请求数后轮换为新指纹（0 表示不按次数轮换）
+var FingerprintRotateRequests = getEnvInt("FINGERPRINT_ROTATE_REQUESTS", 0)
+
+// FingerprintRotateInterval 每个token的指纹生成超过该时长后轮换为新指纹（0 表示不按时间轮换）
+// 已绑定会话的请求沿用会话分配时的指纹，不受轮换影响
+var FingerprintRotateInterval = getEnvDuration("FINGERPRINT_ROTATE_INTERVAL", 0)
+
 // ========== 新增：智能退避配置 ==========
 
 // RateLimitBackoffBase 指数退避基数
@@ -74,6 +141,13 @@ var RateLimitBackoffMultiplier = getEnvFloat("RATE_LIMIT_BACKOFF_MULTIPLIER", 2.
 // 0 表示不限制
 var RateLimitDailyMaxRequests = getEnvInt("RATE_LIMIT_DAILY_MAX", 500)
 
+// DailyResetTZ 每日计数重置使用的时区（IANA名称，如 Asia/Shanghai）
+// 为空时使用服务器本地时区
+var DailyResetTZ = getEnvString("DAILY_RESET_TZ", "")
+
+// DailyResetHour 每日计数在该时区的第几点重置（0-23，默认 0 即午夜）
+var DailyResetHour = getEnvInt("DAILY_RESET_HOUR", 0)
+
 // ========== 新增：请求抖动配置 ==========
 
 // RateLimitJitterPercent 请求间隔抖动百分比
@@ -97,6 +171,199 @@ var ProactiveRefreshInterval = getEnvDuration("PROACTIVE_REFRESH_INTERVAL", 1*ti
 // ProactiveRefreshThreshold Token过期前多久触发刷新
 var ProactiveRefreshThreshold = getEnvDuration("PROACTIVE_REFRESH_THRESHOLD", 5*time.Minute)
 
+// ProactiveRefreshJitter 是否将同一轮需要刷新的token随机错开到检查间隔内执行（避免集中请求认证端点）
+// 已过期或尚未缓存的token立即刷新，错开时间不超过距过期剩余时间的一半
+var ProactiveRefreshJitter = getEnvBool("PROACTIVE_REFRESH_JITTER", true)
+
+// ProactiveRefreshBackoffBase 主动刷新失败后的重试等待基数，连续失败时按2倍递增（叠加随机抖动）
+var ProactiveRefreshBackoffBase = getEnvDuration("PROACTIVE_REFRESH_BACKOFF_BASE", 1*time.Minute)
+
+// ProactiveRefreshBackoffMax 主动刷新失败后的最长重试等待
+var ProactiveRefreshBackoffMax = getEnvDuration("PROACTIVE_REFRESH_BACKOFF_MAX", 30*time.Minute)
+
+// ========== Token选择策略配置 ==========
+
+// TokenSelectionStrategy Token选择策略
+// 可选值: round_robin（默认，严格轮询）、weighted（按剩余额度加权随机）、lru（最久未使用优先）
+var TokenSelectionStrategy = getEnvString("TOKEN_SELECTION_STRATEGY", "round_robin")
+
+// ========== Token等待配置 ==========
+
+// TokenWaitTimeout 没有可用token（如全部处于冷却期）时最多等待多久再失败，0 表示立即失败
+var TokenWaitTimeout = getEnvDuration("TOKEN_WAIT_TIMEOUT", 0)
+
+// TokenWaitPollInterval 等待期间重新检查token的最长间隔（有冷却即将结束时提前检查）
+var TokenWaitPollInterval = getEnvDuration("TOKEN_WAIT_POLL_INTERVAL", 500*time.Millisecond)
+
+// ========== Token状态持久化配置 ==========
+
+// TokenStatePersistEnabled 是否持久化token冷却/耗尽状态（重启后恢复，默认关闭）
+var TokenStatePersistEnabled = getEnvBool("TOKEN_STATE_PERSIST_ENABLED", false)
+
+// TokenStateFile token状态文件路径
+// 为空时与 OAUTH_TOKEN_FILE 同目录（token_state.json），否则使用当前目录
+var TokenStateFile = getEnvString("TOKEN_STATE_FILE", "")
+
+// ========== 共享Token状态配置 ==========
+
+// TokenStore token状态存储后端：memory（默认，仅进程内）或 redis（多实例共享冷却、每日计数与轮询位置）
+var TokenStore = getEnvString("TOKEN_STORE", "memory")
+
+// TokenStoreRedisURL TOKEN_STORE=redis 时的连接地址（如 redis://:password@127.0.0.1:6379/0）
+var TokenStoreRedisURL = getEnvString("TOKEN_STORE_REDIS_URL", "")
+
+// TokenStoreRedisPrefix Redis 键前缀（多个独立部署共用一个 Redis 时区分）
+var TokenStoreRedisPrefix = getEnvString("TOKEN_STORE_REDIS_PREFIX", "kiro2api:")
+
+// TokenStoreSyncInterval 从共享存储拉取其他实例冷却状态与每日计数的间隔
+var TokenStoreSyncInterval = getEnvDuration("TOKEN_STORE_SYNC_INTERVAL", time.Second)
+
+// ========== 使用限制检查配置 ==========
+
+// UsageCheckInterval 后台检查各token使用限制（可用额度、账号等级）的间隔
+// 刷新token缓存时沿用上次已知的额度，不再同步检查；0 表示关闭后台检查，每次刷新缓存时同步检查
+var UsageCheckInterval = getEnvDuration("USAGE_CHECK_INTERVAL", 5*time.Minute)
+
+// ========== Token预热配置 ==========
+
+// TokenWarmupEnabled 启动时是否并发预热所有未禁用token（刷新 + 使用限制检查）
+var TokenWarmupEnabled = getEnvBool("TOKEN_WARMUP_ENABLED", false)
+
+// TokenWarmupConcurrency 预热时的最大并发数
+var TokenWarmupConcurrency = getEnvInt("TOKEN_WARMUP_CONCURRENCY", 4)
+
+// ========== Token事件Webhook配置 ==========
+
+// TokenEventWebhookURL token冷却/暂停/额度耗尽时推送事件的Webhook地址（为空表示不启用）
+var TokenEventWebhookURL = getEnvString("TOKEN_EVENT_WEBHOOK_URL", "")
+
+// TokenEventWebhookMinCooldown 冷却事件的推送阈值，短于此时长的冷却不推送
+var TokenEventWebhookMinCooldown = getEnvDuration("TOKEN_EVENT_WEBHOOK_MIN_COOLDOWN", 10*time.Minute)
+
+// TokenEventWebhookBufferSize 待推送事件的缓冲区大小，缓冲区满时丢弃新事件
+var TokenEventWebhookBufferSize = getEnvInt("TOKEN_EVENT_WEBHOOK_BUFFER", 100)
+
+// TokenEventWebhookMaxRetries 推送失败（网络错误/5xx/429）时的最大重试次数
+var TokenEventWebhookMaxRetries = getEnvInt("TOKEN_EVENT_WEBHOOK_MAX_RETRIES", 3)
+
+// ========== Token熔断配置 ==========
+
+// CircuitBreakerFailureThreshold 连续失败多少次后打开熔断（0 表示禁用）
+var CircuitBreakerFailureThreshold = getEnvInt("CIRCUIT_BREAKER_FAILURE_THRESHOLD", 5)
+
+// CircuitBreakerOpenDuration 熔断打开后跳过该token的时长，结束后进入半开状态放行一个探测请求
+var CircuitBreakerOpenDuration = getEnvDuration("CIRCUIT_BREAKER_OPEN_DURATION", 5*time.Minute)
+
+// ========== Token用量历史配置 ==========
+
+// TokenUsageHistorySize 每个token保留的可用额度快照数（每次刷新使用限制时记录一条，0 表示不记录）
+// 通过 GET /api/tokens/:index/history 查询，用于观察消耗趋势
+var TokenUsageHistorySize = getEnvInt("TOKEN_USAGE_HISTORY_SIZE", 288)
+
+// ========== Token请求统计配置 ==========
+
+// TokenLatencyWindow 每个token保留最近多少次上游请求用于计算延迟分位数与成功/失败次数（0 表示不统计）
+// 通过 GET /api/tokens 的 request_stats 字段查看
+var TokenLatencyWindow = getEnvInt("TOKEN_LATENCY_WINDOW", 100)
+
+// ========== 账户文件热加载配置 ==========
+
+// AccountsWatchEnabled 是否监听 kiro-accounts-*.json 的变化并自动导入、重载token
+var AccountsWatchEnabled = getEnvBool("ACCOUNTS_WATCH_ENABLED", false)
+
+// AccountsWatchDebounce 文件事件的防抖时间，窗口内的连续事件只触发一次重载
+var AccountsWatchDebounce = getEnvDuration("ACCOUNTS_WATCH_DEBOUNCE", time.Second)
+
+// ========== 监控指标配置 ==========
+
+// MetricsEnabled 是否启用 Prometheus 指标端点（GET /metrics）
+var MetricsEnabled = getEnvBool("METRICS_ENABLED", false)
+
+// ========== 访问日志配置 ==========
+
+// AccessLogEnabled 是否为每个完成的 /v1/messages、/v1/chat/completions 请求输出一行结构化访问日志
+// 访问日志不受 LOG_LEVEL 控制，便于单独采集
+var AccessLogEnabled = getEnvBool("ACCESS_LOG_ENABLED", false)
+
+// LogSSESampleRate DEBUG 级别下 content_block_delta 事件日志的采样间隔
+// 1 表示每个 delta 都记录（默认），N>1 表示每个流每 N 个 delta 记录一次，0 表示不记录 delta；
+// message_start/message_stop/error 等结构性事件始终记录
+var LogSSESampleRate = getEnvInt("LOG_SSE_SAMPLE_RATE", 1)
+
+// ========== 客户端限流配置 ==========
+
+// ClientRateLimitEnabled 是否按客户端身份（API密钥）限流
+var ClientRateLimitEnabled = getEnvBool("CLIENT_RATE_LIMIT_ENABLED", false)
+
+// ClientRateLimitRequestsPerMinute 每个客户端每分钟请求数（0 表示不限制）
+var ClientRateLimitRequestsPerMinute = getEnvInt("CLIENT_RATE_LIMIT_RPM", 60)
+
+// ClientRateLimitBurst 令牌桶容量（突发请求数，0 表示等于 RPM）
+var ClientRateLimitBurst = getEnvInt("CLIENT_RATE_LIMIT_BURST", 0)
+
+// ClientRateLimitMaxConcurrentStreams 每个客户端最大并发流式请求数（0 表示不限制）
+var ClientRateLimitMaxConcurrentStreams = getEnvInt("CLIENT_RATE_LIMIT_MAX_STREAMS", 0)
+
+// ClientRateLimitIdleTTL 空闲客户端限流状态保留时间
+var ClientRateLimitIdleTTL = getEnvDuration("CLIENT_RATE_LIMIT_IDLE_TTL", 10*time.Minute)
+
+// ClientRateLimitUserRequestsPerMinute 按 metadata.user_id 区分的每个终端用户每分钟请求数（0 表示不按用户限流）
+var ClientRateLimitUserRequestsPerMinute = getEnvInt("CLIENT_RATE_LIMIT_USER_RPM", 0)
+
+// ========== 上游并发配置 ==========
+
+// MaxConcurrentUpstream 同时进行的上游请求数上限（流式请求在整个流结束前占用名额，0 表示不限制）
+// 可通过 PUT /api/upstream-concurrency 在运行时调整
+var MaxConcurrentUpstream = getEnvInt("MAX_CONCURRENT_UPSTREAM", 0)
+
+// UpstreamQueueSize 名额已满时最多排队等待的请求数（0 表示不排队，直接返回 503）
+var UpstreamQueueSize = getEnvInt("UPSTREAM_QUEUE_SIZE", 100)
+
+// UpstreamQueueTimeout 排队等待名额的最长时间，超时返回 503（0 表示一直等待直到客户端断开）
+var UpstreamQueueTimeout = getEnvDuration("UPSTREAM_QUEUE_TIMEOUT", 30*time.Second)
+
+// ========== 请求头转发配置 ==========
+
+// ForwardHeaders 需要原样复制到上游请求的客户端请求头（逗号分隔，如 X-Trace-Id），默认不转发
+// 认证相关与逐跳请求头始终不转发，代理自身设置的上游请求头不会被覆盖
+var ForwardHeaders = getEnvList("FORWARD_HEADERS")
+
+// ========== 默认系统提示配置 ==========
+
+// DefaultSystemPromptSkipClients 允许通过 X-Kiro-Skip-System-Prompt 跳过默认系统提示的客户端token标识
+// （client:<sha256前16位>，见 GET /api/client-tokens，逗号分隔）；为空时任何请求都不能跳过
+var DefaultSystemPromptSkipClients = getEnvList("DEFAULT_SYSTEM_PROMPT_SKIP_CLIENTS")
+
+// ========== CORS配置 ==========
+
+// CORSAllowedOrigins 允许跨域访问的来源（逗号分隔）；为空时允许任意来源（Access-Control-Allow-Origin: *，不携带凭据）
+// 配置后仅回显白名单中的 Origin 并设置 Access-Control-Allow-Credentials: true
+var CORSAllowedOrigins = getEnvList("CORS_ALLOWED_ORIGINS")
+
+// CORSAllowedMethods 预检响应中允许的请求方法
+var CORSAllowedMethods = getEnvString("CORS_ALLOWED_METHODS", "GET, POST, PUT, DELETE, OPTIONS")
+
+// CORSAllowedHeaders 预检响应中允许的请求头
+var CORSAllowedHeaders = getEnvString("CORS_ALLOWED_HEADERS", "Content-Type, Authorization, x-api-key, anthropic-version, anthropic-beta")
+
+// ========== 服务关闭配置 ==========
+
+// ShutdownTimeout 收到 SIGTERM/SIGINT 后等待进行中请求（含流式响应）完成的最长时间
+var ShutdownTimeout = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+// ========== 流式保活配置 ==========
+
+// SSEPingInterval 上游静默超过该时长时向客户端发送保活（Anthropic 发送 ping 事件，OpenAI/Gemini 发送SSE注释），0 表示禁用
+// 避免长时间思考期间没有SSE流量，被企业代理当作空闲连接关闭
+var SSEPingInterval = getEnvDuration("SSE_PING_INTERVAL", 15*time.Second)
+
+// ========== 流式缓冲配置 ==========
+
+// StreamBufferMode 流式响应缓冲模式（用于无法转发流式响应的反向代理）
+// off（默认）：不缓冲；header：请求带 X-Kiro-Stream-Buffer: true 时缓冲；always：所有流式请求都缓冲
+// 缓冲时 stream=true 的 /v1/messages 请求在流结束后以一个非流式 JSON 响应返回
+var StreamBufferMode = getEnvString("STREAM_BUFFER_MODE", "off")
+
 // ========== 会话级账号池配置 ==========
 
 // SessionPoolEnabled 是否启用会话级账号池
@@ -114,9 +381,17 @@ var SessionPoolTTL = getEnvDuration("SESSION_POOL_TTL", 30*time.Minute)
 // SessionPoolCooldown 429 后默认冷却时间
 var SessionPoolCooldown = getEnvDuration("SESSION_POOL_COOLDOWN", 60*time.Second)
 
-// SessionPoolRetryInterval 重试间隔
+// SessionPoolRetryInterval 重试间隔（指数退避的初始间隔，之后按 RATE_LIMIT_BACKOFF_MULTIPLIER 递增并叠加 RATE_LIMIT_JITTER_PERCENT 抖动）
 var SessionPoolRetryInterval = getEnvDuration("SESSION_POOL_RETRY_INTERVAL", 100*time.Millisecond)
 
+// SessionPoolRetryMaxInterval 单次重试等待的上限
+var SessionPoolRetryMaxInterval = getEnvDuration("SESSION_POOL_RETRY_MAX_INTERVAL", 5*time.Second)
+
+// SessionTokenStickyAcrossModels 会话切换模型时是否保持绑定的账号
+// true 时只要绑定的账号可用于新模型就继续使用（保持会话连续），仅在账号无法服务该模型时重新分配；
+// false 时会话切换模型即重新选择账号
+var SessionTokenStickyAcrossModels = getEnvBool("SESSION_TOKEN_STICKY_ACROSS_MODELS", true)
+
 // ========== 模型访问控制配置 ==========
 
 // ModelAccessControlEnabled 是否启用按账号等级限制模型访问
@@ -125,6 +400,24 @@ var ModelAccessControlEnabled = getEnvBool("MODEL_ACCESS_CONTROL_ENABLED", true)
 // ModelAccessUnknownAllowed 账号等级未知时是否放行全部模型
 var ModelAccessUnknownAllowed = getEnvBool("MODEL_ACCESS_UNKNOWN_ALLOWED", true)
 
+// FallbackModel 没有任何账号可服务请求的模型时替换使用的模型（为空时直接返回模型未找到错误）
+var FallbackModel = getEnvString("FALLBACK_MODEL", "")
+
+// ========== 输出上限配置 ==========
+
+// MaxTokensCapFree 免费账号的 max_tokens 上限（0 表示不限制）
+// 请求的 max_tokens 超过所选账号等级的上限时自动截断，避免上游拒绝
+var MaxTokensCapFree = getEnvInt("MAX_TOKENS_CAP_FREE", 0)
+
+// MaxTokensCapPro Pro 账号的 max_tokens 上限（0 表示不限制）
+var MaxTokensCapPro = getEnvInt("MAX_TOKENS_CAP_PRO", 0)
+
+// MaxTokensCapEnterprise 企业账号的 max_tokens 上限（0 表示不限制）
+var MaxTokensCapEnterprise = getEnvInt("MAX_TOKENS_CAP_ENTERPRISE", 0)
+
+// MaxTokensCapUnknown 账号等级未知时的 max_tokens 上限（0 表示不限制）
+var MaxTokensCapUnknown = getEnvInt("MAX_TOKENS_CAP_UNKNOWN", 0)
+
 // ========== 工具限制配置 ==========
 
 // MaxToolDescriptionLength 工具描述的最大长度（字符数，默认：10000）
@@ -132,6 +425,118 @@ var ModelAccessUnknownAllowed = getEnvBool("MODEL_ACCESS_UNKNOWN_ALLOWED", true)
 // 防止超长内容导致上游 API 错误
 var MaxToolDescriptionLength = getEnvInt("MAX_TOOL_DESCRIPTION_LENGTH", 10000)
 
+// ToolDescTruncateStrategy 工具描述超过 MAX_TOOL_DESCRIPTION_LENGTH 时的截断策略
+// truncate-end（默认，保留开头）、truncate-middle（保留开头与结尾，适合示例写在末尾的长描述）、
+// summarize-first-line（只保留第一行非空内容）
+var ToolDescTruncateStrategy = getEnvString("TOOL_DESC_TRUNCATE_STRATEGY", "truncate-end")
+
+// ToolMaxNestingDepth 工具结果中嵌套工具调用的最大展开深度（默认：3）
+var ToolMaxNestingDepth = getEnvInt("TOOL_MAX_NESTING_DEPTH", 3)
+
+// ToolMaxCallsPerStream 单次响应中最多创建的工具调用块数量（0 表示不限制）
+// 防止异常循环产生无限多的 tool_use 块
+var ToolMaxCallsPerStream = getEnvInt("TOOL_MAX_CALLS_PER_STREAM", 256)
+
+// ValidateToolInputs 是否按工具 input_schema 检查历史 tool_use 的 input（默认关闭）
+// 可转换的类型偏差自动修正，缺少必填参数或类型不符时返回 400 invalid_request_error
+var ValidateToolInputs = getEnvBool("VALIDATE_TOOL_INPUTS", false)
+
+// ========== 历史截断配置 ==========
+
+// HistoryAutoTruncate 估算的请求token数超过 HISTORY_TRUNCATE_MAX_TOKENS 时是否自动丢弃最早的历史消息
+// 用于避免长对话触发上游 CONTENT_LENGTH_EXCEEDS_THRESHOLD
+var HistoryAutoTruncate = getEnvBool("HISTORY_AUTO_TRUNCATE", false)
+
+// HistoryTruncateMaxTokens 历史截断的token预算（含 system、tools 与全部消息的本地估算值）
+var HistoryTruncateMaxTokens = getEnvInt("HISTORY_TRUNCATE_MAX_TOKENS", 150000)
+
+// UpstreamRequestMaxBytes 转换后发往上游的请求体大小上限（字节，0 表示不检查）
+// 超出时开启 HISTORY_AUTO_TRUNCATE 则逐轮丢弃最早的历史消息，否则直接返回 400，不再请求上游
+var UpstreamRequestMaxBytes = getEnvInt("UPSTREAM_REQUEST_MAX_BYTES", 0)
+
+// ========== Thinking配置 ==========
+
+// ThinkingBudgetTokensOverride 覆盖 -thinking 后缀自动开启思考时的默认 budget_tokens（0 表示按模型家族选择）
+// 默认值：opus 20000、sonnet 16000、haiku 8192；超过模型上限时截断
+var ThinkingBudgetTokensOverride = getEnvInt("THINKING_BUDGET_TOKENS", 0)
+
+// ThinkingToolChoiceAutoDowngrade thinking 模式下强制 tool_choice（any/tool）时降级为 auto 并记录警告，而不是拒绝请求
+var ThinkingToolChoiceAutoDowngrade = getEnvBool("THINKING_TOOLCHOICE_AUTODOWNGRADE", false)
+
+// ========== Assistant 预填充配置 ==========
+
+// DropAssistantPrefill 是否丢弃末尾的 assistant 预填充消息（旧行为）
+// 默认 false：预填充内容作为回复开头下发，并让上游从该内容续写
+var DropAssistantPrefill = getEnvBool("DROP_ASSISTANT_PREFILL", false)
+
+// ========== WebSearch MCP配置 ==========
+
+// WebSearchMCPEnabled 是否通过 MCP 执行 web_search 工具调用
+// 默认 false：与其他工具一起出现的 web_search 定义/调用会被过滤，不发送到上游
+var WebSearchMCPEnabled = getEnvBool("WEB_SEARCH_MCP_ENABLED", false)
+
+// WebSearchMCPURL MCP JSON-RPC 端点（为空时使用 Kiro 内置端点 https://q.{region}.amazonaws.com/mcp）
+var WebSearchMCPURL = getEnvString("WEB_SEARCH_MCP_URL", "")
+
+// WebSearchMCPAuthToken MCP 请求使用的 Bearer token（为空时使用当前账号的 access token）
+var WebSearchMCPAuthToken = getEnvString("WEB_SEARCH_MCP_AUTH_TOKEN", "")
+
+// WebSearchMaxUses 单次请求中最多执行的搜索次数，超出后返回 max_uses_exceeded 结果
+var WebSearchMaxUses = getEnvInt("WEB_SEARCH_MAX_USES", 5)
+
+// ========== 图片压缩配置 ==========
+
+// ImageMaxBytes 单张图片解码后的最大字节数，超过时自动重新编码压缩（0 表示不限制）
+// 用于避免大图触发上游 CONTENT_LENGTH_EXCEEDS_THRESHOLD
+var ImageMaxBytes = getEnvInt("IMAGE_MAX_BYTES", 0)
+
+// ImageMaxDimension 图片最长边的最大像素数，超过时等比缩放（0 表示不限制）
+var ImageMaxDimension = getEnvInt("IMAGE_MAX_DIMENSION", 0)
+
+// ImageSupportedFormats 上游接受的图片格式（jpeg/png/gif/webp/bmp，逗号分隔，默认 jpeg,png,gif,webp）
+// 其他格式（如 BMP、HEIC）发送前转码为 PNG/JPEG，无法转码时直接返回错误，避免上游返回难以定位的 400
+var ImageSupportedFormats = getEnvImageFormats("IMAGE_SUPPORTED_FORMATS", []string{"jpeg", "png", "gif", "webp"})
+
+// ========== 文档附件配置 ==========
+
+// DocumentMaxBytes 单个 document 内容块解码后的最大字节数（默认 32MB，0 表示仅受请求体大小限制）
+var DocumentMaxBytes = getEnvInt("DOCUMENT_MAX_BYTES", 32*1024*1024)
+
+// DocumentMaxTextChars 单个文档提取出的文本最大字符数（默认 200000，0 表示不限制）
+// 文档以文本形式内联发送给上游，超长内容会触发上游 CONTENT_LENGTH_EXCEEDS_THRESHOLD
+var DocumentMaxTextChars = getEnvInt("DOCUMENT_MAX_TEXT_CHARS", 200000)
+
+// ========== 响应模型名配置 ==========
+
+// EchoResolvedModel /v1/messages 响应（流式 message_start 与非流式响应）的 model 字段返回解析后的规范模型名
+// 默认 false：原样返回请求中的模型名
+var EchoResolvedModel = getEnvBool("ECHO_RESOLVED_MODEL", false)
+
+// ========== OpenAI兼容配置 ==========
+
+// OpenAIReasoningField 流式响应中以 delta.reasoning_content 输出 thinking 内容
+// 默认 false：thinking 以 <thinking> 标签包裹后放入 content
+var OpenAIReasoningField = getEnvBool("OPENAI_REASONING_FIELD", false)
+
+// OpenAIMaxN 非流式请求允许的最大 n；每个 choice 单独发起一次上游请求，n 越大单个请求占用的上游并发与配额越多
+var OpenAIMaxN = getEnvInt("OPENAI_MAX_N", 4)
+
+// ========== Gemini兼容配置 ==========
+
+// GeminiModelAlias gemini-* 模型名映射到的Claude模型
+var GeminiModelAlias = getEnvString("GEMINI_MODEL_ALIAS", CanonicalModelSonnet45)
+
+// ========== 批处理配置 ==========
+
+// BatchMaxWorkers Message Batches 并发处理的最大请求数
+var BatchMaxWorkers = getEnvInt("BATCH_MAX_WORKERS", 4)
+
+// BatchMaxRequests 单个批次允许的最大请求数
+var BatchMaxRequests = getEnvInt("BATCH_MAX_REQUESTS", 1000)
+
+// BatchResultTTL 批次结果在内存中的保留时间（从批次结束算起）
+var BatchResultTTL = getEnvDuration("BATCH_RESULT_TTL", 24*time.Hour)
+
 // ========== 辅助函数 ==========
 
 // getEnvDuration 从环境变量读取时间间隔，支持格式如 "5s", "1m", "2h"
@@ -181,3 +586,30 @@ func getEnvString(key string, defaultVal string) string {
 	}
 	return defaultVal
 }
+
+// getEnvImageFormats 从环境变量读取图片格式列表（统一小写，"jpg" 视为 "jpeg"），未设置时返回默认值
+func getEnvImageFormats(key string, defaultVal []string) []string {
+	formats := getEnvList(key)
+	if len(formats) == 0 {
+		return defaultVal
+	}
+	for i, format := range formats {
+		format = strings.TrimPrefix(strings.ToLower(format), "image/")
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		formats[i] = format
+	}
+	return formats
+}
+
+// getEnvList 从环境变量读取逗号分隔的列表（去除空白与空项），未设置时返回 nil
+func getEnvList(key string) []string {
+	var result []string
+	for _, part := range strings.Split(os.Getenv(key), ",") {
+		if trimmed := strings.TrimSpace(part); trimmed != "" {
+			result = append(result, trimmed)
+		}
+	}
+	return result
+}
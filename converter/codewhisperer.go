@@ -3,6 +3,7 @@ package converter
 import (
 	"fmt"
 	"strings"
+	"unicode"
 
 	"kiro2api/config"
 	"kiro2api/logger"
@@ -90,34 +91,7 @@ func extractToolResultsFromMessage(content any) []types.ToolResult {
 
 						// 提取 content - 转换为数组格式
 						if content, exists := block["content"]; exists {
-							// 将 content 转换为 []map[string]any 格式
-							var contentArray []map[string]any
-
-							// 处理不同的 content 格式
-							switch c := content.(type) {
-							case string:
-								// 如果是字符串，包装成标准格式
-								contentArray = []map[string]any{
-									{"text": c},
-								}
-							case []any:
-								// 如果已经是数组，保持原样
-								for _, item := range c {
-									if m, ok := item.(map[string]any); ok {
-										contentArray = append(contentArray, m)
-									}
-								}
-							case map[string]any:
-								// 如果是单个对象，包装成数组
-								contentArray = []map[string]any{c}
-							default:
-								// 其他格式，尝试转换为字符串
-								contentArray = []map[string]any{
-									{"text": fmt.Sprintf("%v", c)},
-								}
-							}
-
-							toolResult.Content = contentArray
+							toolResult.Content = convertToolResultContent(content)
 						}
 
 						// 提取 status (默认为 success)
@@ -148,28 +122,7 @@ func extractToolResultsFromMessage(content any) []types.ToolResult {
 
 				// 处理 content
 				if block.Content != nil {
-					var contentArray []map[string]any
-
-					switch c := block.Content.(type) {
-					case string:
-						contentArray = []map[string]any{
-							{"text": c},
-						}
-					case []any:
-						for _, item := range c {
-							if m, ok := item.(map[string]any); ok {
-								contentArray = append(contentArray, m)
-							}
-						}
-					case map[string]any:
-						contentArray = []map[string]any{c}
-					default:
-						contentArray = []map[string]any{
-							{"text": fmt.Sprintf("%v", c)},
-						}
-					}
-
-					toolResult.Content = contentArray
+					toolResult.Content = convertToolResultContent(block.Content)
 				}
 
 				// 设置 status
@@ -187,6 +140,146 @@ func extractToolResultsFromMessage(content any) []types.ToolResult {
 	return toolResults
 }
 
+// applySamplingParams 将 temperature / top_p / top_k 写入 inferenceConfiguration
+// temperature、top_p 截断到 [0, 1]（OpenAI 的 temperature 上限为 2）；top_k 必须为正整数，否则忽略
+func applySamplingParams(cwReq *types.CodeWhispererRequest, anthropicReq types.AnthropicRequest) {
+	temperature := clampSamplingParam("temperature", anthropicReq.Temperature, 0, 1)
+	topP := clampSamplingParam("top_p", anthropicReq.TopP, 0, 1)
+
+	var topK *int
+	if anthropicReq.TopK != nil {
+		if *anthropicReq.TopK > 0 {
+			value := *anthropicReq.TopK
+			topK = &value
+		} else {
+			logger.Warn("忽略无效的 top_k（必须为正整数）", logger.Int("top_k", *anthropicReq.TopK))
+		}
+	}
+
+	if temperature == nil && topP == nil && topK == nil {
+		return
+	}
+	if cwReq.InferenceConfiguration == nil {
+		cwReq.InferenceConfiguration = &types.InferenceConfiguration{}
+	}
+	cwReq.InferenceConfiguration.Temperature = temperature
+	cwReq.InferenceConfiguration.TopP = topP
+	cwReq.InferenceConfiguration.TopK = topK
+}
+
+// clampSamplingParam 将采样参数截断到 [min, max]，发生截断时记录日志
+func clampSamplingParam(name string, value *float64, min, max float64) *float64 {
+	if value == nil {
+		return nil
+	}
+	clamped := *value
+	if clamped < min {
+		clamped = min
+	} else if clamped > max {
+		clamped = max
+	}
+	if clamped != *value {
+		logger.Warn("采样参数超出有效范围，已截断",
+			logger.String("param", name),
+			logger.Float64("value", *value),
+			logger.Float64("clamped", clamped))
+	}
+	return &clamped
+}
+
+// convertToolResultContent 将 tool_result 的 content 转换为 CodeWhisperer 的内容数组
+// 字符串包装为 {"text": ...}；image 块转换为 {"image": {"format", "source": {"bytes"}}}，其他对象保持原样
+func convertToolResultContent(content any) []map[string]any {
+	var contentArray []map[string]any
+
+	switch c := content.(type) {
+	case string:
+		// 如果是字符串，包装成标准格式
+		contentArray = []map[string]any{
+			{"text": c},
+		}
+	case []any:
+		for _, item := range c {
+			if m, ok := item.(map[string]any); ok {
+				contentArray = append(contentArray, convertToolResultContentItem(m))
+			}
+		}
+	case []map[string]any:
+		for _, m := range c {
+			contentArray = append(contentArray, convertToolResultContentItem(m))
+		}
+	case map[string]any:
+		// 如果是单个对象，包装成数组
+		contentArray = []map[string]any{convertToolResultContentItem(c)}
+	default:
+		// 其他格式，尝试转换为字符串
+		contentArray = []map[string]any{
+			{"text": fmt.Sprintf("%v", c)},
+		}
+	}
+
+	return contentArray
+}
+
+// convertToolResultContentItem 转换 tool_result 内容中的单个块
+// 图片（如浏览器工具返回的截图）转换为 CodeWhisperer 图片结构；无法转换时降级为文本说明，避免把base64当作文本发送
+func convertToolResultContentItem(item map[string]any) map[string]any {
+	if blockType, _ := item["type"].(string); blockType != "image" && blockType != "image_url" {
+		return item
+	}
+
+	contentBlock, err := parseContentBlock(item)
+	var cwImage *types.CodeWhispererImage
+	if err == nil && contentBlock.Source != nil {
+		cwImage, err = toCodeWhispererImage(contentBlock.Source)
+	} else if err == nil {
+		err = fmt.Errorf("缺少图片数据")
+	}
+	if err != nil {
+		logger.Warn("工具结果中的图片无法转换，使用文本占位", logger.Err(err))
+		return map[string]any{"text": fmt.Sprintf("[image omitted: %v]", err)}
+	}
+
+	image := downscaleImages([]types.CodeWhispererImage{*cwImage})[0]
+	return map[string]any{
+		"image": map[string]any{
+			"format": image.Format,
+			"source": map[string]any{
+				"bytes": image.Source.Bytes,
+			},
+		},
+	}
+}
+
+// webSearchToolDescription 启用 MCP 搜索时发送到上游的 web_search 工具描述
+const webSearchToolDescription = "Search the web for up-to-date information. Returns a list of results with title, URL and snippet."
+
+// IsWebSearchToolName 是否为 web_search 服务端工具（含 websearch 变体）
+func IsWebSearchToolName(name string) bool {
+	return name == "web_search" || name == "websearch"
+}
+
+// webSearchToolSpec 构造发送到上游的 web_search 工具定义
+// 客户端声明的是服务端工具（如 web_search_20250305），没有 input_schema，这里统一为 {query}
+func webSearchToolSpec(name string) types.CodeWhispererTool {
+	cwTool := types.CodeWhispererTool{}
+	cwTool.ToolSpecification.Name = name
+	cwTool.ToolSpecification.Description = webSearchToolDescription
+	cwTool.ToolSpecification.InputSchema = types.InputSchema{
+		Json: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"query": map[string]any{
+					"type":        "string",
+					"description": "The search query",
+				},
+			},
+			"required": []any{"query"},
+		},
+	}
+	return cwTool
+}
+
 // truncateDescription 截断描述长度，防止超长内容导致上游 API 错误
 // 参数:
 //   - description: 工具描述内容
@@ -204,18 +297,52 @@ func truncateDescription(description string, toolName string) string {
 
 	// 修复: 使用安全的 UTF-8 截断，避免在多字节字符中间截断
 	// 参考: kiro.rs 2026.1.2 - 修复 UTF-8 字符串截断可能导致 panic 的问题
-	truncatedDesc := utils.TruncateUTF8WithEllipsis(description, maxLen)
+	truncatedDesc := truncateToolDescriptionByStrategy(description, maxLen)
 
 	// 记录警告日志，帮助用户了解哪个工具的描述被截断
 	logger.Warn("工具描述被截断",
 		logger.String("tool_name", toolName),
 		logger.Int("original_length", len(description)),
 		logger.Int("truncated_length", len(truncatedDesc)),
-		logger.Int("max_allowed", maxLen))
+		logger.Int("max_allowed", maxLen),
+		logger.String("strategy", config.ToolDescTruncateStrategy))
 
 	return truncatedDesc
 }
 
+// prefillContinuationPrompt 转发 assistant prefill 时追加的续写指令
+const prefillContinuationPrompt = "Continue your previous response exactly from where it ends. Output only the continuation, without repeating any of the previous text."
+
+// AssistantPrefillText 提取 assistant 预填充消息的文本
+// 仅支持纯文本内容（字符串或全部为 text 块），包含工具调用等其他块时返回空串；末尾空白会被去除（与官方API一致）
+func AssistantPrefillText(content any) string {
+	var builder strings.Builder
+	switch v := content.(type) {
+	case string:
+		builder.WriteString(v)
+	case []any:
+		for _, item := range v {
+			block, ok := item.(map[string]any)
+			if !ok || block["type"] != "text" {
+				return ""
+			}
+			text, _ := block["text"].(string)
+			builder.WriteString(text)
+		}
+	case []map[string]any:
+		for _, block := range v {
+			if block["type"] != "text" {
+				return ""
+			}
+			text, _ := block["text"].(string)
+			builder.WriteString(text)
+		}
+	default:
+		return ""
+	}
+	return strings.TrimRightFunc(builder.String(), unicode.IsSpace)
+}
+
 // BuildCodeWhispererRequest 构建 CodeWhisperer 请求
 func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Context) (types.CodeWhispererRequest, error) {
 	// logger.Debug("构建CodeWhisperer请求", logger.String("profile_arn", profileArn))
@@ -261,10 +388,18 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		return cwReq, fmt.Errorf("消息列表为空")
 	}
 
-	// 预处理 assistant prefill：如果末尾不是 user，则静默丢弃并截断到最后一条 user
-	// 参考：kiro.rs fix #72 - Claude 4.x 已弃用 assistant prefill，Kiro API 也不支持
+	// 预处理 assistant prefill：Kiro API 要求以 user 消息结尾
+	// - 请求携带 AssistantPrefill 时：预填充保留在历史中，追加一条续写指令作为当前消息，让上游从预填充处继续
+	// - 否则静默丢弃并截断到最后一条 user（参考：kiro.rs fix #72）
 	messages := anthropicReq.Messages
-	if strings.TrimSpace(messages[len(messages)-1].Role) != "user" {
+	if anthropicReq.AssistantPrefill != "" && strings.TrimSpace(messages[len(messages)-1].Role) == "assistant" {
+		logger.Debug("转发 assistant prefill，追加续写指令",
+			logger.Int("prefill_len", len(anthropicReq.AssistantPrefill)))
+		messages = append(append([]types.AnthropicRequestMessage(nil), messages...), types.AnthropicRequestMessage{
+			Role:    "user",
+			Content: prefillContinuationPrompt,
+		})
+	} else if strings.TrimSpace(messages[len(messages)-1].Role) != "user" {
 		lastUserIdx := -1
 		for i := len(messages) - 1; i >= 0; i-- {
 			if strings.TrimSpace(messages[i].Role) == "user" {
@@ -282,6 +417,12 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		messages = messages[:lastUserIdx+1]
 	}
 
+	// 默认系统提示（DEFAULT_SYSTEM_PROMPT）；服务端已注入时不会重复注入
+	ApplyDefaultSystemPrompt(&anthropicReq, ctx)
+
+	// 可选：历史过长时丢弃最早的消息（HISTORY_AUTO_TRUNCATE）
+	messages = truncateHistoryToBudget(anthropicReq, messages)
+
 	// 宽松模型归一化：兼容别名与家族匹配（对齐 kiro.rs）
 	resolvedModel, modelId, ok := config.ResolveModelID(anthropicReq.Model)
 	if !ok {
@@ -312,7 +453,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = textContent
 	// 确保Images字段始终是数组，即使为空
 	if len(images) > 0 {
-		cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = images
+		cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = downscaleImages(images)
 	} else {
 		cwReq.ConversationState.CurrentMessage.UserInputMessage.Images = []types.CodeWhispererImage{}
 	}
@@ -339,8 +480,12 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 				continue
 			}
 
-			// 过滤不支持的工具：web_search (不发送到上游)
-			if tool.Name == "web_search" || tool.Name == "websearch" {
+			// web_search：启用 MCP 时作为普通工具发送到上游（调用由代理执行），否则过滤
+			if IsWebSearchToolName(tool.Name) {
+				if anthropicReq.WebSearchMCP {
+					currentTools = append(currentTools, webSearchToolSpec(tool.Name))
+					continue
+				}
 				logger.Warn("过滤不支持的工具定义",
 					logger.String("tool_name", tool.Name),
 					logger.String("reason", "web_search 工具不被后端支持"))
@@ -374,26 +519,14 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		// 生成 thinking 前缀（借鉴 kiro.rs，支持 adaptive 模式）
 		thinkingPrefix := generateThinkingPrefixWithRequest(anthropicReq)
 
-		// 构建综合系统提示
-		var systemContentBuilder strings.Builder
-
-		// 添加原有的 system 消息
-		if len(anthropicReq.System) > 0 {
-			for _, sysMsg := range anthropicReq.System {
-				content, err := utils.GetMessageContent(sysMsg)
-				if err == nil {
-					systemContentBuilder.WriteString(content)
-					systemContentBuilder.WriteString("\n")
-				}
-			}
-		}
+		// 构建综合系统提示：多个 system 块按顺序以分隔符连接，保留块边界
+		systemContent := buildSystemContent(anthropicReq.System)
 
 		// 如果有系统内容，添加到历史记录 (恢复v0.4结构化类型)
-		if systemContentBuilder.Len() > 0 {
-			systemContent := strings.TrimSpace(systemContentBuilder.String())
-
+		if systemContent != "" {
 			// 注入 thinking 标签到系统消息最前面（借鉴 kiro.rs）
 			// 如果启用了 thinking 且系统消息中不存在 thinking 标签，则注入
+			// 标签单独占一行，不并入第一个 system 块
 			if thinkingPrefix != "" && !hasThinkingTags(systemContent) {
 				systemContent = thinkingPrefix + "\n" + systemContent
 				logger.Debug("已注入 thinking 标签到系统消息",
@@ -448,7 +581,7 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			if len(assistantBuffer) == 0 {
 				return
 			}
-			mergedAssistant := mergeAssistantMessagesToHistory(assistantBuffer)
+			mergedAssistant := mergeAssistantMessagesToHistory(assistantBuffer, anthropicReq.WebSearchMCP)
 			appendHistoryAssistantMessage(&history, mergedAssistant)
 			assistantBuffer = nil
 		}
@@ -481,8 +614,8 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			mergedUserMsg := mergeHistoryUserMessages(userBuffer, modelId)
 			history = append(history, mergedUserMsg)
 
-			assistantMsg := types.HistoryAssistantMessage{}
-			assistantMsg.AssistantResponseMessage.Content = "OK"
+			assistantMsg := types.HistoryAssistantMessage{Placeholder: true}
+			assistantMsg.AssistantResponseMessage.Content = emptyAssistantHistoryPlaceholder
 			assistantMsg.AssistantResponseMessage.ToolUses = nil
 			appendHistoryAssistantMessage(&history, assistantMsg)
 
@@ -504,6 +637,9 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 		}
 	}
 
+	// 去除既无内容也无工具调用的 user/assistant 历史对，它们对上下文没有贡献且可能被上游拒绝
+	cwReq.ConversationState.History = pruneEmptyHistoryPairs(cwReq.ConversationState.History)
+
 	// 历史中出现过的工具即使本轮未显式声明，也补齐占位定义，避免上游400
 	currentTools = ensureHistoryToolsPresent(currentTools, cwReq.ConversationState.History)
 	if len(currentTools) > 0 {
@@ -522,15 +658,15 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			return cwReq, fmt.Errorf("thinking 配置验证失败: %v", err)
 		}
 
-		// 规范化 budget_tokens（自动截断超限值，借鉴 kiro.rs）
-		budgetTokens := anthropicReq.Thinking.NormalizeBudgetTokens()
+		// 规范化 budget_tokens（按模型上限自动截断超限值，借鉴 kiro.rs；interleaved-thinking 时截断到 max_tokens 以内）
+		budgetTokens := requestThinkingBudget(anthropicReq)
 
 		// 如果值被调整，记录日志
 		if budgetTokens != anthropicReq.Thinking.BudgetTokens {
 			logger.Warn("budget_tokens 已自动调整",
 				logger.Int("original", anthropicReq.Thinking.BudgetTokens),
 				logger.Int("adjusted", budgetTokens),
-				logger.Int("max_allowed", config.ThinkingBudgetTokensMax))
+				logger.Int("max_allowed", config.MaxThinkingBudget(anthropicReq.Model)))
 		}
 
 		// 智能调整 max_tokens：确保 max_tokens > budget_tokens
@@ -544,9 +680,15 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 				logger.Int("adjusted_max_tokens", effectiveMaxTokens))
 		}
 
-		// 验证 tool_choice 兼容性
+		// 验证 tool_choice 兼容性（开启 THINKING_TOOLCHOICE_AUTODOWNGRADE 时降级为 auto，不再强制调用工具）
 		if err := validateToolChoiceForThinking(anthropicReq); err != nil {
-			return cwReq, err
+			if !config.ThinkingToolChoiceAutoDowngrade {
+				return cwReq, err
+			}
+			logger.Warn("thinking 模式下 tool_choice 已降级为 auto",
+				logger.String("model", anthropicReq.Model),
+				logger.String("reason", err.Error()))
+			anthropicReq.ToolChoice = &types.ToolChoice{Type: "auto"}
 		}
 
 		// 设置 inferenceConfiguration
@@ -558,11 +700,6 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			},
 		}
 
-		// 如果有 temperature，也添加到配置中
-		if anthropicReq.Temperature != nil {
-			cwReq.InferenceConfiguration.Temperature = anthropicReq.Temperature
-		}
-
 		logger.Debug("已启用 thinking 模式",
 			logger.String("model", anthropicReq.Model),
 			logger.String("thinking_type", anthropicReq.Thinking.Type),
@@ -570,6 +707,9 @@ func BuildCodeWhispererRequest(anthropicReq types.AnthropicRequest, ctx *gin.Con
 			logger.Int("max_tokens", effectiveMaxTokens))
 	}
 
+	// 采样参数对所有请求透传（不仅限于 thinking 模式）
+	applySamplingParams(&cwReq, anthropicReq)
+
 	// 最终验证请求完整性 (KISS: 简化验证逻辑)
 	if err := validateCodeWhispererRequest(&cwReq); err != nil {
 		return cwReq, fmt.Errorf("请求验证失败: %v", err)
@@ -610,7 +750,7 @@ func mergeHistoryUserMessages(messages []*types.AnthropicRequestMessage, modelId
 
 	mergedUserMsg.UserInputMessage.Content = strings.Join(contentParts, "\n")
 	if len(allImages) > 0 {
-		mergedUserMsg.UserInputMessage.Images = allImages
+		mergedUserMsg.UserInputMessage.Images = downscaleImages(allImages)
 	}
 	if len(allToolResults) > 0 {
 		mergedUserMsg.UserInputMessage.UserInputMessageContext.ToolResults = allToolResults
@@ -680,44 +820,63 @@ func extractThinkingAndTextFromAssistantContent(content any) (thinking string, t
 	return thinkingBuilder.String(), textBuilder.String()
 }
 
-// convertAssistantMessageToHistory 将单条 Anthropic assistant 消息转换为 Kiro history assistant 消息。
-// 修复：
-// - thinking 块转为 <thinking>...</thinking> 标签文本（与 kiro.rs 对齐）
-// - 仅 tool_use 时注入占位空格，避免上游 400
-func convertAssistantMessageToHistory(msg *types.AnthropicRequestMessage) types.HistoryAssistantMessage {
-	out := types.HistoryAssistantMessage{}
+// historyToolUsePlaceholder 仅含 tool_use 的 assistant 历史消息的 content（参考 kiro.rs：单个空格占位，避免污染上下文）
+const historyToolUsePlaceholder = " "
+
+// emptyAssistantHistoryPlaceholder 既无文本也无工具调用的 assistant 历史消息的 content
+// 上游拒绝空 content，且对纯空白内容的处理不稳定，这里统一使用简短的占位回复
+const emptyAssistantHistoryPlaceholder = "OK"
+
+// isBlankHistoryAssistantContent 判断 assistant 历史内容是否没有实际信息（空白或上游的默认回复）
+// 注入的 emptyAssistantHistoryPlaceholder 通过 Placeholder 标记识别，客户端真实的同名回复不视为空
+func isBlankHistoryAssistantContent(content string) bool {
+	trimmed := strings.TrimSpace(content)
+	return trimmed == "" || trimmed == "answer for user question"
+}
 
+// isBlankHistoryAssistant 判断 assistant 历史消息的内容是否为注入的占位回复或没有实际信息
+func isBlankHistoryAssistant(msg types.HistoryAssistantMessage) bool {
+	return msg.Placeholder || isBlankHistoryAssistantContent(msg.AssistantResponseMessage.Content)
+}
+
+// normalizeHistoryAssistantContent 将空的 assistant 历史内容替换为占位内容（Kiro API 要求 content 非空）
+// 仅含 tool_use 时使用空格占位，完全为空时使用 emptyAssistantHistoryPlaceholder 并返回 placeholder=true
+func normalizeHistoryAssistantContent(content string, hasToolUses bool) (normalized string, placeholder bool) {
+	if !isBlankHistoryAssistantContent(content) {
+		return content, false
+	}
+	if hasToolUses {
+		return historyToolUsePlaceholder, false
+	}
+	return emptyAssistantHistoryPlaceholder, true
+}
+
+// assistantHistoryContent 提取单条 Anthropic assistant 消息的历史文本与工具调用（文本未做占位处理，可能为空）
+// thinking 块转为 <thinking>...</thinking> 标签文本（与 kiro.rs 对齐）
+func assistantHistoryContent(msg *types.AnthropicRequestMessage, keepWebSearch bool) (string, []types.ToolUseEntry) {
 	if msg == nil {
-		out.AssistantResponseMessage.Content = " "
-		out.AssistantResponseMessage.ToolUses = nil
-		return out
+		return "", nil
 	}
 
 	thinkingContent, textContent := extractThinkingAndTextFromAssistantContent(msg.Content)
-	toolUses := extractToolUsesFromMessage(msg.Content)
-
-	trimThinking := strings.TrimSpace(thinkingContent)
-	trimText := strings.TrimSpace(textContent)
+	toolUses := extractToolUsesFromMessage(msg.Content, keepWebSearch)
 
-	finalContent := ""
-	if trimThinking != "" {
-		if trimText != "" {
-			finalContent = fmt.Sprintf("<thinking>%s</thinking>\n\n%s", thinkingContent, textContent)
-		} else {
-			finalContent = fmt.Sprintf("<thinking>%s</thinking>", thinkingContent)
-		}
-	} else if trimText == "" && len(toolUses) > 0 {
-		finalContent = " "
-	} else {
-		finalContent = textContent
+	if strings.TrimSpace(thinkingContent) == "" {
+		return textContent, toolUses
 	}
-
-	// Kiro API 要求 content 字段不能为空；空内容降级为空格
-	if strings.TrimSpace(finalContent) == "" || finalContent == "answer for user question" {
-		finalContent = " "
+	if strings.TrimSpace(textContent) != "" {
+		return fmt.Sprintf("<thinking>%s</thinking>\n\n%s", thinkingContent, textContent), toolUses
 	}
+	return fmt.Sprintf("<thinking>%s</thinking>", thinkingContent), toolUses
+}
+
+// convertAssistantMessageToHistory 将单条 Anthropic assistant 消息转换为 Kiro history assistant 消息。
+// 空内容按 normalizeHistoryAssistantContent 注入占位，避免上游 400
+func convertAssistantMessageToHistory(msg *types.AnthropicRequestMessage, keepWebSearch bool) types.HistoryAssistantMessage {
+	content, toolUses := assistantHistoryContent(msg, keepWebSearch)
 
-	out.AssistantResponseMessage.Content = finalContent
+	out := types.HistoryAssistantMessage{}
+	out.AssistantResponseMessage.Content, out.Placeholder = normalizeHistoryAssistantContent(content, len(toolUses) > 0)
 	if len(toolUses) > 0 {
 		out.AssistantResponseMessage.ToolUses = toolUses
 	} else {
@@ -728,60 +887,39 @@ func convertAssistantMessageToHistory(msg *types.AnthropicRequestMessage) types.
 }
 
 // mergeAssistantMessagesToHistory 合并连续 assistant 消息为一条 history assistant（参考 kiro.rs Issue #79）。
-func mergeAssistantMessagesToHistory(messages []*types.AnthropicRequestMessage) types.HistoryAssistantMessage {
-	if len(messages) == 0 {
-		out := types.HistoryAssistantMessage{}
-		out.AssistantResponseMessage.Content = " "
-		out.AssistantResponseMessage.ToolUses = nil
-		return out
-	}
+func mergeAssistantMessagesToHistory(messages []*types.AnthropicRequestMessage, keepWebSearch bool) types.HistoryAssistantMessage {
 	if len(messages) == 1 {
-		return convertAssistantMessageToHistory(messages[0])
+		return convertAssistantMessageToHistory(messages[0], keepWebSearch)
 	}
 
 	var allToolUses []types.ToolUseEntry
 	var contentParts []string
 
 	for _, msg := range messages {
-		converted := convertAssistantMessageToHistory(msg)
-
-		if c := strings.TrimSpace(converted.AssistantResponseMessage.Content); c != "" && c != "answer for user question" {
-			contentParts = append(contentParts, converted.AssistantResponseMessage.Content)
-		}
-		if len(converted.AssistantResponseMessage.ToolUses) > 0 {
-			allToolUses = append(allToolUses, converted.AssistantResponseMessage.ToolUses...)
+		content, toolUses := assistantHistoryContent(msg, keepWebSearch)
+		if !isBlankHistoryAssistantContent(content) {
+			contentParts = append(contentParts, content)
 		}
-	}
-
-	content := ""
-	if len(contentParts) == 0 {
-		// 只要落到 history，就尽量保证 content 非空，避免上游 400
-		content = " "
-	} else {
-		content = strings.Join(contentParts, "\n\n")
+		allToolUses = append(allToolUses, toolUses...)
 	}
 
 	out := types.HistoryAssistantMessage{}
-	out.AssistantResponseMessage.Content = content
+	out.AssistantResponseMessage.Content, out.Placeholder = normalizeHistoryAssistantContent(strings.Join(contentParts, "\n\n"), len(allToolUses) > 0)
 	if len(allToolUses) > 0 {
 		out.AssistantResponseMessage.ToolUses = allToolUses
 	} else {
 		out.AssistantResponseMessage.ToolUses = nil
 	}
 
-	if strings.TrimSpace(out.AssistantResponseMessage.Content) == "" {
-		out.AssistantResponseMessage.Content = " "
-	}
-
 	return out
 }
 
 func mergeTwoHistoryAssistantMessages(a, b types.HistoryAssistantMessage) types.HistoryAssistantMessage {
 	var parts []string
-	if strings.TrimSpace(a.AssistantResponseMessage.Content) != "" && a.AssistantResponseMessage.Content != "answer for user question" {
+	if !isBlankHistoryAssistant(a) {
 		parts = append(parts, a.AssistantResponseMessage.Content)
 	}
-	if strings.TrimSpace(b.AssistantResponseMessage.Content) != "" && b.AssistantResponseMessage.Content != "answer for user question" {
+	if !isBlankHistoryAssistant(b) {
 		parts = append(parts, b.AssistantResponseMessage.Content)
 	}
 
@@ -794,17 +932,13 @@ func mergeTwoHistoryAssistantMessages(a, b types.HistoryAssistantMessage) types.
 	}
 
 	out := types.HistoryAssistantMessage{}
-	out.AssistantResponseMessage.Content = strings.Join(parts, "\n\n")
+	out.AssistantResponseMessage.Content, out.Placeholder = normalizeHistoryAssistantContent(strings.Join(parts, "\n\n"), len(allToolUses) > 0)
 	if len(allToolUses) > 0 {
 		out.AssistantResponseMessage.ToolUses = allToolUses
 	} else {
 		out.AssistantResponseMessage.ToolUses = nil
 	}
 
-	if strings.TrimSpace(out.AssistantResponseMessage.Content) == "" {
-		out.AssistantResponseMessage.Content = " "
-	}
-
 	return out
 }
 
@@ -835,7 +969,8 @@ func appendHistoryAssistantMessage(history *[]any, assistant types.HistoryAssist
 }
 
 // extractToolUsesFromMessage 从助手消息内容中提取工具调用
-func extractToolUsesFromMessage(content any) []types.ToolUseEntry {
+// keepWebSearch 为 false 时过滤 web_search 调用（上游未声明该工具）
+func extractToolUsesFromMessage(content any, keepWebSearch bool) []types.ToolUseEntry {
 	var toolUses []types.ToolUseEntry
 
 	switch v := content.(type) {
@@ -856,8 +991,8 @@ func extractToolUsesFromMessage(content any) []types.ToolUseEntry {
 							toolUse.Name = name
 						}
 
-						// 过滤不支持的工具：web_search
-						if toolUse.Name == "web_search" || toolUse.Name == "websearch" {
+						// 过滤不支持的工具：web_search（启用 MCP 时保留，续写请求中携带已执行的搜索）
+						if IsWebSearchToolName(toolUse.Name) && !keepWebSearch {
 							logger.Warn("过滤历史消息中不支持的工具调用",
 								logger.String("tool_name", toolUse.Name),
 								logger.String("reason", "web_search 工具不被后端支持"))
@@ -892,8 +1027,8 @@ func extractToolUsesFromMessage(content any) []types.ToolUseEntry {
 					toolUse.Name = *block.Name
 				}
 
-				// 过滤不支持的工具：web_search
-				if toolUse.Name == "web_search" || toolUse.Name == "websearch" {
+				// 过滤不支持的工具：web_search（启用 MCP 时保留）
+				if IsWebSearchToolName(toolUse.Name) && !keepWebSearch {
 					logger.Warn("过滤历史消息中不支持的工具调用",
 						logger.String("tool_name", toolUse.Name),
 						logger.String("reason", "web_search 工具不被后端支持"))
@@ -924,6 +1059,26 @@ func extractToolUsesFromMessage(content any) []types.ToolUseEntry {
 	return toolUses
 }
 
+// systemBlockDelimiter 多个 system 块之间的分隔符
+const systemBlockDelimiter = "\n\n---\n\n"
+
+// buildSystemContent 将 system 块按顺序转换为系统提示文本
+// 上游只接受纯文本：单个块原样使用，多个块以 systemBlockDelimiter 分隔，避免块边界丢失；
+// 空白块被跳过。cache_control 等块元数据保留在请求结构中，不写入提示文本
+func buildSystemContent(blocks []types.AnthropicSystemMessage) string {
+	parts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		content, err := utils.GetMessageContent(block)
+		if err != nil {
+			continue
+		}
+		if content = strings.TrimSpace(content); content != "" {
+			parts = append(parts, content)
+		}
+	}
+	return strings.Join(parts, systemBlockDelimiter)
+}
+
 // generateThinkingPrefix 生成 thinking 标签前缀（借鉴 kiro.rs）
 // 当 thinking 启用时，在系统消息最前面注入标签，确保上游正确识别 thinking 模式
 func generateThinkingPrefix(thinking *types.Thinking) string {
@@ -946,7 +1101,7 @@ func generateThinkingPrefixWithRequest(anthropicReq types.AnthropicRequest) stri
 		return ""
 	}
 	if anthropicReq.Thinking.Type == "enabled" {
-		budgetTokens := anthropicReq.Thinking.NormalizeBudgetTokens()
+		budgetTokens := requestThinkingBudget(anthropicReq)
 		return fmt.Sprintf("<thinking_mode>enabled</thinking_mode><max_thinking_length>%d</max_thinking_length>", budgetTokens)
 	}
 	if anthropicReq.Thinking.Type == "adaptive" {
@@ -977,6 +1132,59 @@ func IsThinkingCompatibleModel(model string) bool {
 		strings.Contains(normalized, "haiku")
 }
 
+// normalizeThinkingBudget 规范化 budget_tokens，并截断到模型家族允许的上限（haiku 低于全局上限）
+func normalizeThinkingBudget(model string, thinking *types.Thinking) int {
+	return min(thinking.NormalizeBudgetTokens(), config.MaxThinkingBudget(model))
+}
+
+// ApplyThinkingModelSuffix 处理模型名的 -thinking 后缀（与 kiro.rs 对齐）：去除后缀并自动开启思考模式
+// 请求已自带 thinking 配置时保留原配置，不再叠加默认配置；返回是否带有该后缀
+func ApplyThinkingModelSuffix(req *types.AnthropicRequest) bool {
+	if !strings.HasSuffix(req.Model, "-thinking") {
+		return false
+	}
+	req.Model = strings.TrimSuffix(req.Model, "-thinking")
+	if req.Thinking != nil {
+		return true
+	}
+
+	budgetTokens := config.DefaultThinkingBudget(req.Model)
+	// 与 kiro.rs 对齐：Opus 4.6 使用 adaptive 模式，其他使用 enabled
+	modelLower := strings.ToLower(req.Model)
+	isOpus46 := strings.Contains(modelLower, "opus") &&
+		(strings.Contains(modelLower, "4-6") || strings.Contains(modelLower, "4.6"))
+	if isOpus46 {
+		req.Thinking = &types.Thinking{
+			Type:         "adaptive",
+			BudgetTokens: budgetTokens,
+		}
+		req.OutputConfig = &types.OutputConfig{
+			Effort: "high",
+		}
+	} else {
+		req.Thinking = &types.Thinking{
+			Type:         "enabled",
+			BudgetTokens: budgetTokens,
+		}
+	}
+	// 确保 max_tokens > budget_tokens（官方 API 要求）
+	if req.MaxTokens <= budgetTokens {
+		req.MaxTokens = budgetTokens + 4096
+	}
+	return true
+}
+
+// requestThinkingBudget 单次上游请求的思考预算
+// interleaved-thinking beta 下 budget_tokens 是整轮对话（跨多次工具调用）的预算，可以不小于 max_tokens：
+// 此时保留客户端的 max_tokens 作为输出上限，单次请求的思考长度截断到 max_tokens 以内（不低于最小预算）
+func requestThinkingBudget(req types.AnthropicRequest) int {
+	budget := normalizeThinkingBudget(req.Model, req.Thinking)
+	if req.InterleavedThinking && req.MaxTokens > 0 && budget >= req.MaxTokens {
+		budget = max(req.MaxTokens-1, config.ThinkingBudgetTokensMin)
+	}
+	return budget
+}
+
 // validateToolChoiceForThinking 验证 thinking 模式下的 tool_choice 兼容性
 // 启用 thinking 时，tool_choice 只能为 auto 或 none
 func validateToolChoiceForThinking(req types.AnthropicRequest) error {
@@ -1112,6 +1320,9 @@ func removeOrphanedToolUses(history []any, orphanedToolUseIDs map[string]struct{
 				} else {
 					v.AssistantResponseMessage.ToolUses = filtered
 				}
+				content, placeholder := normalizeHistoryAssistantContent(v.AssistantResponseMessage.Content, len(filtered) > 0)
+				v.AssistantResponseMessage.Content = content
+				v.Placeholder = v.Placeholder || placeholder
 				history[i] = v
 			}
 		case *types.HistoryAssistantMessage:
@@ -1128,11 +1339,59 @@ func removeOrphanedToolUses(history []any, orphanedToolUseIDs map[string]struct{
 				} else {
 					v.AssistantResponseMessage.ToolUses = filtered
 				}
+				content, placeholder := normalizeHistoryAssistantContent(v.AssistantResponseMessage.Content, len(filtered) > 0)
+				v.AssistantResponseMessage.Content = content
+				v.Placeholder = v.Placeholder || placeholder
 			}
 		}
 	}
 }
 
+// pruneEmptyHistoryPairs 删除 user 与 assistant 都没有实际内容的历史对
+// user 无文本、图片与工具结果，且紧随的 assistant 无工具调用、内容为空或占位内容时整对删除
+func pruneEmptyHistoryPairs(history []any) []any {
+	if len(history) < 2 {
+		return history
+	}
+
+	pruned := make([]any, 0, len(history))
+	removed := 0
+	for i := 0; i < len(history); i++ {
+		if i+1 < len(history) && isEmptyHistoryUser(history[i]) && isEmptyHistoryAssistant(history[i+1]) {
+			removed++
+			i++
+			continue
+		}
+		pruned = append(pruned, history[i])
+	}
+	if removed == 0 {
+		return history
+	}
+
+	logger.Debug("删除了空的历史消息对", logger.Int("removed_pairs", removed))
+	return pruned
+}
+
+// isEmptyHistoryUser 判断历史 user 消息是否没有文本、图片与工具结果
+func isEmptyHistoryUser(msg any) bool {
+	user, ok := msg.(types.HistoryUserMessage)
+	if !ok {
+		return false
+	}
+	return strings.TrimSpace(user.UserInputMessage.Content) == "" &&
+		len(user.UserInputMessage.Images) == 0 &&
+		len(user.UserInputMessage.UserInputMessageContext.ToolResults) == 0
+}
+
+// isEmptyHistoryAssistant 判断历史 assistant 消息是否没有工具调用且内容为空或占位内容
+func isEmptyHistoryAssistant(msg any) bool {
+	assistant, ok := msg.(types.HistoryAssistantMessage)
+	if !ok {
+		return false
+	}
+	return len(assistant.AssistantResponseMessage.ToolUses) == 0 && isBlankHistoryAssistant(assistant)
+}
+
 // ensureHistoryToolsPresent 为历史出现但当前未声明的工具补充占位定义。
 func ensureHistoryToolsPresent(currentTools []types.CodeWhispererTool, history []any) []types.CodeWhispererTool {
 	knownToolNames := make(map[string]struct{}, len(currentTools))
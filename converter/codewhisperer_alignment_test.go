@@ -1,8 +1,15 @@
 package converter
 
 import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/gif"
+	"strings"
 	"testing"
 
+	"kiro2api/config"
 	"kiro2api/types"
 )
 
@@ -139,3 +146,130 @@ func newToolResult(toolUseID string) types.ToolResult {
 		},
 	}
 }
+
+func TestExtractToolResultsFromMessage_ImageContent(t *testing.T) {
+	pngData := base64.StdEncoding.EncodeToString(append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...))
+	content := []any{
+		map[string]any{
+			"type":        "tool_result",
+			"tool_use_id": "tool-1",
+			"content": []any{
+				map[string]any{"type": "text", "text": "screenshot taken"},
+				map[string]any{
+					"type": "image",
+					"source": map[string]any{
+						"type":       "base64",
+						"media_type": "image/png",
+						"data":       pngData,
+					},
+				},
+				map[string]any{
+					"type": "image",
+					"source": map[string]any{
+						"type":       "base64",
+						"media_type": "image/bmp",
+						"data":       pngData,
+					},
+				},
+			},
+		},
+	}
+
+	results := extractToolResultsFromMessage(content)
+	if len(results) != 1 || len(results[0].Content) != 3 {
+		t.Fatalf("unexpected tool results: %+v", results)
+	}
+
+	if results[0].Content[0]["text"] != "screenshot taken" {
+		t.Errorf("text block should be preserved, got %v", results[0].Content[0])
+	}
+
+	image, ok := results[0].Content[1]["image"].(map[string]any)
+	if !ok {
+		t.Fatalf("expected image block, got %v", results[0].Content[1])
+	}
+	if image["format"] != "png" {
+		t.Errorf("expected png format, got %v", image["format"])
+	}
+	if source, _ := image["source"].(map[string]any); source["bytes"] != pngData {
+		t.Errorf("image bytes not preserved: %v", image["source"])
+	}
+
+	if text, _ := results[0].Content[2]["text"].(string); !strings.HasPrefix(text, "[image omitted") {
+		t.Errorf("unsupported image should degrade to placeholder text, got %v", results[0].Content[2])
+	}
+
+	// 消息文本中不应写入base64数据
+	text, _, err := processMessageContent(content)
+	if err != nil {
+		t.Fatalf("processMessageContent failed: %v", err)
+	}
+	if strings.Contains(text, pngData) || !strings.Contains(text, "[image]") {
+		t.Errorf("tool result text should use image placeholder, got %q", text)
+	}
+}
+
+func TestApplySamplingParams(t *testing.T) {
+	temperature := 1.5 // OpenAI 允许到 2，超出 Anthropic 范围
+	topP := 0.8
+	topK := 40
+	cwReq := types.CodeWhispererRequest{}
+
+	applySamplingParams(&cwReq, types.AnthropicRequest{Temperature: &temperature, TopP: &topP, TopK: &topK})
+
+	cfg := cwReq.InferenceConfiguration
+	if cfg == nil {
+		t.Fatal("expected inferenceConfiguration to be set without thinking")
+	}
+	if cfg.Temperature == nil || *cfg.Temperature != 1 {
+		t.Errorf("expected temperature clamped to 1, got %v", cfg.Temperature)
+	}
+	if cfg.TopP == nil || *cfg.TopP != 0.8 {
+		t.Errorf("expected top_p 0.8, got %v", cfg.TopP)
+	}
+	if cfg.TopK == nil || *cfg.TopK != 40 {
+		t.Errorf("expected top_k 40, got %v", cfg.TopK)
+	}
+
+	invalidTopK := 0
+	cwReq = types.CodeWhispererRequest{}
+	applySamplingParams(&cwReq, types.AnthropicRequest{TopK: &invalidTopK})
+	if cwReq.InferenceConfiguration != nil {
+		t.Errorf("invalid top_k should be ignored, got %+v", cwReq.InferenceConfiguration)
+	}
+}
+
+func TestProcessMessageContent_TranscodesUnsupportedImages(t *testing.T) {
+	original := config.ImageSupportedFormats
+	config.ImageSupportedFormats = []string{"jpeg", "png"}
+	t.Cleanup(func() { config.ImageSupportedFormats = original })
+
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.White}), nil); err != nil {
+		t.Fatalf("encode gif: %v", err)
+	}
+	imageBlock := func(mediaType string, data []byte) []any {
+		return []any{map[string]any{
+			"type": "image",
+			"source": map[string]any{
+				"type":       "base64",
+				"media_type": mediaType,
+				"data":       base64.StdEncoding.EncodeToString(data),
+			},
+		}}
+	}
+
+	_, images, err := processMessageContent(imageBlock("image/gif", buf.Bytes()))
+	if err != nil {
+		t.Fatalf("processMessageContent failed: %v", err)
+	}
+	if len(images) != 1 || images[0].Format != "png" {
+		t.Fatalf("gif should be transcoded to png, got %+v", images)
+	}
+
+	// 无法解码的格式返回明确错误，而不是转发给上游
+	_, _, err = processMessageContent(imageBlock("image/heic", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00")))
+	if err == nil || !strings.Contains(err.Error(), "heic") {
+		t.Fatalf("expected error naming heic, got %v", err)
+	}
+}
@@ -113,3 +113,300 @@ func TestBuildCodeWhispererRequest_MergeConsecutiveAssistantMessages(t *testing.
 		t.Fatalf("expected merged assistant message to include tool_use_id toolu_01XYZ")
 	}
 }
+
+func TestBuildCodeWhispererRequest_AssistantPrefill(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	messages := []types.AnthropicRequestMessage{
+		{Role: "user", Content: "List three colors as JSON"},
+		{Role: "assistant", Content: `{"colors": [`},
+	}
+
+	t.Run("转发预填充", func(t *testing.T) {
+		anthropicReq := types.AnthropicRequest{
+			Model:            "claude-sonnet-4-20250514",
+			MaxTokens:        1024,
+			Messages:         messages,
+			AssistantPrefill: `{"colors": [`,
+		}
+		cwReq, err := BuildCodeWhispererRequest(anthropicReq, c)
+		if err != nil {
+			t.Fatalf("BuildCodeWhispererRequest failed: %v", err)
+		}
+
+		current := cwReq.ConversationState.CurrentMessage.UserInputMessage
+		if current.Content != prefillContinuationPrompt {
+			t.Fatalf("current message = %q, want continuation prompt", current.Content)
+		}
+		if current.ModelId == "" {
+			t.Fatal("current message ModelId should be set")
+		}
+		history := cwReq.ConversationState.History
+		if len(history) != 2 {
+			t.Fatalf("expected 2 history messages (user + prefill), got %d", len(history))
+		}
+		am, ok := history[1].(types.HistoryAssistantMessage)
+		if !ok || !strings.Contains(am.AssistantResponseMessage.Content, `{"colors": [`) {
+			t.Fatalf("history should end with the prefill assistant turn, got %#v", history[1])
+		}
+		if len(anthropicReq.Messages) != 2 {
+			t.Fatal("caller's messages must not be modified")
+		}
+	})
+
+	t.Run("未设置时丢弃", func(t *testing.T) {
+		anthropicReq := types.AnthropicRequest{
+			Model:     "claude-sonnet-4-20250514",
+			MaxTokens: 1024,
+			Messages:  messages,
+		}
+		cwReq, err := BuildCodeWhispererRequest(anthropicReq, c)
+		if err != nil {
+			t.Fatalf("BuildCodeWhispererRequest failed: %v", err)
+		}
+		if got := cwReq.ConversationState.CurrentMessage.UserInputMessage.Content; got != "List three colors as JSON" {
+			t.Fatalf("current message = %q, want the last user message", got)
+		}
+	})
+}
+
+func TestAssistantPrefillText(t *testing.T) {
+	tests := []struct {
+		name    string
+		content any
+		want    string
+	}{
+		{"字符串", "Sure, here it is:  \n", "Sure, here it is:"},
+		{"文本块", []any{
+			map[string]any{"type": "text", "text": "Hello"},
+			map[string]any{"type": "text", "text": ", world"},
+		}, "Hello, world"},
+		{"包含工具调用", []any{
+			map[string]any{"type": "text", "text": "Calling"},
+			map[string]any{"type": "tool_use", "id": "toolu_1", "name": "x", "input": map[string]any{}},
+		}, ""},
+		{"仅空白", "   ", ""},
+		{"不支持的类型", 42, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := AssistantPrefillText(tt.content); got != tt.want {
+				t.Fatalf("AssistantPrefillText() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildCodeWhispererRequest_WebSearchMCP(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	newReq := func(webSearchMCP bool) types.AnthropicRequest {
+		return types.AnthropicRequest{
+			Model:     "claude-sonnet-4-20250514",
+			MaxTokens: 1024,
+			Tools: []types.AnthropicTool{
+				{Name: "web_search"},
+				{Name: "get_weather", Description: "Get weather", InputSchema: map[string]any{"type": "object"}},
+			},
+			Messages: []types.AnthropicRequestMessage{
+				{Role: "user", Content: "What's new in Go?"},
+				{Role: "assistant", Content: []any{
+					map[string]any{"type": "tool_use", "id": "tooluse_1", "name": "web_search", "input": map[string]any{"query": "go release"}},
+				}},
+				{Role: "user", Content: []any{
+					map[string]any{"type": "tool_result", "tool_use_id": "tooluse_1", "content": "Go 1.25 released"},
+				}},
+			},
+			WebSearchMCP: webSearchMCP,
+		}
+	}
+	toolNames := func(cwReq types.CodeWhispererRequest) []string {
+		var names []string
+		for _, tool := range cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools {
+			names = append(names, tool.ToolSpecification.Name)
+		}
+		return names
+	}
+	historyToolUses := func(cwReq types.CodeWhispererRequest) int {
+		count := 0
+		for _, msg := range cwReq.ConversationState.History {
+			if am, ok := msg.(types.HistoryAssistantMessage); ok {
+				count += len(am.AssistantResponseMessage.ToolUses)
+			}
+		}
+		return count
+	}
+
+	t.Run("启用时作为普通工具发送", func(t *testing.T) {
+		cwReq, err := BuildCodeWhispererRequest(newReq(true), c)
+		if err != nil {
+			t.Fatalf("BuildCodeWhispererRequest failed: %v", err)
+		}
+		if got := strings.Join(toolNames(cwReq), ","); got != "web_search,get_weather" {
+			t.Fatalf("tools = %q, want web_search,get_weather", got)
+		}
+		schema := cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools[0].ToolSpecification.InputSchema.Json
+		props, _ := schema["properties"].(map[string]any)
+		if _, ok := props["query"]; !ok {
+			t.Fatalf("web_search schema should declare query, got %#v", schema)
+		}
+		if got := historyToolUses(cwReq); got != 1 {
+			t.Fatalf("history tool uses = %d, want 1", got)
+		}
+	})
+
+	t.Run("未启用时过滤", func(t *testing.T) {
+		cwReq, err := BuildCodeWhispererRequest(newReq(false), c)
+		if err != nil {
+			t.Fatalf("BuildCodeWhispererRequest failed: %v", err)
+		}
+		if got := strings.Join(toolNames(cwReq), ","); got != "get_weather" {
+			t.Fatalf("tools = %q, want get_weather", got)
+		}
+		if got := historyToolUses(cwReq); got != 0 {
+			t.Fatalf("history tool uses = %d, want 0", got)
+		}
+	})
+}
+
+func TestBuildCodeWhispererRequest_MultipleSystemBlocks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	anthropicReq := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 4096,
+		System: []types.AnthropicSystemMessage{
+			{Type: "text", Text: "You are a helpful assistant.\n"},
+			{Type: "text", Text: "  "},
+			{Type: "text", Text: "Always answer in French.", CacheControl: map[string]any{"type": "ephemeral"}},
+		},
+		Messages: []types.AnthropicRequestMessage{{Role: "user", Content: "Hello"}},
+		Thinking: &types.Thinking{Type: "enabled", BudgetTokens: 2048},
+	}
+	cwReq, err := BuildCodeWhispererRequest(anthropicReq, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest failed: %v", err)
+	}
+
+	history := cwReq.ConversationState.History
+	if len(history) != 2 {
+		t.Fatalf("expected system user/assistant pair, got %d history messages", len(history))
+	}
+	systemMsg, ok := history[0].(types.HistoryUserMessage)
+	if !ok {
+		t.Fatalf("history[0] = %T, want HistoryUserMessage", history[0])
+	}
+	want := "<thinking_mode>enabled</thinking_mode><max_thinking_length>2048</max_thinking_length>\n" +
+		"You are a helpful assistant." + systemBlockDelimiter + "Always answer in French."
+	if got := systemMsg.UserInputMessage.Content; got != want {
+		t.Fatalf("system content = %q, want %q", got, want)
+	}
+}
+
+func TestBuildSystemContent_SingleBlockUnchanged(t *testing.T) {
+	got := buildSystemContent([]types.AnthropicSystemMessage{{Type: "text", Text: "line 1\nline 2\n"}})
+	if got != "line 1\nline 2" {
+		t.Fatalf("buildSystemContent = %q", got)
+	}
+	if got := buildSystemContent(nil); got != "" {
+		t.Fatalf("buildSystemContent(nil) = %q, want empty", got)
+	}
+}
+
+func TestBuildCodeWhispererRequest_EmptyAssistantHistory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	anthropicReq := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 1024,
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "first question"},
+			{Role: "assistant", Content: []any{map[string]any{"type": "text", "text": ""}}},
+			{Role: "user", Content: ""},
+			{Role: "assistant", Content: ""},
+			{Role: "user", Content: "second question"},
+			{Role: "assistant", Content: []any{
+				map[string]any{"type": "tool_use", "id": "toolu_01ABC", "name": "read_file", "input": map[string]any{}},
+			}},
+			{Role: "user", Content: []any{
+				map[string]any{"type": "tool_result", "tool_use_id": "toolu_01ABC", "content": "ok"},
+			}},
+		},
+	}
+
+	cwReq, err := BuildCodeWhispererRequest(anthropicReq, c)
+	if err != nil {
+		t.Fatalf("BuildCodeWhispererRequest failed: %v", err)
+	}
+
+	// 中间的空 user/空 assistant 对被删除，只保留两对有效历史
+	history := cwReq.ConversationState.History
+	if len(history) != 4 {
+		t.Fatalf("expected 4 history messages after pruning the empty pair, got %d", len(history))
+	}
+
+	emptyTurn, ok := history[1].(types.HistoryAssistantMessage)
+	if !ok {
+		t.Fatalf("expected history[1] to be an assistant message, got %T", history[1])
+	}
+	if got := emptyTurn.AssistantResponseMessage.Content; got != emptyAssistantHistoryPlaceholder {
+		t.Errorf("expected empty assistant turn to use placeholder %q, got %q", emptyAssistantHistoryPlaceholder, got)
+	}
+
+	toolTurn, ok := history[3].(types.HistoryAssistantMessage)
+	if !ok {
+		t.Fatalf("expected history[3] to be an assistant message, got %T", history[3])
+	}
+	if got := toolTurn.AssistantResponseMessage.Content; got != historyToolUsePlaceholder {
+		t.Errorf("expected tool_use-only assistant turn to use %q, got %q", historyToolUsePlaceholder, got)
+	}
+	if len(toolTurn.AssistantResponseMessage.ToolUses) != 1 {
+		t.Errorf("expected tool_use to be kept, got %d", len(toolTurn.AssistantResponseMessage.ToolUses))
+	}
+}
+
+func TestMergeAssistantMessagesToHistory_SkipsEmptyTurns(t *testing.T) {
+	merged := mergeAssistantMessagesToHistory([]*types.AnthropicRequestMessage{
+		{Role: "assistant", Content: ""},
+		{Role: "assistant", Content: "Hello"},
+	}, false)
+	if got := merged.AssistantResponseMessage.Content; got != "Hello" {
+		t.Errorf("expected empty turn to be skipped when merging, got %q", got)
+	}
+
+	merged = mergeAssistantMessagesToHistory([]*types.AnthropicRequestMessage{
+		{Role: "assistant", Content: " "},
+		{Role: "assistant", Content: "answer for user question"},
+	}, false)
+	if got := merged.AssistantResponseMessage.Content; got != emptyAssistantHistoryPlaceholder {
+		t.Errorf("expected placeholder for fully empty merged turn, got %q", got)
+	}
+}
+
+func TestMergeTwoHistoryAssistantMessages_KeepsRealOKReply(t *testing.T) {
+	real := convertAssistantMessageToHistory(&types.AnthropicRequestMessage{Role: "assistant", Content: "OK"}, false)
+	if real.Placeholder {
+		t.Fatal("client reply \"OK\" must not be marked as placeholder")
+	}
+	placeholder := convertAssistantMessageToHistory(&types.AnthropicRequestMessage{Role: "assistant", Content: ""}, false)
+	if !placeholder.Placeholder {
+		t.Fatal("expected empty assistant turn to be marked as placeholder")
+	}
+
+	merged := mergeTwoHistoryAssistantMessages(placeholder, real)
+	if got := merged.AssistantResponseMessage.Content; got != "OK" || merged.Placeholder {
+		t.Errorf("expected real \"OK\" reply to be kept, got %q (placeholder=%v)", got, merged.Placeholder)
+	}
+	if isEmptyHistoryAssistant(real) {
+		t.Error("real \"OK\" reply must not be pruned as an empty turn")
+	}
+}
@@ -1,9 +1,12 @@
 package converter
 
 import (
+	"encoding/base64"
 	"fmt"
+	"slices"
 	"strings"
 
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/types"
 	"kiro2api/utils"
@@ -11,7 +14,7 @@ import (
 
 // 消息内容处理器
 
-// processMessageContent 处理消息内容，提取文本和图片
+// processMessageContent 处理消息内容，提取文本和图片（document 块提取文本后内联）
 func processMessageContent(content any) (string, []types.CodeWhispererImage, error) {
 	var textParts []string
 	var images []types.CodeWhispererImage
@@ -39,19 +42,20 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 						logger.Warn("文本块的Text字段为nil")
 					}
 				case "image":
-					// ... 图片处理保持不变
 					if contentBlock.Source != nil {
-						// 验证图片内容
-						if err := utils.ValidateImageContent(contentBlock.Source); err != nil {
+						// 验证图片内容并转换为 CodeWhisperer 格式（上游不支持的格式先转码）
+						cwImage, err := toCodeWhispererImage(contentBlock.Source)
+						if err != nil {
 							return "", nil, fmt.Errorf("图片验证失败: %v", err)
 						}
-
-						// 转换为 CodeWhisperer 格式
-						cwImage := utils.CreateCodeWhispererImage(contentBlock.Source)
-						if cwImage != nil {
-							images = append(images, *cwImage)
-						}
+						images = append(images, *cwImage)
 					}
+				case "document":
+					text, err := documentText(contentBlock.Source, contentBlock.Title)
+					if err != nil {
+						return "", nil, fmt.Errorf("文档处理失败: %v", err)
+					}
+					textParts = append(textParts, text)
 				case "tool_result":
 					// 处理工具结果，支持复杂的内容结构
 					if contentBlock.Content != nil {
@@ -86,14 +90,18 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 				}
 			case "image":
 				if contentBlock.Source != nil {
-					if err := utils.ValidateImageContent(contentBlock.Source); err != nil {
+					cwImage, err := toCodeWhispererImage(contentBlock.Source)
+					if err != nil {
 						return "", nil, fmt.Errorf("图片验证失败: %v", err)
 					}
-					cwImage := utils.CreateCodeWhispererImage(contentBlock.Source)
-					if cwImage != nil {
-						images = append(images, *cwImage)
-					}
+					images = append(images, *cwImage)
 				}
+			case "document":
+				text, err := documentText(contentBlock.Source, contentBlock.Title)
+				if err != nil {
+					return "", nil, fmt.Errorf("文档处理失败: %v", err)
+				}
+				textParts = append(textParts, text)
 			case "tool_result":
 				if contentBlock.Content != nil {
 					parsedContent := utils.ParseToolResultContent(contentBlock.Content)
@@ -117,17 +125,19 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 				}
 			case "image":
 				if block.Source != nil {
-					// 验证图片内容
-					if err := utils.ValidateImageContent(block.Source); err != nil {
+					// 验证图片内容并转换为 CodeWhisperer 格式（上游不支持的格式先转码）
+					cwImage, err := toCodeWhispererImage(block.Source)
+					if err != nil {
 						return "", nil, fmt.Errorf("图片验证失败: %v", err)
 					}
-
-					// 转换为 CodeWhisperer 格式
-					cwImage := utils.CreateCodeWhispererImage(block.Source)
-					if cwImage != nil {
-						images = append(images, *cwImage)
-					}
+					images = append(images, *cwImage)
 				}
+			case "document":
+				text, err := documentText(block.Source, block.Title)
+				if err != nil {
+					return "", nil, fmt.Errorf("文档处理失败: %v", err)
+				}
+				textParts = append(textParts, text)
 			case "tool_result":
 				// 处理工具结果，支持复杂的内容结构
 				if block.Content != nil {
@@ -159,6 +169,77 @@ func processMessageContent(content any) (string, []types.CodeWhispererImage, err
 	return result, images, nil
 }
 
+// toCodeWhispererImage 校验图片并转换为 CodeWhisperer 格式
+// IMAGE_SUPPORTED_FORMATS 之外的格式先转码为 PNG/JPEG，无法转码时返回带格式名的错误
+func toCodeWhispererImage(source *types.ImageSource) (*types.CodeWhispererImage, error) {
+	if err := utils.ValidateImageContent(source); err != nil {
+		return nil, err
+	}
+	cwImage := utils.CreateCodeWhispererImage(source)
+	if cwImage == nil {
+		return nil, fmt.Errorf("不支持的图片格式: %s", source.MediaType)
+	}
+	if slices.Contains(config.ImageSupportedFormats, cwImage.Format) {
+		return cwImage, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(cwImage.Source.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 base64 编码: %v", err)
+	}
+	transcoded, format, err := utils.TranscodeImage(data, cwImage.Format, config.ImageSupportedFormats)
+	if err != nil {
+		logger.Warn("图片转码失败", logger.String("media_type", source.MediaType), logger.Err(err))
+		return nil, err
+	}
+
+	logger.Info("图片已转码",
+		logger.String("original_format", cwImage.Format),
+		logger.String("format", format),
+		logger.Int("original_bytes", len(data)),
+		logger.Int("bytes", len(transcoded)))
+	cwImage.Format = format
+	cwImage.Source.Bytes = base64.StdEncoding.EncodeToString(transcoded)
+	return cwImage, nil
+}
+
+// downscaleImages 对超过 IMAGE_MAX_BYTES / IMAGE_MAX_DIMENSION 的图片缩放并重新编码
+// 处理失败的图片保持原样，由上游决定是否拒绝
+func downscaleImages(images []types.CodeWhispererImage) []types.CodeWhispererImage {
+	if config.ImageMaxBytes <= 0 && config.ImageMaxDimension <= 0 {
+		return images
+	}
+
+	for i := range images {
+		img := &images[i]
+		data, err := base64.StdEncoding.DecodeString(img.Source.Bytes)
+		if err != nil {
+			continue
+		}
+
+		resized, format, changed, err := utils.DownscaleImage(data, img.Format, config.ImageMaxBytes, config.ImageMaxDimension)
+		if err != nil {
+			logger.Warn("图片压缩失败，保持原图",
+				logger.String("format", img.Format),
+				logger.Int("original_bytes", len(data)),
+				logger.Err(err))
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		logger.Info("图片已压缩",
+			logger.String("original_format", img.Format),
+			logger.String("format", format),
+			logger.Int("original_bytes", len(data)),
+			logger.Int("bytes", len(resized)))
+		img.Format = format
+		img.Source.Bytes = base64.StdEncoding.EncodeToString(resized)
+	}
+	return images
+}
+
 // parseContentBlock 解析内容块
 func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 	var contentBlock types.ContentBlock
@@ -186,19 +267,15 @@ func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 
 	case "image":
 		if source, ok := block["source"].(map[string]any); ok {
-			imageSource := &types.ImageSource{}
-
-			if sourceType, ok := source["type"].(string); ok {
-				imageSource.Type = sourceType
-			}
-			if mediaType, ok := source["media_type"].(string); ok {
-				imageSource.MediaType = mediaType
-			}
-			if data, ok := source["data"].(string); ok {
-				imageSource.Data = data
-			}
+			contentBlock.Source = parseBlockSource(source)
+		}
 
-			contentBlock.Source = imageSource
+	case "document":
+		if source, ok := block["source"].(map[string]any); ok {
+			contentBlock.Source = parseBlockSource(source)
+		}
+		if title, ok := block["title"].(string); ok {
+			contentBlock.Title = &title
 		}
 
 	case "image_url":
@@ -238,3 +315,19 @@ func parseContentBlock(block map[string]any) (types.ContentBlock, error) {
 
 	return contentBlock, nil
 }
+
+// parseBlockSource 解析图片/文档块的 source 字段
+func parseBlockSource(source map[string]any) *types.ImageSource {
+	blockSource := &types.ImageSource{}
+
+	if sourceType, ok := source["type"].(string); ok {
+		blockSource.Type = sourceType
+	}
+	if mediaType, ok := source["media_type"].(string); ok {
+		blockSource.MediaType = mediaType
+	}
+	if data, ok := source["data"].(string); ok {
+		blockSource.Data = data
+	}
+	return blockSource
+}
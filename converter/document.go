@@ -0,0 +1,132 @@
+package converter
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// 文档附件处理
+// CodeWhisperer 不支持文档附件：document 块在代理侧提取文本，以 <document> 标记内联到消息文本中
+
+// InlineDocuments 将消息中的 document 块替换为提取出的文本块
+// 文档过大、格式不支持或无法提取文本时返回错误（应作为 400 返回给客户端）
+func InlineDocuments(messages []types.AnthropicRequestMessage) ([]types.AnthropicRequestMessage, error) {
+	var result []types.AnthropicRequestMessage
+	for i, msg := range messages {
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+
+		var inlined []any
+		for j, item := range blocks {
+			block, ok := item.(map[string]any)
+			if !ok || block["type"] != "document" {
+				continue
+			}
+			contentBlock, err := parseContentBlock(block)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d].content[%d]: %v", i, j, err)
+			}
+			text, err := documentText(contentBlock.Source, contentBlock.Title)
+			if err != nil {
+				return nil, fmt.Errorf("messages[%d].content[%d]: %v", i, j, err)
+			}
+			if inlined == nil {
+				inlined = append([]any(nil), blocks...)
+			}
+			inlined[j] = map[string]any{"type": "text", "text": text}
+		}
+		if inlined == nil {
+			continue
+		}
+
+		// 仅在存在文档时复制消息列表，避免修改调用方的数据
+		if result == nil {
+			result = append([]types.AnthropicRequestMessage(nil), messages...)
+		}
+		result[i].Content = inlined
+	}
+	if result == nil {
+		return messages, nil
+	}
+	return result, nil
+}
+
+// documentText 提取文档文本并加上 <document> 标记
+func documentText(source *types.ImageSource, title *string) (string, error) {
+	if source == nil {
+		return "", fmt.Errorf("document 块缺少 source")
+	}
+
+	var text string
+	switch source.Type {
+	case "text":
+		if err := checkDocumentSize(len(source.Data)); err != nil {
+			return "", err
+		}
+		text = source.Data
+
+	case "base64":
+		// 解码前按编码长度估算，避免为超大文档分配内存
+		if err := checkDocumentSize(base64.StdEncoding.DecodedLen(len(source.Data))); err != nil {
+			return "", err
+		}
+		data, err := base64.StdEncoding.DecodeString(source.Data)
+		if err != nil {
+			return "", fmt.Errorf("无效的 base64 编码: %v", err)
+		}
+		switch {
+		case source.MediaType == "application/pdf":
+			text, err = utils.ExtractPDFText(data)
+			if err != nil {
+				return "", err
+			}
+		case strings.HasPrefix(source.MediaType, "text/"):
+			if !utf8.Valid(data) {
+				return "", fmt.Errorf("文本文档不是有效的 UTF-8 编码")
+			}
+			text = string(data)
+		default:
+			return "", fmt.Errorf("不支持的文档格式: %s", source.MediaType)
+		}
+
+	default:
+		return "", fmt.Errorf("不支持的文档来源类型: %s（支持 base64、text）", source.Type)
+	}
+
+	text = strings.TrimSpace(text)
+	if chars := utf8.RuneCountInString(text); config.DocumentMaxTextChars > 0 && chars > config.DocumentMaxTextChars {
+		return "", fmt.Errorf("文档文本过长: %d 字符，最大支持 %d 字符（DOCUMENT_MAX_TEXT_CHARS）", chars, config.DocumentMaxTextChars)
+	}
+
+	mediaType := source.MediaType
+	if mediaType == "" {
+		mediaType = "text/plain"
+	}
+	attrs := fmt.Sprintf(" media_type=%q", mediaType)
+	if title != nil && *title != "" {
+		attrs = fmt.Sprintf(" title=%q", *title) + attrs
+	}
+
+	logger.Debug("文档已转换为文本",
+		logger.String("media_type", mediaType),
+		logger.Int("text_chars", utf8.RuneCountInString(text)))
+
+	return fmt.Sprintf("<document%s>\n%s\n</document>\n\n", attrs, text), nil
+}
+
+// checkDocumentSize 检查文档解码后的大小
+func checkDocumentSize(size int) error {
+	if config.DocumentMaxBytes > 0 && size > config.DocumentMaxBytes {
+		return fmt.Errorf("文档过大: %d 字节，最大支持 %d 字节（DOCUMENT_MAX_BYTES）", size, config.DocumentMaxBytes)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package converter
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+func TestInlineDocuments_ReplacesDocumentBlocks(t *testing.T) {
+	pdf := "%PDF-1.4\n1 0 obj\n<< /Length 30 >>\nstream\nBT (Quarterly report) Tj ET\nendstream\nendobj\n"
+	messages := []types.AnthropicRequestMessage{
+		{Role: "user", Content: "plain text"},
+		{Role: "user", Content: []any{
+			map[string]any{
+				"type":   "document",
+				"title":  "report.pdf",
+				"source": map[string]any{"type": "base64", "media_type": "application/pdf", "data": base64.StdEncoding.EncodeToString([]byte(pdf))},
+			},
+			map[string]any{
+				"type":   "document",
+				"source": map[string]any{"type": "text", "media_type": "text/plain", "data": "notes"},
+			},
+			map[string]any{"type": "text", "text": "Summarize these."},
+		}},
+	}
+
+	inlined, err := InlineDocuments(messages)
+	if err != nil {
+		t.Fatalf("InlineDocuments: %v", err)
+	}
+
+	// 原消息不应被修改
+	if orig := messages[1].Content.([]any)[0].(map[string]any); orig["type"] != "document" {
+		t.Fatalf("original message mutated: %v", orig)
+	}
+
+	text, images, err := processMessageContent(inlined[1].Content)
+	if err != nil {
+		t.Fatalf("processMessageContent: %v", err)
+	}
+	if len(images) != 0 {
+		t.Fatalf("images = %d, want 0", len(images))
+	}
+	want := "<document title=\"report.pdf\" media_type=\"application/pdf\">\nQuarterly report\n</document>\n\n" +
+		"<document media_type=\"text/plain\">\nnotes\n</document>\n\n" +
+		"Summarize these."
+	if text != want {
+		t.Fatalf("text = %q, want %q", text, want)
+	}
+}
+
+func TestProcessMessageContent_DocumentBlock(t *testing.T) {
+	content := []any{
+		map[string]any{
+			"type":   "document",
+			"source": map[string]any{"type": "base64", "media_type": "text/plain", "data": base64.StdEncoding.EncodeToString([]byte("hello"))},
+		},
+	}
+	text, _, err := processMessageContent(content)
+	if err != nil {
+		t.Fatalf("processMessageContent: %v", err)
+	}
+	if !strings.Contains(text, "<document media_type=\"text/plain\">\nhello\n</document>") {
+		t.Fatalf("text = %q", text)
+	}
+}
+
+func TestInlineDocuments_SizeLimits(t *testing.T) {
+	origBytes, origChars := config.DocumentMaxBytes, config.DocumentMaxTextChars
+	defer func() { config.DocumentMaxBytes, config.DocumentMaxTextChars = origBytes, origChars }()
+
+	document := func(data string) []types.AnthropicRequestMessage {
+		return []types.AnthropicRequestMessage{{Role: "user", Content: []any{
+			map[string]any{"type": "document", "source": map[string]any{"type": "text", "media_type": "text/plain", "data": data}},
+		}}}
+	}
+
+	config.DocumentMaxBytes, config.DocumentMaxTextChars = 10, 0
+	if _, err := InlineDocuments(document(strings.Repeat("a", 11))); err == nil || !strings.Contains(err.Error(), "DOCUMENT_MAX_BYTES") {
+		t.Fatalf("err = %v, want DOCUMENT_MAX_BYTES error", err)
+	}
+
+	config.DocumentMaxBytes, config.DocumentMaxTextChars = 0, 5
+	if _, err := InlineDocuments(document("文档内容过长")); err == nil || !strings.Contains(err.Error(), "DOCUMENT_MAX_TEXT_CHARS") {
+		t.Fatalf("err = %v, want DOCUMENT_MAX_TEXT_CHARS error", err)
+	}
+
+	config.DocumentMaxBytes, config.DocumentMaxTextChars = 0, 0
+	_, err := InlineDocuments([]types.AnthropicRequestMessage{{Role: "user", Content: []any{
+		map[string]any{"type": "document", "source": map[string]any{"type": "url", "url": "https://example.com/a.pdf"}},
+	}}})
+	if err == nil || !strings.Contains(err.Error(), "messages[0].content[0]") {
+		t.Fatalf("err = %v, want unsupported source error", err)
+	}
+}
@@ -0,0 +1,332 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// Gemini格式转换器
+
+// ConvertGeminiToAnthropic 将Gemini generateContent请求转换为Anthropic请求
+// model 来自URL路径（models/{model}:generateContent），gemini-* 通过 config.ResolveModelID 映射到Claude模型
+func ConvertGeminiToAnthropic(geminiReq types.GeminiRequest, model string, stream bool) types.AnthropicRequest {
+	if resolvedModel, _, ok := config.ResolveModelID(model); ok {
+		model = resolvedModel
+	}
+
+	anthropicReq := types.AnthropicRequest{
+		Model:     model,
+		MaxTokens: 16384,
+		Messages:  convertGeminiContents(geminiReq.Contents),
+		Stream:    stream,
+	}
+
+	if geminiReq.SystemInstruction != nil {
+		for _, part := range geminiReq.SystemInstruction.Parts {
+			if part.Text != "" {
+				anthropicReq.System = append(anthropicReq.System, types.AnthropicSystemMessage{
+					Type: "text",
+					Text: part.Text,
+				})
+			}
+		}
+	}
+
+	if gc := geminiReq.GenerationConfig; gc != nil {
+		if gc.MaxOutputTokens != nil && *gc.MaxOutputTokens > 0 {
+			anthropicReq.MaxTokens = *gc.MaxOutputTokens
+		}
+		anthropicReq.Temperature = gc.Temperature
+		anthropicReq.TopP = gc.TopP
+		anthropicReq.TopK = gc.TopK
+		anthropicReq.StopSequences = gc.StopSequences
+		if tc := gc.ThinkingConfig; tc != nil && tc.ThinkingBudget != nil && *tc.ThinkingBudget > 0 {
+			anthropicReq.Thinking = &types.Thinking{
+				Type:         "enabled",
+				BudgetTokens: *tc.ThinkingBudget,
+			}
+			// 确保 max_tokens > budget_tokens（官方 API 要求）
+			if anthropicReq.MaxTokens <= *tc.ThinkingBudget {
+				anthropicReq.MaxTokens = *tc.ThinkingBudget + 4096
+			}
+		}
+	}
+
+	mode := ""
+	var allowed []string
+	if geminiReq.ToolConfig != nil && geminiReq.ToolConfig.FunctionCallingConfig != nil {
+		mode = strings.ToUpper(geminiReq.ToolConfig.FunctionCallingConfig.Mode)
+		allowed = geminiReq.ToolConfig.FunctionCallingConfig.AllowedFunctionNames
+	}
+	// NONE：不向上游声明工具，模型只能输出文本
+	if mode != "NONE" {
+		anthropicReq.Tools = convertGeminiTools(geminiReq.Tools)
+	}
+	if len(anthropicReq.Tools) > 0 {
+		switch mode {
+		case "ANY":
+			if len(allowed) == 1 {
+				anthropicReq.ToolChoice = &types.ToolChoice{Type: "tool", Name: allowed[0]}
+			} else {
+				anthropicReq.ToolChoice = &types.ToolChoice{Type: "any"}
+			}
+		case "AUTO":
+			anthropicReq.ToolChoice = &types.ToolChoice{Type: "auto"}
+		}
+	}
+
+	return anthropicReq
+}
+
+// convertGeminiContents 转换对话内容
+// Gemini 的 functionCall 通常不带 id：为其生成 tool_use_id，并按函数名顺序与后续的 functionResponse 配对
+func convertGeminiContents(contents []types.GeminiContent) []types.AnthropicRequestMessage {
+	var messages []types.AnthropicRequestMessage
+	pendingIDs := make(map[string][]string) // 函数名 -> 尚未收到结果的 tool_use_id
+	callCount := 0
+
+	for _, content := range contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+
+		var blocks []any
+		for _, part := range content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				id := part.FunctionCall.ID
+				if id == "" {
+					callCount++
+					id = fmt.Sprintf("toolu_gemini_%d", callCount)
+				}
+				pendingIDs[part.FunctionCall.Name] = append(pendingIDs[part.FunctionCall.Name], id)
+				input := part.FunctionCall.Args
+				if input == nil {
+					input = map[string]any{}
+				}
+				blocks = append(blocks, map[string]any{
+					"type":  "tool_use",
+					"id":    id,
+					"name":  part.FunctionCall.Name,
+					"input": input,
+				})
+
+			case part.FunctionResponse != nil:
+				name := part.FunctionResponse.Name
+				id := part.FunctionResponse.ID
+				if queue := pendingIDs[name]; id == "" && len(queue) > 0 {
+					id = queue[0]
+				}
+				if id == "" {
+					logger.Warn("跳过孤立的 functionResponse：找不到对应的 functionCall",
+						logger.String("name", name))
+					continue
+				}
+				pendingIDs[name] = removeID(pendingIDs[name], id)
+
+				result, _ := utils.SafeMarshal(part.FunctionResponse.Response)
+				blocks = append(blocks, map[string]any{
+					"type":        "tool_result",
+					"tool_use_id": id,
+					"content":     string(result),
+				})
+
+			case part.InlineData != nil:
+				blocks = append(blocks, map[string]any{
+					"type": "image",
+					"source": map[string]any{
+						"type":       "base64",
+						"media_type": part.InlineData.MimeType,
+						"data":       part.InlineData.Data,
+					},
+				})
+
+			case part.Text != "" && !part.Thought:
+				blocks = append(blocks, map[string]any{
+					"type": "text",
+					"text": part.Text,
+				})
+			}
+		}
+
+		if len(blocks) == 0 {
+			continue
+		}
+		// 与OpenAI转换一致：仅有 tool_use 块的 assistant 消息补一个空格文本块占位
+		if role == "assistant" {
+			if first, ok := blocks[0].(map[string]any); ok && first["type"] == "tool_use" {
+				blocks = append([]any{map[string]any{"type": "text", "text": " "}}, blocks...)
+			}
+		}
+		messages = append(messages, types.AnthropicRequestMessage{
+			Role:    role,
+			Content: blocks,
+		})
+	}
+
+	return messages
+}
+
+// removeID 从待配对队列中移除指定 id
+func removeID(queue []string, id string) []string {
+	for i, v := range queue {
+		if v == id {
+			return append(queue[:i], queue[i+1:]...)
+		}
+	}
+	return queue
+}
+
+// convertGeminiTools 将 functionDeclarations 转换为 Anthropic 工具定义
+func convertGeminiTools(tools []types.GeminiTool) []types.AnthropicTool {
+	var anthropicTools []types.AnthropicTool
+	for _, tool := range tools {
+		for _, decl := range tool.FunctionDeclarations {
+			if decl.Name == "" {
+				continue
+			}
+			schema := decl.ParametersJSONSchema
+			if schema == nil {
+				schema = normalizeGeminiSchema(decl.Parameters)
+			}
+			if schema == nil {
+				schema = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			anthropicTools = append(anthropicTools, types.AnthropicTool{
+				Name:        decl.Name,
+				Description: decl.Description,
+				InputSchema: schema,
+			})
+		}
+	}
+	return anthropicTools
+}
+
+// normalizeGeminiSchema 将 OpenAPI 风格的 schema（type 为 OBJECT/STRING 等大写枚举）转换为 JSON Schema
+func normalizeGeminiSchema(schema map[string]any) map[string]any {
+	if schema == nil {
+		return nil
+	}
+	result := make(map[string]any, len(schema))
+	for key, value := range schema {
+		switch v := value.(type) {
+		case string:
+			if key == "type" {
+				v = strings.ToLower(v)
+			}
+			result[key] = v
+		case map[string]any:
+			if key == "properties" {
+				props := make(map[string]any, len(v))
+				for name, prop := range v {
+					if propMap, ok := prop.(map[string]any); ok {
+						props[name] = normalizeGeminiSchema(propMap)
+					} else {
+						props[name] = prop
+					}
+				}
+				result[key] = props
+			} else {
+				result[key] = normalizeGeminiSchema(v)
+			}
+		default:
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// ConvertAnthropicToGemini 将Anthropic响应转换为Gemini响应
+func ConvertAnthropicToGemini(anthropicResp map[string]any, model string) types.GeminiResponse {
+	var blocks []map[string]any
+	switch content := anthropicResp["content"].(type) {
+	case []map[string]any:
+		blocks = content
+	case []any:
+		for _, block := range content {
+			if blockMap, ok := block.(map[string]any); ok {
+				blocks = append(blocks, blockMap)
+			}
+		}
+	}
+
+	var parts []types.GeminiPart
+	for _, block := range blocks {
+		switch block["type"] {
+		case "text":
+			if text, _ := block["text"].(string); text != "" {
+				parts = append(parts, types.GeminiPart{Text: text})
+			}
+		case "thinking":
+			if text, _ := block["thinking"].(string); text != "" {
+				parts = append(parts, types.GeminiPart{Text: text, Thought: true})
+			}
+		case "tool_use":
+			name, _ := block["name"].(string)
+			id, _ := block["id"].(string)
+			args, _ := block["input"].(map[string]any)
+			if args == nil {
+				args = map[string]any{}
+			}
+			parts = append(parts, types.GeminiPart{
+				FunctionCall: &types.GeminiFunctionCall{ID: id, Name: name, Args: args},
+			})
+		}
+	}
+	if parts == nil {
+		parts = []types.GeminiPart{}
+	}
+
+	stopReason, _ := anthropicResp["stop_reason"].(string)
+	resp := types.GeminiResponse{
+		Candidates: []types.GeminiCandidate{
+			{
+				Content:      types.GeminiContent{Role: "model", Parts: parts},
+				FinishReason: GeminiFinishReason(stopReason),
+			},
+		},
+		ModelVersion: model,
+	}
+
+	if usage, ok := anthropicResp["usage"].(map[string]any); ok {
+		inputTokens := toInt(usage["input_tokens"])
+		outputTokens := toInt(usage["output_tokens"])
+		resp.UsageMetadata = &types.GeminiUsageMetadata{
+			PromptTokenCount:     inputTokens,
+			CandidatesTokenCount: outputTokens,
+			TotalTokenCount:      inputTokens + outputTokens,
+		}
+	}
+
+	return resp
+}
+
+// GeminiFinishReason 将Anthropic的stop_reason映射为Gemini的finishReason
+func GeminiFinishReason(stopReason string) string {
+	switch stopReason {
+	case "max_tokens":
+		return "MAX_TOKENS"
+	case "refusal":
+		return "SAFETY"
+	}
+	return "STOP"
+}
+
+// toInt 将JSON数值转换为int
+func toInt(v any) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
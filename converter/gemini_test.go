@@ -0,0 +1,116 @@
+package converter
+
+import (
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertGeminiToAnthropic_ContentsAndTools(t *testing.T) {
+	maxTokens := 2048
+	req := types.GeminiRequest{
+		SystemInstruction: &types.GeminiContent{Parts: []types.GeminiPart{{Text: "be brief"}}},
+		Contents: []types.GeminiContent{
+			{Role: "user", Parts: []types.GeminiPart{
+				{Text: "weather?"},
+				{InlineData: &types.GeminiInlineData{MimeType: "image/png", Data: "aGk="}},
+			}},
+			{Role: "model", Parts: []types.GeminiPart{
+				{FunctionCall: &types.GeminiFunctionCall{Name: "get_weather", Args: map[string]any{"city": "Paris"}}},
+			}},
+			{Role: "user", Parts: []types.GeminiPart{
+				{FunctionResponse: &types.GeminiFunctionResponse{Name: "get_weather", Response: map[string]any{"temp": 20}}},
+			}},
+		},
+		Tools: []types.GeminiTool{{FunctionDeclarations: []types.GeminiFunctionDeclaration{{
+			Name:        "get_weather",
+			Description: "Get weather",
+			Parameters: map[string]any{
+				"type": "OBJECT",
+				"properties": map[string]any{
+					"city": map[string]any{"type": "STRING"},
+				},
+				"required": []any{"city"},
+			},
+		}}}},
+		ToolConfig: &types.GeminiToolConfig{FunctionCallingConfig: &types.GeminiFunctionCallingConfig{
+			Mode:                 "ANY",
+			AllowedFunctionNames: []string{"get_weather"},
+		}},
+		GenerationConfig: &types.GeminiGenerationConfig{MaxOutputTokens: &maxTokens},
+	}
+
+	anthropicReq := ConvertGeminiToAnthropic(req, "claude-sonnet-4-5", true)
+
+	assert.Equal(t, config.CanonicalModelSonnet45, anthropicReq.Model)
+	assert.True(t, anthropicReq.Stream)
+	assert.Equal(t, 2048, anthropicReq.MaxTokens)
+	require.Len(t, anthropicReq.System, 1)
+	assert.Equal(t, "be brief", anthropicReq.System[0].Text)
+
+	require.Len(t, anthropicReq.Messages, 3)
+	assert.Equal(t, "user", anthropicReq.Messages[0].Role)
+	userBlocks := anthropicReq.Messages[0].Content.([]any)
+	require.Len(t, userBlocks, 2)
+	assert.Equal(t, "image", userBlocks[1].(map[string]any)["type"])
+
+	assert.Equal(t, "assistant", anthropicReq.Messages[1].Role)
+	toolUse := anthropicReq.Messages[1].Content.([]any)[1].(map[string]any)
+	toolResult := anthropicReq.Messages[2].Content.([]any)[0].(map[string]any)
+	assert.Equal(t, "tool_use", toolUse["type"])
+	assert.Equal(t, "tool_result", toolResult["type"])
+	assert.Equal(t, toolUse["id"], toolResult["tool_use_id"], "functionResponse 应按函数名与 functionCall 配对")
+	assert.JSONEq(t, `{"temp":20}`, toolResult["content"].(string))
+
+	require.Len(t, anthropicReq.Tools, 1)
+	schema := anthropicReq.Tools[0].InputSchema
+	assert.Equal(t, "object", schema["type"])
+	assert.Equal(t, "string", schema["properties"].(map[string]any)["city"].(map[string]any)["type"])
+	assert.Equal(t, &types.ToolChoice{Type: "tool", Name: "get_weather"}, anthropicReq.ToolChoice)
+}
+
+func TestConvertGeminiToAnthropic_ModeNoneDropsTools(t *testing.T) {
+	req := types.GeminiRequest{
+		Contents:   []types.GeminiContent{{Role: "user", Parts: []types.GeminiPart{{Text: "hi"}}}},
+		Tools:      []types.GeminiTool{{FunctionDeclarations: []types.GeminiFunctionDeclaration{{Name: "noop"}}}},
+		ToolConfig: &types.GeminiToolConfig{FunctionCallingConfig: &types.GeminiFunctionCallingConfig{Mode: "NONE"}},
+	}
+
+	anthropicReq := ConvertGeminiToAnthropic(req, "claude-sonnet-4-5", false)
+
+	assert.Empty(t, anthropicReq.Tools)
+	assert.Nil(t, anthropicReq.ToolChoice)
+}
+
+func TestConvertAnthropicToGemini(t *testing.T) {
+	anthropicResp := map[string]any{
+		"content": []map[string]any{
+			{"type": "text", "text": "Let me check."},
+			{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": map[string]any{"city": "Paris"}},
+		},
+		"stop_reason": "tool_use",
+		"usage":       map[string]any{"input_tokens": 10, "output_tokens": 5},
+	}
+
+	resp := ConvertAnthropicToGemini(anthropicResp, "gemini-2.5-pro")
+
+	require.Len(t, resp.Candidates, 1)
+	candidate := resp.Candidates[0]
+	assert.Equal(t, "model", candidate.Content.Role)
+	assert.Equal(t, "STOP", candidate.FinishReason)
+	require.Len(t, candidate.Content.Parts, 2)
+	assert.Equal(t, "Let me check.", candidate.Content.Parts[0].Text)
+	require.NotNil(t, candidate.Content.Parts[1].FunctionCall)
+	assert.Equal(t, "get_weather", candidate.Content.Parts[1].FunctionCall.Name)
+	assert.Equal(t, map[string]any{"city": "Paris"}, candidate.Content.Parts[1].FunctionCall.Args)
+	require.NotNil(t, resp.UsageMetadata)
+	assert.Equal(t, 15, resp.UsageMetadata.TotalTokenCount)
+	assert.Equal(t, "gemini-2.5-pro", resp.ModelVersion)
+
+	assert.Equal(t, "MAX_TOKENS", GeminiFinishReason("max_tokens"))
+	assert.Equal(t, "SAFETY", GeminiFinishReason("refusal"))
+}
@@ -0,0 +1,85 @@
+package converter
+
+import (
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+)
+
+// truncateHistoryToBudget 估算的token数超过 HISTORY_TRUNCATE_MAX_TOKENS 时丢弃最早的历史消息
+// system 与最后一条消息始终保留；只在不含 tool_result 的 user 消息处截断，保证 tool_use/tool_result 成对保留
+// 即使丢弃全部可丢弃的历史仍超出预算时，截断到最后一个可截断位置，交由上游判断
+func truncateHistoryToBudget(anthropicReq types.AnthropicRequest, messages []types.AnthropicRequestMessage) []types.AnthropicRequestMessage {
+	budget := config.HistoryTruncateMaxTokens
+	if !config.HistoryAutoTruncate || budget <= 0 || len(messages) < 2 {
+		return messages
+	}
+
+	// system 与 tools 不可丢弃，计入固定开销
+	fixed := 0
+	for _, sys := range anthropicReq.System {
+		fixed += utils.CountTokensWithTiktoken(sys.Text, "cl100k_base")
+	}
+	if len(anthropicReq.Tools) > 0 {
+		if b, err := utils.SafeMarshal(anthropicReq.Tools); err == nil {
+			fixed += utils.CountTokensWithTiktoken(string(b), "cl100k_base")
+		}
+	}
+
+	// suffix[i] 为 messages[i:] 的token数
+	suffix := make([]int, len(messages)+1)
+	for i := len(messages) - 1; i >= 0; i-- {
+		suffix[i] = suffix[i+1] + utils.CountAnthropicMessageTokens(messages[i])
+	}
+	if fixed+suffix[0] <= budget {
+		return messages
+	}
+
+	cut := -1
+	for i := 1; i < len(messages); i++ {
+		if !isHistoryCutPoint(messages[i]) {
+			continue
+		}
+		cut = i
+		if fixed+suffix[i] <= budget {
+			break
+		}
+	}
+	if cut < 0 {
+		logger.Warn("历史消息超出token预算，但没有可安全截断的位置",
+			logger.Int("estimated_tokens", fixed+suffix[0]),
+			logger.Int("budget", budget),
+			logger.Int("messages", len(messages)))
+		return messages
+	}
+
+	logger.Info("历史消息超出token预算，已丢弃最早的消息",
+		logger.Int("dropped_messages", cut),
+		logger.Int("remaining_messages", len(messages)-cut),
+		logger.Int("estimated_tokens_before", fixed+suffix[0]),
+		logger.Int("estimated_tokens_after", fixed+suffix[cut]),
+		logger.Int("budget", budget))
+	return messages[cut:]
+}
+
+// DropOldestHistoryTurn 丢弃最早的一轮历史：截断到下一个可截断位置（最后一条消息始终保留）
+// 没有可截断位置时原样返回 false
+func DropOldestHistoryTurn(messages []types.AnthropicRequestMessage) ([]types.AnthropicRequestMessage, bool) {
+	for i := 1; i < len(messages); i++ {
+		if isHistoryCutPoint(messages[i]) {
+			return messages[i:], true
+		}
+	}
+	return messages, false
+}
+
+// isHistoryCutPoint 判断截断后能否以该消息开头：必须是 user 消息，且不含 tool_result（否则对应的 tool_use 已被丢弃）
+func isHistoryCutPoint(msg types.AnthropicRequestMessage) bool {
+	if strings.TrimSpace(msg.Role) != "user" {
+		return false
+	}
+	return len(extractToolResultsFromMessage(msg.Content)) == 0
+}
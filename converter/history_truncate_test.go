@@ -0,0 +1,84 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+func truncateTestMessages() []types.AnthropicRequestMessage {
+	long := strings.Repeat("lorem ipsum dolor sit amet ", 400)
+	return []types.AnthropicRequestMessage{
+		{Role: "user", Content: long},
+		{Role: "assistant", Content: []any{
+			map[string]any{"type": "tool_use", "id": "toolu_1", "name": "read_file", "input": map[string]any{"path": "a.txt"}},
+		}},
+		{Role: "user", Content: []any{
+			map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": long},
+		}},
+		{Role: "assistant", Content: "done"},
+		{Role: "user", Content: "next question"},
+		{Role: "assistant", Content: "answer"},
+		{Role: "user", Content: "final question"},
+	}
+}
+
+func withHistoryTruncate(t *testing.T, enabled bool, budget int) {
+	t.Helper()
+	origEnabled, origBudget := config.HistoryAutoTruncate, config.HistoryTruncateMaxTokens
+	config.HistoryAutoTruncate, config.HistoryTruncateMaxTokens = enabled, budget
+	t.Cleanup(func() {
+		config.HistoryAutoTruncate, config.HistoryTruncateMaxTokens = origEnabled, origBudget
+	})
+}
+
+func TestTruncateHistoryToBudget_KeepsToolPairsAndFinalMessage(t *testing.T) {
+	withHistoryTruncate(t, true, 1000)
+	req := types.AnthropicRequest{System: []types.AnthropicSystemMessage{{Type: "text", Text: "be helpful"}}}
+
+	got := truncateHistoryToBudget(req, truncateTestMessages())
+
+	// tool_result 所在的 user 消息不能作为起点，tool_use 与 tool_result 一起被丢弃
+	if len(got) != 3 {
+		t.Fatalf("期望保留 3 条消息，实际 %d", len(got))
+	}
+	if got[0].Content != "next question" || got[len(got)-1].Content != "final question" {
+		t.Errorf("截断位置不符: first=%v last=%v", got[0].Content, got[len(got)-1].Content)
+	}
+}
+
+func TestTruncateHistoryToBudget_NoopWhenDisabledOrWithinBudget(t *testing.T) {
+	messages := truncateTestMessages()
+
+	withHistoryTruncate(t, false, 1000)
+	if got := truncateHistoryToBudget(types.AnthropicRequest{}, messages); len(got) != len(messages) {
+		t.Errorf("未启用时不应截断，实际保留 %d 条", len(got))
+	}
+
+	config.HistoryAutoTruncate = true
+	config.HistoryTruncateMaxTokens = 1000000
+	if got := truncateHistoryToBudget(types.AnthropicRequest{}, messages); len(got) != len(messages) {
+		t.Errorf("未超出预算时不应截断，实际保留 %d 条", len(got))
+	}
+}
+
+func TestDropOldestHistoryTurn(t *testing.T) {
+	messages := truncateTestMessages()
+
+	got, ok := DropOldestHistoryTurn(messages)
+	// tool_result 所在的 user 消息不能作为起点，下一个可截断位置是 "next question"
+	if !ok || got[0].Content != "next question" {
+		t.Fatalf("DropOldestHistoryTurn() = %v, %v; want start at next question", got, ok)
+	}
+
+	got, ok = DropOldestHistoryTurn(got)
+	if !ok || len(got) != 1 || got[0].Content != "final question" {
+		t.Fatalf("second drop = %v, %v; want only final question", got, ok)
+	}
+
+	if _, ok := DropOldestHistoryTurn(got); ok {
+		t.Error("只剩最后一条消息时不应继续截断")
+	}
+}
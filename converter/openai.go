@@ -1,6 +1,7 @@
 package converter
 
 import (
+	"context"
 	"strings"
 	"time"
 
@@ -13,6 +14,10 @@ import (
 
 // ConvertOpenAIToAnthropic 将OpenAI请求转换为Anthropic请求
 func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequest {
+	// 旧版 functions / function_call 先转换为 tools / tool_choice（按请求检测，新旧客户端可混用）
+	legacyFunctionCall := IsLegacyFunctionRequest(openaiReq)
+	openaiReq = normalizeLegacyFunctions(openaiReq)
+
 	var anthropicMessages []types.AnthropicRequestMessage
 
 	// 收集所有历史中的 tool_use_id，用于验证 tool_result 配对
@@ -184,10 +189,10 @@ func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequ
 		}
 	}
 
-	// 设置默认值
+	// 设置默认值（max_completion_tokens 优先，max_tokens 兜底）
 	maxTokens := 16384
-	if openaiReq.MaxTokens != nil {
-		maxTokens = *openaiReq.MaxTokens
+	if requested := openaiReq.MaxOutputTokens(); requested != nil {
+		maxTokens = *requested
 	}
 
 	// 为了增强兼容性，当stream未设置时默认为false（非流式响应）
@@ -197,59 +202,40 @@ func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequ
 		stream = *openaiReq.Stream
 	}
 
-	// 检测 -thinking 后缀，自动开启思考模式（与 kiro.rs 对齐）
-	model := openaiReq.Model
-	var thinking *types.Thinking
-	var outputConfig *types.OutputConfig
-	if strings.HasSuffix(model, "-thinking") {
-		model = strings.TrimSuffix(model, "-thinking")
-		budgetTokens := 20000 // 与 kiro.rs 对齐
-		// 与 kiro.rs 对齐：Opus 4.6 使用 adaptive 模式
-		modelLower := strings.ToLower(model)
-		isOpus46 := strings.Contains(modelLower, "opus") &&
-			(strings.Contains(modelLower, "4-6") || strings.Contains(modelLower, "4.6"))
-		if isOpus46 {
-			thinking = &types.Thinking{
-				Type:         "adaptive",
-				BudgetTokens: budgetTokens,
-			}
-			outputConfig = &types.OutputConfig{
-				Effort: "high",
-			}
-		} else {
-			thinking = &types.Thinking{
-				Type:         "enabled",
-				BudgetTokens: budgetTokens,
-			}
-		}
-		// 确保 max_tokens > budget_tokens（官方 API 要求）
-		if maxTokens <= budgetTokens {
-			maxTokens = budgetTokens + 4096
-		}
-	}
-
 	anthropicReq := types.AnthropicRequest{
-		Model:        model,
-		MaxTokens:    maxTokens,
-		Messages:     anthropicMessages,
-		Stream:       stream,
-		Thinking:     thinking,
-		OutputConfig: outputConfig,
+		Model:     openaiReq.Model,
+		MaxTokens: maxTokens,
+		Messages:  anthropicMessages,
+		Stream:    stream,
 	}
+	// 检测 -thinking 后缀，自动开启思考模式
+	ApplyThinkingModelSuffix(&anthropicReq)
 
+	if stream && openaiReq.StreamOptions != nil {
+		anthropicReq.IncludeUsage = openaiReq.StreamOptions.IncludeUsage
+	}
+	anthropicReq.LegacyFunctionCall = legacyFunctionCall
 	if openaiReq.Temperature != nil {
 		anthropicReq.Temperature = openaiReq.Temperature
 	}
+	if openaiReq.TopP != nil {
+		anthropicReq.TopP = openaiReq.TopP
+	}
+	logUnsupportedOpenAIParams(openaiReq)
 
 	// 转换 tools
 	if len(openaiReq.Tools) > 0 {
-		anthropicTools, err := validateAndProcessTools(openaiReq.Tools)
+		toolsResult, err := ValidateAndProcessToolsWithMapping(openaiReq.Tools)
 		if err != nil {
 			// 记录警告但不中断处理，允许部分工具失败
 			// 可以考虑返回错误，取决于业务需求
 			// 这里参考server.py的做法，记录错误但继续处理有效的工具
 		}
-		anthropicReq.Tools = anthropicTools
+		anthropicReq.Tools = toolsResult.Tools
+		// 保留参数名截断映射，响应时将工具调用参数还原为客户端声明的原始名称
+		if toolsResult.HasMappings() {
+			anthropicReq.ToolParamMappings = toolsResult.ParamMappings
+		}
 	}
 
 	// 转换 tool_choice
@@ -257,11 +243,31 @@ func ConvertOpenAIToAnthropic(openaiReq types.OpenAIRequest) types.AnthropicRequ
 		anthropicReq.ToolChoice = convertOpenAIToolChoiceToAnthropic(openaiReq.ToolChoice)
 	}
 
+	// 转换 response_format（需在 tools/tool_choice/thinking 之后，以便判断是否强制工具调用）
+	applyResponseFormat(&anthropicReq, openaiReq.ResponseFormat)
+
 	return anthropicReq
 }
 
+// logUnsupportedOpenAIParams 记录上游没有对应参数而被忽略的 seed / logit_bias
+// CodeWhisperer 的 inferenceConfiguration 不支持随机种子与 token 偏置，转发会导致上游拒绝请求
+func logUnsupportedOpenAIParams(openaiReq types.OpenAIRequest) {
+	if len(openaiReq.LogitBias) > 0 {
+		logger.Warn("上游不支持 logit_bias，已忽略",
+			logger.String("model", openaiReq.Model),
+			logger.Int("logit_bias_entries", len(openaiReq.LogitBias)))
+	}
+	if openaiReq.Seed != nil {
+		logger.Debug("上游不支持 seed，已忽略",
+			logger.String("model", openaiReq.Model),
+			logger.Int64("seed", *openaiReq.Seed))
+	}
+}
+
 // ConvertAnthropicToOpenAI 将Anthropic响应转换为OpenAI响应
-func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messageId string) types.OpenAIResponse {
+// 响应中的 usage 优先；缺失时 prompt_tokens 按 count_tokens 接口的方式从原始请求计数，
+// completion_tokens 使用 tiktoken 对文本与工具调用（名称和参数）计数
+func ConvertAnthropicToOpenAI(anthropicResp map[string]any, anthropicReq types.AnthropicRequest, messageId string) types.OpenAIResponse {
 	content := ""
 	var toolCalls []types.OpenAIToolCall
 	finishReason := "stop"
@@ -335,30 +341,19 @@ func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messag
 		content = strings.Join(textParts, "")
 	}
 
-	// 计算token使用量
-	promptTokens := 0
-	completionTokens := len(content) / 4 // 简单估算
-	if usage, ok := anthropicResp["usage"].(map[string]any); ok {
-		if v, ok := usage["input_tokens"]; ok {
-			switch n := v.(type) {
-			case int:
-				promptTokens = n
-			case int64:
-				promptTokens = int(n)
-			case float64:
-				promptTokens = int(n)
-			}
-		}
-		if v, ok := usage["output_tokens"]; ok {
-			switch n := v.(type) {
-			case int:
-				completionTokens = n
-			case int64:
-				completionTokens = int(n)
-			case float64:
-				completionTokens = int(n)
-			}
-		}
+	// 上游拒绝生成（护栏/内容过滤）映射为 content_filter
+	if anthropicResp["stop_reason"] == "refusal" {
+		finishReason = "content_filter"
+	}
+
+	// 计算token使用量（上游返回的 usage 为准）
+	promptTokens, hasPromptTokens := usageTokens(anthropicResp, "input_tokens")
+	if !hasPromptTokens {
+		promptTokens = countPromptTokens(anthropicReq)
+	}
+	completionTokens, hasCompletionTokens := usageTokens(anthropicResp, "output_tokens")
+	if !hasCompletionTokens {
+		completionTokens = countCompletionTokens(content, toolCalls)
 	}
 
 	message := types.OpenAIMessage{
@@ -375,7 +370,7 @@ func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messag
 		ID:      messageId,
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
-		Model:   model,
+		Model:   anthropicReq.Model,
 		Choices: []types.OpenAIChoice{
 			{
 				Index:        0,
@@ -390,3 +385,48 @@ func ConvertAnthropicToOpenAI(anthropicResp map[string]any, model string, messag
 		},
 	}
 }
+
+// usageTokens 读取响应 usage 中的 token 数，字段缺失时返回 false
+func usageTokens(anthropicResp map[string]any, key string) (int, bool) {
+	usage, ok := anthropicResp["usage"].(map[string]any)
+	if !ok {
+		return 0, false
+	}
+	switch n := usage[key].(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	default:
+		return 0, false
+	}
+}
+
+// countPromptTokens 与 /v1/messages/count_tokens 相同的方式计数请求输入 tokens（优先官方API，否则本地tiktoken计数）
+func countPromptTokens(anthropicReq types.AnthropicRequest) int {
+	if len(anthropicReq.Messages) == 0 && len(anthropicReq.System) == 0 {
+		return 0
+	}
+	tokens, err := utils.NewTokenCounterFromEnv().CountInputTokens(context.Background(), &types.CountTokensRequest{
+		Model:    anthropicReq.Model,
+		System:   anthropicReq.System,
+		Messages: anthropicReq.Messages,
+		Tools:    anthropicReq.Tools,
+	})
+	if err != nil {
+		return 0
+	}
+	return tokens
+}
+
+// countCompletionTokens 使用 tiktoken 计数输出文本与工具调用，与非流式 Anthropic 响应的 output_tokens 计数一致
+func countCompletionTokens(content string, toolCalls []types.OpenAIToolCall) int {
+	tokens := utils.CountTokensWithTiktoken(content, "cl100k_base")
+	for _, toolCall := range toolCalls {
+		tokens += utils.CountTokensWithTiktoken(toolCall.Function.Name, "cl100k_base")
+		tokens += utils.CountTokensWithTiktoken(toolCall.Function.Arguments, "cl100k_base")
+	}
+	return tokens
+}
@@ -0,0 +1,129 @@
+package converter
+
+import (
+	"fmt"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// 旧版 OpenAI 函数调用（functions / function_call）兼容
+// 请求中的旧版字段先转换为 tools / tool_choice / tool_calls / role=tool 后按新版格式处理；
+// 请求使用旧版格式时，响应中的 tool_calls 再转换回 function_call（每条消息只能包含一个函数调用）
+
+// IsLegacyFunctionRequest 请求是否使用旧版函数调用格式（声明了 functions 且未声明 tools）
+func IsLegacyFunctionRequest(req types.OpenAIRequest) bool {
+	return len(req.Tools) == 0 && len(req.Functions) > 0
+}
+
+// normalizeLegacyFunctions 将旧版函数调用字段转换为新版格式
+// 已声明 tools / tool_choice 时以新版字段为准
+func normalizeLegacyFunctions(req types.OpenAIRequest) types.OpenAIRequest {
+	if len(req.Tools) == 0 && len(req.Functions) > 0 {
+		tools := make([]types.OpenAITool, 0, len(req.Functions))
+		for _, fn := range req.Functions {
+			tools = append(tools, types.OpenAITool{Type: "function", Function: fn})
+		}
+		req.Tools = tools
+	}
+	if req.ToolChoice == nil && req.FunctionCall != nil {
+		req.ToolChoice = legacyFunctionCallToToolChoice(req.FunctionCall)
+	}
+	req.Messages = normalizeLegacyFunctionMessages(req.Messages)
+	return req
+}
+
+// legacyFunctionCallToToolChoice 将 function_call 转换为等价的 tool_choice
+func legacyFunctionCallToToolChoice(functionCall any) any {
+	switch fc := functionCall.(type) {
+	case string:
+		return fc // "auto" / "none" 与 tool_choice 取值相同
+	case map[string]any:
+		if name, _ := fc["name"].(string); name != "" {
+			return map[string]any{"type": "function", "function": map[string]any{"name": name}}
+		}
+	}
+	return nil
+}
+
+// normalizeLegacyFunctionMessages 将历史消息中的 function_call 与 role=function 转换为 tool_calls 与 role=tool
+// 旧版格式没有调用ID：为每个 function_call 生成ID，role=function 的结果按函数名依次配对
+func normalizeLegacyFunctionMessages(messages []types.OpenAIMessage) []types.OpenAIMessage {
+	result := make([]types.OpenAIMessage, 0, len(messages))
+	pending := make(map[string][]string) // 函数名 -> 尚未收到结果的调用ID
+	for i, msg := range messages {
+		switch {
+		case msg.Role == "assistant" && msg.FunctionCall != nil && len(msg.ToolCalls) == 0:
+			id := fmt.Sprintf("call_fn_%d", i)
+			msg.ToolCalls = []types.OpenAIToolCall{{ID: id, Type: "function", Function: *msg.FunctionCall}}
+			msg.FunctionCall = nil
+			pending[msg.ToolCalls[0].Function.Name] = append(pending[msg.ToolCalls[0].Function.Name], id)
+
+		case msg.Role == "function":
+			msg.Role = "tool"
+			if ids := pending[msg.Name]; len(ids) > 0 {
+				msg.ToolCallID = ids[0]
+				pending[msg.Name] = ids[1:]
+			}
+			// 找不到对应调用的结果保持空ID，转换时作为孤立的 tool_result 跳过
+		}
+		result = append(result, msg)
+	}
+	return result
+}
+
+// ConvertToLegacyFunctionCall 将非流式响应中的 tool_calls 转换为旧版 function_call
+func ConvertToLegacyFunctionCall(resp *types.OpenAIResponse) {
+	for i := range resp.Choices {
+		choice := &resp.Choices[i]
+		if len(choice.Message.ToolCalls) == 0 {
+			continue
+		}
+		if len(choice.Message.ToolCalls) > 1 {
+			logger.Warn("旧版 function_call 格式只支持单个函数调用，丢弃多余的调用",
+				logger.Int("tool_calls", len(choice.Message.ToolCalls)))
+		}
+		fn := choice.Message.ToolCalls[0].Function
+		choice.Message.FunctionCall = &fn
+		choice.Message.ToolCalls = nil
+		if choice.FinishReason == "tool_calls" {
+			choice.FinishReason = "function_call"
+		}
+	}
+}
+
+// ConvertChunkToLegacyFunctionCall 将流式 chunk 中的 tool_calls 增量转换为旧版 function_call 增量
+// 只保留第一个工具调用（index 0）；返回 false 表示转换后 chunk 没有需要下发的内容
+func ConvertChunkToLegacyFunctionCall(chunk map[string]any) bool {
+	choices, ok := chunk["choices"].([]map[string]any)
+	if !ok || len(choices) == 0 {
+		return true // usage chunk 等不含 choices 的 chunk 原样下发
+	}
+	send := false
+	for _, choice := range choices {
+		if choice["finish_reason"] == "tool_calls" {
+			choice["finish_reason"] = "function_call"
+		}
+		if choice["finish_reason"] != nil {
+			send = true
+		}
+
+		delta, _ := choice["delta"].(map[string]any)
+		toolCalls, ok := delta["tool_calls"].([]map[string]any)
+		if !ok {
+			send = true
+			continue
+		}
+		delete(delta, "tool_calls")
+		for _, tc := range toolCalls {
+			if index, _ := tc["index"].(int); index != 0 {
+				continue
+			}
+			if fn, ok := tc["function"].(map[string]any); ok {
+				delta["function_call"] = fn
+				send = true
+			}
+		}
+	}
+	return send
+}
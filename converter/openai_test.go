@@ -1,11 +1,14 @@
 package converter
 
 import (
+	"context"
 	"testing"
 
 	"kiro2api/types"
+	"kiro2api/utils"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConvertOpenAIToAnthropic_BasicMessage(t *testing.T) {
@@ -106,6 +109,35 @@ func TestConvertOpenAIToAnthropic_DefaultMaxTokens(t *testing.T) {
 	assert.Equal(t, 16384, anthropicReq.MaxTokens)
 }
 
+func TestConvertOpenAIToAnthropic_MaxCompletionTokens(t *testing.T) {
+	maxTokens, maxCompletionTokens := 1024, 4096
+	messages := []types.OpenAIMessage{{Role: "user", Content: "Test"}}
+
+	// max_completion_tokens 优先于已弃用的 max_tokens
+	anthropicReq := ConvertOpenAIToAnthropic(types.OpenAIRequest{
+		Model:               "gpt-4",
+		Messages:            messages,
+		MaxTokens:           &maxTokens,
+		MaxCompletionTokens: &maxCompletionTokens,
+	})
+	assert.Equal(t, 4096, anthropicReq.MaxTokens)
+
+	anthropicReq = ConvertOpenAIToAnthropic(types.OpenAIRequest{
+		Model:               "gpt-4",
+		Messages:            messages,
+		MaxCompletionTokens: &maxCompletionTokens,
+	})
+	assert.Equal(t, 4096, anthropicReq.MaxTokens)
+
+	// thinking 模式下同样保证 max_tokens > budget_tokens
+	anthropicReq = ConvertOpenAIToAnthropic(types.OpenAIRequest{
+		Model:               "claude-sonnet-4-thinking",
+		Messages:            messages,
+		MaxCompletionTokens: &maxCompletionTokens,
+	})
+	assert.Greater(t, anthropicReq.MaxTokens, anthropicReq.Thinking.BudgetTokens)
+}
+
 func TestConvertOpenAIToAnthropic_StreamDefault(t *testing.T) {
 	openaiReq := types.OpenAIRequest{
 		Model: "gpt-4",
@@ -141,7 +173,7 @@ func TestConvertAnthropicToOpenAI_BasicResponse(t *testing.T) {
 		},
 	}
 
-	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, "claude-3-sonnet-20240229", "msg_123")
+	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, types.AnthropicRequest{Model: "claude-3-sonnet-20240229"}, "msg_123")
 
 	assert.Equal(t, "msg_123", openaiResp.ID)
 	assert.Equal(t, "chat.completion", openaiResp.Object)
@@ -154,6 +186,62 @@ func TestConvertAnthropicToOpenAI_BasicResponse(t *testing.T) {
 	assert.Equal(t, 30, openaiResp.Usage.TotalTokens)
 }
 
+func TestConvertAnthropicToOpenAI_EstimatesMissingUsage(t *testing.T) {
+	t.Setenv("CLAUDE_API_KEY", "")
+	anthropicReq := types.AnthropicRequest{
+		Model:    "claude-3-sonnet-20240229",
+		Messages: []types.AnthropicRequestMessage{{Role: "user", Content: "What is the weather in Paris today?"}},
+	}
+	anthropicResp := map[string]any{
+		"content": []any{
+			map[string]any{"type": "text", "text": "Let me check the weather for you."},
+			map[string]any{
+				"type":  "tool_use",
+				"id":    "toolu_1",
+				"name":  "get_weather",
+				"input": map[string]any{"city": "Paris"},
+			},
+		},
+		"stop_reason": "tool_use",
+	}
+
+	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, anthropicReq, "msg_123")
+
+	arguments := openaiResp.Choices[0].Message.ToolCalls[0].Function.Arguments
+	expectedCompletion := utils.CountTokensWithTiktoken("Let me check the weather for you.", "cl100k_base") +
+		utils.CountTokensWithTiktoken("get_weather", "cl100k_base") +
+		utils.CountTokensWithTiktoken(arguments, "cl100k_base")
+	expectedPrompt, err := utils.NewTokenCounterFromEnv().CountInputTokens(context.Background(), &types.CountTokensRequest{
+		Model:    anthropicReq.Model,
+		Messages: anthropicReq.Messages,
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, expectedCompletion, openaiResp.Usage.CompletionTokens)
+	assert.Equal(t, expectedPrompt, openaiResp.Usage.PromptTokens)
+	assert.Greater(t, openaiResp.Usage.PromptTokens, 0)
+	assert.Equal(t, expectedPrompt+expectedCompletion, openaiResp.Usage.TotalTokens)
+
+	// 上游返回的 usage 优先
+	anthropicResp["usage"] = map[string]any{"input_tokens": 7, "output_tokens": 3}
+	openaiResp = ConvertAnthropicToOpenAI(anthropicResp, anthropicReq, "msg_123")
+	assert.Equal(t, 7, openaiResp.Usage.PromptTokens)
+	assert.Equal(t, 3, openaiResp.Usage.CompletionTokens)
+}
+
+func TestConvertAnthropicToOpenAI_RefusalMapsToContentFilter(t *testing.T) {
+	anthropicResp := map[string]any{
+		"content": []any{
+			map[string]any{"type": "text", "text": "I can"},
+		},
+		"stop_reason": "refusal",
+	}
+
+	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, types.AnthropicRequest{Model: "claude-3-sonnet-20240229"}, "msg_123")
+
+	assert.Equal(t, "content_filter", openaiResp.Choices[0].FinishReason)
+}
+
 func TestConvertAnthropicToOpenAI_MultipleContentBlocks(t *testing.T) {
 	anthropicResp := map[string]any{
 		"id":   "msg_456",
@@ -172,7 +260,7 @@ func TestConvertAnthropicToOpenAI_MultipleContentBlocks(t *testing.T) {
 		"stop_reason": "end_turn",
 	}
 
-	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, "claude-3-sonnet-20240229", "msg_456")
+	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, types.AnthropicRequest{Model: "claude-3-sonnet-20240229"}, "msg_456")
 
 	assert.Len(t, openaiResp.Choices, 1)
 	// 多个content block应该被合并
@@ -206,7 +294,7 @@ func TestConvertAnthropicToOpenAI_StopReasonMapping(t *testing.T) {
 				"stop_reason": tt.anthropicStopReason,
 			}
 
-			openaiResp := ConvertAnthropicToOpenAI(anthropicResp, "claude-3-sonnet-20240229", "msg_test")
+			openaiResp := ConvertAnthropicToOpenAI(anthropicResp, types.AnthropicRequest{Model: "claude-3-sonnet-20240229"}, "msg_test")
 
 			assert.Equal(t, tt.expectedFinishReason, openaiResp.Choices[0].FinishReason)
 		})
@@ -234,8 +322,137 @@ func TestConvertAnthropicToOpenAI_EmptyContent(t *testing.T) {
 		"stop_reason": "end_turn",
 	}
 
-	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, "claude-3-sonnet-20240229", "msg_empty")
+	openaiResp := ConvertAnthropicToOpenAI(anthropicResp, types.AnthropicRequest{Model: "claude-3-sonnet-20240229"}, "msg_empty")
 
 	assert.Len(t, openaiResp.Choices, 1)
 	assert.Empty(t, openaiResp.Choices[0].Message.Content)
 }
+
+func TestConvertOpenAIToAnthropic_SamplingParams(t *testing.T) {
+	temperature := 0.3
+	topP := 0.9
+	openaiReq := types.OpenAIRequest{
+		Model:       "claude-sonnet-4-20250514",
+		Messages:    []types.OpenAIMessage{{Role: "user", Content: "Hello"}},
+		Temperature: &temperature,
+		TopP:        &topP,
+	}
+
+	result := ConvertOpenAIToAnthropic(openaiReq)
+
+	assert.Equal(t, &temperature, result.Temperature)
+	assert.Equal(t, &topP, result.TopP)
+}
+
+func TestConvertOpenAIToAnthropic_StreamOptionsIncludeUsage(t *testing.T) {
+	stream := true
+	openaiReq := types.OpenAIRequest{
+		Model:         "gpt-4",
+		Messages:      []types.OpenAIMessage{{Role: "user", Content: "Test"}},
+		Stream:        &stream,
+		StreamOptions: &types.OpenAIStreamOptions{IncludeUsage: true},
+	}
+	assert.True(t, ConvertOpenAIToAnthropic(openaiReq).IncludeUsage)
+
+	// 非流式请求忽略 stream_options
+	stream = false
+	assert.False(t, ConvertOpenAIToAnthropic(openaiReq).IncludeUsage)
+}
+
+func TestConvertOpenAIToAnthropic_LegacyFunctions(t *testing.T) {
+	openaiReq := types.OpenAIRequest{
+		Model: "claude-sonnet-4",
+		Messages: []types.OpenAIMessage{
+			{Role: "user", Content: "What's the weather in Paris?"},
+			{Role: "assistant", FunctionCall: &types.OpenAIToolFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+			{Role: "function", Name: "get_weather", Content: "sunny"},
+			{Role: "user", Content: "And tomorrow?"},
+		},
+		Functions: []types.OpenAIFunction{{
+			Name:        "get_weather",
+			Description: "Get the weather",
+			Parameters:  map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}},
+		}},
+		FunctionCall: map[string]any{"name": "get_weather"},
+	}
+
+	result := ConvertOpenAIToAnthropic(openaiReq)
+
+	assert.True(t, result.LegacyFunctionCall)
+	assert.Len(t, result.Tools, 1)
+	assert.Equal(t, "get_weather", result.Tools[0].Name)
+	assert.Equal(t, &types.ToolChoice{Type: "tool", Name: "get_weather"}, result.ToolChoice)
+
+	// function_call / role=function 转换为配对的 tool_use / tool_result
+	assert.Len(t, result.Messages, 4)
+	var toolUse map[string]any
+	for _, block := range result.Messages[1].Content.([]any) {
+		if b := block.(map[string]any); b["type"] == "tool_use" {
+			toolUse = b
+		}
+	}
+	assert.NotNil(t, toolUse)
+	assert.Equal(t, "get_weather", toolUse["name"])
+	toolResult := result.Messages[2].Content.([]map[string]any)[0]
+	assert.Equal(t, "tool_result", toolResult["type"])
+	assert.Equal(t, toolUse["id"], toolResult["tool_use_id"])
+	assert.Equal(t, "sunny", toolResult["content"])
+}
+
+func TestConvertOpenAIToAnthropic_ModernToolsNotLegacy(t *testing.T) {
+	openaiReq := types.OpenAIRequest{
+		Model:    "claude-sonnet-4",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "hi"}},
+		Tools:    []types.OpenAITool{{Type: "function", Function: types.OpenAIFunction{Name: "lookup", Parameters: map[string]any{"type": "object"}}}},
+	}
+	assert.False(t, ConvertOpenAIToAnthropic(openaiReq).LegacyFunctionCall)
+}
+
+func TestConvertToLegacyFunctionCall(t *testing.T) {
+	resp := types.OpenAIResponse{Choices: []types.OpenAIChoice{{
+		Message: types.OpenAIMessage{
+			Role: "assistant",
+			ToolCalls: []types.OpenAIToolCall{
+				{ID: "call_1", Type: "function", Function: types.OpenAIToolFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+				{ID: "call_2", Type: "function", Function: types.OpenAIToolFunction{Name: "get_time", Arguments: `{}`}},
+			},
+		},
+		FinishReason: "tool_calls",
+	}}}
+
+	ConvertToLegacyFunctionCall(&resp)
+
+	choice := resp.Choices[0]
+	assert.Nil(t, choice.Message.ToolCalls)
+	assert.Equal(t, &types.OpenAIToolFunction{Name: "get_weather", Arguments: `{"city":"Paris"}`}, choice.Message.FunctionCall)
+	assert.Equal(t, "function_call", choice.FinishReason)
+}
+
+func TestConvertChunkToLegacyFunctionCall(t *testing.T) {
+	toolChunk := func(index int) map[string]any {
+		return map[string]any{"choices": []map[string]any{{
+			"index": 0,
+			"delta": map[string]any{"tool_calls": []map[string]any{{
+				"index":    index,
+				"function": map[string]any{"arguments": `{"a":1}`},
+			}}},
+			"finish_reason": nil,
+		}}}
+	}
+
+	chunk := toolChunk(0)
+	assert.True(t, ConvertChunkToLegacyFunctionCall(chunk))
+	delta := chunk["choices"].([]map[string]any)[0]["delta"].(map[string]any)
+	assert.Equal(t, map[string]any{"arguments": `{"a":1}`}, delta["function_call"])
+	assert.NotContains(t, delta, "tool_calls")
+
+	// 第二个工具调用无法以旧版格式表示，整个 chunk 不下发
+	assert.False(t, ConvertChunkToLegacyFunctionCall(toolChunk(1)))
+
+	final := map[string]any{"choices": []map[string]any{{"index": 0, "delta": map[string]any{}, "finish_reason": "tool_calls"}}}
+	assert.True(t, ConvertChunkToLegacyFunctionCall(final))
+	assert.Equal(t, "function_call", final["choices"].([]map[string]any)[0]["finish_reason"])
+
+	usage := map[string]any{"choices": []map[string]any{}, "usage": map[string]any{"total_tokens": 3}}
+	assert.True(t, ConvertChunkToLegacyFunctionCall(usage))
+}
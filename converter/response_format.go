@@ -0,0 +1,124 @@
+package converter
+
+import (
+	"fmt"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// OpenAI response_format（结构化输出）转换
+// - json_object：在系统提示中注入"仅输出JSON对象"的指令
+// - json_schema：注入携带 schema 的合成工具并强制 tool_choice，响应时再把工具参数还原为消息内容
+
+// StructuredOutputToolName 结构化输出使用的合成工具名称
+const StructuredOutputToolName = "structured_output"
+
+const jsonObjectInstruction = "You must respond with a single valid JSON object only. " +
+	"Do not wrap it in markdown code fences and do not add any explanation before or after it."
+
+// applyResponseFormat 将 response_format 应用到 Anthropic 请求
+func applyResponseFormat(req *types.AnthropicRequest, format *types.OpenAIResponseFormat) {
+	if format == nil {
+		return
+	}
+
+	switch strings.ToLower(format.Type) {
+	case "", "text":
+		return
+	case "json_object":
+		appendSystemInstruction(req, jsonObjectInstruction)
+	case "json_schema":
+		applyJSONSchemaFormat(req, format.JSONSchema)
+	default:
+		logger.Warn("不支持的 response_format 类型，已忽略",
+			logger.String("type", format.Type))
+	}
+}
+
+// applyJSONSchemaFormat 注入结构化输出合成工具
+// 用户自带工具或启用 thinking 时不强制 tool_choice（thinking 模式只允许 auto），仅通过系统提示引导
+func applyJSONSchemaFormat(req *types.AnthropicRequest, jsonSchema *types.OpenAIJSONSchema) {
+	if jsonSchema == nil || jsonSchema.Schema == nil {
+		// 没有 schema 时退化为 json_object
+		appendSystemInstruction(req, jsonObjectInstruction)
+		return
+	}
+
+	schema, err := cleanAndValidateToolParameters(jsonSchema.Schema)
+	if err != nil {
+		logger.Warn("response_format schema 无效，退化为 json_object",
+			logger.String("schema_name", jsonSchema.Name),
+			logger.Err(err))
+		appendSystemInstruction(req, jsonObjectInstruction)
+		return
+	}
+
+	description := jsonSchema.Description
+	if description == "" {
+		description = "Return the final answer as structured data matching the schema"
+	}
+	if jsonSchema.Name != "" {
+		description = fmt.Sprintf("%s (schema: %s)", description, jsonSchema.Name)
+	}
+
+	req.Tools = append(req.Tools, types.AnthropicTool{
+		Name:        StructuredOutputToolName,
+		Description: truncateToolDescription(description, StructuredOutputToolName),
+		InputSchema: schema,
+	})
+
+	appendSystemInstruction(req, fmt.Sprintf(
+		"When you have the final answer, you must call the `%s` tool exactly once with the answer as its input. "+
+			"Do not write the answer as plain text.", StructuredOutputToolName))
+
+	if len(req.Tools) == 1 && (req.Thinking == nil || !req.Thinking.IsEnabled()) {
+		req.ToolChoice = &types.ToolChoice{Type: "tool", Name: StructuredOutputToolName}
+	}
+}
+
+// appendSystemInstruction 追加系统提示
+func appendSystemInstruction(req *types.AnthropicRequest, instruction string) {
+	req.System = append(req.System, types.AnthropicSystemMessage{
+		Type: "text",
+		Text: instruction,
+	})
+}
+
+// IsStructuredOutputRequest 判断请求是否注入了结构化输出合成工具
+func IsStructuredOutputRequest(req types.AnthropicRequest) bool {
+	for _, tool := range req.Tools {
+		if tool.Name == StructuredOutputToolName {
+			return true
+		}
+	}
+	return false
+}
+
+// UnwrapStructuredOutput 将结构化输出合成工具的调用还原为消息内容
+// 工具参数即为最终 JSON，finish_reason 设为 stop；其余工具调用保持不变
+func UnwrapStructuredOutput(resp *types.OpenAIResponse) {
+	for i := range resp.Choices {
+		choice := &resp.Choices[i]
+
+		var remaining []types.OpenAIToolCall
+		var output string
+		for _, tc := range choice.Message.ToolCalls {
+			if tc.Function.Name == StructuredOutputToolName && output == "" {
+				output = tc.Function.Arguments
+				continue
+			}
+			remaining = append(remaining, tc)
+		}
+		if output == "" {
+			continue
+		}
+
+		choice.Message.Content = output
+		choice.Message.ToolCalls = remaining
+		if len(remaining) == 0 {
+			choice.FinishReason = "stop"
+		}
+	}
+}
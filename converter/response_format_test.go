@@ -0,0 +1,99 @@
+package converter
+
+import (
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvertOpenAIToAnthropic_ResponseFormatJSONObject(t *testing.T) {
+	openaiReq := types.OpenAIRequest{
+		Model:          "claude-sonnet-4",
+		Messages:       []types.OpenAIMessage{{Role: "user", Content: "列出三种水果"}},
+		ResponseFormat: &types.OpenAIResponseFormat{Type: "json_object"},
+	}
+
+	anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+
+	require.Len(t, anthropicReq.System, 1)
+	assert.Equal(t, jsonObjectInstruction, anthropicReq.System[0].Text)
+	assert.Empty(t, anthropicReq.Tools)
+	assert.Nil(t, anthropicReq.ToolChoice)
+	assert.False(t, IsStructuredOutputRequest(anthropicReq))
+}
+
+func TestConvertOpenAIToAnthropic_ResponseFormatJSONSchema(t *testing.T) {
+	openaiReq := types.OpenAIRequest{
+		Model:    "claude-sonnet-4",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "北京天气"}},
+		ResponseFormat: &types.OpenAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: &types.OpenAIJSONSchema{
+				Name: "weather",
+				Schema: map[string]any{
+					"type": "object",
+					"properties": map[string]any{
+						"city": map[string]any{"type": "string"},
+						"temp": map[string]any{"type": "number"},
+					},
+					"required": []any{"city", "temp"},
+				},
+			},
+		},
+	}
+
+	anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+
+	require.Len(t, anthropicReq.Tools, 1)
+	assert.Equal(t, StructuredOutputToolName, anthropicReq.Tools[0].Name)
+	assert.Contains(t, anthropicReq.Tools[0].InputSchema, "properties")
+	assert.Equal(t, &types.ToolChoice{Type: "tool", Name: StructuredOutputToolName}, anthropicReq.ToolChoice)
+	assert.NotEmpty(t, anthropicReq.System)
+	assert.True(t, IsStructuredOutputRequest(anthropicReq))
+}
+
+func TestConvertOpenAIToAnthropic_ResponseFormatJSONSchemaWithThinking(t *testing.T) {
+	openaiReq := types.OpenAIRequest{
+		Model:    "claude-sonnet-4-thinking",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "hi"}},
+		ResponseFormat: &types.OpenAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: &types.OpenAIJSONSchema{
+				Name:   "answer",
+				Schema: map[string]any{"type": "object", "properties": map[string]any{}},
+			},
+		},
+	}
+
+	anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+
+	// thinking 模式只允许 auto，不能强制 tool_choice
+	assert.True(t, IsStructuredOutputRequest(anthropicReq))
+	assert.Nil(t, anthropicReq.ToolChoice)
+}
+
+func TestUnwrapStructuredOutput(t *testing.T) {
+	anthropicResp := map[string]any{
+		"content": []any{
+			map[string]any{"type": "text", "text": "好的"},
+			map[string]any{
+				"type":  "tool_use",
+				"id":    "toolu_1",
+				"name":  StructuredOutputToolName,
+				"input": map[string]any{"city": "北京"},
+			},
+		},
+	}
+
+	resp := ConvertAnthropicToOpenAI(anthropicResp, types.AnthropicRequest{Model: "claude-sonnet-4"}, "chatcmpl-1")
+	require.Equal(t, "tool_calls", resp.Choices[0].FinishReason)
+
+	UnwrapStructuredOutput(&resp)
+
+	assert.Equal(t, "stop", resp.Choices[0].FinishReason)
+	assert.Empty(t, resp.Choices[0].Message.ToolCalls)
+	assert.JSONEq(t, `{"city":"北京"}`, resp.Choices[0].Message.Content.(string))
+}
@@ -0,0 +1,49 @@
+package converter
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SkipDefaultSystemPromptHeader 请求头为 true 时不注入 DEFAULT_SYSTEM_PROMPT
+// 仅对 DEFAULT_SYSTEM_PROMPT_SKIP_CLIENTS 中的客户端token生效，其他调用方发送该请求头会被忽略
+const SkipDefaultSystemPromptHeader = "X-Kiro-Skip-System-Prompt"
+
+// clientTokenIDContextKey 认证中间件写入的客户端token标识（与 server 包中的同名键一致）
+const clientTokenIDContextKey = "client_token_id"
+
+// ApplyDefaultSystemPrompt 将 DEFAULT_SYSTEM_PROMPT 作为第一个 system 块注入请求
+// 位于客户端提供的 system 块之前（thinking 前缀仍在最前面）；每个请求只注入一次，
+// 服务端在估算输入token前调用，使默认提示计入 token 统计
+func ApplyDefaultSystemPrompt(req *types.AnthropicRequest, c *gin.Context) {
+	if req.DefaultSystemPromptApplied {
+		return
+	}
+	req.DefaultSystemPromptApplied = true
+
+	prompt := config.DefaultSystemPrompt()
+	if prompt == "" {
+		return
+	}
+	if c != nil && c.Request != nil {
+		if skip, _ := strconv.ParseBool(strings.TrimSpace(c.GetHeader(SkipDefaultSystemPromptHeader))); skip {
+			clientTokenID := c.GetString(clientTokenIDContextKey)
+			if clientTokenID != "" && slices.Contains(config.DefaultSystemPromptSkipClients, clientTokenID) {
+				logger.Debug("请求头要求跳过默认系统提示",
+					logger.String("client_token_id", clientTokenID))
+				return
+			}
+			logger.Warn("客户端无权跳过默认系统提示，忽略请求头",
+				logger.String("client_token_id", clientTokenID))
+		}
+	}
+
+	req.System = append([]types.AnthropicSystemMessage{{Type: "text", Text: prompt}}, req.System...)
+}
@@ -0,0 +1,81 @@
+package converter
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newSystemPromptTestContext(skipHeader string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	if skipHeader != "" {
+		c.Request.Header.Set(SkipDefaultSystemPromptHeader, skipHeader)
+	}
+	c.Set(clientTokenIDContextKey, "client:trusted")
+	return c
+}
+
+func setDefaultSystemPromptSkipClients(t *testing.T, clients ...string) {
+	t.Helper()
+	orig := config.DefaultSystemPromptSkipClients
+	config.DefaultSystemPromptSkipClients = clients
+	t.Cleanup(func() { config.DefaultSystemPromptSkipClients = orig })
+}
+
+func TestApplyDefaultSystemPrompt_PrependsOnce(t *testing.T) {
+	config.SetDefaultSystemPrompt("house rules")
+	t.Cleanup(func() { config.SetDefaultSystemPrompt("") })
+
+	req := types.AnthropicRequest{System: []types.AnthropicSystemMessage{{Type: "text", Text: "client system"}}}
+	c := newSystemPromptTestContext("")
+
+	ApplyDefaultSystemPrompt(&req, c)
+	ApplyDefaultSystemPrompt(&req, c)
+
+	if len(req.System) != 2 {
+		t.Fatalf("期望注入一次后共 2 个 system 块，实际 %d", len(req.System))
+	}
+	if req.System[0].Text != "house rules" || req.System[1].Text != "client system" {
+		t.Errorf("默认提示应位于客户端 system 之前，实际 %+v", req.System)
+	}
+}
+
+func TestApplyDefaultSystemPrompt_SkipHeader(t *testing.T) {
+	config.SetDefaultSystemPrompt("house rules")
+	t.Cleanup(func() { config.SetDefaultSystemPrompt("") })
+	setDefaultSystemPromptSkipClients(t, "client:trusted")
+
+	req := types.AnthropicRequest{}
+	ApplyDefaultSystemPrompt(&req, newSystemPromptTestContext("true"))
+
+	if len(req.System) != 0 {
+		t.Errorf("请求头要求跳过时不应注入，实际 %+v", req.System)
+	}
+}
+
+func TestApplyDefaultSystemPrompt_SkipHeaderIgnoredForUntrustedClient(t *testing.T) {
+	config.SetDefaultSystemPrompt("house rules")
+	t.Cleanup(func() { config.SetDefaultSystemPrompt("") })
+
+	// 未配置白名单：任何客户端都不能跳过
+	setDefaultSystemPromptSkipClients(t)
+	req := types.AnthropicRequest{}
+	ApplyDefaultSystemPrompt(&req, newSystemPromptTestContext("true"))
+	if len(req.System) != 1 || req.System[0].Text != "house rules" {
+		t.Errorf("未授权的客户端不应跳过默认提示，实际 %+v", req.System)
+	}
+
+	// 白名单中不包含该客户端
+	setDefaultSystemPromptSkipClients(t, "client:other")
+	req = types.AnthropicRequest{}
+	ApplyDefaultSystemPrompt(&req, newSystemPromptTestContext("true"))
+	if len(req.System) != 1 {
+		t.Errorf("不在白名单中的客户端不应跳过默认提示，实际 %+v", req.System)
+	}
+}
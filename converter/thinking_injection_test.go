@@ -116,3 +116,67 @@ func TestHasThinkingTags(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalizeThinkingBudget_ModelMax(t *testing.T) {
+	thinking := &types.Thinking{Type: "enabled", BudgetTokens: 24000}
+
+	if got := normalizeThinkingBudget("claude-sonnet-4-6", thinking); got != 24000 {
+		t.Errorf("sonnet budget = %d, want 24000", got)
+	}
+	// haiku 上限低于全局上限
+	if got := normalizeThinkingBudget("claude-haiku-4-5-20251001", thinking); got != 16384 {
+		t.Errorf("haiku budget = %d, want 16384", got)
+	}
+}
+
+func TestApplyThinkingModelSuffix(t *testing.T) {
+	req := types.AnthropicRequest{Model: "claude-sonnet-4-5-thinking", MaxTokens: 1000}
+	if !ApplyThinkingModelSuffix(&req) {
+		t.Fatal("应识别 -thinking 后缀")
+	}
+	if req.Model != "claude-sonnet-4-5" || req.Thinking == nil || req.Thinking.Type != "enabled" {
+		t.Fatalf("后缀应开启 thinking: %+v", req)
+	}
+	if req.MaxTokens <= req.Thinking.BudgetTokens {
+		t.Errorf("max_tokens = %d 应大于 budget_tokens = %d", req.MaxTokens, req.Thinking.BudgetTokens)
+	}
+
+	// 请求已自带 thinking 配置时保留原配置，不叠加默认配置
+	own := &types.Thinking{Type: "enabled", BudgetTokens: 2048}
+	req = types.AnthropicRequest{Model: "claude-sonnet-4-5-thinking", MaxTokens: 4096, Thinking: own}
+	ApplyThinkingModelSuffix(&req)
+	if req.Thinking != own || req.MaxTokens != 4096 || req.Model != "claude-sonnet-4-5" {
+		t.Errorf("已有 thinking 配置不应被覆盖: %+v", req)
+	}
+
+	req = types.AnthropicRequest{Model: "claude-sonnet-4-5"}
+	if ApplyThinkingModelSuffix(&req) || req.Thinking != nil {
+		t.Error("无后缀时不应修改请求")
+	}
+}
+
+func TestRequestThinkingBudget_Interleaved(t *testing.T) {
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4-6",
+		MaxTokens: 2000,
+		Thinking:  &types.Thinking{Type: "enabled", BudgetTokens: 4096},
+	}
+	if got := requestThinkingBudget(req); got != 4096 {
+		t.Errorf("未启用 interleaved-thinking 时 budget = %d, want 4096", got)
+	}
+
+	// interleaved-thinking：预算按整轮计算，单次请求截断到 max_tokens 以内
+	req.InterleavedThinking = true
+	if got := requestThinkingBudget(req); got != 1999 {
+		t.Errorf("interleaved budget = %d, want 1999", got)
+	}
+	if prefix := generateThinkingPrefixWithRequest(req); prefix != "<thinking_mode>enabled</thinking_mode><max_thinking_length>1999</max_thinking_length>" {
+		t.Errorf("prefix = %q", prefix)
+	}
+
+	// 不低于最小预算
+	req.MaxTokens = 512
+	if got := requestThinkingBudget(req); got != 1024 {
+		t.Errorf("interleaved budget = %d, want 1024", got)
+	}
+}
@@ -0,0 +1,48 @@
+package converter
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func forcedToolThinkingRequest() types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 8192,
+		Thinking:  &types.Thinking{Type: "enabled", BudgetTokens: 2048},
+		Tools: []types.AnthropicTool{{
+			Name:        "get_weather",
+			InputSchema: map[string]any{"type": "object", "properties": map[string]any{}},
+		}},
+		ToolChoice: &types.ToolChoice{Type: "tool", Name: "get_weather"},
+		Messages:   []types.AnthropicRequestMessage{{Role: "user", Content: "weather?"}},
+	}
+}
+
+func TestBuildCodeWhispererRequest_ThinkingToolChoiceAutoDowngrade(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	orig := config.ThinkingToolChoiceAutoDowngrade
+	t.Cleanup(func() { config.ThinkingToolChoiceAutoDowngrade = orig })
+
+	config.ThinkingToolChoiceAutoDowngrade = false
+	if _, err := BuildCodeWhispererRequest(forcedToolThinkingRequest(), c); err == nil {
+		t.Fatal("未开启降级时强制 tool_choice 应返回错误")
+	}
+
+	config.ThinkingToolChoiceAutoDowngrade = true
+	cwReq, err := BuildCodeWhispererRequest(forcedToolThinkingRequest(), c)
+	if err != nil {
+		t.Fatalf("开启降级后不应返回错误: %v", err)
+	}
+	if cwReq.InferenceConfiguration == nil || cwReq.InferenceConfiguration.Thinking == nil {
+		t.Fatal("降级后仍应保留 thinking 配置")
+	}
+}
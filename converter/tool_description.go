@@ -0,0 +1,65 @@
+package converter
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+)
+
+// 工具描述截断策略（TOOL_DESC_TRUNCATE_STRATEGY）
+const (
+	ToolDescTruncateEnd        = "truncate-end"
+	ToolDescTruncateMiddle     = "truncate-middle"
+	ToolDescSummarizeFirstLine = "summarize-first-line"
+)
+
+// toolDescMiddleMarker truncate-middle 策略在开头与结尾之间插入的省略标记
+const toolDescMiddleMarker = "\n...\n"
+
+// truncateToolDescriptionByStrategy 按 TOOL_DESC_TRUNCATE_STRATEGY 将描述截断到 maxLen 字节以内
+// 未知策略按 truncate-end 处理
+func truncateToolDescriptionByStrategy(description string, maxLen int) string {
+	if len(description) <= maxLen {
+		return description
+	}
+
+	switch config.ToolDescTruncateStrategy {
+	case ToolDescTruncateMiddle:
+		return truncateUTF8Middle(description, maxLen)
+	case ToolDescSummarizeFirstLine:
+		return utils.TruncateUTF8WithEllipsis(firstNonEmptyLine(description), maxLen)
+	case ToolDescTruncateEnd, "":
+	default:
+		logger.Warn("未知的工具描述截断策略，使用 truncate-end",
+			logger.String("strategy", config.ToolDescTruncateStrategy))
+	}
+	return utils.TruncateUTF8WithEllipsis(description, maxLen)
+}
+
+// truncateUTF8Middle 保留开头与结尾各约一半，中间替换为省略标记（不在多字节字符中间截断）
+func truncateUTF8Middle(s string, maxBytes int) string {
+	budget := maxBytes - len(toolDescMiddleMarker)
+	if budget <= 0 {
+		return utils.TruncateUTF8WithEllipsis(s, maxBytes)
+	}
+
+	head := utils.TruncateUTF8(s, budget-budget/2)
+	tailStart := len(s) - budget/2
+	for tailStart < len(s) && !utf8.RuneStart(s[tailStart]) {
+		tailStart++
+	}
+	return head + toolDescMiddleMarker + s[tailStart:]
+}
+
+// firstNonEmptyLine 返回第一行非空内容（去除首尾空白）
+func firstNonEmptyLine(s string) string {
+	for line := range strings.SplitSeq(s, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			return trimmed
+		}
+	}
+	return ""
+}
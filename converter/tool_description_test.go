@@ -0,0 +1,53 @@
+package converter
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"kiro2api/config"
+)
+
+func withToolDescStrategy(t *testing.T, strategy string) {
+	t.Helper()
+	orig := config.ToolDescTruncateStrategy
+	config.ToolDescTruncateStrategy = strategy
+	t.Cleanup(func() { config.ToolDescTruncateStrategy = orig })
+}
+
+func TestTruncateToolDescriptionByStrategy(t *testing.T) {
+	description := "Search the codebase.\n" + strings.Repeat("详细说明 ", 40) + "\nExample: search(\"foo\")"
+
+	withToolDescStrategy(t, ToolDescTruncateEnd)
+	if got := truncateToolDescriptionByStrategy(description, 60); len(got) > 60 || !strings.HasPrefix(got, "Search the codebase.") || !strings.HasSuffix(got, "...") {
+		t.Errorf("truncate-end 结果不符: %q", got)
+	}
+
+	withToolDescStrategy(t, ToolDescTruncateMiddle)
+	got := truncateToolDescriptionByStrategy(description, 60)
+	if len(got) > 60 || !utf8.ValidString(got) {
+		t.Errorf("truncate-middle 超出长度或不是合法 UTF-8: %q", got)
+	}
+	if !strings.HasPrefix(got, "Search the codebase.") || !strings.HasSuffix(got, "Example: search(\"foo\")") || !strings.Contains(got, toolDescMiddleMarker) {
+		t.Errorf("truncate-middle 应保留开头与结尾: %q", got)
+	}
+
+	withToolDescStrategy(t, ToolDescSummarizeFirstLine)
+	if got := truncateToolDescriptionByStrategy("\n  "+description, 60); got != "Search the codebase." {
+		t.Errorf("summarize-first-line 应只保留第一行非空内容，实际 %q", got)
+	}
+
+	if got := truncateToolDescriptionByStrategy("short", 60); got != "short" {
+		t.Errorf("未超长的描述不应截断，实际 %q", got)
+	}
+}
+
+func TestTruncateUTF8Middle_MultiByteBoundaries(t *testing.T) {
+	s := strings.Repeat("汉字", 50)
+	for maxBytes := 1; maxBytes <= 40; maxBytes++ {
+		got := truncateUTF8Middle(s, maxBytes)
+		if len(got) > maxBytes || !utf8.ValidString(got) {
+			t.Fatalf("maxBytes=%d 结果不合法: %q", maxBytes, got)
+		}
+	}
+}
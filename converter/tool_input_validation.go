@@ -0,0 +1,211 @@
+package converter
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+)
+
+// ToolInputError 历史 tool_use 的 input 不符合对应工具 input_schema
+type ToolInputError struct {
+	MessageIndex int
+	BlockIndex   int
+	Tool         string
+	Field        string
+	Reason       string
+}
+
+// Path 返回与官方 API 一致的字段路径（如 messages.1.content.0.input.path）
+func (e *ToolInputError) Path() string {
+	path := fmt.Sprintf("messages.%d.content.%d.input", e.MessageIndex, e.BlockIndex)
+	if e.Field != "" {
+		path += "." + e.Field
+	}
+	return path
+}
+
+func (e *ToolInputError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("工具 %q 的 input %s", e.Tool, e.Reason)
+	}
+	return fmt.Sprintf("工具 %q 的参数 %q %s", e.Tool, e.Field, e.Reason)
+}
+
+// ValidateToolInputs 按工具声明的 input_schema 检查历史消息中 tool_use 的 input（VALIDATE_TOOL_INPUTS=true 时启用）
+// 只检查顶层参数：必填参数必须存在，已声明类型的参数类型须大致匹配；
+// 可无损转换的值（如 "3" -> 3、"true" -> true、数字 -> 字符串）原地修正，否则返回第一个错误
+// 未在 tools 中声明的工具不检查
+func ValidateToolInputs(req *types.AnthropicRequest) *ToolInputError {
+	if !config.ValidateToolInputs || len(req.Tools) == 0 {
+		return nil
+	}
+
+	schemas := make(map[string]map[string]any, len(req.Tools))
+	for _, tool := range req.Tools {
+		if tool.InputSchema != nil {
+			schemas[tool.Name] = tool.InputSchema
+		}
+	}
+
+	for i, msg := range req.Messages {
+		if msg.Role != "assistant" {
+			continue
+		}
+		blocks, ok := msg.Content.([]any)
+		if !ok {
+			continue
+		}
+		for j, item := range blocks {
+			block, ok := item.(map[string]any)
+			if !ok || block["type"] != "tool_use" {
+				continue
+			}
+			name, _ := block["name"].(string)
+			schema, declared := schemas[name]
+			if !declared {
+				continue
+			}
+
+			input, ok := block["input"].(map[string]any)
+			if !ok {
+				if block["input"] != nil {
+					return &ToolInputError{MessageIndex: i, BlockIndex: j, Tool: name, Reason: "必须为对象"}
+				}
+				input = map[string]any{}
+			}
+			if field, reason := validateToolInputAgainstSchema(name, input, schema); reason != "" {
+				return &ToolInputError{MessageIndex: i, BlockIndex: j, Tool: name, Field: field, Reason: reason}
+			}
+		}
+	}
+	return nil
+}
+
+// validateToolInputAgainstSchema 检查并修正单个 tool_use 的 input，返回出错的参数名与原因
+func validateToolInputAgainstSchema(toolName string, input map[string]any, schema map[string]any) (string, string) {
+	if required, ok := schema["required"].([]any); ok {
+		for _, item := range required {
+			field, _ := item.(string)
+			if value, exists := input[field]; field != "" && (!exists || value == nil) {
+				return field, "缺少必填参数"
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	fields := make([]string, 0, len(properties))
+	for field := range properties {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	for _, field := range fields {
+		value, exists := input[field]
+		if !exists || value == nil {
+			continue
+		}
+		prop, _ := properties[field].(map[string]any)
+		expected, _ := prop["type"].(string)
+		if expected == "" {
+			// 未声明类型或声明了多种类型（数组形式）时不检查
+			continue
+		}
+
+		coerced, ok := coerceToolInputValue(value, expected)
+		if !ok {
+			return field, fmt.Sprintf("类型应为 %s，当前为 %s", expected, jsonTypeName(value))
+		}
+		if coerced != nil {
+			logger.Debug("已修正工具参数类型",
+				logger.String("tool", toolName),
+				logger.String("field", field),
+				logger.String("expected_type", expected),
+				logger.String("actual_type", jsonTypeName(value)))
+			input[field] = coerced
+		}
+	}
+	return "", ""
+}
+
+// coerceToolInputValue 判断值是否符合期望的 JSON Schema 类型
+// 返回 (nil, true) 表示已符合；(新值, true) 表示可以转换；(nil, false) 表示类型不符
+func coerceToolInputValue(value any, expected string) (any, bool) {
+	switch expected {
+	case "string":
+		switch v := value.(type) {
+		case string:
+			return nil, true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		case bool:
+			return strconv.FormatBool(v), true
+		}
+	case "number":
+		switch v := value.(type) {
+		case float64:
+			return nil, true
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, true
+			}
+		}
+	case "integer":
+		switch v := value.(type) {
+		case float64:
+			if v == math.Trunc(v) {
+				return nil, true
+			}
+		case string:
+			if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+				return float64(n), true
+			}
+		}
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return nil, true
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+				return b, true
+			}
+		}
+	case "array":
+		if _, ok := value.([]any); ok {
+			return nil, true
+		}
+	case "object":
+		if _, ok := value.(map[string]any); ok {
+			return nil, true
+		}
+	default:
+		// 未知类型不检查
+		return nil, true
+	}
+	return nil, false
+}
+
+// jsonTypeName 返回值对应的 JSON 类型名
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
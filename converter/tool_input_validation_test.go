@@ -0,0 +1,76 @@
+package converter
+
+import (
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+)
+
+func toolInputTestRequest(input map[string]any) types.AnthropicRequest {
+	return types.AnthropicRequest{
+		Tools: []types.AnthropicTool{{
+			Name: "read_file",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"path":  map[string]any{"type": "string"},
+					"limit": map[string]any{"type": "integer"},
+				},
+				"required": []any{"path"},
+			},
+		}},
+		Messages: []types.AnthropicRequestMessage{
+			{Role: "user", Content: "read it"},
+			{Role: "assistant", Content: []any{
+				map[string]any{"type": "text", "text": "ok"},
+				map[string]any{"type": "tool_use", "id": "toolu_1", "name": "read_file", "input": input},
+			}},
+		},
+	}
+}
+
+func withValidateToolInputs(t *testing.T) {
+	t.Helper()
+	orig := config.ValidateToolInputs
+	config.ValidateToolInputs = true
+	t.Cleanup(func() { config.ValidateToolInputs = orig })
+}
+
+func TestValidateToolInputs_CoercesLosslessValues(t *testing.T) {
+	withValidateToolInputs(t)
+	input := map[string]any{"path": "a.txt", "limit": "10"}
+	req := toolInputTestRequest(input)
+
+	if err := ValidateToolInputs(&req); err != nil {
+		t.Fatalf("期望修正后通过，实际错误: %v", err)
+	}
+	if input["limit"] != float64(10) {
+		t.Errorf("期望 limit 修正为 10，实际 %#v", input["limit"])
+	}
+}
+
+func TestValidateToolInputs_ReportsToolAndField(t *testing.T) {
+	withValidateToolInputs(t)
+
+	req := toolInputTestRequest(map[string]any{"limit": 5})
+	err := ValidateToolInputs(&req)
+	if err == nil || err.Tool != "read_file" || err.Field != "path" {
+		t.Fatalf("期望报告缺少 path，实际 %v", err)
+	}
+	if err.Path() != "messages.1.content.1.input.path" {
+		t.Errorf("字段路径不符: %s", err.Path())
+	}
+
+	req = toolInputTestRequest(map[string]any{"path": "a.txt", "limit": 1.5})
+	if err := ValidateToolInputs(&req); err == nil || err.Field != "limit" {
+		t.Fatalf("期望报告 limit 类型错误，实际 %v", err)
+	}
+}
+
+func TestValidateToolInputs_DisabledByDefault(t *testing.T) {
+	req := toolInputTestRequest(map[string]any{})
+	if err := ValidateToolInputs(&req); err != nil {
+		t.Errorf("未启用时不应检查，实际错误: %v", err)
+	}
+}
@@ -51,7 +51,7 @@ func ValidateAndProcessToolsWithMapping(tools []types.OpenAITool) (*types.Conver
 		}
 
 		// web_search 是服务端工具：不发送到上游（但也不报错）
-		if tool.Function.Name == "web_search" || tool.Function.Name == "websearch" {
+		if IsWebSearchToolName(tool.Function.Name) {
 			continue
 		}
 
@@ -111,14 +111,15 @@ func truncateToolDescription(description string, toolName string) string {
 
 	// 修复: 使用安全的 UTF-8 截断，避免在多字节字符中间截断
 	// 参考: kiro.rs 2026.1.2 - 修复 UTF-8 字符串截断可能导致 panic 的问题
-	truncatedDesc := utils.TruncateUTF8WithEllipsis(description, maxLen)
+	truncatedDesc := truncateToolDescriptionByStrategy(description, maxLen)
 
 	// 记录警告日志，帮助用户了解哪个工具的描述被截断
 	logger.Warn("工具描述被截断",
 		logger.String("tool_name", toolName),
 		logger.Int("original_length", len(description)),
 		logger.Int("truncated_length", len(truncatedDesc)),
-		logger.Int("max_allowed", maxLen))
+		logger.Int("max_allowed", maxLen),
+		logger.String("strategy", config.ToolDescTruncateStrategy))
 
 	return truncatedDesc
 }
@@ -308,6 +309,46 @@ func cleanAndValidateToolParametersWithMapping(params map[string]any, toolName s
 	return tempParams, paramMapping, nil
 }
 
+// RestoreToolParamNames 将工具调用参数中被截断的参数名还原为客户端声明的原始参数名
+// 截断只发生在顶级 properties，因此只需处理顶级键；无映射时原样返回
+func RestoreToolParamNames(mappings types.ToolParamMappings, toolName string, input map[string]any) map[string]any {
+	mapping := mappings[toolName]
+	if len(mapping) == 0 || len(input) == 0 {
+		return input
+	}
+
+	restored := make(map[string]any, len(input))
+	for key, value := range input {
+		if originalName, ok := mapping[key]; ok {
+			key = originalName
+		}
+		restored[key] = value
+	}
+	return restored
+}
+
+// RestoreToolParamNamesJSON 对JSON字符串形式的工具参数还原参数名
+// 解析失败时返回原始字符串，避免丢失上游输出
+func RestoreToolParamNamesJSON(mappings types.ToolParamMappings, toolName string, arguments string) string {
+	if len(mappings[toolName]) == 0 {
+		return arguments
+	}
+
+	var input map[string]any
+	if err := utils.SafeUnmarshal([]byte(arguments), &input); err != nil {
+		logger.Warn("工具参数解析失败，无法还原参数名",
+			logger.String("tool", toolName),
+			logger.Err(err))
+		return arguments
+	}
+
+	restored, err := utils.SafeMarshal(RestoreToolParamNames(mappings, toolName, input))
+	if err != nil {
+		return arguments
+	}
+	return string(restored)
+}
+
 // convertOpenAIToolChoiceToAnthropic 将OpenAI的tool_choice转换为Anthropic格式
 // 参考server.py中的转换逻辑以及Anthropic官方文档
 func convertOpenAIToolChoiceToAnthropic(openaiToolChoice any) any {
@@ -1,6 +1,7 @@
 package converter
 
 import (
+	"strings"
 	"testing"
 
 	"kiro2api/types"
@@ -503,3 +504,41 @@ func TestConvertOpenAIContentToAnthropic_FilterWebSearchVariantInHistory(t *test
 	assert.True(t, ok)
 	assert.Equal(t, "text", block2["type"])
 }
+
+func TestConvertOpenAIToAnthropic_RestoresTruncatedParamNames(t *testing.T) {
+	longName := strings.Repeat("very_long_parameter_name_", 4)
+	openaiReq := types.OpenAIRequest{
+		Model:    "claude-sonnet-4",
+		Messages: []types.OpenAIMessage{{Role: "user", Content: "hi"}},
+		Tools: []types.OpenAITool{
+			{
+				Type: "function",
+				Function: types.OpenAIFunction{
+					Name: "search",
+					Parameters: map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							longName: map[string]any{"type": "string"},
+							"query":  map[string]any{"type": "string"},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	anthropicReq := ConvertOpenAIToAnthropic(openaiReq)
+	truncated := truncateParamName(longName)
+	assert.NotEqual(t, longName, truncated)
+	assert.Equal(t, longName, anthropicReq.ToolParamMappings["search"][truncated])
+
+	restored := RestoreToolParamNames(anthropicReq.ToolParamMappings, "search", map[string]any{truncated: "a", "query": "b"})
+	assert.Equal(t, map[string]any{longName: "a", "query": "b"}, restored)
+
+	restoredJSON := RestoreToolParamNamesJSON(anthropicReq.ToolParamMappings, "search", `{"`+truncated+`":"a","query":"b"}`)
+	assert.JSONEq(t, `{"`+longName+`":"a","query":"b"}`, restoredJSON)
+
+	// 无映射的工具与无法解析的参数保持原样
+	assert.Equal(t, `{"x":1}`, RestoreToolParamNamesJSON(anthropicReq.ToolParamMappings, "other", `{"x":1}`))
+	assert.Equal(t, `{"broken`, RestoreToolParamNamesJSON(anthropicReq.ToolParamMappings, "search", `{"broken`))
+}
@@ -157,18 +157,28 @@ func (l *Logger) log(level Level, msg string, fields []Field) {
 	if !l.shouldLog(level) {
 		return
 	}
+	l.write(levelNames[level], msg, fields, l.enableCaller)
 
+	// Fatal级别退出程序
+	if level == FATAL {
+		os.Exit(1)
+	}
+}
+
+// write 构建并输出一条日志（不做级别过滤）
+func (l *Logger) write(levelName string, msg string, fields []Field, withCaller bool) {
 	// 构建标准日志条目
 	entry := &LogEntry{
 		Timestamp: time.Now().Format("2006-01-02T15:04:05.000Z07:00"),
-		Level:     levelNames[level],
+		Level:     levelName,
 		Message:   msg,
 		Fields:    make(map[string]any),
 	}
 
 	// 按需获取调用者信息（优化：可配置）
-	if l.enableCaller {
-		if pc, file, line, ok := runtime.Caller(l.callerSkip); ok {
+	if withCaller {
+		// +1：跳过 write 本身
+		if pc, file, line, ok := runtime.Caller(l.callerSkip + 1); ok {
 			if idx := strings.LastIndex(file, "/"); idx >= 0 {
 				file = file[idx+1:]
 			}
@@ -202,11 +212,6 @@ func (l *Logger) log(level Level, msg string, fields []Field) {
 
 	// 直接输出日志 - log.Logger本身已经线程安全！
 	l.logger.Println(string(jsonData))
-
-	// Fatal级别退出程序
-	if level == FATAL {
-		os.Exit(1)
-	}
 }
 
 // marshalLogEntry 自定义日志条目序列化，确保字段顺序（使用对象池优化）
@@ -296,6 +301,11 @@ func Fatal(msg string, fields ...Field) {
 	defaultLogger.log(FATAL, msg, fields)
 }
 
+// Access 输出访问日志（level 为 ACCESS），不受 LOG_LEVEL 过滤，是否输出由调用方决定
+func Access(msg string, fields ...Field) {
+	defaultLogger.write("ACCESS", msg, fields, false)
+}
+
 // 字段构造函数
 func String(key, val string) Field {
 	return Field{Key: key, Value: val}
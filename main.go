@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"kiro2api/auth"
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/server"
 	"path/filepath"
@@ -27,6 +28,11 @@ func main() {
 		logger.String("config_level", os.Getenv("LOG_LEVEL")),
 		logger.String("config_file", os.Getenv("LOG_FILE")))
 
+	// 加载自定义模型别名（MODEL_ALIASES）
+	initModelAliases()
+	initDefaultSystemPrompt()
+	initCodeWhispererEndpoint()
+
 	// 初始化代理池（如果配置了代理）
 	initProxyPool()
 
@@ -48,6 +54,13 @@ func main() {
 	// 设置全局引用，供 OAuth token 重载使用
 	auth.SetGlobalAuthService(authService)
 
+	// 监听账户文件变化，自动导入新账户并重载token池
+	if config.AccountsWatchEnabled {
+		if err := authService.WatchAccounts(".", config.AccountsWatchDebounce); err != nil {
+			logger.Warn("启动账户文件热加载失败", logger.Err(err))
+		}
+	}
+
 	port := "8080" // 默认端口
 	if len(os.Args) > 1 {
 		port = os.Args[1]
@@ -57,25 +70,74 @@ func main() {
 		port = envPort
 	}
 
-	// 从环境变量获取客户端认证token
-	clientToken := os.Getenv("KIRO_CLIENT_TOKEN")
-	if clientToken == "" {
+	// 从环境变量获取客户端认证token（KIRO_CLIENT_TOKEN、KIRO_CLIENT_TOKENS 与 KIRO_CLIENT_TOKENS_FILE 合并生效）
+	clientTokens, err := config.ReadClientTokens()
+	if err != nil {
+		logger.Error("致命错误: 读取 KIRO_CLIENT_TOKENS_FILE 失败", logger.Err(err))
+		os.Exit(1)
+	}
+	if len(clientTokens) == 0 {
 		// OAuth 模式下允许使用默认值
 		if auth.IsOAuthEnabled() {
-			clientToken = "oauth-mode-default"
+			clientTokens = []string{"oauth-mode-default"}
 			logger.Warn("OAuth模式: 使用默认KIRO_CLIENT_TOKEN，建议设置自定义密码")
 		} else {
-			logger.Error("致命错误: 未设置 KIRO_CLIENT_TOKEN 环境变量")
+			logger.Error("致命错误: 未设置 KIRO_CLIENT_TOKEN、KIRO_CLIENT_TOKENS 或 KIRO_CLIENT_TOKENS_FILE 环境变量")
 			logger.Error("请在 .env 文件中设置强密码，例如: KIRO_CLIENT_TOKEN=your-secure-random-password")
 			logger.Error("安全提示: 请使用至少32字符的随机字符串")
 			os.Exit(1)
 		}
 	}
+	config.SetClientTokens(clientTokens)
+	if len(clientTokens) > 1 {
+		logger.Info("已加载多个客户端token", logger.Int("count", len(clientTokens)))
+	}
 
-	server.StartServer(port, clientToken, authService)
+	server.StartServer(port, authService)
 }
 
 
+// initModelAliases 加载自定义模型别名，并输出生效的别名表便于核对
+func initModelAliases() {
+	aliases, err := config.LoadModelAliases()
+	if err != nil {
+		logger.Error("加载模型别名失败，自定义别名未生效", logger.Err(err))
+		return
+	}
+	if len(aliases) == 0 {
+		logger.Debug("未配置模型别名")
+		return
+	}
+	logger.Info("模型别名已加载",
+		logger.Int("count", len(aliases)),
+		logger.Any("aliases", aliases))
+}
+
+// initDefaultSystemPrompt 加载默认系统提示（DEFAULT_SYSTEM_PROMPT）
+func initDefaultSystemPrompt() {
+	prompt, err := config.LoadDefaultSystemPrompt()
+	if err != nil {
+		logger.Error("加载默认系统提示失败，未生效", logger.Err(err))
+		return
+	}
+	if prompt != "" {
+		logger.Info("默认系统提示已加载", logger.Int("length", len(prompt)))
+	}
+}
+
+// initCodeWhispererEndpoint 加载上游端点覆盖（CODEWHISPERER_URL / CODEWHISPERER_HOST）并输出生效的端点
+// 覆盖值不合法时直接退出，避免请求被静默发往默认端点
+func initCodeWhispererEndpoint() {
+	if err := config.LoadCodeWhispererEndpoint(); err != nil {
+		logger.Error("上游端点配置无效", logger.Err(err))
+		os.Exit(1)
+	}
+	logger.Info("上游端点",
+		logger.String("url", config.GetCodeWhispererURL()),
+		logger.String("host", config.GetCodeWhispererHost()),
+		logger.String("usage_limits_url", config.GetUsageLimitsURL()))
+}
+
 // initProxyPool 初始化代理池
 func initProxyPool() {
 	proxyList := os.Getenv("PROXY_POOL")
@@ -117,7 +179,7 @@ func splitAndTrim(s string, sep string) []string {
 
 // importAccounts 扫描并导入账户文件
 func importAccounts() {
-	files, err := filepath.Glob("kiro-accounts-*.json")
+	files, err := filepath.Glob(auth.AccountsFilePattern)
 	if err != nil {
 		logger.Warn("扫描账户文件失败", logger.Err(err))
 		return
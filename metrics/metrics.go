@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prometheus 指标采集
+// 未调用 Init 时所有记录函数均为空操作，避免关闭指标时产生额外开销
+
+const namespace = "kiro2api"
+
+var (
+	enabled  atomic.Bool
+	initOnce sync.Once
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "客户端请求总数（按模型与状态码）",
+	}, []string{"model", "status_code"})
+
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "上游错误响应总数（按状态码）",
+	}, []string{"status_code"})
+
+	tokenRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_requests_total",
+		Help:      "每个 token 发出的上游请求总数",
+	}, []string{"token_key"})
+
+	streamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "stream_duration_seconds",
+		Help:      "流式响应持续时间",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"model"})
+
+	tokenPoolDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "token_pool_tokens"),
+		"token 池中各状态的 token 数量",
+		[]string{"state"}, nil,
+	)
+)
+
+// TokenPoolStats token 池状态（采集时实时读取）
+type TokenPoolStats struct {
+	Total     int
+	Active    int
+	Exhausted int
+}
+
+// tokenPoolCollector 在抓取时读取 token 池状态
+type tokenPoolCollector struct {
+	provider func() TokenPoolStats
+}
+
+func (c *tokenPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tokenPoolDesc
+}
+
+func (c *tokenPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.provider()
+	ch <- prometheus.MustNewConstMetric(tokenPoolDesc, prometheus.GaugeValue, float64(stats.Total), "total")
+	ch <- prometheus.MustNewConstMetric(tokenPoolDesc, prometheus.GaugeValue, float64(stats.Active), "active")
+	ch <- prometheus.MustNewConstMetric(tokenPoolDesc, prometheus.GaugeValue, float64(stats.Exhausted), "exhausted")
+}
+
+// Init 注册指标到默认 registry 并启用采集
+// poolProvider 可为 nil，此时不导出 token 池指标
+func Init(poolProvider func() TokenPoolStats) {
+	initOnce.Do(func() {
+		prometheus.MustRegister(requestsTotal, upstreamErrorsTotal, tokenRequestsTotal, streamDuration)
+		if poolProvider != nil {
+			prometheus.MustRegister(&tokenPoolCollector{provider: poolProvider})
+		}
+		enabled.Store(true)
+	})
+}
+
+// Enabled 是否已启用指标采集
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// Handler 返回 Prometheus 抓取端点处理器
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RecordRequest 记录一次客户端请求
+func RecordRequest(model string, statusCode int) {
+	if !enabled.Load() {
+		return
+	}
+	if model == "" {
+		model = "unknown"
+	}
+	requestsTotal.WithLabelValues(model, strconv.Itoa(statusCode)).Inc()
+}
+
+// RecordUpstreamError 记录一次上游错误响应（如 429/402/403）
+func RecordUpstreamError(statusCode int) {
+	if !enabled.Load() {
+		return
+	}
+	upstreamErrorsTotal.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+}
+
+// RecordTokenRequest 记录指定 token 发出的一次上游请求
+func RecordTokenRequest(tokenKey string) {
+	if !enabled.Load() || tokenKey == "" {
+		return
+	}
+	tokenRequestsTotal.WithLabelValues(tokenKey).Inc()
+}
+
+// ObserveStreamDuration 记录一次流式响应的持续时间
+func ObserveStreamDuration(model string, duration time.Duration) {
+	if !enabled.Load() {
+		return
+	}
+	if model == "" {
+		model = "unknown"
+	}
+	streamDuration.WithLabelValues(model).Observe(duration.Seconds())
+}
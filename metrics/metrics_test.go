@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordBeforeInitIsNoop(t *testing.T) {
+	if Enabled() {
+		t.Skip("指标已在其他测试中启用")
+	}
+	RecordUpstreamError(429)
+	if got := testutil.ToFloat64(upstreamErrorsTotal.WithLabelValues("429")); got != 0 {
+		t.Errorf("未启用时不应记录，实际 %v", got)
+	}
+}
+
+func TestMetricsExport(t *testing.T) {
+	Init(func() TokenPoolStats {
+		return TokenPoolStats{Total: 3, Active: 2, Exhausted: 1}
+	})
+
+	RecordRequest("claude-sonnet-4-5-20250929", 200)
+	RecordUpstreamError(402)
+	RecordTokenRequest("token_0")
+	ObserveStreamDuration("", 1500*time.Millisecond)
+
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues("claude-sonnet-4-5-20250929", "200")); got != 1 {
+		t.Errorf("requests_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(tokenRequestsTotal.WithLabelValues("token_0")); got != 1 {
+		t.Errorf("token_requests_total = %v, want 1", got)
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`kiro2api_upstream_errors_total{status_code="402"} 1`,
+		`kiro2api_token_pool_tokens{state="exhausted"} 1`,
+		`kiro2api_token_pool_tokens{state="active"} 2`,
+		`kiro2api_stream_duration_seconds_count{model="unknown"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("指标输出缺少 %q", want)
+		}
+	}
+}
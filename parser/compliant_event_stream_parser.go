@@ -82,6 +82,7 @@ func (cesp *CompliantEventStreamParser) ParseResponse(streamData []byte) (*Parse
 // ParseStream 解析流式数据（增量解析）
 func (cesp *CompliantEventStreamParser) ParseStream(data []byte) ([]SSEEvent, error) {
 	// 解析新的消息
+	// 解析失败次数过多时仍处理已解析的消息，并将错误返回给调用方
 	messages, err := cesp.robustParser.ParseStream(data)
 	if err != nil {
 		logger.Warn("流式解析部分失败", logger.Err(err))
@@ -100,7 +101,18 @@ func (cesp *CompliantEventStreamParser) ParseStream(data []byte) ([]SSEEvent, er
 		allEvents = append(allEvents, events...)
 	}
 
-	return allEvents, nil
+	return allEvents, err
+}
+
+// BuildResult 基于增量解析（ParseStream）累积的事件构建解析结果
+func (cesp *CompliantEventStreamParser) BuildResult(events []SSEEvent) *ParseResult {
+	return &ParseResult{
+		Events:         events,
+		ToolExecutions: cesp.messageProcessor.toolManager.GetCompletedTools(),
+		ActiveTools:    cesp.messageProcessor.toolManager.GetActiveTools(),
+		SessionInfo:    cesp.messageProcessor.sessionManager.GetSessionInfo(),
+		Summary:        cesp.generateSummary(nil, events),
+	}
 }
 
 // generateSummary 生成解析摘要
@@ -303,8 +303,10 @@ type toolUseEvent struct {
 
 // thinkingEvent 思考事件（Claude Extended Thinking）
 type thinkingEvent struct {
-	Type    string `json:"type"`    // "thinking"
-	Content string `json:"content"` // 思考内容
+	Type      string `json:"type"`                // "thinking" | "redacted_thinking"
+	Content   string `json:"content"`             // 思考内容
+	Signature string `json:"signature,omitempty"` // thinking 签名（原样透传给客户端）
+	Data      string `json:"data,omitempty"`      // redacted_thinking 的加密内容
 }
 
 // parseFullAssistantResponseEvent 解析完整的助手响应事件
@@ -41,7 +41,9 @@ func isToolCallEvent(payload []byte) bool {
 func isThinkingEvent(payload []byte) bool {
 	payloadStr := string(payload)
 	return strings.Contains(payloadStr, "\"type\":\"thinking\"") ||
-		strings.Contains(payloadStr, "\"type\": \"thinking\"")
+		strings.Contains(payloadStr, "\"type\": \"thinking\"") ||
+		strings.Contains(payloadStr, "\"type\":\"redacted_thinking\"") ||
+		strings.Contains(payloadStr, "\"type\": \"redacted_thinking\"")
 }
 
 // isStreamingResponse 检查是否为流式响应
@@ -452,8 +454,8 @@ func (h *StandardAssistantResponseEventHandler) handleLegacyFormat(payload []byt
 		return []SSEEvent{}, nil
 	}
 
-	// 检查是否是 thinking 内容块
-	if contentType, ok := data["type"].(string); ok && contentType == "thinking" {
+	// 检查是否是 thinking / redacted_thinking 内容块
+	if contentType, ok := data["type"].(string); ok && (contentType == "thinking" || contentType == "redacted_thinking") {
 		return h.handleThinkingContent(data)
 	}
 
@@ -477,19 +479,51 @@ func (h *StandardAssistantResponseEventHandler) handleLegacyFormat(payload []byt
 }
 
 // handleThinkingContent 处理 thinking 内容块
-// 将 thinking 内容以 <thinking>...</thinking> 标签包裹后输出
+// 输出为 Anthropic Extended Thinking 规范的内容块，签名与 redacted_thinking 原样透传
 func (h *StandardAssistantResponseEventHandler) handleThinkingContent(data map[string]any) ([]SSEEvent, error) {
+	if redacted, ok := redactedThinkingData(data); ok {
+		logger.Debug("处理 redacted_thinking 内容块",
+			logger.Int("data_length", len(redacted)))
+		return redactedThinkingBlockEvents(redacted), nil
+	}
+
 	content, _ := data["content"].(string)
-	if content == "" {
+	signature := thinkingSignature(data)
+	if content == "" && signature == "" {
 		return []SSEEvent{}, nil
 	}
 
 	logger.Debug("处理 thinking 内容块",
-		logger.Int("content_length", len(content)))
+		logger.Int("content_length", len(content)),
+		logger.Bool("has_signature", signature != ""))
 
-	// 输出为 Anthropic Extended Thinking 规范（thinking_delta），方便 Claude Code 识别“思考模式”。
 	// 注意：这里的 thinking 内容来自上游事件，本项目不生成/推断 thinking。
-	return []SSEEvent{
+	return thinkingBlockEvents(content, signature), nil
+}
+
+// thinkingSignature 读取上游 thinking 事件携带的签名（没有时返回空）
+func thinkingSignature(data map[string]any) string {
+	signature, _ := data["signature"].(string)
+	return signature
+}
+
+// redactedThinkingData 识别上游的 redacted_thinking 事件并返回其加密内容
+// 兼容 Anthropic 格式（type=redacted_thinking + data）与 CodeWhisperer 格式（redactedContent）
+func redactedThinkingData(data map[string]any) (string, bool) {
+	if redacted, ok := data["redactedContent"].(string); ok && redacted != "" {
+		return redacted, true
+	}
+	if data["type"] == "redacted_thinking" {
+		redacted, _ := data["data"].(string)
+		return redacted, true
+	}
+	return "", false
+}
+
+// thinkingBlockEvents 构建 thinking 内容块的 start/delta/stop 事件
+// 上游提供签名时在 content_block_stop 之前追加 signature_delta，供客户端校验 thinking 内容
+func thinkingBlockEvents(content, signature string) []SSEEvent {
+	events := []SSEEvent{
 		{
 			Event: "content_block_start",
 			Data: map[string]any{
@@ -501,7 +535,9 @@ func (h *StandardAssistantResponseEventHandler) handleThinkingContent(data map[s
 				},
 			},
 		},
-		{
+	}
+	if content != "" {
+		events = append(events, SSEEvent{
 			Event: "content_block_delta",
 			Data: map[string]any{
 				"type":  "content_block_delta",
@@ -511,6 +547,44 @@ func (h *StandardAssistantResponseEventHandler) handleThinkingContent(data map[s
 					"thinking": content,
 				},
 			},
+		})
+	}
+	if signature != "" {
+		events = append(events, SSEEvent{
+			Event: "content_block_delta",
+			Data: map[string]any{
+				"type":  "content_block_delta",
+				"index": 0,
+				"delta": map[string]any{
+					"type":      "signature_delta",
+					"signature": signature,
+				},
+			},
+		})
+	}
+	return append(events, SSEEvent{
+		Event: "content_block_stop",
+		Data: map[string]any{
+			"type":  "content_block_stop",
+			"index": 0,
+		},
+	})
+}
+
+// redactedThinkingBlockEvents 构建 redacted_thinking 内容块事件
+// 加密内容随 content_block_start 一次性下发（与 Anthropic 流式格式一致），不做任何改写
+func redactedThinkingBlockEvents(data string) []SSEEvent {
+	return []SSEEvent{
+		{
+			Event: "content_block_start",
+			Data: map[string]any{
+				"type":  "content_block_start",
+				"index": 0,
+				"content_block": map[string]any{
+					"type": "redacted_thinking",
+					"data": data,
+				},
+			},
 		},
 		{
 			Event: "content_block_stop",
@@ -519,7 +593,7 @@ func (h *StandardAssistantResponseEventHandler) handleThinkingContent(data map[s
 				"index": 0,
 			},
 		},
-	}, nil
+	}
 }
 
 // LegacyToolUseEventHandler 处理旧格式的工具使用事件
@@ -559,6 +633,9 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 	// 🔥 统一转换input，避免重复调用
 	inputStr := convertInputToString(evt.Input)
 
+	// 字符串形式的 input 是上游按字节切分的参数片段，需要原样转发并交给聚合器拼接
+	fragment, isFragment := evt.Input.(string)
+
 	// *** 核心修复：区分一次性完整数据和流式分片数据 ***
 
 	// 第一步：检查工具是否已经注册
@@ -570,13 +647,18 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 			logger.String("toolUseId", evt.ToolUseId),
 			logger.String("name", evt.Name))
 
-		// 创建初始工具调用请求（使用完整参数）
+		// 创建初始工具调用请求：一次性完整数据直接使用完整参数；
+		// 流式首个片段不是完整JSON，注册时不带参数，片段随后按增量下发
+		arguments := inputStr
+		if isFragment && !evt.Stop {
+			arguments = ""
+		}
 		toolCall := ToolCall{
 			ID:   evt.ToolUseId,
 			Type: "function",
 			Function: ToolCallFunction{
 				Name:      evt.Name,
-				Arguments: inputStr, // 使用已转换的input参数
+				Arguments: arguments,
 			},
 		}
 
@@ -596,9 +678,11 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 			return events, nil
 		}
 
-		// 🔥 关键修复：如果不是stop事件，说明后续还有数据片段
-		// 但首次注册时的数据已经是完整的JSON对象（来自evt.Input），不是片段
-		// 因此不应该通过聚合器处理，聚合器只处理后续的字符串片段
+		// 首个事件即携带参数片段：交给聚合器并立即下发，避免丢失开头的片段
+		if isFragment && fragment != "" {
+			h.aggregator.ProcessToolData(evt.ToolUseId, evt.Name, fragment, false, -1)
+			events = append(events, h.toolManager.AppendStreamedArguments(evt.ToolUseId, fragment)...)
+		}
 
 		// 如果不是stop事件，说明后续还有数据片段，返回注册事件，等待后续片段
 		return events, nil
@@ -608,86 +692,46 @@ func (h *LegacyToolUseEventHandler) handleToolCallEvent(message *EventStreamMess
 	// 🔥 关键修复：只有在工具已注册且不是首次的情况下，才使用聚合器
 	// 这避免了对已经完整的一次性数据进行二次处理
 
-	// 🔥 核心修复：区分"无参数工具"和"stop信号无新数据"
-	// 场景1：无参数工具 - 从头到尾都没有数据
-	// 场景2：stop信号无新数据 - 已有完整数据，stop事件不带新数据
-
-	if evt.Stop {
-		// 收到stop信号，需要完成聚合
-		// 🔥 关键：只传递空字符串，不传递"{}"，避免污染buffer
-		complete, fullInput := h.aggregator.ProcessToolData(evt.ToolUseId, evt.Name, "", evt.Stop, -1)
-
-		if complete {
-			// 聚合完成，更新工具参数
-			if fullInput != "" && fullInput != "{}" {
-				var testArgs map[string]any
-				if err := utils.FastUnmarshal([]byte(fullInput), &testArgs); err != nil {
-					logger.Warn("聚合后的工具调用参数JSON格式无效",
-						logger.String("toolUseId", evt.ToolUseId),
-						logger.String("fullInput", fullInput),
-						logger.Err(err))
-				} else {
-					h.toolManager.UpdateToolArguments(evt.ToolUseId, testArgs)
-				}
-			}
-
-			// 处理工具完成
-			result := ToolCallResult{
-				ToolCallID: evt.ToolUseId,
-				Result:     "Tool execution completed via toolUseEvent",
-			}
-			return h.toolManager.HandleToolCallResult(result), nil
+	// 每个参数片段按到达顺序作为独立的 input_json_delta 下发（与官方 API 一样逐段流式输出）
+	events := []SSEEvent{}
+	if isFragment && fragment != "" {
+		if evt.ToolUseId == "" {
+			logger.Warn("工具调用片段缺少有效的toolUseId，跳过增量事件发送",
+				logger.String("inputFragment", fragment))
+			return []SSEEvent{}, nil
 		}
+		events = append(events, h.toolManager.AppendStreamedArguments(evt.ToolUseId, fragment)...)
 	}
 
-	// 如果是空数据但不是stop，返回空事件
-	if inputStr == "" || inputStr == "{}" {
-		return []SSEEvent{}, nil
-	}
-
-	// 🔥 使用聚合器处理流式JSON片段
-	complete, _ := h.aggregator.ProcessToolData(evt.ToolUseId, evt.Name, inputStr, evt.Stop, -1)
-
-	// 处理未完整数据时发送增量事件
+	// 🔥 使用聚合器处理流式JSON片段；stop 事件可能携带最后一个片段，一并拼接
+	// 🔥 关键：非字符串 input 只传递空字符串，不传递"{}"，避免污染buffer
+	complete, fullInput := h.aggregator.ProcessToolData(evt.ToolUseId, evt.Name, fragment, evt.Stop, -1)
 	if !complete {
-		// 如果有新的输入片段，发送参数增量事件
-		if inputStr != "" && inputStr != "{}" {
-			// 边界情况检查：确保工具ID有效
-			if evt.ToolUseId == "" {
-				logger.Warn("工具调用片段缺少有效的toolUseId，跳过增量事件发送",
-					logger.String("inputFragment", inputStr))
-				return []SSEEvent{}, nil
-			}
+		return events, nil
+	}
 
-			// 获取工具的块索引
-			toolIndex := h.toolManager.GetBlockIndex(evt.ToolUseId)
-			if toolIndex >= 0 {
-				return []SSEEvent{{
-					Event: "content_block_delta",
-					Data: map[string]any{
-						"type":  "content_block_delta",
-						"index": toolIndex,
-						"delta": map[string]any{
-							"type":         "input_json_delta",
-							"partial_json": inputStr,
-						},
-					},
-				}}, nil
-			} else {
-				// 工具未注册的边界情况（理论上不应该发生，因为上面已经检查过）
-				logger.Warn("尝试发送增量事件但工具未注册，可能存在时序问题",
-					logger.String("toolUseId", evt.ToolUseId),
-					logger.String("name", evt.Name),
-					logger.String("inputFragment", inputStr))
-			}
+	// 聚合完成，更新工具参数
+	if fullInput != "" && fullInput != "{}" {
+		var testArgs map[string]any
+		if err := utils.FastUnmarshal([]byte(fullInput), &testArgs); err != nil {
+			logger.Warn("聚合后的工具调用参数JSON格式无效",
+				logger.String("toolUseId", evt.ToolUseId),
+				logger.String("fullInput", fullInput),
+				logger.Err(err))
+		} else {
+			h.toolManager.UpdateToolArguments(evt.ToolUseId, testArgs)
 		}
-
-		// 无新数据或无法获取索引，返回空事件
-		return []SSEEvent{}, nil
 	}
 
-	// 非stop事件的流式片段处理完成，返回空事件
-	return []SSEEvent{}, nil
+	// content_block_stop 之前确认已下发的参数完整
+	events = append(events, h.toolManager.FinishStreamedArguments(evt.ToolUseId, fullInput)...)
+
+	// 处理工具完成
+	result := ToolCallResult{
+		ToolCallID: evt.ToolUseId,
+		Result:     "Tool execution completed via toolUseEvent",
+	}
+	return append(events, h.toolManager.HandleToolCallResult(result)...), nil
 }
 
 // NoOpEventHandler 空操作事件处理器（用于静默忽略某些事件）
@@ -708,6 +752,12 @@ func (h *ThinkingEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent,
 		return []SSEEvent{}, nil
 	}
 
+	if redacted, ok := redactedThinkingData(data); ok {
+		logger.Debug("处理 redacted_thinking 事件",
+			logger.Int("data_length", len(redacted)))
+		return redactedThinkingBlockEvents(redacted), nil
+	}
+
 	// 兼容多种字段名：优先使用 content 字段，其次使用 thinking 字段
 	// 这是因为上游可能返回不同的字段名
 	content, _ := data["content"].(string)
@@ -715,7 +765,8 @@ func (h *ThinkingEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent,
 		// 尝试使用 thinking 字段
 		content, _ = data["thinking"].(string)
 	}
-	if content == "" {
+	signature := thinkingSignature(data)
+	if content == "" && signature == "" {
 		logger.Debug("thinking 事件内容为空，跳过处理",
 			logger.Any("data_keys", getMapKeys(data)))
 		return []SSEEvent{}, nil
@@ -723,40 +774,11 @@ func (h *ThinkingEventHandler) Handle(message *EventStreamMessage) ([]SSEEvent,
 
 	logger.Debug("处理 thinkingEvent",
 		logger.Int("content_length", len(content)),
+		logger.Bool("has_signature", signature != ""),
 		logger.String("source_field", getThinkingSourceField(data)))
 
-	// 输出为 Anthropic Extended Thinking 规范（thinking_delta），方便 Claude Code 识别。
-	return []SSEEvent{
-		{
-			Event: "content_block_start",
-			Data: map[string]any{
-				"type":  "content_block_start",
-				"index": 0,
-				"content_block": map[string]any{
-					"type":     "thinking",
-					"thinking": "",
-				},
-			},
-		},
-		{
-			Event: "content_block_delta",
-			Data: map[string]any{
-				"type":  "content_block_delta",
-				"index": 0,
-				"delta": map[string]any{
-					"type":     "thinking_delta",
-					"thinking": content,
-				},
-			},
-		},
-		{
-			Event: "content_block_stop",
-			Data: map[string]any{
-				"type":  "content_block_stop",
-				"index": 0,
-			},
-		},
-	}, nil
+	// 输出为 Anthropic Extended Thinking 规范（thinking_delta + signature_delta），方便 Claude Code 识别。
+	return thinkingBlockEvents(content, signature), nil
 }
 
 // getMapKeys 获取map的所有键（用于调试日志）
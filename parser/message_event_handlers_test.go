@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -157,6 +158,54 @@ func TestLegacyToolUseEventHandler_StreamingFragments(t *testing.T) {
 	t.Log("✅ 流式分片数据场景测试通过")
 }
 
+// TestLegacyToolUseEventHandler_StreamsArgumentFragmentsInOrder 参数片段逐个作为 input_json_delta 下发
+func TestLegacyToolUseEventHandler_StreamsArgumentFragmentsInOrder(t *testing.T) {
+	toolManager := NewToolLifecycleManager()
+	aggregator := NewSonicStreamingJSONAggregatorWithCallback(func(toolUseId string, fullParams string) {
+		toolManager.UpdateToolArgumentsFromJSON(toolUseId, fullParams)
+	})
+	handler := &LegacyToolUseEventHandler{
+		toolManager: toolManager,
+		aggregator:  aggregator,
+	}
+
+	// 首个事件即携带片段，最后一个片段随 stop 一起到达
+	fragments := []string{`{"path":"/tmp/a.txt",`, `"content":"你好`, `世界"}`}
+	var events []SSEEvent
+	for i, fragment := range fragments {
+		payload, _ := utils.FastMarshal(toolUseEvent{
+			Name:      "write_file",
+			ToolUseId: "test-tool-fragments",
+			Input:     fragment,
+			Stop:      i == len(fragments)-1,
+		})
+		evts, err := handler.handleToolCallEvent(&EventStreamMessage{Payload: payload})
+		assert.NoError(t, err)
+		events = append(events, evts...)
+	}
+
+	var partials []string
+	stopIndex := -1
+	for i, evt := range events {
+		data := evt.Data.(map[string]any)
+		if data["type"] == "content_block_stop" && data["index"] != 0 {
+			stopIndex = i
+		}
+		if delta, ok := data["delta"].(map[string]any); ok && delta["type"] == "input_json_delta" {
+			assert.Equal(t, -1, stopIndex, "参数增量必须在 content_block_stop 之前")
+			partials = append(partials, delta["partial_json"].(string))
+		}
+	}
+
+	assert.Equal(t, fragments, partials, "片段应按到达顺序逐个下发")
+	assert.NotEqual(t, -1, stopIndex, "stop 后应关闭工具块")
+
+	var accumulated map[string]any
+	assert.NoError(t, utils.SafeUnmarshal([]byte(strings.Join(partials, "")), &accumulated))
+	assert.Equal(t, "你好世界", accumulated["content"])
+	assert.Equal(t, "你好世界", toolManager.GetCompletedTools()["test-tool-fragments"].Arguments["content"])
+}
+
 // TestLegacyToolUseEventHandler_EmptyParameters 测试空参数工具调用
 func TestLegacyToolUseEventHandler_EmptyParameters(t *testing.T) {
 	toolManager := NewToolLifecycleManager()
@@ -337,3 +386,51 @@ func TestLegacyToolUseEventHandler_MemoryLeakPrevention(t *testing.T) {
 
 	t.Log("✅ 内存泄漏预防测试通过")
 }
+
+// TestThinkingEventHandler_SignatureAndRedacted thinking 签名以 signature_delta 透传，redacted_thinking 原样下发
+func TestThinkingEventHandler_SignatureAndRedacted(t *testing.T) {
+	handler := &ThinkingEventHandler{}
+
+	events, err := handler.Handle(&EventStreamMessage{
+		Payload: []byte(`{"type":"thinking","content":"step 1","signature":"sig-123"}`),
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, events, 4) {
+		assert.Equal(t, "thinking_delta", events[1].Data.(map[string]any)["delta"].(map[string]any)["type"])
+		signatureDelta := events[2].Data.(map[string]any)["delta"].(map[string]any)
+		assert.Equal(t, "signature_delta", signatureDelta["type"])
+		assert.Equal(t, "sig-123", signatureDelta["signature"])
+		assert.Equal(t, "content_block_stop", events[3].Event)
+	}
+
+	// 没有签名时保持原有的 start/delta/stop
+	events, err = handler.Handle(&EventStreamMessage{Payload: []byte(`{"type":"thinking","thinking":"step 2"}`)})
+	assert.NoError(t, err)
+	assert.Len(t, events, 3)
+
+	for _, payload := range []string{
+		`{"type":"redacted_thinking","data":"encrypted=="}`,
+		`{"redactedContent":"encrypted=="}`,
+	} {
+		events, err = handler.Handle(&EventStreamMessage{Payload: []byte(payload)})
+		assert.NoError(t, err)
+		if assert.Len(t, events, 2, payload) {
+			block := events[0].Data.(map[string]any)["content_block"]
+			assert.Equal(t, map[string]any{"type": "redacted_thinking", "data": "encrypted=="}, block)
+			assert.Equal(t, "content_block_stop", events[1].Event)
+		}
+	}
+}
+
+// TestStandardAssistantResponseEventHandler_RedactedThinking assistantResponseEvent 中的 redacted_thinking 不被当作文本
+func TestStandardAssistantResponseEventHandler_RedactedThinking(t *testing.T) {
+	handler := &StandardAssistantResponseEventHandler{}
+
+	events, err := handler.Handle(&EventStreamMessage{
+		Payload: []byte(`{"type":"redacted_thinking","data":"encrypted=="}`),
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, events, 2) {
+		assert.Equal(t, "redacted_thinking", events[0].Data.(map[string]any)["content_block"].(map[string]any)["type"])
+	}
+}
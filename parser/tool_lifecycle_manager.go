@@ -1,9 +1,11 @@
 package parser
 
 import (
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/utils"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -11,7 +13,10 @@ import (
 const DefaultMaxNestingDepth = 3
 
 // ToolLifecycleManager 工具调用生命周期管理器
+// 导出方法均并发安全：多个工具调用并发处理时，块索引分配与工具状态表由 mutex 保护
 type ToolLifecycleManager struct {
+	mutex sync.Mutex
+
 	activeTools         map[string]*ToolExecution
 	completedTools      map[string]*ToolExecution
 	blockIndexMap       map[string]int
@@ -19,33 +24,63 @@ type ToolLifecycleManager struct {
 	textIntroGenerated  bool // 跟踪是否已生成文本介绍
 	currentNestingDepth int  // 当前嵌套深度
 	maxNestingDepth     int  // 最大嵌套深度限制
+
+	maxToolCalls        int                         // 单次响应最多创建的工具调用数（0 表示不限制）
+	totalToolCalls      int                         // 已创建的工具调用数
+	droppedTools        map[string]bool             // 因超出上限被丢弃的工具调用ID
+	streamedArgs        map[string]*strings.Builder // 已通过 input_json_delta 下发的参数片段（按工具ID累积）
+	nestingLimitLogged  bool                        // 嵌套深度超限日志只记录一次
+	toolCallLimitLogged bool                        // 工具调用数超限日志只记录一次
 }
 
 // NewToolLifecycleManager 创建工具生命周期管理器
+// 嵌套深度与工具调用上限分别读取 TOOL_MAX_NESTING_DEPTH / TOOL_MAX_CALLS_PER_STREAM
 func NewToolLifecycleManager() *ToolLifecycleManager {
+	maxNestingDepth := config.ToolMaxNestingDepth
+	if maxNestingDepth <= 0 {
+		maxNestingDepth = DefaultMaxNestingDepth
+	}
+
 	return &ToolLifecycleManager{
 		activeTools:         make(map[string]*ToolExecution),
 		completedTools:      make(map[string]*ToolExecution),
 		blockIndexMap:       make(map[string]int),
 		nextBlockIndex:      1, // 索引0预留给文本内容
 		currentNestingDepth: 0,
-		maxNestingDepth:     DefaultMaxNestingDepth,
+		maxNestingDepth:     maxNestingDepth,
+		maxToolCalls:        config.ToolMaxCallsPerStream,
+		droppedTools:        make(map[string]bool),
+		streamedArgs:        make(map[string]*strings.Builder),
 	}
 }
 
 // Reset 重置管理器状态
 func (tlm *ToolLifecycleManager) Reset() {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
 	tlm.activeTools = make(map[string]*ToolExecution)
 	tlm.completedTools = make(map[string]*ToolExecution)
 	tlm.blockIndexMap = make(map[string]int)
 	tlm.nextBlockIndex = 1
 	tlm.textIntroGenerated = false // 重置文本介绍生成状态
 	tlm.currentNestingDepth = 0    // 重置嵌套深度
+	tlm.totalToolCalls = 0
+	tlm.droppedTools = make(map[string]bool)
+	tlm.streamedArgs = make(map[string]*strings.Builder)
+	tlm.nestingLimitLogged = false
+	tlm.toolCallLimitLogged = false
 }
 
-// HandleToolCallRequest 处理工具调用请求
 // HandleToolCallRequest 处理工具调用请求（增强参数验证）
 func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest) []SSEEvent {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+	return tlm.handleToolCallRequest(request)
+}
+
+// handleToolCallRequest 处理工具调用请求（调用方需持有 mutex）
+func (tlm *ToolLifecycleManager) handleToolCallRequest(request ToolCallRequest) []SSEEvent {
 	events := make([]SSEEvent, 0, len(request.ToolCalls)*3) // 调整预分配容量，包含文本介绍
 
 	// *** 关键修复：根据Claude规范，在第一个工具调用前自动生成文本介绍（index:0） ***
@@ -89,6 +124,20 @@ func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest)
 			continue
 		}
 
+		// 工具调用总数上限：防止异常循环创建无限多的工具块
+		if tlm.maxToolCalls > 0 && tlm.totalToolCalls >= tlm.maxToolCalls {
+			tlm.droppedTools[toolCall.ID] = true
+			if !tlm.toolCallLimitLogged {
+				logger.Warn("工具调用数量达到上限，后续工具调用将被丢弃",
+					logger.Int("max_tool_calls", tlm.maxToolCalls),
+					logger.String("tool_id", toolCall.ID),
+					logger.String("tool_name", toolCall.Function.Name))
+				tlm.toolCallLimitLogged = true
+			}
+			continue
+		}
+		tlm.totalToolCalls++
+
 		// 解析工具调用参数
 		// 修复：空 arguments 不应触发 JSON 解析告警（参考 kiro.rs fix #75）
 		var arguments map[string]any
@@ -146,17 +195,7 @@ func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest)
 		// 即使是一次性完整的参数，也封装为 delta 发送，模拟流式传输
 		if len(cleanedArgs) > 0 {
 			argsJSON, _ := utils.SafeMarshal(cleanedArgs)
-			events = append(events, SSEEvent{
-				Event: "content_block_delta",
-				Data: map[string]any{
-					"type":  "content_block_delta",
-					"index": execution.BlockIndex,
-					"delta": map[string]any{
-						"type":         "input_json_delta",
-						"partial_json": string(argsJSON),
-					},
-				},
-			})
+			events = append(events, tlm.inputJSONDeltaEvent(toolCall.ID, execution.BlockIndex, string(argsJSON)))
 		}
 
 		execution.Status = ToolStatusRunning
@@ -167,10 +206,16 @@ func (tlm *ToolLifecycleManager) HandleToolCallRequest(request ToolCallRequest)
 
 // HandleToolCallResult 处理工具调用结果
 func (tlm *ToolLifecycleManager) HandleToolCallResult(result ToolCallResult) []SSEEvent {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
 	events := make([]SSEEvent, 0, 1) // 调整预分配容量（只需要content_block_stop）
 
 	execution, exists := tlm.activeTools[result.ToolCallID]
 	if !exists {
+		if tlm.droppedTools[result.ToolCallID] {
+			return events
+		}
 		logger.Warn("收到未知工具调用的结果",
 			logger.String("tool_call_id", result.ToolCallID))
 		return events
@@ -204,6 +249,7 @@ func (tlm *ToolLifecycleManager) HandleToolCallResult(result ToolCallResult) []S
 	// 移动到已完成工具列表
 	tlm.completedTools[result.ToolCallID] = execution
 	delete(tlm.activeTools, result.ToolCallID)
+	delete(tlm.streamedArgs, result.ToolCallID)
 
 	// 新增：检查结果中是否包含嵌套工具调用
 	if nestedToolCalls := tlm.extractNestedToolCalls(result.Result); len(nestedToolCalls) > 0 {
@@ -213,15 +259,18 @@ func (tlm *ToolLifecycleManager) HandleToolCallResult(result ToolCallResult) []S
 			logger.Int("current_depth", tlm.currentNestingDepth))
 
 		if tlm.currentNestingDepth >= tlm.maxNestingDepth {
-			logger.Warn("嵌套工具调用深度超过限制，停止处理嵌套调用",
-				logger.Int("current_depth", tlm.currentNestingDepth),
-				logger.Int("max_depth", tlm.maxNestingDepth),
-				logger.String("parent_tool_id", result.ToolCallID))
-			// 不处理嵌套调用，但记录日志
+			// 不处理嵌套调用，超限日志每个流只记录一次
+			if !tlm.nestingLimitLogged {
+				logger.Warn("嵌套工具调用深度超过限制，停止处理嵌套调用",
+					logger.Int("current_depth", tlm.currentNestingDepth),
+					logger.Int("max_depth", tlm.maxNestingDepth),
+					logger.String("parent_tool_id", result.ToolCallID))
+				tlm.nestingLimitLogged = true
+			}
 		} else {
 			tlm.currentNestingDepth++
 			// 处理嵌套工具调用
-			nestedEvents := tlm.HandleToolCallRequest(ToolCallRequest{ToolCalls: nestedToolCalls})
+			nestedEvents := tlm.handleToolCallRequest(ToolCallRequest{ToolCalls: nestedToolCalls})
 			events = append(events, nestedEvents...)
 			tlm.currentNestingDepth--
 		}
@@ -399,23 +448,41 @@ func (tlm *ToolLifecycleManager) parseToolCallBlock(block map[string]any) *ToolC
 
 // SetMaxNestingDepth 设置最大嵌套深度
 func (tlm *ToolLifecycleManager) SetMaxNestingDepth(depth int) {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
 	if depth > 0 {
 		tlm.maxNestingDepth = depth
 	}
 }
 
+// SetMaxToolCalls 设置单次响应最多创建的工具调用数（0 表示不限制）
+func (tlm *ToolLifecycleManager) SetMaxToolCalls(limit int) {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+	if limit >= 0 {
+		tlm.maxToolCalls = limit
+	}
+}
+
 // GetCurrentNestingDepth 获取当前嵌套深度
 func (tlm *ToolLifecycleManager) GetCurrentNestingDepth() int {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
 	return tlm.currentNestingDepth
 }
 
 // GetMaxNestingDepth 获取最大嵌套深度
 func (tlm *ToolLifecycleManager) GetMaxNestingDepth() int {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
 	return tlm.maxNestingDepth
 }
 
 // HandleToolCallError 处理工具调用错误
 func (tlm *ToolLifecycleManager) HandleToolCallError(errorInfo ToolCallError) []SSEEvent {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
 	events := make([]SSEEvent, 0, 2) // 调整预分配容量（error + content_block_stop）
 
 	execution, exists := tlm.activeTools[errorInfo.ToolCallID]
@@ -486,6 +553,13 @@ func (tlm *ToolLifecycleManager) HandleToolCallError(errorInfo ToolCallError) []
 
 // GetToolExecution 获取工具执行信息
 func (tlm *ToolLifecycleManager) GetToolExecution(toolID string) *ToolExecution {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+	return tlm.getToolExecution(toolID)
+}
+
+// getToolExecution 获取工具执行信息（调用方需持有 mutex）
+func (tlm *ToolLifecycleManager) getToolExecution(toolID string) *ToolExecution {
 	if tool, exists := tlm.activeTools[toolID]; exists {
 		return tool
 	}
@@ -497,6 +571,8 @@ func (tlm *ToolLifecycleManager) GetToolExecution(toolID string) *ToolExecution
 
 // GetActiveTools 获取所有活跃的工具
 func (tlm *ToolLifecycleManager) GetActiveTools() map[string]*ToolExecution {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
 	result := make(map[string]*ToolExecution)
 	for id, tool := range tlm.activeTools {
 		result[id] = tool
@@ -506,6 +582,8 @@ func (tlm *ToolLifecycleManager) GetActiveTools() map[string]*ToolExecution {
 
 // GetCompletedTools 获取所有已完成的工具
 func (tlm *ToolLifecycleManager) GetCompletedTools() map[string]*ToolExecution {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
 	result := make(map[string]*ToolExecution)
 	for id, tool := range tlm.completedTools {
 		result[id] = tool
@@ -513,7 +591,7 @@ func (tlm *ToolLifecycleManager) GetCompletedTools() map[string]*ToolExecution {
 	return result
 }
 
-// getOrAssignBlockIndex 获取或分配块索引
+// getOrAssignBlockIndex 获取或分配块索引（调用方需持有 mutex）
 func (tlm *ToolLifecycleManager) getOrAssignBlockIndex(toolID string) int {
 	if index, exists := tlm.blockIndexMap[toolID]; exists {
 		return index
@@ -527,6 +605,8 @@ func (tlm *ToolLifecycleManager) getOrAssignBlockIndex(toolID string) int {
 
 // GetBlockIndex 获取工具的块索引
 func (tlm *ToolLifecycleManager) GetBlockIndex(toolID string) int {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
 	if index, exists := tlm.blockIndexMap[toolID]; exists {
 		return index
 	}
@@ -585,6 +665,9 @@ func (tlm *ToolLifecycleManager) generateIntroText(_ string) string {
 
 // GenerateToolSummary 生成工具执行摘要
 func (tlm *ToolLifecycleManager) GenerateToolSummary() map[string]any {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
 	activeCount := len(tlm.activeTools)
 	completedCount := len(tlm.completedTools)
 	errorCount := 0
@@ -614,6 +697,9 @@ func (tlm *ToolLifecycleManager) UpdateToolArguments(toolID string, arguments ma
 	// 	logger.String("tool_id", toolID),
 	// 	logger.Any("arguments", arguments))
 
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
 	// 检查活跃工具
 	if execution, exists := tlm.activeTools[toolID]; exists {
 		execution.Arguments = arguments
@@ -657,6 +743,72 @@ func (tlm *ToolLifecycleManager) UpdateToolArgumentsFromJSON(toolID string, json
 	tlm.UpdateToolArguments(toolID, arguments)
 }
 
+// AppendStreamedArguments 将上游的参数片段原样作为 input_json_delta 下发，保持片段顺序
+// 客户端据此逐步渲染工具参数；工具未注册或已被丢弃时返回 nil
+func (tlm *ToolLifecycleManager) AppendStreamedArguments(toolID string, fragment string) []SSEEvent {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
+	execution, exists := tlm.activeTools[toolID]
+	if !exists || fragment == "" {
+		return nil
+	}
+	return []SSEEvent{tlm.inputJSONDeltaEvent(toolID, execution.BlockIndex, fragment)}
+}
+
+// FinishStreamedArguments 在 content_block_stop 之前收尾工具参数
+// 尚未下发任何参数片段时，将聚合后的完整参数作为一个 input_json_delta 补发；
+// 已下发的片段拼接后无法解析为 JSON 对象时记录告警（片段已发出，无法撤回）
+func (tlm *ToolLifecycleManager) FinishStreamedArguments(toolID string, fullInput string) []SSEEvent {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
+	execution, exists := tlm.activeTools[toolID]
+	if !exists {
+		return nil
+	}
+
+	streamed, ok := tlm.streamedArgs[toolID]
+	if !ok || streamed.Len() == 0 {
+		if fullInput == "" || fullInput == "{}" {
+			return nil
+		}
+		return []SSEEvent{tlm.inputJSONDeltaEvent(toolID, execution.BlockIndex, fullInput)}
+	}
+
+	var parsed map[string]any
+	if err := utils.SafeUnmarshal([]byte(streamed.String()), &parsed); err != nil {
+		logger.Warn("已下发的工具参数片段拼接后不是有效JSON",
+			logger.String("tool_id", toolID),
+			logger.String("tool_name", execution.Name),
+			logger.Int("streamed_bytes", streamed.Len()),
+			logger.Err(err))
+	}
+	return nil
+}
+
+// inputJSONDeltaEvent 生成参数增量事件并记录已下发的片段（调用方需持有 mutex）
+func (tlm *ToolLifecycleManager) inputJSONDeltaEvent(toolID string, blockIndex int, partialJSON string) SSEEvent {
+	streamed, ok := tlm.streamedArgs[toolID]
+	if !ok {
+		streamed = &strings.Builder{}
+		tlm.streamedArgs[toolID] = streamed
+	}
+	streamed.WriteString(partialJSON)
+
+	return SSEEvent{
+		Event: "content_block_delta",
+		Data: map[string]any{
+			"type":  "content_block_delta",
+			"index": blockIndex,
+			"delta": map[string]any{
+				"type":         "input_json_delta",
+				"partial_json": partialJSON,
+			},
+		},
+	}
+}
+
 // ValidateToolPairing 验证工具调用和工具结果的配对关系
 // 修复: 验证并过滤工具配对以移除孤立结果
 // 参考: kiro.rs 2026.1.4 - feat: 验证并过滤工具配对以移除孤立结果
@@ -665,6 +817,9 @@ func (tlm *ToolLifecycleManager) ValidateToolPairing(toolResults []map[string]an
 		return toolResults
 	}
 
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
+
 	validResults := make([]map[string]any, 0, len(toolResults))
 	orphanedCount := 0
 
@@ -678,7 +833,7 @@ func (tlm *ToolLifecycleManager) ValidateToolPairing(toolResults []map[string]an
 		}
 
 		// 检查是否存在对应的工具调用
-		execution := tlm.GetToolExecution(toolUseID)
+		execution := tlm.getToolExecution(toolUseID)
 		if execution == nil {
 			logger.Warn("发现孤立的工具结果，对应的工具调用不存在",
 				logger.String("tool_use_id", toolUseID))
@@ -702,6 +857,8 @@ func (tlm *ToolLifecycleManager) ValidateToolPairing(toolResults []map[string]an
 
 // HasToolCall 检查是否存在指定的工具调用
 func (tlm *ToolLifecycleManager) HasToolCall(toolID string) bool {
+	tlm.mutex.Lock()
+	defer tlm.mutex.Unlock()
 	_, activeExists := tlm.activeTools[toolID]
 	_, completedExists := tlm.completedTools[toolID]
 	return activeExists || completedExists
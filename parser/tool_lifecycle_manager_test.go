@@ -0,0 +1,126 @@
+package parser
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestToolCall(id string) ToolCall {
+	return ToolCall{
+		ID:   id,
+		Type: "function",
+		Function: ToolCallFunction{
+			Name:      "read_file",
+			Arguments: `{"path":"a.txt"}`,
+		},
+	}
+}
+
+func countToolBlockStarts(events []SSEEvent) int {
+	count := 0
+	for _, e := range events {
+		if e.Event == "content_block_start" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestNewToolLifecycleManager_NestingDepthFromConfig(t *testing.T) {
+	orig := config.ToolMaxNestingDepth
+	defer func() { config.ToolMaxNestingDepth = orig }()
+
+	config.ToolMaxNestingDepth = 7
+	assert.Equal(t, 7, NewToolLifecycleManager().GetMaxNestingDepth())
+
+	config.ToolMaxNestingDepth = 0
+	assert.Equal(t, DefaultMaxNestingDepth, NewToolLifecycleManager().GetMaxNestingDepth())
+}
+
+func TestToolLifecycleManager_MaxToolCallsPerStream(t *testing.T) {
+	tlm := NewToolLifecycleManager()
+	tlm.SetMaxToolCalls(2)
+
+	var calls []ToolCall
+	for i := 0; i < 5; i++ {
+		calls = append(calls, newTestToolCall(fmt.Sprintf("tool_%d", i)))
+	}
+	events := tlm.HandleToolCallRequest(ToolCallRequest{ToolCalls: calls})
+
+	assert.Equal(t, 2, countToolBlockStarts(events))
+	assert.Len(t, tlm.GetActiveTools(), 2)
+	assert.Equal(t, -1, tlm.GetBlockIndex("tool_4"))
+
+	// 被丢弃工具的结果不应产生事件
+	assert.Empty(t, tlm.HandleToolCallResult(ToolCallResult{ToolCallID: "tool_4"}))
+
+	tlm.Reset()
+	events = tlm.HandleToolCallRequest(ToolCallRequest{ToolCalls: []ToolCall{newTestToolCall("tool_new")}})
+	assert.Equal(t, 1, countToolBlockStarts(events), "Reset 后计数应清零")
+}
+
+func TestToolLifecycleManager_NestedCallsStopAtMaxDepth(t *testing.T) {
+	tlm := NewToolLifecycleManager()
+	tlm.SetMaxNestingDepth(1)
+
+	tlm.HandleToolCallRequest(ToolCallRequest{ToolCalls: []ToolCall{newTestToolCall("parent")}})
+
+	nested := map[string]any{
+		"type":  "tool_use",
+		"id":    "child",
+		"name":  "read_file",
+		"input": map[string]any{"path": "b.txt"},
+	}
+	events := tlm.HandleToolCallResult(ToolCallResult{ToolCallID: "parent", Result: nested})
+	assert.Equal(t, 1, countToolBlockStarts(events), "深度未超限时应展开嵌套调用")
+
+	tlm.currentNestingDepth = 1
+	grandchild := map[string]any{
+		"type":  "tool_use",
+		"id":    "grandchild",
+		"name":  "read_file",
+		"input": map[string]any{},
+	}
+	events = tlm.HandleToolCallResult(ToolCallResult{ToolCallID: "child", Result: grandchild})
+	assert.Equal(t, 0, countToolBlockStarts(events), "深度超限时不应展开嵌套调用")
+	assert.True(t, tlm.nestingLimitLogged)
+}
+
+func TestToolLifecycleManager_ConcurrentToolCallsGetUniqueIndices(t *testing.T) {
+	tlm := NewToolLifecycleManager()
+	tlm.SetMaxToolCalls(0)
+
+	const workers = 64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			id := fmt.Sprintf("tool_%d", i)
+			tlm.HandleToolCallRequest(ToolCallRequest{ToolCalls: []ToolCall{newTestToolCall(id)}})
+			tlm.HandleToolCallResult(ToolCallResult{ToolCallID: id, Result: "ok"})
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	seen := make(map[int]string, workers)
+	for i := 0; i < workers; i++ {
+		id := fmt.Sprintf("tool_%d", i)
+		index := tlm.GetBlockIndex(id)
+		assert.Positive(t, index, "索引0预留给文本内容")
+		if other, dup := seen[index]; dup {
+			t.Fatalf("block index %d assigned to both %s and %s", index, other, id)
+		}
+		seen[index] = id
+	}
+	assert.Len(t, tlm.GetCompletedTools(), workers)
+	assert.Empty(t, tlm.GetActiveTools())
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessLogContextKey 访问日志记录在 gin 上下文中的键
+const accessLogContextKey = "access_log"
+
+// accessLogEntry 单个请求的访问日志数据，处理过程中逐步填充，请求结束时输出
+type accessLogEntry struct {
+	start            time.Time
+	stream           bool
+	inputTokens      int
+	outputTokens     int
+	upstreamStatus   int
+	upstreamAttempts int
+}
+
+// startAccessLog 开始记录访问日志（ACCESS_LOG_ENABLED=false 时返回 nil）
+// 用法：defer startAccessLog(c).finish(c)
+func startAccessLog(c *gin.Context) *accessLogEntry {
+	if !config.AccessLogEnabled {
+		return nil
+	}
+	entry := &accessLogEntry{start: time.Now()}
+	c.Set(accessLogContextKey, entry)
+	return entry
+}
+
+// accessLogFrom 获取当前请求的访问日志记录（未启用时返回 nil）
+func accessLogFrom(c *gin.Context) *accessLogEntry {
+	if c == nil {
+		return nil
+	}
+	if v, ok := c.Get(accessLogContextKey); ok {
+		if entry, ok := v.(*accessLogEntry); ok {
+			return entry
+		}
+	}
+	return nil
+}
+
+// recordAccessStream 记录是否为流式请求
+func recordAccessStream(c *gin.Context, stream bool) {
+	if entry := accessLogFrom(c); entry != nil {
+		entry.stream = stream
+	}
+}
+
+// recordAccessUsage 记录请求的输入/输出tokens
+func recordAccessUsage(c *gin.Context, inputTokens, outputTokens int) {
+	if entry := accessLogFrom(c); entry != nil {
+		entry.inputTokens = inputTokens
+		entry.outputTokens = outputTokens
+	}
+}
+
+// recordAccessUpstream 记录一次上游请求的状态码（每次尝试调用一次，用于统计重试次数）
+func recordAccessUpstream(c *gin.Context, statusCode int) {
+	if entry := accessLogFrom(c); entry != nil {
+		entry.upstreamStatus = statusCode
+		entry.upstreamAttempts++
+	}
+}
+
+// finish 输出访问日志（nil 安全）
+func (e *accessLogEntry) finish(c *gin.Context) {
+	if e == nil {
+		return
+	}
+	logger.Access("access", e.fields(c)...)
+}
+
+// fields 访问日志字段
+func (e *accessLogEntry) fields(c *gin.Context) []logger.Field {
+	retries := 0
+	if e.upstreamAttempts > 1 {
+		retries = e.upstreamAttempts - 1
+	}
+	return []logger.Field{
+		logger.String("request_id", GetRequestID(c)),
+		logger.String("client_ip", c.ClientIP()),
+		logger.String("client_token_id", c.GetString(clientTokenIDContextKey)),
+		logger.String("method", c.Request.Method),
+		logger.String("path", c.Request.URL.Path),
+		logger.Int("status", c.Writer.Status()),
+		logger.String("model", c.GetString("requested_model")),
+		logger.Bool("stream", e.stream),
+		logger.Int("input_tokens", e.inputTokens),
+		logger.Int("output_tokens", e.outputTokens),
+		logger.Int("upstream_status", e.upstreamStatus),
+		logger.String("token_key", c.GetString("token_key")),
+		logger.String("user_hash", requestUserHash(c)),
+		logger.Int64("latency_ms", time.Since(e.start).Milliseconds()),
+		logger.Int("retries", retries),
+	}
+}
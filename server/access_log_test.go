@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAccessLogTestContext() *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	return c
+}
+
+func TestAccessLog_DisabledIsNoop(t *testing.T) {
+	orig := config.AccessLogEnabled
+	config.AccessLogEnabled = false
+	defer func() { config.AccessLogEnabled = orig }()
+
+	c := newAccessLogTestContext()
+	entry := startAccessLog(c)
+	assert.Nil(t, entry)
+	assert.Nil(t, accessLogFrom(c))
+
+	// 未启用时记录函数与 finish 均不应panic
+	recordAccessStream(c, true)
+	recordAccessUsage(c, 1, 2)
+	recordAccessUpstream(c, http.StatusOK)
+	entry.finish(c)
+}
+
+func TestAccessLog_CollectsRequestMetadata(t *testing.T) {
+	orig := config.AccessLogEnabled
+	config.AccessLogEnabled = true
+	defer func() { config.AccessLogEnabled = orig }()
+
+	c := newAccessLogTestContext()
+	c.Request.RemoteAddr = "203.0.113.7:4321"
+	c.Set("request_id", "req_test")
+	c.Set("requested_model", "claude-sonnet-4-20250514")
+	c.Set("token_key", "token_1")
+
+	entry := startAccessLog(c)
+	require.NotNil(t, entry)
+	assert.Same(t, entry, accessLogFrom(c))
+
+	recordAccessStream(c, true)
+	recordAccessUpstream(c, http.StatusTooManyRequests)
+	recordAccessUpstream(c, http.StatusOK)
+	recordAccessUsage(c, 120, 45)
+
+	fields := make(map[string]any)
+	for _, f := range entry.fields(c) {
+		fields[f.Key] = f.Value
+	}
+	assert.Equal(t, "req_test", fields["request_id"])
+	assert.Equal(t, "203.0.113.7", fields["client_ip"])
+	assert.Equal(t, "claude-sonnet-4-20250514", fields["model"])
+	assert.Equal(t, true, fields["stream"])
+	assert.Equal(t, 120, fields["input_tokens"])
+	assert.Equal(t, 45, fields["output_tokens"])
+	assert.Equal(t, http.StatusOK, fields["upstream_status"])
+	assert.Equal(t, "token_1", fields["token_key"])
+	assert.Equal(t, 1, fields["retries"])
+	assert.Contains(t, fields, "latency_ms")
+}
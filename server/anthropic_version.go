@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Anthropic API 版本与 beta 特性协商
+// 客户端通过 anthropic-version 指定 API 版本、anthropic-beta 启用 beta 特性（逗号分隔，可重复出现）
+// 未携带 anthropic-version 时按默认版本处理；明确指定了不支持的版本时返回 400
+
+const (
+	// anthropicVersionHeader 请求/响应中的 API 版本头
+	anthropicVersionHeader = "anthropic-version"
+	// anthropicBetaHeader 请求中的 beta 特性头
+	anthropicBetaHeader = "anthropic-beta"
+	// defaultAnthropicVersion 未指定版本时使用的 API 版本
+	defaultAnthropicVersion = "2023-06-01"
+
+	// anthropicVersionContextKey 协商后的 API 版本在 gin 上下文中的键
+	anthropicVersionContextKey = "anthropic_version"
+	// anthropicBetasContextKey 请求启用的 beta 特性在 gin 上下文中的键
+	anthropicBetasContextKey = "anthropic_betas"
+)
+
+// supportedAnthropicVersions 支持的 API 版本（仅 Anthropic 文档中列出的当前版本）
+var supportedAnthropicVersions = []string{"2023-06-01"}
+
+// 影响代理行为的 beta 特性；其余 beta（如 prompt-caching、token-efficient-tools）由上游自动处理或不适用，记录日志后忽略
+const (
+	// betaInterleavedThinking 交错思考：thinking.budget_tokens 按整轮对话计算，可以大于等于 max_tokens；
+	// 转换时保留客户端的 max_tokens，单次请求的思考长度截断到 max_tokens 以内
+	betaInterleavedThinking = "interleaved-thinking-2025-05-14"
+)
+
+// AnthropicVersionMiddleware 校验 anthropic-version 并解析 anthropic-beta，仅作用于指定前缀
+// 协商结果存入上下文，响应头回显实际使用的版本
+func AnthropicVersionMiddleware(protectedPrefixes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requiresAuth(c.Request.URL.Path, protectedPrefixes) {
+			c.Next()
+			return
+		}
+
+		version := strings.TrimSpace(c.GetHeader(anthropicVersionHeader))
+		if version == "" {
+			version = defaultAnthropicVersion
+		} else if !slices.Contains(supportedAnthropicVersions, version) {
+			logger.Warn("不支持的 anthropic-version",
+				addReqFields(c, logger.String("anthropic_version", version))...)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"type": "error",
+				"error": gin.H{
+					"type": "invalid_request_error",
+					"message": fmt.Sprintf("anthropic-version: 不支持的 API 版本 %q，支持的版本: %s",
+						version, strings.Join(supportedAnthropicVersions, ", ")),
+				},
+			})
+			return
+		}
+
+		betas := parseAnthropicBetas(c.Request.Header.Values(anthropicBetaHeader))
+		c.Set(anthropicVersionContextKey, version)
+		if len(betas) > 0 {
+			c.Set(anthropicBetasContextKey, betas)
+		}
+		c.Header(anthropicVersionHeader, version)
+
+		logger.Debug("Anthropic API 版本协商",
+			addReqFields(c,
+				logger.String("anthropic_version", version),
+				logger.String("anthropic_beta", strings.Join(betas, ",")))...)
+		c.Next()
+	}
+}
+
+// parseAnthropicBetas 解析 anthropic-beta 头（多个头与逗号分隔的值合并，去重并保持顺序）
+func parseAnthropicBetas(values []string) []string {
+	var betas []string
+	for _, value := range values {
+		for _, beta := range strings.Split(value, ",") {
+			beta = strings.TrimSpace(beta)
+			if beta != "" && !slices.Contains(betas, beta) {
+				betas = append(betas, beta)
+			}
+		}
+	}
+	return betas
+}
+
+// hasAnthropicBeta 当前请求是否启用了指定的 beta 特性
+func hasAnthropicBeta(c *gin.Context, beta string) bool {
+	betas, _ := c.Get(anthropicBetasContextKey)
+	list, _ := betas.([]string)
+	return slices.Contains(list, beta)
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAnthropicVersionTestRouter 挂载版本协商中间件，处理函数返回协商结果
+func newAnthropicVersionTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(AnthropicVersionMiddleware([]string{"/v1/messages"}))
+	handler := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"version":     c.GetString(anthropicVersionContextKey),
+			"interleaved": hasAnthropicBeta(c, betaInterleavedThinking),
+		})
+	}
+	r.POST("/v1/messages", handler)
+	r.POST("/v1/chat/completions", handler)
+	return r
+}
+
+func TestAnthropicVersionMiddleware(t *testing.T) {
+	r := newAnthropicVersionTestRouter()
+
+	tests := []struct {
+		name        string
+		path        string
+		version     string
+		betas       []string
+		wantStatus  int
+		wantVersion string
+		interleaved bool
+	}{
+		{name: "default version", path: "/v1/messages", wantStatus: http.StatusOK, wantVersion: defaultAnthropicVersion},
+		{name: "undocumented older version", path: "/v1/messages", version: "2023-01-01", wantStatus: http.StatusBadRequest},
+		{name: "unsupported version", path: "/v1/messages", version: "2099-01-01", wantStatus: http.StatusBadRequest},
+		{
+			name:        "interleaved thinking beta",
+			path:        "/v1/messages",
+			version:     "2023-06-01",
+			betas:       []string{"prompt-caching-2024-07-31, " + betaInterleavedThinking, "unknown-beta"},
+			wantStatus:  http.StatusOK,
+			wantVersion: "2023-06-01",
+			interleaved: true,
+		},
+		{name: "openai endpoint ignores header", path: "/v1/chat/completions", version: "2099-01-01", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+			if tt.version != "" {
+				req.Header.Set(anthropicVersionHeader, tt.version)
+			}
+			for _, beta := range tt.betas {
+				req.Header.Add(anthropicBetaHeader, beta)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			require.Equal(t, tt.wantStatus, w.Code)
+			var resp map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			if tt.wantStatus != http.StatusOK {
+				errObj := resp["error"].(map[string]any)
+				assert.Equal(t, "invalid_request_error", errObj["type"])
+				assert.Contains(t, errObj["message"], defaultAnthropicVersion)
+				return
+			}
+			assert.Equal(t, tt.wantVersion, resp["version"])
+			assert.Equal(t, tt.wantVersion, w.Header().Get(anthropicVersionHeader))
+			assert.Equal(t, tt.interleaved, resp["interleaved"])
+		})
+	}
+}
+
+func TestParseAnthropicBetas(t *testing.T) {
+	betas := parseAnthropicBetas([]string{"a, b", " b ,c", ""})
+	assert.Equal(t, []string{"a", "b", "c"}, betas)
+	assert.Nil(t, parseAnthropicBetas(nil))
+}
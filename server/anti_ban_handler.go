@@ -31,6 +31,7 @@ func handleAntiBanStatus(c *gin.Context) {
 			"min_token_interval_ms":  config.RateLimitMinTokenInterval.Milliseconds(),
 			"max_token_interval_ms":  config.RateLimitMaxTokenInterval.Milliseconds(),
 			"global_min_interval_ms": config.RateLimitGlobalMinInterval.Milliseconds(),
+			"min_request_spacing_ms": config.RateLimitMinRequestSpacing.Milliseconds(),
 			"max_consecutive_use":    config.RateLimitMaxConsecutiveUse,
 			"cooldown_duration_sec":  config.RateLimitCooldownDuration.Seconds(),
 		},
@@ -46,6 +47,7 @@ func handleAntiBanStatus(c *gin.Context) {
 		"config":       configInfo,
 		"features": map[string]bool{
 			"fingerprint_randomization": true,
+			"fingerprint_rotation":      config.FingerprintRotateRequests > 0 || config.FingerprintRotateInterval > 0,
 			"rate_limiting":             true,
 			"smart_token_rotation":      true,
 			"cooldown_on_error":         true,
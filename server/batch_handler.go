@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchExpiry 批次过期时间（与Anthropic官方一致：创建后24小时）
+const batchExpiry = 24 * time.Hour
+
+// batchForwardHeaders 分发批次请求时从原始请求复制的请求头（认证与协议版本）
+var batchForwardHeaders = []string{"Authorization", "X-Api-Key", "Anthropic-Version", "Anthropic-Beta", "User-Agent"}
+
+// messageBatchState 单个批次的处理状态
+type messageBatchState struct {
+	batch   types.MessageBatch
+	results []types.MessageBatchResultItem // 与请求顺序一致，未完成的条目为零值
+	done    []bool
+	endedAt time.Time
+}
+
+// MessageBatchManager 管理 Message Batches：保存批次状态，并按有限并发把每个请求
+// 作为独立的非流式 POST /v1/messages 分发给 dispatcher（复用完整的请求构建与响应转换流程）
+type MessageBatchManager struct {
+	dispatcher http.Handler
+	workers    int
+	resultTTL  time.Duration
+
+	mu      sync.RWMutex
+	batches map[string]*messageBatchState
+}
+
+// NewMessageBatchManager 创建批次管理器，dispatcher 通常为服务自身的 gin 引擎
+func NewMessageBatchManager(dispatcher http.Handler) *MessageBatchManager {
+	workers := config.BatchMaxWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	return &MessageBatchManager{
+		dispatcher: dispatcher,
+		workers:    workers,
+		resultTTL:  config.BatchResultTTL,
+		batches:    make(map[string]*messageBatchState),
+	}
+}
+
+// handleCreateMessageBatch POST /v1/messages/batches
+// 校验后立即返回 in_progress 状态的批次对象，请求在后台处理
+func handleCreateMessageBatch(m *MessageBatchManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req types.MessageBatchCreateRequest
+		if err := utils.SafeUnmarshal(readBatchBody(c), &req); err != nil {
+			respondBatchError(c, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+			return
+		}
+
+		bodies, err := validateBatchRequests(req.Requests)
+		if err != nil {
+			respondBatchError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		headers := make(http.Header)
+		for _, name := range batchForwardHeaders {
+			if v := c.GetHeader(name); v != "" {
+				headers.Set(name, v)
+			}
+		}
+
+		batch := m.create(req.Requests)
+		logger.Info("创建消息批次",
+			addReqFields(c,
+				logger.String("batch_id", batch.ID),
+				logger.Int("request_count", len(req.Requests)),
+			)...)
+
+		go m.process(batch.ID, req.Requests, bodies, headers)
+
+		c.JSON(http.StatusOK, batch)
+	}
+}
+
+// handleGetMessageBatch GET /v1/messages/batches/:id
+// 批次结束后响应中附带 results 字段
+func handleGetMessageBatch(m *MessageBatchManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		batch, ok := m.get(c.Param("id"), true)
+		if !ok {
+			respondBatchNotFound(c)
+			return
+		}
+		c.JSON(http.StatusOK, batch)
+	}
+}
+
+// handleGetMessageBatchResults GET /v1/messages/batches/:id/results
+// 以 JSONL 返回结果（与官方 results_url 一致），批次未结束时返回 400
+func handleGetMessageBatchResults(m *MessageBatchManager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		batch, ok := m.get(c.Param("id"), true)
+		if !ok {
+			respondBatchNotFound(c)
+			return
+		}
+		if batch.ProcessingStatus != "ended" {
+			respondBatchError(c, http.StatusBadRequest, fmt.Sprintf("Batch %s is still processing", batch.ID))
+			return
+		}
+
+		var buf bytes.Buffer
+		for _, item := range batch.Results {
+			line, err := utils.SafeMarshal(item)
+			if err != nil {
+				continue
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		c.Data(http.StatusOK, "application/x-jsonl", buf.Bytes())
+	}
+}
+
+// validateBatchRequests 校验批次请求并生成每个条目的非流式请求体
+func validateBatchRequests(items []types.MessageBatchRequestItem) ([][]byte, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("requests: at least one request is required")
+	}
+	if config.BatchMaxRequests > 0 && len(items) > config.BatchMaxRequests {
+		return nil, fmt.Errorf("requests: at most %d requests are allowed per batch", config.BatchMaxRequests)
+	}
+
+	seen := make(map[string]bool, len(items))
+	bodies := make([][]byte, len(items))
+	for i, item := range items {
+		if strings.TrimSpace(item.CustomID) == "" {
+			return nil, fmt.Errorf("requests.%d.custom_id: field required", i)
+		}
+		if seen[item.CustomID] {
+			return nil, fmt.Errorf("requests.%d.custom_id: duplicate custom_id %q", i, item.CustomID)
+		}
+		seen[item.CustomID] = true
+
+		var params map[string]any
+		if err := utils.SafeUnmarshal(item.Params, &params); err != nil || params == nil {
+			return nil, fmt.Errorf("requests.%d.params: must be a JSON object", i)
+		}
+		// 批次条目总是按非流式处理
+		params["stream"] = false
+		body, err := utils.SafeMarshal(params)
+		if err != nil {
+			return nil, fmt.Errorf("requests.%d.params: %v", i, err)
+		}
+		bodies[i] = body
+	}
+	return bodies, nil
+}
+
+// create 注册新批次并返回其初始快照
+func (m *MessageBatchManager) create(items []types.MessageBatchRequestItem) types.MessageBatch {
+	now := time.Now().UTC()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.evictExpiredUnlocked(now)
+
+	id := "msgbatch_" + strings.ReplaceAll(utils.GenerateUUID(), "-", "")
+	state := &messageBatchState{
+		batch: types.MessageBatch{
+			ID:               id,
+			Type:             "message_batch",
+			ProcessingStatus: "in_progress",
+			RequestCounts:    types.MessageBatchRequestCounts{Processing: len(items)},
+			CreatedAt:        now.Format(time.RFC3339),
+			ExpiresAt:        now.Add(batchExpiry).Format(time.RFC3339),
+		},
+		results: make([]types.MessageBatchResultItem, len(items)),
+		done:    make([]bool, len(items)),
+	}
+	m.batches[id] = state
+	return state.batch
+}
+
+// get 返回批次快照，withResults 为 true 且批次已结束时附带结果
+func (m *MessageBatchManager) get(id string, withResults bool) (types.MessageBatch, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	state, ok := m.batches[id]
+	if !ok {
+		return types.MessageBatch{}, false
+	}
+	batch := state.batch
+	if withResults && batch.ProcessingStatus == "ended" {
+		batch.Results = append([]types.MessageBatchResultItem(nil), state.results...)
+	}
+	return batch, true
+}
+
+// process 以有限并发处理批次中的全部请求
+func (m *MessageBatchManager) process(id string, items []types.MessageBatchRequestItem, bodies [][]byte, headers http.Header) {
+	startTime := time.Now()
+	sem := make(chan struct{}, m.workers)
+	var wg sync.WaitGroup
+
+	for i := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(index int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result := m.dispatch(id, items[index].CustomID, bodies[index], headers)
+			m.record(id, index, types.MessageBatchResultItem{CustomID: items[index].CustomID, Result: result})
+		}(i)
+	}
+	wg.Wait()
+
+	batch, _ := m.get(id, false)
+	logger.Info("消息批次处理完成",
+		logger.String("batch_id", id),
+		logger.Int("succeeded", batch.RequestCounts.Succeeded),
+		logger.Int("errored", batch.RequestCounts.Errored),
+		logger.Duration("duration", time.Since(startTime)))
+}
+
+// dispatch 将单个条目作为独立的 POST /v1/messages 请求交给 dispatcher 处理
+func (m *MessageBatchManager) dispatch(batchID, customID string, body []byte, headers http.Header) (result types.MessageBatchResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("批次请求处理panic",
+				logger.String("batch_id", batchID),
+				logger.String("custom_id", customID),
+				logger.Any("panic", r))
+			result = erroredBatchResult(http.StatusInternalServerError, "api_error", fmt.Sprintf("internal error: %v", r))
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return erroredBatchResult(http.StatusInternalServerError, "api_error", err.Error())
+	}
+	req.Header = headers.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", batchID+"_"+customID)
+
+	w := newBatchResponseRecorder()
+	m.dispatcher.ServeHTTP(w, req)
+
+	if w.status == http.StatusOK {
+		return types.MessageBatchResult{Type: "succeeded", Message: w.body.Bytes()}
+	}
+	errType, message := extractBatchError(w.body.Bytes())
+	if message == "" {
+		message = http.StatusText(w.status)
+	}
+	return erroredBatchResult(w.status, errType, message)
+}
+
+// record 写入单个条目结果并更新计数，全部完成时结束批次
+func (m *MessageBatchManager) record(id string, index int, item types.MessageBatchResultItem) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state, ok := m.batches[id]
+	if !ok || state.done[index] {
+		return
+	}
+	state.results[index] = item
+	state.done[index] = true
+
+	counts := &state.batch.RequestCounts
+	counts.Processing--
+	if item.Result.Type == "succeeded" {
+		counts.Succeeded++
+	} else {
+		counts.Errored++
+	}
+
+	if counts.Processing == 0 {
+		now := time.Now().UTC()
+		endedAt := now.Format(time.RFC3339)
+		resultsURL := "/v1/messages/batches/" + id + "/results"
+		state.batch.ProcessingStatus = "ended"
+		state.batch.EndedAt = &endedAt
+		state.batch.ResultsURL = &resultsURL
+		state.endedAt = now
+	}
+}
+
+// evictExpiredUnlocked 清理超过保留时间的已结束批次（调用方持有写锁）
+func (m *MessageBatchManager) evictExpiredUnlocked(now time.Time) {
+	if m.resultTTL <= 0 {
+		return
+	}
+	for id, state := range m.batches {
+		if !state.endedAt.IsZero() && now.Sub(state.endedAt) > m.resultTTL {
+			delete(m.batches, id)
+		}
+	}
+}
+
+// erroredBatchResult 构建 errored 结果，未指定错误类型时按状态码推断
+func erroredBatchResult(status int, errType, message string) types.MessageBatchResult {
+	if errType == "" {
+		errType = batchErrorTypeForStatus(status)
+	}
+	return types.MessageBatchResult{
+		Type: "errored",
+		Error: &types.BatchErrorBody{
+			Type:  "error",
+			Error: types.BatchErrorDetail{Type: errType, Message: message},
+		},
+	}
+}
+
+// batchErrorTypeForStatus HTTP状态码到Anthropic错误类型的映射
+func batchErrorTypeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case 529:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// extractBatchError 从错误响应体中提取错误类型与消息
+// 兼容 {"error":{"type","message"}}、{"error":{"message","code"}} 与 {"error":"...","message":"..."} 等格式
+func extractBatchError(body []byte) (string, string) {
+	var resp map[string]any
+	if err := utils.SafeUnmarshal(body, &resp); err != nil {
+		return "", strings.TrimSpace(string(body))
+	}
+
+	if errObj, ok := resp["error"].(map[string]any); ok {
+		errType, _ := errObj["type"].(string)
+		message, _ := errObj["message"].(string)
+		return errType, message
+	}
+
+	message, _ := resp["message"].(string)
+	if message == "" {
+		message, _ = resp["error"].(string)
+	}
+	return "", message
+}
+
+// respondBatchError 返回 invalid_request_error 格式的错误
+func respondBatchError(c *gin.Context, statusCode int, message string) {
+	c.JSON(statusCode, gin.H{
+		"error": gin.H{
+			"type":    batchErrorTypeForStatus(statusCode),
+			"message": message,
+		},
+	})
+}
+
+func respondBatchNotFound(c *gin.Context) {
+	respondBatchError(c, http.StatusNotFound, fmt.Sprintf("Batch %s not found", c.Param("id")))
+}
+
+// readBatchBody 读取请求体（读取失败时返回空，由后续解析报错）
+func readBatchBody(c *gin.Context) []byte {
+	body, err := c.GetRawData()
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// batchResponseRecorder 捕获内部分发请求的响应
+type batchResponseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBatchResponseRecorder() *batchResponseRecorder {
+	return &batchResponseRecorder{header: make(http.Header), status: http.StatusOK}
+}
+
+func (r *batchResponseRecorder) Header() http.Header { return r.header }
+
+func (r *batchResponseRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+
+func (r *batchResponseRecorder) WriteHeader(statusCode int) { r.status = statusCode }
+
+// Flush 满足 http.Flusher，非流式请求不会实际使用
+func (r *batchResponseRecorder) Flush() {}
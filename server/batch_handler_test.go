@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBatchTestRouter 创建带批次端点的路由，/v1/messages 由 messagesHandler 模拟
+func newBatchTestRouter(messagesHandler gin.HandlerFunc) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/v1/messages", messagesHandler)
+
+	manager := NewMessageBatchManager(router)
+	router.POST("/v1/messages/batches", handleCreateMessageBatch(manager))
+	router.GET("/v1/messages/batches/:id", handleGetMessageBatch(manager))
+	router.GET("/v1/messages/batches/:id/results", handleGetMessageBatchResults(manager))
+	return router
+}
+
+func performBatchRequest(router *gin.Engine, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer test-key")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func waitForBatchEnded(t *testing.T, router *gin.Engine, id string) types.MessageBatch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w := performBatchRequest(router, "GET", "/v1/messages/batches/"+id, "")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var batch types.MessageBatch
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &batch))
+		if batch.ProcessingStatus == "ended" {
+			return batch
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("批次 %s 未在超时前结束", id)
+	return types.MessageBatch{}
+}
+
+func TestMessageBatches_ProcessesEntries(t *testing.T) {
+	var calls atomic.Int32
+	router := newBatchTestRouter(func(c *gin.Context) {
+		calls.Add(1)
+		assert.Equal(t, "Bearer test-key", c.GetHeader("Authorization"), "认证头应转发给内部请求")
+
+		var req map[string]any
+		require.NoError(t, c.ShouldBindJSON(&req))
+		assert.Equal(t, false, req["stream"], "批次条目应强制非流式")
+
+		if req["model"] == "bad-model" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": gin.H{"type": "invalid_request_error", "message": "unknown model"}})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"type": "message", "role": "assistant", "model": req["model"]})
+	})
+
+	body := `{"requests":[
+		{"custom_id":"ok","params":{"model":"claude-sonnet-4","max_tokens":16,"stream":true,"messages":[{"role":"user","content":"hi"}]}},
+		{"custom_id":"fail","params":{"model":"bad-model","max_tokens":16,"messages":[{"role":"user","content":"hi"}]}}
+	]}`
+	w := performBatchRequest(router, "POST", "/v1/messages/batches", body)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var created types.MessageBatch
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.ID, "msgbatch_"))
+	assert.Equal(t, "message_batch", created.Type)
+
+	batch := waitForBatchEnded(t, router, created.ID)
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, 1, batch.RequestCounts.Succeeded)
+	assert.Equal(t, 1, batch.RequestCounts.Errored)
+	assert.Equal(t, 0, batch.RequestCounts.Processing)
+	require.NotNil(t, batch.ResultsURL)
+	require.Len(t, batch.Results, 2)
+
+	assert.Equal(t, "ok", batch.Results[0].CustomID)
+	assert.Equal(t, "succeeded", batch.Results[0].Result.Type)
+	var message map[string]any
+	require.NoError(t, json.Unmarshal(batch.Results[0].Result.Message, &message))
+	assert.Equal(t, "claude-sonnet-4", message["model"])
+
+	assert.Equal(t, "fail", batch.Results[1].CustomID)
+	assert.Equal(t, "errored", batch.Results[1].Result.Type)
+	require.NotNil(t, batch.Results[1].Result.Error)
+	assert.Equal(t, "invalid_request_error", batch.Results[1].Result.Error.Error.Type)
+	assert.Equal(t, "unknown model", batch.Results[1].Result.Error.Error.Message)
+
+	results := performBatchRequest(router, "GET", *batch.ResultsURL, "")
+	require.Equal(t, http.StatusOK, results.Code)
+	lines := strings.Split(strings.TrimSpace(results.Body.String()), "\n")
+	assert.Len(t, lines, 2)
+}
+
+func TestMessageBatches_ValidatesRequests(t *testing.T) {
+	router := newBatchTestRouter(func(c *gin.Context) {
+		t.Error("校验失败的批次不应分发请求")
+	})
+
+	cases := map[string]string{
+		"empty":             `{"requests":[]}`,
+		"missing custom_id": `{"requests":[{"params":{"model":"m"}}]}`,
+		"duplicate":         `{"requests":[{"custom_id":"a","params":{}},{"custom_id":"a","params":{}}]}`,
+		"params not object": `{"requests":[{"custom_id":"a","params":"text"}]}`,
+		"malformed":         `{"requests":`,
+	}
+	for name, body := range cases {
+		w := performBatchRequest(router, "POST", "/v1/messages/batches", body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, name)
+		assert.Contains(t, w.Body.String(), "invalid_request_error", name)
+	}
+}
+
+func TestMessageBatches_UnknownBatch(t *testing.T) {
+	router := newBatchTestRouter(func(c *gin.Context) {})
+
+	assert.Equal(t, http.StatusNotFound, performBatchRequest(router, "GET", "/v1/messages/batches/msgbatch_missing", "").Code)
+	assert.Equal(t, http.StatusNotFound, performBatchRequest(router, "GET", "/v1/messages/batches/msgbatch_missing/results", "").Code)
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ClientRateLimiterConfig 客户端限流配置
+type ClientRateLimiterConfig struct {
+	RequestsPerMinute    int           // 每分钟请求数（令牌补充速率），<=0 表示不限制
+	Burst                int           // 令牌桶容量，<=0 时等于 RequestsPerMinute
+	MaxConcurrentStreams int           // 每个客户端最大并发流式请求数，<=0 表示不限制
+	IdleTTL              time.Duration // 空闲客户端状态保留时间
+}
+
+// DefaultClientRateLimiterConfig 默认配置（从config包读取）
+func DefaultClientRateLimiterConfig() ClientRateLimiterConfig {
+	return ClientRateLimiterConfig{
+		RequestsPerMinute:    config.ClientRateLimitRequestsPerMinute,
+		Burst:                config.ClientRateLimitBurst,
+		MaxConcurrentStreams: config.ClientRateLimitMaxConcurrentStreams,
+		IdleTTL:              config.ClientRateLimitIdleTTL,
+	}
+}
+
+// clientBucket 单个客户端的限流状态
+type clientBucket struct {
+	tokens        float64
+	lastRefill    time.Time
+	lastSeen      time.Time
+	activeStreams int
+}
+
+// ClientRateLimiter 按客户端身份的令牌桶限流器（内存实现）
+type ClientRateLimiter struct {
+	cfg     ClientRateLimiterConfig
+	rate    float64 // 每秒补充的令牌数
+	burst   float64
+	clients map[string]*clientBucket
+	mutex   sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewClientRateLimiter 创建客户端限流器并启动清理goroutine
+func NewClientRateLimiter(cfg ClientRateLimiterConfig) *ClientRateLimiter {
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.RequestsPerMinute
+	}
+	if cfg.IdleTTL <= 0 {
+		cfg.IdleTTL = 10 * time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	rl := &ClientRateLimiter{
+		cfg:     cfg,
+		rate:    float64(cfg.RequestsPerMinute) / 60.0,
+		burst:   float64(burst),
+		clients: make(map[string]*clientBucket),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go rl.cleanupLoop()
+	return rl
+}
+
+// Allow 尝试为客户端消耗一个令牌
+// 返回是否允许以及被拒绝时建议的重试等待时间
+func (rl *ClientRateLimiter) Allow(clientID string) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	bucket := rl.getOrCreateBucketUnlocked(clientID)
+	if rl.cfg.RequestsPerMinute <= 0 {
+		return true, 0
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(bucket.lastRefill).Seconds()
+	bucket.tokens = math.Min(rl.burst, bucket.tokens+elapsed*rl.rate)
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// AcquireStream 占用一个并发流名额，返回是否成功
+func (rl *ClientRateLimiter) AcquireStream(clientID string) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	bucket := rl.getOrCreateBucketUnlocked(clientID)
+	if rl.cfg.MaxConcurrentStreams > 0 && bucket.activeStreams >= rl.cfg.MaxConcurrentStreams {
+		return false
+	}
+	bucket.activeStreams++
+	return true
+}
+
+// ReleaseStream 释放一个并发流名额
+func (rl *ClientRateLimiter) ReleaseStream(clientID string) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if bucket, exists := rl.clients[clientID]; exists && bucket.activeStreams > 0 {
+		bucket.activeStreams--
+		bucket.lastSeen = time.Now()
+	}
+}
+
+// getOrCreateBucketUnlocked 获取或创建客户端状态（调用者必须持有锁）
+func (rl *ClientRateLimiter) getOrCreateBucketUnlocked(clientID string) *clientBucket {
+	now := time.Now()
+	bucket, exists := rl.clients[clientID]
+	if !exists {
+		bucket = &clientBucket{
+			tokens:     rl.burst,
+			lastRefill: now,
+		}
+		rl.clients[clientID] = bucket
+	}
+	bucket.lastSeen = now
+	return bucket
+}
+
+// cleanupLoop 定期清理空闲客户端
+func (rl *ClientRateLimiter) cleanupLoop() {
+	ticker := time.NewTicker(rl.cfg.IdleTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rl.ctx.Done():
+			return
+		case <-ticker.C:
+			rl.cleanup()
+		}
+	}
+}
+
+// cleanup 清理超过 IdleTTL 未活动且没有进行中流的客户端
+func (rl *ClientRateLimiter) cleanup() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := time.Now()
+	expiredCount := 0
+	for clientID, bucket := range rl.clients {
+		if bucket.activeStreams == 0 && now.Sub(bucket.lastSeen) > rl.cfg.IdleTTL {
+			delete(rl.clients, clientID)
+			expiredCount++
+		}
+	}
+
+	if expiredCount > 0 {
+		logger.Debug("客户端限流状态清理完成",
+			logger.Int("expired_count", expiredCount),
+			logger.Int("remaining_count", len(rl.clients)))
+	}
+}
+
+// Stop 停止清理goroutine
+func (rl *ClientRateLimiter) Stop() {
+	if rl.cancel != nil {
+		rl.cancel()
+	}
+}
+
+// clientIdentity 根据客户端提供的API密钥生成身份标识（不保留明文）
+func clientIdentity(c *gin.Context) string {
+	if tokenID := c.GetString(clientTokenIDContextKey); tokenID != "" {
+		return tokenID
+	}
+	apiKey := extractAPIKey(c)
+	if apiKey == "" {
+		return "anonymous:" + c.ClientIP()
+	}
+	return config.ClientTokenID(apiKey)
+}
+
+// isStreamRequest 读取请求体判断是否为流式请求，并恢复请求体供后续处理
+func isStreamRequest(c *gin.Context) bool {
+	if c.Request.Body == nil || c.Request.Method != http.MethodPost {
+		return false
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+
+	var req struct {
+		Stream bool `json:"stream"`
+	}
+	if err := utils.SafeUnmarshal(body, &req); err != nil {
+		return false
+	}
+	return req.Stream
+}
+
+// ClientRateLimitMiddleware 按客户端身份限流（请求速率 + 并发流）
+// 仅作用于指定前缀的路径，应放在认证中间件之后
+func ClientRateLimitMiddleware(limiter *ClientRateLimiter, protectedPrefixes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if limiter == nil || !requiresAuth(c.Request.URL.Path, protectedPrefixes) {
+			c.Next()
+			return
+		}
+
+		clientID := clientIdentity(c)
+
+		if allowed, retryAfter := limiter.Allow(clientID); !allowed {
+			logger.Warn("客户端请求频率超限",
+				logger.String("client_id", clientID),
+				logger.String("path", c.Request.URL.Path),
+				logger.Duration("retry_after", retryAfter))
+			respondClientRateLimited(c, retryAfter, "请求频率超过限制，请稍后重试")
+			return
+		}
+
+		if limiter.cfg.MaxConcurrentStreams > 0 && isStreamRequest(c) {
+			if !limiter.AcquireStream(clientID) {
+				logger.Warn("客户端并发流超限",
+					logger.String("client_id", clientID),
+					logger.Int("max_concurrent_streams", limiter.cfg.MaxConcurrentStreams))
+				respondClientRateLimited(c, time.Second, "并发流式请求数超过限制，请稍后重试")
+				return
+			}
+			defer limiter.ReleaseStream(clientID)
+		}
+
+		c.Next()
+	}
+}
+
+// UserRateLimitMiddleware 按 metadata.user_id 标识的终端用户限流（多个用户共享同一客户端密钥时区分用户）
+// 未携带 metadata.user_id 的请求不受影响；应放在 MetadataUserIDMiddleware 之后
+func UserRateLimitMiddleware(limiter *ClientRateLimiter, protectedPrefixes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userHash := requestUserHash(c)
+		if limiter == nil || userHash == "" || !requiresAuth(c.Request.URL.Path, protectedPrefixes) {
+			c.Next()
+			return
+		}
+
+		if allowed, retryAfter := limiter.Allow("user:" + userHash); !allowed {
+			logger.Warn("终端用户请求频率超限",
+				logger.String("client_id", clientIdentity(c)),
+				logger.String("user_hash", userHash),
+				logger.String("path", c.Request.URL.Path),
+				logger.Duration("retry_after", retryAfter))
+			respondClientRateLimited(c, retryAfter, "请求频率超过限制，请稍后重试")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// respondClientRateLimited 返回 Claude 规范的 429 错误
+func respondClientRateLimited(c *gin.Context, retryAfter time.Duration, message string) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "rate_limit_error",
+			"message": message,
+		},
+	})
+}
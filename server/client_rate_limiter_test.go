@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRateLimiter_TokenBucket(t *testing.T) {
+	rl := NewClientRateLimiter(ClientRateLimiterConfig{RequestsPerMinute: 60, Burst: 2})
+	defer rl.Stop()
+
+	allowed, _ := rl.Allow("client:a")
+	assert.True(t, allowed)
+	allowed, _ = rl.Allow("client:a")
+	assert.True(t, allowed)
+
+	allowed, retryAfter := rl.Allow("client:a")
+	assert.False(t, allowed, "超过突发容量后应被拒绝")
+	assert.Greater(t, retryAfter, time.Duration(0))
+
+	// 不同客户端互不影响
+	allowed, _ = rl.Allow("client:b")
+	assert.True(t, allowed)
+}
+
+func TestClientRateLimiter_ConcurrentStreams(t *testing.T) {
+	rl := NewClientRateLimiter(ClientRateLimiterConfig{MaxConcurrentStreams: 1})
+	defer rl.Stop()
+
+	assert.True(t, rl.AcquireStream("client:a"))
+	assert.False(t, rl.AcquireStream("client:a"))
+	rl.ReleaseStream("client:a")
+	assert.True(t, rl.AcquireStream("client:a"))
+}
+
+func TestClientRateLimiter_CleanupKeepsActiveStreams(t *testing.T) {
+	rl := NewClientRateLimiter(ClientRateLimiterConfig{MaxConcurrentStreams: 2, IdleTTL: time.Millisecond})
+	defer rl.Stop()
+
+	rl.AcquireStream("client:busy")
+	rl.Allow("client:idle")
+	time.Sleep(5 * time.Millisecond)
+	rl.cleanup()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	assert.Contains(t, rl.clients, "client:busy")
+	assert.NotContains(t, rl.clients, "client:idle")
+}
+
+func TestClientRateLimitMiddleware_Returns429(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rl := NewClientRateLimiter(ClientRateLimiterConfig{RequestsPerMinute: 60, Burst: 1})
+	defer rl.Stop()
+
+	router := gin.New()
+	router.Use(ClientRateLimitMiddleware(rl, []string{"/v1"}))
+	router.POST("/v1/messages", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"stream":true}`))
+		req.Header.Set("Authorization", "Bearer teammate-key")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusOK, send().Code)
+
+	w := send()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"rate_limit_error"`)
+}
+
+func TestClientRateLimitMiddleware_StreamBodyPreserved(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rl := NewClientRateLimiter(ClientRateLimiterConfig{MaxConcurrentStreams: 1})
+	defer rl.Stop()
+
+	router := gin.New()
+	router.Use(ClientRateLimitMiddleware(rl, []string{"/v1"}))
+	router.POST("/v1/messages", func(c *gin.Context) {
+		body, _ := c.GetRawData()
+		c.String(http.StatusOK, string(body))
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"stream":true,"model":"x"}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{"stream":true,"model":"x"}`, w.Body.String())
+}
+
+func TestUserRateLimitMiddleware_LimitsPerMetadataUserID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	rl := NewClientRateLimiter(ClientRateLimiterConfig{RequestsPerMinute: 60, Burst: 1})
+	defer rl.Stop()
+
+	router := gin.New()
+	router.Use(MetadataUserIDMiddleware([]string{"/v1/messages"}))
+	router.Use(UserRateLimitMiddleware(rl, []string{"/v1"}))
+	router.POST("/v1/messages", func(c *gin.Context) {
+		body, _ := c.GetRawData()
+		c.String(http.StatusOK, requestUserHash(c)+"|"+string(body))
+	})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)))
+		return w
+	}
+
+	alice := `{"metadata":{"user_id":"alice"}}`
+	w := send(alice)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "alice|", "日志标识应为哈希而不是明文")
+	assert.True(t, strings.HasSuffix(w.Body.String(), "|"+alice), "请求体应被恢复")
+
+	assert.Equal(t, http.StatusTooManyRequests, send(alice).Code)
+	// 不同用户与未携带 user_id 的请求互不影响
+	assert.Equal(t, http.StatusOK, send(`{"metadata":{"user_id":"bob"}}`).Code)
+	assert.Equal(t, http.StatusOK, send(`{}`).Code)
+	assert.Equal(t, http.StatusOK, send(`{}`).Code)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleClientTokensStatus 返回当前生效的客户端token标识（不返回明文）
+// 标识与访问日志、客户端限流中的 client_token_id 一致，可据此定位调用方
+func handleClientTokensStatus(c *gin.Context) {
+	ids := config.ClientTokenIDs()
+	c.JSON(http.StatusOK, gin.H{
+		"count":     len(ids),
+		"token_ids": ids,
+	})
+}
+
+// handleClientTokensReload 重新读取 KIRO_CLIENT_TOKEN / KIRO_CLIENT_TOKENS / KIRO_CLIENT_TOKENS_FILE 并替换生效的token列表
+// 吊销调用方只需从 KIRO_CLIENT_TOKENS_FILE 中移除其token后调用本接口（环境变量在运行中不会变化）；读取失败或结果为空时保留当前列表
+func handleClientTokensReload(c *gin.Context) {
+	tokens, err := config.ReadClientTokens()
+	if err != nil {
+		logger.Warn("重新加载客户端token失败", logger.Err(err))
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(tokens) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no client tokens configured, keeping current tokens"})
+		return
+	}
+
+	previous := len(config.ClientTokenIDs())
+	config.SetClientTokens(tokens)
+	ids := config.ClientTokenIDs()
+	logger.Info("客户端token已重新加载",
+		logger.Int("previous_count", previous),
+		logger.Int("count", len(ids)))
+
+	c.JSON(http.StatusOK, gin.H{
+		"count":     len(ids),
+		"token_ids": ids,
+	})
+}
@@ -2,10 +2,14 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,6 +17,7 @@ import (
 	"kiro2api/config"
 	"kiro2api/converter"
 	"kiro2api/logger"
+	"kiro2api/metrics"
 	"kiro2api/types"
 	"kiro2api/utils"
 
@@ -24,7 +29,7 @@ import (
 type AuthServiceWithFingerprint interface {
 	GetToken() (types.TokenInfo, error)
 	GetTokenWithFingerprint() (types.TokenInfo, *auth.Fingerprint, error)
-	MarkTokenFailed()
+	MarkTokenFailed(tokenKey string)
 }
 
 // AuthServiceWithSession 带会话绑定的认证服务接口
@@ -32,7 +37,19 @@ type AuthServiceWithSession interface {
 	GetToken() (types.TokenInfo, error)
 	GetTokenWithFingerprint() (types.TokenInfo, *auth.Fingerprint, error)
 	GetTokenWithFingerprintForSession(sessionID string) (types.TokenInfo, *auth.Fingerprint, string, error)
-	MarkTokenFailed()
+	MarkTokenFailed(tokenKey string)
+}
+
+// AuthServiceWithExhaustion 支持标记 token 额度耗尽
+type AuthServiceWithExhaustion interface {
+	MarkTokenExhausted(tokenKey string)
+}
+
+// AuthServiceWithCircuitBreaker 支持按token记录请求结果（熔断器）
+type AuthServiceWithCircuitBreaker interface {
+	MarkTokenSucceeded(tokenKey string)
+	RecordTokenError(tokenKey string)
+	GetCircuitBreakerStatus(tokenKey string) auth.CircuitBreakerStatus
 }
 
 // AuthServiceWithModel 支持按模型获取 token
@@ -50,6 +67,26 @@ type AuthServiceWithSessionForModel interface {
 	GetTokenWithFingerprintForSessionAndModel(sessionID string, model string) (types.TokenInfo, *auth.Fingerprint, string, error)
 }
 
+// AuthServiceWithSessionForModelContext 支持按模型获取会话绑定 token，等待可用 token 时响应请求取消
+type AuthServiceWithSessionForModelContext interface {
+	GetTokenWithFingerprintForSessionAndModelContext(ctx context.Context, sessionID string, model string) (types.TokenInfo, *auth.Fingerprint, string, error)
+}
+
+// AuthServiceWithTokenProxy 支持查询token绑定的出口代理
+type AuthServiceWithTokenProxy interface {
+	GetTokenProxy(tokenKey string) string
+}
+
+// AuthServiceWithTokenIndex 支持直接使用指定配置索引的token（X-Kiro-Token-Index）
+type AuthServiceWithTokenIndex interface {
+	GetTokenWithFingerprintForIndex(index int) (types.TokenInfo, *auth.Fingerprint, string, error)
+}
+
+// AuthServiceWithTokenAccountLevel 支持查询token的账号等级
+type AuthServiceWithTokenAccountLevel interface {
+	GetTokenAccountLevel(tokenKey string) auth.AccountLevel
+}
+
 // getRequestFingerprint 从上下文获取请求指纹
 func getRequestFingerprint(c *gin.Context) *auth.Fingerprint {
 	if fp, exists := c.Get("request_fingerprint"); exists {
@@ -93,11 +130,33 @@ func respondError(c *gin.Context, statusCode int, format string, args ...any) {
 
 // 通用请求处理错误函数
 func handleRequestBuildError(c *gin.Context, err error) {
+	var tooLarge *RequestTooLargeError
+	if errors.As(err, &tooLarge) {
+		respondRequestTooLarge(c, tooLarge)
+		return
+	}
 	logger.Error("构建请求失败", addReqFields(c, logger.Err(err))...)
 	respondError(c, http.StatusInternalServerError, "构建请求失败: %v", err)
 }
 
 func handleRequestSendError(c *gin.Context, err error) {
+	// 客户端已断开：上游请求随之取消，无需再响应
+	if errors.Is(err, context.Canceled) {
+		logger.Info("客户端已断开，取消上游请求", addReqFields(c, logger.Err(err))...)
+		return
+	}
+	// 超过 MAX_CONCURRENT_UPSTREAM 且无法排队
+	if isUpstreamLimitError(err) {
+		respondUpstreamBusy(c, err)
+		return
+	}
+	// 超过 UPSTREAM_TIMEOUT / UPSTREAM_CONNECT_TIMEOUT
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		logger.Error("上游请求超时", addReqFields(c, logger.Err(err))...)
+		respondError(c, http.StatusGatewayTimeout, "上游请求超时: %v", err)
+		return
+	}
 	logger.Error("发送请求失败", addReqFields(c, logger.Err(err))...)
 	respondError(c, http.StatusInternalServerError, "发送请求失败: %v", err)
 }
@@ -119,16 +178,30 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 		return nil, err
 	}
 
-	resp, err := utils.DoRequest(req)
+	tokenKey := c.GetString("token_key")
+	start := time.Now()
+	resp, err := doUpstreamRequestWithNetRetry(c, req)
+	return finishCodeWhispererRequest(c, tokenKey, start, resp, err)
+}
+
+// finishCodeWhispererRequest 记录一次上游请求的结果（token统计、熔断状态、访问日志），失败时写入错误响应
+// resp/err 为 doUpstreamRequestWithNetRetry 的返回值；上游返回错误状态码时关闭响应体
+func finishCodeWhispererRequest(c *gin.Context, tokenKey string, start time.Time, resp *http.Response, err error) (*http.Response, error) {
 	if err != nil {
+		recordTokenRequest(c, tokenKey, start, false)
 		handleRequestSendError(c, err)
 		return nil, err
 	}
+	metrics.RecordTokenRequest(tokenKey)
+	recordAccessUpstream(c, resp.StatusCode)
 
 	if handleCodeWhispererError(c, resp) {
+		recordTokenRequest(c, tokenKey, start, false)
 		resp.Body.Close()
 		return nil, fmt.Errorf("CodeWhisperer API error")
 	}
+	recordTokenRequest(c, tokenKey, start, true)
+	markTokenSucceeded(c)
 
 	// 上游响应成功，记录方向与会话
 	logger.Debug("上游响应成功",
@@ -143,17 +216,12 @@ func executeCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReq
 // executeCodeWhispererRequestWithRetry 带429重试的请求执行函数
 // 当启用会话池时，遇到429会自动切换Token重试
 func executeCodeWhispererRequestWithRetry(c *gin.Context, anthropicReq types.AnthropicRequest, isStream bool) (*http.Response, error) {
-	sessionID, _ := c.Get("session_id")
-	sessionIDStr, _ := sessionID.(string)
-	if sessionIDStr == "" {
-		sessionIDStr = auth.ExtractSessionID(map[string]string{
-			"X-Session-ID": c.GetHeader("X-Session-ID"),
-			"X-Request-ID": c.GetHeader("X-Request-ID"),
-		})
-	}
+	sessionIDStr := requestSessionID(c)
 
 	poolManager := auth.GetSessionTokenPoolManager()
 	maxRetries := config.SessionPoolMaxRetries
+	// 429 重试间隔使用指数退避 + 抖动，避免连续 429 时以固定频率请求上游
+	retrier := NewExponentialBackoffRetrier(nil)
 
 	var lastResp *http.Response
 	var currentTokenKey string
@@ -200,14 +268,21 @@ func executeCodeWhispererRequestWithRetry(c *gin.Context, anthropicReq types.Ant
 			return nil, err
 		}
 
-		resp, err := utils.DoRequest(req)
+		start := time.Now()
+		resp, err := doUpstreamRequest(c, req)
 		if err != nil {
+			recordTokenRequest(c, currentTokenKey, start, false)
 			handleRequestSendError(c, err)
 			return nil, err
 		}
+		metrics.RecordTokenRequest(currentTokenKey)
+		recordAccessUpstream(c, resp.StatusCode)
 
 		// 检查是否为429
+		// 429 是瞬态限流，在会话池中冷却该token，并单独计入 rate_limited（不计入失败次数，避免同一次限流记录两次）
 		if resp.StatusCode == http.StatusTooManyRequests {
+			metrics.RecordUpstreamError(resp.StatusCode)
+			tokenRequestStats.RecordRateLimited(currentTokenKey)
 			logger.Warn("收到429错误，尝试切换Token重试",
 				logger.String("session_id", sessionIDStr),
 				logger.String("token_key", currentTokenKey),
@@ -225,24 +300,36 @@ func executeCodeWhispererRequestWithRetry(c *gin.Context, anthropicReq types.Ant
 				logger.Error("达到最大重试次数",
 					logger.String("session_id", sessionIDStr),
 					logger.Int("retries", retry))
-				respondErrorWithCode(c, http.StatusTooManyRequests, "rate_limited", "请求过于频繁，请稍后重试")
+				errorBody := gin.H{
+					"message": "请求过于频繁，请稍后重试",
+					"code":    "rate_limited",
+				}
+				applyQuotaReset(c, errorBody, auth.ParseQuotaResetTimestamp(body))
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": errorBody})
 				return nil, fmt.Errorf("max retries exceeded")
 			}
 
-			// 等待重试间隔
+			// 等待退避时间（下一次尝试会切换Token）
+			backoff := retrier.calculateBackoff(retry)
+			logger.Debug("等待退避后重试",
+				logger.String("session_id", sessionIDStr),
+				logger.Int("retry", retry),
+				logger.Duration("backoff", backoff))
 			select {
 			case <-c.Request.Context().Done():
 				return nil, c.Request.Context().Err()
-			case <-time.After(config.SessionPoolRetryInterval):
+			case <-time.After(backoff):
 			}
 			continue
 		}
 
 		// 非429错误或成功
 		if handleCodeWhispererError(c, resp) {
+			recordTokenRequest(c, currentTokenKey, start, false)
 			resp.Body.Close()
 			return nil, fmt.Errorf("CodeWhisperer API error")
 		}
+		recordTokenRequest(c, currentTokenKey, start, true)
 
 		// 成功
 		poolManager.MarkTokenSuccess(sessionIDStr, currentTokenKey)
@@ -259,11 +346,41 @@ func executeCodeWhispererRequestWithRetry(c *gin.Context, anthropicReq types.Ant
 	return lastResp, fmt.Errorf("unexpected retry loop exit")
 }
 
+// requestSessionID 获取会话级账号池使用的会话ID
+func requestSessionID(c *gin.Context) string {
+	sessionID, _ := c.Get("session_id")
+	sessionIDStr, _ := sessionID.(string)
+	if sessionIDStr == "" {
+		sessionIDStr = auth.ExtractSessionID(map[string]string{
+			"X-Session-ID": c.GetHeader("X-Session-ID"),
+			"X-Request-ID": c.GetHeader("X-Request-ID"),
+		})
+	}
+	return sessionIDStr
+}
+
 // execCWRequest 供测试覆盖的请求执行入口（可在测试中替换）
 var execCWRequest = executeCodeWhispererRequest
 
 // buildCodeWhispererRequest 构建通用的CodeWhisperer请求
 func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Request, error) {
+	req, err := newCodeWhispererRequest(c, anthropicReq, tokenInfo, isStream)
+	if err != nil {
+		return nil, err
+	}
+
+	// 出口代理：优先使用token绑定的代理，否则回退到全局代理池
+	if proxyURL := resolveUpstreamProxy(c); proxyURL != "" {
+		req = req.WithContext(utils.WithProxyURL(req.Context(), proxyURL))
+	}
+
+	return req, nil
+}
+
+// newCodeWhispererRequest 转换请求并设置上游请求头（不选择出口代理，供请求预览复用）
+func newCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo, isStream bool) (*http.Request, error) {
+	anthropicReq.MaxTokens = capMaxTokensForAccountLevel(c, anthropicReq.MaxTokens)
+
 	cwReq, err := converter.BuildCodeWhispererRequest(anthropicReq, c)
 	if err != nil {
 		// 检查是否是模型未找到错误
@@ -280,6 +397,12 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		return nil, fmt.Errorf("序列化请求失败: %v", err)
 	}
 
+	// 请求体超过 UPSTREAM_REQUEST_MAX_BYTES 时预先截断历史或拒绝，避免白白请求上游
+	cwReq, cwReqBody, err = enforceUpstreamRequestSize(c, anthropicReq, cwReq, cwReqBody)
+	if err != nil {
+		return nil, err
+	}
+
 	// 临时调试：记录发送给CodeWhisperer的请求内容
 	// 补充：当工具直传启用时输出工具名称预览
 	var toolNamesPreview string
@@ -300,7 +423,12 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		logger.Int("tools_count", len(cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools)),
 		logger.String("tools_names", toolNamesPreview))
 
-	req, err := http.NewRequest("POST", config.GetCodeWhispererURL(), bytes.NewReader(cwReqBody))
+	// 绑定客户端请求的上下文：客户端断开时立即取消上游请求
+	ctx := context.Background()
+	if c.Request != nil {
+		ctx = c.Request.Context()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", config.GetCodeWhispererURL(), bytes.NewReader(cwReqBody))
 	if err != nil {
 		return nil, fmt.Errorf("创建请求失败: %v", err)
 	}
@@ -314,11 +442,14 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	}
 
 	// 添加上游请求必需的header（借鉴 kiro.rs）
-	req.Header.Set("x-amzn-kiro-agent-mode", "vibe")             // kiro.rs 使用 "vibe"
-	req.Header.Set("x-amzn-codewhisperer-optout", "true")        // 借鉴 kiro.rs
-	req.Header.Set("amz-sdk-invocation-id", uuid.New().String()) // 借鉴 kiro.rs：请求追踪ID
-	req.Header.Set("amz-sdk-request", "attempt=1; max=3")        // 借鉴 kiro.rs：重试配置
-	req.Header.Set("Host", config.GetCodeWhispererHost())         // 与 kiro.rs 对齐：设置 Host 头
+	invocationID := uuid.New().String()
+	req.Header.Set("x-amzn-kiro-agent-mode", "vibe")      // kiro.rs 使用 "vibe"
+	req.Header.Set("x-amzn-codewhisperer-optout", "true") // 借鉴 kiro.rs
+	req.Header.Set("amz-sdk-invocation-id", invocationID) // 借鉴 kiro.rs：请求追踪ID
+	req.Header.Set("amz-sdk-request", "attempt=1; max=3") // 借鉴 kiro.rs：重试配置
+	req.Header.Set("Host", config.GetCodeWhispererHost()) // 与 kiro.rs 对齐：设置 Host 头
+	// 错误响应中返回上游调用ID，便于与上游请求对应
+	c.Set(upstreamInvocationIDContextKey, invocationID)
 
 	// 使用指纹管理器获取随机化的请求头
 	fingerprint := getRequestFingerprint(c)
@@ -336,12 +467,76 @@ func buildCodeWhispererRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		req.Header.Set("user-agent", "aws-sdk-js/1.0.27 ua/2.1 os/darwin#24.6.0 lang/js md/nodejs#22.21.1 api/codewhispererstreaming#1.0.27 m/E KiroIDE-0.9.2-66c23a8c5d15afabec89ef9954ef52a119f10d369df04d548fc6c1eac694b0d1")
 		req.Header.Set("Accept-Language", "en-US,en;q=0.9")
 		req.Header.Set("Accept-Encoding", "gzip, deflate, br")
-		req.Header.Set("Connection", "close") // 借鉴 kiro.rs 使用 close
+		req.Header.Set("Connection", fallbackConnectionHeader())
 	}
 
+	// FORWARD_HEADERS 白名单中的客户端请求头
+	applyForwardHeaders(c, req)
+
 	return req, nil
 }
 
+// fallbackConnectionHeader 未使用指纹时的 Connection 头
+// 默认 keep-alive 复用连接池中的连接，避免每个请求重新握手TLS；UPSTREAM_FORCE_CONNECTION_CLOSE=true 时使用 close（与 kiro.rs 一致）
+func fallbackConnectionHeader() string {
+	if config.UpstreamForceConnectionClose {
+		return "close"
+	}
+	return "keep-alive"
+}
+
+// capMaxTokensForAccountLevel 将 max_tokens 截断到所选token账号等级的上限（MAX_TOKENS_CAP_*）
+// 未选定token或该等级未配置上限时原样返回
+func capMaxTokensForAccountLevel(c *gin.Context, maxTokens int) int {
+	tokenKey := c.GetString("token_key")
+	v, exists := c.Get("auth_service")
+	if !exists || tokenKey == "" {
+		return maxTokens
+	}
+	provider, ok := v.(AuthServiceWithTokenAccountLevel)
+	if !ok {
+		return maxTokens
+	}
+
+	level := provider.GetTokenAccountLevel(tokenKey)
+	ceiling := auth.MaxTokensCapForLevel(level)
+	if ceiling <= 0 || maxTokens <= ceiling {
+		return maxTokens
+	}
+
+	logger.Info("max_tokens 超过账号等级上限，已截断",
+		addReqFields(c,
+			logger.String("token_key", tokenKey),
+			logger.String("account_level", string(level)),
+			logger.Int("original_max_tokens", maxTokens),
+			logger.Int("capped_max_tokens", ceiling),
+		)...)
+	return ceiling
+}
+
+// resolveUpstreamProxy 解析本次上游请求的出口代理
+// 选中的token绑定了代理时使用该代理，否则从全局代理池选取（未启用代理池返回空，使用默认客户端）
+func resolveUpstreamProxy(c *gin.Context) string {
+	tokenKey := c.GetString("token_key")
+	if v, exists := c.Get("auth_service"); exists && tokenKey != "" {
+		if provider, ok := v.(AuthServiceWithTokenProxy); ok {
+			if proxyURL := provider.GetTokenProxy(tokenKey); proxyURL != "" {
+				logger.Debug("使用token绑定的出口代理",
+					addReqFields(c, logger.String("token_key", tokenKey))...)
+				return proxyURL
+			}
+		}
+	}
+
+	if pool := auth.GetProxyPool(); pool.IsEnabled() {
+		if proxyURL, proxyInfo := pool.GetProxyURL(); proxyURL != nil {
+			pool.RecordUse(proxyInfo)
+			return proxyURL.String()
+		}
+	}
+	return ""
+}
+
 // handleCodeWhispererError 处理 CodeWhisperer API 错误响应
 // 使用统一的 ErrorMapper 处理所有错误类型
 func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
@@ -368,6 +563,8 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 			logger.String("response_body", string(body)),
 		)...)
 
+	metrics.RecordUpstreamError(resp.StatusCode)
+
 	// 使用统一的错误映射器处理所有错误
 	errorMapper := NewErrorMapper()
 	result := errorMapper.MapCodeWhispererError(resp.StatusCode, body)
@@ -375,6 +572,14 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 	// 如果策略要求标记 token 失败，执行标记
 	if result.ShouldMarkTokenFail {
 		markTokenFailed(c)
+	} else if resp.StatusCode >= http.StatusInternalServerError {
+		// 上游5xx不触发冷却，但计入熔断，避免持续选中异常账号
+		recordTokenError(c)
+	}
+
+	// 402 月度配额耗尽：额外记录耗尽标记（持久化，重启后不会立即重试）
+	if _, ok := result.Strategy.(*PaymentRequiredStrategy); ok {
+		markTokenExhausted(c)
 	}
 
 	// 发送符合 Claude 规范的错误响应
@@ -383,19 +588,48 @@ func handleCodeWhispererError(c *gin.Context, resp *http.Response) bool {
 	return true
 }
 
-// markTokenFailed 标记当前 token 失败
+// markTokenFailed 标记当前请求使用的 token 失败
 func markTokenFailed(c *gin.Context) {
+	tokenKey := c.GetString("token_key")
 	if authService, exists := c.Get("auth_service"); exists {
 		if as, ok := authService.(AuthServiceWithSession); ok {
-			as.MarkTokenFailed()
+			as.MarkTokenFailed(tokenKey)
 			logger.Debug("已标记 token 失败（会话绑定模式）")
 		} else if as, ok := authService.(AuthServiceWithFingerprint); ok {
-			as.MarkTokenFailed()
+			as.MarkTokenFailed(tokenKey)
 			logger.Debug("已标记 token 失败（指纹模式）")
 		}
 	}
 }
 
+// markTokenSucceeded 标记当前请求使用的 token 成功（重置失败计数、关闭熔断）
+func markTokenSucceeded(c *gin.Context) {
+	if authService, exists := c.Get("auth_service"); exists {
+		if as, ok := authService.(AuthServiceWithCircuitBreaker); ok {
+			as.MarkTokenSucceeded(c.GetString("token_key"))
+		}
+	}
+}
+
+// recordTokenError 记录当前请求使用的 token 出现上游服务端错误
+func recordTokenError(c *gin.Context) {
+	if authService, exists := c.Get("auth_service"); exists {
+		if as, ok := authService.(AuthServiceWithCircuitBreaker); ok {
+			as.RecordTokenError(c.GetString("token_key"))
+		}
+	}
+}
+
+// markTokenExhausted 标记当前请求使用的 token 额度耗尽
+func markTokenExhausted(c *gin.Context) {
+	if authService, exists := c.Get("auth_service"); exists {
+		if as, ok := authService.(AuthServiceWithExhaustion); ok {
+			as.MarkTokenExhausted(c.GetString("token_key"))
+			logger.Debug("已标记 token 额度耗尽")
+		}
+	}
+}
+
 // StreamEventSender 统一的流事件发送接口
 type StreamEventSender interface {
 	SendEvent(c *gin.Context, data any) error
@@ -403,7 +637,9 @@ type StreamEventSender interface {
 }
 
 // AnthropicStreamSender Anthropic格式的流事件发送器
-type AnthropicStreamSender struct{}
+type AnthropicStreamSender struct {
+	deltaEvents int // 已发送的 content_block_delta 事件数（用于 LOG_SSE_SAMPLE_RATE 日志采样）
+}
 
 func (s *AnthropicStreamSender) SendEvent(c *gin.Context, data any) error {
 	var eventType string
@@ -420,14 +656,16 @@ func (s *AnthropicStreamSender) SendEvent(c *gin.Context, data any) error {
 		return err
 	}
 
-	// 压缩日志：仅记录事件类型与负载长度
-	logger.Debug("发送SSE事件",
-		addReqFields(c,
-			logger.String("direction", "downstream_send"),
-			logger.String("event", eventType),
-			logger.Int("payload_len", len(json)),
-			logger.String("payload_preview", string(json)),
-		)...)
+	// 压缩日志：仅记录事件类型与负载长度；content_block_delta 按 LOG_SSE_SAMPLE_RATE 采样
+	if s.shouldLogEvent(eventType) {
+		logger.Debug("发送SSE事件",
+			addReqFields(c,
+				logger.String("direction", "downstream_send"),
+				logger.String("event", eventType),
+				logger.Int("payload_len", len(json)),
+				logger.String("payload_preview", string(json)),
+			)...)
+	}
 
 	fmt.Fprintf(c.Writer, "event: %s\n", eventType)
 	fmt.Fprintf(c.Writer, "data: %s\n\n", string(json))
@@ -435,21 +673,43 @@ func (s *AnthropicStreamSender) SendEvent(c *gin.Context, data any) error {
 	return nil
 }
 
+// shouldLogEvent 判断是否记录该SSE事件的调试日志：非 delta 事件始终记录，delta 事件每 LOG_SSE_SAMPLE_RATE 个记录一次
+func (s *AnthropicStreamSender) shouldLogEvent(eventType string) bool {
+	if eventType != "content_block_delta" {
+		return true
+	}
+	s.deltaEvents++
+	rate := config.LogSSESampleRate
+	if rate <= 0 {
+		return false
+	}
+	return (s.deltaEvents-1)%rate == 0
+}
+
 func (s *AnthropicStreamSender) SendError(c *gin.Context, message string, _ error) error {
+	errorBody := map[string]any{
+		"type":    "overloaded_error",
+		"message": message,
+	}
+	applyErrorTrace(c, errorBody)
 	errorResp := map[string]any{
-		"type": "error",
-		"error": map[string]any{
-			"type":    "overloaded_error",
-			"message": message,
-		},
+		"type":  "error",
+		"error": errorBody,
 	}
 	return s.SendEvent(c, errorResp)
 }
 
 // OpenAIStreamSender OpenAI格式的流事件发送器
-type OpenAIStreamSender struct{}
+type OpenAIStreamSender struct {
+	legacyFunctionCall bool // 请求使用旧版 functions 格式：tool_calls 增量转换为 function_call
+}
 
 func (s *OpenAIStreamSender) SendEvent(c *gin.Context, data any) error {
+	if chunk, ok := data.(map[string]any); ok && s.legacyFunctionCall {
+		if !converter.ConvertChunkToLegacyFunctionCall(chunk) {
+			return nil
+		}
+	}
 
 	json, err := utils.SafeMarshal(data)
 	if err != nil {
@@ -469,12 +729,14 @@ func (s *OpenAIStreamSender) SendEvent(c *gin.Context, data any) error {
 }
 
 func (s *OpenAIStreamSender) SendError(c *gin.Context, message string, _ error) error {
+	errorBody := map[string]any{
+		"message": message,
+		"type":    "server_error",
+		"code":    "internal_error",
+	}
+	applyErrorTrace(c, errorBody)
 	errorResp := map[string]any{
-		"error": map[string]any{
-			"message": message,
-			"type":    "server_error",
-			"code":    "internal_error",
-		},
+		"error": errorBody,
 	}
 
 	json, err := utils.FastMarshal(errorResp)
@@ -494,6 +756,8 @@ type RequestContext struct {
 		GetToken() (types.TokenInfo, error)
 	}
 	RequestType string // "anthropic" 或 "openai"
+	// RequestedModel 不在请求体中的模型名（如 Gemini 的 URL 路径参数），为空时从请求体提取
+	RequestedModel string
 }
 
 // GetTokenAndBody 通用的token获取和请求体读取
@@ -510,7 +774,10 @@ func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
 		return types.TokenInfo{}, nil, err
 	}
 
-	requestedModel := extractRequestedModel(body)
+	requestedModel := rc.RequestedModel
+	if requestedModel == "" {
+		requestedModel = extractRequestedModel(body)
+	}
 	rc.GinContext.Set("requested_model", requestedModel)
 
 	// 提取会话 ID
@@ -522,11 +789,131 @@ func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
 	// 将会话 ID 存入上下文
 	rc.GinContext.Set("session_id", sessionID)
 
-	// 尝试使用会话绑定获取 token
+	// 请求头指定了token索引（需开启 TOKEN_INDEX_OVERRIDE_ENABLED）时跳过轮询选择
+	tokenIndex, overrideIndex, verr := requestedTokenIndex(rc.GinContext)
+	if verr != nil {
+		respondInvalidRequest(rc.GinContext, verr)
+		return types.TokenInfo{}, nil, verr
+	}
+	authWithIndex, _ := rc.AuthService.(AuthServiceWithTokenIndex)
+
+	if overrideIndex && authWithIndex != nil {
+		if tokenInfo, err = rc.getTokenForIndex(authWithIndex, tokenIndex); err != nil {
+			return types.TokenInfo{}, nil, err
+		}
+	} else {
+		tokenInfo, err = rc.selectTokenForModel(sessionID, requestedModel)
+
+		// 没有任何账号可服务请求的模型时，按 FALLBACK_MODEL 替换模型后重新选择
+		if fallback, ok := fallbackModelFor(err, requestedModel); ok {
+			logger.Warn("请求的模型无可用账号，替换为回退模型",
+				addReqFields(rc.GinContext,
+					logger.String("requested_model", requestedModel),
+					logger.String("fallback_model", fallback),
+				)...)
+			if rc.RequestedModel != "" {
+				rc.RequestedModel = fallback
+			} else if body, err = replaceRequestModel(body, fallback); err != nil {
+				respondError(rc.GinContext, http.StatusBadRequest, "解析请求体失败: %v", err)
+				return types.TokenInfo{}, nil, err
+			}
+			requestedModel = fallback
+			rc.GinContext.Set("requested_model", requestedModel)
+			rc.GinContext.Set("fallback_model", fallback)
+			tokenInfo, err = rc.selectTokenForModel(sessionID, requestedModel)
+		}
+	}
+
+	if err != nil {
+		var modelNotFoundErr *types.ModelNotFoundErrorType
+		if errors.As(err, &modelNotFoundErr) {
+			rc.GinContext.JSON(http.StatusBadRequest, modelNotFoundErr.ErrorData)
+			return types.TokenInfo{}, nil, err
+		}
+
+		logger.Error("获取token失败", logger.Err(err))
+		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
+		return types.TokenInfo{}, nil, err
+	}
+
+	// 记录请求日志
+	logger.Debug(fmt.Sprintf("收到%s请求", rc.RequestType),
+		addReqFields(rc.GinContext,
+			logger.String("direction", "client_request"),
+			logger.String("session_id", sessionID),
+			logger.String("model", requestedModel),
+			logger.String("body", string(body)),
+			logger.Int("body_size", len(body)),
+			logger.String("remote_addr", rc.GinContext.ClientIP()),
+			logger.String("user_agent", rc.GinContext.GetHeader("User-Agent")),
+		)...)
+
+	return tokenInfo, body, nil
+}
+
+// TokenIndexHeader 调试用请求头：直接使用指定配置索引的token（需开启 TOKEN_INDEX_OVERRIDE_ENABLED）
+const TokenIndexHeader = "X-Kiro-Token-Index"
+
+// requestedTokenIndex 解析请求头指定的token索引
+// 未开启 TOKEN_INDEX_OVERRIDE_ENABLED 时忽略请求头；值不是非负整数时返回校验错误
+func requestedTokenIndex(c *gin.Context) (int, bool, *ValidationError) {
+	raw := strings.TrimSpace(c.GetHeader(TokenIndexHeader))
+	if raw == "" {
+		return 0, false, nil
+	}
+	if !config.TokenIndexOverrideEnabled {
+		logger.Debug("未开启 TOKEN_INDEX_OVERRIDE_ENABLED，忽略token索引请求头",
+			addReqFields(c, logger.String("value", raw))...)
+		return 0, false, nil
+	}
+	index, err := strconv.Atoi(raw)
+	if err != nil || index < 0 {
+		return 0, false, &ValidationError{Field: TokenIndexHeader, Message: "必须是非负整数"}
+	}
+	return index, true, nil
+}
+
+// getTokenForIndex 使用指定索引的token，索引不可用时返回 400
+func (rc *RequestContext) getTokenForIndex(provider AuthServiceWithTokenIndex, index int) (types.TokenInfo, error) {
+	tokenInfo, fingerprint, tokenKey, err := provider.GetTokenWithFingerprintForIndex(index)
+	if err != nil {
+		var indexErr *auth.TokenIndexError
+		if errors.As(err, &indexErr) {
+			respondInvalidRequest(rc.GinContext, &ValidationError{Field: TokenIndexHeader, Message: err.Error()})
+		} else {
+			logger.Error("获取token失败", logger.Err(err))
+			respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
+		}
+		return types.TokenInfo{}, err
+	}
+
+	if fingerprint != nil {
+		rc.GinContext.Set("request_fingerprint", fingerprint)
+	}
+	rc.GinContext.Set("token_key", tokenKey)
+	logger.Info("使用请求头指定的token",
+		addReqFields(rc.GinContext,
+			logger.String("token_key", tokenKey),
+			logger.String("request_type", rc.RequestType),
+		)...)
+	return tokenInfo, nil
+}
+
+// selectTokenForModel 按认证服务支持的能力选择可用于指定模型的token
+// 选中的指纹与 token key 写入请求上下文
+func (rc *RequestContext) selectTokenForModel(sessionID, requestedModel string) (types.TokenInfo, error) {
+	var tokenInfo types.TokenInfo
+	var err error
+
 	if authWithSessionModel, ok := rc.AuthService.(AuthServiceWithSessionForModel); ok {
+		// 尝试使用会话绑定获取 token
 		var fingerprint *auth.Fingerprint
 		var tokenKey string
-		tokenInfo, fingerprint, tokenKey, err = authWithSessionModel.GetTokenWithFingerprintForSessionAndModel(sessionID, requestedModel)
+		if authWithCtx, ok := rc.AuthService.(AuthServiceWithSessionForModelContext); ok {
+			tokenInfo, fingerprint, tokenKey, err = authWithCtx.GetTokenWithFingerprintForSessionAndModelContext(rc.GinContext.Request.Context(), sessionID, requestedModel)
+		} else {
+			tokenInfo, fingerprint, tokenKey, err = authWithSessionModel.GetTokenWithFingerprintForSessionAndModel(sessionID, requestedModel)
+		}
 		if err == nil {
 			if fingerprint != nil {
 				rc.GinContext.Set("request_fingerprint", fingerprint)
@@ -583,31 +970,38 @@ func (rc *RequestContext) GetTokenAndBody() (types.TokenInfo, []byte, error) {
 		tokenInfo, err = rc.AuthService.GetToken()
 	}
 
-	if err != nil {
-		var modelNotFoundErr *types.ModelNotFoundErrorType
-		if errors.As(err, &modelNotFoundErr) {
-			rc.GinContext.JSON(http.StatusBadRequest, modelNotFoundErr.ErrorData)
-			return types.TokenInfo{}, nil, err
-		}
+	return tokenInfo, err
+}
 
-		logger.Error("获取token失败", logger.Err(err))
-		respondError(rc.GinContext, http.StatusInternalServerError, "获取token失败: %v", err)
-		return types.TokenInfo{}, nil, err
+// fallbackModelFor 判断选择token的错误是否应以 FALLBACK_MODEL 重试
+// 仅在没有任何账号支持请求的模型、且回退模型与请求的模型不同时返回 true
+func fallbackModelFor(err error, requestedModel string) (string, bool) {
+	fallback := strings.TrimSpace(config.FallbackModel)
+	if err == nil || fallback == "" {
+		return "", false
 	}
+	var modelNotFoundErr *types.ModelNotFoundErrorType
+	if !errors.As(err, &modelNotFoundErr) {
+		return "", false
+	}
+	if config.NormalizeModelName(fallback) == config.NormalizeModelName(requestedModel) {
+		return "", false
+	}
+	return fallback, true
+}
 
-	// 记录请求日志
-	logger.Debug(fmt.Sprintf("收到%s请求", rc.RequestType),
-		addReqFields(rc.GinContext,
-			logger.String("direction", "client_request"),
-			logger.String("session_id", sessionID),
-			logger.String("model", requestedModel),
-			logger.String("body", string(body)),
-			logger.Int("body_size", len(body)),
-			logger.String("remote_addr", rc.GinContext.ClientIP()),
-			logger.String("user_agent", rc.GinContext.GetHeader("User-Agent")),
-		)...)
-
-	return tokenInfo, body, nil
+// replaceRequestModel 替换请求体中的 model 字段，其余字段原样保留
+func replaceRequestModel(body []byte, model string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	fields["model"] = encoded
+	return json.Marshal(fields)
 }
 
 func extractRequestedModel(body []byte) string {
@@ -2,16 +2,22 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"kiro2api/auth"
+	"kiro2api/config"
 	"kiro2api/types"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -173,6 +179,109 @@ func TestRequestContext_GetTokenAndBody_ModelNotFound(t *testing.T) {
 	assert.Contains(t, w.Body.String(), "model_not_found")
 }
 
+// mockModelAuthService 仅支持 supported 中模型的 MockAuthService
+type mockModelAuthService struct {
+	MockAuthService
+	supported map[string]bool
+}
+
+func (m *mockModelAuthService) GetTokenForModel(model string) (types.TokenInfo, error) {
+	if !m.supported[model] {
+		return types.TokenInfo{}, types.NewModelNotFoundErrorType(model, "test_request_id")
+	}
+	return types.TokenInfo{AccessToken: "token-for-" + model}, nil
+}
+
+func TestRequestContext_GetTokenAndBody_FallbackModel(t *testing.T) {
+	origFallback := config.FallbackModel
+	t.Cleanup(func() { config.FallbackModel = origFallback })
+
+	run := func(fallback string) (*httptest.ResponseRecorder, *gin.Context, types.TokenInfo, []byte, error) {
+		config.FallbackModel = fallback
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/test", bytes.NewBufferString(`{"model":"claude-opus-4-6","max_tokens":10}`))
+		reqCtx := &RequestContext{
+			GinContext:  c,
+			AuthService: &mockModelAuthService{supported: map[string]bool{"claude-sonnet-4-6": true}},
+			RequestType: "test",
+		}
+		tokenInfo, body, err := reqCtx.GetTokenAndBody()
+		return w, c, tokenInfo, body, err
+	}
+
+	// 未配置时保持返回模型未找到
+	w, _, _, _, err := run("")
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "model_not_found")
+
+	_, c, tokenInfo, body, err := run("claude-sonnet-4-6")
+	require.NoError(t, err)
+	assert.Equal(t, "token-for-claude-sonnet-4-6", tokenInfo.AccessToken)
+	assert.Equal(t, "claude-sonnet-4-6", extractRequestedModel(body))
+	assert.Equal(t, "claude-sonnet-4-6", c.GetString("requested_model"))
+	assert.Equal(t, "claude-sonnet-4-6", c.GetString("fallback_model"))
+
+	var parsed map[string]any
+	require.NoError(t, json.Unmarshal(body, &parsed))
+	assert.EqualValues(t, 10, parsed["max_tokens"])
+
+	// 回退模型同样不可用时返回回退模型的模型未找到错误
+	w, _, _, _, err = run("claude-haiku-4-5-20251001")
+	assert.Error(t, err)
+	assert.Contains(t, w.Body.String(), "model_not_found")
+}
+
+// mockIndexAuthService 支持按索引获取token的 MockAuthService
+type mockIndexAuthService struct {
+	MockAuthService
+}
+
+func (m *mockIndexAuthService) GetTokenWithFingerprintForIndex(index int) (types.TokenInfo, *auth.Fingerprint, string, error) {
+	if index > 1 {
+		return types.TokenInfo{}, nil, "", &auth.TokenIndexError{Index: index, Reason: "有效范围为 0-1"}
+	}
+	return types.TokenInfo{AccessToken: fmt.Sprintf("index-token-%d", index)}, nil, fmt.Sprintf("token_%d", index), nil
+}
+
+func TestRequestContext_GetTokenAndBody_TokenIndexHeader(t *testing.T) {
+	origEnabled := config.TokenIndexOverrideEnabled
+	t.Cleanup(func() { config.TokenIndexOverrideEnabled = origEnabled })
+
+	run := func(enabled bool, header string) (*httptest.ResponseRecorder, *gin.Context, types.TokenInfo, error) {
+		config.TokenIndexOverrideEnabled = enabled
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("POST", "/test", bytes.NewBufferString(`{"model":"claude-sonnet-4-6"}`))
+		c.Request.Header.Set(TokenIndexHeader, header)
+		reqCtx := &RequestContext{
+			GinContext:  c,
+			AuthService: &mockIndexAuthService{MockAuthService{token: types.TokenInfo{AccessToken: "round-robin"}}},
+			RequestType: "test",
+		}
+		tokenInfo, _, err := reqCtx.GetTokenAndBody()
+		return w, c, tokenInfo, err
+	}
+
+	// 未开启时忽略请求头
+	_, _, tokenInfo, err := run(false, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "round-robin", tokenInfo.AccessToken)
+
+	_, c, tokenInfo, err := run(true, "1")
+	require.NoError(t, err)
+	assert.Equal(t, "index-token-1", tokenInfo.AccessToken)
+	assert.Equal(t, "token_1", c.GetString("token_key"))
+
+	for _, header := range []string{"abc", "-1", "5"} {
+		w, _, _, err := run(true, header)
+		assert.Error(t, err, header)
+		assert.Equal(t, http.StatusBadRequest, w.Code, header)
+		assert.Contains(t, w.Body.String(), TokenIndexHeader)
+	}
+}
+
 func TestHandleRequestBuildError(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -211,6 +320,25 @@ func TestHandleRequestSendError(t *testing.T) {
 	assert.Contains(t, errorObj["message"], "发送请求失败")
 }
 
+func TestHandleRequestSendError_Timeout(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	handleRequestSendError(c, fmt.Errorf("请求失败: %w", context.DeadlineExceeded))
+
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "上游请求超时")
+}
+
+func TestHandleRequestSendError_ClientCanceled(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	handleRequestSendError(c, fmt.Errorf("请求失败: %w", context.Canceled))
+
+	assert.False(t, c.Writer.Written(), "客户端已断开时不应再写响应")
+}
+
 func TestHandleResponseReadError(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
@@ -294,3 +422,98 @@ func TestOpenAIStreamSender_SendEvent(t *testing.T) {
 	body := w.Body.String()
 	assert.Contains(t, body, "data:")
 }
+
+func TestAnthropicStreamSender_SamplesDeltaLogs(t *testing.T) {
+	orig := config.LogSSESampleRate
+	t.Cleanup(func() { config.LogSSESampleRate = orig })
+
+	config.LogSSESampleRate = 3
+	sender := &AnthropicStreamSender{}
+	assert.True(t, sender.shouldLogEvent("message_start"))
+	var logged []bool
+	for i := 0; i < 5; i++ {
+		logged = append(logged, sender.shouldLogEvent("content_block_delta"))
+	}
+	assert.Equal(t, []bool{true, false, false, true, false}, logged)
+	assert.True(t, sender.shouldLogEvent("message_stop"))
+
+	config.LogSSESampleRate = 0
+	assert.False(t, sender.shouldLogEvent("content_block_delta"))
+	assert.True(t, sender.shouldLogEvent("error"))
+}
+
+type stubTokenProxyProvider map[string]string
+
+func (s stubTokenProxyProvider) GetTokenProxy(tokenKey string) string {
+	return s[tokenKey]
+}
+
+func TestResolveUpstreamProxy_UsesTokenBinding(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	c.Set("auth_service", stubTokenProxyProvider{"token_1": "http://10.0.0.1:8080"})
+
+	c.Set("token_key", "token_1")
+	assert.Equal(t, "http://10.0.0.1:8080", resolveUpstreamProxy(c))
+
+	// 未绑定代理且未启用代理池时不使用代理
+	c.Set("token_key", "token_0")
+	assert.Empty(t, resolveUpstreamProxy(c))
+}
+
+type stubTokenLevelProvider map[string]auth.AccountLevel
+
+func (s stubTokenLevelProvider) GetTokenAccountLevel(tokenKey string) auth.AccountLevel {
+	return s[tokenKey]
+}
+
+func TestCapMaxTokensForAccountLevel(t *testing.T) {
+	origFree, origPro := config.MaxTokensCapFree, config.MaxTokensCapPro
+	config.MaxTokensCapFree, config.MaxTokensCapPro = 8192, 0
+	t.Cleanup(func() { config.MaxTokensCapFree, config.MaxTokensCapPro = origFree, origPro })
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+	// 未选定token时不截断
+	assert.Equal(t, 32000, capMaxTokensForAccountLevel(c, 32000))
+
+	c.Set("auth_service", stubTokenLevelProvider{"token_0": auth.AccountLevelFree, "token_1": auth.AccountLevelPro})
+	c.Set("token_key", "token_0")
+	assert.Equal(t, 8192, capMaxTokensForAccountLevel(c, 32000))
+	assert.Equal(t, 4096, capMaxTokensForAccountLevel(c, 4096))
+
+	// 未配置上限的等级不截断
+	c.Set("token_key", "token_1")
+	assert.Equal(t, 32000, capMaxTokensForAccountLevel(c, 32000))
+}
+
+func TestSendOpenAIUsageChunk(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	sendOpenAIUsageChunk(c, &OpenAIStreamSender{}, "chatcmpl-123", "claude-sonnet-4", 12, 30)
+
+	body := strings.TrimSpace(w.Body.String())
+	require.True(t, strings.HasPrefix(body, "data: "))
+	var chunk map[string]any
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(body, "data: ")), &chunk))
+	assert.Equal(t, "chat.completion.chunk", chunk["object"])
+	assert.Empty(t, chunk["choices"])
+	assert.Equal(t, map[string]any{
+		"prompt_tokens":     float64(12),
+		"completion_tokens": float64(30),
+		"total_tokens":      float64(42),
+	}, chunk["usage"])
+}
+
+func TestFallbackConnectionHeader(t *testing.T) {
+	orig := config.UpstreamForceConnectionClose
+	t.Cleanup(func() { config.UpstreamForceConnectionClose = orig })
+
+	config.UpstreamForceConnectionClose = false
+	assert.Equal(t, "keep-alive", fallbackConnectionHeader())
+
+	config.UpstreamForceConnectionClose = true
+	assert.Equal(t, "close", fallbackConnectionHeader())
+}
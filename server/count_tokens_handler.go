@@ -12,11 +12,12 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-// handleCountTokens 本地实现token计数接口
-// 设计原则：
-// - KISS: 简单高效的估算算法，避免引入复杂的tokenizer库
-// - 向后兼容: 支持所有Claude模型和消息格式
-// - 性能优先: 本地计算，响应时间<5ms
+// handleCountTokens 实现 /v1/messages/count_tokens 接口
+// 计数路径与流式处理的 message_start/usage 一致：
+// - 系统提示、消息文本、工具调用与工具结果使用 tiktoken(cl100k_base) 计数
+// - 图片按固定占位token计数
+// - 工具定义按JSON schema计数
+// 响应格式与官方一致：{"input_tokens": N}
 func handleCountTokens(c *gin.Context) {
 	var req types.CountTokensRequest
 
@@ -55,20 +56,8 @@ func handleCountTokens(c *gin.Context) {
 		return
 	}
 
-	// 创建token估算器
-	counter := utils.NewTokenCounterFromEnv()
-
-	// 计算token数量（优先官方API，失败则本地估算）
-	tokenCount, err := counter.CountInputTokens(c.Request.Context(), &req)
-	if err != nil {
-		logger.Warn("token计数失败，回退到本地估算",
-			addReqFields(c,
-				logger.Err(err),
-			)...)
-		// 理论上 CountInputTokens 已做本地回退，这里再兜底一次
-		estimator := utils.NewTokenEstimator()
-		tokenCount = estimator.EstimateTokens(&req)
-	}
+	// 与流式处理共用同一计数路径（优先官方API，否则本地tiktoken计数）
+	tokenCount := GetTokenCalculator().CountRequestTokens(c.Request.Context(), &req)
 
 	// 返回符合官方API格式的响应
 	c.JSON(http.StatusOK, types.CountTokensResponse{
@@ -2,7 +2,9 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -10,6 +12,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 	"kiro2api/types"
+	"kiro2api/utils"
 )
 
 // TestHandleCountTokens_Success 测试成功的token计数
@@ -389,3 +392,67 @@ func BenchmarkHandleCountTokens(b *testing.B) {
 		handleCountTokens(c)
 	}
 }
+
+// TestHandleCountTokens_Fixtures 固定样例的token计数，防止估算结果漂移
+// 期望值按组成部分用 tiktoken 计数拼出，图片按固定占位计数，base64 数据与 thinking 签名不计入
+func TestHandleCountTokens_Fixtures(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	const imageTokens = 1500
+	count := func(text string) int { return utils.CountTokensWithTiktoken(text, "cl100k_base") }
+	pngData := "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+
+	tests := []struct {
+		name       string
+		body       string
+		wantTokens int
+	}{
+		{
+			name:       "字符串格式的系统提示",
+			body:       `{"model":"claude-sonnet-4-20250514","system":"You are a helpful assistant.","messages":[{"role":"user","content":"Hello, how are you today?"}]}`,
+			wantTokens: count("You are a helpful assistant.") + count("Hello, how are you today?"),
+		},
+		{
+			name:       "文本与图片块",
+			body:       `{"model":"claude-sonnet-4-20250514","messages":[{"role":"user","content":[{"type":"text","text":"Describe this image"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + pngData + `"}}]}]}`,
+			wantTokens: count("Describe this image") + imageTokens,
+		},
+		{
+			name: "工具调用与包含图片的工具结果",
+			body: `{"model":"claude-sonnet-4-20250514","messages":[` +
+				`{"role":"user","content":"Take a screenshot"},` +
+				`{"role":"assistant","content":[{"type":"thinking","thinking":"I should call the tool.","signature":"c2lnbmF0dXJl"},{"type":"tool_use","id":"toolu_1","name":"screenshot","input":{"full_page":true}}]},` +
+				`{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"done"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + pngData + `"}}]}]}]}`,
+			wantTokens: count("Take a screenshot") +
+				count("I should call the tool.") +
+				count(`<invoke name="screenshot">{"full_page":true}</invoke>`) +
+				count("<tool_result></tool_result>") + count("done") + imageTokens,
+		},
+		{
+			name: "工具定义",
+			body: `{"model":"claude-sonnet-4-20250514","system":[{"type":"text","text":"Use tools when helpful."}],"messages":[{"role":"user","content":"What's the weather in Paris?"}],` +
+				`"tools":[{"name":"get_weather","description":"Get the current weather for a city","input_schema":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}]}`,
+			wantTokens: count("Use tools when helpful.") + count("What's the weather in Paris?") +
+				count(`[{"name":"get_weather","description":"Get the current weather for a city","input_schema":{"properties":{"city":{"type":"string"}},"required":["city"],"type":"object"}}]`),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages/count_tokens", bytes.NewReader([]byte(tt.body)))
+			c.Request.Header.Set("Content-Type", "application/json")
+
+			handleCountTokens(c)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.JSONEq(t, fmt.Sprintf(`{"input_tokens":%d}`, tt.wantTokens), w.Body.String())
+
+			// 与流式处理使用的计数结果一致
+			var anthropicReq types.AnthropicRequest
+			assert.NoError(t, json.Unmarshal([]byte(tt.body), &anthropicReq))
+			assert.Equal(t, tt.wantTokens, GetTokenCalculator().CalculateInputTokens(context.Background(), anthropicReq))
+		})
+	}
+}
@@ -3,11 +3,16 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"kiro2api/auth"
 	"kiro2api/logger"
+	"kiro2api/parser"
 )
 
 // ========== 错误响应结构 ==========
@@ -19,6 +24,8 @@ type ClaudeErrorResponse struct {
 	Code       string `json:"code,omitempty"`
 	StopReason string `json:"stop_reason,omitempty"`
 	HTTPStatus int    `json:"-"` // 不序列化，仅用于内部传递
+	// QuotaResetTimestamp 上游配额重置时间（Unix 秒，0 表示未知），用于 Retry-After 与错误响应体
+	QuotaResetTimestamp int64 `json:"-"`
 }
 
 // CodeWhispererErrorBody AWS CodeWhisperer 错误响应体
@@ -95,10 +102,11 @@ func (s *RateLimitStrategy) MapError(statusCode int, responseBody []byte) *Claud
 	}
 
 	return &ClaudeErrorResponse{
-		Type:       "error",
-		Code:       "rate_limited",
-		Message:    message,
-		HTTPStatus: http.StatusTooManyRequests,
+		Type:                "error",
+		Code:                "rate_limited",
+		Message:             message,
+		HTTPStatus:          http.StatusTooManyRequests,
+		QuotaResetTimestamp: auth.ParseQuotaResetTimestamp(responseBody),
 	}
 }
 
@@ -143,10 +151,11 @@ func (s *PaymentRequiredStrategy) MapError(statusCode int, responseBody []byte)
 	}
 
 	return &ClaudeErrorResponse{
-		Type:       "error",
-		Code:       "rate_limited",
-		Message:    message,
-		HTTPStatus: http.StatusTooManyRequests, // 转换为 429 返回给客户端
+		Type:                "error",
+		Code:                "rate_limited",
+		Message:             message,
+		HTTPStatus:          http.StatusTooManyRequests, // 转换为 429 返回给客户端
+		QuotaResetTimestamp: auth.ParseQuotaResetTimestamp(responseBody),
 	}
 }
 
@@ -417,6 +426,8 @@ func (em *ErrorMapper) MapCodeWhispererError(statusCode int, responseBody []byte
 // SendClaudeError 发送 Claude 规范的错误响应
 func (em *ErrorMapper) SendClaudeError(c *gin.Context, result *MapResult) {
 	claudeError := result.Response
+	annotateErrorStrategy(c, result)
+	applyErrorTrace(c, nil)
 
 	// 根据错误类型决定发送格式
 	if claudeError.StopReason == "max_tokens" {
@@ -431,6 +442,7 @@ func (em *ErrorMapper) SendClaudeError(c *gin.Context, result *MapResult) {
 // SendStreamError 发送流式错误响应
 func (em *ErrorMapper) SendStreamError(c *gin.Context, result *MapResult, sender StreamEventSender) {
 	claudeError := result.Response
+	annotateErrorStrategy(c, result)
 
 	if claudeError.StopReason == "max_tokens" {
 		// max_tokens 场景：发送 message_delta 事件
@@ -452,6 +464,50 @@ func (em *ErrorMapper) SendStreamError(c *gin.Context, result *MapResult, sender
 	}
 }
 
+// ErrorStrategyHeader 标识处理上游错误的映射策略（如 rate_limit、payment_required），便于排查错误映射
+const ErrorStrategyHeader = "X-Kiro-Error-Strategy"
+
+// UpstreamInvocationIDHeader 错误响应中返回本次上游调用的 amz-sdk-invocation-id，与 X-Request-ID 一起用于排查单次失败
+const UpstreamInvocationIDHeader = "X-Kiro-Upstream-Invocation-Id"
+
+// upstreamInvocationIDContextKey 最近一次上游调用的 amz-sdk-invocation-id 在 gin 上下文中的键（重试时为最后一次）
+const upstreamInvocationIDContextKey = "upstream_invocation_id"
+
+// applyErrorTrace 在错误体中附带代理的 request_id 与上游的 upstream_invocation_id（errorBody 为 nil 时仅设置响应头）
+// 响应头尚未写出时同时设置 UpstreamInvocationIDHeader（X-Request-ID 已由 RequestIDMiddleware 设置）
+func applyErrorTrace(c *gin.Context, errorBody map[string]any) {
+	requestID := GetRequestID(c)
+	invocationID := c.GetString(upstreamInvocationIDContextKey)
+	if errorBody != nil {
+		if requestID != "" {
+			errorBody["request_id"] = requestID
+		}
+		if invocationID != "" {
+			errorBody["upstream_invocation_id"] = invocationID
+		}
+	}
+	if invocationID != "" && !c.Writer.Written() {
+		c.Header(UpstreamInvocationIDHeader, invocationID)
+	}
+}
+
+// annotateErrorStrategy 在响应头中标注处理错误的策略
+// 流式响应头已发送时无法再设置响应头，改为记录日志
+func annotateErrorStrategy(c *gin.Context, result *MapResult) {
+	if result.Strategy == nil {
+		return
+	}
+	name := result.Strategy.GetStrategyName()
+	if !c.Writer.Written() {
+		c.Header(ErrorStrategyHeader, name)
+		return
+	}
+	logger.Info("响应头已发送，错误映射策略仅记录日志",
+		addReqFields(c,
+			logger.String("strategy", name),
+			logger.String("mapped_code", result.Response.Code))...)
+}
+
 // sendMaxTokensResponse 发送 max_tokens 类型的响应
 func (em *ErrorMapper) sendMaxTokensResponse(c *gin.Context, claudeError *ClaudeErrorResponse) {
 	response := map[string]any{
@@ -481,14 +537,41 @@ func (em *ErrorMapper) sendMaxTokensResponse(c *gin.Context, claudeError *Claude
 
 // sendStandardError 发送标准错误响应
 func (em *ErrorMapper) sendStandardError(c *gin.Context, claudeError *ClaudeErrorResponse) {
+	errorBody := gin.H{
+		"type":    claudeError.Code,
+		"message": claudeError.Message,
+	}
+	applyQuotaReset(c, errorBody, claudeError.QuotaResetTimestamp)
+	applyErrorTrace(c, errorBody)
 	c.JSON(claudeError.HTTPStatus, gin.H{
-		"error": gin.H{
-			"type":    claudeError.Code,
-			"message": claudeError.Message,
-		},
+		"error": errorBody,
 	})
 }
 
+// retryAfterSeconds 距配额重置的秒数（向上取整，已过期或未知时返回 0）
+func retryAfterSeconds(resetTimestamp int64) int {
+	if resetTimestamp <= 0 {
+		return 0
+	}
+	wait := time.Until(time.Unix(resetTimestamp, 0))
+	if wait <= 0 {
+		return 0
+	}
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// applyQuotaReset 已知配额重置时间时设置 Retry-After 头，并在错误体中附带 quota_reset_timestamp
+// 客户端可据此精确安排重试；响应头已写出时（流式）仅修改错误体
+func applyQuotaReset(c *gin.Context, errorBody map[string]any, resetTimestamp int64) {
+	if resetTimestamp <= 0 {
+		return
+	}
+	errorBody["quota_reset_timestamp"] = resetTimestamp
+	if seconds := retryAfterSeconds(resetTimestamp); seconds > 0 && !c.Writer.Written() {
+		c.Header("Retry-After", strconv.Itoa(seconds))
+	}
+}
+
 // ========== 流式异常处理策略 ==========
 
 // StreamExceptionStrategy 流式异常处理策略接口
@@ -523,7 +606,7 @@ func (s *ContentLengthExceptionStrategy) Handle(ctx *StreamProcessorContext, dat
 				"type":  "content_block_stop",
 				"index": index,
 			}
-			_ = ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, stopEvent)
+			_ = ctx.sendEvent(stopEvent)
 		}
 	}
 
@@ -540,7 +623,7 @@ func (s *ContentLengthExceptionStrategy) Handle(ctx *StreamProcessorContext, dat
 		},
 	}
 
-	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, maxTokensEvent); err != nil {
+	if err := ctx.sendEvent(maxTokensEvent); err != nil {
 		logger.Error("发送 max_tokens 响应失败", logger.Err(err))
 		return false
 	}
@@ -549,7 +632,7 @@ func (s *ContentLengthExceptionStrategy) Handle(ctx *StreamProcessorContext, dat
 	stopEvent := map[string]any{
 		"type": "message_stop",
 	}
-	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, stopEvent); err != nil {
+	if err := ctx.sendEvent(stopEvent); err != nil {
 		logger.Error("发送 message_stop 失败", logger.Err(err))
 		return false
 	}
@@ -573,22 +656,38 @@ func (s *ThrottlingExceptionStrategy) CanHandle(exceptionType string, _ map[stri
 func (s *ThrottlingExceptionStrategy) Handle(ctx *StreamProcessorContext, dataMap map[string]any) bool {
 	logger.Warn("检测到限流异常",
 		addReqFields(ctx.c,
-			logger.String("exception_type", dataMap["exception_type"].(string)))...)
+			logger.String("exception_type", dataMap["exception_type"].(string)),
+			logger.Bool("committed", ctx.committed))...)
+
+	// 尚未向客户端写出任何数据：交由调用方切换token重试
+	if ctx.retryOnThrottle && !ctx.committed {
+		ctx.throttled = true
+		return true
+	}
 
-	// 发送 overloaded_error
+	// 发送 overloaded_error（尚未提交时 Retry-After 随SSE响应头一起写出）
+	errorBody := map[string]any{
+		"type":    "overloaded_error",
+		"message": "服务繁忙，请稍后重试",
+	}
+	if raw, ok := dataMap["raw_data"].(map[string]any); ok {
+		if resetTimestamp, ok := extractIntAny(raw["quota_reset_timestamp"]); ok {
+			applyQuotaReset(ctx.c, errorBody, int64(resetTimestamp))
+		}
+	}
+	applyErrorTrace(ctx.c, errorBody)
 	errorEvent := map[string]any{
-		"type": "error",
-		"error": map[string]any{
-			"type":    "overloaded_error",
-			"message": "服务繁忙，请稍后重试",
-		},
+		"type":  "error",
+		"error": errorBody,
 	}
 
-	if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, errorEvent); err != nil {
+	if err := ctx.sendEvent(errorEvent); err != nil {
 		logger.Error("发送限流错误失败", logger.Err(err))
 		return false
 	}
 
+	// 已下发错误事件：结束流，不再重新开始，避免客户端收到重叠的内容块
+	ctx.aborted = true
 	ctx.c.Writer.Flush()
 	return true
 }
@@ -597,6 +696,64 @@ func (s *ThrottlingExceptionStrategy) GetStrategyName() string {
 	return "throttling_exception"
 }
 
+// RefusalExceptionStrategy 护栏/内容过滤异常处理
+// 上游拒绝生成时不转发原始异常，结束事件中的 stop_reason 改为 refusal
+type RefusalExceptionStrategy struct{}
+
+func (s *RefusalExceptionStrategy) CanHandle(_ string, dataMap map[string]any) bool {
+	return isRefusalException(dataMap)
+}
+
+func (s *RefusalExceptionStrategy) Handle(ctx *StreamProcessorContext, dataMap map[string]any) bool {
+	logger.Warn("检测到上游拒绝生成，映射为 refusal stop_reason",
+		addReqFields(ctx.c,
+			logger.String("exception_type", getStringField(dataMap, "exception_type")),
+			logger.String("exception_message", getStringField(dataMap, "exception_message")))...)
+
+	ctx.refused = true
+	return true
+}
+
+func (s *RefusalExceptionStrategy) GetStrategyName() string {
+	return "refusal_exception"
+}
+
+// refusalMarkers 护栏/内容过滤类异常的标识（不区分大小写，匹配异常类型或 reason 字段）
+var refusalMarkers = []string{"guardrail", "contentfilter", "content_filter", "contentpolicy", "content_policy", "refusal"}
+
+// isRefusalException 判断上游异常事件是否表示拒绝生成（护栏拦截、内容过滤）
+func isRefusalException(dataMap map[string]any) bool {
+	if dataMap["type"] != "exception" {
+		return false
+	}
+	candidates := []string{getStringField(dataMap, "exception_type")}
+	if raw, ok := dataMap["raw_data"].(map[string]any); ok {
+		candidates = append(candidates, getStringField(raw, "reason"))
+	}
+	for _, candidate := range candidates {
+		lower := strings.ToLower(candidate)
+		for _, marker := range refusalMarkers {
+			if lower != "" && strings.Contains(lower, marker) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseResultRefused 非流式解析结果中是否包含拒绝生成的异常事件
+func parseResultRefused(result *parser.ParseResult) bool {
+	if result == nil {
+		return false
+	}
+	for _, event := range result.Events {
+		if dataMap, ok := event.Data.(map[string]any); ok && isRefusalException(dataMap) {
+			return true
+		}
+	}
+	return false
+}
+
 // StreamExceptionMapper 流式异常映射器
 type StreamExceptionMapper struct {
 	strategies []StreamExceptionStrategy
@@ -608,6 +765,7 @@ func NewStreamExceptionMapper() *StreamExceptionMapper {
 		strategies: []StreamExceptionStrategy{
 			&ContentLengthExceptionStrategy{},
 			&ThrottlingExceptionStrategy{},
+			&RefusalExceptionStrategy{},
 		},
 	}
 }
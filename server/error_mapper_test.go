@@ -2,13 +2,17 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // TestContentLengthExceedsStrategy_MapError 测试内容长度超限策略
@@ -395,3 +399,109 @@ func BenchmarkContentLengthExceedsStrategy_MapError(b *testing.B) {
 		strategy.MapError(http.StatusBadRequest, responseBody)
 	}
 }
+
+// TestErrorMapper_RateLimitSurfacesQuotaReset 429/402 携带 quota_reset_timestamp 时下发 Retry-After 与重置时间
+func TestErrorMapper_RateLimitSurfacesQuotaReset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	resetAt := time.Now().Add(90 * time.Second).Unix()
+
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+	}{
+		{"429", http.StatusTooManyRequests, fmt.Sprintf(`{"message":"Too many requests","quota_reset_timestamp":%d}`, resetAt)},
+		{"402月度配额", http.StatusPaymentRequired, fmt.Sprintf(`{"message":"monthly quota","reason":"MONTHLY_REQUEST_COUNT","quota_reset_timestamp":%d}`, resetAt)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			mapper := NewErrorMapper()
+			mapper.SendClaudeError(c, mapper.MapCodeWhispererError(tt.statusCode, []byte(tt.body)))
+
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+			retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+			require.NoError(t, err)
+			assert.InDelta(t, 90, retryAfter, 2)
+
+			var response map[string]any
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+			errorObj := response["error"].(map[string]any)
+			assert.Equal(t, float64(resetAt), errorObj["quota_reset_timestamp"])
+		})
+	}
+}
+
+// TestErrorMapper_RateLimitWithoutQuotaReset 未知重置时间时不猜测 Retry-After
+func TestErrorMapper_RateLimitWithoutQuotaReset(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	mapper := NewErrorMapper()
+	mapper.SendClaudeError(c, mapper.MapCodeWhispererError(http.StatusTooManyRequests, []byte(`{"message":"Too many requests"}`)))
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+	assert.NotContains(t, w.Body.String(), "quota_reset_timestamp")
+}
+
+// TestErrorMapper_ErrorStrategyHeader 响应头标注处理错误的策略，区分 429 与 402 改写的 429
+func TestErrorMapper_ErrorStrategyHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		strategy   string
+	}{
+		{"429", http.StatusTooManyRequests, `{"message":"Too many requests"}`, "rate_limit"},
+		{"402", http.StatusPaymentRequired, `{"message":"monthly quota","reason":"MONTHLY_REQUEST_COUNT"}`, "payment_required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+
+			mapper := NewErrorMapper()
+			mapper.SendClaudeError(c, mapper.MapCodeWhispererError(tt.statusCode, []byte(tt.body)))
+
+			assert.Equal(t, http.StatusTooManyRequests, w.Code)
+			assert.Equal(t, tt.strategy, w.Header().Get(ErrorStrategyHeader))
+		})
+	}
+}
+
+func TestErrorMapper_ErrorTraceIDs(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("request_id", "req_abc")
+	c.Set(upstreamInvocationIDContextKey, "inv-123")
+
+	mapper := NewErrorMapper()
+	mapper.SendClaudeError(c, mapper.MapCodeWhispererError(http.StatusInternalServerError, []byte(`{"message":"boom"}`)))
+
+	assert.Equal(t, "inv-123", w.Header().Get(UpstreamInvocationIDHeader))
+	var response struct {
+		Error map[string]any `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "req_abc", response.Error["request_id"])
+	assert.Equal(t, "inv-123", response.Error["upstream_invocation_id"])
+
+	// 流式错误：ID 写入 error 事件
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	c.Set("request_id", "req_abc")
+	c.Set(upstreamInvocationIDContextKey, "inv-456")
+	mapper.SendStreamError(c, mapper.MapCodeWhispererError(http.StatusInternalServerError, nil), &AnthropicStreamSender{})
+
+	assert.Contains(t, w.Body.String(), "event: error")
+	assert.Contains(t, w.Body.String(), `"request_id":"req_abc"`)
+	assert.Contains(t, w.Body.String(), `"upstream_invocation_id":"inv-456"`)
+}
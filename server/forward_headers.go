@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// forwardHeaderDenylistPrefix 代理自身的控制请求头（如 X-Kiro-Skip-System-Prompt）前缀，始终不转发
+const forwardHeaderDenylistPrefix = "X-Kiro-"
+
+// forwardHeaderDenylist 即使出现在 FORWARD_HEADERS 中也不转发的请求头（认证凭据、逐跳头与请求体描述）
+// extractAPIKey 读取的全部请求头（apiKeyHeaders）在 init 中加入
+var forwardHeaderDenylist = map[string]bool{
+	"Proxy-Authorization":  true,
+	"Cookie":               true,
+	"X-Amz-Security-Token": true,
+	"Host":                 true,
+	"Connection":           true,
+	"Keep-Alive":           true,
+	"Proxy-Connection":     true,
+	"Te":                   true,
+	"Trailer":              true,
+	"Transfer-Encoding":    true,
+	"Upgrade":              true,
+	"Content-Length":       true,
+	"Content-Type":         true,
+	"Content-Encoding":     true,
+}
+
+func init() {
+	for _, header := range apiKeyHeaders {
+		forwardHeaderDenylist[http.CanonicalHeaderKey(header)] = true
+	}
+	forwardHeaders = resolveForwardHeaders(config.ForwardHeaders)
+}
+
+// forwardHeaders 生效的转发白名单（规范化后的请求头名）
+var forwardHeaders []string
+
+// isForwardHeaderDenied 请求头是否禁止转发（规范化后的请求头名）
+func isForwardHeaderDenied(canonical string) bool {
+	return forwardHeaderDenylist[canonical] || strings.HasPrefix(canonical, forwardHeaderDenylistPrefix)
+}
+
+// resolveForwardHeaders 规范化 FORWARD_HEADERS 中的请求头名，去重并剔除禁止转发的请求头
+func resolveForwardHeaders(names []string) []string {
+	var resolved []string
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		canonical := http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if canonical == "" || seen[canonical] {
+			continue
+		}
+		seen[canonical] = true
+		if isForwardHeaderDenied(canonical) {
+			logger.Warn("FORWARD_HEADERS 中的请求头禁止转发，已忽略",
+				logger.String("header", canonical))
+			continue
+		}
+		resolved = append(resolved, canonical)
+	}
+	return resolved
+}
+
+// applyForwardHeaders 将白名单中的客户端请求头复制到上游请求
+// 上游请求中已由代理设置的请求头（固定头、指纹头）不会被覆盖
+func applyForwardHeaders(c *gin.Context, req *http.Request) {
+	if len(forwardHeaders) == 0 || c.Request == nil {
+		return
+	}
+	for _, name := range forwardHeaders {
+		values := c.Request.Header.Values(name)
+		if len(values) == 0 || req.Header.Get(name) != "" {
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+}
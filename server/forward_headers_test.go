@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveForwardHeaders(t *testing.T) {
+	got := resolveForwardHeaders([]string{"x-trace-id", "X-Trace-Id", "authorization", " x-request-source ", "Cookie", "x-api-key", "x-goog-api-key", "X-Kiro-Skip-System-Prompt", "x-kiro-anything", ""})
+	assert.Equal(t, []string{"X-Trace-Id", "X-Request-Source"}, got)
+}
+
+func TestApplyForwardHeaders(t *testing.T) {
+	orig := forwardHeaders
+	forwardHeaders = resolveForwardHeaders([]string{"X-Trace-Id", "Accept", "X-Missing"})
+	t.Cleanup(func() { forwardHeaders = orig })
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	c.Request.Header.Add("X-Trace-Id", "trace-1")
+	c.Request.Header.Add("X-Trace-Id", "trace-2")
+	c.Request.Header.Set("Accept", "application/json")
+	c.Request.Header.Set("X-Not-Listed", "secret")
+
+	req, err := http.NewRequest(http.MethodPost, "https://upstream.example.com", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+
+	applyForwardHeaders(c, req)
+
+	assert.Equal(t, []string{"trace-1", "trace-2"}, req.Header.Values("X-Trace-Id"))
+	assert.Equal(t, "text/event-stream", req.Header.Get("Accept"), "代理设置的请求头不应被覆盖")
+	assert.Empty(t, req.Header.Get("X-Not-Listed"))
+	assert.Empty(t, req.Header.Get("X-Missing"))
+}
@@ -0,0 +1,318 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/parser"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleGeminiGenerateContent 处理 POST /v1beta/models/{model}:generateContent 与 :streamGenerateContent
+// 请求转换为Anthropic格式后复用CodeWhisperer请求链路，响应再转换回Gemini的candidates结构
+func handleGeminiGenerateContent(authService interface {
+	GetToken() (types.TokenInfo, error)
+}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		model, action, found := strings.Cut(c.Param("modelAction"), ":")
+		if !found || model == "" || (action != "generateContent" && action != "streamGenerateContent") {
+			respondError(c, http.StatusNotFound, "%s", "404 未找到")
+			return
+		}
+		stream := action == "streamGenerateContent"
+
+		resolvedModel := model
+		if resolved, _, ok := config.ResolveModelID(model); ok {
+			resolvedModel = resolved
+		}
+
+		reqCtx := &RequestContext{
+			GinContext:     c,
+			AuthService:    authService,
+			RequestType:    "Gemini",
+			RequestedModel: resolvedModel,
+		}
+		tokenInfo, body, err := reqCtx.GetTokenAndBody()
+		if err != nil {
+			return // 错误已在GetTokenAndBody中处理
+		}
+
+		var geminiReq types.GeminiRequest
+		if err := utils.SafeUnmarshal(body, &geminiReq); err != nil {
+			logger.Error("解析Gemini请求体失败", logger.Err(err))
+			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+			return
+		}
+
+		// 按 FALLBACK_MODEL 替换了模型时以回退模型请求上游，响应仍按请求路径中的模型名返回
+		upstreamModel := model
+		if reqCtx.RequestedModel != resolvedModel {
+			upstreamModel = reqCtx.RequestedModel
+		}
+		anthropicReq := converter.ConvertGeminiToAnthropic(geminiReq, upstreamModel, stream)
+		converter.ApplyDefaultSystemPrompt(&anthropicReq, c)
+
+		// 与 /v1/messages 一致：丢弃末尾的 model 轮（prefill），并要求至少一条消息
+		if n := len(anthropicReq.Messages); n > 0 && anthropicReq.Messages[n-1].Role == "assistant" {
+			anthropicReq.Messages = anthropicReq.Messages[:n-1]
+		}
+		if len(anthropicReq.Messages) == 0 {
+			respondError(c, http.StatusBadRequest, "%s", "contents 不能为空")
+			return
+		}
+
+		includeThoughts := geminiReq.GenerationConfig != nil &&
+			geminiReq.GenerationConfig.ThinkingConfig != nil &&
+			geminiReq.GenerationConfig.ThinkingConfig.IncludeThoughts
+
+		if stream {
+			handleGeminiStreamRequest(c, anthropicReq, tokenInfo, model, includeThoughts)
+			return
+		}
+		handleGeminiNonStreamRequest(c, anthropicReq, tokenInfo, model)
+	}
+}
+
+// handleGeminiNonStreamRequest 处理Gemini非流式请求
+func handleGeminiNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo, model string) {
+	anthropicResp, ok := executeNonStreamAnthropicRequest(c, anthropicReq, token)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, converter.ConvertAnthropicToGemini(anthropicResp, model))
+}
+
+// GeminiStreamSender Gemini格式的流事件发送器
+// alt=sse 时以 SSE 的 data 行输出；否则按官方默认格式输出一个逐步写入的JSON数组
+type GeminiStreamSender struct {
+	sse     bool
+	started bool
+}
+
+func (s *GeminiStreamSender) SendEvent(c *gin.Context, data any) error {
+	json, err := utils.SafeMarshal(data)
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("发送Gemini流式分块",
+		addReqFields(c,
+			logger.String("direction", "downstream_send"),
+			logger.Int("payload_len", len(json)),
+		)...)
+
+	switch {
+	case s.sse:
+		fmt.Fprintf(c.Writer, "data: %s\n\n", string(json))
+	case !s.started:
+		fmt.Fprintf(c.Writer, "[%s", string(json))
+	default:
+		fmt.Fprintf(c.Writer, ",\n%s", string(json))
+	}
+	s.started = true
+	c.Writer.Flush()
+	return nil
+}
+
+func (s *GeminiStreamSender) SendError(c *gin.Context, message string, _ error) error {
+	errorBody := map[string]any{
+		"code":    http.StatusInternalServerError,
+		"message": message,
+		"status":  "INTERNAL",
+	}
+	applyErrorTrace(c, errorBody)
+	return s.SendEvent(c, map[string]any{"error": errorBody})
+}
+
+// Keepalive 写出保活内容：SSE模式为注释行，JSON数组模式为元素间合法的空白字符
+func (s *GeminiStreamSender) Keepalive(c *gin.Context) {
+	if s.sse {
+		writeSSEKeepalive(c)
+		return
+	}
+	fmt.Fprint(c.Writer, "\n")
+	c.Writer.Flush()
+}
+
+// Close 结束JSON数组（SSE模式无需处理）
+func (s *GeminiStreamSender) Close(c *gin.Context) {
+	if s.sse {
+		return
+	}
+	if !s.started {
+		fmt.Fprint(c.Writer, "[")
+	}
+	fmt.Fprint(c.Writer, "]")
+	c.Writer.Flush()
+}
+
+// handleGeminiStreamRequest 处理Gemini流式请求
+// 文本/思考增量逐块下发；函数调用在工具块结束时以完整 functionCall 下发（Gemini 不支持参数增量）
+func handleGeminiStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo, model string, includeThoughts bool) {
+	sender := &GeminiStreamSender{sse: c.Query("alt") == "sse"}
+	if sender.sse {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no") // 禁用nginx缓冲
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
+
+	resp, err := executeCodeWhispererRequest(c, anthropicReq, token, true)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	c.Writer.Flush()
+
+	sendParts := func(parts ...types.GeminiPart) {
+		sender.SendEvent(c, types.GeminiResponse{
+			Candidates: []types.GeminiCandidate{
+				{Content: types.GeminiContent{Role: "model", Parts: parts}},
+			},
+			ModelVersion: model,
+		})
+	}
+
+	type pendingCall struct {
+		id   string
+		name string
+		args strings.Builder
+	}
+	pendingCalls := make(map[int]*pendingCall) // 内容块 index -> 待下发的函数调用
+	var output strings.Builder                 // 用于估算输出tokens
+	stopReason := ""
+
+	// 上游静默期间定时写出保活内容
+	body := newKeepaliveReader(resp.Body, config.SSEPingInterval, func() { sender.Keepalive(c) })
+
+	compliantParser := parser.NewCompliantEventStreamParser()
+	buf := make([]byte, 8192)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			// 宽松模式：解析错误时继续处理已解析的事件
+			events, _ := compliantParser.ParseStream(buf[:n])
+			for _, event := range events {
+				dataMap, ok := event.Data.(map[string]any)
+				if !ok {
+					continue
+				}
+				blockIndex := toBlockIndex(dataMap["index"])
+				switch dataMap["type"] {
+				case "content_block_start":
+					block, _ := dataMap["content_block"].(map[string]any)
+					if block["type"] == "tool_use" {
+						id, _ := block["id"].(string)
+						name, _ := block["name"].(string)
+						pendingCalls[blockIndex] = &pendingCall{id: id, name: name}
+					}
+				case "content_block_delta":
+					delta, _ := dataMap["delta"].(map[string]any)
+					switch delta["type"] {
+					case "text_delta":
+						if text, _ := delta["text"].(string); text != "" {
+							output.WriteString(text)
+							sendParts(types.GeminiPart{Text: text})
+						}
+					case "thinking_delta":
+						if text, _ := delta["thinking"].(string); text != "" && includeThoughts {
+							sendParts(types.GeminiPart{Text: text, Thought: true})
+						}
+					case "input_json_delta":
+						if call, ok := pendingCalls[blockIndex]; ok {
+							partial, _ := delta["partial_json"].(string)
+							call.args.WriteString(partial)
+						}
+					}
+				case "content_block_stop":
+					call, ok := pendingCalls[blockIndex]
+					if !ok {
+						continue
+					}
+					delete(pendingCalls, blockIndex)
+					args := map[string]any{}
+					if raw := call.args.String(); raw != "" {
+						if err := utils.SafeUnmarshal([]byte(raw), &args); err != nil {
+							logger.Warn("解析工具参数失败", addReqFields(c, logger.String("tool", call.name), logger.Err(err))...)
+						}
+					}
+					output.WriteString(call.name)
+					output.WriteString(call.args.String())
+					sendParts(types.GeminiPart{
+						FunctionCall: &types.GeminiFunctionCall{ID: call.id, Name: call.name, Args: args},
+					})
+				case "message_delta":
+					if delta, ok := dataMap["delta"].(map[string]any); ok {
+						if sr, _ := delta["stop_reason"].(string); sr != "" {
+							stopReason = sr
+						}
+					}
+				}
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				logger.Warn("读取上游流失败", addReqFields(c, logger.Err(readErr))...)
+			}
+			break
+		}
+	}
+
+	// 最终分块携带 finishReason 与用量
+	countReq := &types.CountTokensRequest{
+		Model:    anthropicReq.Model,
+		System:   anthropicReq.System,
+		Messages: anthropicReq.Messages,
+		Tools:    anthropicReq.Tools,
+	}
+	inputTokens := utils.NewTokenEstimator().EstimateTokens(countReq)
+	outputTokens := utils.CountTokensWithTiktoken(output.String(), "cl100k_base")
+	sender.SendEvent(c, types.GeminiResponse{
+		Candidates: []types.GeminiCandidate{
+			{
+				Content:      types.GeminiContent{Role: "model", Parts: []types.GeminiPart{}},
+				FinishReason: converter.GeminiFinishReason(stopReason),
+			},
+		},
+		UsageMetadata: &types.GeminiUsageMetadata{
+			PromptTokenCount:     inputTokens,
+			CandidatesTokenCount: outputTokens,
+			TotalTokenCount:      inputTokens + outputTokens,
+		},
+		ModelVersion: model,
+	})
+	sender.Close(c)
+
+	logger.Debug("Gemini流式响应完成",
+		addReqFields(c,
+			logger.String("direction", "downstream_send"),
+			logger.String("stop_reason", stopReason),
+			logger.Int("output_tokens", outputTokens),
+		)...)
+}
+
+// toBlockIndex 解析事件中的内容块索引
+func toBlockIndex(v any) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return 0
+}
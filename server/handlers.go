@@ -1,15 +1,18 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"kiro2api/auth"
 	"kiro2api/config"
+	"kiro2api/converter"
 	"kiro2api/logger"
 	"kiro2api/parser"
 	"kiro2api/types"
@@ -64,30 +67,35 @@ func handleStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, to
 	handleGenericStreamRequest(c, anthropicReq, tokenWithUsage, sender, createAnthropicStreamEvents)
 }
 
+// handleMessagesStream 分发 /v1/messages 的流式请求
+func handleMessagesStream(c *gin.Context, anthropicReq types.AnthropicRequest, tokenInfo types.TokenInfo) {
+	// 检测纯 WebSearch 请求（参考 kiro.rs）
+	if hasWebSearchTool(anthropicReq) {
+		handleWebSearchRequest(c, anthropicReq, tokenInfo)
+		return
+	}
+	// 与其他工具一起出现的 web_search：启用 MCP 时由代理执行，否则过滤
+	anthropicReq.WebSearchMCP = requestUsesWebSearchMCP(anthropicReq)
+	// 当启用会话池时，使用带重试的处理器
+	if config.SessionPoolEnabled {
+		handleStreamRequestWithRetry(c, anthropicReq, tokenInfo)
+	} else {
+		handleStreamRequest(c, anthropicReq, tokenInfo)
+	}
+}
+
 // handleStreamRequestWithRetry 带429重试的流式请求处理
-func handleStreamRequestWithRetry(c *gin.Context, anthropicReq types.AnthropicRequest) {
+// token 仅用于 web_search 的 MCP 调用与续写请求，首轮请求使用会话池选择的token
+func handleStreamRequestWithRetry(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
 	// 记录请求接收日志 - 详细记录请求参数
 	logRequestReceived(c, anthropicReq, true)
 
-	// 使用带重试的请求执行
-	resp, err := executeCodeWhispererRequestWithRetry(c, anthropicReq, true)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-
 	// 获取当前token信息用于后续处理
 	tokenWithUsage := &types.TokenWithUsage{
 		AvailableCount: 100,
 		LastUsageCheck: time.Now(),
 	}
-
-	// 初始化SSE响应
 	sender := &AnthropicStreamSender{}
-	if err := initializeSSEResponse(c); err != nil {
-		_ = sender.SendError(c, "连接不支持SSE刷新", err)
-		return
-	}
 
 	// 生成消息ID
 	messageID := fmt.Sprintf(config.MessageIDFormat, time.Now().Format(config.MessageIDTimeFormat))
@@ -98,21 +106,59 @@ func handleStreamRequestWithRetry(c *gin.Context, anthropicReq types.AnthropicRe
 	inputTokens := tokenCalculator.CalculateInputTokens(c.Request.Context(), anthropicReq)
 
 	// 创建流处理上下文
+	// SSE响应头与初始事件延迟到第一个需要下发的事件：在此之前上游限流可以安全地换token重试
 	ctx := NewStreamProcessorContext(c, anthropicReq, tokenWithUsage, sender, messageID, inputTokens)
 	defer ctx.Cleanup()
+	ctx.deferInitialEvents(createAnthropicStreamEvents)
+	ctx.webSearch = newWebSearchInterceptor(anthropicReq, token)
 
-	// 发送初始事件
-	if err := ctx.sendInitialEvents(createAnthropicStreamEvents); err != nil {
+	for attempt := 0; ; attempt++ {
+		// 使用带重试的请求执行（尚未写出任何数据，失败时可直接返回错误响应）
+		resp, err := executeCodeWhispererRequestWithRetry(c, anthropicReq, true)
+		if err != nil {
+			return
+		}
+
+		// 处理事件流
+		ctx.retryOnThrottle = attempt < config.SessionPoolMaxRetries
+		processor := NewEventStreamProcessor(ctx)
+		err = processor.ProcessEventStream(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			logger.Error("事件流处理失败", logger.Err(err))
+			return
+		}
+		if !ctx.throttled {
+			break
+		}
+
+		// 流中途限流且尚未下发任何内容：冷却当前token后换token重新请求
+		tokenKey := c.GetString("token_key")
+		logger.Warn("流式响应开始前收到限流异常，切换Token重试",
+			addReqFields(c,
+				logger.String("token_key", tokenKey),
+				logger.Int("retry", attempt+1),
+			)...)
+		auth.GetSessionTokenPoolManager().MarkTokenCooldown(requestSessionID(c), tokenKey, config.SessionPoolCooldown)
+		ctx.resetForRetry()
+	}
+
+	// 客户端已断开：上游连接已关闭，不再续写或下发结束事件
+	if ctx.clientDisconnected {
 		return
 	}
 
-	// 处理事件流
-	processor := NewEventStreamProcessor(ctx)
-	if err := processor.ProcessEventStream(resp.Body); err != nil {
+	// 上游调用了 web_search：携带搜索结果继续请求
+	if err := runWebSearchFollowUps(ctx); err != nil {
 		logger.Error("事件流处理失败", logger.Err(err))
 		return
 	}
 
+	// 已下发错误事件的流直接结束
+	if ctx.aborted {
+		return
+	}
+
 	// 发送结束事件
 	if err := ctx.sendFinalEvents(); err != nil {
 		logger.Error("发送结束事件失败", logger.Err(err))
@@ -151,6 +197,7 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 	// 创建流处理上下文
 	ctx := NewStreamProcessorContext(c, anthropicReq, token, sender, messageID, inputTokens)
 	defer ctx.Cleanup()
+	ctx.webSearch = newWebSearchInterceptor(anthropicReq, token.TokenInfo)
 
 	// 发送初始事件
 	if err := ctx.sendInitialEvents(eventCreator); err != nil {
@@ -164,6 +211,22 @@ func handleGenericStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequ
 		return
 	}
 
+	// 客户端已断开：上游连接已关闭，不再续写或下发结束事件
+	if ctx.clientDisconnected {
+		return
+	}
+
+	// 上游调用了 web_search：携带搜索结果继续请求
+	if err := runWebSearchFollowUps(ctx); err != nil {
+		logger.Error("事件流处理失败", logger.Err(err))
+		return
+	}
+
+	// 已下发错误事件的流直接结束
+	if ctx.aborted {
+		return
+	}
+
 	// 发送结束事件
 	if err := ctx.sendFinalEvents(); err != nil {
 		logger.Error("发送结束事件失败", logger.Err(err))
@@ -196,6 +259,10 @@ func createAnthropicStreamEvents(messageId string, inputTokens int, model string
 				"usage": map[string]any{
 					"input_tokens":  inputTokens,
 					"output_tokens": 0, // 初始输出tokens为0，最终在message_delta中更新
+					// 缓存tokens在上游响应前未知，输出0；上游报告后在message_delta中更新
+					"cache_creation_input_tokens": 0,
+					"cache_read_input_tokens":     0,
+					"service_tier":                serviceTierStandard,
 				},
 			},
 		},
@@ -207,11 +274,14 @@ func createAnthropicStreamEvents(messageId string, inputTokens int, model string
 }
 
 // createAnthropicFinalEvents 创建Anthropic流式结束事件
-func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string) []map[string]any {
+// stopSequence 为命中的停止序列，为空时输出 null
+func createAnthropicFinalEvents(outputTokens, inputTokens int, cache cacheUsage, stopReason, stopSequence string) []map[string]any {
 	// 构建符合Claude规范的完整usage信息
 	usage := map[string]any{
-		"output_tokens": outputTokens,
-		"input_tokens":  inputTokens,
+		"output_tokens":               outputTokens,
+		"input_tokens":                inputTokens,
+		"cache_creation_input_tokens": cache.creationInputTokens,
+		"cache_read_input_tokens":     cache.readInputTokens,
 	}
 
 	// 删除硬编码的content_block_stop，依赖sendFinalEvents的动态保护机制
@@ -222,12 +292,17 @@ func createAnthropicFinalEvents(outputTokens, inputTokens int, stopReason string
 	// 1. ProcessEventStream正常转发上游的stop事件（99%场景）
 	// 2. sendFinalEvents遍历所有activeBlocks并补发缺失的stop（容错机制，100%覆盖）
 	// 3. handleMessageDelta在发送message_delta前的最后检查（最后保险）
+	var stopSequenceValue any
+	if stopSequence != "" {
+		stopSequenceValue = stopSequence
+	}
+
 	events := []map[string]any{
 		{
 			"type": "message_delta",
 			"delta": map[string]any{
 				"stop_reason":   stopReason,
-				"stop_sequence": nil,
+				"stop_sequence": stopSequenceValue,
 			},
 			"usage": usage,
 		},
@@ -256,47 +331,41 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		_ = Body.Close()
 	}(resp.Body)
 
-	// 读取响应体
-	body, err := utils.ReadHTTPResponse(resp.Body)
-	if err != nil {
-		handleResponseReadError(c, err)
-		return
-	}
-
-	// 使用新的符合AWS规范的解析器，但在非流式模式下增加超时保护
+	// 使用新的符合AWS规范的解析器，边读取边解析，超时保护绑定在请求上下文上
 	compliantParser := parser.NewCompliantEventStreamParser()
 	compliantParser.SetMaxErrors(5) // 限制最大错误次数以防死循环
 
-	// 为非流式解析添加超时保护
-	result, err := func() (*parser.ParseResult, error) {
-		done := make(chan struct{})
-		var result *parser.ParseResult
-		var err error
+	ctx, cancel := nonStreamParseContext(c)
+	defer cancel()
+	result, responseSize, err := readNonStreamResponse(ctx, resp.Body, compliantParser)
+
+	// 超时但已收到部分内容：返回已有内容，而不是整体丢弃
+	truncated := false
+	if errors.Is(err, errNonStreamTimeout) && result != nil &&
+		(result.GetCompletionText() != "" || len(result.ToolExecutions) > 0) {
+		logger.Warn("非流式响应读取超时，返回已收到的部分内容",
+			addReqFields(c,
+				logger.Duration("timeout", config.NonStreamParseTimeout),
+				logger.Int("response_size", responseSize),
+			)...)
+		truncated = true
+		err = nil
+	}
 
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					err = fmt.Errorf("解析器panic: %v", r)
-				}
-				close(done)
-			}()
-			result, err = compliantParser.ParseResponse(body)
-		}()
-
-		select {
-		case <-done:
-			return result, err
-		case <-time.After(10 * time.Second): // 10秒超时
-			logger.Error("非流式解析超时")
-			return nil, fmt.Errorf("解析超时")
-		}
-	}()
+	if errors.Is(err, context.Canceled) {
+		logger.Info("客户端已断开，停止读取上游响应", addReqFields(c, logger.Err(err))...)
+		return
+	}
+	if err != nil && !errors.Is(err, errNonStreamTimeout) && !errors.Is(err, errNonStreamParserPanic) && !errors.Is(err, errNonStreamParse) {
+		handleResponseReadError(c, err)
+		return
+	}
 
 	if err != nil {
 		logger.Error("非流式解析失败",
 			logger.Err(err),
 			logger.String("model", anthropicReq.Model),
-			logger.Int("response_size", len(body)))
+			logger.Int("response_size", responseSize))
 
 		// 提供更详细的错误信息和建议
 		errorResp := gin.H{
@@ -307,29 +376,31 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 
 		// 根据错误类型提供不同的HTTP状态码
 		statusCode := http.StatusInternalServerError
-		if strings.Contains(err.Error(), "解析超时") {
+		if errors.Is(err, errNonStreamTimeout) {
 			statusCode = http.StatusRequestTimeout
 			errorResp["message"] = "请求处理超时，请稍后重试"
-		} else if strings.Contains(err.Error(), "格式错误") {
-			statusCode = http.StatusBadRequest
-			errorResp["message"] = "请求格式不正确"
 		}
 
 		c.JSON(statusCode, errorResp)
 		return
 	}
 
-	// 转换为Anthropic格式
+	// 转换为Anthropic格式（assistant prefill 作为回复开头）
 	var contexts []map[string]any
-	textAgg := result.GetCompletionText()
+	textAgg := anthropicReq.AssistantPrefill + result.GetCompletionText()
+
+	// stop_sequences 客户端侧截断（与流式响应一致）
+	textAgg, stopSequence := truncateAtStopSequence(textAgg, anthropicReq.StopSequences)
 
 	// 先获取工具管理器的所有工具，确保sawToolUse的判断基于实际工具
 	toolManager := compliantParser.GetToolManager()
 	allTools := make([]*parser.ToolExecution, 0)
 
-	// 获取活跃工具
-	for _, tool := range toolManager.GetActiveTools() {
-		allTools = append(allTools, tool)
+	// 获取活跃工具（超时截断时参数不完整，不下发）
+	if !truncated {
+		for _, tool := range toolManager.GetActiveTools() {
+			allTools = append(allTools, tool)
+		}
 	}
 
 	// 获取已完成工具
@@ -337,6 +408,11 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		allTools = append(allTools, tool)
 	}
 
+	// 命中停止序列时响应在该处结束，之后的工具调用不再下发
+	if stopSequence != "" {
+		allTools = allTools[:0]
+	}
+
 	// 基于实际工具数量判断是否包含工具调用
 	sawToolUse := len(allTools) > 0
 
@@ -373,11 +449,20 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	outputTokens := tokenCalculator.EstimateOutputTokens(textAgg, sawToolUse)
 
 	stopReasonManager.UpdateToolCallStatus(sawToolUse, sawToolUse)
+	stopReasonManager.SetStopSequence(stopSequence)
 	stopReason := stopReasonManager.DetermineStopReason()
+	// 超时截断不是模型输出达到上限，使用 pause_turn 提示客户端可继续该轮对话
+	if truncated && stopSequence == "" {
+		stopReason = "pause_turn"
+	}
+	if parseResultRefused(result) {
+		stopReason = "refusal"
+	}
 
+	recordAccessUsage(c, inputTokens, outputTokens)
 	anthropicResp := map[string]any{
 		"content":       contexts,
-		"model":         anthropicReq.Model,
+		"model":         config.ResponseModel(anthropicReq.Model),
 		"role":          "assistant",
 		"stop_reason":   stopReason,
 		"stop_sequence": nil,
@@ -385,8 +470,12 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 		"usage": map[string]any{
 			"input_tokens":  inputTokens,
 			"output_tokens": outputTokens,
+			"service_tier":  serviceTierStandard,
 		},
 	}
+	if stopReason == "stop_sequence" {
+		anthropicResp["stop_sequence"] = stopSequence
+	}
 
 	logger.Debug("下发非流式响应",
 		addReqFields(c,
@@ -398,6 +487,74 @@ func handleNonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest,
 	c.JSON(http.StatusOK, anthropicResp)
 }
 
+var (
+	// errNonStreamTimeout 非流式响应读取/解析超过 NONSTREAM_PARSE_TIMEOUT
+	errNonStreamTimeout = errors.New("解析超时")
+	// errNonStreamParserPanic 解析器panic
+	errNonStreamParserPanic = errors.New("解析器panic")
+	// errNonStreamParse 上游响应解析错误过多
+	errNonStreamParse = errors.New("响应解析失败")
+)
+
+// nonStreamParseContext 基于客户端请求上下文创建非流式解析的超时上下文
+func nonStreamParseContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if c.Request != nil {
+		ctx = c.Request.Context()
+	}
+	if config.NonStreamParseTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, config.NonStreamParseTimeout)
+}
+
+// readNonStreamResponse 增量读取并解析上游非流式响应
+// 读取与 ctx 协作：超时或客户端断开时关闭响应体，阻塞中的读取立即返回，不会遗留解析goroutine；
+// 此时仍返回已解析的部分结果，err 为 errNonStreamTimeout 或 context.Canceled；
+// 解析错误次数过多时停止读取，err 为 errNonStreamParse
+func readNonStreamResponse(ctx context.Context, body io.ReadCloser, compliantParser *parser.CompliantEventStreamParser) (result *parser.ParseResult, size int, err error) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = body.Close()
+	})
+	defer stop()
+
+	var events []parser.SSEEvent
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("%w: %v", errNonStreamParserPanic, r)
+			return
+		}
+		result = compliantParser.BuildResult(events)
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			size += n
+			chunkEvents, parseErr := compliantParser.ParseStream(buf[:n])
+			events = append(events, chunkEvents...)
+			if parseErr != nil {
+				logger.Error("非流式响应解析失败", logger.Int("response_size", size), logger.Err(parseErr))
+				return result, size, fmt.Errorf("%w: %v", errNonStreamParse, parseErr)
+			}
+		}
+		if readErr == nil {
+			continue
+		}
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			logger.Error("非流式解析超时", logger.Int("response_size", size))
+			err = errNonStreamTimeout
+		case ctx.Err() != nil:
+			err = ctx.Err()
+		case readErr != io.EOF:
+			err = readErr
+		}
+		return result, size, err
+	}
+}
+
 // createTokenPreview 创建token预览显示格式 (***+后10位)
 func createTokenPreview(token string) string {
 	if len(token) <= 10 {
@@ -478,6 +635,10 @@ func handleTokenPoolAPI(c *gin.Context) {
 				"status":          "error",
 				"error":           err.Error(),
 				"binding_key":     bindingKey,
+				"daily_quota":     buildDailyQuotaInfo(i),
+				"circuit_breaker": buildCircuitBreakerInfo(i),
+				"cooldown":        buildCooldownInfo(i),
+				"request_stats":   tokenRequestStats.Snapshot(fmt.Sprintf(config.TokenCacheKeyFormat, i)),
 				// 删除相关字段
 				"source":    authConfig.Source,
 				"oauth_id":  authConfig.OAuthID,
@@ -526,6 +687,11 @@ func handleTokenPoolAPI(c *gin.Context) {
 			"deletable": authConfig.Deletable,
 		}
 
+		tokenData["daily_quota"] = buildDailyQuotaInfo(i)
+		tokenData["circuit_breaker"] = buildCircuitBreakerInfo(i)
+		tokenData["cooldown"] = buildCooldownInfo(i)
+		tokenData["request_stats"] = tokenRequestStats.Snapshot(fmt.Sprintf(config.TokenCacheKeyFormat, i))
+
 		// 添加使用限制详细信息 (基于CREDIT资源类型)
 		if usageInfo != nil {
 			tokenData["subscription_info"] = map[string]any{
@@ -592,6 +758,69 @@ func handleTokenPoolAPI(c *gin.Context) {
 	})
 }
 
+// handleTokenUsageHistory 返回指定token的可用额度历史，用于绘制消耗曲线、预估耗尽时间
+func handleTokenUsageHistory(c *gin.Context) {
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil || index < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "index must be a non-negative integer"})
+		return
+	}
+
+	as := auth.GetGlobalAuthService()
+	if as == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "认证服务未初始化"})
+		return
+	}
+	history, ok := as.GetTokenUsageHistory(index)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("token index %d not found", index)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"index":     index,
+		"token_key": fmt.Sprintf(config.TokenCacheKeyFormat, index),
+		"capacity":  config.TokenUsageHistorySize,
+		"history":   history,
+	})
+}
+
+// buildDailyQuotaInfo 构建token今日请求配额信息（limit 为 0、remaining 为 -1 表示不限制）
+func buildDailyQuotaInfo(index int) map[string]any {
+	usage := auth.GetRateLimiter().GetDailyUsage(fmt.Sprintf(config.TokenCacheKeyFormat, index))
+	return map[string]any{
+		"limit":     usage.Limit,
+		"used":      usage.Used,
+		"remaining": usage.Remaining,
+		"reset_at":  usage.ResetAt.Format(time.RFC3339),
+	}
+}
+
+// buildCircuitBreakerInfo 构建token熔断状态（state: closed/open/half_open）
+func buildCircuitBreakerInfo(index int) auth.CircuitBreakerStatus {
+	as := auth.GetGlobalAuthService()
+	if as == nil {
+		return auth.CircuitBreakerStatus{State: auth.CircuitClosed}
+	}
+	return as.GetCircuitBreakerStatus(fmt.Sprintf(config.TokenCacheKeyFormat, index))
+}
+
+// buildCooldownInfo 构建token冷却状态（remaining_seconds 为 0 表示不在冷却期，suspended 表示因账号暂停进入长冷却）
+func buildCooldownInfo(index int) map[string]any {
+	rl := auth.GetRateLimiter()
+	tokenKey := fmt.Sprintf(config.TokenCacheKeyFormat, index)
+	remaining := rl.CooldownRemaining(tokenKey)
+	info := map[string]any{
+		"in_cooldown":       remaining > 0,
+		"remaining_seconds": int(remaining.Seconds()),
+		"suspended":         rl.IsTokenSuspended(tokenKey),
+	}
+	if remaining > 0 {
+		info["cooldown_until"] = time.Now().Add(remaining).Format(time.RFC3339)
+	}
+	return info
+}
+
 // refreshSingleTokenByConfig 根据配置刷新单个token
 func refreshSingleTokenByConfig(config auth.AuthConfig) (types.TokenInfo, error) {
 	switch config.AuthType {
@@ -682,3 +911,118 @@ func logResponseEvent(c *gin.Context, eventType string, details map[string]any)
 
 	logger.Debug("响应处理事件", addReqFields(c, fields...)...)
 }
+
+// parseMessagesRequest 解析并规范化 /v1/messages 请求体（工具格式、-thinking 后缀、assistant 预填充、文档内联），
+// 并校验消息有效性；失败时已写出错误响应，返回 false
+func parseMessagesRequest(c *gin.Context, body []byte) (types.AnthropicRequest, bool) {
+	// 先解析为通用map以便处理工具格式
+	var rawReq map[string]any
+	if err := utils.SafeUnmarshal(body, &rawReq); err != nil {
+		logger.Error("解析请求体失败", logger.Err(err))
+		respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+		return types.AnthropicRequest{}, false
+	}
+
+	// 标准化工具格式处理
+	if tools, exists := rawReq["tools"]; exists && tools != nil {
+		if toolsArray, ok := tools.([]any); ok {
+			normalizedTools := make([]map[string]any, 0, len(toolsArray))
+			for _, tool := range toolsArray {
+				if toolMap, ok := tool.(map[string]any); ok {
+					// 检查是否是简化的工具格式（直接包含name, description, input_schema）
+					if name, hasName := toolMap["name"]; hasName {
+						if description, hasDesc := toolMap["description"]; hasDesc {
+							if inputSchema, hasSchema := toolMap["input_schema"]; hasSchema {
+								// 转换为标准Anthropic工具格式
+								normalizedTool := map[string]any{
+									"name":         name,
+									"description":  description,
+									"input_schema": inputSchema,
+								}
+								normalizedTools = append(normalizedTools, normalizedTool)
+								continue
+							}
+						}
+					}
+					// 如果不是简化格式，保持原样
+					normalizedTools = append(normalizedTools, toolMap)
+				}
+			}
+			rawReq["tools"] = normalizedTools
+		}
+	}
+
+	// 重新序列化并解析为AnthropicRequest
+	normalizedBody, err := utils.SafeMarshal(rawReq)
+	if err != nil {
+		logger.Error("重新序列化请求失败", logger.Err(err))
+		respondError(c, http.StatusBadRequest, "处理请求格式失败: %v", err)
+		return types.AnthropicRequest{}, false
+	}
+
+	var anthropicReq types.AnthropicRequest
+	if err := utils.SafeUnmarshal(normalizedBody, &anthropicReq); err != nil {
+		logger.Error("解析标准化请求体失败", logger.Err(err))
+		respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
+		return types.AnthropicRequest{}, false
+	}
+
+	// 检测 -thinking 后缀，自动开启思考模式；请求已自带 thinking 配置时不再叠加
+	converter.ApplyThinkingModelSuffix(&anthropicReq)
+
+	anthropicReq.InterleavedThinking = hasAnthropicBeta(c, betaInterleavedThinking)
+	anthropicReq.ServiceTier = resolveServiceTier(c, anthropicReq.ServiceTier)
+
+	// 验证请求的有效性（消息、工具定义、thinking 配置），避免格式错误的请求在上游才失败
+	if verr := ValidateAnthropicRequest(anthropicReq); verr != nil {
+		respondInvalidRequest(c, verr)
+		return types.AnthropicRequest{}, false
+	}
+
+	// 可选：按工具 input_schema 检查历史 tool_use 的 input（VALIDATE_TOOL_INPUTS）
+	if terr := converter.ValidateToolInputs(&anthropicReq); terr != nil {
+		respondInvalidRequest(c, &ValidationError{Field: terr.Path(), Message: terr.Error()})
+		return types.AnthropicRequest{}, false
+	}
+
+	// assistant prefill：默认作为回复开头下发并让上游续写；
+	// DROP_ASSISTANT_PREFILL=true 或预填充不是纯文本时静默丢弃（参考 kiro.rs fix #72）
+	if lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]; lastMsg.Role == "assistant" {
+		if !config.DropAssistantPrefill {
+			anthropicReq.AssistantPrefill = converter.AssistantPrefillText(lastMsg.Content)
+		}
+		if anthropicReq.AssistantPrefill != "" && len(anthropicReq.Messages) > 1 {
+			logger.Debug("转发 assistant prefill 消息",
+				addReqFields(c, logger.Int("prefill_len", len(anthropicReq.AssistantPrefill)))...)
+		} else {
+			logger.Debug("静默丢弃 assistant prefill 消息")
+			anthropicReq.AssistantPrefill = ""
+			anthropicReq.Messages = anthropicReq.Messages[:len(anthropicReq.Messages)-1]
+			if len(anthropicReq.Messages) == 0 {
+				respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
+				return types.AnthropicRequest{}, false
+			}
+		}
+	}
+
+	// document 块在代理侧提取文本后内联（上游不支持文档附件）
+	anthropicReq.Messages, err = converter.InlineDocuments(anthropicReq.Messages)
+	if err != nil {
+		logger.Warn("文档处理失败", addReqFields(c, logger.Err(err))...)
+		respondError(c, http.StatusBadRequest, "文档处理失败: %v", err)
+		return types.AnthropicRequest{}, false
+	}
+
+	// 验证最后一条消息有有效内容
+	lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]
+	content, err := utils.GetMessageContent(lastMsg.Content)
+	if err != nil || strings.TrimSpace(content) == "" || strings.TrimSpace(content) == "answer for user question" {
+		respondError(c, http.StatusBadRequest, "%s", "消息内容不能为空")
+		return types.AnthropicRequest{}, false
+	}
+
+	// 注入默认系统提示，使其计入输入token估算
+	converter.ApplyDefaultSystemPrompt(&anthropicReq, c)
+
+	return anthropicReq, true
+}
@@ -1,11 +1,19 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"kiro2api/parser"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func init() {
@@ -206,3 +214,60 @@ func TestCreateTokenPreview_EdgeCases(t *testing.T) {
 		})
 	}
 }
+
+// encodeAssistantEventFrame 构造无头部的事件流帧（解析器默认按 assistantResponseEvent 处理，不校验CRC）
+func encodeAssistantEventFrame(payload string) []byte {
+	frame := make([]byte, 12, 16+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(16+len(payload)))
+	frame = append(frame, payload...)
+	return append(frame, 0, 0, 0, 0)
+}
+
+func TestReadNonStreamResponse_Complete(t *testing.T) {
+	body := io.NopCloser(io.MultiReader(
+		bytes.NewReader(encodeAssistantEventFrame(`{"content":"Hello, "}`)),
+		bytes.NewReader(encodeAssistantEventFrame(`{"content":"world"}`)),
+	))
+
+	result, size, err := readNonStreamResponse(context.Background(), body, parser.NewCompliantEventStreamParser())
+	require.NoError(t, err)
+	assert.Greater(t, size, 0)
+	assert.Equal(t, "Hello, world", result.GetCompletionText())
+}
+
+func TestReadNonStreamResponse_TimeoutReturnsPartial(t *testing.T) {
+	reader, writer := io.Pipe()
+	go func() {
+		_, _ = writer.Write(encodeAssistantEventFrame(`{"content":"partial"}`))
+		// 之后上游不再发送数据，也不结束响应
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	result, _, err := readNonStreamResponse(ctx, reader, parser.NewCompliantEventStreamParser())
+	assert.ErrorIs(t, err, errNonStreamTimeout)
+	assert.Less(t, time.Since(start), 2*time.Second, "超时后应立即中断阻塞的读取")
+	require.NotNil(t, result)
+	assert.Equal(t, "partial", result.GetCompletionText())
+}
+
+func TestReadNonStreamResponse_ClientCanceled(t *testing.T) {
+	reader, _ := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := readNonStreamResponse(ctx, reader, parser.NewCompliantEventStreamParser())
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReadNonStreamResponse_ParseErrorsReturnError(t *testing.T) {
+	// 消息长度字段无效的垃圾数据，解析器逐段跳过并累计错误，超过最大错误次数
+	stream := bytes.Repeat([]byte{0xff}, 64)
+	p := parser.NewCompliantEventStreamParser()
+	p.SetMaxErrors(5)
+
+	_, _, err := readNonStreamResponse(context.Background(), io.NopCloser(bytes.NewReader(stream)), p)
+	assert.ErrorIs(t, err, errNonStreamParse)
+}
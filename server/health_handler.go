@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"kiro2api/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PoolHealthProvider 提供token池健康状况
+type PoolHealthProvider interface {
+	GetPoolHealth() auth.PoolHealth
+}
+
+// handleHealth 负载均衡健康检查
+// 至少一个token可用时返回 200，否则返回 503；部分token不可用时 degraded=true
+func handleHealth(provider PoolHealthProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var health auth.PoolHealth
+		if provider != nil {
+			health = provider.GetPoolHealth()
+		}
+
+		status := "ok"
+		statusCode := http.StatusOK
+		if health.Active == 0 {
+			status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		c.JSON(statusCode, gin.H{
+			"status":        status,
+			"timestamp":     time.Now().Format(time.RFC3339),
+			"total_tokens":  health.Total,
+			"active_tokens": health.Active,
+			"degraded":      health.Active > 0 && health.Active < health.Total,
+		})
+	}
+}
+
+// handleLivez Kubernetes 存活探针：进程存活且 HTTP 服务正常处理请求即返回 200
+func handleLivez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleReadyz Kubernetes 就绪探针：完成首次token缓存刷新且至少一个token可用时返回 200，否则返回 503
+// 避免token未预热时就接收流量
+func handleReadyz(provider PoolHealthProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var health auth.PoolHealth
+		if provider != nil {
+			health = provider.GetPoolHealth()
+		}
+
+		status := "ready"
+		statusCode := http.StatusOK
+		switch {
+		case !health.CacheRefreshed:
+			status = "warming_up"
+			statusCode = http.StatusServiceUnavailable
+		case health.Active == 0:
+			status = "unavailable"
+			statusCode = http.StatusServiceUnavailable
+		}
+
+		c.JSON(statusCode, gin.H{
+			"status":        status,
+			"active_tokens": health.Active,
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/auth"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubPoolHealthProvider struct {
+	health auth.PoolHealth
+}
+
+func (s stubPoolHealthProvider) GetPoolHealth() auth.PoolHealth {
+	return s.health
+}
+
+func performHealthRequest(t *testing.T, provider PoolHealthProvider) (*httptest.ResponseRecorder, map[string]any) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(PathBasedAuthMiddleware([]string{"/v1"}))
+	router.GET("/health", handleHealth(provider))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+
+	var body map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return w, body
+}
+
+func TestHandleHealth_AllActive(t *testing.T) {
+	w, body := performHealthRequest(t, stubPoolHealthProvider{auth.PoolHealth{Total: 2, Active: 2}})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok", body["status"])
+	assert.Equal(t, false, body["degraded"])
+	assert.Equal(t, float64(2), body["active_tokens"])
+}
+
+func TestHandleHealth_Degraded(t *testing.T) {
+	w, body := performHealthRequest(t, stubPoolHealthProvider{auth.PoolHealth{Total: 3, Active: 1}})
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, true, body["degraded"])
+	assert.Equal(t, float64(3), body["total_tokens"])
+}
+
+func TestHandleHealth_NoActiveTokens(t *testing.T) {
+	w, body := performHealthRequest(t, stubPoolHealthProvider{auth.PoolHealth{Total: 2, Active: 0}})
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "unavailable", body["status"])
+	assert.Equal(t, false, body["degraded"])
+}
+
+func TestHandleHealth_NilAuthService(t *testing.T) {
+	var as *auth.AuthService
+	w, body := performHealthRequest(t, as)
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, float64(0), body["total_tokens"])
+}
+
+func TestHandleProbes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	probe := func(provider PoolHealthProvider, path string) (int, string) {
+		router := gin.New()
+		router.Use(PathBasedAuthMiddleware([]string{"/v1"}))
+		router.GET("/livez", handleLivez)
+		router.GET("/readyz", handleReadyz(provider))
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var body map[string]any
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		status, _ := body["status"].(string)
+		return w.Code, status
+	}
+
+	code, _ := probe(nil, "/livez")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, status := probe(stubPoolHealthProvider{auth.PoolHealth{Total: 1, Active: 1}}, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "warming_up", status)
+
+	code, status = probe(stubPoolHealthProvider{auth.PoolHealth{Total: 1, CacheRefreshed: true}}, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "unavailable", status)
+
+	code, status = probe(stubPoolHealthProvider{auth.PoolHealth{Total: 1, Active: 1, CacheRefreshed: true}}, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", status)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keepaliveReader 包装上游响应体：等待上游数据期间，每隔 interval 在调用方goroutine中执行一次 onIdle
+// 读取在后台goroutine中进行，而保活事件的写出仍由调用 Read 的goroutine完成，
+// 因此与正常事件的写出天然串行，不需要对 gin.ResponseWriter 加锁；流结束后不再调用 Read，保活随之停止
+type keepaliveReader struct {
+	ctx      context.Context
+	src      io.Reader
+	interval time.Duration
+	onIdle   func()
+}
+
+type keepaliveReadResult struct {
+	n   int
+	err error
+}
+
+// newKeepaliveReader 创建保活读取器，interval <= 0 时直接返回原始 reader
+func newKeepaliveReader(src io.Reader, interval time.Duration, onIdle func()) io.Reader {
+	return newContextKeepaliveReader(context.Background(), src, interval, onIdle)
+}
+
+// newContextKeepaliveReader 创建可取消的保活读取器：ctx 结束（如客户端断开）时 Read 立即返回 ctx.Err()
+// interval <= 0 时不发送保活；ctx 不可取消且不需要保活时直接返回原始 reader
+func newContextKeepaliveReader(ctx context.Context, src io.Reader, interval time.Duration, onIdle func()) io.Reader {
+	if interval <= 0 {
+		onIdle = nil
+	}
+	if onIdle == nil && ctx.Done() == nil {
+		return src
+	}
+	return &keepaliveReader{ctx: ctx, src: src, interval: interval, onIdle: onIdle}
+}
+
+func (r *keepaliveReader) Read(p []byte) (int, error) {
+	// 正常情况下每次读取都等待其完成后才返回，后台goroutine不会在 Read 返回后继续写入 p；
+	// ctx 结束时提前返回，调用方必须停止使用 p 并关闭 src 以结束后台读取
+	done := make(chan keepaliveReadResult, 1)
+	go func() {
+		n, err := r.src.Read(p)
+		done <- keepaliveReadResult{n: n, err: err}
+	}()
+
+	// 不需要保活时 tick 为 nil，对应分支永远不会触发
+	var tick <-chan time.Time
+	if r.onIdle != nil {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case result := <-done:
+			return result.n, result.err
+		case <-tick:
+			r.onIdle()
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+// writeSSEKeepalive 写出SSE注释行保活（OpenAI/Gemini 客户端会忽略注释）
+func writeSSEKeepalive(c *gin.Context) {
+	fmt.Fprint(c.Writer, ": keepalive\n\n")
+	c.Writer.Flush()
+}
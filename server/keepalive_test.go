@@ -0,0 +1,60 @@
+package server
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeepaliveReader_PingsWhileUpstreamIsQuiet(t *testing.T) {
+	reader, writer := io.Pipe()
+	go func() {
+		time.Sleep(120 * time.Millisecond)
+		_, _ = writer.Write([]byte("data"))
+		_ = writer.Close()
+	}()
+
+	pings := 0
+	r := newKeepaliveReader(reader, 20*time.Millisecond, func() { pings++ })
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.GreaterOrEqual(t, pings, 2, "上游静默期间应多次触发保活")
+}
+
+func TestKeepaliveReader_Disabled(t *testing.T) {
+	src := strings.NewReader("data")
+	assert.Same(t, io.Reader(src), newKeepaliveReader(src, 0, func() {}))
+}
+
+// TestSSEStateManager_PingOrdering ping 只能出现在 message_start 与 message_stop 之间
+func TestSSEStateManager_PingOrdering(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	sender := &recordingStreamSender{}
+	ssm := NewSSEStateManager(false)
+	ping := map[string]any{"type": "ping"}
+
+	require.NoError(t, ssm.SendEvent(c, sender, ping))
+	assert.Empty(t, sender.events, "message_start 之前的 ping 应被跳过")
+
+	require.NoError(t, ssm.SendEvent(c, sender, map[string]any{"type": "message_start", "message": map[string]any{}}))
+	require.NoError(t, ssm.SendEvent(c, sender, ping))
+	require.Len(t, sender.events, 2)
+	assert.Equal(t, "ping", sender.events[1]["type"])
+
+	require.NoError(t, ssm.SendEvent(c, sender, map[string]any{"type": "message_delta", "delta": map[string]any{"stop_reason": "end_turn"}}))
+	require.NoError(t, ssm.SendEvent(c, sender, map[string]any{"type": "message_stop"}))
+	count := len(sender.events)
+	require.NoError(t, ssm.SendEvent(c, sender, ping))
+	assert.Len(t, sender.events, count, "message_stop 之后的 ping 应被跳过")
+
+	strict := NewSSEStateManager(true)
+	assert.Error(t, strict.SendEvent(c, &recordingStreamSender{}, ping))
+}
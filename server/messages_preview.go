@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// previewRedactedAuthorization 预览中替代真实 access token 的占位值
+const previewRedactedAuthorization = "Bearer <redacted>"
+
+// handleMessagesPreview 预览 /v1/messages 请求转换后的上游请求
+// 执行与正式请求相同的解析与转换流程，但不获取token、不选择出口代理、不调用上游
+// 返回上游URL、请求头（Authorization 已脱敏）与序列化后的 CodeWhispererRequest
+func handleMessagesPreview(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "读取请求体失败: %v", err)
+		return
+	}
+
+	anthropicReq, ok := parseMessagesRequest(c, body)
+	if !ok {
+		return // 错误已在parseMessagesRequest中处理
+	}
+	if anthropicReq.Stream {
+		anthropicReq.WebSearchMCP = requestUsesWebSearchMCP(anthropicReq)
+	}
+
+	req, err := newCodeWhispererRequest(c, anthropicReq, types.TokenInfo{}, anthropicReq.Stream)
+	if err != nil {
+		if c.Writer.Written() {
+			return // 模型未找到等错误已写出
+		}
+		var tooLarge *RequestTooLargeError
+		if errors.As(err, &tooLarge) {
+			respondRequestTooLarge(c, tooLarge)
+			return
+		}
+		logger.Warn("预览请求构建失败", addReqFields(c, logger.Err(err))...)
+		respondError(c, http.StatusBadRequest, "构建请求失败: %v", err)
+		return
+	}
+
+	cwReqBody, err := io.ReadAll(req.Body)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "读取预览请求体失败: %v", err)
+		return
+	}
+
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		headers[name] = strings.Join(values, ", ")
+	}
+	headers["Authorization"] = previewRedactedAuthorization
+
+	c.JSON(http.StatusOK, gin.H{
+		"method":  req.Method,
+		"url":     req.URL.String(),
+		"headers": headers,
+		"body":    json.RawMessage(cwReqBody),
+	})
+}
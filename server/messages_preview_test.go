@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMessagesPreviewRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/messages/preview", handleMessagesPreview)
+	return r
+}
+
+func TestHandleMessagesPreview_ReturnsUpstreamRequest(t *testing.T) {
+	r := newMessagesPreviewRouter()
+	body := `{"model":"claude-sonnet-4-20250514","max_tokens":100,"stream":true,
+		"system":"be brief","messages":[{"role":"user","content":"hello"}]}`
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages/preview", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	var resp struct {
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Body    map[string]any    `json:"body"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, http.MethodPost, resp.Method)
+	assert.NotEmpty(t, resp.URL)
+	assert.Equal(t, previewRedactedAuthorization, resp.Headers["Authorization"])
+	assert.Equal(t, "text/event-stream", resp.Headers["Accept"])
+
+	state, ok := resp.Body["conversationState"].(map[string]any)
+	require.True(t, ok, "body 应为序列化的 CodeWhispererRequest")
+	assert.Contains(t, w.Body.String(), "hello")
+	assert.NotEmpty(t, state["conversationId"])
+}
+
+func TestHandleMessagesPreview_InvalidRequest(t *testing.T) {
+	r := newMessagesPreviewRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages/preview",
+		strings.NewReader(`{"model":"claude-sonnet-4-20250514","messages":[]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_request_error")
+	assert.Contains(t, w.Body.String(), "messages: ")
+}
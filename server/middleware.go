@@ -7,6 +7,7 @@ import (
 
 	"kiro2api/config"
 	"kiro2api/logger"
+	"kiro2api/metrics"
 	"kiro2api/utils"
 
 	"github.com/gin-gonic/gin"
@@ -24,8 +25,11 @@ func MaxBodySizeMiddleware() gin.HandlerFunc {
 	}
 }
 
+// clientTokenIDContextKey 认证通过的客户端token标识在 gin 上下文中的键（见 config.ClientTokenID）
+const clientTokenIDContextKey = "client_token_id"
+
 // PathBasedAuthMiddleware 创建基于路径的API密钥验证中间件
-func PathBasedAuthMiddleware(authToken string, protectedPrefixes []string) gin.HandlerFunc {
+func PathBasedAuthMiddleware(protectedPrefixes []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		path := c.Request.URL.Path
 
@@ -36,7 +40,7 @@ func PathBasedAuthMiddleware(authToken string, protectedPrefixes []string) gin.H
 			return
 		}
 
-		if !validateAPIKey(c, authToken) {
+		if !validateAPIKey(c) {
 			c.Abort()
 			return
 		}
@@ -68,6 +72,54 @@ func UIAuthMiddleware(uiPassword string, protectedPrefixes []string) gin.Handler
 	}
 }
 
+// AdminAuthMiddleware 未设置 UI 密码时，要求指定前缀下的写操作（GET/HEAD/OPTIONS 以外的请求）提供客户端API密钥
+// 设置了 UI 密码时这些端点已由 UIAuthMiddleware 保护，此处直接放行
+func AdminAuthMiddleware(uiPassword string, protectedPrefixes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if uiPassword != "" || isReadOnlyMethod(c.Request.Method) || !requiresAuth(c.Request.URL.Path, protectedPrefixes) {
+			c.Next()
+			return
+		}
+
+		if !validateAPIKey(c) {
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// isReadOnlyMethod 是否为不修改服务端状态的请求方法
+func isReadOnlyMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// MetricsMiddleware 按模型与状态码统计请求数（仅统计指定前缀的路径）
+func MetricsMiddleware(prefixes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if !requiresAuth(c.Request.URL.Path, prefixes) {
+			return
+		}
+		metrics.RecordRequest(metricsModelLabel(c.GetString("requested_model")), c.Writer.Status())
+	}
+}
+
+// metricsModelLabel 将客户端请求的模型名映射为指标标签
+// 只使用解析后的规范模型名，无法解析的模型统一记为 other，避免任意模型名产生无限多的时间序列
+func metricsModelLabel(model string) string {
+	if resolved, _, ok := config.ResolveModelID(model); ok {
+		return resolved
+	}
+	return "other"
+}
+
 // RequestIDMiddleware 为每个请求注入 request_id 并通过响应头返回
 // - 优先使用客户端的 X-Request-ID
 // - 若无则生成一个UUID（utils.GenerateUUID）
@@ -129,19 +181,35 @@ func requiresAuth(path string, protectedPrefixes []string) bool {
 	return false
 }
 
+// apiKeyHeaders 按优先级读取API密钥的请求头（Gemini 客户端使用 x-goog-api-key）
+// 这些请求头同时禁止通过 FORWARD_HEADERS 转发到上游
+var apiKeyHeaders = []string{"Authorization", "X-Api-Key", "X-Goog-Api-Key"}
+
+// geminiPathPrefix Gemini 兼容端点的路径前缀，仅这些端点接受 ?key= 查询参数
+const geminiPathPrefix = "/v1beta/"
+
 // extractAPIKey 提取API密钥的通用逻辑
 func extractAPIKey(c *gin.Context) string {
-	apiKey := c.GetHeader("Authorization")
-	if apiKey == "" {
-		apiKey = c.GetHeader("x-api-key")
-	} else {
-		apiKey = strings.TrimPrefix(apiKey, "Bearer ")
+	for _, header := range apiKeyHeaders {
+		apiKey := c.GetHeader(header)
+		if apiKey == "" {
+			continue
+		}
+		if header == "Authorization" {
+			apiKey = strings.TrimPrefix(apiKey, "Bearer ")
+		}
+		return apiKey
 	}
-	return apiKey
+	// Gemini 客户端也可使用 ?key= 查询参数；其他端点不接受，避免密钥出现在URL与访问日志中
+	if strings.HasPrefix(c.Request.URL.Path, geminiPathPrefix) {
+		return c.Query("key")
+	}
+	return ""
 }
 
-// validateAPIKey 验证API密钥 - 重构后的版本
-func validateAPIKey(c *gin.Context, authToken string) bool {
+// validateAPIKey 验证API密钥：匹配 KIRO_CLIENT_TOKEN / KIRO_CLIENT_TOKENS / KIRO_CLIENT_TOKENS_FILE 中任一token
+// 匹配成功时将该token的标识写入上下文（client_token_id），供按调用方限流与日志使用
+func validateAPIKey(c *gin.Context) bool {
 	providedApiKey := extractAPIKey(c)
 
 	if providedApiKey == "" {
@@ -150,7 +218,8 @@ func validateAPIKey(c *gin.Context, authToken string) bool {
 		return false
 	}
 
-	if providedApiKey != authToken {
+	tokenID, ok := config.MatchClientToken(providedApiKey)
+	if !ok {
 		logger.Error("authToken验证失败",
 			logger.String("expected", "***"),
 			logger.String("provided", "***"))
@@ -158,6 +227,7 @@ func validateAPIKey(c *gin.Context, authToken string) bool {
 		return false
 	}
 
+	c.Set(clientTokenIDContextKey, tokenID)
 	return true
 }
 
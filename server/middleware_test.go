@@ -5,6 +5,8 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"kiro2api/config"
+
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -16,10 +18,10 @@ func TestPathBasedAuthMiddleware_ValidToken(t *testing.T) {
 	c, router := gin.CreateTestContext(w)
 
 	// 配置中间件
-	authToken := "test-token-123"
+	setClientTokensForTest(t, "test-token-123")
 	protectedPrefixes := []string{"/v1/"}
 
-	router.Use(PathBasedAuthMiddleware(authToken, protectedPrefixes))
+	router.Use(PathBasedAuthMiddleware(protectedPrefixes))
 	router.POST("/v1/messages", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "success"})
 	})
@@ -39,10 +41,10 @@ func TestPathBasedAuthMiddleware_InvalidToken(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, router := gin.CreateTestContext(w)
 
-	authToken := "test-token-123"
+	setClientTokensForTest(t, "test-token-123")
 	protectedPrefixes := []string{"/v1/"}
 
-	router.Use(PathBasedAuthMiddleware(authToken, protectedPrefixes))
+	router.Use(PathBasedAuthMiddleware(protectedPrefixes))
 	router.POST("/v1/messages", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "success"})
 	})
@@ -61,10 +63,10 @@ func TestPathBasedAuthMiddleware_MissingAuthHeader(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, router := gin.CreateTestContext(w)
 
-	authToken := "test-token-123"
+	setClientTokensForTest(t, "test-token-123")
 	protectedPrefixes := []string{"/v1/"}
 
-	router.Use(PathBasedAuthMiddleware(authToken, protectedPrefixes))
+	router.Use(PathBasedAuthMiddleware(protectedPrefixes))
 	router.POST("/v1/messages", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "success"})
 	})
@@ -82,10 +84,10 @@ func TestPathBasedAuthMiddleware_UnprotectedPath(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, router := gin.CreateTestContext(w)
 
-	authToken := "test-token-123"
+	setClientTokensForTest(t, "test-token-123")
 	protectedPrefixes := []string{"/v1/"}
 
-	router.Use(PathBasedAuthMiddleware(authToken, protectedPrefixes))
+	router.Use(PathBasedAuthMiddleware(protectedPrefixes))
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "healthy"})
 	})
@@ -103,10 +105,10 @@ func TestPathBasedAuthMiddleware_EmptyProtectedPrefixes(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, router := gin.CreateTestContext(w)
 
-	authToken := "test-token-123"
+	setClientTokensForTest(t, "test-token-123")
 	protectedPrefixes := []string{}
 
-	router.Use(PathBasedAuthMiddleware(authToken, protectedPrefixes))
+	router.Use(PathBasedAuthMiddleware(protectedPrefixes))
 	router.POST("/any/path", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "success"})
 	})
@@ -124,10 +126,10 @@ func TestPathBasedAuthMiddleware_InvalidBearerFormat(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, router := gin.CreateTestContext(w)
 
-	authToken := "test-token-123"
+	setClientTokensForTest(t, "test-token-123")
 	protectedPrefixes := []string{"/v1/"}
 
-	router.Use(PathBasedAuthMiddleware(authToken, protectedPrefixes))
+	router.Use(PathBasedAuthMiddleware(protectedPrefixes))
 	router.POST("/v1/messages", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "success"})
 	})
@@ -146,10 +148,10 @@ func TestPathBasedAuthMiddleware_MultipleProtectedPrefixes(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, router := gin.CreateTestContext(w)
 
-	authToken := "test-token-123"
+	setClientTokensForTest(t, "test-token-123")
 	protectedPrefixes := []string{"/v1/", "/api/"}
 
-	router.Use(PathBasedAuthMiddleware(authToken, protectedPrefixes))
+	router.Use(PathBasedAuthMiddleware(protectedPrefixes))
 	router.POST("/api/data", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"message": "success"})
 	})
@@ -161,3 +163,179 @@ func TestPathBasedAuthMiddleware_MultipleProtectedPrefixes(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, w.Code)
 }
+
+func TestPathBasedAuthMiddleware_GeminiAPIKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	setClientTokensForTest(t, "test-token-123")
+
+	router := gin.New()
+	router.Use(PathBasedAuthMiddleware([]string{"/v1"}))
+	router.POST("/v1beta/models/:modelAction", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "success"})
+	})
+	router.POST("/v1/messages", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "success"})
+	})
+
+	// x-goog-api-key 请求头
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent", nil)
+	req.Header.Set("x-goog-api-key", "test-token-123")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// ?key= 查询参数
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent?key=test-token-123", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1beta/models/gemini-2.5-pro:generateContent?key=wrong", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// 非 Gemini 端点不接受 ?key= 查询参数
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1/messages?key=test-token-123", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func newCORSTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(corsMiddleware())
+	r.GET("/v1/models", func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r
+}
+
+func TestCORSMiddleware_DefaultWildcard(t *testing.T) {
+	orig := config.CORSAllowedOrigins
+	config.CORSAllowedOrigins = nil
+	defer func() { config.CORSAllowedOrigins = orig }()
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	req.Header.Set("Origin", "https://any.example.com")
+	newCORSTestRouter().ServeHTTP(w, req)
+
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCORSMiddleware_AllowedOrigins(t *testing.T) {
+	orig := config.CORSAllowedOrigins
+	config.CORSAllowedOrigins = []string{"https://dashboard.example.com/"}
+	defer func() { config.CORSAllowedOrigins = orig }()
+	r := newCORSTestRouter()
+
+	// 白名单中的来源：回显 Origin 并允许凭据
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodOptions, "/v1/models", nil)
+	req.Header.Set("Origin", "https://dashboard.example.com")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://dashboard.example.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, config.CORSAllowedMethods, w.Header().Get("Access-Control-Allow-Methods"))
+
+	// 其他来源：不返回 CORS 头，预检请求被拒绝
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodOptions, "/v1/models", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// setClientTokensForTest 设置测试期间生效的客户端token，结束后清空
+func setClientTokensForTest(t *testing.T, tokens ...string) {
+	t.Helper()
+	config.SetClientTokens(tokens)
+	t.Cleanup(func() { config.SetClientTokens(nil) })
+}
+
+func TestPathBasedAuthMiddleware_MultipleClientTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setClientTokensForTest(t, "team-a", "team-b")
+
+	router := gin.New()
+	router.Use(PathBasedAuthMiddleware([]string{"/v1/"}))
+	router.POST("/v1/messages", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(clientTokenIDContextKey))
+	})
+
+	send := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/v1/messages", nil)
+		req.Header.Set("x-api-key", token)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("team-b")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, config.ClientTokenID("team-b"), w.Body.String())
+
+	w = send("team-a")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, config.ClientTokenID("team-a"), w.Body.String())
+
+	// 吊销 team-b 后立即拒绝
+	config.SetClientTokens([]string{"team-a"})
+	assert.Equal(t, http.StatusUnauthorized, send("team-b").Code)
+}
+
+func TestAdminAuthMiddleware_RequiresClientTokenWithoutUIPassword(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setClientTokensForTest(t, "team-a")
+
+	newRouter := func(uiPassword string) *gin.Engine {
+		router := gin.New()
+		router.Use(AdminAuthMiddleware(uiPassword, []string{"/api", "/oauth"}))
+		router.POST("/api/client-tokens/reload", func(c *gin.Context) { c.Status(http.StatusOK) })
+		router.GET("/api/session-binding/:session_id", func(c *gin.Context) { c.Status(http.StatusOK) })
+		router.DELETE("/api/session-binding/:session_id", func(c *gin.Context) { c.Status(http.StatusOK) })
+		router.POST("/oauth/start", func(c *gin.Context) { c.Status(http.StatusOK) })
+		return router
+	}
+	send := func(router *gin.Engine, method, path, token string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	router := newRouter("")
+	assert.Equal(t, http.StatusUnauthorized, send(router, http.MethodPost, "/api/client-tokens/reload", ""))
+	assert.Equal(t, http.StatusUnauthorized, send(router, http.MethodPost, "/api/client-tokens/reload", "wrong"))
+	assert.Equal(t, http.StatusOK, send(router, http.MethodPost, "/api/client-tokens/reload", "team-a"))
+
+	// 其他写操作同样需要客户端API密钥，只读请求不受影响
+	assert.Equal(t, http.StatusUnauthorized, send(router, http.MethodDelete, "/api/session-binding/s1", ""))
+	assert.Equal(t, http.StatusOK, send(router, http.MethodDelete, "/api/session-binding/s1", "team-a"))
+	assert.Equal(t, http.StatusUnauthorized, send(router, http.MethodPost, "/oauth/start", ""))
+	assert.Equal(t, http.StatusOK, send(router, http.MethodGet, "/api/session-binding/s1", ""))
+
+	// 设置了 UI 密码时由 UIAuthMiddleware 负责认证
+	assert.Equal(t, http.StatusOK, send(newRouter("ui-secret"), http.MethodDelete, "/api/session-binding/s1", ""))
+}
+
+func TestMetricsModelLabel(t *testing.T) {
+	assert.Equal(t, config.CanonicalModelSonnet45, metricsModelLabel("claude-sonnet-4-20250514"))
+	assert.Equal(t, config.CanonicalModelSonnet46, metricsModelLabel("claude-sonnet-4-6"))
+	// 无法解析的模型名不作为标签，避免客户端制造任意时间序列
+	assert.Equal(t, "other", metricsModelLabel("random-model-abc123"))
+	assert.Equal(t, "other", metricsModelLabel(""))
+}
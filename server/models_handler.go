@@ -0,0 +1,135 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AvailableModelsProvider 提供当前token池可用的模型（按账号等级聚合）
+type AvailableModelsProvider interface {
+	GetAvailableModels() []string
+}
+
+// modelListFilter GET /v1/models 的查询过滤条件（nil 表示不过滤）
+type modelListFilter struct {
+	supportsThinking *bool
+	ownedBy          string
+	available        *bool
+}
+
+// parseModelListFilter 解析查询参数，无法识别的参数或取值直接忽略
+func parseModelListFilter(c *gin.Context) modelListFilter {
+	var filter modelListFilter
+	if v, err := strconv.ParseBool(c.Query("supports_thinking")); err == nil {
+		filter.supportsThinking = &v
+	}
+	if v, err := strconv.ParseBool(c.Query("available")); err == nil {
+		filter.available = &v
+	}
+	filter.ownedBy = strings.TrimSpace(c.Query("owned_by"))
+	return filter
+}
+
+// handleListModels 模型列表
+// 支持查询参数：supports_thinking=true|false、owned_by=<owner>、available=true|false
+// 未指定 available 时保持原行为（优先返回token池可用模型）；available=false 返回完整模型目录
+func handleListModels(provider AvailableModelsProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		filter := parseModelListFilter(c)
+
+		requestModels := config.ListRequestModels()
+		if provider != nil && (filter.available == nil || *filter.available) {
+			if models := provider.GetAvailableModels(); len(models) > 0 {
+				requestModels = models
+			}
+		}
+
+		models := make([]types.Model, 0, len(requestModels)*2)
+		for _, model := range buildModelList(requestModels) {
+			if filter.supportsThinking != nil && model.SupportsThinking != *filter.supportsThinking {
+				continue
+			}
+			if filter.ownedBy != "" && !strings.EqualFold(model.OwnedBy, filter.ownedBy) {
+				continue
+			}
+			models = append(models, model)
+		}
+
+		c.JSON(http.StatusOK, types.ModelsResponse{
+			Object: "list",
+			Data:   models,
+		})
+	}
+}
+
+// handleGetModel 单个模型详情（GET /v1/models/:id）
+// 在完整模型目录与token池可用模型中查找，能力字段与列表接口一致；未知模型返回 Anthropic 格式的 404
+func handleGetModel(provider AvailableModelsProvider) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := strings.TrimSpace(c.Param("id"))
+
+		requestModels := config.ListRequestModels()
+		if provider != nil {
+			requestModels = append(requestModels, provider.GetAvailableModels()...)
+		}
+
+		for _, model := range buildModelList(requestModels) {
+			if strings.EqualFold(model.ID, id) {
+				c.JSON(http.StatusOK, model)
+				return
+			}
+		}
+
+		c.JSON(http.StatusNotFound, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    "not_found_error",
+				"message": "model: " + id,
+			},
+		})
+	}
+}
+
+// buildModelList 构建模型列表，为支持 thinking 的模型追加 -thinking 变体
+func buildModelList(requestModels []string) []types.Model {
+	models := []types.Model{}
+	for _, anthropicModel := range requestModels {
+		isThinkingVariant := strings.HasSuffix(anthropicModel, "-thinking")
+		baseModel := strings.TrimSuffix(anthropicModel, "-thinking")
+		supportsThinking := converter.IsThinkingCompatibleModel(baseModel)
+
+		// 添加原始模型
+		models = append(models, types.Model{
+			ID:               anthropicModel,
+			Object:           "model",
+			Created:          1234567890,
+			OwnedBy:          "anthropic",
+			DisplayName:      anthropicModel,
+			Type:             "text",
+			MaxTokens:        200000,
+			SupportsThinking: supportsThinking,
+		})
+
+		// 为支持 thinking 的模型添加 -thinking 后缀版本
+		if supportsThinking && !isThinkingVariant {
+			models = append(models, types.Model{
+				ID:               baseModel + "-thinking",
+				Object:           "model",
+				Created:          1234567890,
+				OwnedBy:          "anthropic",
+				DisplayName:      baseModel + " (Thinking)",
+				Type:             "text",
+				MaxTokens:        200000,
+				SupportsThinking: true,
+			})
+		}
+	}
+	return models
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubModelsProvider struct {
+	models []string
+}
+
+func (s stubModelsProvider) GetAvailableModels() []string {
+	return s.models
+}
+
+func performListModels(t *testing.T, provider AvailableModelsProvider, query string) types.ModelsResponse {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/v1/models", handleListModels(provider))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models"+query, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp types.ModelsResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestHandleListModels_SupportsThinkingFilter(t *testing.T) {
+	resp := performListModels(t, nil, "?supports_thinking=true")
+
+	require.NotEmpty(t, resp.Data)
+	for _, m := range resp.Data {
+		assert.True(t, m.SupportsThinking, "模型 %s 不应出现在 supports_thinking=true 结果中", m.ID)
+	}
+}
+
+func TestHandleListModels_OwnedByFilter(t *testing.T) {
+	assert.NotEmpty(t, performListModels(t, nil, "?owned_by=Anthropic").Data)
+	assert.Empty(t, performListModels(t, nil, "?owned_by=openai").Data)
+}
+
+func TestHandleListModels_AvailableFilter(t *testing.T) {
+	allModels := config.ListRequestModels()
+	require.Greater(t, len(allModels), 1)
+	provider := stubModelsProvider{models: allModels[:1]}
+
+	for _, query := range []string{"", "?available=true"} {
+		resp := performListModels(t, provider, query)
+		for _, m := range resp.Data {
+			assert.Equal(t, allModels[0], strings.TrimSuffix(m.ID, "-thinking"), "query=%q", query)
+		}
+	}
+
+	full := performListModels(t, provider, "?available=false")
+	assert.Greater(t, len(full.Data), len(performListModels(t, provider, "").Data))
+}
+
+func TestHandleListModels_UnknownParamsIgnored(t *testing.T) {
+	base := performListModels(t, nil, "")
+	resp := performListModels(t, nil, "?foo=bar&supports_thinking=maybe")
+	assert.Equal(t, len(base.Data), len(resp.Data))
+}
+
+func TestHandleGetModel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/v1/models/:id", handleGetModel(nil))
+
+	get := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/models/"+id, nil))
+		return w
+	}
+
+	var thinkingModel string
+	for _, m := range buildModelList(config.ListRequestModels()) {
+		if strings.HasSuffix(m.ID, "-thinking") {
+			thinkingModel = m.ID
+			break
+		}
+	}
+	require.NotEmpty(t, thinkingModel)
+
+	w := get(thinkingModel)
+	require.Equal(t, http.StatusOK, w.Code)
+	var model types.Model
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &model))
+	assert.Equal(t, thinkingModel, model.ID)
+	assert.True(t, model.SupportsThinking)
+	assert.Equal(t, 200000, model.MaxTokens)
+
+	w = get("not-a-model")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	var errResp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+	assert.Equal(t, "error", errResp["type"])
+	assert.Equal(t, "not_found_error", errResp["error"].(map[string]any)["type"])
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAI n 参数支持
+// 上游每次只生成一个回复：n>1 时并行发起 n 次上游请求，组装为 n 个 choices（index 0..n-1）
+// 并发数不超过 OPENAI_MAX_N，且仍受 MAX_CONCURRENT_UPSTREAM 限制
+
+// openAIChoiceCount 校验并返回请求的 n（缺省为1）
+func openAIChoiceCount(req types.OpenAIRequest) (int, error) {
+	if req.N == nil {
+		return 1, nil
+	}
+	n := *req.N
+	if n < 1 {
+		return 0, fmt.Errorf("n 必须为正整数")
+	}
+	if n > config.OpenAIMaxN {
+		return 0, fmt.Errorf("n 最大支持 %d（OPENAI_MAX_N），每个 choice 都会单独请求上游", config.OpenAIMaxN)
+	}
+	if n > 1 && req.Stream != nil && *req.Stream {
+		return 0, fmt.Errorf("流式请求不支持 n>1，请使用非流式请求")
+	}
+	return n, nil
+}
+
+// openAIChoiceResult 单个 choice 的执行结果
+type openAIChoiceResult struct {
+	resp     map[string]any
+	upstream *http.Response // 上游响应；状态码非200时响应体未读取，由外层统一处理
+	err      error          // 发送请求或读取/解析响应失败
+	start    time.Time
+}
+
+// failed 是否执行失败
+func (r openAIChoiceResult) failed() bool {
+	return r.err != nil || r.upstream == nil || r.upstream.StatusCode != http.StatusOK
+}
+
+// handleOpenAINonStreamChoices 处理 n>1 的OpenAI非流式请求
+// 上游请求只构建一次，各 choice 并行发送并直接收集结果；任一 choice 失败时取消其余请求，
+// 由外层按最先失败的结果写出错误响应（token状态只按该结果更新一次）
+func handleOpenAINonStreamChoices(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo, n int) {
+	req, err := buildCodeWhispererRequest(c, anthropicReq, token, false)
+	if err != nil {
+		// 模型未找到时响应已经发送
+		if _, ok := err.(*types.ModelNotFoundErrorType); !ok {
+			handleRequestBuildError(c, err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	results := make([]openAIChoiceResult, n)
+	firstFailed := -1
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = executeOpenAIChoice(ctx, c, anthropicReq, req)
+			if results[i].failed() {
+				failOnce.Do(func() {
+					firstFailed = i
+					cancel()
+				})
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tokenKey := c.GetString("token_key")
+	for i, result := range results {
+		switch {
+		case i == firstFailed:
+			logger.Warn("OpenAI 多 choice 请求失败",
+				addReqFields(c, logger.Int("n", n), logger.Int("failed_choice", firstFailed), logger.Err(result.err))...)
+			if result.upstream == nil || result.upstream.StatusCode != http.StatusOK {
+				// 发送失败或上游返回错误状态码：按单次请求的方式记录并写出错误响应
+				_, _ = finishCodeWhispererRequest(c, tokenKey, result.start, result.upstream, result.err)
+				continue
+			}
+			_, _ = finishCodeWhispererRequest(c, tokenKey, result.start, result.upstream, nil)
+			respondNonStreamAnthropicError(c, result.err)
+		case result.upstream == nil:
+			// 被取消的请求不计入token统计
+		case result.upstream.StatusCode != http.StatusOK:
+			recordAccessUpstream(c, result.upstream.StatusCode)
+			_ = result.upstream.Body.Close()
+		default:
+			_, _ = finishCodeWhispererRequest(c, tokenKey, result.start, result.upstream, nil)
+		}
+	}
+	if firstFailed >= 0 {
+		return
+	}
+
+	openaiMessageId := fmt.Sprintf("chatcmpl-%s", time.Now().Format(config.MessageIDTimeFormat))
+	openaiResp := mergeOpenAIChoices(results, anthropicReq, openaiMessageId)
+	recordAccessUsage(c, openaiResp.Usage.PromptTokens, openaiResp.Usage.CompletionTokens)
+
+	logger.Debug("下发OpenAI非流式响应",
+		addReqFields(c,
+			logger.String("direction", "downstream_send"),
+			logger.Int("choices", len(openaiResp.Choices)),
+		)...)
+	c.JSON(http.StatusOK, openaiResp)
+}
+
+// executeOpenAIChoice 发送一次上游请求并读取为Anthropic响应结构（不写入响应、不修改 gin.Context）
+func executeOpenAIChoice(ctx context.Context, c *gin.Context, anthropicReq types.AnthropicRequest, req *http.Request) openAIChoiceResult {
+	result := openAIChoiceResult{start: time.Now()}
+	body, err := req.GetBody()
+	if err != nil {
+		result.err = err
+		return result
+	}
+	choiceReq := req.Clone(ctx)
+	choiceReq.Body = body
+
+	result.upstream, result.err = doUpstreamRequestWithNetRetry(c, choiceReq)
+	if result.err != nil || result.upstream.StatusCode != http.StatusOK {
+		return result
+	}
+	defer result.upstream.Body.Close()
+	result.resp, result.err = readNonStreamAnthropicResponse(c, anthropicReq, result.upstream.Body)
+	return result
+}
+
+// mergeOpenAIChoices 将各 choice 的 Anthropic 响应组装为一个 OpenAI 响应
+// prompt_tokens 取单次请求的值，completion_tokens 为各 choice 之和
+func mergeOpenAIChoices(results []openAIChoiceResult, anthropicReq types.AnthropicRequest, messageId string) types.OpenAIResponse {
+	var merged types.OpenAIResponse
+	for i, result := range results {
+		resp := converter.ConvertAnthropicToOpenAI(result.resp, anthropicReq, messageId)
+		if converter.IsStructuredOutputRequest(anthropicReq) {
+			converter.UnwrapStructuredOutput(&resp)
+		}
+		if anthropicReq.LegacyFunctionCall {
+			converter.ConvertToLegacyFunctionCall(&resp)
+		}
+		if i == 0 {
+			merged = resp
+			merged.Choices = nil
+			merged.Usage.CompletionTokens = 0
+		}
+		for _, choice := range resp.Choices {
+			choice.Index = i
+			merged.Choices = append(merged.Choices, choice)
+		}
+		merged.Usage.CompletionTokens += resp.Usage.CompletionTokens
+	}
+	merged.Usage.TotalTokens = merged.Usage.PromptTokens + merged.Usage.CompletionTokens
+	return merged
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIChoiceCount(t *testing.T) {
+	origMax := config.OpenAIMaxN
+	config.OpenAIMaxN = 3
+	defer func() { config.OpenAIMaxN = origMax }()
+
+	intPtr := func(v int) *int { return &v }
+	stream := true
+
+	n, err := openAIChoiceCount(types.OpenAIRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = openAIChoiceCount(types.OpenAIRequest{N: intPtr(3)})
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// n=1 的流式请求照常处理
+	n, err = openAIChoiceCount(types.OpenAIRequest{N: intPtr(1), Stream: &stream})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = openAIChoiceCount(types.OpenAIRequest{N: intPtr(0)})
+	assert.Error(t, err)
+	_, err = openAIChoiceCount(types.OpenAIRequest{N: intPtr(4)})
+	assert.ErrorContains(t, err, "OPENAI_MAX_N")
+	_, err = openAIChoiceCount(types.OpenAIRequest{N: intPtr(2), Stream: &stream})
+	assert.ErrorContains(t, err, "流式")
+}
+
+func TestHandleOpenAINonStreamChoices_AssemblesChoices(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write(encodeEventFrame("assistantResponseEvent", `{"content":"hello"}`))
+	}))
+	defer upstream.Close()
+	require.NoError(t, config.SetCodeWhispererEndpoint(upstream.URL, ""))
+	defer config.SetCodeWhispererEndpoint("", "")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	handleOpenAINonStreamChoices(c, types.AnthropicRequest{
+		Model:     "claude-sonnet-4",
+		MaxTokens: 100,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "hi"}},
+	}, types.TokenInfo{AccessToken: "test-token"}, 3)
+
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, int32(3), calls.Load())
+
+	var resp types.OpenAIResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Choices, 3)
+	for i, choice := range resp.Choices {
+		assert.Equal(t, i, choice.Index)
+		assert.Equal(t, "hello", choice.Message.Content)
+	}
+	assert.Positive(t, resp.Usage.PromptTokens)
+	assert.Equal(t, resp.Usage.PromptTokens+resp.Usage.CompletionTokens, resp.Usage.TotalTokens)
+}
+
+func TestHandleOpenAINonStreamChoices_PropagatesFailure(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"message":"Improperly formed request."}`))
+			return
+		}
+		// 其余 choice 应被取消
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+	require.NoError(t, config.SetCodeWhispererEndpoint(upstream.URL, ""))
+	defer config.SetCodeWhispererEndpoint("", "")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleOpenAINonStreamChoices(c, types.AnthropicRequest{
+			Model:     "claude-sonnet-4",
+			MaxTokens: 100,
+			Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "hi"}},
+		}, types.TokenInfo{AccessToken: "test-token"}, 2)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("失败后应取消其余 choice")
+	}
+
+	assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"kiro2api/config"
@@ -16,27 +18,86 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// SeedHonoredHeader 请求携带 seed 时在响应头中标注是否生效（上游没有随机种子参数，始终为 false）
+const SeedHonoredHeader = "X-Kiro-Seed-Honored"
+
+// annotateOpenAISeed 请求携带 seed 时标注未生效，避免客户端误以为结果可复现
+func annotateOpenAISeed(c *gin.Context, openaiReq types.OpenAIRequest) {
+	if openaiReq.Seed == nil {
+		return
+	}
+	c.Header(SeedHonoredHeader, "false")
+}
+
 // handleOpenAINonStreamRequest 处理OpenAI非流式请求
 func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) {
+	anthropicResp, ok := executeNonStreamAnthropicRequest(c, anthropicReq, token)
+	if !ok {
+		return
+	}
+
+	// 转换为OpenAI格式
+	openaiMessageId := fmt.Sprintf("chatcmpl-%s", time.Now().Format(config.MessageIDTimeFormat))
+	openaiResp := converter.ConvertAnthropicToOpenAI(anthropicResp, anthropicReq, openaiMessageId)
+	if converter.IsStructuredOutputRequest(anthropicReq) {
+		// response_format=json_schema：将合成工具调用还原为JSON消息内容
+		converter.UnwrapStructuredOutput(&openaiResp)
+	}
+	if anthropicReq.LegacyFunctionCall {
+		converter.ConvertToLegacyFunctionCall(&openaiResp)
+	}
+
+	// 下发OpenAI兼容非流式响应
+	logger.Debug("下发OpenAI非流式响应",
+		addReqFields(c,
+			logger.String("direction", "downstream_send"),
+			logger.Bool("saw_tool_use", anthropicResp["stop_reason"] == "tool_use"),
+		)...)
+	c.JSON(http.StatusOK, openaiResp)
+}
+
+// executeNonStreamAnthropicRequest 执行非流式上游请求并组装为Anthropic响应结构
+// 供OpenAI/Gemini等兼容端点再转换为各自的响应格式；失败时错误响应已写出，返回false
+func executeNonStreamAnthropicRequest(c *gin.Context, anthropicReq types.AnthropicRequest, token types.TokenInfo) (map[string]any, bool) {
 	resp, err := executeCodeWhispererRequest(c, anthropicReq, token, false)
 	if err != nil {
-		return
+		return nil, false
 	}
 	defer resp.Body.Close()
 
-	// 读取响应体
-	body, err := utils.ReadHTTPResponse(resp.Body)
+	anthropicResp, err := readNonStreamAnthropicResponse(c, anthropicReq, resp.Body)
 	if err != nil {
-		handleResponseReadError(c, err)
+		respondNonStreamAnthropicError(c, err)
+		return nil, false
+	}
+	usage := anthropicResp["usage"].(map[string]any)
+	recordAccessUsage(c, usage["input_tokens"].(int), usage["output_tokens"].(int))
+	return anthropicResp, true
+}
+
+// respondNonStreamAnthropicError 写入读取或解析上游非流式响应失败的错误响应
+func respondNonStreamAnthropicError(c *gin.Context, err error) {
+	if errors.Is(err, errNonStreamParse) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "响应解析失败"})
 		return
 	}
+	handleResponseReadError(c, err)
+}
+
+// readNonStreamAnthropicResponse 读取并解析上游非流式响应体，组装为Anthropic响应结构
+// 不写入响应、不修改 gin.Context，可在多个 goroutine 中并发调用；解析失败时返回 errNonStreamParse
+func readNonStreamAnthropicResponse(c *gin.Context, anthropicReq types.AnthropicRequest, respBody io.Reader) (map[string]any, error) {
+	// 读取响应体
+	body, err := utils.ReadHTTPResponse(respBody)
+	if err != nil {
+		return nil, err
+	}
 
 	// 使用新的符合AWS规范的解析器
 	compliantParser := parser.NewCompliantEventStreamParser()
 	result, err := compliantParser.ParseResponse(body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "响应解析失败"})
-		return
+		return nil, fmt.Errorf("%w: %v", errNonStreamParse, err)
 	}
 
 	// 转换为Anthropic格式
@@ -52,13 +113,13 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 		})
 	}
 
-	// 添加工具调用
+	// 添加工具调用（被截断的参数名还原为客户端声明的原始名称）
 	for _, tool := range result.GetToolCalls() {
 		contexts = append(contexts, map[string]any{
 			"type":  "tool_use",
 			"id":    tool.ID,
 			"name":  tool.Name,
-			"input": tool.Arguments,
+			"input": converter.RestoreToolParamNames(anthropicReq.ToolParamMappings, tool.Name, tool.Arguments),
 		})
 	}
 
@@ -86,6 +147,9 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 		}
 	}
 	stopReason := func() string {
+		if parseResultRefused(result) {
+			return "refusal"
+		}
 		if sawToolUse {
 			return "tool_use"
 		}
@@ -103,18 +167,7 @@ func handleOpenAINonStreamRequest(c *gin.Context, anthropicReq types.AnthropicRe
 			"output_tokens": outputTokens,
 		},
 	}
-
-	// 转换为OpenAI格式
-	openaiMessageId := fmt.Sprintf("chatcmpl-%s", time.Now().Format(config.MessageIDTimeFormat))
-	openaiResp := converter.ConvertAnthropicToOpenAI(anthropicResp, anthropicReq.Model, openaiMessageId)
-
-	// 下发OpenAI兼容非流式响应
-	logger.Debug("下发OpenAI非流式响应",
-		addReqFields(c,
-			logger.String("direction", "downstream_send"),
-			logger.Bool("saw_tool_use", sawToolUse),
-		)...)
-	c.JSON(http.StatusOK, openaiResp)
+	return anthropicResp, nil
 }
 
 // handleOpenAIStreamRequest 处理OpenAI流式请求
@@ -137,7 +190,7 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	// 立即刷新响应头
 	c.Writer.Flush()
 
-	sender := &OpenAIStreamSender{}
+	sender := &OpenAIStreamSender{legacyFunctionCall: anthropicReq.LegacyFunctionCall}
 
 	// 发送初始OpenAI事件
 	initialEvent := map[string]any{
@@ -165,8 +218,19 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 	toolUseIdByBlockIndex := make(map[int]string) // 内容块 index -> tool_use_id
 	nextToolIndex := 0
 	sawToolUse := false
+	refused := false // 上游拒绝生成（护栏/内容过滤）
+	// response_format=json_schema：合成工具的参数以 content 增量透出
+	structuredOutput := converter.IsStructuredOutputRequest(anthropicReq)
+	structuredBlocks := make(map[int]bool)
+	// 参数名被截断的工具：参数增量先缓冲，块结束时还原参数名后一次性下发
+	mappedToolArgs := make(map[int]*bufferedToolArgs)
+	// 尚未下发任何参数增量的工具块（块 index -> tool_calls 数组索引），块结束时补发 "{}"
+	emptyToolArgs := make(map[int]int)
 	sentFinal := false
 	inThinking := false
+	var output strings.Builder // 用于访问日志的输出tokens统计
+	// OPENAI_REASONING_FIELD=true：thinking 以 delta.reasoning_content 透出，不再包裹标签
+	reasoningField := config.OpenAIReasoningField
 
 	// 添加完整性跟踪
 	totalBytesRead := 0
@@ -177,17 +241,16 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 
 	// 使用更大的缓冲区避免数据丢失
 	buf := make([]byte, 8192) // 增加到8KB
+	// 上游静默期间定时写出SSE注释保活
+	body := newKeepaliveReader(resp.Body, config.SSEPingInterval, func() { writeSSEKeepalive(c) })
 	for hasMoreData {
-		n, err := resp.Body.Read(buf)
+		n, err := body.Read(buf)
 		if n > 0 {
 			totalBytesRead += n
 			consecutiveErrors = 0 // 重置错误计数
 
-			events, parseErr := compliantParser.ParseStream(buf[:n])
-			if parseErr != nil {
-				// 在宽松模式下继续处理
-				continue
-			}
+			// 宽松模式：解析错误时继续处理已解析的事件
+			events, _ := compliantParser.ParseStream(buf[:n])
 			messageCount += len(events)
 			for _, event := range events {
 				if event.Data != nil {
@@ -200,7 +263,8 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 									case "text_delta":
 										// 移除错误的逻辑：不要在text_delta中强制关闭thinking
 										// thinking的关闭应该由content_block_stop或新的content_block_start来控制
-										if text, ok := deltaMap["text"]; ok {
+										if text, _ := deltaMap["text"].(string); text != "" {
+											output.WriteString(text)
 											// 发送文本内容的增量
 											contentEvent := map[string]any{
 												"id":      messageId,
@@ -211,7 +275,7 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 													{
 														"index": 0,
 														"delta": map[string]any{
-															"content": text.(string),
+															"content": text,
 														},
 														"finish_reason": nil,
 													},
@@ -220,7 +284,8 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 											sender.SendEvent(c, contentEvent)
 										}
 									case "thinking_delta":
-										// OpenAI 协议没有 thinking 字段，这里用 <thinking> 标签透出，便于终端/客户端观察。
+										// OpenAI 协议没有 thinking 字段，默认用 <thinking> 标签透出，便于终端/客户端观察；
+										// 启用 OPENAI_REASONING_FIELD 时改用 reasoning_content 扩展字段。
 										var thinking string
 										if v, ok := deltaMap["thinking"]; ok {
 											switch s := v.(type) {
@@ -232,7 +297,24 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 												}
 											}
 										}
-										if thinking != "" {
+										output.WriteString(thinking)
+										if thinking != "" && reasoningField {
+											sender.SendEvent(c, map[string]any{
+												"id":      messageId,
+												"object":  "chat.completion.chunk",
+												"created": time.Now().Unix(),
+												"model":   anthropicReq.Model,
+												"choices": []map[string]any{
+													{
+														"index": 0,
+														"delta": map[string]any{
+															"reasoning_content": thinking,
+														},
+														"finish_reason": nil,
+													},
+												},
+											})
+										} else if thinking != "" {
 											if !inThinking {
 												openEvent := map[string]any{
 													"id":      messageId,
@@ -270,6 +352,9 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 											sender.SendEvent(c, thinkingEvent)
 										}
 									case "input_json_delta":
+										if partial, ok := deltaMap["partial_json"].(string); ok {
+											output.WriteString(partial)
+										}
 										// 工具调用参数增量
 										// 找到对应的tool_use和OpenAI tool_calls索引
 										toolBlockIndex := 0
@@ -285,7 +370,25 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 												toolBlockIndex = int(v)
 											}
 										}
-										if toolUseId, ok := toolUseIdByBlockIndex[toolBlockIndex]; ok {
+										if structuredBlocks[toolBlockIndex] {
+											if partial, ok := deltaMap["partial_json"].(string); ok && partial != "" {
+												sender.SendEvent(c, map[string]any{
+													"id":      messageId,
+													"object":  "chat.completion.chunk",
+													"created": time.Now().Unix(),
+													"model":   anthropicReq.Model,
+													"choices": []map[string]any{
+														{
+															"index": 0,
+															"delta": map[string]any{
+																"content": partial,
+															},
+															"finish_reason": nil,
+														},
+													},
+												})
+											}
+										} else if toolUseId, ok := toolUseIdByBlockIndex[toolBlockIndex]; ok {
 											if toolIdx, ok := toolIndexByToolUseId[toolUseId]; ok {
 												var partial string
 												if pj, ok := deltaMap["partial_json"]; ok {
@@ -298,7 +401,10 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 														}
 													}
 												}
-												if partial != "" {
+												if buffered, ok := mappedToolArgs[toolBlockIndex]; ok {
+													buffered.args.WriteString(partial)
+												} else if partial != "" {
+													delete(emptyToolArgs, toolBlockIndex)
 													toolDelta := map[string]any{
 														"id":      messageId,
 														"object":  "chat.completion.chunk",
@@ -311,7 +417,6 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 																	"tool_calls": []map[string]any{
 																		{
 																			"index": toolIdx,
-																			"type":  "function",
 																			"function": map[string]any{
 																				"arguments": partial,
 																			},
@@ -335,7 +440,7 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 									blockType, _ := blockMap["type"].(string)
 
 									// 处理 thinking 块开始 - 在这里发送 <thinking> 前缀
-									if blockType == "thinking" && !inThinking {
+									if blockType == "thinking" && !inThinking && !reasoningField {
 										openEvent := map[string]any{
 											"id":      messageId,
 											"object":  "chat.completion.chunk",
@@ -393,7 +498,9 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 												toolBlockIndex = int(v)
 											}
 										}
-										if toolUseId != "" {
+										if structuredOutput && toolName == converter.StructuredOutputToolName {
+											structuredBlocks[toolBlockIndex] = true
+										} else if toolUseId != "" {
 											if _, exists := toolIndexByToolUseId[toolUseId]; !exists {
 												toolIndexByToolUseId[toolUseId] = nextToolIndex
 												nextToolIndex++
@@ -401,6 +508,11 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 											toolUseIdByBlockIndex[toolBlockIndex] = toolUseId
 											sawToolUse = true
 											toolIdx := toolIndexByToolUseId[toolUseId]
+											if len(anthropicReq.ToolParamMappings[toolName]) > 0 {
+												mappedToolArgs[toolBlockIndex] = &bufferedToolArgs{name: toolName, toolIndex: toolIdx}
+											} else {
+												emptyToolArgs[toolBlockIndex] = toolIdx
+											}
 											// 发送OpenAI工具调用开始增量
 											// 注意：arguments 必须为空字符串，参数内容通过后续的 input_json_delta 转换而来
 											// 这符合 OpenAI 流式协议的标准：先发 id/name，再发 arguments delta
@@ -457,8 +569,14 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 									}
 								}
 							}
+						case "exception":
+							if isRefusalException(dataMap) {
+								refused = true
+							}
 						case "content_block_stop":
-							// 忽略，最终结束由message_delta驱动
+							// 最终结束由message_delta驱动；此处仅下发缓冲的工具参数
+							flushBufferedToolArgs(c, sender, messageId, anthropicReq, dataMap, mappedToolArgs)
+							flushEmptyToolArgs(c, sender, messageId, anthropicReq, dataMap, emptyToolArgs)
 						}
 					}
 				}
@@ -525,6 +643,9 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		if sawToolUse {
 			finishReason = "tool_calls"
 		}
+		if refused {
+			finishReason = "content_filter"
+		}
 
 		finalEvent := map[string]any{
 			"id":      messageId,
@@ -543,11 +664,38 @@ func handleOpenAIStreamRequest(c *gin.Context, anthropicReq types.AnthropicReque
 		c.Writer.Flush()
 	}
 
+	if accessLogFrom(c) != nil || anthropicReq.IncludeUsage {
+		inputTokens := GetTokenCalculator().EstimateInputTokens(anthropicReq)
+		outputTokens := utils.CountTokensWithTiktoken(output.String(), "cl100k_base")
+		recordAccessUsage(c, inputTokens, outputTokens)
+		if anthropicReq.IncludeUsage {
+			sendOpenAIUsageChunk(c, sender, messageId, anthropicReq.Model, inputTokens, outputTokens)
+		}
+	}
+
 	// 发送结束标记
 	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
 	c.Writer.Flush()
 }
 
+// sendOpenAIUsageChunk 下发 stream_options.include_usage 要求的 usage chunk（choices 为空数组，位于 [DONE] 之前）
+func sendOpenAIUsageChunk(c *gin.Context, sender *OpenAIStreamSender, messageId, model string, inputTokens, outputTokens int) {
+	usageEvent := map[string]any{
+		"id":      messageId,
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]any{},
+		"usage": map[string]any{
+			"prompt_tokens":     inputTokens,
+			"completion_tokens": outputTokens,
+			"total_tokens":      inputTokens + outputTokens,
+		},
+	}
+	sender.SendEvent(c, usageEvent)
+	c.Writer.Flush()
+}
+
 // handleOpenAIStreamRequestWithRetry 带429重试的OpenAI流式请求处理
 func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.AnthropicRequest) {
 	c.Header("Content-Type", "text/event-stream")
@@ -568,7 +716,7 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 	// 立即刷新响应头
 	c.Writer.Flush()
 
-	sender := &OpenAIStreamSender{}
+	sender := &OpenAIStreamSender{legacyFunctionCall: anthropicReq.LegacyFunctionCall}
 
 	// 发送初始OpenAI事件
 	initialEvent := map[string]any{
@@ -596,8 +744,19 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 	toolUseIdByBlockIndex := make(map[int]string)
 	nextToolIndex := 0
 	sawToolUse := false
+	refused := false // 上游拒绝生成（护栏/内容过滤）
+	// response_format=json_schema：合成工具的参数以 content 增量透出
+	structuredOutput := converter.IsStructuredOutputRequest(anthropicReq)
+	structuredBlocks := make(map[int]bool)
+	// 参数名被截断的工具：参数增量先缓冲，块结束时还原参数名后一次性下发
+	mappedToolArgs := make(map[int]*bufferedToolArgs)
+	// 尚未下发任何参数增量的工具块（块 index -> tool_calls 数组索引），块结束时补发 "{}"
+	emptyToolArgs := make(map[int]int)
 	sentFinal := false
 	inThinking := false
+	var output strings.Builder // 用于访问日志的输出tokens统计
+	// OPENAI_REASONING_FIELD=true：thinking 以 delta.reasoning_content 透出，不再包裹标签
+	reasoningField := config.OpenAIReasoningField
 
 	totalBytesRead := 0
 	messageCount := 0
@@ -606,16 +765,16 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 	const maxConsecutiveErrors = 3
 
 	buf := make([]byte, 8192)
+	// 上游静默期间定时写出SSE注释保活
+	body := newKeepaliveReader(resp.Body, config.SSEPingInterval, func() { writeSSEKeepalive(c) })
 	for hasMoreData {
-		n, err := resp.Body.Read(buf)
+		n, err := body.Read(buf)
 		if n > 0 {
 			totalBytesRead += n
 			consecutiveErrors = 0
 
-			events, parseErr := compliantParser.ParseStream(buf[:n])
-			if parseErr != nil {
-				continue
-			}
+			// 宽松模式：解析错误时继续处理已解析的事件
+			events, _ := compliantParser.ParseStream(buf[:n])
 			messageCount += len(events)
 			for _, event := range events {
 				if event.Data != nil {
@@ -628,7 +787,8 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 									case "text_delta":
 										// 移除错误的逻辑：不要在text_delta中强制关闭thinking
 										// thinking的关闭应该由content_block_stop或新的content_block_start来控制
-										if text, ok := deltaMap["text"]; ok {
+										if text, _ := deltaMap["text"].(string); text != "" {
+											output.WriteString(text)
 											contentEvent := map[string]any{
 												"id":      messageId,
 												"object":  "chat.completion.chunk",
@@ -638,7 +798,7 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 													{
 														"index": 0,
 														"delta": map[string]any{
-															"content": text.(string),
+															"content": text,
 														},
 														"finish_reason": nil,
 													},
@@ -658,7 +818,24 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 												}
 											}
 										}
-										if thinking != "" {
+										output.WriteString(thinking)
+										if thinking != "" && reasoningField {
+											sender.SendEvent(c, map[string]any{
+												"id":      messageId,
+												"object":  "chat.completion.chunk",
+												"created": time.Now().Unix(),
+												"model":   anthropicReq.Model,
+												"choices": []map[string]any{
+													{
+														"index": 0,
+														"delta": map[string]any{
+															"reasoning_content": thinking,
+														},
+														"finish_reason": nil,
+													},
+												},
+											})
+										} else if thinking != "" {
 											if !inThinking {
 												openEvent := map[string]any{
 													"id":      messageId,
@@ -696,6 +873,9 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 											sender.SendEvent(c, thinkingEvent)
 										}
 									case "input_json_delta":
+										if partial, ok := deltaMap["partial_json"].(string); ok {
+											output.WriteString(partial)
+										}
 										toolBlockIndex := 0
 										if idxAny, ok := dataMap["index"]; ok {
 											switch v := idxAny.(type) {
@@ -709,7 +889,25 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 												toolBlockIndex = int(v)
 											}
 										}
-										if toolUseId, ok := toolUseIdByBlockIndex[toolBlockIndex]; ok {
+										if structuredBlocks[toolBlockIndex] {
+											if partial, ok := deltaMap["partial_json"].(string); ok && partial != "" {
+												sender.SendEvent(c, map[string]any{
+													"id":      messageId,
+													"object":  "chat.completion.chunk",
+													"created": time.Now().Unix(),
+													"model":   anthropicReq.Model,
+													"choices": []map[string]any{
+														{
+															"index": 0,
+															"delta": map[string]any{
+																"content": partial,
+															},
+															"finish_reason": nil,
+														},
+													},
+												})
+											}
+										} else if toolUseId, ok := toolUseIdByBlockIndex[toolBlockIndex]; ok {
 											if toolIdx, ok := toolIndexByToolUseId[toolUseId]; ok {
 												var partial string
 												if pj, ok := deltaMap["partial_json"]; ok {
@@ -722,7 +920,10 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 														}
 													}
 												}
-												if partial != "" {
+												if buffered, ok := mappedToolArgs[toolBlockIndex]; ok {
+													buffered.args.WriteString(partial)
+												} else if partial != "" {
+													delete(emptyToolArgs, toolBlockIndex)
 													toolDelta := map[string]any{
 														"id":      messageId,
 														"object":  "chat.completion.chunk",
@@ -735,7 +936,6 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 																	"tool_calls": []map[string]any{
 																		{
 																			"index": toolIdx,
-																			"type":  "function",
 																			"function": map[string]any{
 																				"arguments": partial,
 																			},
@@ -759,7 +959,7 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 									blockType, _ := blockMap["type"].(string)
 
 									// 处理 thinking 块开始 - 在这里发送 <thinking> 前缀
-									if blockType == "thinking" && !inThinking {
+									if blockType == "thinking" && !inThinking && !reasoningField {
 										openEvent := map[string]any{
 											"id":      messageId,
 											"object":  "chat.completion.chunk",
@@ -816,7 +1016,9 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 												toolBlockIndex = int(v)
 											}
 										}
-										if toolUseId != "" {
+										if structuredOutput && toolName == converter.StructuredOutputToolName {
+											structuredBlocks[toolBlockIndex] = true
+										} else if toolUseId != "" {
 											if _, exists := toolIndexByToolUseId[toolUseId]; !exists {
 												toolIndexByToolUseId[toolUseId] = nextToolIndex
 												nextToolIndex++
@@ -824,6 +1026,11 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 											toolUseIdByBlockIndex[toolBlockIndex] = toolUseId
 											sawToolUse = true
 											toolIdx := toolIndexByToolUseId[toolUseId]
+											if len(anthropicReq.ToolParamMappings[toolName]) > 0 {
+												mappedToolArgs[toolBlockIndex] = &bufferedToolArgs{name: toolName, toolIndex: toolIdx}
+											} else {
+												emptyToolArgs[toolBlockIndex] = toolIdx
+											}
 
 											toolStart := map[string]any{
 												"id":      messageId,
@@ -877,6 +1084,13 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 									}
 								}
 							}
+						case "exception":
+							if isRefusalException(dataMap) {
+								refused = true
+							}
+						case "content_block_stop":
+							flushBufferedToolArgs(c, sender, messageId, anthropicReq, dataMap, mappedToolArgs)
+							flushEmptyToolArgs(c, sender, messageId, anthropicReq, dataMap, emptyToolArgs)
 						}
 					}
 				}
@@ -932,6 +1146,9 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 		if sawToolUse {
 			finishReason = "tool_calls"
 		}
+		if refused {
+			finishReason = "content_filter"
+		}
 
 		finalEvent := map[string]any{
 			"id":      messageId,
@@ -950,6 +1167,77 @@ func handleOpenAIStreamRequestWithRetry(c *gin.Context, anthropicReq types.Anthr
 		c.Writer.Flush()
 	}
 
+	if accessLogFrom(c) != nil || anthropicReq.IncludeUsage {
+		inputTokens := GetTokenCalculator().EstimateInputTokens(anthropicReq)
+		outputTokens := utils.CountTokensWithTiktoken(output.String(), "cl100k_base")
+		recordAccessUsage(c, inputTokens, outputTokens)
+		if anthropicReq.IncludeUsage {
+			sendOpenAIUsageChunk(c, sender, messageId, anthropicReq.Model, inputTokens, outputTokens)
+		}
+	}
+
 	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
 	c.Writer.Flush()
 }
+
+// bufferedToolArgs 参数名被截断的工具调用的参数缓冲
+type bufferedToolArgs struct {
+	name      string
+	toolIndex int
+	args      strings.Builder
+}
+
+// flushBufferedToolArgs 工具块结束时还原参数名，并以单个 tool_calls 增量下发完整参数
+func flushBufferedToolArgs(c *gin.Context, sender *OpenAIStreamSender, messageId string, anthropicReq types.AnthropicRequest, dataMap map[string]any, buffers map[int]*bufferedToolArgs) {
+	blockIndex := toBlockIndex(dataMap["index"])
+	buffered, ok := buffers[blockIndex]
+	if !ok {
+		return
+	}
+	delete(buffers, blockIndex)
+
+	arguments := buffered.args.String()
+	if arguments == "" {
+		arguments = "{}"
+	}
+	arguments = converter.RestoreToolParamNamesJSON(anthropicReq.ToolParamMappings, buffered.name, arguments)
+	sender.SendEvent(c, openAIToolArgumentsChunk(messageId, anthropicReq.Model, buffered.toolIndex, arguments))
+}
+
+// flushEmptyToolArgs 工具块结束时仍未下发任何参数增量的工具补发 "{}"
+// 上游对无参数的工具不发送 input_json_delta，而 OpenAI 客户端按 JSON 解析 arguments，空字符串会解析失败
+func flushEmptyToolArgs(c *gin.Context, sender *OpenAIStreamSender, messageId string, anthropicReq types.AnthropicRequest, dataMap map[string]any, pending map[int]int) {
+	blockIndex := toBlockIndex(dataMap["index"])
+	toolIndex, ok := pending[blockIndex]
+	if !ok {
+		return
+	}
+	delete(pending, blockIndex)
+	sender.SendEvent(c, openAIToolArgumentsChunk(messageId, anthropicReq.Model, toolIndex, "{}"))
+}
+
+// openAIToolArgumentsChunk 构造追加工具参数的 tool_calls 增量（只含 index 与 function.arguments）
+func openAIToolArgumentsChunk(messageId, model string, toolIndex int, arguments string) map[string]any {
+	return map[string]any{
+		"id":      messageId,
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]any{
+			{
+				"index": 0,
+				"delta": map[string]any{
+					"tool_calls": []map[string]any{
+						{
+							"index": toolIndex,
+							"function": map[string]any{
+								"arguments": arguments,
+							},
+						},
+					},
+				},
+				"finish_reason": nil,
+			},
+		},
+	}
+}
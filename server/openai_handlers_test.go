@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnotateOpenAISeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var req types.OpenAIRequest
+	require.NoError(t, utils.SafeUnmarshal([]byte(`{"model":"gpt-4o","seed":42,"logit_bias":{"50256":-100}}`), &req))
+	require.NotNil(t, req.Seed)
+	assert.Equal(t, int64(42), *req.Seed)
+	assert.Len(t, req.LogitBias, 1)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	annotateOpenAISeed(c, req)
+	assert.Equal(t, "false", w.Header().Get(SeedHonoredHeader))
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	annotateOpenAISeed(c, types.OpenAIRequest{Model: "gpt-4o"})
+	assert.Empty(t, w.Header().Get(SeedHonoredHeader), "未携带 seed 时不应添加响应头")
+}
+
+// encodeEventFrame 构造带 :event-type 头的 AWS event-stream 帧（CRC 置零，解析器不校验）
+func encodeEventFrame(eventType, payload string) []byte {
+	var headers []byte
+	for _, h := range [][2]string{{":message-type", "event"}, {":event-type", eventType}} {
+		headers = append(headers, byte(len(h[0])))
+		headers = append(headers, h[0]...)
+		headers = append(headers, 7) // string
+		headers = binary.BigEndian.AppendUint16(headers, uint16(len(h[1])))
+		headers = append(headers, h[1]...)
+	}
+	total := 12 + len(headers) + len(payload) + 4
+	frame := make([]byte, 12, total)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(total))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(headers)))
+	frame = append(frame, headers...)
+	frame = append(frame, payload...)
+	return append(frame, 0, 0, 0, 0)
+}
+
+// parseOpenAIChunks 解析 OpenAI SSE 响应中的 chunk（不含 [DONE]）
+func parseOpenAIChunks(t *testing.T, body string) []map[string]any {
+	t.Helper()
+	var chunks []map[string]any
+	for line := range strings.SplitSeq(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk map[string]any
+		require.NoError(t, json.Unmarshal([]byte(data), &chunk))
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// TestHandleOpenAIStreamRequest_ToolCallDeltas 工具调用按 OpenAI 流式协议下发：
+// 首个增量带 index/id/name 与空 arguments，之后的增量只追加 arguments，最后 finish_reason 为 tool_calls
+func TestHandleOpenAIStreamRequest_ToolCallDeltas(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(encodeEventFrame("assistantResponseEvent", `{"content":"Checking."}`))
+		_, _ = w.Write(encodeEventFrame("toolUseEvent", `{"name":"get_weather","toolUseId":"tooluse_weather7Xk2pQm9Lb4Rz","input":"{\"city\":"}`))
+		_, _ = w.Write(encodeEventFrame("toolUseEvent", `{"name":"get_weather","toolUseId":"tooluse_weather7Xk2pQm9Lb4Rz","input":"\"Paris\"}"}`))
+		_, _ = w.Write(encodeEventFrame("toolUseEvent", `{"name":"get_weather","toolUseId":"tooluse_weather7Xk2pQm9Lb4Rz","stop":true}`))
+		_, _ = w.Write(encodeEventFrame("toolUseEvent", `{"name":"get_time","toolUseId":"tooluse_clock3Hn8sVw1Ty6Gd"}`))
+		_, _ = w.Write(encodeEventFrame("toolUseEvent", `{"name":"get_time","toolUseId":"tooluse_clock3Hn8sVw1Ty6Gd","stop":true}`))
+	}))
+	defer upstream.Close()
+	require.NoError(t, config.SetCodeWhispererEndpoint(upstream.URL, ""))
+	defer config.SetCodeWhispererEndpoint("", "")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req := types.AnthropicRequest{
+		Model:     "claude-sonnet-4",
+		MaxTokens: 100,
+		Stream:    true,
+		Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "weather?"}},
+		Tools: []types.AnthropicTool{
+			{Name: "get_weather", InputSchema: map[string]any{"type": "object"}},
+			{Name: "get_time", InputSchema: map[string]any{"type": "object"}},
+		},
+	}
+	handleOpenAIStreamRequest(c, req, types.TokenInfo{AccessToken: "test-token"})
+
+	body := w.Body.String()
+	assert.True(t, strings.HasSuffix(body, "data: [DONE]\n\n"))
+	assert.NotContains(t, body, "content_block", "不应下发 Anthropic 格式的事件")
+
+	arguments := map[int]string{}
+	var starts []map[string]any
+	var finishReasons []any
+	for _, chunk := range parseOpenAIChunks(t, body) {
+		assert.Equal(t, "chat.completion.chunk", chunk["object"])
+		choice := chunk["choices"].([]any)[0].(map[string]any)
+		if reason := choice["finish_reason"]; reason != nil {
+			finishReasons = append(finishReasons, reason)
+		}
+		delta := choice["delta"].(map[string]any)
+		if content, ok := delta["content"]; ok {
+			assert.NotEmpty(t, content, "不应下发空的 content 增量")
+		}
+		toolCalls, ok := delta["tool_calls"].([]any)
+		if !ok {
+			continue
+		}
+		require.Len(t, toolCalls, 1)
+		call := toolCalls[0].(map[string]any)
+		index := int(call["index"].(float64))
+		function := call["function"].(map[string]any)
+		if _, isStart := call["id"]; isStart {
+			assert.Equal(t, "function", call["type"])
+			assert.Equal(t, "", function["arguments"], "首个增量的 arguments 应为空字符串")
+			starts = append(starts, call)
+			continue
+		}
+		assert.NotContains(t, call, "type")
+		assert.NotContains(t, function, "name", "参数增量不应重复工具名")
+		arguments[index] += function["arguments"].(string)
+	}
+
+	require.Len(t, starts, 2)
+	assert.Equal(t, "tooluse_weather7Xk2pQm9Lb4Rz", starts[0]["id"])
+	assert.Equal(t, "get_weather", starts[0]["function"].(map[string]any)["name"])
+	assert.Equal(t, float64(0), starts[0]["index"])
+	assert.Equal(t, "tooluse_clock3Hn8sVw1Ty6Gd", starts[1]["id"])
+	assert.Equal(t, float64(1), starts[1]["index"])
+	assert.JSONEq(t, `{"city":"Paris"}`, arguments[0], body)
+	assert.JSONEq(t, `{}`, arguments[1], body)
+	assert.Equal(t, []any{"tool_calls"}, finishReasons)
+}
+
+// TestHandleOpenAIStreamRequest_ReasoningField thinking 默认以 <thinking> 标签放入 content；
+// 启用 OPENAI_REASONING_FIELD 后改为 delta.reasoning_content，content 仅包含正文
+func TestHandleOpenAIStreamRequest_ReasoningField(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(encodeEventFrame("thinkingEvent", `{"content":"let me think"}`))
+		_, _ = w.Write(encodeEventFrame("assistantResponseEvent", `{"content":"Answer."}`))
+	}))
+	defer upstream.Close()
+	require.NoError(t, config.SetCodeWhispererEndpoint(upstream.URL, ""))
+	defer config.SetCodeWhispererEndpoint("", "")
+
+	orig := config.OpenAIReasoningField
+	defer func() { config.OpenAIReasoningField = orig }()
+
+	stream := func(reasoningField bool) (content, reasoning string) {
+		config.OpenAIReasoningField = reasoningField
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		handleOpenAIStreamRequest(c, types.AnthropicRequest{
+			Model:     "claude-sonnet-4",
+			MaxTokens: 100,
+			Stream:    true,
+			Messages:  []types.AnthropicRequestMessage{{Role: "user", Content: "hi"}},
+		}, types.TokenInfo{AccessToken: "test-token"})
+
+		for _, chunk := range parseOpenAIChunks(t, w.Body.String()) {
+			delta := chunk["choices"].([]any)[0].(map[string]any)["delta"].(map[string]any)
+			if s, ok := delta["content"].(string); ok {
+				content += s
+			}
+			if s, ok := delta["reasoning_content"].(string); ok {
+				reasoning += s
+			}
+		}
+		return content, reasoning
+	}
+
+	content, reasoning := stream(false)
+	assert.Empty(t, reasoning)
+	assert.Contains(t, content, "<thinking>")
+	assert.Contains(t, content, "let me think")
+	assert.Contains(t, content, "Answer.")
+
+	content, reasoning = stream(true)
+	assert.Equal(t, "let me think", reasoning)
+	assert.Equal(t, "Answer.", content)
+}
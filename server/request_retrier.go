@@ -31,7 +31,7 @@ func DefaultRetryConfig() *RetryConfig {
 	return &RetryConfig{
 		MaxRetries:      config.SessionPoolMaxRetries,
 		InitialInterval: config.SessionPoolRetryInterval,
-		MaxInterval:     config.RateLimitBackoffMax,
+		MaxInterval:     config.SessionPoolRetryMaxInterval,
 		BackoffFactor:   config.RateLimitBackoffMultiplier,
 		JitterPercent:   config.RateLimitJitterPercent,
 	}
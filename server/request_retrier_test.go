@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoffRetrier_CalculateBackoff(t *testing.T) {
+	r := &ExponentialBackoffRetrier{config: &RetryConfig{
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     time.Second,
+		BackoffFactor:   2,
+		JitterPercent:   30,
+	}}
+
+	// 每次重试翻倍，抖动只会在基础值上增加 0-30%
+	for retry, base := range []time.Duration{100, 200, 400, 800} {
+		base *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			backoff := r.calculateBackoff(retry)
+			assert.GreaterOrEqual(t, backoff, base)
+			assert.LessOrEqual(t, backoff, base*13/10)
+		}
+	}
+
+	// 超过上限后截断（抖动在截断后叠加）
+	backoff := r.calculateBackoff(10)
+	assert.GreaterOrEqual(t, backoff, time.Second)
+	assert.LessOrEqual(t, backoff, 1300*time.Millisecond)
+}
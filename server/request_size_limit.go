@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestTooLargeError 转换后的上游请求体超过 UPSTREAM_REQUEST_MAX_BYTES
+type RequestTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *RequestTooLargeError) Error() string {
+	return fmt.Sprintf("请求内容过大：转换后的上游请求约 %d 字节，超过上限 %d 字节，请精简对话历史、工具定义或附件后重试",
+		e.Size, e.Limit)
+}
+
+// enforceUpstreamRequestSize 在发往上游前检查序列化后的请求体大小，避免请求上游后才收到 CONTENT_LENGTH_EXCEEDS_THRESHOLD
+// 超出上限时：开启 HISTORY_AUTO_TRUNCATE 则逐轮丢弃最早的历史消息后重新转换；仍超出或未开启时返回 RequestTooLargeError
+func enforceUpstreamRequestSize(c *gin.Context, anthropicReq types.AnthropicRequest, cwReq types.CodeWhispererRequest, body []byte) (types.CodeWhispererRequest, []byte, error) {
+	limit := config.UpstreamRequestMaxBytes
+	if limit <= 0 || len(body) <= limit {
+		return cwReq, body, nil
+	}
+
+	originalSize := len(body)
+	originalMessages := len(anthropicReq.Messages)
+	for config.HistoryAutoTruncate && len(body) > limit {
+		messages, ok := converter.DropOldestHistoryTurn(anthropicReq.Messages)
+		if !ok {
+			break
+		}
+		anthropicReq.Messages = messages
+
+		var err error
+		if cwReq, err = converter.BuildCodeWhispererRequest(anthropicReq, c); err != nil {
+			return cwReq, nil, fmt.Errorf("构建CodeWhisperer请求失败: %v", err)
+		}
+		if body, err = utils.SafeMarshal(cwReq); err != nil {
+			return cwReq, nil, fmt.Errorf("序列化请求失败: %v", err)
+		}
+	}
+
+	if len(body) > limit {
+		return cwReq, nil, &RequestTooLargeError{Size: len(body), Limit: limit}
+	}
+
+	logger.Info("上游请求超过大小上限，已丢弃最早的历史消息",
+		addReqFields(c,
+			logger.Int("dropped_messages", originalMessages-len(anthropicReq.Messages)),
+			logger.Int("request_size_before", originalSize),
+			logger.Int("request_size_after", len(body)),
+			logger.Int("limit", limit))...)
+	return cwReq, body, nil
+}
+
+// respondRequestTooLarge 返回 Claude 规范的 400 invalid_request_error，消息中带估算的请求大小
+func respondRequestTooLarge(c *gin.Context, err *RequestTooLargeError) {
+	logger.Warn("上游请求超过大小上限，拒绝请求",
+		addReqFields(c,
+			logger.Int("request_size", err.Size),
+			logger.Int("limit", err.Limit))...)
+	c.JSON(http.StatusBadRequest, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "invalid_request_error",
+			"message": err.Error(),
+		},
+	})
+}
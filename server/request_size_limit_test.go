@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withUpstreamRequestMaxBytes(t *testing.T, limit int, autoTruncate bool) {
+	t.Helper()
+	origLimit, origTruncate := config.UpstreamRequestMaxBytes, config.HistoryAutoTruncate
+	config.UpstreamRequestMaxBytes, config.HistoryAutoTruncate = limit, autoTruncate
+	t.Cleanup(func() {
+		config.UpstreamRequestMaxBytes, config.HistoryAutoTruncate = origLimit, origTruncate
+	})
+}
+
+// oversizedHistoryBody 最早一轮历史带有大段内容，丢弃后请求体明显变小
+func oversizedHistoryBody() string {
+	padding := strings.Repeat("x", 8000)
+	return `{"model":"claude-sonnet-4-20250514","max_tokens":100,"messages":[
+		{"role":"user","content":"` + padding + `"},
+		{"role":"assistant","content":"noted"},
+		{"role":"user","content":"final question"}]}`
+}
+
+func TestUpstreamRequestSize_RejectsOversizedRequest(t *testing.T) {
+	withUpstreamRequestMaxBytes(t, 4000, false)
+	r := newMessagesPreviewRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages/preview", strings.NewReader(oversizedHistoryBody())))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	errObj := resp["error"].(map[string]any)
+	assert.Equal(t, "invalid_request_error", errObj["type"])
+	assert.Contains(t, errObj["message"], "4000 字节")
+}
+
+func TestUpstreamRequestSize_TruncatesHistoryWhenEnabled(t *testing.T) {
+	withUpstreamRequestMaxBytes(t, 4000, true)
+	r := newMessagesPreviewRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages/preview", strings.NewReader(oversizedHistoryBody())))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.NotContains(t, w.Body.String(), strings.Repeat("x", 100), "最早的历史应被丢弃")
+	assert.Contains(t, w.Body.String(), "final question")
+}
+
+func TestUpstreamRequestSize_DisabledByDefault(t *testing.T) {
+	withUpstreamRequestMaxBytes(t, 0, false)
+	r := newMessagesPreviewRouter()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages/preview", strings.NewReader(oversizedHistoryBody())))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
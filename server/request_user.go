@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metadataUserIDContextKey Anthropic 请求 metadata.user_id 在 gin 上下文中的键
+const metadataUserIDContextKey = "metadata_user_id"
+
+// MetadataUserIDMiddleware 提取请求体中的 metadata.user_id 存入上下文，并恢复请求体供后续处理
+// 用于按终端用户限流与访问日志；仅读取指定路由（精确匹配，如 /v1/messages）的 POST 请求体
+// 读取请求体失败时恢复已读取的部分并返回 400
+func MetadataUserIDMiddleware(routes []string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method != http.MethodPost || c.Request.Body == nil || !slices.Contains(routes, c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			logger.Warn("读取请求体失败", addReqFields(c, logger.Err(err))...)
+			respondError(c, http.StatusBadRequest, "读取请求体失败: %v", err)
+			c.Abort()
+			return
+		}
+		if userID := extractMetadataUserID(body); userID != "" {
+			c.Set(metadataUserIDContextKey, userID)
+		}
+		c.Next()
+	}
+}
+
+// extractMetadataUserID 从请求体解析 metadata.user_id（解析失败或缺失时返回空）
+func extractMetadataUserID(body []byte) string {
+	var req struct {
+		Metadata struct {
+			UserID any `json:"user_id"`
+		} `json:"metadata"`
+	}
+	if err := utils.SafeUnmarshal(body, &req); err != nil {
+		return ""
+	}
+	userID, _ := req.Metadata.UserID.(string)
+	return strings.TrimSpace(userID)
+}
+
+// requestUserHash 返回 metadata.user_id 的哈希（不保留明文，未提供时返回空）
+func requestUserHash(c *gin.Context) string {
+	userID := c.GetString(metadataUserIDContextKey)
+	if userID == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(userID))
+	return hex.EncodeToString(hash[:8])
+}
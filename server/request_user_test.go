@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingBody 读取即失败的请求体，并记录是否被读取
+type failingBody struct{ read bool }
+
+func (b *failingBody) Read([]byte) (int, error) {
+	b.read = true
+	return 0, errors.New("connection reset")
+}
+
+func (b *failingBody) Close() error { return nil }
+
+func TestMetadataUserIDMiddleware_OnlyReadsConfiguredRoutes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(MetadataUserIDMiddleware([]string{"/v1/messages"}))
+	router.POST("/v1/messages", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/v1/chat/completions", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	// 其他路由不读取请求体
+	body := &failingBody{}
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	req.Body = body
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, body.read)
+
+	// 读取失败时返回 400，不再继续处理
+	body = &failingBody{}
+	req = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req.Body = body
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.True(t, body.read)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "读取请求体失败")
+}
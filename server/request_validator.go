@@ -0,0 +1,116 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 请求验证器 ==========
+
+// ValidateAnthropicRequest 在发送上游之前验证 /v1/messages 请求
+// 上游对格式错误的请求只返回含糊的 400，这里提前检查并指出具体字段（字段路径与官方 API 一致，如 messages.1.role）
+// 返回第一个发现的错误，验证通过时返回 nil
+func ValidateAnthropicRequest(req types.AnthropicRequest) *ValidationError {
+	if len(req.Messages) == 0 {
+		return &ValidationError{Field: "messages", Message: "至少需要一条消息"}
+	}
+
+	for i, msg := range req.Messages {
+		switch msg.Role {
+		case "user", "assistant":
+		case "system":
+			// 兼容部分客户端：messages 中的 system 消息与相邻的 user 消息合并
+		case "":
+			return &ValidationError{Field: fmt.Sprintf("messages.%d.role", i), Message: "缺少 role"}
+		default:
+			return &ValidationError{Field: fmt.Sprintf("messages.%d.role", i), Message: fmt.Sprintf("role 必须为 'user' 或 'assistant'，当前为: %s", msg.Role)}
+		}
+		if msg.Content == nil {
+			return &ValidationError{Field: fmt.Sprintf("messages.%d.content", i), Message: "缺少 content"}
+		}
+	}
+
+	names := make(map[string]int, len(req.Tools))
+	for i, tool := range req.Tools {
+		if tool.Name == "" {
+			return &ValidationError{Field: fmt.Sprintf("tools.%d.name", i), Message: "缺少工具名称"}
+		}
+		if prev, exists := names[tool.Name]; exists {
+			return &ValidationError{Field: fmt.Sprintf("tools.%d.name", i), Message: fmt.Sprintf("工具名称 %q 与 tools.%d 重复", tool.Name, prev)}
+		}
+		names[tool.Name] = i
+
+		// web_search 等服务端工具没有 input_schema
+		if converter.IsWebSearchToolName(tool.Name) {
+			continue
+		}
+		if err := validateToolInputSchema(tool.InputSchema); err != "" {
+			return &ValidationError{Field: fmt.Sprintf("tools.%d.input_schema", i), Message: err}
+		}
+	}
+
+	if req.Thinking != nil {
+		if err := req.Thinking.Validate(); err != nil {
+			return &ValidationError{Field: "thinking", Message: err.Error()}
+		}
+		// budget_tokens 已在反序列化时规范化到允许范围内；enabled 模式还要求小于 max_tokens
+		// （interleaved-thinking beta 下预算按整轮对话计算，不受此限制）
+		if req.Thinking.Type == "enabled" && !req.InterleavedThinking && req.MaxTokens > 0 && req.Thinking.BudgetTokens >= req.MaxTokens {
+			return &ValidationError{
+				Field:   "thinking.budget_tokens",
+				Message: fmt.Sprintf("budget_tokens (%d) 必须小于 max_tokens (%d)", req.Thinking.BudgetTokens, req.MaxTokens),
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateToolInputSchema 检查工具 input_schema 是否为 object 类型的 JSON Schema，返回错误描述
+func validateToolInputSchema(schema map[string]any) string {
+	if schema == nil {
+		return "缺少 input_schema"
+	}
+	if schemaType, exists := schema["type"]; exists && schemaType != "object" {
+		return fmt.Sprintf("input_schema.type 必须为 'object'，当前为: %v", schemaType)
+	}
+	if properties, exists := schema["properties"]; exists && properties != nil {
+		if _, ok := properties.(map[string]any); !ok {
+			return "input_schema.properties 必须为对象"
+		}
+	}
+	if required, exists := schema["required"]; exists && required != nil {
+		items, ok := required.([]any)
+		if !ok {
+			return "input_schema.required 必须为字符串数组"
+		}
+		for _, item := range items {
+			if _, ok := item.(string); !ok {
+				return "input_schema.required 必须为字符串数组"
+			}
+		}
+	}
+	return ""
+}
+
+// respondInvalidRequest 返回 Claude 规范的 400 invalid_request_error，消息以字段路径开头
+func respondInvalidRequest(c *gin.Context, verr *ValidationError) {
+	logger.Warn("请求验证失败",
+		addReqFields(c,
+			logger.String("field", verr.Field),
+			logger.String("reason", verr.Message),
+		)...)
+	c.JSON(http.StatusBadRequest, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "invalid_request_error",
+			"message": fmt.Sprintf("%s: %s", verr.Field, verr.Message),
+		},
+	})
+}
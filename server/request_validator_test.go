@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAnthropicRequest(t *testing.T) {
+	userMsg := types.AnthropicRequestMessage{Role: "user", Content: "hi"}
+	objectSchema := map[string]any{"type": "object", "properties": map[string]any{"q": map[string]any{"type": "string"}}}
+
+	tests := []struct {
+		name  string
+		req   types.AnthropicRequest
+		field string // 为空表示验证通过
+	}{
+		{
+			name: "valid",
+			req: types.AnthropicRequest{
+				MaxTokens: 4096,
+				Messages:  []types.AnthropicRequestMessage{userMsg, {Role: "assistant", Content: "ok"}, userMsg},
+				Tools:     []types.AnthropicTool{{Name: "search", InputSchema: objectSchema}, {Name: "web_search"}},
+				Thinking:  &types.Thinking{Type: "enabled", BudgetTokens: 2048},
+			},
+		},
+		{name: "empty messages", req: types.AnthropicRequest{}, field: "messages"},
+		{
+			name:  "invalid role",
+			req:   types.AnthropicRequest{Messages: []types.AnthropicRequestMessage{userMsg, {Role: "tool", Content: "x"}}},
+			field: "messages.1.role",
+		},
+		{
+			name:  "missing content",
+			req:   types.AnthropicRequest{Messages: []types.AnthropicRequestMessage{{Role: "user"}}},
+			field: "messages.0.content",
+		},
+		{
+			name: "duplicate tool name",
+			req: types.AnthropicRequest{
+				Messages: []types.AnthropicRequestMessage{userMsg},
+				Tools:    []types.AnthropicTool{{Name: "search", InputSchema: objectSchema}, {Name: "search", InputSchema: objectSchema}},
+			},
+			field: "tools.1.name",
+		},
+		{
+			name: "missing input_schema",
+			req: types.AnthropicRequest{
+				Messages: []types.AnthropicRequestMessage{userMsg},
+				Tools:    []types.AnthropicTool{{Name: "search"}},
+			},
+			field: "tools.0.input_schema",
+		},
+		{
+			name: "non-object input_schema",
+			req: types.AnthropicRequest{
+				Messages: []types.AnthropicRequestMessage{userMsg},
+				Tools:    []types.AnthropicTool{{Name: "search", InputSchema: map[string]any{"type": "array"}}},
+			},
+			field: "tools.0.input_schema",
+		},
+		{
+			name: "invalid required",
+			req: types.AnthropicRequest{
+				Messages: []types.AnthropicRequestMessage{userMsg},
+				Tools:    []types.AnthropicTool{{Name: "search", InputSchema: map[string]any{"type": "object", "required": "q"}}},
+			},
+			field: "tools.0.input_schema",
+		},
+		{
+			name: "budget exceeds max_tokens",
+			req: types.AnthropicRequest{
+				MaxTokens: 2000,
+				Messages:  []types.AnthropicRequestMessage{userMsg},
+				Thinking:  &types.Thinking{Type: "enabled", BudgetTokens: 4096},
+			},
+			field: "thinking.budget_tokens",
+		},
+		{
+			name: "interleaved thinking allows budget above max_tokens",
+			req: types.AnthropicRequest{
+				MaxTokens:           2000,
+				Messages:            []types.AnthropicRequestMessage{userMsg},
+				Thinking:            &types.Thinking{Type: "enabled", BudgetTokens: 4096},
+				InterleavedThinking: true,
+			},
+		},
+		{
+			name: "invalid thinking type",
+			req: types.AnthropicRequest{
+				Messages: []types.AnthropicRequestMessage{userMsg},
+				Thinking: &types.Thinking{Type: "always"},
+			},
+			field: "thinking",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verr := ValidateAnthropicRequest(tt.req)
+			if tt.field == "" {
+				assert.Nil(t, verr)
+				return
+			}
+			require.NotNil(t, verr)
+			assert.Equal(t, tt.field, verr.Field)
+		})
+	}
+}
+
+func TestParseMessagesRequest_InvalidToolSchema(t *testing.T) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	body := `{"model":"claude-sonnet-4","max_tokens":1024,"messages":[{"role":"user","content":"hi"}],` +
+		`"tools":[{"name":"lookup","description":"d","input_schema":{"type":"string"}}]}`
+	_, ok := parseMessagesRequest(c, []byte(body))
+	require.False(t, ok)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	errObj := resp["error"].(map[string]any)
+	assert.Equal(t, "invalid_request_error", errObj["type"])
+	assert.Contains(t, errObj["message"], "tools.0.input_schema")
+}
@@ -1,14 +1,19 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"kiro2api/auth"
 	"kiro2api/config"
 	"kiro2api/converter"
 	"kiro2api/logger"
+	"kiro2api/metrics"
 	"kiro2api/types"
 	"kiro2api/utils"
 
@@ -18,7 +23,7 @@ import (
 // 移除全局httpClient，使用utils包中的共享客户端
 
 // StartServer 启动HTTP代理服务器
-func StartServer(port string, authToken string, authService *auth.AuthService) {
+func StartServer(port string, authService *auth.AuthService) {
 	// 设置 gin 模式
 	ginMode := os.Getenv("GIN_MODE")
 	if ginMode == "" {
@@ -39,21 +44,59 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	r.Use(corsMiddleware())
 	// 请求体大小限制中间件（100MB，支持大图片上传）
 	r.Use(MaxBodySizeMiddleware())
+	// Prometheus 指标（METRICS_ENABLED=true 时启用）
+	if config.MetricsEnabled {
+		metrics.Init(func() metrics.TokenPoolStats {
+			health := authService.GetPoolHealth()
+			return metrics.TokenPoolStats{
+				Total:     health.Total,
+				Active:    health.Active,
+				Exhausted: health.Exhausted,
+			}
+		})
+		r.Use(MetricsMiddleware([]string{"/v1"}))
+		r.GET("/metrics", gin.WrapH(metrics.Handler()))
+		logger.Info("Prometheus 指标已启用", logger.String("path", "/metrics"))
+	}
 	// 注入AuthService到上下文，供错误处理时使用
 	r.Use(func(c *gin.Context) {
 		c.Set("auth_service", authService)
 		c.Next()
 	})
 	// 只对 /v1 开头的端点进行认证
-	r.Use(PathBasedAuthMiddleware(authToken, []string{"/v1"}))
+	r.Use(PathBasedAuthMiddleware([]string{"/v1"}))
+	// 提取 metadata.user_id，用于按终端用户限流与访问日志（仅 Anthropic 消息端点携带）
+	r.Use(MetadataUserIDMiddleware([]string{"/v1/messages"}))
+	// 校验 anthropic-version、解析 anthropic-beta（仅 Anthropic 格式端点）
+	r.Use(AnthropicVersionMiddleware([]string{"/v1/messages"}))
+	// 按客户端身份限流（CLIENT_RATE_LIMIT_ENABLED=true 时启用）
+	var clientLimiter, userLimiter *ClientRateLimiter
+	if config.ClientRateLimitEnabled {
+		clientLimiter = NewClientRateLimiter(DefaultClientRateLimiterConfig())
+		r.Use(ClientRateLimitMiddleware(clientLimiter, []string{"/v1"}))
+		logger.Info("客户端限流已启用",
+			logger.Int("rpm", config.ClientRateLimitRequestsPerMinute),
+			logger.Int("max_concurrent_streams", config.ClientRateLimitMaxConcurrentStreams))
+
+		if config.ClientRateLimitUserRequestsPerMinute > 0 {
+			userLimiter = NewClientRateLimiter(ClientRateLimiterConfig{
+				RequestsPerMinute: config.ClientRateLimitUserRequestsPerMinute,
+				IdleTTL:           config.ClientRateLimitIdleTTL,
+			})
+			r.Use(UserRateLimitMiddleware(userLimiter, []string{"/v1"}))
+			logger.Info("终端用户限流已启用", logger.Int("rpm", config.ClientRateLimitUserRequestsPerMinute))
+		}
+	}
 	uiPassword := strings.TrimSpace(os.Getenv("KIRO_UI_PASSWORD"))
 	if uiPassword != "" {
 		logger.Info("UI 认证已启用")
 	} else {
 		logger.Info("UI 认证未启用")
 	}
-	// 仅保护 Web UI 与管理端点
-	r.Use(UIAuthMiddleware(uiPassword, []string{"/static", "/oauth", "/api"}))
+	// 仅保护 Web UI 与管理端点（请求预览会暴露上游请求细节，同样视为管理端点）
+	r.Use(UIAuthMiddleware(uiPassword, []string{"/static", "/oauth", "/api", "/v1/messages/preview"}))
+	// 未设置 UI 密码时，管理端点的写操作（解绑会话、调整并发、导入/删除账号、发起 OAuth 等）仍需提供客户端API密钥
+	r.Use(AdminAuthMiddleware(uiPassword, []string{"/api", "/oauth"}))
 
 	// 静态资源服务 - 前后端完全分离
 	r.Static("/static", "./static")
@@ -67,66 +110,34 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	// 注册机器码管理路由
 	RegisterMachineIdRoutes(r)
 
+	// 健康检查（无需认证，供负载均衡器使用）
+	r.GET("/health", handleHealth(authService))
+	// Kubernetes 存活/就绪探针（无需认证）
+	r.GET("/livez", handleLivez)
+	r.GET("/readyz", handleReadyz(authService))
+
 	// API端点 - 纯数据服务
 	r.GET("/api/tokens", handleTokenPoolAPI)
+	r.GET("/api/tokens/:index/history", handleTokenUsageHistory)
 	r.GET("/api/anti-ban/status", handleAntiBanStatus)
 	r.GET("/api/session-binding/status", handleSessionBindingStatus)
 	r.GET("/api/session-binding/:session_id", handleSessionBindingDetail)
+	r.DELETE("/api/session-binding/:session_id", handleSessionBindingDelete)
+	r.GET("/api/session-pool", handleSessionPoolStatus)
+	r.GET("/api/upstream-concurrency", handleUpstreamConcurrencyStatus)
+	r.PUT("/api/upstream-concurrency", handleSetUpstreamConcurrency)
+	r.GET("/api/upstream-concurrency/queue", handleUpstreamQueueStatus)
+	r.GET("/api/client-tokens", handleClientTokensStatus)
+	r.POST("/api/client-tokens/reload", handleClientTokensReload)
 
 	// GET /v1/models 端点
-	r.GET("/v1/models", func(c *gin.Context) {
-		requestModels := config.ListRequestModels()
-		if modelProvider, ok := any(authService).(interface{ GetAvailableModels() []string }); ok {
-			if models := modelProvider.GetAvailableModels(); len(models) > 0 {
-				requestModels = models
-			}
-		}
-
-		// 构建模型列表
-		models := []types.Model{}
-		for _, anthropicModel := range requestModels {
-			isThinkingVariant := strings.HasSuffix(anthropicModel, "-thinking")
-			baseModel := strings.TrimSuffix(anthropicModel, "-thinking")
-			supportsThinking := converter.IsThinkingCompatibleModel(baseModel)
-
-			// 添加原始模型
-			model := types.Model{
-				ID:               anthropicModel,
-				Object:           "model",
-				Created:          1234567890,
-				OwnedBy:          "anthropic",
-				DisplayName:      anthropicModel,
-				Type:             "text",
-				MaxTokens:        200000,
-				SupportsThinking: supportsThinking,
-			}
-			models = append(models, model)
-
-			// 为支持 thinking 的模型添加 -thinking 后缀版本
-			if supportsThinking && !isThinkingVariant {
-				thinkingModel := types.Model{
-					ID:               baseModel + "-thinking",
-					Object:           "model",
-					Created:          1234567890,
-					OwnedBy:          "anthropic",
-					DisplayName:      baseModel + " (Thinking)",
-					Type:             "text",
-					MaxTokens:        200000,
-					SupportsThinking: true,
-				}
-				models = append(models, thinkingModel)
-			}
-		}
-
-		response := types.ModelsResponse{
-			Object: "list",
-			Data:   models,
-		}
-
-		c.JSON(http.StatusOK, response)
-	})
+	r.GET("/v1/models", handleListModels(authService))
+	r.GET("/v1/models/:id", handleGetModel(authService))
 
 	r.POST("/v1/messages", func(c *gin.Context) {
+		// 请求结束时输出结构化访问日志（ACCESS_LOG_ENABLED=true 时）
+		defer startAccessLog(c).finish(c)
+
 		// 使用RequestContext统一处理token获取和请求体读取
 		reqCtx := &RequestContext{
 			GinContext:  c,
@@ -139,126 +150,19 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 			return // 错误已在GetTokenAndBody中处理
 		}
 
-		// 先解析为通用map以便处理工具格式
-		var rawReq map[string]any
-		if err := utils.SafeUnmarshal(body, &rawReq); err != nil {
-			logger.Error("解析请求体失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
-			return
-		}
-
-		// 标准化工具格式处理
-		if tools, exists := rawReq["tools"]; exists && tools != nil {
-			if toolsArray, ok := tools.([]any); ok {
-				normalizedTools := make([]map[string]any, 0, len(toolsArray))
-				for _, tool := range toolsArray {
-					if toolMap, ok := tool.(map[string]any); ok {
-						// 检查是否是简化的工具格式（直接包含name, description, input_schema）
-						if name, hasName := toolMap["name"]; hasName {
-							if description, hasDesc := toolMap["description"]; hasDesc {
-								if inputSchema, hasSchema := toolMap["input_schema"]; hasSchema {
-									// 转换为标准Anthropic工具格式
-									normalizedTool := map[string]any{
-										"name":         name,
-										"description":  description,
-										"input_schema": inputSchema,
-									}
-									normalizedTools = append(normalizedTools, normalizedTool)
-									continue
-								}
-							}
-						}
-						// 如果不是简化格式，保持原样
-						normalizedTools = append(normalizedTools, toolMap)
-					}
-				}
-				rawReq["tools"] = normalizedTools
-			}
-		}
-
-		// 重新序列化并解析为AnthropicRequest
-		normalizedBody, err := utils.SafeMarshal(rawReq)
-		if err != nil {
-			logger.Error("重新序列化请求失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "处理请求格式失败: %v", err)
-			return
-		}
-
-		var anthropicReq types.AnthropicRequest
-		if err := utils.SafeUnmarshal(normalizedBody, &anthropicReq); err != nil {
-			logger.Error("解析标准化请求体失败", logger.Err(err))
-			respondError(c, http.StatusBadRequest, "解析请求体失败: %v", err)
-			return
-		}
-
-		// 检测 -thinking 后缀，自动开启思考模式（与 kiro.rs 对齐）
-		if strings.HasSuffix(anthropicReq.Model, "-thinking") {
-			anthropicReq.Model = strings.TrimSuffix(anthropicReq.Model, "-thinking")
-			if anthropicReq.Thinking == nil {
-				// 与 kiro.rs 对齐：Opus 4.6 使用 adaptive 模式，其他使用 enabled
-				modelLower := strings.ToLower(anthropicReq.Model)
-				isOpus46 := strings.Contains(modelLower, "opus") &&
-					(strings.Contains(modelLower, "4-6") || strings.Contains(modelLower, "4.6"))
-
-				budgetTokens := 20000 // 与 kiro.rs 对齐
-				if isOpus46 {
-					anthropicReq.Thinking = &types.Thinking{
-						Type:         "adaptive",
-						BudgetTokens: budgetTokens,
-					}
-					anthropicReq.OutputConfig = &types.OutputConfig{
-						Effort: "high",
-					}
-				} else {
-					anthropicReq.Thinking = &types.Thinking{
-						Type:         "enabled",
-						BudgetTokens: budgetTokens,
-					}
-				}
-				// 确保 max_tokens > budget_tokens（官方 API 要求）
-				if anthropicReq.MaxTokens <= budgetTokens {
-					anthropicReq.MaxTokens = budgetTokens + 4096
-				}
-			}
-		}
-
-		// 验证请求的有效性
-		if len(anthropicReq.Messages) == 0 {
-			logger.Error("请求中没有消息")
-			respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
-			return
-		}
-
-		// 静默丢弃 assistant prefill（参考 kiro.rs fix #72）
-		if anthropicReq.Messages[len(anthropicReq.Messages)-1].Role == "assistant" {
-			logger.Debug("静默丢弃 assistant prefill 消息")
-			anthropicReq.Messages = anthropicReq.Messages[:len(anthropicReq.Messages)-1]
-			if len(anthropicReq.Messages) == 0 {
-				respondError(c, http.StatusBadRequest, "%s", "messages 数组不能为空")
-				return
-			}
-		}
-
-		// 验证最后一条消息有有效内容
-		lastMsg := anthropicReq.Messages[len(anthropicReq.Messages)-1]
-		content, err := utils.GetMessageContent(lastMsg.Content)
-		if err != nil || strings.TrimSpace(content) == "" || strings.TrimSpace(content) == "answer for user question" {
-			respondError(c, http.StatusBadRequest, "%s", "消息内容不能为空")
-			return
+		anthropicReq, ok := parseMessagesRequest(c, body)
+		if !ok {
+			return // 错误已在parseMessagesRequest中处理
 		}
 
+		recordAccessStream(c, anthropicReq.Stream)
 		if anthropicReq.Stream {
-			// 检测纯 WebSearch 请求（参考 kiro.rs）
-			if hasWebSearchTool(anthropicReq) {
-				handleWebSearchRequest(c, anthropicReq, tokenInfo)
+			// 无法转发流式响应的代理：照常流式处理，结束后以非流式响应返回（STREAM_BUFFER_MODE）
+			if streamBufferRequested(c) {
+				serveBufferedStream(c, func() { handleMessagesStream(c, anthropicReq, tokenInfo) })
 				return
 			}
-			// 当启用会话池时，使用带重试的处理器
-			if config.SessionPoolEnabled {
-				handleStreamRequestWithRetry(c, anthropicReq)
-			} else {
-				handleStreamRequest(c, anthropicReq, tokenInfo)
-			}
+			handleMessagesStream(c, anthropicReq, tokenInfo)
 			return
 		}
 
@@ -268,8 +172,20 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 	// Token计数端点
 	r.POST("/v1/messages/count_tokens", handleCountTokens)
 
+	// 请求预览端点：返回转换后的上游请求，不调用上游
+	r.POST("/v1/messages/preview", handleMessagesPreview)
+
+	// Message Batches 端点：每个条目作为独立的非流式 /v1/messages 请求在后台处理
+	batchManager := NewMessageBatchManager(r)
+	r.POST("/v1/messages/batches", handleCreateMessageBatch(batchManager))
+	r.GET("/v1/messages/batches/:id", handleGetMessageBatch(batchManager))
+	r.GET("/v1/messages/batches/:id/results", handleGetMessageBatchResults(batchManager))
+
 	// 新增：OpenAI兼容的 /v1/chat/completions 端点
 	r.POST("/v1/chat/completions", func(c *gin.Context) {
+		// 请求结束时输出结构化访问日志（ACCESS_LOG_ENABLED=true 时）
+		defer startAccessLog(c).finish(c)
+
 		// 使用RequestContext统一处理token获取和请求体读取
 		reqCtx := &RequestContext{
 			GinContext:  c,
@@ -293,15 +209,24 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 			logger.String("model", openaiReq.Model),
 			logger.Bool("stream", openaiReq.Stream != nil && *openaiReq.Stream),
 			logger.Int("max_tokens", func() int {
-				if openaiReq.MaxTokens != nil {
-					return *openaiReq.MaxTokens
+				if requested := openaiReq.MaxOutputTokens(); requested != nil {
+					return *requested
 				}
 				return 16384
 			}()))
 
+		choiceCount, err := openAIChoiceCount(openaiReq)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "%v", err)
+			return
+		}
+		annotateOpenAISeed(c, openaiReq)
+
 		// 转换为Anthropic格式
 		anthropicReq := converter.ConvertOpenAIToAnthropic(openaiReq)
+		converter.ApplyDefaultSystemPrompt(&anthropicReq, c)
 
+		recordAccessStream(c, anthropicReq.Stream)
 		if anthropicReq.Stream {
 			// 当启用会话池时，使用带重试的处理器
 			if config.SessionPoolEnabled {
@@ -311,9 +236,16 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 			}
 			return
 		}
+		if choiceCount > 1 {
+			handleOpenAINonStreamChoices(c, anthropicReq, tokenInfo, choiceCount)
+			return
+		}
 		handleOpenAINonStreamRequest(c, anthropicReq, tokenInfo)
 	})
 
+	// Gemini兼容端点：POST /v1beta/models/{model}:generateContent 与 :streamGenerateContent
+	r.POST("/v1beta/models/:modelAction", handleGeminiGenerateContent(authService))
+
 	r.NoRoute(func(c *gin.Context) {
 		logger.Warn("访问未知端点",
 			logger.String("path", c.Request.URL.Path),
@@ -325,14 +257,29 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 		logger.String("port", port),
 		logger.String("auth_token", "***"))
 	logger.Info("AuthToken 验证已启用")
+	if mode := utils.ReplayModeDescription(); mode != "" {
+		logger.Warn("上游录制/回放已启用",
+			logger.String("mode", mode),
+			logger.String("dir", config.UpstreamReplayDir))
+	}
 	logger.Info("可用端点:")
 	logger.Info("  GET  /                          - 重定向到静态Dashboard")
 	logger.Info("  GET  /static/*                  - 静态资源服务")
+	logger.Info("  GET  /health                    - 健康检查")
+	logger.Info("  GET  /livez                     - 存活探针")
+	logger.Info("  GET  /readyz                    - 就绪探针")
 	logger.Info("  GET  /api/tokens                - Token池状态API")
+	logger.Info("  GET  /api/tokens/:index/history - Token可用额度历史")
+	logger.Info("  GET  /api/session-pool          - 会话池状态API")
+	logger.Info("  DELETE /api/session-binding/:id - 强制解绑会话（清除Token绑定与会话池）")
+	logger.Info("  GET  /api/upstream-concurrency  - 上游并发限制状态（PUT 调整上限）")
 	logger.Info("  GET  /v1/models                 - 模型列表")
+	logger.Info("  GET  /v1/models/:id             - 模型详情")
 	logger.Info("  POST /v1/messages               - Anthropic API代理")
 	logger.Info("  POST /v1/messages/count_tokens  - Token计数接口")
+	logger.Info("  POST /v1/messages/preview       - 上游请求预览（不调用上游）")
 	logger.Info("  POST /v1/chat/completions       - OpenAI API代理")
+	logger.Info("  POST /v1beta/models/*          - Gemini API代理")
 	logger.Info("按Ctrl+C停止服务器")
 
 	// 创建自定义HTTP服务器以支持长时间请求
@@ -343,18 +290,89 @@ func StartServer(port string, authToken string, authService *auth.AuthService) {
 
 	logger.Info("启动HTTP服务器", logger.String("port", port))
 
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Error("启动服务器失败", logger.Err(err), logger.String("port", port))
-		os.Exit(1)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	// 等待退出信号，收到后优雅关闭（允许进行中的流式响应在宽限期内完成）
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("启动服务器失败", logger.Err(err), logger.String("port", port))
+			os.Exit(1)
+		}
+		return
+	case <-sigCtx.Done():
+	}
+
+	gracefulShutdown(server, authService, config.ShutdownTimeout)
+	if clientLimiter != nil {
+		clientLimiter.Stop()
+	}
+	if userLimiter != nil {
+		userLimiter.Stop()
+	}
+}
+
+// gracefulShutdown 停止接收新连接，等待进行中请求完成后停止后台任务
+func gracefulShutdown(server *http.Server, authService *auth.AuthService, timeout time.Duration) {
+	logger.Info("收到退出信号，开始优雅关闭",
+		logger.Duration("timeout", timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warn("优雅关闭超时，强制关闭剩余连接", logger.Err(err))
+		_ = server.Close()
+	}
+
+	// 停止后台任务
+	authService.Stop()
+	if config.SessionPoolEnabled {
+		auth.GetSessionTokenPoolManager().Stop()
 	}
+	auth.GetSessionTokenBindingManager().Stop()
+
+	logger.Info("服务器已关闭")
 }
 
 // corsMiddleware CORS中间件
+// 未配置 CORS_ALLOWED_ORIGINS 时允许任意来源（不携带凭据）；
+// 配置后仅回显白名单中的 Origin，并允许携带凭据（Cookie / Basic Auth）
 func corsMiddleware() gin.HandlerFunc {
+	allowed := make(map[string]bool, len(config.CORSAllowedOrigins))
+	wildcard := len(config.CORSAllowedOrigins) == 0
+	for _, origin := range config.CORSAllowedOrigins {
+		if origin == "*" {
+			wildcard = true
+		}
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
 	return func(c *gin.Context) {
-		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key")
+		origin := c.GetHeader("Origin")
+		switch {
+		case wildcard:
+			c.Header("Access-Control-Allow-Origin", "*")
+		case origin != "" && allowed[origin]:
+			c.Header("Access-Control-Allow-Origin", origin)
+			c.Header("Access-Control-Allow-Credentials", "true")
+			c.Header("Vary", "Origin")
+		default:
+			c.Header("Vary", "Origin")
+			if c.Request.Method == "OPTIONS" && origin != "" {
+				// 不在白名单中的来源：拒绝预检请求
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+		}
+		c.Header("Access-Control-Allow-Methods", config.CORSAllowedMethods)
+		c.Header("Access-Control-Allow-Headers", config.CORSAllowedHeaders)
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusOK)
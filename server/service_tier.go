@@ -0,0 +1,28 @@
+package server
+
+import (
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// serviceTierStandard 实际使用的服务等级：上游 CodeWhisperer 没有分级容量，所有请求都按标准等级处理
+const serviceTierStandard = "standard"
+
+// standardCompatibleServiceTiers 可以由标准等级满足的 service_tier 取值（空值表示未指定）
+var standardCompatibleServiceTiers = map[string]bool{
+	"":              true,
+	"auto":          true,
+	"standard_only": true,
+	"standard":      true,
+}
+
+// resolveServiceTier 将请求的 service_tier 解析为实际使用的等级
+// 上游不支持的等级（如 priority、flex）不报错，记录日志后按标准等级处理
+func resolveServiceTier(c *gin.Context, requested string) string {
+	if !standardCompatibleServiceTiers[requested] {
+		logger.Warn("上游不支持请求的 service_tier，按 standard 处理",
+			addReqFields(c, logger.String("service_tier", requested))...)
+	}
+	return serviceTierStandard
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveServiceTier(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	for _, requested := range []string{"", "auto", "standard_only", "priority", "flex"} {
+		assert.Equal(t, serviceTierStandard, resolveServiceTier(c, requested), requested)
+	}
+}
+
+func TestParseMessagesRequest_ServiceTier(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	body := `{"model":"claude-sonnet-4","max_tokens":1024,"service_tier":"priority","messages":[{"role":"user","content":"hi"}]}`
+	req, ok := parseMessagesRequest(c, []byte(body))
+	require.True(t, ok)
+	assert.Equal(t, serviceTierStandard, req.ServiceTier)
+}
+
+func TestCreateAnthropicStreamEvents_EchoesServiceTier(t *testing.T) {
+	events := createAnthropicStreamEvents("msg_test", 10, "claude-sonnet-4")
+	message := events[0]["message"].(map[string]any)
+	usage := message["usage"].(map[string]any)
+	assert.Equal(t, serviceTierStandard, usage["service_tier"])
+}
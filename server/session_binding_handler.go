@@ -1,9 +1,13 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"kiro2api/auth"
+	"kiro2api/config"
+	"kiro2api/logger"
 
 	"github.com/gin-gonic/gin"
 )
@@ -31,3 +35,87 @@ func handleSessionBindingDetail(c *gin.Context) {
 
 	c.JSON(http.StatusOK, stats)
 }
+
+// handleSessionBindingDelete 强制解绑会话：清除会话的 Token 绑定（含会话池备用账号的绑定）与会话池
+// 下一次请求重新选择账号，用于会话被固定到已耗尽额度的账号等情况；响应中返回被清除的绑定与会话池
+func handleSessionBindingDelete(c *gin.Context) {
+	sessionID := c.Param("session_id")
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "session_id is required",
+		})
+		return
+	}
+
+	bindingManager := auth.GetSessionTokenBindingManager()
+	poolManager := auth.GetSessionTokenPoolManager()
+	binding := bindingManager.GetSessionStats(sessionID)
+	backupBinding := bindingManager.GetSessionStats(auth.SessionBackupBindingID(sessionID))
+	pool := poolManager.GetPoolStats(sessionID)
+
+	bindingCleared := bindingManager.UnbindSession(sessionID)
+	backupCleared := bindingManager.UnbindSession(auth.SessionBackupBindingID(sessionID))
+	poolCleared := poolManager.UnbindSession(sessionID)
+
+	resp := gin.H{
+		"session_id": sessionID,
+		"cleared":    bindingCleared || backupCleared || poolCleared,
+	}
+	if bindingCleared {
+		resp["binding"] = binding
+	}
+	if backupCleared {
+		resp["backup_binding"] = backupBinding
+	}
+	if poolCleared {
+		resp["pool"] = pool
+	}
+
+	logger.Info("已强制解绑会话",
+		logger.String("session_id", sessionID),
+		logger.Bool("binding_cleared", bindingCleared),
+		logger.Bool("backup_binding_cleared", backupCleared),
+		logger.Bool("pool_cleared", poolCleared))
+	c.JSON(http.StatusOK, resp)
+}
+
+// 会话池列表分页参数
+const (
+	sessionPoolDefaultLimit = 50
+	sessionPoolMaxLimit     = 500
+)
+
+// handleSessionPoolStatus 处理会话池状态查询：汇总统计 + 分页会话列表
+// 查询参数：offset（默认 0）、limit（默认 50，最大 500）
+func handleSessionPoolStatus(c *gin.Context) {
+	offset, err := parseNonNegativeQuery(c, "offset", 0)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit, err := parseNonNegativeQuery(c, "limit", sessionPoolDefaultLimit)
+	if err != nil || limit == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive integer"})
+		return
+	}
+	if limit > sessionPoolMaxLimit {
+		limit = sessionPoolMaxLimit
+	}
+
+	stats := auth.GetSessionTokenPoolManager().ListPoolStats(offset, limit)
+	stats["enabled"] = config.SessionPoolEnabled
+	c.JSON(http.StatusOK, stats)
+}
+
+// parseNonNegativeQuery 解析非负整数查询参数，缺省时返回默认值
+func parseNonNegativeQuery(c *gin.Context, name string, defaultValue int) (int, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.Atoi(raw)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return v, nil
+}
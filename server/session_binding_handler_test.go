@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"kiro2api/auth"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleSessionPoolStatus_Pagination(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/session-pool", handleSessionPoolStatus)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/session-pool?offset=0&limit=1000", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, float64(sessionPoolMaxLimit), resp["limit"], "limit 超过上限时截断")
+	assert.Contains(t, resp, "total_pools")
+	assert.Contains(t, resp, "total_backup_tokens")
+	assert.Contains(t, resp, "sessions_in_cooldown")
+
+	for _, query := range []string{"offset=-1", "limit=0", "limit=abc"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/session-pool?"+query, nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestHandleSessionBindingDelete(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/api/session-binding/:session_id", handleSessionBindingDelete)
+
+	sessionID := "delete-binding-session"
+	bindingManager := auth.GetSessionTokenBindingManager()
+	bindingManager.BindSessionToken(sessionID, "token_3", "claude-opus-4-6",
+		types.TokenInfo{AccessToken: "access", ExpiresAt: time.Now().Add(time.Hour)}, nil)
+	bindingManager.BindSessionToken(auth.SessionBackupBindingID(sessionID), "token_4", "claude-opus-4-6",
+		types.TokenInfo{AccessToken: "backup", ExpiresAt: time.Now().Add(time.Hour)}, nil)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/session-binding/"+sessionID, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, true, resp["cleared"])
+	assert.Equal(t, "token_3", resp["binding"].(map[string]any)["token_key"])
+	assert.Equal(t, "token_4", resp["backup_binding"].(map[string]any)["token_key"])
+	assert.NotContains(t, resp, "pool")
+
+	_, _, _, bound := bindingManager.GetSessionToken(sessionID)
+	assert.False(t, bound, "绑定应已清除")
+
+	// 再次删除：没有可清除的内容
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/session-binding/"+sessionID, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	resp = nil
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, false, resp["cleared"])
+	assert.NotContains(t, resp, "binding")
+}
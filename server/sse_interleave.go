@@ -0,0 +1,164 @@
+package server
+
+import (
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// thinking 与工具块交错（thinking→text→tool_use→thinking）时的索引处理
+//
+// 上游的 thinking、文本都在索引 0 上下发，工具块从索引 1 起编号；而 SSEStateManager
+// 会把 thinking 之后的文本另起新的text块。交错出现时上游索引会与这些新块冲突，
+// 这里统一改用新索引下发，并记录上游索引 -> 下发索引的映射，保证客户端看到的块索引单调且不重复。
+
+// blockStopped 指定下发索引的块是否已启动且已关闭
+func (ssm *SSEStateManager) blockStopped(index int) bool {
+	block, exists := ssm.activeBlocks[index]
+	return exists && block.Stopped
+}
+
+// remapIndex 记录上游索引改用的下发索引
+func (ssm *SSEStateManager) remapIndex(upstreamIndex, index int) {
+	if ssm.indexRemap == nil {
+		ssm.indexRemap = make(map[int]int)
+	}
+	ssm.indexRemap[upstreamIndex] = index
+}
+
+// clearIndexRemap 块关闭后移除仍指向它的上游索引映射
+func (ssm *SSEStateManager) clearIndexRemap(upstreamIndex, index int) {
+	if remapped, ok := ssm.indexRemap[upstreamIndex]; ok && remapped == index {
+		delete(ssm.indexRemap, upstreamIndex)
+	}
+}
+
+// thinkingOpenFor 上游索引上的thinking块是否已启动且未关闭
+func (ssm *SSEStateManager) thinkingOpenFor(upstreamIndex int) bool {
+	if !ssm.thinkingBlockStarted || !ssm.inThinking || upstreamIndex != ssm.thinkingUpstreamIndex {
+		return false
+	}
+	block, exists := ssm.activeBlocks[ssm.thinkingBlockIndex]
+	return exists && !block.Stopped
+}
+
+// resolveToolBlockIndex 返回工具块实际下发的索引；同一工具块重复启动时返回 true
+// 上游索引已被其他块占用时改用新索引，并记录映射供后续增量与 stop 改写
+func (ssm *SSEStateManager) resolveToolBlockIndex(index int, eventData map[string]any) (int, bool) {
+	blockType, toolUseID := "", ""
+	if contentBlock, ok := eventData["content_block"].(map[string]any); ok {
+		blockType, _ = contentBlock["type"].(string)
+		toolUseID, _ = contentBlock["id"].(string)
+	}
+
+	if remapped, ok := ssm.indexRemap[index]; ok {
+		if block, exists := ssm.activeBlocks[remapped]; exists && !block.Stopped && block.ToolUseID == toolUseID {
+			return remapped, true
+		}
+	}
+
+	block, used := ssm.activeBlocks[index]
+	if !used || (block.Type == blockType && block.ToolUseID == toolUseID) {
+		return index, false
+	}
+
+	remapped := ssm.nextBlockIndex
+	ssm.remapIndex(index, remapped)
+	eventData["index"] = remapped
+	logger.Debug("工具块的上游索引已被占用，改用新索引",
+		logger.Int("upstream_index", index),
+		logger.Int("block_index", remapped),
+		logger.String("occupied_by", block.Type))
+	return remapped, false
+}
+
+// startThinkingBlock 为上游索引启动新的thinking块
+// 上一段 thinking 后的text块或同一上游索引上的text块仍未关闭时先关闭；上游索引已被占用时改用新索引
+func (ssm *SSEStateManager) startThinkingBlock(c *gin.Context, sender StreamEventSender, upstreamIndex int) error {
+	if ssm.textBlockStartedAfterThinking {
+		if err := ssm.closeOpenBlock(c, sender, ssm.textBlockIndexAfterThinking); err != nil {
+			return err
+		}
+		ssm.textBlockStartedAfterThinking = false
+	}
+	if block, exists := ssm.activeBlocks[upstreamIndex]; exists && block.Type == "text" {
+		if err := ssm.closeOpenBlock(c, sender, upstreamIndex); err != nil {
+			return err
+		}
+	}
+
+	index := upstreamIndex
+	if _, used := ssm.activeBlocks[index]; used {
+		index = ssm.nextBlockIndex
+		ssm.remapIndex(upstreamIndex, index)
+	}
+	ssm.thinkingUpstreamIndex = upstreamIndex
+	ssm.thinkingBlockIndex = index
+	ssm.thinkingBlockStarted = true
+
+	thinkingStartEvent := map[string]any{
+		"type":  "content_block_start",
+		"index": index,
+		"content_block": map[string]any{
+			"type":     "thinking",
+			"thinking": "",
+		},
+	}
+	if err := ssm.handleContentBlockStart(c, sender, thinkingStartEvent); err != nil {
+		return err
+	}
+	logger.Debug("已启动thinking块",
+		logger.Int("index", index),
+		logger.Int("upstream_index", upstreamIndex))
+	return nil
+}
+
+// interruptThinkingForTool 工具块启动时结束当前 thinking 段
+// thinking 尚未闭合时下发缓冲的内容并关闭thinking块；保留 thinking 的上游索引，
+// 工具块之后同一上游索引上的文本另起新的text块，新的 <thinking> 标签另起新的thinking块
+func (ssm *SSEStateManager) interruptThinkingForTool(c *gin.Context, sender StreamEventSender, toolIndex int) error {
+	logger.Debug("工具块打断thinking段",
+		logger.Int("tool_block_index", toolIndex),
+		logger.Bool("was_in_thinking", ssm.inThinking),
+		logger.Bool("text_block_started", ssm.textBlockStartedAfterThinking))
+
+	if ssm.inThinking {
+		if ssm.thinkingBuffer != "" {
+			thinkingDeltaEvent := map[string]any{
+				"type":  "content_block_delta",
+				"index": ssm.thinkingBlockIndex,
+				"delta": map[string]any{
+					"type":     "thinking_delta",
+					"thinking": ssm.thinkingBuffer,
+				},
+			}
+			if err := sender.SendEvent(c, thinkingDeltaEvent); err != nil {
+				return err
+			}
+		}
+		if err := ssm.closeOpenBlock(c, sender, ssm.thinkingBlockIndex); err != nil {
+			return err
+		}
+		ssm.clearIndexRemap(ssm.thinkingUpstreamIndex, ssm.thinkingBlockIndex)
+		ssm.inThinking = false
+	}
+	ssm.thinkingBuffer = ""
+
+	// text块已关闭（默认在工具块前自动关闭）时，工具块之后的文本另起新块
+	if ssm.textBlockStartedAfterThinking && ssm.blockStopped(ssm.textBlockIndexAfterThinking) {
+		ssm.textBlockStartedAfterThinking = false
+	}
+	return nil
+}
+
+// closeOpenBlock 关闭指定下发索引上已启动且未关闭的块
+func (ssm *SSEStateManager) closeOpenBlock(c *gin.Context, sender StreamEventSender, index int) error {
+	block, exists := ssm.activeBlocks[index]
+	if !exists || !block.Started || block.Stopped {
+		return nil
+	}
+	return ssm.stopBlock(c, sender, map[string]any{
+		"type":  "content_block_stop",
+		"index": index,
+	}, index)
+}
@@ -3,8 +3,10 @@ package server
 import (
 	"errors"
 	"fmt"
+	"kiro2api/config"
 	"kiro2api/logger"
 	"kiro2api/parser"
+	"kiro2api/utils"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -34,20 +36,46 @@ type SSEStateManager struct {
 	nextBlockIndex   int
 	strictMode       bool
 
+	// autoCloseTextBeforeTool 工具块启动前自动关闭未关闭的文本块（SSE_AUTO_CLOSE_TEXT_BEFORE_TOOL）
+	autoCloseTextBeforeTool bool
+
 	// thinking状态跟踪
-	inThinking                     bool   // 是否正在thinking块内
-	thinkingBuffer                 string // 用于缓存和检测thinking标签
-	thinkingBlockIndex             int    // thinking块的索引
-	thinkingBlockStarted           bool   // thinking块是否已启动
-	textBlockStartedAfterThinking  bool   // thinking结束后text块是否已启动
-	textBlockIndexAfterThinking    int    // thinking结束后text块的索引
+	inThinking                    bool   // 是否正在thinking块内
+	thinkingBuffer                string // 用于缓存和检测thinking标签
+	thinkingBlockIndex            int    // thinking块的下发索引
+	thinkingUpstreamIndex         int    // thinking块对应的上游索引（改用新索引下发时与 thinkingBlockIndex 不同）
+	thinkingBlockStarted          bool   // thinking块是否已启动
+	textBlockStartedAfterThinking bool   // thinking结束后text块是否已启动
+	textBlockIndexAfterThinking   int    // thinking结束后text块的索引
+
+	// 上游索引 -> 实际下发索引：redacted_thinking 块、工具块或新一轮 thinking 块的上游索引
+	// 已被之前的块占用时改用新索引，同一上游索引上的后续增量与 stop 同步改写
+	indexRemap map[int]int
+}
+
+// ErrSSEProtocolViolation 严格模式下事件序列违反 Claude 流式协议
+var ErrSSEProtocolViolation = errors.New("SSE协议违规")
+
+// violation 严格模式下返回协议违规错误，并记录违规事件与当前状态
+func (ssm *SSEStateManager) violation(eventData map[string]any, errMsg string) error {
+	eventJSON, _ := utils.SafeMarshal(eventData)
+	logger.Error("SSE协议违规（严格模式）",
+		logger.String("violation", errMsg),
+		logger.String("event", string(eventJSON)),
+		logger.Bool("message_started", ssm.messageStarted),
+		logger.Bool("message_delta_sent", ssm.messageDeltaSent),
+		logger.Bool("message_ended", ssm.messageEnded),
+		logger.Int("next_block_index", ssm.nextBlockIndex),
+		logger.Int("active_blocks", len(ssm.activeBlocks)))
+	return fmt.Errorf("%w: %s", ErrSSEProtocolViolation, errMsg)
 }
 
 // NewSSEStateManager 创建SSE状态管理器
 func NewSSEStateManager(strictMode bool) *SSEStateManager {
 	return &SSEStateManager{
-		activeBlocks: make(map[int]*BlockState),
-		strictMode:   strictMode,
+		activeBlocks:            make(map[int]*BlockState),
+		strictMode:              strictMode,
+		autoCloseTextBeforeTool: config.SSEAutoCloseTextBeforeTool,
 	}
 }
 
@@ -63,9 +91,11 @@ func (ssm *SSEStateManager) Reset() {
 	ssm.inThinking = false
 	ssm.thinkingBuffer = ""
 	ssm.thinkingBlockIndex = 0
+	ssm.thinkingUpstreamIndex = 0
 	ssm.thinkingBlockStarted = false
 	ssm.textBlockStartedAfterThinking = false
 	ssm.textBlockIndexAfterThinking = 0
+	ssm.indexRemap = nil
 }
 
 // SendEvent 受控的事件发送，确保符合Claude规范
@@ -89,6 +119,8 @@ func (ssm *SSEStateManager) SendEvent(c *gin.Context, sender StreamEventSender,
 		return ssm.handleMessageDelta(c, sender, eventData)
 	case "message_stop":
 		return ssm.handleMessageStop(c, sender, eventData)
+	case "ping":
+		return ssm.handlePing(c, sender, eventData)
 	default:
 		// 其他事件直接转发
 		return sender.SendEvent(c, eventData)
@@ -101,7 +133,7 @@ func (ssm *SSEStateManager) handleMessageStart(c *gin.Context, sender StreamEven
 		errMsg := "违规：message_start只能出现一次"
 		logger.Error(errMsg)
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 		return nil // 非严格模式下跳过重复的message_start
 	}
@@ -110,13 +142,27 @@ func (ssm *SSEStateManager) handleMessageStart(c *gin.Context, sender StreamEven
 	return sender.SendEvent(c, eventData)
 }
 
+// handlePing 处理ping事件：只能出现在 message_start 之后、message_stop 之前
+func (ssm *SSEStateManager) handlePing(c *gin.Context, sender StreamEventSender, eventData map[string]any) error {
+	if !ssm.messageStarted || ssm.messageEnded {
+		errMsg := "违规：ping必须在message_start之后、message_stop之前"
+		logger.Debug(errMsg)
+		if ssm.strictMode {
+			return ssm.violation(eventData, errMsg)
+		}
+		return nil // 非严格模式下跳过
+	}
+
+	return sender.SendEvent(c, eventData)
+}
+
 // handleContentBlockStart 处理内容块开始事件
 func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender StreamEventSender, eventData map[string]any) error {
 	if !ssm.messageStarted {
 		errMsg := "违规：content_block_start必须在message_start之后"
 		logger.Error(errMsg)
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 	}
 
@@ -124,7 +170,7 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 		errMsg := "违规：message已结束，不能发送content_block_start"
 		logger.Error(errMsg)
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 		return nil
 	}
@@ -139,6 +185,31 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 		}
 	}
 
+	// 确定块类型
+	blockType := "text"
+	if contentBlock, ok := eventData["content_block"].(map[string]any); ok {
+		if cbType, ok := contentBlock["type"].(string); ok {
+			blockType = cbType
+		}
+	}
+
+	// 上游 thinking 块的 content_block_start 晚于 <thinking> 标签到达，thinking块已由标签启动
+	if blockType == "thinking" && ssm.thinkingOpenFor(index) {
+		logger.Debug("thinking块已由标签启动，跳过上游的content_block_start",
+			logger.Int("upstream_index", index),
+			logger.Int("thinking_block_index", ssm.thinkingBlockIndex))
+		return nil
+	}
+
+	// 工具块的上游索引已被之前的块占用（如 thinking 结束后另起的text块）时改用新索引
+	if blockType == "tool_use" || blockType == "server_tool_use" {
+		var duplicate bool
+		if index, duplicate = ssm.resolveToolBlockIndex(index, eventData); duplicate {
+			logger.Debug("跳过重复的工具块content_block_start事件", logger.Int("block_index", index))
+			return nil
+		}
+	}
+
 	// 检查是否重复启动同一块
 	if block, exists := ssm.activeBlocks[index]; exists && block.Started && !block.Stopped {
 		// *** 修复：宽松处理重复启动事件 ***
@@ -150,12 +221,21 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 		return nil // 跳过重复的start
 	}
 
-	// 确定块类型
-	blockType := "text"
-	if contentBlock, ok := eventData["content_block"].(map[string]any); ok {
-		if cbType, ok := contentBlock["type"].(string); ok {
-			blockType = cbType
+	// redacted_thinking 块原样下发：客户端按索引累积内容块，上游索引已被之前的块占用时改用新索引，
+	// 之后同一上游索引上的文本与 thinking 结束后的文本一样另起新的text块
+	if blockType == "redacted_thinking" {
+		upstreamIndex := index
+		if _, used := ssm.activeBlocks[index]; used {
+			index = ssm.nextBlockIndex
+			ssm.remapIndex(upstreamIndex, index)
+			eventData["index"] = index
 		}
+		ssm.inThinking = false
+		ssm.thinkingBuffer = ""
+		ssm.thinkingBlockStarted = true
+		ssm.thinkingBlockIndex = index
+		ssm.thinkingUpstreamIndex = upstreamIndex
+		ssm.textBlockStartedAfterThinking = false
 	}
 
 	// *** 关键修复：在启动新工具块前，自动关闭文本块 ***
@@ -168,10 +248,12 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 	// - index:0 stop (延迟关闭)
 	//
 	// 修复策略：当检测到新工具块启动时，自动关闭所有未关闭的文本块
-	if blockType == "tool_use" {
+	// （代理执行的 web_search 以 server_tool_use 块下发，同样处理）
+	// 关闭 SSE_AUTO_CLOSE_TEXT_BEFORE_TOOL 时保持上游原生的事件顺序，文本块由上游自行关闭
+	if blockType == "tool_use" || blockType == "server_tool_use" {
 		// 遍历所有活跃块，找到未关闭的文本块
 		for blockIndex, block := range ssm.activeBlocks {
-			if block.Type == "text" && block.Started && !block.Stopped {
+			if ssm.autoCloseTextBeforeTool && block.Type == "text" && block.Started && !block.Stopped {
 				// 自动发送content_block_stop来关闭文本块
 				stopEvent := map[string]any{
 					"type":  "content_block_stop",
@@ -193,26 +275,18 @@ func (ssm *SSEStateManager) handleContentBlockStart(c *gin.Context, sender Strea
 			}
 		}
 
-		// *** 新增修复：重置thinking状态，避免后续text_delta被错误重定向 ***
-		// 问题场景：thinking结束后启动tool_use块，但thinking状态未重置
-		// 导致后续text_delta被错误地重定向到thinking后的text块索引
+		// thinking→text→tool_use→thinking 交错：工具块打断 thinking 段时不重置 thinking 状态，
+		// 否则之后的 thinking/text 会复用已关闭块的索引，见 interruptThinkingForTool
 		if ssm.thinkingBlockStarted {
-			logger.Debug("工具块启动时重置thinking状态",
-				logger.Int("tool_block_index", index),
-				logger.Bool("was_in_thinking", ssm.inThinking),
-				logger.Bool("text_block_started", ssm.textBlockStartedAfterThinking))
-
-			ssm.thinkingBlockStarted = false
-			ssm.inThinking = false
-			ssm.thinkingBuffer = ""
-			ssm.textBlockStartedAfterThinking = false
-			ssm.textBlockIndexAfterThinking = 0
+			if err := ssm.interruptThinkingForTool(c, sender, index); err != nil {
+				return err
+			}
 		}
 	}
 
 	// 创建或更新块状态
 	toolUseID := ""
-	if blockType == "tool_use" {
+	if blockType == "tool_use" || blockType == "server_tool_use" {
 		if contentBlock, ok := eventData["content_block"].(map[string]any); ok {
 			if id, ok := contentBlock["id"].(string); ok {
 				toolUseID = id
@@ -250,7 +324,7 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 			errMsg := "content_block_delta缺少有效索引"
 			logger.Error(errMsg)
 			if ssm.strictMode {
-				return errors.New(errMsg)
+				return ssm.violation(eventData, errMsg)
 			}
 			return nil
 		}
@@ -270,6 +344,12 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 		}
 	}
 
+	// 非文本增量（thinking_delta、signature_delta、input_json_delta）按上游索引改写到实际下发的块
+	if remapped, ok := ssm.indexRemap[index]; ok && deltaType != "text_delta" {
+		index = remapped
+		eventData["index"] = index
+	}
+
 	// 将内容添加到thinking缓冲区进行检测
 	if deltaType == "text_delta" && deltaText != "" {
 		ssm.thinkingBuffer += deltaText
@@ -283,24 +363,11 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 			// 去掉<thinking>标签
 			ssm.thinkingBuffer = ssm.thinkingBuffer[len(thinkingStartTag):]
 
-			// 如果thinking块未启动，启动thinking块
-			if !ssm.thinkingBlockStarted {
-				ssm.thinkingBlockIndex = index
-				ssm.thinkingBlockStarted = true
-
-				// 发送thinking类型的content_block_start
-				thinkingStartEvent := map[string]any{
-					"type":  "content_block_start",
-					"index": index,
-					"content_block": map[string]any{
-						"type":     "thinking",
-						"thinking": "",
-					},
-				}
-				if err := ssm.handleContentBlockStart(c, sender, thinkingStartEvent); err != nil {
+			// 如果thinking块未启动（或上一段thinking已关闭），启动新的thinking块
+			if !ssm.thinkingBlockStarted || ssm.blockStopped(ssm.thinkingBlockIndex) {
+				if err := ssm.startThinkingBlock(c, sender, index); err != nil {
 					return err
 				}
-				logger.Debug("已启动thinking块", logger.Int("index", index))
 			}
 		}
 
@@ -336,9 +403,10 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 					"type":  "content_block_stop",
 					"index": ssm.thinkingBlockIndex,
 				}
-				if err := ssm.handleContentBlockStop(c, sender, thinkingStopEvent); err != nil {
+				if err := ssm.stopBlock(c, sender, thinkingStopEvent, ssm.thinkingBlockIndex); err != nil {
 					return err
 				}
+				ssm.clearIndexRemap(ssm.thinkingUpstreamIndex, ssm.thinkingBlockIndex)
 				logger.Debug("已关闭thinking块", logger.Int("index", ssm.thinkingBlockIndex))
 
 				// 重置thinking状态
@@ -394,19 +462,8 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 				ssm.thinkingBuffer = ssm.thinkingBuffer[safeLen:]
 
 				// 确保thinking块已启动
-				if !ssm.thinkingBlockStarted {
-					ssm.thinkingBlockIndex = index
-					ssm.thinkingBlockStarted = true
-
-					thinkingStartEvent := map[string]any{
-						"type":  "content_block_start",
-						"index": index,
-						"content_block": map[string]any{
-							"type":     "thinking",
-							"thinking": "",
-						},
-					}
-					if err := ssm.handleContentBlockStart(c, sender, thinkingStartEvent); err != nil {
+				if !ssm.thinkingBlockStarted || ssm.blockStopped(ssm.thinkingBlockIndex) {
+					if err := ssm.startThinkingBlock(c, sender, index); err != nil {
 						return err
 					}
 				}
@@ -442,7 +499,7 @@ func (ssm *SSEStateManager) handleContentBlockDelta(c *gin.Context, sender Strea
 
 		// thinking已结束，后续内容作为text处理
 		// *** 修复：只处理来自原始索引的text_delta，避免错误重定向其他索引的内容 ***
-		if ssm.thinkingBlockStarted && !ssm.inThinking && index == ssm.thinkingBlockIndex {
+		if ssm.thinkingBlockStarted && !ssm.inThinking && index == ssm.thinkingUpstreamIndex {
 			logger.Debug("thinking已结束，处理后续text内容",
 				logger.Bool("textBlockStartedAfterThinking", ssm.textBlockStartedAfterThinking),
 				logger.Int("textBlockIndexAfterThinking", ssm.textBlockIndexAfterThinking),
@@ -556,19 +613,43 @@ func (ssm *SSEStateManager) handleContentBlockStop(c *gin.Context, sender Stream
 			errMsg := "content_block_stop缺少有效索引"
 			logger.Error(errMsg)
 			if ssm.strictMode {
-				return errors.New(errMsg)
+				return ssm.violation(eventData, errMsg)
 			}
 			return nil
 		}
 	}
 
+	// redacted_thinking、工具块或 thinking 块已改用新索引下发，stop 同步改写
+	if remapped, ok := ssm.indexRemap[index]; ok {
+		delete(ssm.indexRemap, index)
+		index = remapped
+		eventData["index"] = index
+	} else if ssm.thinkingBlockStarted && !ssm.inThinking && index == ssm.thinkingUpstreamIndex && ssm.blockStopped(ssm.thinkingBlockIndex) {
+		// thinking块已由 </thinking> 标签关闭，上游随后的 content_block_stop 不再重复下发；
+		// 同一上游索引上已另起text块时改为关闭该text块
+		if !ssm.textBlockStartedAfterThinking || ssm.blockStopped(ssm.textBlockIndexAfterThinking) {
+			logger.Debug("thinking块已关闭，跳过上游的content_block_stop",
+				logger.Int("upstream_index", index),
+				logger.Int("thinking_block_index", ssm.thinkingBlockIndex))
+			return nil
+		}
+		index = ssm.textBlockIndexAfterThinking
+		eventData["index"] = index
+		ssm.textBlockStartedAfterThinking = false
+	}
+
+	return ssm.stopBlock(c, sender, eventData, index)
+}
+
+// stopBlock 校验并下发指定下发索引的 content_block_stop（不做上游索引改写，供内部关闭块使用）
+func (ssm *SSEStateManager) stopBlock(c *gin.Context, sender StreamEventSender, eventData map[string]any, index int) error {
 	// 验证块状态
 	block, exists := ssm.activeBlocks[index]
 	if !exists || !block.Started {
 		errMsg := fmt.Sprintf("违规：索引%d的content_block未启动就发送stop", index)
 		logger.Error(errMsg, logger.Int("block_index", index))
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 		return nil
 	}
@@ -577,7 +658,7 @@ func (ssm *SSEStateManager) handleContentBlockStop(c *gin.Context, sender Stream
 		errMsg := fmt.Sprintf("违规：索引%d的content_block重复停止", index)
 		logger.Error(errMsg, logger.Int("block_index", index))
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 		return nil
 	}
@@ -594,7 +675,7 @@ func (ssm *SSEStateManager) handleMessageDelta(c *gin.Context, sender StreamEven
 		errMsg := "违规：message_delta必须在message_start之后"
 		logger.Error(errMsg)
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 	}
 
@@ -607,7 +688,7 @@ func (ssm *SSEStateManager) handleMessageDelta(c *gin.Context, sender StreamEven
 			logger.Bool("message_delta_sent", ssm.messageDeltaSent),
 			logger.Bool("message_ended", ssm.messageEnded))
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 		logger.Debug("跳过重复的message_delta事件")
 		return nil // 非严格模式下跳过重复的message_delta
@@ -651,7 +732,7 @@ func (ssm *SSEStateManager) handleMessageStop(c *gin.Context, sender StreamEvent
 		errMsg := "违规：message_stop必须在message_start之后"
 		logger.Error(errMsg)
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 	}
 
@@ -659,7 +740,7 @@ func (ssm *SSEStateManager) handleMessageStop(c *gin.Context, sender StreamEvent
 		errMsg := "违规：message_stop只能出现一次"
 		logger.Error(errMsg)
 		if ssm.strictMode {
-			return errors.New(errMsg)
+			return ssm.violation(eventData, errMsg)
 		}
 		return nil
 	}
@@ -676,6 +757,11 @@ func (ssm *SSEStateManager) GetActiveBlocks() map[int]*BlockState {
 	return ssm.activeBlocks
 }
 
+// NextBlockIndex 下一个可用的块索引
+func (ssm *SSEStateManager) NextBlockIndex() int {
+	return ssm.nextBlockIndex
+}
+
 // IsMessageStarted 检查消息是否已开始
 func (ssm *SSEStateManager) IsMessageStarted() bool {
 	return ssm.messageStarted
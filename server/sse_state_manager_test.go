@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventSummary 将事件压缩为 "类型:索引" 便于断言顺序
+func eventSummary(events []map[string]any) []string {
+	var summary []string
+	for _, event := range events {
+		eventType, _ := event["type"].(string)
+		if index, ok := event["index"].(int); ok {
+			summary = append(summary, fmt.Sprintf("%s:%d", eventType, index))
+			continue
+		}
+		summary = append(summary, eventType)
+	}
+	return summary
+}
+
+func TestSSEStateManager_AutoCloseTextBeforeTool(t *testing.T) {
+	orig := config.SSEAutoCloseTextBeforeTool
+	t.Cleanup(func() { config.SSEAutoCloseTextBeforeTool = orig })
+
+	run := func(autoClose bool) []string {
+		config.SSEAutoCloseTextBeforeTool = autoClose
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		sender := &recordingStreamSender{}
+		ssm := NewSSEStateManager(false)
+
+		events := []map[string]any{
+			{"type": "message_start", "message": map[string]any{}},
+			{"type": "content_block_start", "index": 0, "content_block": map[string]any{"type": "text", "text": ""}},
+			{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "text_delta", "text": "hi"}},
+			{"type": "content_block_start", "index": 1, "content_block": map[string]any{"type": "tool_use", "id": "toolu_1", "name": "f", "input": map[string]any{}}},
+			{"type": "content_block_stop", "index": 0},
+			{"type": "content_block_stop", "index": 1},
+		}
+		for _, event := range events {
+			require.NoError(t, ssm.SendEvent(c, sender, event))
+		}
+		return eventSummary(sender.events)
+	}
+
+	assert.Equal(t, []string{
+		"message_start", "content_block_start:0", "content_block_delta:0",
+		"content_block_stop:0", "content_block_start:1", "content_block_stop:1",
+	}, run(true), "默认在工具块启动前关闭文本块")
+
+	assert.Equal(t, []string{
+		"message_start", "content_block_start:0", "content_block_delta:0",
+		"content_block_start:1", "content_block_stop:0", "content_block_stop:1",
+	}, run(false), "关闭后保持上游原生顺序")
+}
+
+// TestSSEStateManager_ThinkingTagsAcrossToolBoundary <thinking> 标签在工具块之后再次出现时另起新的thinking块
+func TestSSEStateManager_ThinkingTagsAcrossToolBoundary(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	sender := &recordingStreamSender{}
+	ssm := NewSSEStateManager(true)
+
+	text := func(s string) map[string]any {
+		return map[string]any{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "text_delta", "text": s}}
+	}
+	events := []map[string]any{
+		{"type": "message_start", "message": map[string]any{}},
+		text("<thinking>first</thinking>"),
+		text("answer"),
+		{"type": "content_block_start", "index": 1, "content_block": map[string]any{"type": "tool_use", "id": "toolu_1", "name": "f", "input": map[string]any{}}},
+		{"type": "content_block_stop", "index": 1},
+		text("<thinking>second"),
+		text(" part</thinking>"),
+		text("final"),
+		{"type": "content_block_stop", "index": 0},
+		{"type": "message_delta", "delta": map[string]any{"stop_reason": "end_turn"}},
+		{"type": "message_stop"},
+	}
+	for _, event := range events {
+		require.NoError(t, ssm.SendEvent(c, sender, event), "严格模式下不应出现协议违规")
+	}
+
+	assert.Equal(t, []string{
+		"message_start",
+		"content_block_start:0", "content_block_delta:0", "content_block_stop:0",
+		"content_block_start:1", "content_block_delta:1", "content_block_stop:1",
+		"content_block_start:2", "content_block_stop:2",
+		"content_block_start:3", "content_block_delta:3", "content_block_stop:3",
+		"content_block_start:4", "content_block_delta:4", "content_block_stop:4",
+		"message_delta", "message_stop",
+	}, eventSummary(sender.events), "上游索引0的 stop 应关闭 thinking 之后另起的text块")
+
+	var thinking strings.Builder
+	for _, event := range sender.events {
+		if event["index"] == 3 && event["type"] == "content_block_delta" {
+			thinking.WriteString(event["delta"].(map[string]any)["thinking"].(string))
+		}
+	}
+	assert.Equal(t, "second part", thinking.String())
+}
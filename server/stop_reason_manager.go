@@ -9,6 +9,8 @@ import (
 type StopReasonManager struct {
 	hasActiveToolCalls bool
 	hasCompletedTools  bool
+	stopSequence       string // 命中的停止序列
+	refused            bool   // 上游拒绝生成（护栏/内容过滤）
 }
 
 // NewStopReasonManager 创建stop_reason管理器
@@ -29,8 +31,27 @@ func (srm *StopReasonManager) UpdateToolCallStatus(hasActiveCalls, hasCompleted
 		logger.Bool("has_completed_tools", hasCompleted))
 }
 
+// SetStopSequence 记录命中的停止序列（为空表示未命中）
+func (srm *StopReasonManager) SetStopSequence(sequence string) {
+	srm.stopSequence = sequence
+}
+
+// SetRefusal 记录上游是否拒绝生成
+func (srm *StopReasonManager) SetRefusal(refused bool) {
+	srm.refused = refused
+}
+
 // DetermineStopReason 根据Claude官方规范确定stop_reason
 func (srm *StopReasonManager) DetermineStopReason() string {
+	// 上游护栏拦截：响应在拒绝处结束，已下发的工具调用不应再被执行
+	if srm.refused {
+		return "refusal"
+	}
+
+	// 命中停止序列时响应已被截断，后续内容（包括工具调用）不会下发
+	if srm.stopSequence != "" {
+		return "stop_sequence"
+	}
 
 	// 检查是否有工具调用（活跃或已完成）
 	// *** 关键修复：根据Claude规范，只要消息包含tool_use块，stop_reason就应该是tool_use ***
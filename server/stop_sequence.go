@@ -0,0 +1,99 @@
+package server
+
+import (
+	"strings"
+
+	"kiro2api/utils"
+)
+
+// stopSequenceMatcher 在流式文本上匹配 stop_sequences
+// CodeWhisperer 没有停止序列参数，因此由代理在客户端侧截断：
+// 可能构成停止序列前缀的尾部文本会被暂存，直到确认不匹配后再下发
+type stopSequenceMatcher struct {
+	sequences []string
+	pending   string // 暂存的尾部文本（可能是某个停止序列的前缀）
+	matched   string // 命中的停止序列
+}
+
+// newStopSequenceMatcher 创建匹配器，没有有效停止序列时返回 nil
+func newStopSequenceMatcher(sequences []string) *stopSequenceMatcher {
+	var valid []string
+	for _, seq := range sequences {
+		if seq != "" {
+			valid = append(valid, seq)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	return &stopSequenceMatcher{sequences: valid}
+}
+
+// Process 处理一段增量文本，返回可以安全下发的文本以及是否命中停止序列
+// 命中后返回停止序列之前的全部文本，后续输入应被丢弃
+func (m *stopSequenceMatcher) Process(text string) (string, bool) {
+	if m.matched != "" {
+		return "", true
+	}
+
+	buf := m.pending + text
+	m.pending = ""
+
+	// 命中位置最靠前的停止序列优先
+	matchIdx := -1
+	for _, seq := range m.sequences {
+		if idx := strings.Index(buf, seq); idx >= 0 && (matchIdx < 0 || idx < matchIdx) {
+			matchIdx = idx
+			m.matched = seq
+		}
+	}
+	if matchIdx >= 0 {
+		return buf[:matchIdx], true
+	}
+
+	holdFrom := len(buf) - m.longestPrefixSuffix(buf)
+	m.pending = buf[holdFrom:]
+	return buf[:holdFrom], false
+}
+
+// Flush 返回并清空暂存文本（文本块结束或流结束时调用）
+func (m *stopSequenceMatcher) Flush() string {
+	pending := m.pending
+	m.pending = ""
+	return pending
+}
+
+// Matched 返回命中的停止序列（未命中为空）
+func (m *stopSequenceMatcher) Matched() string {
+	return m.matched
+}
+
+// longestPrefixSuffix 返回 buf 的最长后缀长度，该后缀同时是某个停止序列的真前缀
+func (m *stopSequenceMatcher) longestPrefixSuffix(buf string) int {
+	longest := 0
+	for _, seq := range m.sequences {
+		maxLen := min(len(seq)-1, len(buf))
+		for l := maxLen; l > longest; l-- {
+			if strings.HasSuffix(buf, seq[:l]) {
+				longest = l
+				break
+			}
+		}
+	}
+	return longest
+}
+
+// truncateAtStopSequence 对完整文本应用停止序列（非流式响应）
+// 返回第一个停止序列之前的文本（不含停止序列本身）与命中的序列，未命中时原样返回
+func truncateAtStopSequence(text string, sequences []string) (string, string) {
+	matcher := newStopSequenceMatcher(sequences)
+	if matcher == nil {
+		return text, ""
+	}
+	emit, matched := matcher.Process(text)
+	if !matched {
+		return text, ""
+	}
+	// 按字节截断，确保不会落在多字节字符中间
+	return utils.TruncateUTF8(text, len(emit)), matcher.Matched()
+}
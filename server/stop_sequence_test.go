@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/parser"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStopSequenceMatcher_SplitAcrossDeltas(t *testing.T) {
+	m := newStopSequenceMatcher([]string{"\n\nHuman:", "END"})
+
+	emit, matched := m.Process("Hello wor")
+	assert.Equal(t, "Hello wor", emit)
+	assert.False(t, matched)
+
+	emit, matched = m.Process("ld\n\nHu")
+	assert.Equal(t, "ld", emit, "可能构成停止序列前缀的尾部应被暂存")
+	assert.False(t, matched)
+
+	emit, matched = m.Process("man: bye")
+	assert.Equal(t, "", emit)
+	assert.True(t, matched)
+	assert.Equal(t, "\n\nHuman:", m.Matched())
+}
+
+func TestStopSequenceMatcher_FlushOnMismatch(t *testing.T) {
+	m := newStopSequenceMatcher([]string{"STOP"})
+
+	emit, _ := m.Process("abc ST")
+	assert.Equal(t, "abc ", emit)
+	assert.Equal(t, "ST", m.Flush())
+	assert.Empty(t, m.Matched())
+}
+
+func TestStopSequenceMatcher_EarliestMatchWins(t *testing.T) {
+	m := newStopSequenceMatcher([]string{"world", "lo"})
+
+	emit, matched := m.Process("hello world")
+	assert.True(t, matched)
+	assert.Equal(t, "hel", emit)
+	assert.Equal(t, "lo", m.Matched())
+}
+
+func TestNewStopSequenceMatcher_EmptySequences(t *testing.T) {
+	assert.Nil(t, newStopSequenceMatcher(nil))
+	assert.Nil(t, newStopSequenceMatcher([]string{""}))
+}
+
+type recordingStreamSender struct {
+	events []map[string]any
+}
+
+func (s *recordingStreamSender) SendEvent(_ *gin.Context, data any) error {
+	if m, ok := data.(map[string]any); ok {
+		s.events = append(s.events, m)
+	}
+	return nil
+}
+
+func (s *recordingStreamSender) SendError(_ *gin.Context, _ string, _ error) error {
+	return nil
+}
+
+func textDeltaEvent(text string) parser.SSEEvent {
+	return parser.SSEEvent{
+		Event: "content_block_delta",
+		Data: map[string]any{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]any{"type": "text_delta", "text": text},
+		},
+	}
+}
+
+func TestEventStreamProcessor_TruncatesOnStopSequence(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	sender := &recordingStreamSender{}
+	req := types.AnthropicRequest{Model: "claude-sonnet-4", StopSequences: []string{"###"}}
+	ctx := NewStreamProcessorContext(c, req, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	processor := NewEventStreamProcessor(ctx)
+
+	for _, text := range []string{"Answer: 42", " #", "## ignored", " more"} {
+		require.NoError(t, processor.processEvent(textDeltaEvent(text)))
+	}
+	require.NoError(t, ctx.sendFinalEvents())
+
+	var text strings.Builder
+	var finalDelta map[string]any
+	for _, event := range sender.events {
+		switch event["type"] {
+		case "content_block_delta":
+			delta := event["delta"].(map[string]any)
+			text.WriteString(delta["text"].(string))
+		case "message_delta":
+			finalDelta = event["delta"].(map[string]any)
+		}
+	}
+
+	assert.Equal(t, "Answer: 42 ", text.String())
+	require.NotNil(t, finalDelta)
+	assert.Equal(t, "stop_sequence", finalDelta["stop_reason"])
+	assert.Equal(t, "###", finalDelta["stop_sequence"])
+}
+
+func TestEventStreamProcessor_PrependsAssistantPrefill(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	sender := &recordingStreamSender{}
+	req := types.AnthropicRequest{Model: "claude-sonnet-4", AssistantPrefill: `{"colors": [`}
+	ctx := NewStreamProcessorContext(c, req, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	processor := NewEventStreamProcessor(ctx)
+
+	for _, text := range []string{`"red", `, `"blue"]}`} {
+		require.NoError(t, processor.processEvent(textDeltaEvent(text)))
+	}
+
+	var deltas []string
+	for _, event := range sender.events {
+		if event["type"] == "content_block_delta" {
+			deltas = append(deltas, event["delta"].(map[string]any)["text"].(string))
+		}
+	}
+	assert.Equal(t, []string{`{"colors": ["red", `, `"blue"]}`}, deltas, "预填充只拼接到第一个文本增量")
+}
+
+func TestTruncateAtStopSequence(t *testing.T) {
+	text, matched := truncateAtStopSequence("你好，世界。END之后的内容", []string{"之后", "END"})
+	assert.Equal(t, "你好，世界。", text)
+	assert.Equal(t, "END", matched)
+
+	text, matched = truncateAtStopSequence("没有停止序列", []string{"STOP"})
+	assert.Equal(t, "没有停止序列", text)
+	assert.Empty(t, matched)
+
+	text, matched = truncateAtStopSequence("STOP", nil)
+	assert.Equal(t, "STOP", text)
+	assert.Empty(t, matched)
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 流式响应缓冲（STREAM_BUFFER_MODE）
+// 部分反向代理无法转发真正的流式响应，会缓冲整个 SSE 响应并在等待期间超时
+// 缓冲时 stream=true 的请求照常经过流处理流程，但 SSE 输出写入内存，流结束后聚合为一个非流式 JSON 响应
+
+const (
+	streamBufferModeHeader = "header"
+	streamBufferModeAlways = "always"
+
+	// StreamBufferHeader 客户端请求缓冲流式响应的请求头（STREAM_BUFFER_MODE=header 时生效）
+	StreamBufferHeader = "X-Kiro-Stream-Buffer"
+)
+
+// streamBufferRequested 当前流式请求是否需要缓冲为非流式响应
+func streamBufferRequested(c *gin.Context) bool {
+	switch strings.ToLower(strings.TrimSpace(config.StreamBufferMode)) {
+	case streamBufferModeAlways:
+		return true
+	case streamBufferModeHeader:
+		enabled, _ := strconv.ParseBool(strings.TrimSpace(c.GetHeader(StreamBufferHeader)))
+		return enabled
+	default:
+		return false
+	}
+}
+
+// streamBufferWriter 把响应写入内存的 gin.ResponseWriter，Flush 为空操作
+type streamBufferWriter struct {
+	gin.ResponseWriter
+	header  http.Header
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func newStreamBufferWriter(w gin.ResponseWriter) *streamBufferWriter {
+	return &streamBufferWriter{ResponseWriter: w, header: make(http.Header), status: http.StatusOK}
+}
+
+func (w *streamBufferWriter) Header() http.Header { return w.header }
+
+func (w *streamBufferWriter) WriteHeader(code int) {
+	if code > 0 && !w.written {
+		w.status = code
+	}
+}
+
+func (w *streamBufferWriter) WriteHeaderNow() { w.written = true }
+
+func (w *streamBufferWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.body.Write(b)
+}
+
+func (w *streamBufferWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *streamBufferWriter) Flush() {}
+
+func (w *streamBufferWriter) Status() int { return w.status }
+
+func (w *streamBufferWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *streamBufferWriter) Written() bool { return w.written }
+
+// sseOnlyHeaders 只适用于 SSE 的响应头，缓冲后的 JSON 响应不复制
+var sseOnlyHeaders = []string{"Content-Type", "Cache-Control", "Connection", "X-Accel-Buffering"}
+
+// serveBufferedStream 以缓冲方式执行流式处理 handle，结束后把 SSE 事件聚合为非流式响应写出
+// 开始流式输出之前写出的错误响应（如请求构建失败、限流）原样返回
+func serveBufferedStream(c *gin.Context, handle func()) {
+	original := c.Writer
+	buffer := newStreamBufferWriter(original)
+	c.Writer = buffer
+	handle()
+	c.Writer = original
+
+	// 客户端已断开：没有可写出的对象
+	if c.Request.Context().Err() != nil {
+		return
+	}
+
+	for name, values := range buffer.header {
+		if slices.Contains(sseOnlyHeaders, http.CanonicalHeaderKey(name)) {
+			continue
+		}
+		for _, value := range values {
+			c.Writer.Header().Add(name, value)
+		}
+	}
+
+	if !strings.HasPrefix(buffer.header.Get("Content-Type"), "text/event-stream") {
+		if contentType := buffer.header.Get("Content-Type"); contentType != "" {
+			c.Writer.Header().Set("Content-Type", contentType)
+		}
+		c.Writer.WriteHeader(buffer.status)
+		_, _ = c.Writer.Write(buffer.body.Bytes())
+		return
+	}
+
+	message, errEvent := aggregateStreamEvents(buffer.body.Bytes())
+	switch {
+	case errEvent != nil:
+		errObj, _ := errEvent["error"].(map[string]any)
+		errType := stringField(errObj, "type")
+		logger.Warn("缓冲的流式响应以错误结束", addReqFields(c, logger.String("error_type", errType))...)
+		c.JSON(statusForAnthropicErrorType(errType), errEvent)
+	case message == nil:
+		logger.Error("缓冲的流式响应缺少 message_start", addReqFields(c, logger.Int("bytes", buffer.body.Len()))...)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"type":  "error",
+			"error": gin.H{"type": "api_error", "message": "上游流式响应不完整"},
+		})
+	default:
+		logger.Debug("下发缓冲的流式响应",
+			addReqFields(c,
+				logger.String("direction", "downstream_send"),
+				logger.Int("buffered_bytes", buffer.body.Len()))...)
+		c.JSON(http.StatusOK, message)
+	}
+}
+
+// aggregateStreamEvents 把 Anthropic SSE 事件聚合为非流式消息
+// 返回聚合后的消息（没有 message_start 时为 nil）与流中的第一个 error 事件
+func aggregateStreamEvents(data []byte) (map[string]any, map[string]any) {
+	var message map[string]any
+	blocks := make(map[int]map[string]any)
+	partialJSON := make(map[int]*strings.Builder)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		payload, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // event 行、保活注释与空行
+		}
+		var event map[string]any
+		if err := json.Unmarshal([]byte(strings.TrimSpace(payload)), &event); err != nil {
+			continue
+		}
+
+		index := eventBlockIndex(event)
+		switch event["type"] {
+		case "error":
+			return message, event
+		case "message_start":
+			message, _ = event["message"].(map[string]any)
+		case "content_block_start":
+			if block, ok := event["content_block"].(map[string]any); ok {
+				blocks[index] = block
+			}
+		case "content_block_delta":
+			block, ok := blocks[index]
+			delta, _ := event["delta"].(map[string]any)
+			if !ok || delta == nil {
+				continue
+			}
+			switch delta["type"] {
+			case "text_delta":
+				block["text"] = stringField(block, "text") + stringField(delta, "text")
+			case "thinking_delta":
+				block["thinking"] = stringField(block, "thinking") + stringField(delta, "thinking")
+			case "signature_delta":
+				block["signature"] = delta["signature"]
+			case "citations_delta":
+				citations, _ := block["citations"].([]any)
+				block["citations"] = append(citations, delta["citation"])
+			case "input_json_delta":
+				if partialJSON[index] == nil {
+					partialJSON[index] = &strings.Builder{}
+				}
+				partialJSON[index].WriteString(stringField(delta, "partial_json"))
+			}
+		case "content_block_stop":
+			if partial, ok := partialJSON[index]; ok && blocks[index] != nil {
+				var input any
+				if err := json.Unmarshal([]byte(partial.String()), &input); err == nil {
+					blocks[index]["input"] = input
+				}
+				delete(partialJSON, index)
+			}
+		case "message_delta":
+			if message == nil {
+				continue
+			}
+			if delta, ok := event["delta"].(map[string]any); ok {
+				for key, value := range delta {
+					message[key] = value
+				}
+			}
+			if usage, ok := event["usage"].(map[string]any); ok {
+				merged, _ := message["usage"].(map[string]any)
+				if merged == nil {
+					merged = make(map[string]any)
+				}
+				for key, value := range usage {
+					merged[key] = value
+				}
+				message["usage"] = merged
+			}
+		}
+	}
+
+	if message == nil {
+		return nil, nil
+	}
+	indexes := make([]int, 0, len(blocks))
+	for index := range blocks {
+		indexes = append(indexes, index)
+	}
+	slices.Sort(indexes)
+	content := make([]any, 0, len(indexes))
+	for _, index := range indexes {
+		content = append(content, blocks[index])
+	}
+	message["content"] = content
+	return message, nil
+}
+
+// eventBlockIndex 读取事件的内容块索引（没有时为 -1）
+func eventBlockIndex(event map[string]any) int {
+	if index, ok := event["index"].(float64); ok {
+		return int(index)
+	}
+	return -1
+}
+
+// stringField 读取字符串字段，不存在或类型不符时返回空
+func stringField(m map[string]any, key string) string {
+	s, _ := m[key].(string)
+	return s
+}
+
+// statusForAnthropicErrorType Anthropic错误类型到HTTP状态码的映射（与 batchErrorTypeForStatus 相反）
+func statusForAnthropicErrorType(errType string) int {
+	switch errType {
+	case "invalid_request_error":
+		return http.StatusBadRequest
+	case "authentication_error":
+		return http.StatusUnauthorized
+	case "permission_error":
+		return http.StatusForbidden
+	case "not_found_error":
+		return http.StatusNotFound
+	case "rate_limit_error":
+		return http.StatusTooManyRequests
+	case "overloaded_error":
+		return 529
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveBufferedTestStream 以缓冲方式执行 handle，返回写出的响应
+func serveBufferedTestStream(t *testing.T, handle func(c *gin.Context)) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/messages", func(c *gin.Context) {
+		serveBufferedStream(c, func() { handle(c) })
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/messages", nil))
+	return w
+}
+
+func TestStreamBufferRequested(t *testing.T) {
+	orig := config.StreamBufferMode
+	t.Cleanup(func() { config.StreamBufferMode = orig })
+
+	tests := []struct {
+		mode   string
+		header string
+		want   bool
+	}{
+		{mode: "off", header: "true", want: false},
+		{mode: "header", header: "", want: false},
+		{mode: "header", header: "true", want: true},
+		{mode: "header", header: "0", want: false},
+		{mode: "Always", header: "", want: true},
+	}
+	for _, tt := range tests {
+		config.StreamBufferMode = tt.mode
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		if tt.header != "" {
+			c.Request.Header.Set(StreamBufferHeader, tt.header)
+		}
+		assert.Equal(t, tt.want, streamBufferRequested(c), "mode=%s header=%q", tt.mode, tt.header)
+	}
+}
+
+func TestServeBufferedStream_AggregatesEvents(t *testing.T) {
+	w := serveBufferedTestStream(t, func(c *gin.Context) {
+		require.NoError(t, initializeSSEResponse(c))
+		sender := &AnthropicStreamSender{}
+		events := []map[string]any{
+			{"type": "message_start", "message": map[string]any{
+				"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4-5",
+				"content": []any{}, "stop_reason": nil, "stop_sequence": nil,
+				"usage": map[string]any{"input_tokens": 12, "output_tokens": 0},
+			}},
+			{"type": "ping"},
+			{"type": "content_block_start", "index": 0, "content_block": map[string]any{"type": "text", "text": ""}},
+			{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "text_delta", "text": "Hello, "}},
+			{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "text_delta", "text": "world"}},
+			{"type": "content_block_stop", "index": 0},
+			{"type": "content_block_start", "index": 1, "content_block": map[string]any{
+				"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": map[string]any{},
+			}},
+			{"type": "content_block_delta", "index": 1, "delta": map[string]any{"type": "input_json_delta", "partial_json": `{"city":`}},
+			{"type": "content_block_delta", "index": 1, "delta": map[string]any{"type": "input_json_delta", "partial_json": `"Paris"}`}},
+			{"type": "content_block_stop", "index": 1},
+			{"type": "message_delta", "delta": map[string]any{"stop_reason": "tool_use", "stop_sequence": nil},
+				"usage": map[string]any{"output_tokens": 7}},
+			{"type": "message_stop"},
+		}
+		for i, event := range events {
+			require.NoError(t, sender.SendEvent(c, event))
+			if i == 1 {
+				writeSSEKeepalive(c)
+			}
+		}
+	})
+
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	assert.Empty(t, w.Header().Get("X-Accel-Buffering"))
+
+	var msg map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &msg))
+	assert.Equal(t, "msg_1", msg["id"])
+	assert.Equal(t, "tool_use", msg["stop_reason"])
+	usage := msg["usage"].(map[string]any)
+	assert.Equal(t, float64(12), usage["input_tokens"])
+	assert.Equal(t, float64(7), usage["output_tokens"])
+
+	content := msg["content"].([]any)
+	require.Len(t, content, 2)
+	assert.Equal(t, "Hello, world", content[0].(map[string]any)["text"])
+	tool := content[1].(map[string]any)
+	assert.Equal(t, "get_weather", tool["name"])
+	assert.Equal(t, map[string]any{"city": "Paris"}, tool["input"])
+}
+
+func TestServeBufferedStream_ErrorEvent(t *testing.T) {
+	w := serveBufferedTestStream(t, func(c *gin.Context) {
+		require.NoError(t, initializeSSEResponse(c))
+		sender := &AnthropicStreamSender{}
+		require.NoError(t, sender.SendEvent(c, map[string]any{"type": "message_start", "message": map[string]any{"id": "msg_1"}}))
+		require.NoError(t, sender.SendError(c, "上游繁忙", nil))
+	})
+
+	assert.Equal(t, 529, w.Code)
+	var resp map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "error", resp["type"])
+	assert.Equal(t, "overloaded_error", resp["error"].(map[string]any)["type"])
+}
+
+func TestServeBufferedStream_PassesThroughNonStreamResponse(t *testing.T) {
+	w := serveBufferedTestStream(t, func(c *gin.Context) {
+		c.Header("Retry-After", "30")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": gin.H{"message": "rate limited", "code": "rate_limited"}})
+	})
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Header().Get("Content-Type"), "application/json")
+	assert.Contains(t, w.Body.String(), "rate_limited")
+}
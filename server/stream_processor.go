@@ -1,12 +1,16 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"kiro2api/config"
 	"kiro2api/logger"
+	"kiro2api/metrics"
 	"kiro2api/parser"
 	"kiro2api/types"
 	"kiro2api/utils"
@@ -24,6 +28,7 @@ type StreamProcessorContext struct {
 	sender      StreamEventSender
 	messageID   string
 	inputTokens int
+	startTime   time.Time
 
 	// 状态管理器
 	sseStateManager   *SSEStateManager
@@ -39,6 +44,8 @@ type StreamProcessorContext struct {
 	totalReadBytes       int
 	totalProcessedEvents int
 	lastParseErr         error
+	cacheUsage           cacheUsage    // 上游报告的缓存 tokens（未报告时为 0）
+	upstreamUsage        upstreamUsage // 上游报告的输入/输出 tokens（未报告时为 0，使用估算值）
 
 	// 工具调用跟踪
 	toolUseIdByBlockIndex map[int]string
@@ -52,6 +59,26 @@ type StreamProcessorContext struct {
 	inThinking           bool // 是否正在 thinking 块内
 	thinkingPrefixSent   bool // 是否已发送 <thinking> 前缀
 	currentThinkingIndex int  // 当前 thinking 块的索引
+
+	// stop_sequences 客户端侧截断（nil 表示请求未设置停止序列）
+	stopMatcher        *stopSequenceMatcher
+	lastTextBlockIndex int // 最近一次文本增量所在的块索引（用于下发暂存文本）
+
+	// assistant prefill：尚未下发的预填充文本，拼接到第一个文本增量之前
+	pendingPrefill string
+
+	// web_search 拦截（nil 表示未启用 MCP 搜索）
+	webSearch *webSearchInterceptor
+
+	// 响应提交状态：committed 之后客户端已收到数据，上游失败时不能再换token重新开始
+	committed       bool
+	pendingInitial  []map[string]any // 延迟下发的初始事件，提交时连同SSE响应头一起写出
+	retryOnThrottle bool             // 未提交时遇到限流异常，交由调用方切换token重试
+	throttled       bool             // 未提交时收到限流异常，等待调用方重试
+	aborted         bool             // 已向客户端下发错误事件，流应立即结束
+	refused         bool             // 上游拒绝生成（护栏/内容过滤），stop_reason 为 refusal
+
+	clientDisconnected bool // 客户端已断开连接，已停止读取上游响应，不再下发任何事件
 }
 
 // NewStreamProcessorContext 创建流处理上下文
@@ -73,19 +100,24 @@ func NewStreamProcessorContext(
 		sender:                sender,
 		messageID:             messageID,
 		inputTokens:           inputTokens,
-		sseStateManager:       NewSSEStateManager(false),
+		startTime:             time.Now(),
+		sseStateManager:       NewSSEStateManager(config.SSEStrictMode),
 		stopReasonManager:     NewStopReasonManager(req),
 		tokenEstimator:        utils.NewTokenEstimator(),
 		compliantParser:       parser.NewCompliantEventStreamParser(),
 		toolUseIdByBlockIndex: make(map[int]string),
 		completedToolUseIds:   make(map[string]bool),
 		thinkingContext:       parser.NewThinkingStreamContext(thinkingEnabled),
+		stopMatcher:           newStopSequenceMatcher(req.StopSequences),
+		pendingPrefill:        req.AssistantPrefill,
 	}
 }
 
 // Cleanup 清理资源
 // 完整清理所有状态，防止内存泄漏
 func (ctx *StreamProcessorContext) Cleanup() {
+	metrics.ObserveStreamDuration(metricsModelLabel(ctx.req.Model), time.Since(ctx.startTime))
+
 	// 重置解析器状态
 	if ctx.compliantParser != nil {
 		ctx.compliantParser.Reset()
@@ -109,6 +141,7 @@ func (ctx *StreamProcessorContext) Cleanup() {
 	}
 
 	// 清理管理器引用，帮助GC
+	ctx.webSearch = nil
 	ctx.sseStateManager = nil
 	ctx.stopReasonManager = nil
 	ctx.tokenEstimator = nil
@@ -140,11 +173,12 @@ func initializeSSEResponse(c *gin.Context) error {
 // sendInitialEvents 发送初始事件
 func (ctx *StreamProcessorContext) sendInitialEvents(eventCreator func(string, int, string) []map[string]any) error {
 	// 直接使用上下文中的 inputTokens（已经通过 TokenEstimator 精确计算）
-	initialEvents := eventCreator(ctx.messageID, ctx.inputTokens, ctx.req.Model)
+	initialEvents := eventCreator(ctx.messageID, ctx.inputTokens, config.ResponseModel(ctx.req.Model))
 
 	// 注意：初始事件现在只包含 message_start 和 ping
 	// content_block_start 会在收到实际内容时由 sse_state_manager 自动生成
 	// 这避免了发送空内容块（如果上游只返回 tool_use 而没有文本）
+	ctx.committed = true
 	for _, event := range initialEvents {
 		// 使用状态管理器发送事件
 		if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
@@ -156,6 +190,111 @@ func (ctx *StreamProcessorContext) sendInitialEvents(eventCreator func(string, i
 	return nil
 }
 
+// deferInitialEvents 延迟初始事件：直到第一个需要下发的事件才写出SSE响应头与 message_start
+// 在此之前上游限流可以换token重试，客户端不会收到重复或重叠的内容块
+func (ctx *StreamProcessorContext) deferInitialEvents(eventCreator func(string, int, string) []map[string]any) {
+	ctx.pendingInitial = eventCreator(ctx.messageID, ctx.inputTokens, config.ResponseModel(ctx.req.Model))
+}
+
+// commit 提交响应：写出延迟的SSE响应头与初始事件，此后不能再重试
+func (ctx *StreamProcessorContext) commit() error {
+	if ctx.committed {
+		return nil
+	}
+	ctx.committed = true
+	if ctx.pendingInitial == nil {
+		return nil
+	}
+
+	initialEvents := ctx.pendingInitial
+	ctx.pendingInitial = nil
+	if err := initializeSSEResponse(ctx.c); err != nil {
+		return err
+	}
+	for _, event := range initialEvents {
+		if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
+			logger.Error("初始SSE事件发送失败", logger.Err(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// sendEvent 经状态管理器下发事件，首次下发前先提交响应
+// 严格模式下出现协议违规时改为下发 error 事件并结束流；已下发错误事件后不再下发任何事件
+func (ctx *StreamProcessorContext) sendEvent(event map[string]any) error {
+	if ctx.aborted {
+		return nil
+	}
+	if err := ctx.commit(); err != nil {
+		return err
+	}
+	err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event)
+	if errors.Is(err, ErrSSEProtocolViolation) {
+		ctx.abortOnProtocolViolation(err)
+	}
+	return err
+}
+
+// abortOnProtocolViolation 严格模式下向客户端下发 api_error 并结束流，避免客户端收到不完整的事件序列
+func (ctx *StreamProcessorContext) abortOnProtocolViolation(violation error) {
+	ctx.aborted = true
+	logger.Error("流式响应违反SSE协议，结束流",
+		addReqFields(ctx.c,
+			logger.Err(violation),
+			logger.Int("total_processed_events", ctx.totalProcessedEvents),
+			logger.Int("total_read_bytes", ctx.totalReadBytes))...)
+
+	errorEvent := map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    "api_error",
+			"message": fmt.Sprintf("上游响应违反流式协议: %v", violation),
+		},
+	}
+	if err := ctx.sender.SendEvent(ctx.c, errorEvent); err != nil {
+		logger.Error("发送协议违规错误失败", logger.Err(err))
+	}
+}
+
+// resetForRetry 未提交时换token重试前重置上游解析相关状态（延迟的初始事件保留）
+func (ctx *StreamProcessorContext) resetForRetry() {
+	thinkingEnabled := ctx.req.Thinking != nil && ctx.req.Thinking.Type == "enabled"
+
+	ctx.compliantParser = parser.NewCompliantEventStreamParser()
+	ctx.stopReasonManager = NewStopReasonManager(ctx.req)
+	ctx.toolUseIdByBlockIndex = make(map[int]string)
+	ctx.completedToolUseIds = make(map[string]bool)
+	ctx.thinkingContext = parser.NewThinkingStreamContext(thinkingEnabled)
+	ctx.stopMatcher = newStopSequenceMatcher(ctx.req.StopSequences)
+	ctx.pendingPrefill = ctx.req.AssistantPrefill
+	ctx.inThinking = false
+	ctx.thinkingPrefixSent = false
+	ctx.totalOutputChars = 0
+	ctx.totalOutputTokens = 0
+	ctx.cacheUsage = cacheUsage{}
+	ctx.upstreamUsage = upstreamUsage{}
+	ctx.throttled = false
+	ctx.refused = false
+	if ctx.webSearch != nil {
+		ctx.webSearch = newWebSearchInterceptor(ctx.req, ctx.webSearch.tokenInfo)
+	}
+}
+
+// resetForFollowUp web_search 续写请求前重置上游解析相关状态（已下发的内容与输出统计保留）
+func (ctx *StreamProcessorContext) resetForFollowUp() {
+	thinkingEnabled := ctx.req.Thinking != nil && ctx.req.Thinking.Type == "enabled"
+
+	ctx.compliantParser = parser.NewCompliantEventStreamParser()
+	ctx.toolUseIdByBlockIndex = make(map[int]string)
+	ctx.completedToolUseIds = make(map[string]bool)
+	ctx.thinkingContext = parser.NewThinkingStreamContext(thinkingEnabled)
+	ctx.pendingPrefill = ""
+	ctx.inThinking = false
+	ctx.thinkingPrefixSent = false
+	ctx.retryOnThrottle = false
+}
+
 // processToolUseStart 处理工具使用开始事件
 func (ctx *StreamProcessorContext) processToolUseStart(dataMap map[string]any) {
 	cb, ok := dataMap["content_block"].(map[string]any)
@@ -210,11 +349,56 @@ func (ctx *StreamProcessorContext) processToolUseStop(dataMap map[string]any) {
 	}
 }
 
+// sendPing 下发 ping 保活事件（由状态管理器保证只出现在 message_start 与 message_stop 之间）
+// 延迟提交的响应会随之提交：此后上游限流不再换token重试
+func (ctx *StreamProcessorContext) sendPing() {
+	if err := ctx.sendEvent(map[string]any{"type": "ping"}); err != nil {
+		logger.Debug("发送ping保活失败", logger.Err(err))
+		return
+	}
+	ctx.c.Writer.Flush()
+}
+
 // 直传模式：不再进行文本聚合
 
-// sendFinalEvents 发送结束事件
-func (ctx *StreamProcessorContext) sendFinalEvents() error {
-	// 关闭所有未关闭的content_block
+// stopSequenceMatched 返回命中的停止序列（未命中为空）
+func (ctx *StreamProcessorContext) stopSequenceMatched() string {
+	if ctx.stopMatcher == nil {
+		return ""
+	}
+	return ctx.stopMatcher.Matched()
+}
+
+// flushStopSequencePending 下发停止序列匹配暂存的文本（文本块结束或流结束时调用）
+func (ctx *StreamProcessorContext) flushStopSequencePending(index int) {
+	if ctx.stopMatcher == nil || index != ctx.lastTextBlockIndex {
+		return
+	}
+	pending := ctx.stopMatcher.Flush()
+	if pending == "" {
+		return
+	}
+
+	event := map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]any{
+			"type": "text_delta",
+			"text": pending,
+		},
+	}
+	if err := ctx.sendEvent(event); err != nil {
+		logger.Error("下发暂存文本失败", logger.Err(err), logger.Int("index", index))
+		return
+	}
+	ctx.totalOutputTokens += utils.CountTokensWithTiktoken(pending, "cl100k_base")
+}
+
+// closeOpenBlocks 下发暂存文本并关闭所有未关闭的content_block
+func (ctx *StreamProcessorContext) closeOpenBlocks() {
+	// 流结束时仍有暂存文本（未收到对应的 content_block_stop），先下发
+	ctx.flushStopSequencePending(ctx.lastTextBlockIndex)
+
 	activeBlocks := ctx.sseStateManager.GetActiveBlocks()
 	for index, block := range activeBlocks {
 		if block.Started && !block.Stopped {
@@ -222,12 +406,17 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 				"type":  "content_block_stop",
 				"index": index,
 			}
-			logger.Debug("最终事件前关闭未关闭的content_block", logger.Int("index", index))
-			if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, stopEvent); err != nil {
+			logger.Debug("关闭未关闭的content_block", logger.Int("index", index))
+			if err := ctx.sendEvent(stopEvent); err != nil {
 				logger.Error("关闭content_block失败", logger.Err(err), logger.Int("index", index))
 			}
 		}
 	}
+}
+
+// sendFinalEvents 发送结束事件
+func (ctx *StreamProcessorContext) sendFinalEvents() error {
+	ctx.closeOpenBlocks()
 
 	// 更新工具调用状态
 	// 使用已完成工具集合来判断，因为toolUseIdByBlockIndex在stop时已被清空
@@ -241,12 +430,17 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 	// 	logger.Int("completed_count", len(ctx.completedToolUseIds)))
 
 	ctx.stopReasonManager.UpdateToolCallStatus(hasActiveTools, hasCompletedTools)
+	ctx.stopReasonManager.SetStopSequence(ctx.stopSequenceMatched())
+	ctx.stopReasonManager.SetRefusal(ctx.refused)
 
 	// 计算输出tokens：
 	// 1) 优先使用上游 message_delta.usage.output_tokens（如果有）
 	// 2) 否则基于流式 delta 累计的 totalOutputTokens
 	// 3) 最后才回退到历史的“按输出负载字节数估算”
-	outputTokens := ctx.totalOutputTokens
+	outputTokens := ctx.upstreamUsage.outputTokens
+	if outputTokens <= 0 {
+		outputTokens = ctx.totalOutputTokens
+	}
 	if outputTokens <= 0 {
 		baseTokens := ctx.totalOutputChars / config.TokenEstimationRatio
 		outputTokens = baseTokens
@@ -259,18 +453,28 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 		}
 	}
 
+	// 输入tokens同样以上游报告为准，未报告时使用请求时的估算值
+	inputTokens := ctx.inputTokens
+	if ctx.upstreamUsage.inputTokens > 0 {
+		inputTokens = ctx.upstreamUsage.inputTokens
+	}
+
 	// 确定stop_reason
 	stopReason := ctx.stopReasonManager.DetermineStopReason()
 
 	logger.Debug("创建结束事件",
 		logger.String("stop_reason", stopReason),
 		logger.String("stop_reason_description", GetStopReasonDescription(stopReason)),
-		logger.Int("output_tokens", outputTokens))
+		logger.Int("input_tokens", inputTokens),
+		logger.Int("output_tokens", outputTokens),
+		logger.Bool("upstream_usage", ctx.upstreamUsage.outputTokens > 0))
 
 	// 创建并发送结束事件
-	finalEvents := createAnthropicFinalEvents(outputTokens, ctx.inputTokens, stopReason)
+	recordAccessUsage(ctx.c, inputTokens, outputTokens)
+	finalEvents := createAnthropicFinalEvents(outputTokens, inputTokens, ctx.cacheUsage, stopReason, ctx.stopSequenceMatched())
+	ctx.webSearch.annotateUsage(finalEvents)
 	for _, event := range finalEvents {
-		if err := ctx.sseStateManager.SendEvent(ctx.c, ctx.sender, event); err != nil {
+		if err := ctx.sendEvent(event); err != nil {
 			logger.Error("结束事件发送违规", logger.Err(err))
 		}
 	}
@@ -280,6 +484,38 @@ func (ctx *StreamProcessorContext) sendFinalEvents() error {
 
 // 辅助函数
 
+// cacheUsage 缓存相关的输入tokens（对应 Anthropic usage 的 cache_*_input_tokens 字段）
+type cacheUsage struct {
+	creationInputTokens int
+	readInputTokens     int
+}
+
+// record 记录上游 usage 中报告的缓存 tokens（字段缺失时保持原值）
+func (u *cacheUsage) record(usage map[string]any) {
+	if v, ok := extractIntAny(usage["cache_creation_input_tokens"]); ok && v >= 0 {
+		u.creationInputTokens = v
+	}
+	if v, ok := extractIntAny(usage["cache_read_input_tokens"]); ok && v >= 0 {
+		u.readInputTokens = v
+	}
+}
+
+// upstreamUsage 上游报告的输入/输出 tokens，报告后以上游为准，不再使用估算值
+type upstreamUsage struct {
+	inputTokens  int
+	outputTokens int
+}
+
+// record 记录上游 usage 中报告的 tokens（字段缺失或为 0 时保持原值，视为未报告）
+func (u *upstreamUsage) record(usage map[string]any) {
+	if v, ok := extractIntAny(usage["input_tokens"]); ok && v > 0 {
+		u.inputTokens = v
+	}
+	if v, ok := extractIntAny(usage["output_tokens"]); ok && v > 0 {
+		u.outputTokens = v
+	}
+}
+
 // extractIndex 从数据映射中提取索引
 func extractIndex(dataMap map[string]any) int {
 	if v, ok := dataMap["index"].(int); ok {
@@ -329,6 +565,12 @@ func NewEventStreamProcessor(ctx *StreamProcessorContext) *EventStreamProcessor
 
 // ProcessEventStream 处理事件流的主循环
 func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
+	// 上游静默期间定时下发 ping 保活；客户端断开时立即停止读取，由调用方关闭上游连接
+	requestCtx := context.Background()
+	if esp.ctx.c.Request != nil {
+		requestCtx = esp.ctx.c.Request.Context()
+	}
+	reader = newContextKeepaliveReader(requestCtx, reader, config.SSEPingInterval, esp.ctx.sendPing)
 	buf := make([]byte, 1024)
 
 	for {
@@ -357,10 +599,32 @@ func (esp *EventStreamProcessor) ProcessEventStream(reader io.Reader) error {
 					return err
 				}
 			}
+
+			// 限流待重试、已下发错误事件或上游拒绝生成：不再读取上游剩余内容
+			if esp.ctx.throttled || esp.ctx.aborted || esp.ctx.refused {
+				break
+			}
+
+			// 命中停止序列后不再读取上游剩余内容
+			if matched := esp.ctx.stopSequenceMatched(); matched != "" {
+				logger.Debug("命中停止序列，提前结束响应流",
+					addReqFields(esp.ctx.c,
+						logger.String("stop_sequence", matched),
+						logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
+					)...)
+				break
+			}
 		}
 
 		if err != nil {
-			if err == io.EOF {
+			if requestCtx.Err() != nil {
+				// 客户端主动断开不是token的问题：不记录失败，上游请求成功时已标记成功
+				esp.ctx.clientDisconnected = true
+				logger.Info("客户端已断开连接，停止读取上游响应",
+					addReqFields(esp.ctx.c,
+						logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
+					)...)
+			} else if err == io.EOF {
 				logger.Debug("响应流结束",
 					addReqFields(esp.ctx.c,
 						logger.Int("total_read_bytes", esp.ctx.totalReadBytes),
@@ -391,6 +655,16 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 
 	eventType, _ := dataMap["type"].(string)
 
+	// 已命中停止序列、限流待重试、已下发错误事件或上游拒绝生成：丢弃同一批次中剩余的上游事件
+	if esp.ctx.stopSequenceMatched() != "" || esp.ctx.throttled || esp.ctx.aborted || esp.ctx.refused {
+		return nil
+	}
+
+	// web_search 调用由代理执行，不转发给客户端
+	if esp.ctx.webSearch != nil && esp.ctx.webSearch.intercept(esp.ctx, dataMap) {
+		return nil
+	}
+
 	// 处理不同类型的事件
 	switch eventType {
 	case "content_block_start":
@@ -401,21 +675,36 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 	case "content_block_delta":
 		// 处理 thinking_delta - 确保在内容前发送 <thinking> 前缀
 		esp.handleThinkingDelta(dataMap)
+		// assistant prefill 作为回复开头，拼接到第一个文本增量
+		esp.applyAssistantPrefill(dataMap)
+		// 停止序列截断：文本被暂存时不转发该事件
+		if esp.applyStopSequences(dataMap) {
+			return nil
+		}
 
 	case "content_block_stop":
+		esp.ctx.flushStopSequencePending(extractIndex(dataMap))
 		esp.ctx.processToolUseStop(dataMap)
 		// 处理 thinking 块结束 - 发送 </thinking> 后缀
 		esp.handleThinkingBlockStop(dataMap)
 
+	case "message_start":
+		// 上游 message_start 可能携带更准确的 input_tokens，记录后在最终 message_delta 中修正
+		if message, ok := dataMap["message"].(map[string]any); ok {
+			if usage, ok := message["usage"].(map[string]any); ok {
+				esp.ctx.upstreamUsage.record(usage)
+				esp.ctx.cacheUsage.record(usage)
+			}
+		}
+
 	case "message_delta":
-		// 如果上游携带了usage.output_tokens，优先记录下来作为最终输出
+		// 如果上游携带了usage，记录下来作为最终输出（output_tokens/input_tokens 以上游为准）
 		if usage, ok := dataMap["usage"].(map[string]any); ok {
-			if v, exists := usage["output_tokens"]; exists {
-				if out, ok2 := extractIntAny(v); ok2 && out > 0 {
-					esp.ctx.totalOutputTokens = out
-				}
-			}
+			esp.ctx.upstreamUsage.record(usage)
+			esp.ctx.cacheUsage.record(usage)
 		}
+		// usage 已记录，由 sendFinalEvents 统一下发唯一的 message_delta（message_delta 只能出现一次）
+		return nil
 
 	case "exception":
 		// 处理上游异常事件，检查是否需要映射为max_tokens
@@ -425,7 +714,7 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 	}
 
 	// 使用状态管理器发送事件（直传）
-	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, dataMap); err != nil {
+	if err := esp.ctx.sendEvent(dataMap); err != nil {
 		logger.Error("SSE事件发送违规", logger.Err(err))
 		// 非严格模式下，违规事件被跳过但不中断流
 	}
@@ -465,8 +754,44 @@ func (esp *EventStreamProcessor) processEvent(event parser.SSEEvent) error {
 	return nil
 }
 
+// applyAssistantPrefill 将尚未下发的 assistant prefill 拼接到文本增量之前（仅一次）
+func (esp *EventStreamProcessor) applyAssistantPrefill(dataMap map[string]any) {
+	if esp.ctx.pendingPrefill == "" {
+		return
+	}
+	delta, ok := dataMap["delta"].(map[string]any)
+	if !ok || delta["type"] != "text_delta" {
+		return
+	}
+	text, _ := delta["text"].(string)
+	delta["text"] = esp.ctx.pendingPrefill + text
+	esp.ctx.pendingPrefill = ""
+}
+
+// applyStopSequences 对 text_delta 应用停止序列截断
+// 返回 true 表示本次增量被全部暂存，不需要转发
+func (esp *EventStreamProcessor) applyStopSequences(dataMap map[string]any) bool {
+	matcher := esp.ctx.stopMatcher
+	if matcher == nil {
+		return false
+	}
+	delta, ok := dataMap["delta"].(map[string]any)
+	if !ok || delta["type"] != "text_delta" {
+		return false
+	}
+	text, _ := delta["text"].(string)
+	esp.ctx.lastTextBlockIndex = extractIndex(dataMap)
+
+	emit, _ := matcher.Process(text)
+	if emit == "" {
+		return true
+	}
+	delta["text"] = emit
+	return false
+}
+
 // handleThinkingBlockStart 处理 thinking 块开始事件
-// 当检测到 content_block_start 事件中的 blockType == "thinking" 时，发送 <thinking>\n 前缀
+// 当检测到 content_block_start 事件中的 blockType == "thinking" 时，发送 <thinking> 前缀
 func (esp *EventStreamProcessor) handleThinkingBlockStart(dataMap map[string]any) {
 	cb, ok := dataMap["content_block"].(map[string]any)
 	if !ok {
@@ -531,7 +856,7 @@ func (esp *EventStreamProcessor) handleThinkingDelta(dataMap map[string]any) {
 }
 
 // handleThinkingBlockStop 处理 thinking 块结束事件
-// 当 thinking 块结束时，发送 </thinking>\n\n 后缀
+// 当 thinking 块结束时，发送 </thinking> 后缀
 func (esp *EventStreamProcessor) handleThinkingBlockStop(dataMap map[string]any) {
 	blockIndex := extractIndex(dataMap)
 
@@ -547,19 +872,21 @@ func (esp *EventStreamProcessor) handleThinkingBlockStop(dataMap map[string]any)
 }
 
 // sendThinkingPrefix 发送 <thinking> 前缀
+// 标签只作为 SSEStateManager 的 thinking 块边界标记，不携带换行，
+// 否则换行会作为额外的 thinking_delta 追加到上游内容（及其签名）之后
 func (esp *EventStreamProcessor) sendThinkingPrefix() {
 	prefixEvent := map[string]any{
 		"type":  "content_block_delta",
 		"index": 0,
 		"delta": map[string]any{
 			"type": "text_delta",
-			"text": "<thinking>\n",
+			"text": thinkingStartTag,
 		},
 	}
 
 	logger.Debug("发送 thinking 前缀 <thinking>")
 
-	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, prefixEvent); err != nil {
+	if err := esp.ctx.sendEvent(prefixEvent); err != nil {
 		logger.Error("发送 thinking 前缀失败", logger.Err(err))
 	}
 	esp.ctx.c.Writer.Flush()
@@ -572,13 +899,13 @@ func (esp *EventStreamProcessor) sendThinkingSuffix() {
 		"index": 0,
 		"delta": map[string]any{
 			"type": "text_delta",
-			"text": "\n</thinking>\n\n",
+			"text": thinkingEndTag,
 		},
 	}
 
 	logger.Debug("发送 thinking 后缀 </thinking>")
 
-	if err := esp.ctx.sseStateManager.SendEvent(esp.ctx.c, esp.ctx.sender, suffixEvent); err != nil {
+	if err := esp.ctx.sendEvent(suffixEvent); err != nil {
 		logger.Error("发送 thinking 后缀失败", logger.Err(err))
 	}
 	esp.ctx.c.Writer.Flush()
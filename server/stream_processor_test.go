@@ -0,0 +1,481 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kiro2api/parser"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func throttlingExceptionEvent() parser.SSEEvent {
+	return parser.SSEEvent{
+		Event: "exception",
+		Data: map[string]any{
+			"type":           "exception",
+			"exception_type": "ThrottlingException",
+		},
+	}
+}
+
+func newDeferredStreamContext(t *testing.T) (*StreamProcessorContext, *recordingStreamSender, *httptest.ResponseRecorder) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	sender := &recordingStreamSender{}
+	req := types.AnthropicRequest{Model: "claude-sonnet-4"}
+	ctx := NewStreamProcessorContext(c, req, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	ctx.deferInitialEvents(createAnthropicStreamEvents)
+	ctx.retryOnThrottle = true
+	return ctx, sender, w
+}
+
+// TestStreamProcessor_ThrottleBeforeCommitIsRetryable 未下发任何内容时的限流交由调用方重试，客户端无任何输出
+func TestStreamProcessor_ThrottleBeforeCommitIsRetryable(t *testing.T) {
+	ctx, sender, w := newDeferredStreamContext(t)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(throttlingExceptionEvent()))
+
+	assert.True(t, ctx.throttled)
+	assert.False(t, ctx.committed)
+	assert.Empty(t, sender.events)
+	assert.Empty(t, w.Header().Get("Content-Type"), "重试前不应写出SSE响应头")
+
+	// 重试后的上游内容正常下发，message_start 只发送一次
+	ctx.resetForRetry()
+	require.NoError(t, processor.processEvent(textDeltaEvent("hello")))
+	require.NoError(t, ctx.sendFinalEvents())
+
+	messageStarts := 0
+	for _, event := range sender.events {
+		if event["type"] == "message_start" {
+			messageStarts++
+		}
+	}
+	assert.Equal(t, 1, messageStarts)
+	assert.Equal(t, "message_start", sender.events[0]["type"])
+	assert.True(t, ctx.committed)
+}
+
+// TestStreamProcessor_ThrottleAfterCommitSendsError 已下发内容后的限流以错误事件结束流，不再重新开始
+func TestStreamProcessor_ThrottleAfterCommitSendsError(t *testing.T) {
+	ctx, sender, _ := newDeferredStreamContext(t)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(textDeltaEvent("partial")))
+	require.NoError(t, processor.processEvent(throttlingExceptionEvent()))
+
+	assert.False(t, ctx.throttled)
+	assert.True(t, ctx.aborted)
+	last := sender.events[len(sender.events)-1]
+	assert.Equal(t, "error", last["type"])
+
+	// 错误之后的上游事件被丢弃
+	count := len(sender.events)
+	require.NoError(t, processor.processEvent(textDeltaEvent("ignored")))
+	assert.Len(t, sender.events, count)
+}
+
+// TestStreamProcessor_GuardrailExceptionMapsToRefusal 护栏异常不转发给客户端，stop_reason 为 refusal
+func TestStreamProcessor_GuardrailExceptionMapsToRefusal(t *testing.T) {
+	ctx, sender, _ := newDeferredStreamContext(t)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(textDeltaEvent("I can")))
+	require.NoError(t, processor.processEvent(parser.SSEEvent{
+		Event: "exception",
+		Data: map[string]any{
+			"type":              "exception",
+			"exception_type":    "GuardrailInterventionException",
+			"exception_message": "blocked by guardrail",
+		},
+	}))
+	// 拒绝之后的上游内容被丢弃
+	require.NoError(t, processor.processEvent(textDeltaEvent("not help")))
+	require.NoError(t, ctx.sendFinalEvents())
+
+	var stopReason any
+	for _, event := range sender.events {
+		assert.NotEqual(t, "exception", event["type"])
+		if delta, ok := event["delta"].(map[string]any); ok {
+			assert.NotEqual(t, "not help", delta["text"])
+			if event["type"] == "message_delta" {
+				stopReason = delta["stop_reason"]
+			}
+		}
+	}
+	assert.Equal(t, "refusal", stopReason)
+}
+
+func TestIsRefusalException(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]any
+		want bool
+	}{
+		{"护栏异常", map[string]any{"type": "exception", "exception_type": "GuardrailInterventionException"}, true},
+		{"内容过滤reason", map[string]any{"type": "exception", "exception_type": "ValidationException", "raw_data": map[string]any{"reason": "CONTENT_FILTERED"}}, true},
+		{"限流异常", map[string]any{"type": "exception", "exception_type": "ThrottlingException"}, false},
+		{"非异常事件", map[string]any{"type": "content_block_delta", "exception_type": "Guardrail"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isRefusalException(tt.data))
+		})
+	}
+}
+
+// TestStreamProcessor_ThrottleAfterCommitSurfacesQuotaReset 流式 overloaded_error 携带配额重置时间
+func TestStreamProcessor_ThrottleAfterCommitSurfacesQuotaReset(t *testing.T) {
+	ctx, sender, w := newDeferredStreamContext(t)
+	ctx.retryOnThrottle = false
+	processor := NewEventStreamProcessor(ctx)
+
+	resetAt := time.Now().Add(time.Minute).Unix()
+	require.NoError(t, processor.processEvent(parser.SSEEvent{
+		Event: "exception",
+		Data: map[string]any{
+			"type":           "exception",
+			"exception_type": "ThrottlingException",
+			"raw_data":       map[string]any{"quota_reset_timestamp": float64(resetAt)},
+		},
+	}))
+
+	assert.True(t, ctx.aborted)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"), "未提交时 Retry-After 随SSE响应头写出")
+	var errorObj map[string]any
+	for _, event := range sender.events {
+		if event["type"] == "error" {
+			errorObj = event["error"].(map[string]any)
+		}
+	}
+	require.NotNil(t, errorObj)
+	assert.Equal(t, "overloaded_error", errorObj["type"])
+	assert.Equal(t, resetAt, errorObj["quota_reset_timestamp"])
+}
+
+// TestStreamProcessor_UsageIncludesCacheTokens message_start 与 message_delta 的 usage 均包含缓存tokens字段
+func TestStreamProcessor_UsageIncludesCacheTokens(t *testing.T) {
+	ctx, sender, _ := newDeferredStreamContext(t)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(textDeltaEvent("hello")))
+	require.NoError(t, processor.processEvent(parser.SSEEvent{
+		Event: "message_delta",
+		Data: map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{},
+			"usage": map[string]any{"cache_read_input_tokens": float64(2048)},
+		},
+	}))
+	require.NoError(t, ctx.sendFinalEvents())
+
+	var startUsage, finalUsage map[string]any
+	for _, event := range sender.events {
+		switch event["type"] {
+		case "message_start":
+			startUsage = event["message"].(map[string]any)["usage"].(map[string]any)
+		case "message_delta":
+			finalUsage, _ = event["usage"].(map[string]any)
+		}
+	}
+	require.NotNil(t, startUsage)
+	assert.Equal(t, 0, startUsage["cache_creation_input_tokens"])
+	assert.Equal(t, 0, startUsage["cache_read_input_tokens"])
+
+	require.NotNil(t, finalUsage)
+	assert.Equal(t, 0, finalUsage["cache_creation_input_tokens"])
+	assert.Equal(t, 2048, finalUsage["cache_read_input_tokens"])
+}
+
+// finalUsageOf 返回最终 message_delta 的 usage
+func finalUsageOf(t *testing.T, sender *recordingStreamSender) map[string]any {
+	t.Helper()
+	for _, event := range sender.events {
+		if event["type"] == "message_delta" {
+			usage, _ := event["usage"].(map[string]any)
+			return usage
+		}
+	}
+	t.Fatal("没有下发 message_delta")
+	return nil
+}
+
+// TestStreamProcessor_UpstreamUsageIsAuthoritative 上游报告的 usage 优先于估算值，且不受之后的增量累计影响
+func TestStreamProcessor_UpstreamUsageIsAuthoritative(t *testing.T) {
+	ctx, sender, _ := newDeferredStreamContext(t)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(textDeltaEvent("hello world")))
+	require.NoError(t, processor.processEvent(parser.SSEEvent{
+		Event: "message_delta",
+		Data: map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{},
+			"usage": map[string]any{"input_tokens": float64(1234), "output_tokens": float64(42)},
+		},
+	}))
+	require.NoError(t, processor.processEvent(textDeltaEvent(" and more text after usage")))
+	require.NoError(t, ctx.sendFinalEvents())
+
+	usage := finalUsageOf(t, sender)
+	require.NotNil(t, usage)
+	assert.Equal(t, 1234, usage["input_tokens"])
+	assert.Equal(t, 42, usage["output_tokens"])
+}
+
+// TestStreamProcessor_UsageFallsBackToEstimate 上游未报告 usage 时使用请求估算的输入与增量累计的输出
+func TestStreamProcessor_UsageFallsBackToEstimate(t *testing.T) {
+	ctx, sender, _ := newDeferredStreamContext(t)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(textDeltaEvent("hello world")))
+	require.NoError(t, processor.processEvent(parser.SSEEvent{
+		Event: "message_delta",
+		Data: map[string]any{
+			"type":  "message_delta",
+			"delta": map[string]any{},
+			"usage": map[string]any{"output_tokens": float64(0)},
+		},
+	}))
+	require.NoError(t, ctx.sendFinalEvents())
+
+	usage := finalUsageOf(t, sender)
+	require.NotNil(t, usage)
+	assert.Equal(t, 10, usage["input_tokens"])
+	assert.Equal(t, ctx.totalOutputTokens, usage["output_tokens"])
+	assert.Positive(t, ctx.totalOutputTokens)
+}
+
+// TestStreamProcessor_ClientDisconnectStopsUpstreamRead 客户端中途断开时立即停止读取上游，不等待上游结束
+func TestStreamProcessor_ClientDisconnectStopsUpstreamRead(t *testing.T) {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil).WithContext(reqCtx)
+	sender := &recordingStreamSender{}
+	ctx := NewStreamProcessorContext(c, types.AnthropicRequest{Model: "claude-sonnet-4"}, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	defer ctx.Cleanup()
+	require.NoError(t, ctx.sendInitialEvents(createAnthropicStreamEvents))
+
+	// 上游发送一段内容后保持连接但不再发送数据
+	upstream, writer := io.Pipe()
+	defer writer.Close()
+	go func() {
+		_, _ = writer.Write(encodeAssistantEventFrame(`{"content":"partial"}`))
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- NewEventStreamProcessor(ctx).ProcessEventStream(upstream) }()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("客户端断开后应立即停止读取上游")
+	}
+	assert.True(t, ctx.clientDisconnected)
+
+	deltas := 0
+	for _, event := range sender.events {
+		if event["type"] == "content_block_delta" {
+			deltas++
+		}
+	}
+	assert.Equal(t, 1, deltas, "断开前收到的内容应正常下发")
+}
+
+// TestStreamProcessor_ThinkingSignatureAndRedactedPassthrough thinking 签名与 redacted_thinking 块原样下发，且不改写 thinking 内容
+func TestStreamProcessor_ThinkingSignatureAndRedactedPassthrough(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	sender := &recordingStreamSender{}
+	ctx := NewStreamProcessorContext(c, types.AnthropicRequest{Model: "claude-sonnet-4"}, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	require.NoError(t, ctx.sendInitialEvents(createAnthropicStreamEvents))
+	processor := NewEventStreamProcessor(ctx)
+
+	upstream := []map[string]any{
+		{"type": "content_block_start", "index": 0, "content_block": map[string]any{"type": "thinking", "thinking": ""}},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "thinking_delta", "thinking": "let me think"}},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "signature_delta", "signature": "sig-abc"}},
+		{"type": "content_block_stop", "index": 0},
+		{"type": "content_block_start", "index": 0, "content_block": map[string]any{"type": "redacted_thinking", "data": "encrypted-xyz"}},
+		{"type": "content_block_stop", "index": 0},
+	}
+	for _, data := range upstream {
+		require.NoError(t, processor.processEvent(parser.SSEEvent{Event: data["type"].(string), Data: data}))
+	}
+	require.NoError(t, processor.processEvent(textDeltaEvent("answer")))
+	require.NoError(t, ctx.sendFinalEvents())
+
+	blocks := map[int]map[string]any{}
+	var thinking, text strings.Builder
+	var signature string
+	var signatureBeforeStop bool
+	for _, event := range sender.events {
+		index, _ := event["index"].(int)
+		switch event["type"] {
+		case "content_block_start":
+			assert.NotContains(t, blocks, index, "同一索引不应重复开始内容块")
+			blocks[index] = event["content_block"].(map[string]any)
+		case "content_block_delta":
+			delta := event["delta"].(map[string]any)
+			switch delta["type"] {
+			case "thinking_delta":
+				thinking.WriteString(delta["thinking"].(string))
+			case "signature_delta":
+				signature = delta["signature"].(string)
+			case "text_delta":
+				text.WriteString(delta["text"].(string))
+			}
+		case "content_block_stop":
+			if blocks[index]["type"] == "thinking" {
+				signatureBeforeStop = signature != ""
+			}
+		}
+	}
+
+	assert.Equal(t, "let me think", thinking.String())
+	assert.Equal(t, "sig-abc", signature)
+	assert.True(t, signatureBeforeStop, "signature_delta 应在 thinking 块结束前下发")
+	assert.Equal(t, "answer", text.String())
+	require.Len(t, blocks, 3)
+	assert.Equal(t, "thinking", blocks[0]["type"])
+	assert.Equal(t, map[string]any{"type": "redacted_thinking", "data": "encrypted-xyz"}, blocks[1])
+	assert.Equal(t, "text", blocks[2]["type"])
+}
+
+// TestStreamProcessor_StrictModeViolationSendsError 严格模式下协议违规时下发 api_error 并结束流
+func TestStreamProcessor_StrictModeViolationSendsError(t *testing.T) {
+	ctx, sender, _ := newDeferredStreamContext(t)
+	ctx.sseStateManager = NewSSEStateManager(true)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(textDeltaEvent("hello")))
+	stopUnknown := parser.SSEEvent{
+		Event: "content_block_stop",
+		Data:  map[string]any{"type": "content_block_stop", "index": 5},
+	}
+	require.NoError(t, processor.processEvent(stopUnknown))
+	require.NoError(t, processor.processEvent(textDeltaEvent("ignored")))
+
+	assert.True(t, ctx.aborted)
+	last := sender.events[len(sender.events)-1]
+	assert.Equal(t, "error", last["type"])
+	errObj, _ := last["error"].(map[string]any)
+	assert.Equal(t, "api_error", errObj["type"])
+	assert.Contains(t, errObj["message"], "索引5")
+	assert.Len(t, eventsOfType(sender.events, "error"), 1)
+}
+
+// TestStreamProcessor_NonStrictModeSkipsViolation 默认模式下跳过违规事件继续下发
+func TestStreamProcessor_NonStrictModeSkipsViolation(t *testing.T) {
+	ctx, sender, _ := newDeferredStreamContext(t)
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(textDeltaEvent("hello")))
+	stopUnknown := parser.SSEEvent{
+		Event: "content_block_stop",
+		Data:  map[string]any{"type": "content_block_stop", "index": 5},
+	}
+	require.NoError(t, processor.processEvent(stopUnknown))
+	require.NoError(t, processor.processEvent(textDeltaEvent(" world")))
+
+	assert.False(t, ctx.aborted)
+	assert.Empty(t, eventsOfType(sender.events, "error"))
+	assert.Len(t, eventsOfType(sender.events, "content_block_delta"), 2)
+}
+
+// eventsOfType 筛选指定类型的事件
+func eventsOfType(events []map[string]any, eventType string) []map[string]any {
+	var out []map[string]any
+	for _, event := range events {
+		if event["type"] == eventType {
+			out = append(out, event)
+		}
+	}
+	return out
+}
+
+// TestStreamProcessor_InterleavedThinkingAndTools thinking→text→tool_use→thinking→text 交错时
+// 每个块使用独立且递增的索引，工具块之后的 thinking 与文本不复用已关闭块的索引
+func TestStreamProcessor_InterleavedThinkingAndTools(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil)
+
+	sender := &recordingStreamSender{}
+	ctx := NewStreamProcessorContext(c, types.AnthropicRequest{Model: "claude-sonnet-4"}, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	require.NoError(t, ctx.sendInitialEvents(createAnthropicStreamEvents))
+	processor := NewEventStreamProcessor(ctx)
+
+	upstream := []map[string]any{
+		{"type": "content_block_start", "index": 0, "content_block": map[string]any{"type": "thinking", "thinking": ""}},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "thinking_delta", "thinking": "plan"}},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "signature_delta", "signature": "sig-1"}},
+		{"type": "content_block_stop", "index": 0},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "text_delta", "text": "calling"}},
+		{"type": "content_block_start", "index": 1, "content_block": map[string]any{"type": "tool_use", "id": "toolu_1", "name": "lookup", "input": map[string]any{}}},
+		{"type": "content_block_delta", "index": 1, "delta": map[string]any{"type": "input_json_delta", "partial_json": `{"q":1}`}},
+		{"type": "content_block_stop", "index": 1},
+		{"type": "content_block_start", "index": 0, "content_block": map[string]any{"type": "thinking", "thinking": ""}},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "thinking_delta", "thinking": "reflect"}},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "signature_delta", "signature": "sig-2"}},
+		{"type": "content_block_stop", "index": 0},
+		{"type": "content_block_delta", "index": 0, "delta": map[string]any{"type": "text_delta", "text": "done"}},
+	}
+	for _, data := range upstream {
+		require.NoError(t, processor.processEvent(parser.SSEEvent{Event: data["type"].(string), Data: data}))
+	}
+	require.NoError(t, ctx.sendFinalEvents())
+
+	var starts []string
+	content := map[int]*strings.Builder{}
+	stopped := map[int]bool{}
+	for _, event := range sender.events {
+		index, _ := event["index"].(int)
+		switch event["type"] {
+		case "content_block_start":
+			assert.Len(t, starts, index, "块索引应从0开始连续递增")
+			starts = append(starts, event["content_block"].(map[string]any)["type"].(string))
+			content[index] = &strings.Builder{}
+		case "content_block_delta":
+			require.Contains(t, content, index, "增量必须属于已启动的块")
+			assert.False(t, stopped[index], "增量不能写入已关闭的块 %d", index)
+			delta := event["delta"].(map[string]any)
+			for _, key := range []string{"thinking", "text", "partial_json", "signature"} {
+				if value, ok := delta[key].(string); ok {
+					content[index].WriteString(value)
+				}
+			}
+		case "content_block_stop":
+			assert.False(t, stopped[index], "块 %d 不应重复关闭", index)
+			stopped[index] = true
+		}
+	}
+
+	assert.Equal(t, []string{"thinking", "text", "tool_use", "thinking", "text"}, starts)
+	assert.Equal(t, "plansig-1", content[0].String())
+	assert.Equal(t, "calling", content[1].String())
+	assert.Equal(t, `{"q":1}`, content[2].String())
+	assert.Equal(t, "reflectsig-2", content[3].String())
+	assert.Equal(t, "done", content[4].String())
+	for index := range starts {
+		assert.True(t, stopped[index], "块 %d 应已关闭", index)
+	}
+	assert.Empty(t, eventsOfType(sender.events, "error"))
+}
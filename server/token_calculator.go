@@ -26,14 +26,18 @@ func NewTokenCalculator() *TokenCalculator {
 // CalculateInputTokens 计算输入 tokens
 // 优先使用官方 count_tokens API，失败则回退到本地估算
 func (tc *TokenCalculator) CalculateInputTokens(ctx context.Context, req types.AnthropicRequest) int {
-	countReq := tc.buildCountRequest(req)
+	return tc.CountRequestTokens(ctx, tc.buildCountRequest(req))
+}
 
+// CountRequestTokens 计算 count_tokens 请求的输入 tokens
+// /v1/messages/count_tokens 与流式处理共用该路径，保证两处计数一致
+func (tc *TokenCalculator) CountRequestTokens(ctx context.Context, countReq *types.CountTokensRequest) int {
 	// 尝试使用官方 API
 	inputTokens, err := tc.counter.CountInputTokens(ctx, countReq)
 	if err != nil {
 		logger.Debug("官方 token 计数失败，回退到本地估算",
 			logger.Err(err),
-			logger.String("model", req.Model))
+			logger.String("model", countReq.Model))
 		inputTokens = tc.estimator.EstimateTokens(countReq)
 	}
 
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenRequestSample 一次上游请求的结果
+type tokenRequestSample struct {
+	latency time.Duration
+	success bool
+}
+
+// tokenRequestRecord 单个token最近请求的环形缓冲区与累计计数
+type tokenRequestRecord struct {
+	samples      []tokenRequestSample
+	next         int
+	full         bool
+	totalSuccess int64
+	totalFailure int64
+	rateLimited  int64 // 会话池内换token重试的 429 次数（不计入成功/失败）
+	lastRequest  time.Time
+}
+
+// TokenRequestStatsSnapshot token请求统计快照（用于 /api/tokens 展示）
+// 延迟为发出请求到收到上游响应头的耗时（不含流式正文传输），分位数基于最近 window 次请求
+type TokenRequestStatsSnapshot struct {
+	Window        int    `json:"window"`
+	Samples       int    `json:"samples"`
+	LatencyP50Ms  int64  `json:"latency_p50_ms"`
+	LatencyP95Ms  int64  `json:"latency_p95_ms"`
+	SuccessCount  int    `json:"success_count"`
+	FailureCount  int    `json:"failure_count"`
+	TotalSuccess  int64  `json:"total_success"`
+	TotalFailure  int64  `json:"total_failure"`
+	RateLimited   int64  `json:"rate_limited"`
+	LastRequestAt string `json:"last_request_at,omitempty"`
+}
+
+// TokenRequestStats 按 tokenKey 统计最近的上游请求延迟与成功/失败次数
+type TokenRequestStats struct {
+	mutex  sync.Mutex
+	window int // 每个token保留的最近请求数，<=0 表示不统计
+	tokens map[string]*tokenRequestRecord
+}
+
+// NewTokenRequestStats 创建token请求统计
+func NewTokenRequestStats(window int) *TokenRequestStats {
+	return &TokenRequestStats{
+		window: window,
+		tokens: make(map[string]*tokenRequestRecord),
+	}
+}
+
+// tokenRequestStats 全局token请求统计（TOKEN_LATENCY_WINDOW）
+var tokenRequestStats = NewTokenRequestStats(config.TokenLatencyWindow)
+
+// Record 记录一次上游请求，窗口已满时覆盖最旧的一条
+func (s *TokenRequestStats) Record(tokenKey string, latency time.Duration, success bool) {
+	if s.window <= 0 || tokenKey == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.recordUnlocked(tokenKey)
+	record.samples[record.next] = tokenRequestSample{latency: latency, success: success}
+	record.next = (record.next + 1) % len(record.samples)
+	if record.next == 0 {
+		record.full = true
+	}
+	if success {
+		record.totalSuccess++
+	} else {
+		record.totalFailure++
+	}
+	record.lastRequest = time.Now()
+}
+
+// RecordRateLimited 记录一次会话池内换token重试的 429（单独计数，不进入延迟窗口与成功/失败统计）
+func (s *TokenRequestStats) RecordRateLimited(tokenKey string) {
+	if s.window <= 0 || tokenKey == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.recordUnlocked(tokenKey)
+	record.rateLimited++
+	record.lastRequest = time.Now()
+}
+
+// recordUnlocked 返回token的统计记录，不存在时创建（调用方须持有 s.mutex）
+func (s *TokenRequestStats) recordUnlocked(tokenKey string) *tokenRequestRecord {
+	record, exists := s.tokens[tokenKey]
+	if !exists {
+		record = &tokenRequestRecord{samples: make([]tokenRequestSample, s.window)}
+		s.tokens[tokenKey] = record
+	}
+	return record
+}
+
+// Snapshot 返回指定token的统计快照，没有请求记录时各项为 0
+func (s *TokenRequestStats) Snapshot(tokenKey string) TokenRequestStatsSnapshot {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot := TokenRequestStatsSnapshot{Window: max(s.window, 0)}
+	record, exists := s.tokens[tokenKey]
+	if !exists {
+		return snapshot
+	}
+
+	samples := record.samples[:record.next]
+	if record.full {
+		samples = record.samples
+	}
+	latencies := make([]time.Duration, 0, len(samples))
+	for _, sample := range samples {
+		latencies = append(latencies, sample.latency)
+		if sample.success {
+			snapshot.SuccessCount++
+		} else {
+			snapshot.FailureCount++
+		}
+	}
+	slices.Sort(latencies)
+
+	snapshot.Samples = len(latencies)
+	snapshot.LatencyP50Ms = latencyPercentile(latencies, 0.50).Milliseconds()
+	snapshot.LatencyP95Ms = latencyPercentile(latencies, 0.95).Milliseconds()
+	snapshot.TotalSuccess = record.totalSuccess
+	snapshot.TotalFailure = record.totalFailure
+	snapshot.RateLimited = record.rateLimited
+	snapshot.LastRequestAt = record.lastRequest.Format(time.RFC3339)
+	return snapshot
+}
+
+// latencyPercentile 最近秩法计算分位数（sorted 须已升序）
+func latencyPercentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	return sorted[min(max(rank, 1), len(sorted))-1]
+}
+
+// recordTokenRequest 记录当前请求使用的token的上游请求结果
+// 客户端已断开导致的失败与token无关，不计入统计
+func recordTokenRequest(c *gin.Context, tokenKey string, start time.Time, success bool) {
+	if !success && c.Request.Context().Err() != nil {
+		return
+	}
+	tokenRequestStats.Record(tokenKey, time.Since(start), success)
+}
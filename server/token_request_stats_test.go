@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenRequestStats_PercentilesAndCounts(t *testing.T) {
+	stats := NewTokenRequestStats(10)
+
+	// 前 5 次请求超出窗口后被覆盖
+	for range 5 {
+		stats.Record("token_0", time.Hour, false)
+	}
+	for i := 1; i <= 10; i++ {
+		stats.Record("token_0", time.Duration(i*100)*time.Millisecond, i != 10)
+	}
+
+	snapshot := stats.Snapshot("token_0")
+	assert.Equal(t, 10, snapshot.Window)
+	assert.Equal(t, 10, snapshot.Samples)
+	assert.Equal(t, int64(500), snapshot.LatencyP50Ms)
+	assert.Equal(t, int64(1000), snapshot.LatencyP95Ms)
+	assert.Equal(t, 9, snapshot.SuccessCount)
+	assert.Equal(t, 1, snapshot.FailureCount)
+	assert.Equal(t, int64(9), snapshot.TotalSuccess)
+	assert.Equal(t, int64(6), snapshot.TotalFailure)
+	assert.NotEmpty(t, snapshot.LastRequestAt)
+
+	empty := stats.Snapshot("token_1")
+	assert.Zero(t, empty.Samples)
+	assert.Zero(t, empty.LatencyP95Ms)
+	assert.Empty(t, empty.LastRequestAt)
+}
+
+func TestTokenRequestStats_RateLimitedCountedSeparately(t *testing.T) {
+	stats := NewTokenRequestStats(10)
+	stats.Record("token_0", time.Second, true)
+	stats.RecordRateLimited("token_0")
+	stats.RecordRateLimited("token_0")
+
+	// 429 单独计数，不进入延迟窗口与失败次数
+	snapshot := stats.Snapshot("token_0")
+	assert.Equal(t, int64(2), snapshot.RateLimited)
+	assert.Equal(t, 1, snapshot.Samples)
+	assert.Zero(t, snapshot.FailureCount)
+	assert.Zero(t, snapshot.TotalFailure)
+
+	stats.RecordRateLimited("token_1")
+	assert.Equal(t, int64(1), stats.Snapshot("token_1").RateLimited)
+	assert.Zero(t, stats.Snapshot("token_1").Samples)
+}
+
+func TestTokenRequestStats_DisabledWindow(t *testing.T) {
+	stats := NewTokenRequestStats(0)
+	stats.Record("token_0", time.Second, true)
+	assert.Zero(t, stats.Snapshot("token_0").Samples)
+}
+
+func TestRecordTokenRequest_IgnoresClientDisconnect(t *testing.T) {
+	orig := tokenRequestStats
+	tokenRequestStats = NewTokenRequestStats(10)
+	t.Cleanup(func() { tokenRequestStats = orig })
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Request = httptest.NewRequest("POST", "/v1/messages", nil).WithContext(ctx)
+	cancel()
+
+	recordTokenRequest(c, "token_0", time.Now(), false)
+	assert.Zero(t, tokenRequestStats.Snapshot("token_0").Samples)
+
+	recordTokenRequest(c, "token_0", time.Now(), true)
+	assert.Equal(t, 1, tokenRequestStats.Snapshot("token_0").SuccessCount)
+}
@@ -0,0 +1,407 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	// errUpstreamQueueFull 等待队列已满
+	errUpstreamQueueFull = errors.New("上游并发已满且等待队列已满")
+	// errUpstreamQueueTimeout 排队超过 UPSTREAM_QUEUE_TIMEOUT
+	errUpstreamQueueTimeout = errors.New("等待上游并发名额超时")
+)
+
+// UpstreamLimiter 限制同时进行的上游请求数
+// 名额从发起请求开始占用，直到响应体关闭（流式响应在整个流结束后才释放）
+// 名额已满时按会话公平排队：各会话轮流获得释放的名额，同一会话内先到先得，避免单个会话占满上游
+type UpstreamLimiter struct {
+	mutex        sync.Mutex
+	limit        int // <=0 表示不限制
+	active       int
+	waiting      int
+	maxQueue     int // 最大排队数，<=0 表示不排队，名额满时直接拒绝
+	queueTimeout time.Duration
+
+	queues    map[string][]*upstreamWaiter // 按会话ID分组的排队请求（组内先到先得）
+	order     []string                     // 有排队请求的会话，按轮转顺序排列
+	waitStats map[string]*list.Element     // 按会话统计的排队等待时间（元素值为 *upstreamSessionStats）
+	waitLRU   *list.List                   // 会话统计按最近获得名额的时间排列，最近的在前
+}
+
+// upstreamWaiter 一个排队中的请求
+type upstreamWaiter struct {
+	sessionID  string
+	enqueuedAt time.Time
+	ready      chan struct{} // 获得名额时关闭
+	granted    bool
+}
+
+// upstreamSessionStats 单个会话的排队统计
+type upstreamSessionStats struct {
+	sessionID string
+	served    int // 获得名额的请求数
+	totalWait time.Duration
+	maxWait   time.Duration
+	lastWait  time.Duration
+	lastSeen  time.Time
+}
+
+const (
+	// upstreamWaitStatsTTL 会话排队统计的保留时间（自最后一次获得名额算起）
+	upstreamWaitStatsTTL = 10 * time.Minute
+	// upstreamWaitStatsMaxSessions 最多保留统计的会话数，超出时淘汰最久未获得名额的会话
+	upstreamWaitStatsMaxSessions = 1024
+)
+
+// NewUpstreamLimiter 创建上游并发限制器
+func NewUpstreamLimiter(limit, maxQueue int, queueTimeout time.Duration) *UpstreamLimiter {
+	return &UpstreamLimiter{
+		limit:        limit,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+		queues:       make(map[string][]*upstreamWaiter),
+		waitStats:    make(map[string]*list.Element),
+		waitLRU:      list.New(),
+	}
+}
+
+// upstreamLimiter 全局上游并发限制器（MAX_CONCURRENT_UPSTREAM）
+var upstreamLimiter = NewUpstreamLimiter(config.MaxConcurrentUpstream, config.UpstreamQueueSize, config.UpstreamQueueTimeout)
+
+// Acquire 为 sessionID 所属会话占用一个名额；名额已满时排队等待，队列已满、排队超时或请求取消时返回错误
+// 已有请求排队时新请求同样排队，由轮转调度决定获得名额的顺序
+// 成功时返回的 release 必须且只能调用一次
+func (l *UpstreamLimiter) Acquire(ctx context.Context, sessionID string) (release func(), err error) {
+	l.mutex.Lock()
+	if l.waiting == 0 && l.hasCapacityUnlocked() {
+		l.active++
+		l.recordWaitUnlocked(sessionID, 0)
+		l.mutex.Unlock()
+		return l.releaseOnce(), nil
+	}
+	if l.waiting >= l.maxQueue {
+		l.mutex.Unlock()
+		return nil, errUpstreamQueueFull
+	}
+
+	waiter := &upstreamWaiter{sessionID: sessionID, enqueuedAt: time.Now(), ready: make(chan struct{})}
+	l.enqueueUnlocked(waiter)
+	// 上限可能刚被放宽，排队后立即尝试调度
+	l.dispatchUnlocked()
+	l.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if l.queueTimeout > 0 {
+		timer := time.NewTimer(l.queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-waiter.ready:
+		return l.releaseOnce(), nil
+	case <-timeout:
+		err = errUpstreamQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if waiter.granted {
+		// 超时/取消与获得名额同时发生：归还名额
+		l.active--
+		l.dispatchUnlocked()
+	} else {
+		l.removeWaiterUnlocked(waiter)
+	}
+	return nil, err
+}
+
+// SetLimit 运行时调整并发上限（<=0 表示不限制），放宽后立即唤醒排队的请求
+func (l *UpstreamLimiter) SetLimit(limit int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.limit = limit
+	l.dispatchUnlocked()
+}
+
+// Stats 返回限制器当前状态
+func (l *UpstreamLimiter) Stats() map[string]any {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return map[string]any{
+		"limit":              l.limit,
+		"active":             l.active,
+		"waiting":            l.waiting,
+		"waiting_sessions":   len(l.order),
+		"max_queue":          l.maxQueue,
+		"queue_timeout_secs": l.queueTimeout.Seconds(),
+	}
+}
+
+// QueueStats 返回排队深度与按会话的等待时间
+// 包含正在排队的会话与最近 upstreamWaitStatsTTL 内获得过名额的会话，按排队数、会话ID排序
+func (l *UpstreamLimiter) QueueStats() map[string]any {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.pruneWaitStatsUnlocked(now)
+
+	sessionIDs := make([]string, 0, len(l.waitStats)+len(l.order))
+	for sessionID := range l.waitStats {
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	for _, sessionID := range l.order {
+		if _, ok := l.waitStats[sessionID]; !ok {
+			sessionIDs = append(sessionIDs, sessionID)
+		}
+	}
+	sort.Slice(sessionIDs, func(i, j int) bool {
+		qi, qj := len(l.queues[sessionIDs[i]]), len(l.queues[sessionIDs[j]])
+		if qi != qj {
+			return qi > qj
+		}
+		return sessionIDs[i] < sessionIDs[j]
+	})
+
+	sessions := make([]map[string]any, 0, len(sessionIDs))
+	for _, sessionID := range sessionIDs {
+		entry := map[string]any{
+			"session_id": sessionID,
+			"waiting":    len(l.queues[sessionID]),
+		}
+		if queue := l.queues[sessionID]; len(queue) > 0 {
+			entry["oldest_wait_ms"] = now.Sub(queue[0].enqueuedAt).Milliseconds()
+		}
+		if elem, ok := l.waitStats[sessionID]; ok {
+			stats := elem.Value.(*upstreamSessionStats)
+			entry["served"] = stats.served
+			entry["avg_wait_ms"] = (stats.totalWait / time.Duration(stats.served)).Milliseconds()
+			entry["max_wait_ms"] = stats.maxWait.Milliseconds()
+			entry["last_wait_ms"] = stats.lastWait.Milliseconds()
+		}
+		sessions = append(sessions, entry)
+	}
+
+	return map[string]any{
+		"limit":            l.limit,
+		"active":           l.active,
+		"waiting":          l.waiting,
+		"waiting_sessions": len(l.order),
+		"sessions":         sessions,
+	}
+}
+
+func (l *UpstreamLimiter) hasCapacityUnlocked() bool {
+	return l.limit <= 0 || l.active < l.limit
+}
+
+// enqueueUnlocked 将请求加入所属会话的队列，新会话排到轮转顺序末尾（调用者必须持有锁）
+func (l *UpstreamLimiter) enqueueUnlocked(waiter *upstreamWaiter) {
+	if len(l.queues[waiter.sessionID]) == 0 {
+		l.order = append(l.order, waiter.sessionID)
+	}
+	l.queues[waiter.sessionID] = append(l.queues[waiter.sessionID], waiter)
+	l.waiting++
+}
+
+// removeWaiterUnlocked 移除超时或取消的排队请求（调用者必须持有锁）
+func (l *UpstreamLimiter) removeWaiterUnlocked(waiter *upstreamWaiter) {
+	queue := l.queues[waiter.sessionID]
+	for i, w := range queue {
+		if w == waiter {
+			queue = append(queue[:i], queue[i+1:]...)
+			l.waiting--
+			break
+		}
+	}
+	if len(queue) > 0 {
+		l.queues[waiter.sessionID] = queue
+		return
+	}
+	delete(l.queues, waiter.sessionID)
+	for i, sessionID := range l.order {
+		if sessionID == waiter.sessionID {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// dispatchUnlocked 按会话轮转把空闲名额分配给排队的请求：
+// 取轮转顺序首位会话的最早请求，该会话仍有排队请求时移到末尾（调用者必须持有锁）
+func (l *UpstreamLimiter) dispatchUnlocked() {
+	for len(l.order) > 0 && l.hasCapacityUnlocked() {
+		sessionID := l.order[0]
+		l.order = l.order[1:]
+
+		queue := l.queues[sessionID]
+		waiter := queue[0]
+		if len(queue) > 1 {
+			l.queues[sessionID] = queue[1:]
+			l.order = append(l.order, sessionID)
+		} else {
+			delete(l.queues, sessionID)
+		}
+
+		l.waiting--
+		l.active++
+		waiter.granted = true
+		l.recordWaitUnlocked(sessionID, time.Since(waiter.enqueuedAt))
+		close(waiter.ready)
+	}
+}
+
+// recordWaitUnlocked 记录会话获得名额前的等待时间（不限制并发时不统计，调用者必须持有锁）
+func (l *UpstreamLimiter) recordWaitUnlocked(sessionID string, wait time.Duration) {
+	if l.limit <= 0 {
+		return
+	}
+	var stats *upstreamSessionStats
+	if elem, ok := l.waitStats[sessionID]; ok {
+		stats = elem.Value.(*upstreamSessionStats)
+		l.waitLRU.MoveToFront(elem)
+	} else {
+		if l.waitLRU.Len() >= upstreamWaitStatsMaxSessions {
+			oldest := l.waitLRU.Back()
+			l.waitLRU.Remove(oldest)
+			delete(l.waitStats, oldest.Value.(*upstreamSessionStats).sessionID)
+		}
+		stats = &upstreamSessionStats{sessionID: sessionID}
+		l.waitStats[sessionID] = l.waitLRU.PushFront(stats)
+	}
+	stats.served++
+	stats.totalWait += wait
+	stats.maxWait = max(stats.maxWait, wait)
+	stats.lastWait = wait
+	stats.lastSeen = time.Now()
+}
+
+// pruneWaitStatsUnlocked 从最久未获得名额的一端清理超过 upstreamWaitStatsTTL 的会话统计（调用者必须持有锁）
+func (l *UpstreamLimiter) pruneWaitStatsUnlocked(now time.Time) {
+	for elem := l.waitLRU.Back(); elem != nil; elem = l.waitLRU.Back() {
+		stats := elem.Value.(*upstreamSessionStats)
+		if now.Sub(stats.lastSeen) <= upstreamWaitStatsTTL {
+			return
+		}
+		l.waitLRU.Remove(elem)
+		delete(l.waitStats, stats.sessionID)
+	}
+}
+
+func (l *UpstreamLimiter) releaseOnce() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.active--
+			l.dispatchUnlocked()
+		})
+	}
+}
+
+// releaseOnCloseBody 响应体关闭时释放上游并发名额
+type releaseOnCloseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// upstreamFairnessKey 返回排队公平调度使用的会话键
+// 请求带有 X-Session-ID / X-Request-ID 时使用会话ID；否则会话ID为每个请求新生成的，
+// 改用客户端token ID或API密钥哈希，使同一客户端的请求归入同一队列
+func upstreamFairnessKey(c *gin.Context) string {
+	if c.GetHeader("X-Session-ID") != "" || c.GetHeader("X-Request-ID") != "" {
+		return c.GetString("session_id")
+	}
+	if clientTokenID := c.GetString(clientTokenIDContextKey); clientTokenID != "" {
+		return "client_" + clientTokenID
+	}
+	if apiKey := extractAPIKey(c); apiKey != "" {
+		hash := sha256.Sum256([]byte(apiKey))
+		return "key_" + hex.EncodeToString(hash[:8])
+	}
+	return c.GetString("session_id")
+}
+
+// doUpstreamRequest 在上游并发限制下执行 CodeWhisperer 请求，名额已满时按会话（upstreamFairnessKey）公平排队
+// 同一客户端请求内的嵌套调用（web_search 续写、MCP 搜索）复用外层名额，不经过此函数
+func doUpstreamRequest(c *gin.Context, req *http.Request) (*http.Response, error) {
+	release, err := upstreamLimiter.Acquire(req.Context(), upstreamFairnessKey(c))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.DoRequest(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnCloseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// isUpstreamLimitError 是否为上游并发限制导致的失败
+func isUpstreamLimitError(err error) bool {
+	return errors.Is(err, errUpstreamQueueFull) || errors.Is(err, errUpstreamQueueTimeout)
+}
+
+// handleUpstreamConcurrencyStatus 返回上游并发限制状态
+func handleUpstreamConcurrencyStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, upstreamLimiter.Stats())
+}
+
+// handleUpstreamQueueStatus 返回上游排队深度与按会话的等待时间
+func handleUpstreamQueueStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, upstreamLimiter.QueueStats())
+}
+
+// handleSetUpstreamConcurrency 运行时调整上游并发上限（仅内存生效，重启后恢复 MAX_CONCURRENT_UPSTREAM）
+func handleSetUpstreamConcurrency(c *gin.Context) {
+	var req struct {
+		Limit *int `json:"limit" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || *req.Limit < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a non-negative integer (0 means unlimited)"})
+		return
+	}
+
+	upstreamLimiter.SetLimit(*req.Limit)
+	logger.Info("上游并发上限已调整", logger.Int("limit", *req.Limit))
+	c.JSON(http.StatusOK, upstreamLimiter.Stats())
+}
+
+// respondUpstreamBusy 返回 Claude 规范的 503 overloaded_error
+func respondUpstreamBusy(c *gin.Context, err error) {
+	logger.Warn("上游并发已满，拒绝请求", addReqFields(c, logger.Err(err))...)
+	c.Header("Retry-After", "1")
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"type": "error",
+		"error": gin.H{
+			"type":    "overloaded_error",
+			"message": "上游并发请求数已达上限，请稍后重试",
+		},
+	})
+}
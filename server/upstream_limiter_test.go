@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamLimiter_QueueFullAndTimeout(t *testing.T) {
+	l := NewUpstreamLimiter(1, 1, 50*time.Millisecond)
+
+	release, err := l.Acquire(context.Background(), "")
+	require.NoError(t, err)
+
+	// 第二个请求排队，第三个请求因队列已满被立即拒绝
+	queued := make(chan error, 1)
+	go func() {
+		_, err := l.Acquire(context.Background(), "")
+		queued <- err
+	}()
+	require.Eventually(t, func() bool { return l.Stats()["waiting"] == 1 }, time.Second, time.Millisecond)
+
+	_, err = l.Acquire(context.Background(), "")
+	assert.ErrorIs(t, err, errUpstreamQueueFull)
+
+	// 排队请求超时
+	assert.ErrorIs(t, <-queued, errUpstreamQueueTimeout)
+	assert.Equal(t, 0, l.Stats()["waiting"])
+
+	release()
+	release() // 重复释放不应使计数变为负数
+	assert.Equal(t, 0, l.Stats()["active"])
+}
+
+func TestUpstreamLimiter_ReleaseAndSetLimitWakeWaiters(t *testing.T) {
+	l := NewUpstreamLimiter(1, 10, 0)
+
+	release, err := l.Acquire(context.Background(), "")
+	require.NoError(t, err)
+
+	acquired := make(chan func(), 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r, err := l.Acquire(context.Background(), "")
+			if err == nil {
+				acquired <- r
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return l.Stats()["waiting"] == 2 }, time.Second, time.Millisecond)
+
+	// 释放名额后唤醒一个排队请求
+	release()
+	r1 := <-acquired
+	assert.Equal(t, 1, l.Stats()["active"])
+
+	// 放宽上限后剩余的排队请求立即获得名额
+	l.SetLimit(2)
+	r2 := <-acquired
+	assert.Equal(t, 2, l.Stats()["active"])
+	r1()
+	r2()
+}
+
+func TestUpstreamLimiter_ContextCanceled(t *testing.T) {
+	l := NewUpstreamLimiter(1, 10, 0)
+	_, err := l.Acquire(context.Background(), "")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = l.Acquire(ctx, "")
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestHandleSetUpstreamConcurrency(t *testing.T) {
+	orig := upstreamLimiter
+	upstreamLimiter = NewUpstreamLimiter(0, 10, time.Second)
+	defer func() { upstreamLimiter = orig }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/upstream-concurrency", handleUpstreamConcurrencyStatus)
+	r.PUT("/api/upstream-concurrency", handleSetUpstreamConcurrency)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/upstream-concurrency", strings.NewReader(`{"limit":8}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/upstream-concurrency", nil))
+	var stats map[string]any
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, float64(8), stats["limit"])
+
+	for _, body := range []string{`{"limit":-1}`, `{}`, `not json`} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/api/upstream-concurrency", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
+
+func TestHandleRequestSendError_UpstreamBusy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	handleRequestSendError(c, errUpstreamQueueFull)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "overloaded_error")
+}
+
+func TestUpstreamLimiter_FairAcrossSessions(t *testing.T) {
+	l := NewUpstreamLimiter(1, 10, 0)
+	release, err := l.Acquire(context.Background(), "busy")
+	require.NoError(t, err)
+
+	// busy 会话先排队 3 个请求，quiet 会话随后排队 1 个
+	order := make(chan string, 4)
+	enqueue := func(sessionID string, waiting int) {
+		go func() {
+			r, err := l.Acquire(context.Background(), sessionID)
+			if err == nil {
+				order <- sessionID
+				r()
+			}
+		}()
+		require.Eventually(t, func() bool { return l.Stats()["waiting"] == waiting }, time.Second, time.Millisecond)
+	}
+	enqueue("busy", 1)
+	enqueue("busy", 2)
+	enqueue("busy", 3)
+	enqueue("quiet", 4)
+	assert.Equal(t, 2, l.Stats()["waiting_sessions"])
+
+	queue := l.QueueStats()
+	sessions := queue["sessions"].([]map[string]any)
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "busy", sessions[0]["session_id"])
+	assert.Equal(t, 3, sessions[0]["waiting"])
+	assert.Equal(t, 1, sessions[0]["served"])
+	assert.Contains(t, sessions[1], "oldest_wait_ms")
+
+	// quiet 会话在 busy 的第二个请求之前获得名额
+	release()
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, <-order)
+	}
+	assert.Equal(t, []string{"busy", "quiet", "busy", "busy"}, got)
+
+	require.Eventually(t, func() bool { return l.Stats()["active"] == 0 }, time.Second, time.Millisecond)
+	sessions = l.QueueStats()["sessions"].([]map[string]any)
+	require.Len(t, sessions, 2)
+	for _, s := range sessions {
+		assert.Equal(t, 0, s["waiting"])
+		assert.NotContains(t, s, "oldest_wait_ms")
+	}
+}
+
+func TestHandleUpstreamQueueStatus(t *testing.T) {
+	orig := upstreamLimiter
+	upstreamLimiter = NewUpstreamLimiter(2, 10, time.Second)
+	defer func() { upstreamLimiter = orig }()
+
+	release, err := upstreamLimiter.Acquire(context.Background(), "session-a")
+	require.NoError(t, err)
+	defer release()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/api/upstream-concurrency/queue", handleUpstreamQueueStatus)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/upstream-concurrency/queue", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Active   int              `json:"active"`
+		Waiting  int              `json:"waiting"`
+		Sessions []map[string]any `json:"sessions"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, 1, body.Active)
+	assert.Equal(t, 0, body.Waiting)
+	require.Len(t, body.Sessions, 1)
+	assert.Equal(t, "session-a", body.Sessions[0]["session_id"])
+	assert.Equal(t, float64(1), body.Sessions[0]["served"])
+}
+
+func TestUpstreamLimiter_WaitStatsEvictLeastRecentlyServed(t *testing.T) {
+	l := NewUpstreamLimiter(1, 0, 0)
+	acquire := func(sessionID string) {
+		r, err := l.Acquire(context.Background(), sessionID)
+		require.NoError(t, err)
+		r()
+	}
+	for i := 0; i < upstreamWaitStatsMaxSessions; i++ {
+		acquire(fmt.Sprintf("session-%d", i))
+	}
+	// session-0 再次获得名额后成为最近使用的会话，新会话淘汰最久未使用的 session-1
+	acquire("session-0")
+	acquire("session-new")
+
+	assert.Len(t, l.waitStats, upstreamWaitStatsMaxSessions)
+	assert.Equal(t, upstreamWaitStatsMaxSessions, l.waitLRU.Len())
+	assert.Contains(t, l.waitStats, "session-0")
+	assert.Contains(t, l.waitStats, "session-new")
+	assert.NotContains(t, l.waitStats, "session-1")
+}
+
+func TestUpstreamFairnessKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newContext := func(headers map[string]string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+		for k, v := range headers {
+			c.Request.Header.Set(k, v)
+		}
+		c.Set("session_id", fmt.Sprintf("session_%d", time.Now().UnixNano()))
+		return c
+	}
+
+	// 显式会话头：使用会话ID
+	c := newContext(map[string]string{"X-Session-ID": "abc", "Authorization": "Bearer key-1"})
+	c.Set("session_id", "abc")
+	assert.Equal(t, "abc", upstreamFairnessKey(c))
+
+	// 无会话头：同一客户端token的请求归入同一队列
+	c = newContext(nil)
+	c.Set(clientTokenIDContextKey, "team-a")
+	assert.Equal(t, "client_team-a", upstreamFairnessKey(c))
+
+	// 无会话头与客户端token：按API密钥哈希分组，不暴露明文
+	first := upstreamFairnessKey(newContext(map[string]string{"Authorization": "Bearer key-1"}))
+	second := upstreamFairnessKey(newContext(map[string]string{"Authorization": "Bearer key-1"}))
+	other := upstreamFairnessKey(newContext(map[string]string{"Authorization": "Bearer key-2"}))
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+	assert.NotContains(t, first, "key-1")
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// doUpstreamRequestWithNetRetry 执行上游请求，建立连接失败（连接被拒绝、DNS 抖动等）时重试
+// 上游请求为非幂等的 POST，连接建立后的重置、EOF 或超时可能已被上游处理，不重试以免重复提交；
+// 最多重试 UPSTREAM_NET_RETRIES 次，间隔从 UPSTREAM_NET_RETRY_INTERVAL 开始逐次翻倍；
+// 请求上下文已取消（客户端断开）时不重试。与 429 换token重试相互独立
+func doUpstreamRequestWithNetRetry(c *gin.Context, req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := doUpstreamRequest(c, req)
+		if err == nil || attempt >= config.UpstreamNetRetries || req.GetBody == nil ||
+			req.Context().Err() != nil || !utils.IsConnectNetError(err) {
+			return resp, err
+		}
+
+		backoff := config.UpstreamNetRetryInterval << attempt
+		logger.Warn("连接上游失败，准备重试",
+			addReqFields(c,
+				logger.Err(err),
+				logger.Int("attempt", attempt+1),
+				logger.Int("max_retries", config.UpstreamNetRetries),
+				logger.Duration("backoff", backoff),
+			)...)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+
+		// 请求体已被上一次尝试读取，重建后再发送
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kiro2api/config"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFlakyUpstream 前 failures 次请求直接断开连接，之后返回请求体
+func newFlakyUpstream(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= failures {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestDoUpstreamRequestWithNetRetry(t *testing.T) {
+	origRetries, origInterval := config.UpstreamNetRetries, config.UpstreamNetRetryInterval
+	config.UpstreamNetRetries, config.UpstreamNetRetryInterval = 3, 20*time.Millisecond
+	defer func() { config.UpstreamNetRetries, config.UpstreamNetRetryInterval = origRetries, origInterval }()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	// 上游尚未监听（连接被拒绝）时重试，上游启动后成功，且重试时重新发送了请求体
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write(body)
+	})}
+	t.Cleanup(func() { _ = srv.Close() })
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		if ln, err := net.Listen("tcp", addr); err == nil {
+			_ = srv.Serve(ln)
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr, bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	resp, err := doUpstreamRequestWithNetRetry(c, req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "payload", string(body))
+}
+
+func TestDoUpstreamRequestWithNetRetry_DoesNotRetryAfterConnect(t *testing.T) {
+	origRetries, origInterval := config.UpstreamNetRetries, config.UpstreamNetRetryInterval
+	config.UpstreamNetRetries, config.UpstreamNetRetryInterval = 2, time.Millisecond
+	defer func() { config.UpstreamNetRetries, config.UpstreamNetRetryInterval = origRetries, origInterval }()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	// 请求已发送后连接断开（EOF）：上游可能已处理，不重试
+	srv, calls := newFlakyUpstream(t, 5)
+	req, err := http.NewRequest(http.MethodPost, srv.URL, bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	_, err = doUpstreamRequestWithNetRetry(c, req)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestDoUpstreamRequestWithNetRetry_CanceledContext(t *testing.T) {
+	srv, calls := newFlakyUpstream(t, 5)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL, bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	_, err = doUpstreamRequestWithNetRetry(c, req)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, int32(0), calls.Load())
+}
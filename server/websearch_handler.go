@@ -81,10 +81,22 @@ type webSearchResultItem struct {
 	PageAge          string `json:"page_age,omitempty"`
 }
 
+// getMCPURL MCP 端点：优先使用 WEB_SEARCH_MCP_URL，否则使用 Kiro 内置端点
 func getMCPURL() string {
+	if config.WebSearchMCPURL != "" {
+		return config.WebSearchMCPURL
+	}
 	return fmt.Sprintf("https://q.%s.amazonaws.com/mcp", config.DefaultRegion)
 }
 
+// getMCPAuthToken MCP 请求的 Bearer token：优先使用 WEB_SEARCH_MCP_AUTH_TOKEN，否则使用账号 access token
+func getMCPAuthToken(tokenInfo types.TokenInfo) string {
+	if config.WebSearchMCPAuthToken != "" {
+		return config.WebSearchMCPAuthToken
+	}
+	return tokenInfo.AccessToken
+}
+
 func randLowerAlphaNum(n int) string {
 	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
 	b := make([]byte, n)
@@ -144,7 +156,7 @@ func callMCPWebSearch(ctx *gin.Context, query string, tokenInfo types.TokenInfo)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+tokenInfo.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+getMCPAuthToken(tokenInfo))
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := utils.DoRequest(req)
@@ -152,11 +164,15 @@ func callMCPWebSearch(ctx *gin.Context, query string, tokenInfo types.TokenInfo)
 		return nil, err
 	}
 	defer resp.Body.Close()
+	recordAccessUpstream(ctx, resp.StatusCode)
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("mcp request failed: status %d: %s", resp.StatusCode, string(body))
+	}
 
 	var rpcResp mcpJSONRPCResponse
 	if err := utils.SafeUnmarshal(body, &rpcResp); err != nil {
@@ -253,6 +269,7 @@ func handleWebSearchRequest(c *gin.Context, req types.AnthropicRequest, tokenInf
 
 	summary := generateSearchSummary(query, searchResults)
 	outputTokens := (len(summary) + 3) / 4
+	recordAccessUsage(c, inputTokens, outputTokens)
 
 	events := []map[string]any{
 		{
@@ -262,7 +279,7 @@ func handleWebSearchRequest(c *gin.Context, req types.AnthropicRequest, tokenInf
 				"type":          "message",
 				"role":          "assistant",
 				"content":       []any{},
-				"model":         req.Model,
+				"model":         config.ResponseModel(req.Model),
 				"stop_reason":   nil,
 				"stop_sequence": nil,
 				"usage": map[string]any{
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"kiro2api/config"
+	"kiro2api/converter"
+	"kiro2api/logger"
+	"kiro2api/metrics"
+	"kiro2api/types"
+	"kiro2api/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webSearchInterceptor 流式响应中拦截上游的 web_search 工具调用（WEB_SEARCH_MCP_ENABLED=true）
+// 调用通过 MCP 执行，以 server_tool_use / web_search_tool_result 块下发给客户端；
+// 本轮上游响应结束后，携带 tool_use/tool_result 继续请求上游，直到模型不再搜索
+type webSearchInterceptor struct {
+	tokenInfo types.TokenInfo
+	messages  []types.AnthropicRequestMessage // 续写请求的消息（逐轮追加）
+
+	indexOffset int                       // 上游块索引 -> 下发块索引的偏移（插入结果块与续写轮次都会增加）
+	pending     map[int]*pendingWebSearch // 上游块索引 -> 正在接收参数的 web_search 调用
+	calls       []webSearchCall           // 本轮已执行的搜索
+	roundText   strings.Builder           // 本轮模型输出的文本
+	uses        int                       // 已执行的搜索次数
+	rounds      int                       // 已发起的续写请求次数
+}
+
+// pendingWebSearch 正在接收参数的 web_search 调用
+type pendingWebSearch struct {
+	id    string
+	name  string
+	input strings.Builder
+}
+
+// webSearchCall 已执行的搜索：续写请求中作为 tool_use/tool_result 发送给上游
+type webSearchCall struct {
+	id      string
+	name    string
+	query   string
+	result  string
+	isError bool
+}
+
+// newWebSearchInterceptor 请求未启用 MCP 搜索时返回 nil
+func newWebSearchInterceptor(req types.AnthropicRequest, tokenInfo types.TokenInfo) *webSearchInterceptor {
+	if !req.WebSearchMCP {
+		return nil
+	}
+	messages := req.Messages
+	if req.AssistantPrefill != "" && len(messages) > 0 {
+		// 预填充会与本轮输出一起作为 assistant 消息发送，这里去掉末尾的 assistant 消息
+		messages = messages[:len(messages)-1]
+	}
+	ws := &webSearchInterceptor{
+		tokenInfo: tokenInfo,
+		messages:  append([]types.AnthropicRequestMessage(nil), messages...),
+		pending:   make(map[int]*pendingWebSearch),
+	}
+	ws.roundText.WriteString(req.AssistantPrefill)
+	return ws
+}
+
+// requestUsesWebSearchMCP 是否由代理通过 MCP 执行 web_search（仅 /v1/messages 流式请求）
+func requestUsesWebSearchMCP(req types.AnthropicRequest) bool {
+	if !config.WebSearchMCPEnabled || !req.Stream {
+		return false
+	}
+	for _, tool := range req.Tools {
+		if converter.IsWebSearchToolName(tool.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// intercept 处理上游事件：重映射块索引，拦截 web_search 调用
+// 返回 true 表示事件已被拦截，不需要继续处理
+func (ws *webSearchInterceptor) intercept(ctx *StreamProcessorContext, dataMap map[string]any) bool {
+	idx := extractIndex(dataMap)
+	if idx < 0 {
+		return false
+	}
+	dataMap["index"] = idx + ws.indexOffset
+	eventType, _ := dataMap["type"].(string)
+
+	switch eventType {
+	case "content_block_start":
+		cb, _ := dataMap["content_block"].(map[string]any)
+		if cb["type"] != "tool_use" || !converter.IsWebSearchToolName(getStringField(cb, "name")) {
+			return false
+		}
+		ws.pending[idx] = &pendingWebSearch{id: getStringField(cb, "id"), name: getStringField(cb, "name")}
+		return true
+
+	case "content_block_delta":
+		delta, _ := dataMap["delta"].(map[string]any)
+		if call, ok := ws.pending[idx]; ok {
+			if pj, ok := delta["partial_json"].(string); ok {
+				call.input.WriteString(pj)
+			}
+			return true
+		}
+		if text, ok := delta["text"].(string); ok && delta["type"] == "text_delta" {
+			ws.roundText.WriteString(text)
+		}
+
+	case "content_block_stop":
+		call, ok := ws.pending[idx]
+		if !ok {
+			return false
+		}
+		delete(ws.pending, idx)
+		ws.execute(ctx, idx+ws.indexOffset, call)
+		return true
+	}
+	return false
+}
+
+// execute 执行搜索并下发 server_tool_use 与 web_search_tool_result 块
+func (ws *webSearchInterceptor) execute(ctx *StreamProcessorContext, index int, pending *pendingWebSearch) {
+	input := map[string]any{}
+	if raw := pending.input.String(); raw != "" {
+		if err := utils.SafeUnmarshal([]byte(raw), &input); err != nil {
+			logger.Warn("解析 web_search 参数失败", addReqFields(ctx.c, logger.Err(err))...)
+		}
+	}
+	query, _ := input["query"].(string)
+	call := webSearchCall{id: pending.id, name: pending.name, query: query}
+
+	var resultContent any
+	if ws.uses >= config.WebSearchMaxUses {
+		resultContent = map[string]any{"type": "web_search_tool_result_error", "error_code": "max_uses_exceeded"}
+		call.result = "Error: the maximum number of web searches for this request has been reached."
+		call.isError = true
+	} else {
+		ws.uses++
+		results, err := callMCPWebSearch(ctx.c, query, ws.tokenInfo)
+		if err != nil {
+			logger.Warn("MCP web_search 调用失败", addReqFields(ctx.c, logger.String("query", query), logger.Err(err))...)
+			resultContent = map[string]any{"type": "web_search_tool_result_error", "error_code": "unavailable"}
+			call.result = "Error: web search is currently unavailable."
+			call.isError = true
+		} else {
+			resultContent = results
+			call.result = formatWebSearchToolResult(query, results)
+		}
+	}
+	ws.calls = append(ws.calls, call)
+
+	srvToolUseID := generateToolUseID()
+	events := []map[string]any{
+		{
+			"type":  "content_block_start",
+			"index": index,
+			"content_block": map[string]any{
+				"type":  "server_tool_use",
+				"id":    srvToolUseID,
+				"name":  "web_search",
+				"input": map[string]any{"query": query},
+			},
+		},
+		{"type": "content_block_stop", "index": index},
+		{
+			"type":  "content_block_start",
+			"index": index + 1,
+			"content_block": map[string]any{
+				"type":        "web_search_tool_result",
+				"tool_use_id": srvToolUseID,
+				"content":     resultContent,
+			},
+		},
+		{"type": "content_block_stop", "index": index + 1},
+	}
+	for _, event := range events {
+		if err := ctx.sendEvent(event); err != nil {
+			logger.Error("下发 web_search 结果失败", logger.Err(err))
+		}
+	}
+	ctx.c.Writer.Flush()
+
+	// 结果块占用了一个额外的索引，之后的上游块顺延
+	ws.indexOffset++
+}
+
+// needsFollowUp 本轮执行了搜索且模型没有调用其他工具时，需要携带结果继续请求上游
+func (ws *webSearchInterceptor) needsFollowUp(ctx *StreamProcessorContext) bool {
+	if len(ws.calls) == 0 || ctx.aborted || ctx.throttled || ctx.refused || ctx.stopSequenceMatched() != "" {
+		return false
+	}
+	return len(ctx.toolUseIdByBlockIndex) == 0 && len(ctx.completedToolUseIds) == 0
+}
+
+// nextRound 追加本轮的 tool_use/tool_result 消息，返回续写请求，并为下一轮重置状态
+func (ws *webSearchInterceptor) nextRound(ctx *StreamProcessorContext) types.AnthropicRequest {
+	assistantContent := make([]any, 0, len(ws.calls)+1)
+	if text := ws.roundText.String(); strings.TrimSpace(text) != "" {
+		assistantContent = append(assistantContent, map[string]any{"type": "text", "text": text})
+	}
+	userContent := make([]any, 0, len(ws.calls))
+	for _, call := range ws.calls {
+		assistantContent = append(assistantContent, map[string]any{
+			"type":  "tool_use",
+			"id":    call.id,
+			"name":  call.name,
+			"input": map[string]any{"query": call.query},
+		})
+		userContent = append(userContent, map[string]any{
+			"type":        "tool_result",
+			"tool_use_id": call.id,
+			"content":     call.result,
+			"is_error":    call.isError,
+		})
+	}
+	ws.messages = append(ws.messages,
+		types.AnthropicRequestMessage{Role: "assistant", Content: assistantContent},
+		types.AnthropicRequestMessage{Role: "user", Content: userContent},
+	)
+
+	ws.calls = nil
+	ws.roundText.Reset()
+	ws.pending = make(map[int]*pendingWebSearch)
+	ws.indexOffset = ctx.sseStateManager.NextBlockIndex()
+	ws.rounds++
+
+	req := ctx.req
+	req.Messages = append([]types.AnthropicRequestMessage(nil), ws.messages...)
+	req.AssistantPrefill = ""
+	return req
+}
+
+// annotateUsage 在 message_delta 的 usage 中记录搜索次数（与官方 API 一致）
+func (ws *webSearchInterceptor) annotateUsage(events []map[string]any) {
+	if ws == nil || ws.uses == 0 {
+		return
+	}
+	for _, event := range events {
+		if usage, ok := event["usage"].(map[string]any); ok && event["type"] == "message_delta" {
+			usage["server_tool_use"] = map[string]any{"web_search_requests": ws.uses}
+		}
+	}
+}
+
+// formatWebSearchToolResult 将搜索结果格式化为返回上游的 tool_result 文本
+func formatWebSearchToolResult(query string, results []webSearchResultItem) string {
+	if len(results) == 0 {
+		return fmt.Sprintf("No web search results found for %q.", query)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Web search results for %q:\n", query)
+	for i, r := range results {
+		fmt.Fprintf(&b, "\n%d. %s\nURL: %s\n", i+1, r.Title, r.URL)
+		if r.PageAge != "" {
+			fmt.Fprintf(&b, "Published: %s\n", r.PageAge)
+		}
+		if r.EncryptedContent != "" {
+			fmt.Fprintf(&b, "%s\n", r.EncryptedContent)
+		}
+	}
+	return b.String()
+}
+
+// runWebSearchFollowUps 本轮上游调用了 web_search 时，携带搜索结果继续请求上游并把输出追加到同一条消息
+// 响应已提交，续写请求失败时以错误事件结束流
+func runWebSearchFollowUps(ctx *StreamProcessorContext) error {
+	ws := ctx.webSearch
+	for ws != nil && !ctx.clientDisconnected && ws.needsFollowUp(ctx) {
+		// 超出搜索次数后模型仍会收到 max_uses_exceeded 结果，再多给一轮用于作答
+		if ws.rounds > config.WebSearchMaxUses {
+			break
+		}
+		ctx.closeOpenBlocks()
+		req := ws.nextRound(ctx)
+		ctx.resetForFollowUp()
+
+		resp, err := execWebSearchFollowUp(ctx.c, req, ws.tokenInfo)
+		if err != nil {
+			logger.Error("web_search 续写请求失败", addReqFields(ctx.c, logger.Err(err))...)
+			_ = ctx.sender.SendError(ctx.c, "web_search 续写请求失败", err)
+			ctx.aborted = true
+			return nil
+		}
+		err = NewEventStreamProcessor(ctx).ProcessEventStream(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execWebSearchFollowUp 供测试覆盖的续写请求执行入口
+var execWebSearchFollowUp = executeWebSearchFollowUp
+
+// executeWebSearchFollowUp 发起续写请求
+// 与 executeCodeWhispererRequest 不同，失败时不写出错误响应（此时SSE响应已开始）
+func executeWebSearchFollowUp(c *gin.Context, req types.AnthropicRequest, tokenInfo types.TokenInfo) (*http.Response, error) {
+	httpReq, err := buildCodeWhispererRequest(c, req, tokenInfo, true)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := utils.DoRequest(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	recordAccessUpstream(c, resp.StatusCode)
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		metrics.RecordUpstreamError(resp.StatusCode)
+		return nil, fmt.Errorf("上游返回 %d: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
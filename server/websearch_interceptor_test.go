@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kiro2api/config"
+	"kiro2api/parser"
+	"kiro2api/types"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMCPTestServer 返回固定搜索结果的 MCP JSON-RPC 服务，记录收到的 Authorization 与查询
+func newMCPTestServer(t *testing.T, auth *string, queries *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req mcpJSONRPCRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		*auth = r.Header.Get("Authorization")
+		query, _ := req.Params.Arguments["query"].(string)
+		*queries = append(*queries, query)
+
+		payload := `{"results":[{"title":"Go 1.25 Release Notes","url":"https://go.dev/doc/go1.25","snippet":"Go 1.25 is released."}]}`
+		resp := map[string]any{
+			"jsonrpc": "2.0",
+			"id":      req.ID,
+			"result":  map[string]any{"content": []any{map[string]any{"type": "text", "text": payload}}},
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func TestWebSearchInterceptor_ExecutesSearchAndContinues(t *testing.T) {
+	var auth string
+	var queries []string
+	mcp := newMCPTestServer(t, &auth, &queries)
+	defer mcp.Close()
+
+	origURL, origToken := config.WebSearchMCPURL, config.WebSearchMCPAuthToken
+	config.WebSearchMCPURL, config.WebSearchMCPAuthToken = mcp.URL, "mcp-secret"
+	defer func() { config.WebSearchMCPURL, config.WebSearchMCPAuthToken = origURL, origToken }()
+
+	var followUp types.AnthropicRequest
+	origExec := execWebSearchFollowUp
+	execWebSearchFollowUp = func(_ *gin.Context, req types.AnthropicRequest, _ types.TokenInfo) (*http.Response, error) {
+		followUp = req
+		body := encodeAssistantEventFrame(`{"content":"Go 1.25 is out."}`)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(body))}, nil
+	}
+	defer func() { execWebSearchFollowUp = origExec }()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req := types.AnthropicRequest{
+		Model:        "claude-sonnet-4",
+		Stream:       true,
+		Tools:        []types.AnthropicTool{{Name: "web_search"}, {Name: "get_weather"}},
+		Messages:     []types.AnthropicRequestMessage{{Role: "user", Content: "What's new in Go?"}},
+		WebSearchMCP: true,
+	}
+	sender := &recordingStreamSender{}
+	ctx := NewStreamProcessorContext(c, req, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	ctx.webSearch = newWebSearchInterceptor(req, types.TokenInfo{AccessToken: "account-token"})
+	processor := NewEventStreamProcessor(ctx)
+
+	upstream := []parser.SSEEvent{
+		textDeltaEvent("Let me search."),
+		{Data: map[string]any{"type": "content_block_start", "index": 1, "content_block": map[string]any{
+			"type": "tool_use", "id": "tooluse_1", "name": "web_search", "input": map[string]any{},
+		}}},
+		{Data: map[string]any{"type": "content_block_delta", "index": 1, "delta": map[string]any{
+			"type": "input_json_delta", "partial_json": `{"query":"go 1.25"}`,
+		}}},
+		{Data: map[string]any{"type": "content_block_stop", "index": 1}},
+	}
+	for _, ev := range upstream {
+		require.NoError(t, processor.processEvent(ev))
+	}
+	require.NoError(t, runWebSearchFollowUps(ctx))
+	require.NoError(t, ctx.sendFinalEvents())
+
+	assert.Equal(t, "Bearer mcp-secret", auth)
+	assert.Equal(t, []string{"go 1.25"}, queries)
+
+	// 续写请求携带 tool_use 与 tool_result
+	require.Len(t, followUp.Messages, 3)
+	assistant := followUp.Messages[1].Content.([]any)
+	require.Len(t, assistant, 2)
+	assert.Equal(t, "Let me search.", assistant[0].(map[string]any)["text"])
+	assert.Equal(t, "tooluse_1", assistant[1].(map[string]any)["id"])
+	toolResult := followUp.Messages[2].Content.([]any)[0].(map[string]any)
+	assert.Equal(t, "tooluse_1", toolResult["tool_use_id"])
+	assert.Contains(t, toolResult["content"], "https://go.dev/doc/go1.25")
+
+	// 客户端看到 server_tool_use / web_search_tool_result，续写内容排在其后，不会看到 tool_use
+	blockTypes := map[int]string{}
+	var finalDelta map[string]any
+	for _, event := range sender.events {
+		switch event["type"] {
+		case "content_block_start":
+			cb := event["content_block"].(map[string]any)
+			blockTypes[extractIndex(event)] = cb["type"].(string)
+		case "message_delta":
+			finalDelta = event
+		}
+	}
+	assert.Equal(t, "text", blockTypes[0])
+	assert.Equal(t, "server_tool_use", blockTypes[1])
+	assert.Equal(t, "web_search_tool_result", blockTypes[2])
+	assert.Equal(t, "text", blockTypes[3])
+	for _, typ := range blockTypes {
+		assert.NotEqual(t, "tool_use", typ)
+	}
+
+	require.NotNil(t, finalDelta)
+	assert.Equal(t, "end_turn", finalDelta["delta"].(map[string]any)["stop_reason"])
+	usage := finalDelta["usage"].(map[string]any)
+	assert.Equal(t, map[string]any{"web_search_requests": 1}, usage["server_tool_use"])
+}
+
+func TestWebSearchInterceptor_MaxUsesExceeded(t *testing.T) {
+	origMax := config.WebSearchMaxUses
+	config.WebSearchMaxUses = 0
+	defer func() { config.WebSearchMaxUses = origMax }()
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+	req := types.AnthropicRequest{Model: "claude-sonnet-4", Stream: true, WebSearchMCP: true}
+	sender := &recordingStreamSender{}
+	ctx := NewStreamProcessorContext(c, req, &types.TokenWithUsage{}, sender, "msg_test", 10)
+	ctx.webSearch = newWebSearchInterceptor(req, types.TokenInfo{})
+	processor := NewEventStreamProcessor(ctx)
+
+	require.NoError(t, processor.processEvent(parser.SSEEvent{Data: map[string]any{"type": "content_block_start", "index": 0, "content_block": map[string]any{
+		"type": "tool_use", "id": "tooluse_1", "name": "web_search",
+	}}}))
+	require.NoError(t, processor.processEvent(parser.SSEEvent{Data: map[string]any{"type": "content_block_stop", "index": 0}}))
+
+	require.Len(t, ctx.webSearch.calls, 1)
+	assert.True(t, ctx.webSearch.calls[0].isError)
+	assert.Equal(t, 0, ctx.webSearch.uses)
+
+	var resultBlock map[string]any
+	for _, event := range sender.events {
+		if cb, ok := event["content_block"].(map[string]any); ok && cb["type"] == "web_search_tool_result" {
+			resultBlock = cb
+		}
+	}
+	require.NotNil(t, resultBlock)
+	assert.Equal(t, "max_uses_exceeded", resultBlock["content"].(map[string]any)["error_code"])
+}
+
+func TestRequestUsesWebSearchMCP(t *testing.T) {
+	orig := config.WebSearchMCPEnabled
+	defer func() { config.WebSearchMCPEnabled = orig }()
+
+	req := types.AnthropicRequest{Stream: true, Tools: []types.AnthropicTool{{Name: "get_weather"}, {Name: "web_search"}}}
+
+	config.WebSearchMCPEnabled = false
+	assert.False(t, requestUsesWebSearchMCP(req), "未启用时保持过滤")
+
+	config.WebSearchMCPEnabled = true
+	assert.True(t, requestUsesWebSearchMCP(req))
+
+	nonStream := req
+	nonStream.Stream = false
+	assert.False(t, requestUsesWebSearchMCP(nonStream), "非流式请求保持过滤")
+
+	noSearch := req
+	noSearch.Tools = req.Tools[:1]
+	assert.False(t, requestUsesWebSearchMCP(noSearch))
+}
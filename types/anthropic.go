@@ -91,17 +91,35 @@ type OutputConfig struct {
 
 // AnthropicRequest 表示 Anthropic API 的请求结构
 type AnthropicRequest struct {
-	Model        string                    `json:"model"`
-	MaxTokens    int                       `json:"max_tokens"`
-	Messages     []AnthropicRequestMessage `json:"messages"`
-	System       []AnthropicSystemMessage  `json:"system,omitempty"`
-	Tools        []AnthropicTool           `json:"tools,omitempty"`
-	ToolChoice   any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
-	Stream       bool                      `json:"stream"`
-	Temperature  *float64                  `json:"temperature,omitempty"`
-	Metadata     map[string]any            `json:"metadata,omitempty"`
-	Thinking     *Thinking                 `json:"thinking,omitempty"`       // Claude 深度思考配置
-	OutputConfig *OutputConfig             `json:"output_config,omitempty"`  // 输出配置（adaptive thinking 的 effort）
+	Model         string                    `json:"model"`
+	MaxTokens     int                       `json:"max_tokens"`
+	Messages      []AnthropicRequestMessage `json:"messages"`
+	System        []AnthropicSystemMessage  `json:"system,omitempty"`
+	Tools         []AnthropicTool           `json:"tools,omitempty"`
+	ToolChoice    any                       `json:"tool_choice,omitempty"` // 可以是string或ToolChoice对象
+	Stream        bool                      `json:"stream"`
+	Temperature   *float64                  `json:"temperature,omitempty"`
+	TopP          *float64                  `json:"top_p,omitempty"`
+	TopK          *int                      `json:"top_k,omitempty"`
+	StopSequences []string                  `json:"stop_sequences,omitempty"` // 自定义停止序列（由代理在客户端侧截断）
+	Metadata      map[string]any            `json:"metadata,omitempty"`
+	Thinking      *Thinking                 `json:"thinking,omitempty"`      // Claude 深度思考配置
+	OutputConfig  *OutputConfig             `json:"output_config,omitempty"` // 输出配置（adaptive thinking 的 effort）
+	ServiceTier   string                    `json:"service_tier,omitempty"`  // 服务等级偏好（auto / standard_only），上游只有标准容量
+	// ToolParamMappings 工具参数名截断映射（仅内部使用，用于在响应中还原原始参数名）
+	ToolParamMappings ToolParamMappings `json:"-"`
+	// AssistantPrefill 末尾 assistant 消息的预填充文本（仅内部使用）：非空时上游从该内容续写，响应以其开头
+	AssistantPrefill string `json:"-"`
+	// WebSearchMCP web_search 工具是否由代理通过 MCP 执行（仅内部使用）：为 true 时 web_search 作为普通工具发送到上游
+	WebSearchMCP bool `json:"-"`
+	// IncludeUsage OpenAI stream_options.include_usage（仅内部使用）：流式响应结束前下发 usage chunk
+	IncludeUsage bool `json:"-"`
+	// LegacyFunctionCall OpenAI 请求使用旧版 functions/function_call 格式（仅内部使用）：响应以 function_call 返回工具调用
+	LegacyFunctionCall bool `json:"-"`
+	// DefaultSystemPromptApplied 是否已处理 DEFAULT_SYSTEM_PROMPT 注入（仅内部使用）：避免重复注入
+	DefaultSystemPromptApplied bool `json:"-"`
+	// InterleavedThinking 请求启用了 interleaved-thinking beta（仅内部使用）：thinking.budget_tokens 可以不小于 max_tokens
+	InterleavedThinking bool `json:"-"`
 }
 
 // UnmarshalJSON 自定义反序列化，支持传统 Anthropic API 格式
@@ -169,9 +187,11 @@ type AnthropicRequestMessage struct {
 	Content any    `json:"content"` // 可以是 string 或 []ContentBlock
 }
 
+// AnthropicSystemMessage system 块（多个块按顺序转换，块的 type/cache_control 随块保留）
 type AnthropicSystemMessage struct {
-	Type string `json:"type"`
-	Text string `json:"text"` // 可以是 string 或 []ContentBlock
+	Type         string         `json:"type"`
+	Text         string         `json:"text"` // 可以是 string 或 []ContentBlock
+	CacheControl map[string]any `json:"cache_control,omitempty"`
 }
 
 // ContentBlock 表示消息内容块的结构
@@ -184,7 +204,8 @@ type ContentBlock struct {
 	Input     *any         `json:"input,omitempty"`    // tool_use的输入参数
 	ID        *string      `json:"id,omitempty"`       // tool_use的唯一标识符
 	IsError   *bool        `json:"is_error,omitempty"` // tool_result是否表示错误
-	Source    *ImageSource `json:"source,omitempty"`   // 图片数据源
+	Source    *ImageSource `json:"source,omitempty"`   // 图片/文档数据源
+	Title     *string      `json:"title,omitempty"`    // document的标题
 }
 
 // ImageSource 表示图片数据源的结构
@@ -0,0 +1,66 @@
+package types
+
+import "encoding/json"
+
+// MessageBatchCreateRequest 符合Anthropic Message Batches API的创建请求
+// 参考: https://docs.anthropic.com/en/api/creating-message-batches
+type MessageBatchCreateRequest struct {
+	Requests []MessageBatchRequestItem `json:"requests"`
+}
+
+// MessageBatchRequestItem 批次中的单个请求，params 与 POST /v1/messages 请求体一致
+type MessageBatchRequestItem struct {
+	CustomID string          `json:"custom_id"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// MessageBatch 批次对象
+type MessageBatch struct {
+	ID                string                    `json:"id"`
+	Type              string                    `json:"type"`
+	ProcessingStatus  string                    `json:"processing_status"` // in_progress | ended
+	RequestCounts     MessageBatchRequestCounts `json:"request_counts"`
+	CreatedAt         string                    `json:"created_at"`
+	ExpiresAt         string                    `json:"expires_at"`
+	EndedAt           *string                   `json:"ended_at"`
+	CancelInitiatedAt *string                   `json:"cancel_initiated_at"`
+	ArchivedAt        *string                   `json:"archived_at"`
+	ResultsURL        *string                   `json:"results_url"`
+	// Results 批次结束后附带的结果（扩展字段，便于轮询时直接获取结果）
+	Results []MessageBatchResultItem `json:"results,omitempty"`
+}
+
+// MessageBatchRequestCounts 批次中各状态的请求数量
+type MessageBatchRequestCounts struct {
+	Processing int `json:"processing"`
+	Succeeded  int `json:"succeeded"`
+	Errored    int `json:"errored"`
+	Canceled   int `json:"canceled"`
+	Expired    int `json:"expired"`
+}
+
+// MessageBatchResultItem 单个请求的结果（results JSONL 的一行）
+type MessageBatchResultItem struct {
+	CustomID string             `json:"custom_id"`
+	Result   MessageBatchResult `json:"result"`
+}
+
+// MessageBatchResult 单个请求的处理结果
+// type 为 succeeded 时 message 为完整的 Message 响应；errored 时 error 为标准错误对象
+type MessageBatchResult struct {
+	Type    string          `json:"type"` // succeeded | errored
+	Message json.RawMessage `json:"message,omitempty"`
+	Error   *BatchErrorBody `json:"error,omitempty"`
+}
+
+// BatchErrorBody 标准错误响应体 {"type":"error","error":{...}}
+type BatchErrorBody struct {
+	Type  string           `json:"type"`
+	Error BatchErrorDetail `json:"error"`
+}
+
+// BatchErrorDetail 错误详情
+type BatchErrorDetail struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
@@ -35,6 +35,7 @@ type InferenceConfiguration struct {
 	MaxTokens   int                      `json:"maxTokens,omitempty"`
 	Temperature *float64                 `json:"temperature,omitempty"`
 	TopP        *float64                 `json:"topP,omitempty"`
+	TopK        *int                     `json:"topK,omitempty"`
 	Thinking    *CodeWhispererThinking   `json:"thinking,omitempty"` // 深度思考配置
 }
 
@@ -92,6 +93,9 @@ type HistoryAssistantMessage struct {
 		Content  string         `json:"content"`
 		ToolUses []ToolUseEntry `json:"toolUses"`
 	} `json:"assistantResponseMessage"`
+
+	// Placeholder 内容为转换时注入的占位回复而非客户端消息（不发送给上游）
+	Placeholder bool `json:"-"`
 }
 
 // ToolUseEntry 表示工具使用条目
@@ -1,5 +1,7 @@
 package types
 
+import "encoding/json"
+
 // CountTokensRequest 符合Anthropic官方API规范的token计数请求结构
 // 参考: https://docs.anthropic.com/en/api/messages-count-tokens
 type CountTokensRequest struct {
@@ -9,6 +11,36 @@ type CountTokensRequest struct {
 	Tools    []AnthropicTool           `json:"tools,omitempty"`
 }
 
+// UnmarshalJSON 自定义反序列化：与 AnthropicRequest 一致，system 同时支持字符串与数组格式
+func (r *CountTokensRequest) UnmarshalJSON(data []byte) error {
+	type countTokensRequestAlias CountTokensRequest
+	aux := &struct {
+		*countTokensRequestAlias
+		System json.RawMessage `json:"system,omitempty"`
+	}{
+		countTokensRequestAlias: (*countTokensRequestAlias)(r),
+	}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	r.System = nil
+	if len(aux.System) > 0 {
+		var systemStr string
+		if err := json.Unmarshal(aux.System, &systemStr); err == nil {
+			if systemStr != "" {
+				r.System = []AnthropicSystemMessage{{Type: "text", Text: systemStr}}
+			}
+		} else {
+			var systemArr []AnthropicSystemMessage
+			if err := json.Unmarshal(aux.System, &systemArr); err == nil {
+				r.System = systemArr
+			}
+		}
+	}
+	return nil
+}
+
 // CountTokensResponse 符合Anthropic官方API规范的token计数响应结构
 type CountTokensResponse struct {
 	InputTokens int `json:"input_tokens"`
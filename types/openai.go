@@ -6,6 +6,10 @@ type OpenAIMessage struct {
 	Content    any              `json:"content"` // 可以是 string 或 []ContentBlock
 	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`
 	ToolCallID string           `json:"tool_call_id,omitempty"`
+
+	// 旧版函数调用格式：assistant 消息的 function_call，role=function 消息的 name
+	FunctionCall *OpenAIToolFunction `json:"function_call,omitempty"`
+	Name         string              `json:"name,omitempty"`
 }
 
 type OpenAIToolCall struct {
@@ -42,13 +46,54 @@ type OpenAIToolChoiceFunction struct {
 }
 
 type OpenAIRequest struct {
-	Model       string          `json:"model"`
-	Messages    []OpenAIMessage `json:"messages"`
-	MaxTokens   *int            `json:"max_tokens,omitempty"`
-	Temperature *float64        `json:"temperature,omitempty"`
-	Stream      *bool           `json:"stream,omitempty"`
-	Tools       []OpenAITool    `json:"tools,omitempty"`
-	ToolChoice  any             `json:"tool_choice,omitempty"` // 可以是 "auto", "none", "required" 或 OpenAIToolChoice
+	Model               string          `json:"model"`
+	Messages            []OpenAIMessage `json:"messages"`
+	MaxTokens           *int            `json:"max_tokens,omitempty"`            // 已弃用，新版客户端使用 max_completion_tokens
+	MaxCompletionTokens *int            `json:"max_completion_tokens,omitempty"` // 输出上限，优先于 max_tokens
+	Temperature         *float64        `json:"temperature,omitempty"`
+	TopP                *float64        `json:"top_p,omitempty"`
+	Stream              *bool           `json:"stream,omitempty"`
+	N                   *int            `json:"n,omitempty"` // 生成的 choice 数量，每个 choice 单独请求上游
+	Tools               []OpenAITool    `json:"tools,omitempty"`
+	ToolChoice          any             `json:"tool_choice,omitempty"` // 可以是 "auto", "none", "required" 或 OpenAIToolChoice
+
+	// 旧版函数调用格式（已被 tools / tool_choice 取代）
+	Functions    []OpenAIFunction `json:"functions,omitempty"`
+	FunctionCall any              `json:"function_call,omitempty"` // 可以是 "auto", "none" 或 {"name": "..."}
+
+	ResponseFormat *OpenAIResponseFormat `json:"response_format,omitempty"` // 结构化输出：text / json_object / json_schema
+	StreamOptions  *OpenAIStreamOptions  `json:"stream_options,omitempty"`  // 流式选项：include_usage
+
+	// 上游不支持的采样参数：仅用于向客户端反馈未生效，不转发
+	Seed      *int64             `json:"seed,omitempty"`
+	LogitBias map[string]float64 `json:"logit_bias,omitempty"`
+}
+
+// MaxOutputTokens 返回客户端指定的输出上限：优先 max_completion_tokens，其次已弃用的 max_tokens，都未设置时返回 nil
+func (r *OpenAIRequest) MaxOutputTokens() *int {
+	if r.MaxCompletionTokens != nil {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// OpenAIStreamOptions 表示OpenAI的 stream_options
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"` // 为 true 时在 [DONE] 前下发带 usage 的 chunk
+}
+
+// OpenAIResponseFormat 表示OpenAI的 response_format（结构化输出）
+type OpenAIResponseFormat struct {
+	Type       string            `json:"type"`                  // "text", "json_object", "json_schema"
+	JSONSchema *OpenAIJSONSchema `json:"json_schema,omitempty"` // type 为 json_schema 时有效
+}
+
+// OpenAIJSONSchema 表示 response_format.json_schema
+type OpenAIJSONSchema struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      *bool          `json:"strict,omitempty"`
 }
 
 type OpenAIChoice struct {
@@ -17,9 +17,13 @@ type Token struct {
 }
 
 // FromRefreshResponse 从RefreshResponse创建Token
+// 响应携带新的 refresh token（上游轮换）时使用新值，否则保持原始refresh token
 func (t *Token) FromRefreshResponse(resp RefreshResponse, originalRefreshToken string) {
 	t.AccessToken = resp.AccessToken
-	t.RefreshToken = originalRefreshToken // 保持原始refresh token
+	t.RefreshToken = originalRefreshToken
+	if resp.RefreshToken != "" {
+		t.RefreshToken = resp.RefreshToken
+	}
 	t.ExpiresIn = resp.ExpiresIn
 	t.ProfileArn = resp.ProfileArn
 	t.ExpiresAt = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
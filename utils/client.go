@@ -25,6 +25,8 @@ func init() {
 
 	// 创建统一的HTTP客户端
 	SharedHTTPClient = &http.Client{
+		// 总超时（UPSTREAM_TIMEOUT），覆盖连接、请求发送与响应体读取
+		Timeout: config.UpstreamTimeout,
 		Transport: &http.Transport{
 			// {{RIPER-10 Action}}
 			// Role: LD | Time: 2025-12-14T13:54:45Z
@@ -32,15 +34,15 @@ func init() {
 			// Taste: 使用标准库 http.ProxyFromEnvironment，自动读取 HTTP_PROXY/HTTPS_PROXY/NO_PROXY
 			Proxy: http.ProxyFromEnvironment,
 
-			// 连接池配置
-			MaxIdleConns:        200,
-			MaxIdleConnsPerHost: 100,
+			// 连接池配置（UPSTREAM_MAX_IDLE_CONNS / UPSTREAM_MAX_IDLE_CONNS_PER_HOST / UPSTREAM_IDLE_CONN_TIMEOUT）
+			MaxIdleConns:        config.UpstreamMaxIdleConns,
+			MaxIdleConnsPerHost: config.UpstreamMaxIdleConnsPerHost,
 			MaxConnsPerHost:     100,
-			IdleConnTimeout:     120 * time.Second,
+			IdleConnTimeout:     config.UpstreamIdleConnTimeout,
 
 			// 连接建立配置
 			DialContext: (&net.Dialer{
-				Timeout:   15 * time.Second,
+				Timeout:   config.UpstreamConnectTimeout,
 				KeepAlive: config.HTTPClientKeepAlive,
 				DualStack: true,
 			}).DialContext,
@@ -102,7 +104,24 @@ func GetTLSMinVersion() uint16 {
 }
 
 // DoRequest 执行HTTP请求
+// 请求上下文中携带出口代理（WithProxyURL）时，使用该代理对应的客户端
+// 配置 UPSTREAM_REPLAY_DIR 时录制或回放上游响应
 func DoRequest(req *http.Request) (*http.Response, error) {
+	if upstreamReplayEnabled() {
+		return doReplayableRequest(req, doRequest)
+	}
+	return doRequest(req)
+}
+
+// doRequest 直接发送HTTP请求（不经过录制/回放）
+func doRequest(req *http.Request) (*http.Response, error) {
+	if proxyURL := ProxyURLFromContext(req.Context()); proxyURL != "" {
+		client, err := clientForProxy(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		return client.Do(req)
+	}
 	return SharedHTTPClient.Do(req)
 }
 
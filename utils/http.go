@@ -2,7 +2,11 @@ package utils
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
+	"net"
+	"syscall"
 )
 
 // ReadHTTPResponse 通用的HTTP响应体读取函数（使用对象池优化）
@@ -29,3 +33,22 @@ func ReadHTTPResponse(body io.Reader) ([]byte, error) {
 		}
 	}
 }
+
+// IsConnectNetError 判断请求错误是否发生在建立连接阶段（请求尚未发送，重试不会重复提交）
+// 包括连接被拒绝、连接建立失败/超时与 DNS 临时失败；连接建立后的重置、EOF 与读取超时不算在内
+// 上下文取消或超过截止时间不可重试；DNS 解析结果为不存在时不可重试
+func IsConnectNetError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -2,11 +2,20 @@ package utils
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"strings"
+	"syscall"
 	"testing"
 
+	"kiro2api/config"
+
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestReadHTTPResponse_Success(t *testing.T) {
@@ -116,3 +125,29 @@ func TestReadHTTPResponse_ExactlyOneKB(t *testing.T) {
 	assert.Equal(t, 1024, len(result))
 	assert.Equal(t, testData, string(result))
 }
+
+func TestIsConnectNetError(t *testing.T) {
+	assert.False(t, IsConnectNetError(nil))
+	assert.False(t, IsConnectNetError(context.Canceled))
+	assert.False(t, IsConnectNetError(fmt.Errorf("Post: %w", context.DeadlineExceeded)))
+	assert.False(t, IsConnectNetError(errors.New("invalid request")))
+
+	// 连接建立阶段的错误可重试
+	assert.True(t, IsConnectNetError(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}))
+	assert.True(t, IsConnectNetError(&net.OpError{Op: "dial", Err: errors.New("i/o timeout")}))
+	assert.True(t, IsConnectNetError(&net.DNSError{Err: "server misbehaving", IsTemporary: true}))
+	assert.False(t, IsConnectNetError(&net.DNSError{Err: "no such host", IsNotFound: true}))
+
+	// 请求可能已发送：连接重置、EOF 不重试，避免重复提交非幂等请求
+	assert.False(t, IsConnectNetError(&net.OpError{Op: "read", Err: syscall.ECONNRESET}))
+	assert.False(t, IsConnectNetError(fmt.Errorf("Post: %w", io.EOF)))
+	assert.False(t, IsConnectNetError(fmt.Errorf("Post: %w", io.ErrUnexpectedEOF)))
+}
+
+func TestSharedHTTPClient_UsesPoolingConfig(t *testing.T) {
+	transport, ok := SharedHTTPClient.Transport.(*http.Transport)
+	require.True(t, ok)
+	assert.Equal(t, config.UpstreamMaxIdleConns, transport.MaxIdleConns)
+	assert.Equal(t, config.UpstreamMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, config.UpstreamIdleConnTimeout, transport.IdleConnTimeout)
+}
@@ -17,6 +17,8 @@ var SupportedImageFormats = map[string]string{
 	".gif":  "image/gif",
 	".webp": "image/webp",
 	".bmp":  "image/bmp",
+	".heic": "image/heic",
+	".heif": "image/heif",
 }
 
 // MaxImageSize 最大图片大小 (20MB)
@@ -82,6 +84,10 @@ func GetImageFormatFromMediaType(mediaType string) string {
 		return "webp"
 	case "image/bmp":
 		return "bmp"
+	case "image/heic":
+		return "heic"
+	case "image/heif":
+		return "heif"
 	default:
 		return ""
 	}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+// 图片缩放与重新编码
+// 支持 JPEG/PNG/GIF/WebP/BMP 解码，JPEG/PNG/GIF 编码；WebP/BMP 需要重新编码时输出 PNG
+
+const (
+	// imageShrinkFactor 每轮缩小的边长比例
+	imageShrinkFactor = 0.75
+	// imageMaxAttempts 最多尝试的重新编码次数
+	imageMaxAttempts = 8
+	// imageMinDimension 缩放后最短边的下限，避免图片失去可读性
+	imageMinDimension = 64
+)
+
+// jpegQualitySteps JPEG 先逐步降低质量，再缩小尺寸
+var jpegQualitySteps = []int{85, 70, 55}
+
+// DownscaleImage 将图片缩放/重新编码到不超过 maxBytes 字节且最长边不超过 maxDimension 像素
+// format 为 CodeWhisperer 图片格式（jpeg/png/gif/webp/bmp），maxBytes/maxDimension <= 0 表示不限制
+// 返回新的图片数据、格式以及是否发生了变化；尽量保留原格式，PNG/GIF 无法压到阈值内时回退为 JPEG
+func DownscaleImage(data []byte, format string, maxBytes, maxDimension int) ([]byte, string, bool, error) {
+	tooLarge := maxBytes > 0 && len(data) > maxBytes
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if tooLarge {
+			return data, format, false, fmt.Errorf("无法解码 %s 图片: %v", format, err)
+		}
+		return data, format, false, nil
+	}
+
+	longest := max(cfg.Width, cfg.Height)
+	tooWide := maxDimension > 0 && longest > maxDimension
+	if !tooLarge && !tooWide {
+		return data, format, false, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data, format, false, fmt.Errorf("无法解码 %s 图片: %v", format, err)
+	}
+
+	scale := 1.0
+	if tooWide {
+		scale = float64(maxDimension) / float64(longest)
+	}
+
+	outFormat := format
+	if outFormat != "jpeg" && outFormat != "png" && outFormat != "gif" {
+		outFormat = "png"
+	}
+
+	var best []byte
+	bestFormat := outFormat
+	qualityIdx := 0
+	for attempt := 0; attempt < imageMaxAttempts; attempt++ {
+		width := max(1, int(float64(cfg.Width)*scale))
+		height := max(1, int(float64(cfg.Height)*scale))
+
+		var resized image.Image = img
+		if scale < 1 {
+			resized = resizeImage(img, width, height)
+		}
+
+		quality := jpegQualitySteps[min(qualityIdx, len(jpegQualitySteps)-1)]
+		encoded, encErr := encodeImage(resized, outFormat, quality)
+		if encErr != nil {
+			return data, format, false, encErr
+		}
+		if best == nil || len(encoded) < len(best) {
+			best, bestFormat = encoded, outFormat
+		}
+		if maxBytes <= 0 || len(encoded) <= maxBytes {
+			return encoded, outFormat, true, nil
+		}
+
+		switch {
+		case outFormat == "jpeg" && qualityIdx < len(jpegQualitySteps)-1:
+			qualityIdx++
+		case min(width, height) <= imageMinDimension:
+			// 已经缩到下限：无损格式回退为 JPEG，否则放弃
+			if outFormat == "jpeg" {
+				return best, bestFormat, true, nil
+			}
+			outFormat = "jpeg"
+		default:
+			scale *= imageShrinkFactor
+		}
+	}
+
+	return best, bestFormat, true, nil
+}
+
+// encodeImage 按格式编码图片
+func encodeImage(img image.Image, format string, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, flattenImage(img), &jpeg.Options{Quality: quality})
+	case "png":
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, &gif.Options{NumColors: 256})
+	default:
+		return nil, fmt.Errorf("不支持编码的图片格式: %s", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("编码 %s 图片失败: %v", format, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// flattenImage 将透明区域合成到白色背景（JPEG 不支持透明通道）
+func flattenImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Over)
+	return dst
+}
+
+// resizeImage 使用区域平均（box filter）缩小图片，缩小场景下效果接近双线性且无需额外依赖
+func resizeImage(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+
+	for y := 0; y < height; y++ {
+		sy0 := bounds.Min.Y + y*srcH/height
+		sy1 := max(sy0+1, bounds.Min.Y+(y+1)*srcH/height)
+		for x := 0; x < width; x++ {
+			sx0 := bounds.Min.X + x*srcW/width
+			sx1 := max(sx0+1, bounds.Min.X+(x+1)*srcW/width)
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					b += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r / n) >> 8),
+				G: uint8((g / n) >> 8),
+				B: uint8((b / n) >> 8),
+				A: uint8((a / n) >> 8),
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newNoisyImage 生成随机噪声图片（难以压缩，便于测试字节阈值）
+func newNoisyImage(width, height int) *image.RGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255})
+		}
+	}
+	return img
+}
+
+func TestDownscaleImage_WithinLimitsUnchanged(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, newNoisyImage(32, 32)))
+
+	out, format, changed, err := DownscaleImage(buf.Bytes(), "png", 0, 1024)
+	require.NoError(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, buf.Bytes(), out)
+}
+
+func TestDownscaleImage_MaxDimensionPreservesFormat(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, newNoisyImage(400, 200)))
+
+	out, format, changed, err := DownscaleImage(buf.Bytes(), "png", 0, 100)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "png", format)
+
+	cfg, decodedFormat, err := image.DecodeConfig(bytes.NewReader(out))
+	require.NoError(t, err)
+	assert.Equal(t, "png", decodedFormat)
+	assert.Equal(t, 100, cfg.Width)
+	assert.Equal(t, 50, cfg.Height)
+}
+
+func TestDownscaleImage_MaxBytes(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, newNoisyImage(512, 512), &jpeg.Options{Quality: 100}))
+	maxBytes := buf.Len() / 4
+
+	out, format, changed, err := DownscaleImage(buf.Bytes(), "jpeg", maxBytes, 0)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, "jpeg", format)
+	assert.LessOrEqual(t, len(out), maxBytes)
+}
+
+func TestDownscaleImage_UndecodableTooLarge(t *testing.T) {
+	data := bytes.Repeat([]byte{0x42, 0x4D}, 64)
+
+	out, format, changed, err := DownscaleImage(data, "bmp", 16, 0)
+	assert.Error(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, "bmp", format)
+	assert.Equal(t, data, out)
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"slices"
+
+	// 注册 WebP/BMP 解码器，使其可以转码或缩放
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+// transcodeTargets 转码目标格式的优先顺序：PNG 无损，上游不接受 PNG 时退回 JPEG
+var transcodeTargets = []string{"png", "jpeg"}
+
+// TranscodeImage 将上游不支持的图片转码为 supported 中的格式
+// format 为 CodeWhisperer 图片格式；已在 supported 中时原样返回
+// 仅能转码已注册 Go 解码器的格式（JPEG/PNG/GIF/WebP/BMP），HEIC 等无法解码时返回带格式名的错误
+func TranscodeImage(data []byte, format string, supported []string) ([]byte, string, error) {
+	if slices.Contains(supported, format) {
+		return data, format, nil
+	}
+
+	target := ""
+	for _, candidate := range transcodeTargets {
+		if slices.Contains(supported, candidate) {
+			target = candidate
+			break
+		}
+	}
+	if target == "" {
+		return nil, "", fmt.Errorf("上游不支持 %s 图片，且没有可转码的目标格式（支持: %v）", format, supported)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("上游不支持 %s 图片，且无法转码为 %s: %v", format, target, err)
+	}
+
+	encoded, err := encodeImage(img, target, jpegQualitySteps[0])
+	if err != nil {
+		return nil, "", err
+	}
+	return encoded, target, nil
+}
@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/gif"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestTranscodeImage_SupportedUnchanged(t *testing.T) {
+	data := []byte("not decoded")
+
+	out, format, err := TranscodeImage(data, "png", []string{"jpeg", "png"})
+	require.NoError(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, data, out)
+}
+
+func TestTranscodeImage_DecodableToPNG(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, gif.Encode(&buf, newNoisyImage(16, 8), nil))
+
+	out, format, err := TranscodeImage(buf.Bytes(), "gif", []string{"jpeg", "png"})
+	require.NoError(t, err)
+	assert.Equal(t, "png", format)
+
+	cfg, decodedFormat, err := image.DecodeConfig(bytes.NewReader(out))
+	require.NoError(t, err)
+	assert.Equal(t, "png", decodedFormat)
+	assert.Equal(t, 16, cfg.Width)
+	assert.Equal(t, 8, cfg.Height)
+
+	// 上游不接受 PNG 时退回 JPEG
+	_, format, err = TranscodeImage(buf.Bytes(), "gif", []string{"jpeg"})
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+}
+
+func TestTranscodeImage_WebPAndBMP(t *testing.T) {
+	// 1x1 无损 WebP
+	webp, err := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+	require.NoError(t, err)
+
+	out, format, err := TranscodeImage(webp, "webp", []string{"jpeg", "png"})
+	require.NoError(t, err)
+	assert.Equal(t, "png", format)
+	cfg, decodedFormat, err := image.DecodeConfig(bytes.NewReader(out))
+	require.NoError(t, err)
+	assert.Equal(t, "png", decodedFormat)
+	assert.Equal(t, 1, cfg.Width)
+
+	var buf bytes.Buffer
+	require.NoError(t, bmp.Encode(&buf, newNoisyImage(16, 8)))
+	out, format, err = TranscodeImage(buf.Bytes(), "bmp", []string{"jpeg"})
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	cfg, decodedFormat, err = image.DecodeConfig(bytes.NewReader(out))
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", decodedFormat)
+	assert.Equal(t, 16, cfg.Width)
+}
+
+func TestTranscodeImage_UndecodableNamesFormat(t *testing.T) {
+	heic := []byte("\x00\x00\x00\x18ftypheic")
+
+	_, _, err := TranscodeImage(heic, "heic", []string{"jpeg", "png"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "heic")
+
+	_, _, err = TranscodeImage(heic, "heic", []string{"gif"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "没有可转码的目标格式")
+}
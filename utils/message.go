@@ -38,6 +38,9 @@ func ParseToolResultContent(content any) string {
 					if text, ok := itemVal["text"].(string); ok && text != "" {
 						result.WriteString(text + "\n")
 					}
+				} else if itemType == "image" || itemType == "image_url" {
+					// 图片随 toolResults 单独发送，文本中只保留占位，避免写入base64数据
+					result.WriteString("[image]\n")
 				} else if text, ok := itemVal["text"].(string); ok && text != "" {
 					// 处理包含text字段但没有type的对象
 					result.WriteString(text + "\n")
@@ -76,6 +79,10 @@ func ParseToolResultContent(content any) string {
 			}
 		}
 
+		if contentType, ok := v["type"].(string); ok && (contentType == "image" || contentType == "image_url") {
+			return "[image]"
+		}
+
 		// 检查是否有直接的text字段
 		if text, ok := v["text"].(string); ok {
 			if text == "" {
@@ -0,0 +1,514 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"kiro2api/config"
+)
+
+// PDF 文本提取
+// 仅依赖标准库的尽力而为实现：解析未压缩或 FlateDecode 压缩的内容流中的文本绘制操作符
+// （Tj / TJ / ' / "），不处理加密文档、扫描件以及依赖 ToUnicode 映射的复合字体
+
+// pdfTJSpaceThreshold TJ 数组中超过该字距调整量（千分之一字号）时视为单词间隔
+const pdfTJSpaceThreshold = 200
+
+// pdfMaxInflatedStreamSize 单个 FlateDecode 流解压后的最大字节数，超过时放弃该流（防止压缩炸弹）
+const pdfMaxInflatedStreamSize = 16 << 20
+
+// pdfInflatedBudgetFactor 所有流解压后的总字节预算为文档大小上限（DOCUMENT_MAX_BYTES）的倍数，
+// 防止大量小流各自贴近单流上限累积成压缩炸弹
+const pdfInflatedBudgetFactor = 4
+
+// ExtractPDFText 提取PDF中的文本内容
+func ExtractPDFText(data []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("%PDF-")) {
+		return "", fmt.Errorf("不是有效的PDF文件")
+	}
+	if bytes.Contains(data, []byte("/Encrypt")) {
+		return "", fmt.Errorf("不支持加密的PDF文件")
+	}
+
+	var out strings.Builder
+	var tooLong bool
+	forEachPDFContentStream(data, pdfInflatedBudget(len(data)), func(stream []byte) bool {
+		extractPDFStreamText(stream, &out)
+		// 原始文本未超限时规范化后也不会超限，只在必要时才做规范化
+		if limit := config.DocumentMaxTextChars; limit > 0 && utf8.RuneCountInString(out.String()) > limit &&
+			utf8.RuneCountInString(normalizePDFText(out.String())) > limit {
+			tooLong = true
+			return false
+		}
+		return true
+	})
+	if tooLong {
+		return "", fmt.Errorf("文档文本过长: 超过 %d 字符（DOCUMENT_MAX_TEXT_CHARS）", config.DocumentMaxTextChars)
+	}
+
+	text := normalizePDFText(out.String())
+	if text == "" {
+		return "", fmt.Errorf("PDF中未找到可提取的文本（可能是扫描件或使用了不支持的字体编码）")
+	}
+	return text, nil
+}
+
+// pdfInflatedBudget 返回单个文档所有 FlateDecode 流解压后的总字节预算
+// DOCUMENT_MAX_BYTES 为 0 时按文档自身大小计算，且不低于单流上限
+func pdfInflatedBudget(size int) int64 {
+	base := int64(config.DocumentMaxBytes)
+	if base <= 0 {
+		base = max(int64(size), pdfMaxInflatedStreamSize)
+	}
+	return base * pdfInflatedBudgetFactor
+}
+
+// forEachPDFContentStream 依次解压可能包含文本的流并交给 fn 处理，fn 返回 false 时停止
+// 图片、字体程序等二进制流以及无法解码的流会被跳过；解压总量超过 budget 时停止扫描
+func forEachPDFContentStream(data []byte, budget int64, fn func(stream []byte) bool) {
+	pos := 0
+	for {
+		rel := bytes.Index(data[pos:], []byte("stream"))
+		if rel < 0 {
+			return
+		}
+		kw := pos + rel
+		pos = kw + len("stream")
+		if kw >= 3 && string(data[kw-3:kw]) == "end" {
+			continue
+		}
+
+		// 流数据从 stream 关键字后的换行开始
+		start := pos
+		if start < len(data) && data[start] == '\r' {
+			start++
+		}
+		if start < len(data) && data[start] == '\n' {
+			start++
+		}
+		endRel := bytes.Index(data[start:], []byte("endstream"))
+		if endRel < 0 {
+			return
+		}
+		end := start + endRel
+		pos = end + len("endstream")
+
+		// 流字典位于所属对象的 obj 关键字与 stream 关键字之间
+		dictStart := bytes.LastIndex(data[:kw], []byte("obj"))
+		if dictStart < 0 {
+			dictStart = 0
+		}
+		dict := data[dictStart:kw]
+		if bytes.Contains(dict, []byte("/Image")) || bytes.Contains(dict, []byte("/Length1")) ||
+			bytes.Contains(dict, []byte("/XRef")) || bytes.Contains(dict, []byte("/Metadata")) {
+			continue
+		}
+
+		raw := bytes.TrimRight(data[start:end], "\r\n")
+		switch {
+		case bytes.Contains(dict, []byte("/FlateDecode")):
+			// 剩余预算不足单流上限时，超出剩余预算的流同样被放弃，之后不再解压任何流
+			decoded, ok := inflatePDFStreamLimit(raw, min(pdfMaxInflatedStreamSize, budget))
+			if !ok {
+				if budget < pdfMaxInflatedStreamSize {
+					return
+				}
+				continue
+			}
+			budget -= int64(len(decoded))
+			if !fn(decoded) {
+				return
+			}
+		case bytes.Contains(dict, []byte("/Filter")):
+			// 其他编码（DCT、LZW、ASCII85 等）不处理
+			continue
+		default:
+			if !fn(raw) {
+				return
+			}
+		}
+	}
+}
+
+// inflatePDFStreamLimit 解压 FlateDecode 流，数据被截断时保留已解压的部分
+// 解压结果超过 limit 时放弃该流
+func inflatePDFStreamLimit(raw []byte, limit int64) ([]byte, bool) {
+	r, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	decoded, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if int64(len(decoded)) > limit {
+		return nil, false
+	}
+	if err != nil && len(decoded) == 0 {
+		return nil, false
+	}
+	return decoded, true
+}
+
+// pdfOperand 内容流中的操作数：字符串、数字或数组
+type pdfOperand struct {
+	str    string
+	isStr  bool
+	num    float64
+	isNum  bool
+	array  []pdfOperand
+	isList bool
+}
+
+// extractPDFStreamText 解析内容流中的文本操作符并写入 out
+func extractPDFStreamText(stream []byte, out *strings.Builder) {
+	var operands []pdfOperand
+	inText := false
+	s := &pdfScanner{data: stream}
+
+	for {
+		tok, operand, ok := s.next()
+		if !ok {
+			return
+		}
+		if operand != nil {
+			operands = append(operands, *operand)
+			continue
+		}
+
+		switch tok {
+		case "BT":
+			inText = true
+		case "ET":
+			inText = false
+			out.WriteByte('\n')
+		case "Tj":
+			if inText {
+				writeLastPDFString(operands, out)
+			}
+		case "'", "\"":
+			if inText {
+				out.WriteByte('\n')
+				writeLastPDFString(operands, out)
+			}
+		case "TJ":
+			if inText && len(operands) > 0 && operands[len(operands)-1].isList {
+				for _, item := range operands[len(operands)-1].array {
+					if item.isStr {
+						out.WriteString(item.str)
+					} else if item.isNum && item.num < -pdfTJSpaceThreshold {
+						out.WriteByte(' ')
+					}
+				}
+			}
+		case "T*":
+			if inText {
+				out.WriteByte('\n')
+			}
+		case "Td", "TD":
+			// 纵向移动视为换行，横向移动视为空格
+			if inText && len(operands) >= 2 {
+				if operands[len(operands)-1].num != 0 {
+					out.WriteByte('\n')
+				} else if operands[len(operands)-2].num != 0 {
+					out.WriteByte(' ')
+				}
+			}
+		case "Tm":
+			if inText {
+				out.WriteByte('\n')
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+// writeLastPDFString 输出最后一个字符串操作数
+func writeLastPDFString(operands []pdfOperand, out *strings.Builder) {
+	if len(operands) > 0 && operands[len(operands)-1].isStr {
+		out.WriteString(operands[len(operands)-1].str)
+	}
+}
+
+// pdfScanner 内容流词法分析器
+type pdfScanner struct {
+	data []byte
+	pos  int
+}
+
+// next 返回下一个操作符（tok）或操作数（operand），数据结束时 ok 为 false
+func (s *pdfScanner) next() (tok string, operand *pdfOperand, ok bool) {
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case isPDFWhitespace(c):
+			s.pos++
+		case c == '%':
+			for s.pos < len(s.data) && s.data[s.pos] != '\n' && s.data[s.pos] != '\r' {
+				s.pos++
+			}
+		case c == '(':
+			s.pos++
+			return "", &pdfOperand{str: decodePDFString(s.readLiteral()), isStr: true}, true
+		case c == '<' && s.pos+1 < len(s.data) && s.data[s.pos+1] == '<':
+			// 内联字典（如标记内容属性），整体跳过
+			s.skipDict()
+		case c == '<':
+			s.pos++
+			return "", &pdfOperand{str: decodePDFString(s.readHex()), isStr: true}, true
+		case c == '[':
+			s.pos++
+			return "", &pdfOperand{array: s.readArray(), isList: true}, true
+		case c == ']' || c == '>' || c == '{' || c == '}' || c == ')':
+			s.pos++
+		case c == '/':
+			// 名称对象（字体名、资源名等），作为占位操作数
+			s.pos++
+			s.readRegular()
+			return "", &pdfOperand{}, true
+		default:
+			word := s.readRegular()
+			if word == "" {
+				s.pos++
+				continue
+			}
+			if num, err := strconv.ParseFloat(word, 64); err == nil {
+				return "", &pdfOperand{num: num, isNum: true}, true
+			}
+			if word == "BI" {
+				s.skipInlineImage()
+				continue
+			}
+			return word, nil, true
+		}
+	}
+	return "", nil, false
+}
+
+// readLiteral 读取括号字符串（已跳过开头的 '('），处理嵌套括号与转义
+func (s *pdfScanner) readLiteral() []byte {
+	var buf []byte
+	depth := 1
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		s.pos++
+		switch c {
+		case '\\':
+			if s.pos >= len(s.data) {
+				return buf
+			}
+			e := s.data[s.pos]
+			s.pos++
+			switch e {
+			case 'n':
+				buf = append(buf, '\n')
+			case 'r':
+				buf = append(buf, '\r')
+			case 't':
+				buf = append(buf, '\t')
+			case 'b':
+				buf = append(buf, '\b')
+			case 'f':
+				buf = append(buf, '\f')
+			case '\r':
+				// 续行
+				if s.pos < len(s.data) && s.data[s.pos] == '\n' {
+					s.pos++
+				}
+			case '\n':
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && s.pos < len(s.data) && s.data[s.pos] >= '0' && s.data[s.pos] <= '7'; i++ {
+						v = v*8 + int(s.data[s.pos]-'0')
+						s.pos++
+					}
+					buf = append(buf, byte(v))
+				} else {
+					buf = append(buf, e)
+				}
+			}
+		case '(':
+			depth++
+			buf = append(buf, c)
+		case ')':
+			depth--
+			if depth == 0 {
+				return buf
+			}
+			buf = append(buf, c)
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// readHex 读取十六进制字符串（已跳过开头的 '<'）
+func (s *pdfScanner) readHex() []byte {
+	var digits []byte
+	for s.pos < len(s.data) && s.data[s.pos] != '>' {
+		if c := s.data[s.pos]; isHexDigit(c) {
+			digits = append(digits, c)
+		}
+		s.pos++
+	}
+	s.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	buf := make([]byte, len(digits)/2)
+	for i := range buf {
+		v, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		buf[i] = byte(v)
+	}
+	return buf
+}
+
+// readArray 读取数组（已跳过开头的 '['），仅保留字符串与数字元素
+func (s *pdfScanner) readArray() []pdfOperand {
+	var items []pdfOperand
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == ']':
+			s.pos++
+			return items
+		case isPDFWhitespace(c):
+			s.pos++
+		case c == '(':
+			s.pos++
+			items = append(items, pdfOperand{str: decodePDFString(s.readLiteral()), isStr: true})
+		case c == '<':
+			s.pos++
+			items = append(items, pdfOperand{str: decodePDFString(s.readHex()), isStr: true})
+		default:
+			word := s.readRegular()
+			if word == "" {
+				s.pos++
+				continue
+			}
+			if num, err := strconv.ParseFloat(word, 64); err == nil {
+				items = append(items, pdfOperand{num: num, isNum: true})
+			}
+		}
+	}
+	return items
+}
+
+// readRegular 读取普通字符序列（直到空白或分隔符）
+func (s *pdfScanner) readRegular() string {
+	start := s.pos
+	for s.pos < len(s.data) && !isPDFWhitespace(s.data[s.pos]) && !isPDFDelimiter(s.data[s.pos]) {
+		s.pos++
+	}
+	return string(s.data[start:s.pos])
+}
+
+// skipDict 跳过 << ... >>（支持嵌套）
+func (s *pdfScanner) skipDict() {
+	depth := 0
+	for s.pos+1 < len(s.data) {
+		switch {
+		case s.data[s.pos] == '<' && s.data[s.pos+1] == '<':
+			depth++
+			s.pos += 2
+		case s.data[s.pos] == '>' && s.data[s.pos+1] == '>':
+			depth--
+			s.pos += 2
+			if depth == 0 {
+				return
+			}
+		case s.data[s.pos] == '(':
+			s.pos++
+			s.readLiteral()
+		default:
+			s.pos++
+		}
+	}
+	s.pos = len(s.data)
+}
+
+// skipInlineImage 跳过内联图片数据（BI ... ID <data> EI）
+func (s *pdfScanner) skipInlineImage() {
+	for i := s.pos; i+1 < len(s.data); i++ {
+		if s.data[i] != 'E' || s.data[i+1] != 'I' {
+			continue
+		}
+		before := i == 0 || isPDFWhitespace(s.data[i-1])
+		after := i+2 >= len(s.data) || isPDFWhitespace(s.data[i+2])
+		if before && after {
+			s.pos = i + 2
+			return
+		}
+	}
+	s.pos = len(s.data)
+}
+
+// decodePDFString 将PDF字符串转换为UTF-8：带BOM的按UTF-16BE解码，否则按单字节编码解释
+func decodePDFString(b []byte) string {
+	if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		units := make([]uint16, 0, (len(b)-2)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// normalizePDFText 去除控制字符，合并多余空行与行尾空白
+func normalizePDFText(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r == '\r' {
+			return '\n'
+		}
+		if r < 0x20 || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, text)
+
+	lines := strings.Split(text, "\n")
+	kept := make([]string, 0, len(lines))
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if strings.TrimSpace(line) == "" {
+			if !blank && len(kept) > 0 {
+				kept = append(kept, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		kept = append(kept, line)
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+func isPDFWhitespace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
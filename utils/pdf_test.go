@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildTestPDF 构造只包含一个内容流的最小PDF
+func buildTestPDF(content []byte, flate bool) []byte {
+	stream := content
+	filter := ""
+	if flate {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(content)
+		zw.Close()
+		stream = buf.Bytes()
+		filter = " /Filter /FlateDecode"
+	}
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	pdf.WriteString("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	pdf.WriteString("2 0 obj\n<< /Type /Pages /Kids [3 0 R] /Count 1 >>\nendobj\n")
+	pdf.WriteString("3 0 obj\n<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>\nendobj\n")
+	fmt.Fprintf(&pdf, "4 0 obj\n<< /Length %d%s >>\nstream\n", len(stream), filter)
+	pdf.Write(stream)
+	pdf.WriteString("\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return pdf.Bytes()
+}
+
+const testPDFContent = `BT
+/F1 12 Tf
+72 712 Td
+(Hello \(PDF\) World) Tj
+0 -14 Td
+[(Sec) -20 (ond) -400 (line)] TJ
+T*
+<FEFF4E2D6587> Tj
+ET`
+
+func TestExtractPDFText_Uncompressed(t *testing.T) {
+	text, err := ExtractPDFText(buildTestPDF([]byte(testPDFContent), false))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello (PDF) World\nSecond line\n中文", text)
+}
+
+func TestExtractPDFText_FlateDecode(t *testing.T) {
+	text, err := ExtractPDFText(buildTestPDF([]byte(testPDFContent), true))
+	require.NoError(t, err)
+	assert.Equal(t, "Hello (PDF) World\nSecond line\n中文", text)
+}
+
+func TestExtractPDFText_Errors(t *testing.T) {
+	_, err := ExtractPDFText([]byte("not a pdf"))
+	assert.ErrorContains(t, err, "不是有效的PDF文件")
+
+	_, err = ExtractPDFText([]byte("%PDF-1.4\ntrailer\n<< /Encrypt 5 0 R >>\n"))
+	assert.ErrorContains(t, err, "加密")
+
+	// 只有图形操作、没有文本
+	_, err = ExtractPDFText(buildTestPDF([]byte("0 0 m 100 100 l S"), false))
+	assert.ErrorContains(t, err, "未找到可提取的文本")
+}
+
+func TestInflatePDFStream_AbandonsOversizedStream(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("A"), 1024))
+	zw.Close()
+
+	decoded, ok := inflatePDFStreamLimit(buf.Bytes(), 1024)
+	assert.True(t, ok)
+	assert.Len(t, decoded, 1024)
+
+	_, ok = inflatePDFStreamLimit(buf.Bytes(), 1023)
+	assert.False(t, ok)
+}
+
+func TestExtractPDFText_StopsAtTotalInflatedBudget(t *testing.T) {
+	origMax := config.DocumentMaxBytes
+	config.DocumentMaxBytes = 1 << 20
+	defer func() { config.DocumentMaxBytes = origMax }()
+
+	// 每个流单独都低于单流上限，合计远超总预算
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte(" "), 3<<20))
+	zw.Close()
+	bomb := buf.Bytes()
+
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	for i := 1; i <= 10; i++ {
+		fmt.Fprintf(&pdf, "%d 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", i, len(bomb))
+		pdf.Write(bomb)
+		pdf.WriteString("\nendstream\nendobj\n")
+	}
+	pdf.WriteString("11 0 obj\n<< /Length 20 >>\nstream\nBT (late) Tj ET\nendstream\nendobj\n")
+
+	var streams int
+	var total int
+	forEachPDFContentStream(pdf.Bytes(), pdfInflatedBudget(pdf.Len()), func(stream []byte) bool {
+		streams++
+		total += len(stream)
+		return true
+	})
+	assert.Equal(t, 1, streams)
+	assert.LessOrEqual(t, int64(total), pdfInflatedBudget(pdf.Len()))
+
+	_, err := ExtractPDFText(pdf.Bytes())
+	assert.ErrorContains(t, err, "未找到可提取的文本")
+}
+
+func TestExtractPDFText_StopsAtTextLimit(t *testing.T) {
+	origMax := config.DocumentMaxTextChars
+	config.DocumentMaxTextChars = 10
+	defer func() { config.DocumentMaxTextChars = origMax }()
+
+	_, err := ExtractPDFText(buildTestPDF([]byte(testPDFContent), true))
+	assert.ErrorContains(t, err, "DOCUMENT_MAX_TEXT_CHARS")
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// proxyURLContextKey 请求上下文中出口代理的键
+type proxyURLContextKey struct{}
+
+// proxyClients 按代理URL缓存的HTTP客户端（复用连接池）
+var proxyClients sync.Map // map[string]*http.Client
+
+// WithProxyURL 返回携带出口代理的上下文，DoRequest 会据此选择客户端
+func WithProxyURL(ctx context.Context, proxyURL string) context.Context {
+	if proxyURL == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, proxyURLContextKey{}, proxyURL)
+}
+
+// ProxyURLFromContext 读取上下文中的出口代理（未设置返回空）
+func ProxyURLFromContext(ctx context.Context) string {
+	proxyURL, _ := ctx.Value(proxyURLContextKey{}).(string)
+	return proxyURL
+}
+
+// clientForProxy 获取（或创建）使用指定代理的客户端
+// 基于 SharedHTTPClient 克隆 Transport 并沿用其超时，保留TLS与连接池配置
+func clientForProxy(proxyURL string) (*http.Client, error) {
+	if client, ok := proxyClients.Load(proxyURL); ok {
+		return client.(*http.Client), nil
+	}
+
+	proxy, err := parseProxyURL(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("解析代理URL失败: %v", err)
+	}
+
+	transport := SharedHTTPClient.Transport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxy)
+
+	client, _ := proxyClients.LoadOrStore(proxyURL, &http.Client{Transport: transport, Timeout: SharedHTTPClient.Timeout})
+	return client.(*http.Client), nil
+}
@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoRequest_UsesProxyFromContext(t *testing.T) {
+	var proxiedURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 经HTTP代理转发的请求使用绝对URL
+		proxiedURL = r.URL.String()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer proxy.Close()
+
+	req, err := http.NewRequest(http.MethodGet, "http://upstream.invalid/generateAssistantResponse", nil)
+	require.NoError(t, err)
+	req = req.WithContext(WithProxyURL(context.Background(), proxy.URL))
+
+	resp, err := DoRequest(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "http://upstream.invalid/generateAssistantResponse", proxiedURL)
+}
+
+func TestClientForProxy_ReusesClient(t *testing.T) {
+	first, err := clientForProxy("http://127.0.0.1:40000")
+	require.NoError(t, err)
+	second, err := clientForProxy("http://127.0.0.1:40000")
+	require.NoError(t, err)
+	assert.Same(t, first, second, "同一代理应复用客户端以复用连接池")
+
+	other, err := clientForProxy("http://127.0.0.1:40001")
+	require.NoError(t, err)
+	assert.NotSame(t, first, other)
+}
+
+func TestWithProxyURL_EmptyKeepsContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, ctx, WithProxyURL(ctx, ""))
+	assert.Empty(t, ProxyURLFromContext(ctx))
+}
+
+func TestDoRequest_RespectsContextCancellation(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err = DoRequest(req)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -142,8 +142,14 @@ func (tc *TokenCounter) countViaAnthropicAPI(ctx context.Context, req *types.Cou
 	return out.InputTokens, nil
 }
 
+// localImageTokenEstimate 图片的固定占位token数（离线无法精确计算视觉输入）
 const localImageTokenEstimate = 1500
 
+// CountAnthropicMessageTokens 本地估算单条消息的token数（cl100k_base 近似）
+func CountAnthropicMessageTokens(msg types.AnthropicRequestMessage) int {
+	return countTokensFromAnthropicMessageContent(msg.Content, "cl100k_base")
+}
+
 func countTokensFromAnthropicMessages(messages []types.AnthropicRequestMessage, encodingName string) int {
 	total := 0
 	for _, m := range messages {
@@ -154,6 +160,9 @@ func countTokensFromAnthropicMessages(messages []types.AnthropicRequestMessage,
 
 func countTokensFromAnthropicMessageContent(content any, encodingName string) int {
 	switch v := content.(type) {
+	case nil:
+		return 0
+
 	case string:
 		if strings.TrimSpace(v) == "" {
 			return 0
@@ -163,48 +172,22 @@ func countTokensFromAnthropicMessageContent(content any, encodingName string) in
 	case []any:
 		total := 0
 		for _, item := range v {
-			m, ok := item.(map[string]any)
-			if !ok {
-				continue
+			if m, ok := item.(map[string]any); ok {
+				total += countTokensFromContentBlockMap(m, encodingName)
 			}
-			t, _ := m["type"].(string)
-			switch t {
-			case "text":
-				if s, ok := m["text"].(string); ok {
-					total += CountTokensWithTiktoken(s, encodingName)
-				}
-
-			case "image":
-				// No official tokenizer offline for vision payload; use a conservative fixed estimate.
-				total += localImageTokenEstimate
-
-			case "tool_use":
-				name, _ := m["name"].(string)
-				input := m["input"]
-				inputJSON, _ := SafeMarshal(input)
-				total += CountTokensWithTiktoken("<invoke name=\""+name+"\">"+string(inputJSON)+"</invoke>", encodingName)
-
-			case "tool_result":
-				// content may be string/array/object; stringify conservatively
-				var contentStr string
-				switch c := m["content"].(type) {
-				case string:
-					contentStr = c
-				default:
-					if jb, err := SafeMarshal(c); err == nil {
-						contentStr = string(jb)
-					}
-				}
-				total += CountTokensWithTiktoken("<tool_result>"+contentStr+"</tool_result>", encodingName)
+		}
+		return total
 
-			default:
-				if jb, err := SafeMarshal(m); err == nil {
-					total += CountTokensWithTiktoken(string(jb), encodingName)
-				}
-			}
+	case []map[string]any:
+		total := 0
+		for _, m := range v {
+			total += countTokensFromContentBlockMap(m, encodingName)
 		}
 		return total
 
+	case map[string]any:
+		return countTokensFromContentBlockMap(v, encodingName)
+
 	case []types.ContentBlock:
 		total := 0
 		for _, block := range v {
@@ -222,23 +205,14 @@ func countTokensFromAnthropicMessageContent(content any, encodingName string) in
 				if block.Name != nil {
 					name = *block.Name
 				}
-				var inputJSON []byte
+				var input any
 				if block.Input != nil {
-					inputJSON, _ = SafeMarshal(*block.Input)
+					input = *block.Input
 				}
-				total += CountTokensWithTiktoken("<invoke name=\""+name+"\">"+string(inputJSON)+"</invoke>", encodingName)
+				total += countToolUseTokens(name, input, encodingName)
 
 			case "tool_result":
-				contentStr := ""
-				switch c := block.Content.(type) {
-				case string:
-					contentStr = c
-				default:
-					if jb, err := SafeMarshal(c); err == nil {
-						contentStr = string(jb)
-					}
-				}
-				total += CountTokensWithTiktoken("<tool_result>"+contentStr+"</tool_result>", encodingName)
+				total += countToolResultTokens(block.Content, encodingName)
 
 			default:
 				if jb, err := SafeMarshal(block); err == nil {
@@ -255,3 +229,48 @@ func countTokensFromAnthropicMessageContent(content any, encodingName string) in
 		return 0
 	}
 }
+
+// countTokensFromContentBlockMap 计算单个 map 形式内容块的token数
+func countTokensFromContentBlockMap(m map[string]any, encodingName string) int {
+	t, _ := m["type"].(string)
+	switch t {
+	case "text":
+		s, _ := m["text"].(string)
+		return CountTokensWithTiktoken(s, encodingName)
+
+	case "image", "image_url":
+		// No official tokenizer offline for vision payload; use a conservative fixed estimate.
+		return localImageTokenEstimate
+
+	case "thinking":
+		s, _ := m["thinking"].(string)
+		return CountTokensWithTiktoken(s, encodingName)
+
+	case "redacted_thinking":
+		return 0
+
+	case "tool_use":
+		name, _ := m["name"].(string)
+		return countToolUseTokens(name, m["input"], encodingName)
+
+	case "tool_result":
+		return countToolResultTokens(m["content"], encodingName)
+
+	default:
+		if jb, err := SafeMarshal(m); err == nil {
+			return CountTokensWithTiktoken(string(jb), encodingName)
+		}
+		return 0
+	}
+}
+
+func countToolUseTokens(name string, input any, encodingName string) int {
+	inputJSON, _ := SafeMarshal(input)
+	return CountTokensWithTiktoken("<invoke name=\""+name+"\">"+string(inputJSON)+"</invoke>", encodingName)
+}
+
+// countToolResultTokens 工具结果按内容块递归计数，避免把内嵌图片的base64数据当作文本计算
+func countToolResultTokens(content any, encodingName string) int {
+	return CountTokensWithTiktoken("<tool_result></tool_result>", encodingName) +
+		countTokensFromAnthropicMessageContent(content, encodingName)
+}
@@ -0,0 +1,221 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"kiro2api/config"
+	"kiro2api/logger"
+)
+
+// 上游录制/回放
+// UPSTREAM_REPLAY_DIR 非空时生效：UPSTREAM_RECORD=true 为录制模式，照常请求上游并把原始响应字节写入目录；
+// 否则为回放模式，直接返回目录中的录制，找不到录制时报错而不是请求上游
+// 每条录制包含 <hash>.bin（原始响应字节，如 AWS event-stream）与 <hash>.json（状态码等元数据）
+
+// replayVolatileFields 计算请求哈希时忽略的字段（每次请求随机生成，不影响上游响应）
+var replayVolatileFields = [][]string{
+	{"conversationState", "conversationId"},
+	{"conversationState", "agentContinuationId"},
+	{"id"}, // MCP JSON-RPC 请求ID
+}
+
+// ReplayRecording 一条上游响应录制的元数据
+type ReplayRecording struct {
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	StatusCode  int       `json:"status_code"`
+	ContentType string    `json:"content_type,omitempty"`
+	RecordedAt  time.Time `json:"recorded_at"`
+}
+
+// upstreamReplayEnabled 是否启用录制/回放
+func upstreamReplayEnabled() bool {
+	return config.UpstreamReplayDir != ""
+}
+
+// ReplayRequestHash 计算请求的录制键：方法 + URL 路径 + 去除随机字段后的请求体
+// 请求体为 JSON 时按规范化后的内容计算（键有序），否则使用原始字节
+func ReplayRequestHash(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + path + "\n"))
+
+	var payload map[string]any
+	if err := json.Unmarshal(body, &payload); err == nil {
+		for _, field := range replayVolatileFields {
+			deleteNestedField(payload, field)
+		}
+		if normalized, err := json.Marshal(payload); err == nil {
+			body = normalized
+		}
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))[:32]
+}
+
+// deleteNestedField 删除嵌套字段（中间层不存在时忽略）
+func deleteNestedField(payload map[string]any, path []string) {
+	for i, key := range path {
+		if i == len(path)-1 {
+			delete(payload, key)
+			return
+		}
+		next, ok := payload[key].(map[string]any)
+		if !ok {
+			return
+		}
+		payload = next
+	}
+}
+
+// doReplayableRequest 在录制/回放模式下执行请求
+func doReplayableRequest(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("读取请求体失败: %w", err)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	hash := ReplayRequestHash(req.Method, req.URL.Path, body)
+	basePath := filepath.Join(config.UpstreamReplayDir, hash)
+
+	if !config.UpstreamRecord {
+		return replayResponse(req, basePath, hash)
+	}
+
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &recordingBody{
+		ReadCloser: resp.Body,
+		basePath:   basePath,
+		meta: ReplayRecording{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			StatusCode:  resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			RecordedAt:  time.Now(),
+		},
+	}
+	return resp, nil
+}
+
+// replayResponse 从录制构造响应
+func replayResponse(req *http.Request, basePath, hash string) (*http.Response, error) {
+	metaData, err := os.ReadFile(basePath + ".json")
+	if err != nil {
+		logger.Warn("没有找到上游响应录制",
+			logger.String("hash", hash),
+			logger.String("url", req.URL.String()),
+			logger.String("dir", config.UpstreamReplayDir))
+		return nil, fmt.Errorf("回放模式下没有找到请求 %s 的录制: %w", hash, err)
+	}
+	var meta ReplayRecording
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return nil, fmt.Errorf("解析录制元数据 %s 失败: %w", hash, err)
+	}
+	body, err := os.ReadFile(basePath + ".bin")
+	if err != nil {
+		return nil, fmt.Errorf("读取录制 %s 失败: %w", hash, err)
+	}
+
+	logger.Debug("回放上游响应",
+		logger.String("hash", hash),
+		logger.Int("status_code", meta.StatusCode),
+		logger.Int("bytes", len(body)))
+
+	header := make(http.Header)
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", meta.StatusCode, http.StatusText(meta.StatusCode)),
+		StatusCode:    meta.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// recordingBody 读取响应体的同时缓存原始字节，读到末尾时写入录制
+// 未读完就关闭（如客户端断开）的响应不写入，避免留下截断的录制
+type recordingBody struct {
+	io.ReadCloser
+	basePath string
+	meta     ReplayRecording
+	buf      bytes.Buffer
+	saved    bool
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF && !b.saved {
+		b.saved = true
+		b.save()
+	}
+	return n, err
+}
+
+// save 写入录制（先写临时文件再重命名，失败只记录日志）
+func (b *recordingBody) save() {
+	metaData, err := json.MarshalIndent(b.meta, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(b.basePath+".bin", b.buf.Bytes())
+	}
+	if err == nil {
+		err = writeFileAtomic(b.basePath+".json", metaData)
+	}
+	if err != nil {
+		logger.Warn("写入上游响应录制失败",
+			logger.String("path", b.basePath),
+			logger.Err(err))
+		return
+	}
+	logger.Info("已录制上游响应",
+		logger.String("hash", filepath.Base(b.basePath)),
+		logger.String("url", b.meta.URL),
+		logger.Int("status_code", b.meta.StatusCode),
+		logger.Int("bytes", b.buf.Len()))
+}
+
+// writeFileAtomic 先写临时文件再重命名
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReplayModeDescription 返回当前录制/回放模式（用于启动日志），未启用时返回空
+func ReplayModeDescription() string {
+	if !upstreamReplayEnabled() {
+		return ""
+	}
+	if config.UpstreamRecord {
+		return "record"
+	}
+	return "replay"
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kiro2api/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func withUpstreamReplay(t *testing.T, dir string, record bool) {
+	t.Helper()
+	origDir, origRecord := config.UpstreamReplayDir, config.UpstreamRecord
+	config.UpstreamReplayDir, config.UpstreamRecord = dir, record
+	t.Cleanup(func() {
+		config.UpstreamReplayDir, config.UpstreamRecord = origDir, origRecord
+	})
+}
+
+func TestReplayRequestHash_IgnoresVolatileIDs(t *testing.T) {
+	a := ReplayRequestHash("POST", "/generateAssistantResponse",
+		[]byte(`{"conversationState":{"conversationId":"a","agentContinuationId":"x","history":[]},"profileArn":"p"}`))
+	b := ReplayRequestHash("POST", "/generateAssistantResponse",
+		[]byte(`{"profileArn":"p","conversationState":{"history":[],"conversationId":"b","agentContinuationId":"y"}}`))
+	c := ReplayRequestHash("POST", "/generateAssistantResponse",
+		[]byte(`{"conversationState":{"conversationId":"a","history":[1]},"profileArn":"p"}`))
+
+	assert.Equal(t, a, b, "随机ID与键顺序不应影响哈希")
+	assert.NotEqual(t, a, c)
+}
+
+func TestDoRequest_RecordThenReplay(t *testing.T) {
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		_, _ = w.Write([]byte("\x00\x00\x00raw-event-stream"))
+	}))
+	defer upstream.Close()
+
+	dir := t.TempDir()
+	send := func(conversationID string) (*http.Response, error) {
+		req, err := http.NewRequest("POST", upstream.URL+"/generateAssistantResponse",
+			strings.NewReader(`{"conversationState":{"conversationId":"`+conversationID+`"}}`))
+		require.NoError(t, err)
+		return DoRequest(req)
+	}
+
+	withUpstreamReplay(t, dir, true)
+	resp, err := send("first")
+	require.NoError(t, err)
+	recorded, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 1, calls)
+
+	// 回放模式不再请求上游，返回录制的原始字节
+	config.UpstreamRecord = false
+	resp, err = send("second")
+	require.NoError(t, err)
+	replayed, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/vnd.amazon.eventstream", resp.Header.Get("Content-Type"))
+	assert.Equal(t, recorded, replayed)
+	assert.Equal(t, 1, calls)
+
+	// 没有录制的请求报错，而不是请求上游
+	req, err := http.NewRequest("POST", upstream.URL+"/generateAssistantResponse", strings.NewReader(`{"other":true}`))
+	require.NoError(t, err)
+	_, err = DoRequest(req)
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}